@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"os"
@@ -37,36 +38,136 @@ type benchmarkResult struct {
 	PeakAllocMB   uint64
 	PeakSysMB     uint64
 	PeakGoroutine int
+	LatencyP50    time.Duration // Per call, remote mode only
+	LatencyP99    time.Duration
 }
 
+// progress receives the human-readable output. It is stderr when machine
+// output goes to stdout.
+var progress io.Writer = os.Stdout
+
 func main() {
 	usersFlag := flag.Int("users", 1000, "Number of users to simulate (single mode)")
 	durationFlag := flag.Duration("duration", 5*time.Minute, "Duration of benchmark run")
 	intervalFlag := flag.Duration("interval", 1*time.Second, "Interval between reports per user")
 	suiteFlag := flag.Bool("suite", false, "Run the built-in 5-case mini benchmark suite")
+	formatFlag := flag.String("format", "text", "Result format: text, json or csv")
+	outFlag := flag.String("out", "", "File to write json/csv results to (default stdout)")
+	compareFlag := flag.String("compare", "", "Baseline JSON results to compare against; exits with status 1 on a regression")
+	thresholdFlag := flag.Float64("threshold", 10, "Percent a metric may worsen against the baseline before it counts as a regression")
+	targetFlag := flag.String("target", "", "gRPC address of a running HUE to benchmark instead of the in-process engine")
+	keyFlag := flag.String("key", os.Getenv("HUE_AUTH_SECRET"), "Owner key used to provision the remote node, service and users")
+	concurrencyFlag := flag.Int("concurrency", 16, "Workers sending reports to the remote target")
+	batchRatioFlag := flag.Float64("batch-ratio", 0.5, "Share of remote calls that are BatchReportUsage instead of ReportUsage")
+	batchSizeFlag := flag.Int("batch-size", 50, "Reports per remote BatchReportUsage call")
+	tagsFlag := flag.Int("tags", 0, "Tags on each remote report")
 	flag.Parse()
 
-	if *suiteFlag {
-		runMiniSuite()
-		return
+	switch *formatFlag {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("Unknown -format %q, expected text, json or csv", *formatFlag)
+	}
+	if *formatFlag != "text" && *outFlag == "" {
+		progress = os.Stderr
 	}
 
-	scenario := benchmarkScenario{
-		Name:     "single",
-		Users:    *usersFlag,
-		Duration: *durationFlag,
-		Interval: *intervalFlag,
+	var baseline benchmarkReport
+	if *compareFlag != "" {
+		var err error
+		if baseline, err = readReport(*compareFlag); err != nil {
+			log.Fatalf("Failed to read baseline: %v", err)
+		}
 	}
 
-	result, err := runScenario(scenario, true)
+	var results []benchmarkResult
+	if *targetFlag != "" {
+		if *suiteFlag {
+			log.Fatalf("-suite runs in process and cannot be combined with -target")
+		}
+		if *keyFlag == "" {
+			log.Fatalf("An owner key is required for -target (-key or HUE_AUTH_SECRET)")
+		}
+		if *concurrencyFlag <= 0 || *batchSizeFlag <= 0 || *batchRatioFlag < 0 || *batchRatioFlag > 1 {
+			log.Fatalf("-concurrency and -batch-size must be positive and -batch-ratio between 0 and 1")
+		}
+
+		scenario := benchmarkScenario{Name: "remote", Users: *usersFlag, Duration: *durationFlag}
+		result, err := runRemoteScenario(scenario, remoteConfig{
+			Target:      *targetFlag,
+			OwnerKey:    *keyFlag,
+			Concurrency: *concurrencyFlag,
+			BatchRatio:  *batchRatioFlag,
+			BatchSize:   *batchSizeFlag,
+			Tags:        *tagsFlag,
+		})
+		if err != nil {
+			log.Fatalf("Benchmark failed: %v", err)
+		}
+		printScenarioSummary(result)
+		results = append(results, result)
+	} else if *suiteFlag {
+		results = runMiniSuite()
+	} else {
+		scenario := benchmarkScenario{
+			Name:     "single",
+			Users:    *usersFlag,
+			Duration: *durationFlag,
+			Interval: *intervalFlag,
+		}
+
+		result, err := runScenario(scenario, true)
+		if err != nil {
+			log.Fatalf("Benchmark failed: %v", err)
+		}
+		printScenarioSummary(result)
+		results = append(results, result)
+	}
+
+	report := newReport(results)
+	if *formatFlag != "text" {
+		if err := saveReport(*outFlag, *formatFlag, report); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+	}
+
+	if *compareFlag != "" && !printComparison(baseline, report, *thresholdFlag) {
+		os.Exit(1)
+	}
+}
+
+// saveReport writes the report to path, or to stdout when path is empty
+func saveReport(path, format string, report benchmarkReport) error {
+	if path == "" {
+		return writeReport(os.Stdout, format, report)
+	}
+	f, err := os.Create(path)
 	if err != nil {
-		log.Fatalf("Benchmark failed: %v", err)
+		return err
 	}
+	if err := writeReport(f, format, report); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	printScenarioSummary(result)
+// printComparison prints the regressions against the baseline and returns
+// false if there are any
+func printComparison(baseline, report benchmarkReport, threshold float64) bool {
+	regressions := compareReports(baseline, report, threshold)
+	fmt.Fprintf(progress, "\n=== Comparison with baseline (threshold %.1f%%) ===\n", threshold)
+	if len(regressions) == 0 {
+		fmt.Fprintln(progress, "No regressions.")
+		return true
+	}
+	for _, r := range regressions {
+		fmt.Fprintln(progress, "REGRESSION", r)
+	}
+	return false
 }
 
-func runMiniSuite() {
+func runMiniSuite() []benchmarkResult {
 	scenarios := []benchmarkScenario{
 		{Name: "mini-1", Users: 100, Duration: 45 * time.Second, Interval: 1 * time.Second},
 		{Name: "mini-2", Users: 1000, Duration: 45 * time.Second, Interval: 1 * time.Second},
@@ -75,15 +176,15 @@ func runMiniSuite() {
 		{Name: "mini-5", Users: 10000, Duration: 60 * time.Second, Interval: 1 * time.Second},
 	}
 
-	fmt.Println("Running 5 mini benchmarks (real simulation mode)...")
+	fmt.Fprintln(progress, "Running 5 mini benchmarks (real simulation mode)...")
 	results := make([]benchmarkResult, 0, len(scenarios))
 
 	for _, scenario := range scenarios {
-		fmt.Printf("\n=== %s | users=%d duration=%v interval=%v ===\n", scenario.Name, scenario.Users, scenario.Duration, scenario.Interval)
+		fmt.Fprintf(progress, "\n=== %s | users=%d duration=%v interval=%v ===\n", scenario.Name, scenario.Users, scenario.Duration, scenario.Interval)
 
 		result, err := runScenario(scenario, false)
 		if err != nil {
-			fmt.Printf("Scenario %s failed: %v\n", scenario.Name, err)
+			fmt.Fprintf(progress, "Scenario %s failed: %v\n", scenario.Name, err)
 			continue
 		}
 		results = append(results, result)
@@ -91,14 +192,14 @@ func runMiniSuite() {
 	}
 
 	if len(results) == 0 {
-		fmt.Println("No scenario completed successfully.")
-		return
+		fmt.Fprintln(progress, "No scenario completed successfully.")
+		return nil
 	}
 
-	fmt.Println("\n=== Mini Suite Summary ===")
-	fmt.Println("Scenario | Users | Duration | Requests | Errors | Rejected | Avg RPS | PeakAllocMB | PeakSysMB | PeakG")
+	fmt.Fprintln(progress, "\n=== Mini Suite Summary ===")
+	fmt.Fprintln(progress, "Scenario | Users | Duration | Requests | Errors | Rejected | Avg RPS | PeakAllocMB | PeakSysMB | PeakG")
 	for _, r := range results {
-		fmt.Printf("%s | %d | %v | %d | %d | %d | %.2f | %d | %d | %d\n",
+		fmt.Fprintf(progress, "%s | %d | %v | %d | %d | %d | %.2f | %d | %d | %d\n",
 			r.Scenario.Name,
 			r.Scenario.Users,
 			r.ActualTime.Truncate(time.Millisecond),
@@ -111,10 +212,11 @@ func runMiniSuite() {
 			r.PeakGoroutine,
 		)
 	}
+	return results
 }
 
 func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkResult, error) {
-	fmt.Printf("Starting benchmark with %d users for %v (interval: %v)\n", scenario.Users, scenario.Duration, scenario.Interval)
+	fmt.Fprintf(progress, "Starting benchmark with %d users for %v (interval: %v)\n", scenario.Users, scenario.Duration, scenario.Interval)
 
 	logger, err := zap.NewProduction()
 	if err != nil {
@@ -158,7 +260,7 @@ func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkRes
 		return benchmarkResult{}, fmt.Errorf("create node: %w", err)
 	}
 
-	fmt.Println("Provisioning users and packages...")
+	fmt.Fprintln(progress, "Provisioning users and packages...")
 	userIDs := make([]string, scenario.Users)
 	for i := 0; i < scenario.Users; i++ {
 		userID := uuid.New().String()
@@ -186,7 +288,7 @@ func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkRes
 			return benchmarkResult{}, fmt.Errorf("create package: %w", err)
 		}
 	}
-	fmt.Println("Provisioning complete.")
+	fmt.Fprintln(progress, "Provisioning complete.")
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -214,7 +316,7 @@ func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkRes
 	startTime := time.Now()
 	endTime := startTime.Add(scenario.Duration)
 
-	fmt.Println("Starting simulation...")
+	fmt.Fprintln(progress, "Starting simulation...")
 
 	for i := 0; i < scenario.Users; i++ {
 		wg.Add(1)
@@ -225,6 +327,7 @@ func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkRes
 
 			sessionID := uuid.New().String()
 			clientIP := fmt.Sprintf("192.168.%d.%d", (index/250)%255, index%250)
+			identity := sessionManager.IdentityKey(domain.SessionIdentitySession, sessionID, clientIP, "")
 
 			ticker := time.NewTicker(scenario.Interval)
 			defer ticker.Stop()
@@ -235,9 +338,9 @@ func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkRes
 
 				penaltyResult := penaltyHandler.CheckPenalty(uID)
 				if !penaltyResult.HasPenalty {
-					sessionResult := sessionManager.CheckSession(uID, sessionID, clientIP, 5)
+					sessionResult := sessionManager.CheckSession(uID, sessionID, identity, clientIP, 5, 0, domain.SessionReplaceOff)
 					if sessionResult.SessionLimitHit {
-						penaltyHandler.ApplyPenalty(uID, "concurrent_session_limit_exceeded")
+						penaltyHandler.ApplyPenalty(uID, "concurrent_session_limit_exceeded", domain.PenaltyPolicy{})
 					} else {
 						quotaResult, quotaErr := quotaEngine.CheckQuota(uID, upload, download)
 						if quotaErr != nil {
@@ -306,7 +409,7 @@ func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkRes
 			}
 
 			if showLiveMetrics {
-				fmt.Printf("[%.0fs] Reqs: %d (%.2f req/s) | Errs: %d | Rejected: %d | Alloc: %d MB | Sys: %d MB | G: %d\n",
+				fmt.Fprintf(progress, "[%.0fs] Reqs: %d (%.2f req/s) | Errs: %d | Rejected: %d | Alloc: %d MB | Sys: %d MB | G: %d\n",
 					elapsed, reqs, rps, errs, rejected, allocMB, sysMB, goroutines)
 			}
 		}
@@ -354,17 +457,22 @@ func runScenario(scenario benchmarkScenario, showLiveMetrics bool) (benchmarkRes
 }
 
 func printScenarioSummary(result benchmarkResult) {
-	fmt.Println("\n--- Benchmark Results ---")
-	fmt.Printf("Scenario: %s\n", result.Scenario.Name)
-	fmt.Printf("Total Users: %d\n", result.Scenario.Users)
-	fmt.Printf("Duration: %v\n", result.ActualTime.Truncate(time.Millisecond))
-	fmt.Printf("Total Requests: %d\n", result.TotalRequests)
-	fmt.Printf("Total Errors: %d\n", result.TotalErrors)
-	fmt.Printf("Total Rejected: %d\n", result.TotalRejected)
-	fmt.Printf("Average RPS: %.2f\n", result.AvgRPS)
-	fmt.Printf("Peak Alloc: %d MB\n", result.PeakAllocMB)
-	fmt.Printf("Peak Sys: %d MB\n", result.PeakSysMB)
-	fmt.Printf("Peak Goroutines: %d\n", result.PeakGoroutine)
+	fmt.Fprintln(progress, "\n--- Benchmark Results ---")
+	fmt.Fprintf(progress, "Scenario: %s\n", result.Scenario.Name)
+	fmt.Fprintf(progress, "Total Users: %d\n", result.Scenario.Users)
+	fmt.Fprintf(progress, "Duration: %v\n", result.ActualTime.Truncate(time.Millisecond))
+	fmt.Fprintf(progress, "Total Requests: %d\n", result.TotalRequests)
+	fmt.Fprintf(progress, "Total Errors: %d\n", result.TotalErrors)
+	fmt.Fprintf(progress, "Total Rejected: %d\n", result.TotalRejected)
+	fmt.Fprintf(progress, "Average RPS: %.2f\n", result.AvgRPS)
+	if result.PeakSysMB > 0 {
+		fmt.Fprintf(progress, "Peak Alloc: %d MB\n", result.PeakAllocMB)
+		fmt.Fprintf(progress, "Peak Sys: %d MB\n", result.PeakSysMB)
+		fmt.Fprintf(progress, "Peak Goroutines: %d\n", result.PeakGoroutine)
+	}
+	if result.LatencyP99 > 0 {
+		fmt.Fprintf(progress, "Call Latency p50/p99: %v / %v\n", result.LatencyP50, result.LatencyP99)
+	}
 }
 
 func cleanupDBFiles(base string) {
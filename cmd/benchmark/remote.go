@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/hiddify/hue-go/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// remoteConfig selects the server and the traffic of a remote run
+type remoteConfig struct {
+	Target      string
+	OwnerKey    string
+	Concurrency int
+	BatchRatio  float64 // Share of calls that are BatchReportUsage
+	BatchSize   int
+	Tags        int // Tags per report
+}
+
+// remoteRun is a node, service and users provisioned on a live server
+type remoteRun struct {
+	cfg   remoteConfig
+	usage pb.UsageServiceClient
+
+	nodeID     string
+	serviceID  string
+	serviceKey string
+	userIDs    []string
+}
+
+// runRemoteScenario provisions users on a running HUE and has concurrency
+// workers send reports back to back over gRPC, so serialization, auth and
+// the network are part of the measurement. Requests, errors and rejections
+// count reports; memory and goroutines are the server's to watch and are
+// left empty.
+func runRemoteScenario(scenario benchmarkScenario, cfg remoteConfig) (benchmarkResult, error) {
+	fmt.Fprintf(progress, "Starting remote benchmark against %s with %d users and %d workers for %v (batch ratio %.2f, batch size %d)\n",
+		cfg.Target, scenario.Users, cfg.Concurrency, scenario.Duration, cfg.BatchRatio, cfg.BatchSize)
+
+	conn, err := grpc.NewClient(cfg.Target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return benchmarkResult{}, fmt.Errorf("connect to %s: %w", cfg.Target, err)
+	}
+	defer conn.Close()
+
+	run := &remoteRun{cfg: cfg, usage: pb.NewUsageServiceClient(conn)}
+	ctx := context.Background()
+	fmt.Fprintln(progress, "Provisioning node, service, users and packages...")
+	if err := run.provision(ctx, pb.NewAdminServiceClient(conn), pb.NewNodeServiceClient(conn), scenario.Users); err != nil {
+		return benchmarkResult{}, err
+	}
+	fmt.Fprintln(progress, "Provisioning complete.")
+
+	var totalRequests, totalErrors, totalRejected int64
+	latencies := make([][]time.Duration, cfg.Concurrency)
+	svc := metadata.AppendToOutgoingContext(ctx, "hue-api-key", run.serviceKey)
+
+	fmt.Fprintln(progress, "Starting simulation...")
+	startTime := time.Now()
+	endTime := startTime.Add(scenario.Duration)
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := mrand.New(mrand.NewSource(time.Now().UnixNano() + int64(w)))
+
+			for time.Now().Before(endTime) {
+				n := 1
+				if rng.Float64() < cfg.BatchRatio {
+					n = cfg.BatchSize
+				}
+				reports := make([]*pb.UsageReport, n)
+				for i := range reports {
+					reports[i] = run.report(rng)
+				}
+
+				start := time.Now()
+				results, err := run.send(svc, reports)
+				latencies[w] = append(latencies[w], time.Since(start))
+
+				atomic.AddInt64(&totalRequests, int64(n))
+				if err != nil {
+					atomic.AddInt64(&totalErrors, int64(n))
+					continue
+				}
+				for _, res := range results {
+					if !res.Accepted {
+						atomic.AddInt64(&totalRejected, 1)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	actualDuration := time.Since(startTime)
+	var all []time.Duration
+	for _, l := range latencies {
+		all = append(all, l...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+
+	return benchmarkResult{
+		Scenario:      scenario,
+		ActualTime:    actualDuration,
+		TotalRequests: totalRequests,
+		TotalErrors:   totalErrors,
+		TotalRejected: totalRejected,
+		AvgRPS:        float64(totalRequests) / actualDuration.Seconds(),
+		LatencyP50:    percentile(all, 50),
+		LatencyP99:    percentile(all, 99),
+	}, nil
+}
+
+// provision registers a node and a service, authenticates the node like an
+// agent does and creates the users with an unlimited package each
+func (r *remoteRun) provision(ctx context.Context, admin pb.AdminServiceClient, node pb.NodeServiceClient, users int) error {
+	owner := metadata.AppendToOutgoingContext(ctx, "hue-api-key", r.cfg.OwnerKey)
+	suffix := randomHex(4)
+	nodeKey := randomHex(16)
+	r.serviceKey = randomHex(16)
+
+	n, err := admin.CreateNode(owner, &pb.CreateNodeRequest{Name: "benchmark-" + suffix, SecretKey: nodeKey})
+	if err != nil {
+		return fmt.Errorf("create node: %w", err)
+	}
+	service, err := admin.CreateService(owner, &pb.CreateServiceRequest{
+		NodeId:    n.Id,
+		SecretKey: r.serviceKey,
+		Name:      "benchmark-" + suffix + "-vless",
+		Protocol:  "vless",
+	})
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	r.serviceID = service.Id
+
+	auth, err := node.Authenticate(metadata.AppendToOutgoingContext(ctx, "hue-api-key", r.serviceKey), &pb.AuthenticateRequest{SecretKey: nodeKey})
+	if err != nil {
+		return fmt.Errorf("authenticate: %w", err)
+	}
+	if !auth.Success {
+		return fmt.Errorf("authenticate: %s", auth.Error)
+	}
+	r.nodeID = auth.NodeId
+
+	// Provision with the workers too; thousands of users one RPC at a time
+	// take longer than the run
+	r.userIDs = make([]string, users)
+	next := int64(-1)
+	errs := make(chan error, r.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for w := 0; w < r.cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= users {
+					return
+				}
+				id, err := provisionUser(owner, admin, fmt.Sprintf("benchmark-%s-%d", suffix, i))
+				if err != nil {
+					errs <- err
+					return
+				}
+				r.userIDs[i] = id
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// provisionUser creates a user with an active package that never runs out
+func provisionUser(owner context.Context, admin pb.AdminServiceClient, username string) (string, error) {
+	user, err := admin.CreateUser(owner, &pb.CreateUserRequest{Username: username})
+	if err != nil {
+		return "", fmt.Errorf("create user: %w", err)
+	}
+	pkg, err := admin.CreatePackage(owner, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1 << 50})
+	if err != nil {
+		return "", fmt.Errorf("create package: %w", err)
+	}
+	if _, err := admin.UpdateUser(owner, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		return "", fmt.Errorf("attach package: %w", err)
+	}
+	return user.Id, nil
+}
+
+// report builds a report for a random user. Each user keeps one session, so
+// session limits do not reject reports.
+func (r *remoteRun) report(rng *mrand.Rand) *pb.UsageReport {
+	i := rng.Intn(len(r.userIDs))
+	report := &pb.UsageReport{
+		UserId:    r.userIDs[i],
+		NodeId:    r.nodeID,
+		ServiceId: r.serviceID,
+		SessionId: fmt.Sprintf("bench-%d", i),
+		ClientIp:  fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+		Upload:    rng.Int63n(1024 * 1024),
+		Download:  rng.Int63n(5 * 1024 * 1024),
+		Timestamp: time.Now().Unix(),
+	}
+	for t := 0; t < r.cfg.Tags; t++ {
+		report.Tags = append(report.Tags, fmt.Sprintf("tag-%d", t))
+	}
+	return report
+}
+
+// send reports with ReportUsage, or BatchReportUsage for more than one
+func (r *remoteRun) send(ctx context.Context, reports []*pb.UsageReport) ([]*pb.UsageReportResult, error) {
+	if len(reports) == 1 {
+		resp, err := r.usage.ReportUsage(ctx, &pb.ReportUsageRequest{Report: reports[0]})
+		if err != nil {
+			return nil, err
+		}
+		return []*pb.UsageReportResult{resp.Result}, nil
+	}
+	resp, err := r.usage.BatchReportUsage(ctx, &pb.BatchReportUsageRequest{Reports: reports})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
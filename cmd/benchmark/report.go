@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// benchmarkReport is the machine-readable result of a run, also read back as
+// the baseline of -compare
+type benchmarkReport struct {
+	GeneratedAt time.Time      `json:"generated_at"`
+	GoVersion   string         `json:"go_version"`
+	NumCPU      int            `json:"num_cpu"`
+	Results     []resultRecord `json:"results"`
+}
+
+// resultRecord is one scenario's result with flat, unit-suffixed fields
+type resultRecord struct {
+	Scenario        string  `json:"scenario"`
+	Users           int     `json:"users"`
+	IntervalSeconds float64 `json:"interval_seconds"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Requests        int64   `json:"requests"`
+	Errors          int64   `json:"errors"`
+	Rejected        int64   `json:"rejected"`
+	RPS             float64 `json:"rps"`
+	PeakAllocMB     uint64  `json:"peak_alloc_mb"`
+	PeakSysMB       uint64  `json:"peak_sys_mb"`
+	PeakGoroutines  int     `json:"peak_goroutines"`
+	LatencyP50Ms    float64 `json:"latency_p50_ms,omitempty"`
+	LatencyP99Ms    float64 `json:"latency_p99_ms,omitempty"`
+}
+
+// resultCSVHeader is the column order of CSV output
+var resultCSVHeader = []string{
+	"scenario", "users", "interval_seconds", "duration_seconds", "requests", "errors", "rejected",
+	"rps", "peak_alloc_mb", "peak_sys_mb", "peak_goroutines", "latency_p50_ms", "latency_p99_ms",
+}
+
+func newReport(results []benchmarkResult) benchmarkReport {
+	report := benchmarkReport{
+		GeneratedAt: time.Now().UTC(),
+		GoVersion:   runtime.Version(),
+		NumCPU:      runtime.NumCPU(),
+		Results:     make([]resultRecord, 0, len(results)),
+	}
+	for _, r := range results {
+		report.Results = append(report.Results, resultRecord{
+			Scenario:        r.Scenario.Name,
+			Users:           r.Scenario.Users,
+			IntervalSeconds: r.Scenario.Interval.Seconds(),
+			DurationSeconds: r.ActualTime.Seconds(),
+			Requests:        r.TotalRequests,
+			Errors:          r.TotalErrors,
+			Rejected:        r.TotalRejected,
+			RPS:             r.AvgRPS,
+			PeakAllocMB:     r.PeakAllocMB,
+			PeakSysMB:       r.PeakSysMB,
+			PeakGoroutines:  r.PeakGoroutine,
+			LatencyP50Ms:    durationMs(r.LatencyP50),
+			LatencyP99Ms:    durationMs(r.LatencyP99),
+		})
+	}
+	return report
+}
+
+// durationMs returns d in fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeReport writes the report as JSON or CSV
+func writeReport(out io.Writer, format string, report benchmarkReport) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "csv":
+		w := csv.NewWriter(out)
+		if err := w.Write(resultCSVHeader); err != nil {
+			return err
+		}
+		for _, r := range report.Results {
+			if err := w.Write([]string{
+				r.Scenario,
+				strconv.Itoa(r.Users),
+				strconv.FormatFloat(r.IntervalSeconds, 'f', -1, 64),
+				strconv.FormatFloat(r.DurationSeconds, 'f', 3, 64),
+				strconv.FormatInt(r.Requests, 10),
+				strconv.FormatInt(r.Errors, 10),
+				strconv.FormatInt(r.Rejected, 10),
+				strconv.FormatFloat(r.RPS, 'f', 2, 64),
+				strconv.FormatUint(r.PeakAllocMB, 10),
+				strconv.FormatUint(r.PeakSysMB, 10),
+				strconv.Itoa(r.PeakGoroutines),
+				strconv.FormatFloat(r.LatencyP50Ms, 'f', 3, 64),
+				strconv.FormatFloat(r.LatencyP99Ms, 'f', 3, 64),
+			}); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return fmt.Errorf("unknown format %q, expected text, json or csv", format)
+}
+
+// readReport reads a report written with -format json
+func readReport(path string) (benchmarkReport, error) {
+	var report benchmarkReport
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&report); err != nil {
+		return report, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return report, nil
+}
+
+// regression is a metric that got worse than the baseline by more than the
+// threshold
+type regression struct {
+	Scenario string
+	Metric   string
+	Baseline float64
+	Current  float64
+	Change   float64 // Percent, positive is worse
+}
+
+func (r regression) String() string {
+	if r.Baseline == 0 {
+		return fmt.Sprintf("%s: %s %.2f -> %.2f (new)", r.Scenario, r.Metric, r.Baseline, r.Current)
+	}
+	return fmt.Sprintf("%s: %s %.2f -> %.2f (%+.1f%% worse)", r.Scenario, r.Metric, r.Baseline, r.Current, r.Change)
+}
+
+// compareReports returns the metrics of current that are worse than in
+// baseline by more than threshold percent. Throughput regresses when it
+// drops; error rate, memory, goroutines and latency regress when they grow.
+// Scenarios missing from the baseline are not compared.
+func compareReports(baseline, current benchmarkReport, threshold float64) []regression {
+	base := make(map[string]resultRecord, len(baseline.Results))
+	for _, r := range baseline.Results {
+		base[r.Scenario] = r
+	}
+
+	var regressions []regression
+	for _, cur := range current.Results {
+		old, ok := base[cur.Scenario]
+		if !ok {
+			continue
+		}
+		check := func(metric string, before, after float64, lowerIsWorse bool) {
+			if before <= 0 {
+				return
+			}
+			change := (after - before) / before * 100
+			if lowerIsWorse {
+				change = -change
+			}
+			if change > threshold {
+				regressions = append(regressions, regression{Scenario: cur.Scenario, Metric: metric, Baseline: before, Current: after, Change: change})
+			}
+		}
+		check("rps", old.RPS, cur.RPS, true)
+		if before, after := errorRate(old), errorRate(cur); before == 0 && after > 0 {
+			// Errors where there were none have no ratio to the baseline
+			regressions = append(regressions, regression{Scenario: cur.Scenario, Metric: "error_rate", Current: after})
+		} else {
+			check("error_rate", before, after, false)
+		}
+		check("peak_alloc_mb", float64(old.PeakAllocMB), float64(cur.PeakAllocMB), false)
+		check("peak_goroutines", float64(old.PeakGoroutines), float64(cur.PeakGoroutines), false)
+		check("latency_p99_ms", old.LatencyP99Ms, cur.LatencyP99Ms, false)
+	}
+	return regressions
+}
+
+// errorRate returns the percentage of requests that failed
+func errorRate(r resultRecord) float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Requests) * 100
+}
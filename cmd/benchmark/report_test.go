@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestCompareReportsFlagsRegressionsBeyondThreshold(t *testing.T) {
+	baseline := benchmarkReport{Results: []resultRecord{
+		{Scenario: "a", Requests: 1000, RPS: 100, PeakAllocMB: 100, PeakGoroutines: 50},
+		{Scenario: "b", Requests: 1000, Errors: 10, RPS: 100, PeakAllocMB: 100, PeakGoroutines: 50},
+	}}
+	current := benchmarkReport{Results: []resultRecord{
+		{Scenario: "a", Requests: 1000, Errors: 1, RPS: 95, PeakAllocMB: 120, PeakGoroutines: 50},
+		{Scenario: "b", Requests: 1000, Errors: 10, RPS: 80, PeakAllocMB: 105, PeakGoroutines: 50},
+		{Scenario: "new", Requests: 1, RPS: 1},
+	}}
+
+	got := map[string]bool{}
+	for _, r := range compareReports(baseline, current, 10) {
+		got[r.Scenario+"/"+r.Metric] = true
+	}
+	want := []string{"a/error_rate", "a/peak_alloc_mb", "b/rps"}
+	if len(got) != len(want) {
+		t.Fatalf("expected regressions %v, got %v", want, got)
+	}
+	for _, w := range want {
+		if !got[w] {
+			t.Fatalf("expected regression %s, got %v", w, got)
+		}
+	}
+}
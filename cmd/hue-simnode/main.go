@@ -0,0 +1,524 @@
+// Command hue-simnode simulates a node agent: it registers a node and a
+// service, authenticates, reports usage for a population of simulated users
+// and reacts to disconnect decisions the way a real agent would.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	pb "github.com/hiddify/hue-go/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+type simConfig struct {
+	Users         int
+	Interval      time.Duration
+	Duration      time.Duration
+	Churn         float64
+	Bad           float64
+	Traffic       int64
+	MaxConcurrent int
+	Batch         int
+	Stream        bool
+}
+
+func main() {
+	addrFlag := flag.String("addr", "127.0.0.1:50051", "HUE gRPC address")
+	keyFlag := flag.String("key", os.Getenv("HUE_AUTH_SECRET"), "Owner key used to register the node, service and users")
+	usersFlag := flag.Int("users", 50, "Number of simulated users")
+	intervalFlag := flag.Duration("interval", 5*time.Second, "Interval between report rounds")
+	durationFlag := flag.Duration("duration", 0, "How long to run (0 runs until interrupted)")
+	churnFlag := flag.Float64("churn", 0.05, "Chance per round that a session ends and its user reconnects")
+	badFlag := flag.Float64("bad", 0, "Fraction of users that open extra sessions from new IPs every round")
+	trafficFlag := flag.Int64("traffic", 10<<30, "Package size in bytes for each simulated user")
+	maxConcurrentFlag := flag.Int("max-concurrent", 2, "Concurrent session limit on each simulated package")
+	batchFlag := flag.Int("batch", 100, "Reports per BatchReportUsage call")
+	streamFlag := flag.Bool("stream", false, "Send reports over one StreamUsage stream per round instead of batches")
+	seedFlag := flag.Int64("seed", time.Now().UnixNano(), "Random seed")
+	flag.Parse()
+
+	if *keyFlag == "" {
+		log.Fatalf("An owner key is required (-key or HUE_AUTH_SECRET)")
+	}
+
+	cfg := simConfig{
+		Users:         *usersFlag,
+		Interval:      *intervalFlag,
+		Duration:      *durationFlag,
+		Churn:         *churnFlag,
+		Bad:           *badFlag,
+		Traffic:       *trafficFlag,
+		MaxConcurrent: *maxConcurrentFlag,
+		Batch:         *batchFlag,
+		Stream:        *streamFlag,
+	}
+	if cfg.Users <= 0 || cfg.Batch <= 0 || cfg.Interval <= 0 {
+		log.Fatalf("-users, -batch and -interval must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	conn, err := grpc.NewClient(*addrFlag,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		log.Fatalf("Failed to connect to %s: %v", *addrFlag, err)
+	}
+	defer conn.Close()
+
+	sim := newSimNode(conn, *keyFlag, cfg, mrand.New(mrand.NewSource(*seedFlag)))
+	if err := sim.register(ctx); err != nil {
+		log.Fatalf("Registration failed: %v", err)
+	}
+	fmt.Printf("Registered node %s (service %s)\n", sim.nodeID, sim.serviceID)
+
+	if err := sim.provision(ctx); err != nil {
+		log.Fatalf("Provisioning failed: %v", err)
+	}
+	fmt.Printf("Provisioned %d users (%d misbehaving)\n", len(sim.users), sim.badCount())
+
+	sim.run(ctx)
+	sim.printSummary()
+}
+
+// simUser is a provisioned user and whether it misbehaves
+type simUser struct {
+	id  string
+	bad bool
+}
+
+// simSession is one connected client on the simulated node
+type simSession struct {
+	id     string
+	userID string
+	ip     string
+}
+
+type simStats struct {
+	Rounds       int
+	Reports      int
+	Accepted     int
+	Errors       int
+	Disconnects  int
+	Commands     int
+	Reconnects   int
+	ShedSessions int
+	Upload       int64
+	Download     int64
+	Rejected     map[string]int
+}
+
+type simNode struct {
+	cfg      simConfig
+	rng      *mrand.Rand
+	ownerKey string
+
+	admin pb.AdminServiceClient
+	usage pb.UsageServiceClient
+	node  pb.NodeServiceClient
+
+	nodeID     string
+	serviceID  string
+	serviceKey string
+
+	users    []simUser
+	sessions map[string]*simSession
+	seq      int
+	stats    simStats
+}
+
+func newSimNode(conn *grpc.ClientConn, ownerKey string, cfg simConfig, rng *mrand.Rand) *simNode {
+	return &simNode{
+		cfg:      cfg,
+		rng:      rng,
+		ownerKey: ownerKey,
+		admin:    pb.NewAdminServiceClient(conn),
+		usage:    pb.NewUsageServiceClient(conn),
+		node:     pb.NewNodeServiceClient(conn),
+		sessions: make(map[string]*simSession),
+		stats:    simStats{Rejected: make(map[string]int)},
+	}
+}
+
+func withKey(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "hue-api-key", key)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// register creates the node and its service, then authenticates with the
+// node's secret like an agent does on startup
+func (s *simNode) register(ctx context.Context) error {
+	owner := withKey(ctx, s.ownerKey)
+	suffix := randomHex(4)
+	nodeKey := randomHex(16)
+	s.serviceKey = randomHex(16)
+
+	node, err := s.admin.CreateNode(owner, &pb.CreateNodeRequest{
+		Name:      "simnode-" + suffix,
+		SecretKey: nodeKey,
+	})
+	if err != nil {
+		return fmt.Errorf("create node: %w", err)
+	}
+
+	service, err := s.admin.CreateService(owner, &pb.CreateServiceRequest{
+		NodeId:    node.Id,
+		SecretKey: s.serviceKey,
+		Name:      "simnode-" + suffix + "-vless",
+		Protocol:  "vless",
+	})
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	s.serviceID = service.Id
+
+	auth, err := s.node.Authenticate(withKey(ctx, s.serviceKey), &pb.AuthenticateRequest{SecretKey: nodeKey})
+	if err != nil {
+		return fmt.Errorf("authenticate: %w", err)
+	}
+	if !auth.Success {
+		return fmt.Errorf("authenticate: %s", auth.Error)
+	}
+	s.nodeID = auth.NodeId
+
+	return nil
+}
+
+// provision creates the simulated users with one package each and connects
+// every user with a first session
+func (s *simNode) provision(ctx context.Context) error {
+	owner := withKey(ctx, s.ownerKey)
+	badUsers := int(float64(s.cfg.Users) * s.cfg.Bad)
+
+	for i := 0; i < s.cfg.Users; i++ {
+		user, err := s.admin.CreateUser(owner, &pb.CreateUserRequest{
+			Username: fmt.Sprintf("%s-user-%d", s.nodeID[:8], i),
+		})
+		if err != nil {
+			return fmt.Errorf("create user: %w", err)
+		}
+
+		pkg, err := s.admin.CreatePackage(owner, &pb.CreatePackageRequest{
+			UserId:        user.Id,
+			TotalTraffic:  s.cfg.Traffic,
+			MaxConcurrent: int32(s.cfg.MaxConcurrent),
+		})
+		if err != nil {
+			return fmt.Errorf("create package: %w", err)
+		}
+
+		if _, err := s.admin.UpdateUser(owner, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+			return fmt.Errorf("attach package: %w", err)
+		}
+
+		s.users = append(s.users, simUser{id: user.Id, bad: i < badUsers})
+		s.connect(user.Id)
+	}
+
+	return nil
+}
+
+func (s *simNode) badCount() int {
+	n := 0
+	for _, u := range s.users {
+		if u.bad {
+			n++
+		}
+	}
+	return n
+}
+
+// connect opens a new session for a user from a fresh client address
+func (s *simNode) connect(userID string) {
+	s.seq++
+	id := fmt.Sprintf("sim-%d", s.seq)
+	s.sessions[id] = &simSession{
+		id:     id,
+		userID: userID,
+		ip:     fmt.Sprintf("10.%d.%d.%d", s.seq>>16&0xff, s.seq>>8&0xff, s.seq&0xff),
+	}
+}
+
+func (s *simNode) userConnected(userID string) bool {
+	for _, sess := range s.sessions {
+		if sess.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *simNode) run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.round(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamReports sends the round's reports over one StreamUsage stream and
+// tallies the results. It returns false when the context ended.
+func (s *simNode) streamReports(ctx context.Context, reports []*pb.UsageReport) bool {
+	stream, err := s.usage.StreamUsage(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		s.stats.Errors++
+		log.Printf("open usage stream failed: %v", err)
+		return true
+	}
+
+	sendErr := make(chan error, 1)
+	go func() {
+		for _, report := range reports {
+			if err := stream.Send(report); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+
+	for _, report := range reports {
+		res, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return false
+			}
+			s.stats.Errors++
+			log.Printf("stream report failed: %v", err)
+			return true
+		}
+		s.tally(report, res)
+	}
+	if err := <-sendErr; err != nil && ctx.Err() == nil {
+		s.stats.Errors++
+		log.Printf("stream report failed: %v", err)
+	}
+	return ctx.Err() == nil
+}
+
+// tally counts one report's result and drops the session when HUE asks
+func (s *simNode) tally(report *pb.UsageReport, res *pb.UsageReportResult) {
+	s.stats.Reports++
+	if res.Accepted {
+		s.stats.Accepted++
+		s.stats.Upload += report.Upload
+		s.stats.Download += report.Download
+	} else {
+		code := res.ReasonCode
+		if code == "" {
+			code = "unknown"
+		}
+		s.stats.Rejected[code]++
+	}
+	if res.ShouldDisconnect {
+		s.disconnect(report.SessionId)
+	}
+}
+
+// round runs one reporting cycle: churn, misbehavior, reports, disconnect
+// commands and a heartbeat
+func (s *simNode) round(ctx context.Context) {
+	s.stats.Rounds++
+	s.churn()
+
+	for _, u := range s.users {
+		if u.bad && s.userConnected(u.id) {
+			s.connect(u.id)
+		}
+	}
+
+	var upload, download int64
+	reports := make([]*pb.UsageReport, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		up := s.rng.Int63n(256 << 10)
+		down := s.rng.Int63n(4 << 20)
+		upload += up
+		download += down
+		reports = append(reports, &pb.UsageReport{
+			UserId:    sess.userID,
+			NodeId:    s.nodeID,
+			ServiceId: s.serviceID,
+			SessionId: sess.id,
+			ClientIp:  sess.ip,
+			Upload:    up,
+			Download:  down,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+
+	svc := withKey(ctx, s.serviceKey)
+	if s.cfg.Stream {
+		if !s.streamReports(svc, reports) {
+			return
+		}
+	} else {
+		for start := 0; start < len(reports); start += s.cfg.Batch {
+			end := start + s.cfg.Batch
+			if end > len(reports) {
+				end = len(reports)
+			}
+			batch := reports[start:end]
+
+			resp, err := s.usage.BatchReportUsage(svc, &pb.BatchReportUsageRequest{Reports: batch})
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				s.stats.Errors++
+				log.Printf("batch report failed: %v", err)
+				continue
+			}
+
+			for i, res := range resp.Results {
+				if i >= len(batch) {
+					break
+				}
+				s.tally(batch[i], res)
+			}
+		}
+	}
+
+	cmds, err := s.usage.GetDisconnectCommands(svc, &pb.GetDisconnectCommandsRequest{NodeId: s.nodeID})
+	if err == nil {
+		ids := make([]string, 0, len(cmds.Commands))
+		for _, cmd := range cmds.Commands {
+			s.stats.Commands++
+			s.applyCommand(cmd)
+			ids = append(ids, cmd.Id)
+		}
+		if len(ids) > 0 {
+			if _, err := s.usage.AckDisconnects(svc, &pb.AckDisconnectsRequest{NodeId: s.nodeID, Ids: ids}); err != nil && ctx.Err() == nil {
+				s.stats.Errors++
+				log.Printf("ack disconnect commands failed: %v", err)
+			}
+		}
+	} else if ctx.Err() == nil {
+		s.stats.Errors++
+		log.Printf("get disconnect commands failed: %v", err)
+	}
+
+	hb, err := s.node.Heartbeat(svc, &pb.HeartbeatRequest{
+		NodeId:            s.nodeID,
+		CurrentUpload:     upload,
+		CurrentDownload:   download,
+		ActiveConnections: int64(len(s.sessions)),
+		BandwidthBps:      int64(float64(upload+download) * 8 / s.cfg.Interval.Seconds()),
+		AgentVersion:      "hue-simnode",
+	})
+	if err == nil {
+		s.stats.ShedSessions += int(hb.SessionsShed)
+	} else if ctx.Err() == nil {
+		s.stats.Errors++
+		log.Printf("heartbeat failed: %v", err)
+	}
+
+	fmt.Printf("round %d | sessions=%d reports=%d accepted=%d rejected=%d disconnects=%d errors=%d\n",
+		s.stats.Rounds, len(s.sessions), s.stats.Reports, s.stats.Accepted,
+		s.stats.Reports-s.stats.Accepted, s.stats.Disconnects, s.stats.Errors)
+}
+
+// churn ends a share of the sessions and reconnects a share of the users
+// that have no session left
+func (s *simNode) churn() {
+	if s.cfg.Churn <= 0 {
+		return
+	}
+
+	for id, sess := range s.sessions {
+		if s.rng.Float64() < s.cfg.Churn {
+			delete(s.sessions, id)
+			s.connect(sess.userID)
+		}
+	}
+
+	for _, u := range s.users {
+		if !s.userConnected(u.id) && s.rng.Float64() < s.cfg.Churn {
+			s.stats.Reconnects++
+			s.connect(u.id)
+		}
+	}
+}
+
+func (s *simNode) disconnect(sessionID string) {
+	if _, ok := s.sessions[sessionID]; ok {
+		delete(s.sessions, sessionID)
+		s.stats.Disconnects++
+	}
+}
+
+// applyCommand drops the session a command names, or every session of the
+// user when it names none
+func (s *simNode) applyCommand(cmd *pb.DisconnectCommand) {
+	if cmd.SessionId != "" {
+		s.disconnect(cmd.SessionId)
+		return
+	}
+	for id, sess := range s.sessions {
+		if sess.userID == cmd.UserId {
+			s.disconnect(id)
+		}
+	}
+}
+
+func (s *simNode) printSummary() {
+	fmt.Println("\n=== Simulated Node Summary ===")
+	fmt.Printf("Node:             %s\n", s.nodeID)
+	fmt.Printf("Rounds:           %d\n", s.stats.Rounds)
+	fmt.Printf("Reports:          %d\n", s.stats.Reports)
+	fmt.Printf("Accepted:         %d\n", s.stats.Accepted)
+	fmt.Printf("Billed traffic:   %d up / %d down\n", s.stats.Upload, s.stats.Download)
+	fmt.Printf("Disconnects:      %d\n", s.stats.Disconnects)
+	fmt.Printf("Commands:         %d\n", s.stats.Commands)
+	fmt.Printf("Reconnects:       %d\n", s.stats.Reconnects)
+	fmt.Printf("Shed by HUE:      %d\n", s.stats.ShedSessions)
+	fmt.Printf("Errors:           %d\n", s.stats.Errors)
+
+	if len(s.stats.Rejected) == 0 {
+		return
+	}
+	codes := make([]string, 0, len(s.stats.Rejected))
+	for code := range s.stats.Rejected {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Println("Rejected by reason:")
+	for _, code := range codes {
+		fmt.Printf("  %-34s %d\n", code, s.stats.Rejected[code])
+	}
+}
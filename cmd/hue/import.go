@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hiddify/hue-go/internal/importer"
+	"github.com/spf13/cobra"
+)
+
+func newImportCommand() *cobra.Command {
+	var from, managerID string
+	var dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "import --from marzban|hiddify <file>",
+		Short: "Import users, plans and remaining traffic from a Marzban database or Hiddify panel backup",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			source, err := importer.ParseSource(from)
+			if err != nil {
+				return err
+			}
+
+			var in io.Reader
+			if source == importer.SourceHiddify {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return fmt.Errorf("failed to open %s: %w", args[0], err)
+				}
+				defer f.Close()
+				in = f
+			}
+			records, err := importer.Read(source, args[0], in)
+			if err != nil {
+				return err
+			}
+
+			userDB, err := openStateDB()
+			if err != nil {
+				return err
+			}
+			defer userDB.Close()
+
+			outcomes, err := importer.Import(userDB, records, importer.Options{ManagerID: managerID, DryRun: dryRun})
+			if perr := printImportOutcomes(cmd.OutOrStdout(), outcomes, dryRun); perr != nil {
+				return perr
+			}
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "panel the file comes from: marzban (db.sqlite3) or hiddify (JSON backup)")
+	cmd.Flags().StringVar(&managerID, "manager", "", "assign the imported users to this manager")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "show what would be imported without writing it")
+	_ = cmd.MarkFlagRequired("from")
+
+	return cmd
+}
+
+func printImportOutcomes(out io.Writer, outcomes []importer.Outcome, dryRun bool) error {
+	prefix := ""
+	if dryRun {
+		prefix = "would "
+	}
+	imported := 0
+	for _, o := range outcomes {
+		if o.Imported {
+			imported++
+		}
+		if _, err := fmt.Fprintln(out, prefix+o.String()); err != nil {
+			return err
+		}
+	}
+	summary := "%d imported, %d skipped\n"
+	if dryRun {
+		summary = "%d to import, %d to skip\n"
+	}
+	_, err := fmt.Fprintf(out, summary, imported, len(outcomes)-imported)
+	return err
+}
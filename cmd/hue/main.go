@@ -2,22 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	stdhttp "net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/hiddify/hue-go/internal/api/grpc"
 	httpapi "github.com/hiddify/hue-go/internal/api/http"
+	"github.com/hiddify/hue-go/internal/auth"
 	"github.com/hiddify/hue-go/internal/config"
+	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/engine"
 	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/jobs"
+	"github.com/hiddify/hue-go/internal/metrics"
 	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/internal/tracing"
 	"github.com/soheilhy/cmux"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -38,6 +47,11 @@ func newRootCommand() *cobra.Command {
 
 	rootCmd.AddCommand(newServeCommand())
 	rootCmd.AddCommand(newVersionCommand())
+	rootCmd.AddCommand(newExportCommand())
+	rootCmd.AddCommand(newApplyCommand())
+	rootCmd.AddCommand(newMigrateCommand())
+	rootCmd.AddCommand(newImportCommand())
+	rootCmd.AddCommand(newReplayCommand())
 
 	return rootCmd
 }
@@ -63,26 +77,24 @@ func newVersionCommand() *cobra.Command {
 }
 
 func runServe() error {
-	// Initialize logger
-	logger, err := zap.NewProduction()
-	if err != nil {
-		return fmt.Errorf("failed to initialize logger: %w", err)
-	}
-	defer logger.Sync()
-
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	// Debug: print loaded secret
-	logger.Info("Config loaded", zap.String("auth_secret", cfg.AuthSecret))
-
-	// Set log level
-	if cfg.LogLevel == "debug" {
-		logger = logger.With(zap.String("level", "debug"))
+	// Initialize logger; the level changes on SIGHUP
+	level, err := zap.ParseAtomicLevel(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid HUE_LOG_LEVEL: %w", err)
 	}
+	logConfig := zap.NewProductionConfig()
+	logConfig.Level = level
+	logger, err := logConfig.Build()
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+	defer logger.Sync()
 
 	logger.Info("Starting HUE - Hiddify Usage Engine",
 		zap.String("version", "1.0.0"),
@@ -108,19 +120,46 @@ func runServe() error {
 	}
 	defer historyDB.Close()
 
+	tuning := sqlite.Tuning{
+		BusyTimeout: cfg.DBBusyTimeout,
+		Synchronous: cfg.DBSynchronous,
+		CacheSize:   cfg.DBCacheSize,
+		MmapSize:    cfg.DBMmapSize,
+		ReadConns:   cfg.DBReadConns,
+	}
+	for _, db := range []*sqlite.DB{userDB.DB, activeDB.DB, historyDB.DB} {
+		if err := db.Tune(tuning); err != nil {
+			return fmt.Errorf("failed to tune database %s: %w", db.Path(), err)
+		}
+	}
+
 	// Run migrations
 	if err := userDB.Migrate(); err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
-	if cfg.AuthSecret != "" {
-		if err := userDB.UpsertOwnerAuthKey(cfg.AuthSecret); err != nil {
-			return fmt.Errorf("failed to initialize owner auth key: %w", err)
-		}
+	if err := ensureOwnerCredential(cfg.AuthSecret, userDB, os.Stdout); err != nil {
+		return err
 	}
 
-	// Initialize in-memory cache
-	memCache := cache.NewMemoryCache()
+	// Initialize the hot state cache
+	var stateCache cache.Cache
+	switch cfg.CacheBackend {
+	case "memory", "":
+		memoryCache := cache.NewMemoryCache()
+		memoryCache.SetLimits(cfg.CacheTTL, cfg.CacheMaxEntries)
+		stateCache = memoryCache
+	case "redis":
+		redisCache, err := cache.NewRedisCache(cfg.RedisURL, cfg.RedisPrefix, logger)
+		if err != nil {
+			return fmt.Errorf("failed to initialize redis cache: %w", err)
+		}
+		defer redisCache.Close()
+		stateCache = redisCache
+	default:
+		return fmt.Errorf("invalid cache backend %q, expected memory or redis", cfg.CacheBackend)
+	}
+	statsCache := cache.NewStatsCache(cfg.StatsCacheTTL)
 
 	// Initialize event store
 	eventStore, err := eventstore.New(cfg.EventStoreType, historyDB)
@@ -129,34 +168,246 @@ func runServe() error {
 	}
 
 	// Initialize core engine
-	quotaEngine := engine.NewQuotaEngine(userDB, activeDB, memCache, logger)
-	sessionManager := engine.NewSessionManager(memCache, cfg.ConcurrentWindow, logger)
-	penaltyHandler := engine.NewPenaltyHandler(memCache, cfg.PenaltyDuration, logger)
+	quotaEngine := engine.NewQuotaEngine(userDB, activeDB, stateCache, logger)
+	quotaEngine.SetRequireReportSource(cfg.RequireReportSource)
+	enforcementMode := domain.EnforcementMode(cfg.ManagerEnforcementMode)
+	if !enforcementMode.IsValid() {
+		return fmt.Errorf("invalid HUE_MANAGER_ENFORCEMENT_MODE %q, expected soft, default or hard", cfg.ManagerEnforcementMode)
+	}
+	quotaEngine.SetManagerEnforcementMode(enforcementMode)
+	quotaEngine.SetNegativeCacheTTL(cfg.NegativeCacheTTL)
+	quotaEngine.SetReservationTTL(cfg.ReservationTTL)
+	quotaEngine.SetWriteBehind(cfg.UsageWriteBehind)
+	if cfg.CacheWarmup {
+		start := time.Now()
+		warmed, err := quotaEngine.WarmCache(cfg.CacheWarmupLimit)
+		if err != nil {
+			return fmt.Errorf("failed to warm up cache: %w", err)
+		}
+		logger.Info("cache warmed up", zap.Int("users", warmed), zap.Duration("took", time.Since(start)))
+	}
+	sessionManager := engine.NewSessionManager(stateCache, cfg.ConcurrentWindow, logger)
+	sessionManager.SetRoamingPolicy(cfg.RoamingWindow, domain.RoamingAction(cfg.RoamingAction))
+	identityGroups := make(map[string]domain.SessionIdentity)
+	for group, identity := range cfg.SessionIdentityGroupMap() {
+		identityGroups[group] = domain.SessionIdentity(identity)
+	}
+	sessionManager.SetIdentityPolicy(domain.SessionIdentity(cfg.SessionIdentity), identityGroups)
+	sessionManager.SetReplacePolicy(domain.SessionReplace(cfg.SessionReplace), cfg.SessionReplaceAfter)
+	sessionManager.SetSpeedPolicy(cfg.SpeedStaleAfter, domain.SpeedRule{
+		ThresholdBps: cfg.SpeedAlertBps,
+		Sustain:      cfg.SpeedAlertDuration,
+	})
+	penaltyHandler := engine.NewPenaltyHandler(stateCache, cfg.PenaltyDuration, logger)
+	penaltySteps, err := cfg.PenaltyStepDurations()
+	if err != nil {
+		return err
+	}
+	penaltyHandler.SetEscalation(penaltySteps, cfg.PenaltyWindow)
 	geoHandler, err := engine.NewGeoHandler(cfg.MaxMindDBPath)
 	if err != nil {
-		logger.Warn("GeoIP handler not initialized, geo features disabled", zap.Error(err))
+		logger.Warn("GeoIP handler on standby until a database is loaded through the admin API", zap.Error(err))
+		geoHandler = engine.NewStandbyGeoHandler()
+	}
+	if cfg.MaxMindASNDBPath != "" {
+		if err := geoHandler.LoadASN(cfg.MaxMindASNDBPath); err != nil {
+			logger.Warn("ISP lookups disabled", zap.Error(err))
+		}
 	}
 
+	usageEngine := engine.NewEngine(quotaEngine, sessionManager, penaltyHandler, geoHandler, eventStore, stateCache, userDB, logger)
+	usageEngine.SetNodeLoadThresholds(domain.NodeLoadThresholds{
+		MaxCPUPercent:   cfg.NodeMaxCPUPercent,
+		MaxConnections:  cfg.NodeMaxConnections,
+		MaxBandwidthBps: cfg.NodeMaxBandwidth,
+	})
+	usageEngine.SetNodeHeartbeatTimeout(cfg.NodeHeartbeatTimeout)
+	eventHub := eventstore.NewReceiverHub()
+	usageEngine.SetReceiverHub(eventHub)
+	usageEngine.SetDisconnectAckTimeout(cfg.DisconnectAckTimeout)
+	usageEngine.SetDisconnectBatchSize(cfg.DisconnectBatchSize)
+	hueMetrics := metrics.New()
+	usageEngine.SetMetrics(hueMetrics)
+	activeDB.SetFlushObserver(func(d time.Duration) { hueMetrics.FlushDuration.Observe(d.Seconds()) })
+	if memoryCache, ok := stateCache.(*cache.MemoryCache); ok {
+		memoryCache.SetEvictionObserver(func(reason cache.EvictReason) { hueMetrics.CacheEvictions.Inc(string(reason)) })
+	}
+	hueMetrics.NewGaugeFunc("hue_active_sessions", "Sessions seen within the concurrent window.", func() float64 {
+		return float64(sessionManager.TotalActiveSessions())
+	})
+	hueMetrics.NewGaugeFunc("hue_usage_buffer_depth", "Usage reports waiting to be flushed to the database.", func() float64 {
+		return float64(activeDB.BufferDepth())
+	})
+	if err := usageEngine.RestoreNodeDraining(); err != nil {
+		return fmt.Errorf("failed to restore node draining state: %w", err)
+	}
+
+	unknownUserAction := domain.UnknownUserAction(cfg.UnknownUserAction)
+	if !unknownUserAction.IsValid() {
+		return fmt.Errorf("invalid unknown user action %q, expected reject, queue or provision", cfg.UnknownUserAction)
+	}
+	var provisioner engine.Provisioner
+	if unknownUserAction == domain.UnknownUserActionProvision {
+		if cfg.UnknownUserHookURL == "" {
+			return fmt.Errorf("unknown user action provision needs HUE_UNKNOWN_USER_HOOK_URL")
+		}
+		provisioner = engine.NewWebhookProvisioner(cfg.UnknownUserHookURL, 5*time.Second)
+	}
+	usageEngine.SetUnknownUserPolicy(unknownUserAction, provisioner)
+
+	deviceLimitAction := domain.DeviceLimitAction(cfg.DeviceLimitAction)
+	if !deviceLimitAction.IsValid() {
+		return fmt.Errorf("invalid device limit action %q, expected reject or penalize", cfg.DeviceLimitAction)
+	}
+	usageEngine.SetDeviceLimitAction(deviceLimitAction)
+	usageEngine.SetUnknownUserLimits(cfg.UnknownUserQueueMax, cfg.UnknownUserRetryAfter)
+	usageEngine.SetBackfillAfter(cfg.BackfillAfter)
+	usageEngine.SetReportDedupWindow(cfg.ReportDedupWindow)
+
+	tagRules := make([]domain.TagRule, 0, len(cfg.TagRules))
+	for _, entry := range cfg.TagRules {
+		rule, err := domain.ParseTagRule(entry)
+		if err != nil {
+			return err
+		}
+		tagRules = append(tagRules, rule)
+	}
+	var tagRuleLocation *time.Location
+	if cfg.TagRuleTimezone != "" {
+		if tagRuleLocation, err = time.LoadLocation(cfg.TagRuleTimezone); err != nil {
+			return fmt.Errorf("invalid tag rule timezone: %w", err)
+		}
+	}
+	usageEngine.SetTagRules(tagRules, tagRuleLocation)
+	usageEngine.SetUsageHistory(historyDB)
+
 	// Create context with cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start buffered write system
-	flushTicker := time.NewTicker(cfg.DBFlushInterval)
-	defer flushTicker.Stop()
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-flushTicker.C:
-				if err := activeDB.Flush(); err != nil {
-					logger.Error("Failed to flush active database", zap.Error(err))
-				}
-			}
+	// Background jobs
+	scheduler := jobs.NewScheduler(logger)
+	if err := scheduler.Register("usage_flush", cfg.DBFlushInterval, func(context.Context) error {
+		_, err := quotaEngine.FlushUsage()
+		return errors.Join(err, activeDB.Flush(), historyDB.Flush())
+	}); err != nil {
+		return err
+	}
+	if err := scheduler.Register("session_cleanup", time.Minute, func(context.Context) error {
+		usageEngine.Cleanup()
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := scheduler.Register("quota_reservation_expiry", time.Minute, func(context.Context) error {
+		return quotaEngine.ExpireReservations()
+	}); err != nil {
+		return err
+	}
+	if unknownUserAction == domain.UnknownUserActionQueue {
+		if err := scheduler.Register("unknown_user_replay", time.Minute, func(context.Context) error {
+			_, _, err := usageEngine.ReplayPendingReports(cfg.UnknownUserQueueTTL)
+			return err
+		}); err != nil {
+			return err
 		}
-	}()
+	}
+	if err := scheduler.Register("report_dedup_prune", time.Minute, func(context.Context) error {
+		_, err := usageEngine.PruneReportResults(time.Now())
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := scheduler.Register("package_expiry", time.Minute, func(context.Context) error {
+		_, err := usageEngine.ExpirePackages(time.Now())
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := scheduler.Register("node_down", time.Minute, func(context.Context) error {
+		_, err := usageEngine.DetectDownNodes(time.Now())
+		return err
+	}); err != nil {
+		return err
+	}
+	usageEngine.SetNodeResetHistory(historyDB)
+	if err := scheduler.Register("node_reset", time.Minute, func(context.Context) error {
+		_, err := usageEngine.ResetDueNodes(time.Now())
+		return err
+	}); err != nil {
+		return err
+	}
+	biller := engine.NewBiller(userDB, activeDB, domain.BillingRates{
+		NodeGroups: cfg.BillingNodeGroupMap(),
+		Rates:      cfg.BillingRateMap(),
+		Currency:   cfg.BillingCurrency,
+	}, logger)
+	usageEngine.SetRetention(historyDB, cfg.UsageDataRetention, cfg.HistDataRetention)
+	if err := scheduler.Register("usage_retention", time.Hour, func(context.Context) error {
+		_, err := usageEngine.PurgeUsageReports(time.Now())
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := scheduler.Register("history_retention", time.Hour, func(context.Context) error {
+		_, err := usageEngine.PurgeHistory(time.Now())
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := scheduler.Register("usage_rollup", time.Minute, func(context.Context) error {
+		_, err := historyDB.RollupUsage()
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := scheduler.Register("billing", time.Hour, func(context.Context) error {
+		return biller.Run(time.Now())
+	}); err != nil {
+		return err
+	}
+	digester := engine.NewDigester(userDB, activeDB, historyDB, engine.NewWebhookNotifier(10*time.Second), logger)
+	if err := scheduler.Register("manager_digest", time.Hour, func(ctx context.Context) error {
+		return digester.Run(ctx, time.Now())
+	}); err != nil {
+		return err
+	}
+	var panelSync *engine.PanelSync
+	if cfg.PanelWebhookURL != "" {
+		if cfg.PanelWebhookSecret == "" {
+			return fmt.Errorf("HUE_PANEL_WEBHOOK_URL is set but HUE_PANEL_WEBHOOK_SECRET is empty; panel callbacks must be signed")
+		}
+		panelSync = engine.NewPanelSync(userDB, cfg.PanelWebhookURL, cfg.PanelWebhookSecret, 10*time.Second, logger)
+		usageEngine.SetPanelSync(panelSync)
+		if err := scheduler.Register("panel_sync", 10*time.Second, func(ctx context.Context) error {
+			_, err := panelSync.Deliver(ctx)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if len(cfg.EventWebhookURLs) > 0 && cfg.EventWebhookSecret == "" {
+		return fmt.Errorf("HUE_EVENT_WEBHOOK_URLS is set but HUE_EVENT_WEBHOOK_SECRET is empty; event webhooks must be signed")
+	}
+	if cfg.EventWebhookSecret != "" {
+		types := make([]domain.EventType, 0, len(cfg.EventWebhookTypes))
+		for _, t := range cfg.EventWebhookTypes {
+			types = append(types, domain.EventType(strings.ToUpper(t)))
+		}
+		eventWebhooks := engine.NewEventWebhooks(engine.EventWebhookOptions{
+			URLs:        cfg.EventWebhookURLs,
+			Secret:      cfg.EventWebhookSecret,
+			Types:       types,
+			MaxAttempts: cfg.EventWebhookMaxAttempts,
+			Backoff:     cfg.EventWebhookBackoff,
+			Timeout:     10 * time.Second,
+		}, userDB, historyDB, logger)
+		eventWebhooks.Start()
+		defer eventWebhooks.Stop()
+		usageEngine.SetEventWebhooks(eventWebhooks)
+	}
+	scheduler.Start(ctx)
+	defer scheduler.Stop()
 
 	// Initialize gRPC server
 	grpcServer := grpc.NewServer(
@@ -169,64 +420,176 @@ func runServe() error {
 		cfg.AuthSecret,
 	)
 	grpcServer.SetUserDB(userDB)
+	grpcServer.SetEngine(usageEngine)
+	grpcServer.SetStatsCache(statsCache)
 
-	// Start shared listener and multiplex protocols
-	lis, err := net.Listen("tcp", ":"+cfg.Port)
+	// Access tokens for people, in place of sharing the owner key
+	if cfg.JWTMaxTTL <= 0 {
+		return fmt.Errorf("invalid HUE_JWT_MAX_TTL %s: must be positive", cfg.JWTMaxTTL)
+	}
+	tokens, err := auth.NewTokenIssuer(cfg.JWTSecret, cfg.JWTMaxTTL)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port: %w", err)
+		return fmt.Errorf("failed to initialize token issuer: %w", err)
+	}
+	if cfg.JWTSecret == "" {
+		logger.Warn("HUE_JWT_SECRET is not set; access tokens stop working when HUE restarts")
+	}
+	grpcServer.SetTokenIssuer(tokens)
+	if cfg.OTelEndpoint != "" {
+		tracer := tracing.New(tracing.Options{
+			Endpoint:    cfg.OTelEndpoint,
+			ServiceName: cfg.OTelServiceName,
+			SampleRatio: cfg.OTelSampleRatio,
+		}, logger)
+		tracer.Start()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tracer.Shutdown(shutdownCtx); err != nil {
+				logger.Warn("failed to flush traces", zap.Error(err))
+			}
+		}()
+		grpcServer.SetTracer(tracer)
 	}
 
-	m := cmux.New(lis)
-	grpcLis := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
-	httpLis := m.Match(cmux.HTTP1Fast())
+	// Transport-level authentication: node IP allowlist and optional TLS
+	if cfg.TLSSelfSigned {
+		if err := ensureSelfSignedCerts(cfg, logger); err != nil {
+			return err
+		}
+	}
+	authenticator, err := auth.NewAuthenticator(cfg.AuthSecret, cfg.TLSCertPath, cfg.TLSKeyPath, cfg.AllowedNodeIPs)
+	if err != nil {
+		return fmt.Errorf("failed to initialize authenticator: %w", err)
+	}
+	if cfg.TLSClientCA != "" {
+		if err := authenticator.SetClientCA(cfg.TLSClientCA); err != nil {
+			return fmt.Errorf("invalid HUE_TLS_CLIENT_CA: %w", err)
+		}
+		grpcServer.SetNodeCertRequired(true)
+	}
+	httpTLS, err := restTLSConfig(cfg, authenticator)
+	if err != nil {
+		return err
+	}
 
-	go func() {
-		logger.Info("gRPC server starting", zap.String("port", cfg.Port))
-		if err := grpcServer.Serve(grpcLis); err != nil && !errors.Is(err, net.ErrClosed) {
-			logger.Error("gRPC server error", zap.Error(err))
+	// Start the gRPC listener, shared with the REST API unless it has its own
+	if cfg.TLSSinglePort && cfg.HTTPAddr() != "" {
+		return fmt.Errorf("HUE_TLS_SINGLE_PORT serves the REST API on the gRPC port; unset HUE_HTTP_PORT and HUE_HTTP_LISTEN")
+	}
+	lis, err := listen(cfg.GRPCAddr())
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", cfg.GRPCAddr(), err)
+	}
+	var httpLis net.Listener
+	if addr := cfg.HTTPAddr(); addr != "" {
+		if httpLis, err = listen(addr); err != nil {
+			_ = lis.Close()
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
 		}
-	}()
+	}
 
 	// Initialize HTTP server
 	httpRouter := httpapi.NewServer(
 		userDB,
 		activeDB,
+		historyDB,
 		quotaEngine,
+		usageEngine,
+		sessionManager,
+		penaltyHandler,
+		geoHandler,
+		statsCache,
+		scheduler,
+		biller,
+		digester,
+		panelSync,
+		eventHub,
+		eventStore,
+		hueMetrics.Registry,
 		logger,
 		cfg.AuthSecret,
+		tokens,
 	)
 
+	if err := httpRouter.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid HUE_TRUSTED_PROXIES: %w", err)
+	}
+
 	httpServer := &stdhttp.Server{
 		Handler: httpRouter,
 	}
+	if restAddr := cfg.HTTPAddr(); isUnixAddr(restAddr) || restAddr == "" && isUnixAddr(cfg.GRPCAddr()) {
+		httpServer.Handler = localPeer(httpRouter)
+	}
 
-	go func() {
-		logger.Info("HTTP server starting", zap.String("port", cfg.Port))
-		if err := httpServer.Serve(httpLis); err != nil && err != stdhttp.ErrServerClosed {
-			logger.Error("HTTP server error", zap.Error(err))
+	var socketServer *stdhttp.Server
+	if cfg.HTTPSocket != "" {
+		socketServer, err = serveUnixSocket(cfg.HTTPSocket, httpRouter, logger)
+		if err != nil {
+			return err
 		}
-	}()
+	}
 
-	go func() {
-		if err := m.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
-			logger.Error("cmux serve error", zap.Error(err))
+	if cfg.TLSSinglePort {
+		if !authenticator.HasTLS() {
+			return fmt.Errorf("HUE_TLS_SINGLE_PORT needs HUE_TLS_CERT and HUE_TLS_KEY")
 		}
-	}()
+		serveTLSSinglePort(lis, httpServer, grpcServer, authenticator, logger)
+	} else if httpLis != nil {
+		httpServer.TLSConfig = httpTLS
+		serveGRPC(lis, grpcServer, authenticator, cfg, logger)
+		serveHTTP(httpLis, httpServer, logger)
+	} else {
+		serveMultiplexed(lis, httpServer, grpcServer, authenticator, cfg, logger)
+	}
+
+	// Reload on SIGHUP until asked to shut down
+	reloader := &reloader{
+		cfg:           cfg,
+		level:         level,
+		scheduler:     scheduler,
+		penalty:       penaltyHandler,
+		sessions:      sessionManager,
+		authenticator: authenticator,
+		quota:         quotaEngine,
+		logger:        logger,
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+wait:
+	for {
+		select {
+		case <-hup:
+			reloader.reload()
+		case <-quit:
+			break wait
+		}
+	}
 
 	logger.Info("Shutting down HUE...")
 
 	// Final flush before shutdown
+	if _, err := quotaEngine.FlushUsage(); err != nil {
+		logger.Error("Failed to flush usage on shutdown", zap.Error(err))
+	}
 	if err := activeDB.Flush(); err != nil {
 		logger.Error("Failed to flush on shutdown", zap.Error(err))
 	}
+	if err := historyDB.Flush(); err != nil {
+		logger.Error("Failed to flush usage history on shutdown", zap.Error(err))
+	}
 
-	// Stop servers
-	grpcServer.GracefulStop()
+	// Stop servers. On a single TLS port gRPC calls run inside the HTTPS
+	// server, whose shutdown drains them; grpc-go cannot drain those itself.
+	if !cfg.TLSSinglePort {
+		grpcServer.GracefulStop()
+	}
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
@@ -234,6 +597,14 @@ func runServe() error {
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		logger.Error("HTTP server shutdown error", zap.Error(err))
 	}
+	if cfg.TLSSinglePort {
+		grpcServer.Stop()
+	}
+	if socketServer != nil {
+		if err := socketServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("HTTP socket shutdown error", zap.Error(err))
+		}
+	}
 
 	if err := lis.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 		logger.Error("listener close error", zap.Error(err))
@@ -247,3 +618,240 @@ func runServe() error {
 	logger.Info("HUE shutdown complete")
 	return nil
 }
+
+// serveMultiplexed splits the shared port by protocol: gRPC (or every TLS
+// connection when TLS is on, since gRPC terminates it) and plain HTTP/1
+func serveMultiplexed(lis net.Listener, httpServer *stdhttp.Server, grpcServer *grpc.Server, authenticator *auth.Authenticator, cfg *config.Config, logger *zap.Logger) {
+	m := cmux.New(lis)
+	var grpcLis net.Listener
+	if authenticator.HasTLS() {
+		// gRPC terminates TLS itself, so route every TLS handshake to it
+		grpcLis = m.Match(cmux.TLS())
+	} else {
+		grpcLis = m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+	}
+	httpLis := m.Match(cmux.HTTP1Fast())
+
+	serveGRPC(grpcLis, grpcServer, authenticator, cfg, logger)
+	serveHTTP(httpLis, httpServer, logger)
+
+	go func() {
+		if err := m.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("cmux serve error", zap.Error(err))
+		}
+	}()
+}
+
+// serveGRPC serves gRPC on lis in the background
+func serveGRPC(lis net.Listener, grpcServer *grpc.Server, authenticator *auth.Authenticator, cfg *config.Config, logger *zap.Logger) {
+	go func() {
+		logger.Info("gRPC server starting",
+			zap.String("addr", cfg.GRPCAddr()),
+			zap.Bool("tls", authenticator.HasTLS()),
+			zap.Bool("client_certs", authenticator.RequiresClientCert()),
+			zap.Int("allowed_node_ips", len(cfg.AllowedNodeIPs)),
+		)
+		if err := grpcServer.Serve(lis, authenticator.GRPCServerOptions()...); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("gRPC server error", zap.Error(err))
+		}
+	}()
+}
+
+// serveHTTP serves the REST API on lis in the background, over TLS when the
+// server has a TLS config
+func serveHTTP(lis net.Listener, httpServer *stdhttp.Server, logger *zap.Logger) {
+	go func() {
+		logger.Info("HTTP server starting", zap.String("addr", lis.Addr().String()), zap.Bool("tls", httpServer.TLSConfig != nil))
+		var err error
+		if httpServer.TLSConfig != nil {
+			err = httpServer.ServeTLS(lis, "", "")
+		} else {
+			err = httpServer.Serve(lis)
+		}
+		if err != nil && err != stdhttp.ErrServerClosed {
+			logger.Error("HTTP server error", zap.Error(err))
+		}
+	}()
+}
+
+// serveTLSSinglePort terminates TLS on the shared port and negotiates h2 or
+// http/1.1 through ALPN. HTTP/2 requests with a gRPC content type go to the
+// gRPC server, everything else to the REST API, so a deployment can expose
+// one HTTPS port for both node agents and the panel.
+func serveTLSSinglePort(lis net.Listener, httpServer *stdhttp.Server, grpcServer *grpc.Server, authenticator *auth.Authenticator, logger *zap.Logger) {
+	grpcHandler := grpcServer.Handler(authenticator.GRPCInterceptors()...)
+	restHandler := httpServer.Handler
+	httpServer.Handler = stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		if grpc.IsGRPCRequest(r) {
+			grpcHandler.ServeHTTP(w, r)
+			return
+		}
+		restHandler.ServeHTTP(w, r)
+	})
+	httpServer.TLSConfig = authenticator.GetTLSConfig().Clone()
+	httpServer.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+
+	go func() {
+		logger.Info("gRPC and HTTPS server starting on one TLS port", zap.String("addr", lis.Addr().String()))
+		if err := httpServer.ServeTLS(lis, "", ""); err != nil && err != stdhttp.ErrServerClosed {
+			logger.Error("TLS server error", zap.Error(err))
+		}
+	}()
+}
+
+// restTLSConfig returns the TLS config of the REST API's own listener: its
+// own certificate, else the gRPC one, else nil for plain HTTP. A unix socket
+// listener stays plain.
+func restTLSConfig(cfg *config.Config, authenticator *auth.Authenticator) (*tls.Config, error) {
+	if cfg.HTTPTLSCertPath != "" || cfg.HTTPTLSKeyPath != "" {
+		if cfg.HTTPTLSCertPath == "" || cfg.HTTPTLSKeyPath == "" {
+			return nil, fmt.Errorf("HUE_HTTP_TLS_CERT and HUE_HTTP_TLS_KEY must be set together")
+		}
+		if cfg.HTTPAddr() == "" {
+			return nil, fmt.Errorf("HUE_HTTP_TLS_CERT is for the REST API's own listener; set HUE_HTTP_PORT or HUE_HTTP_LISTEN, or use HUE_TLS_SINGLE_PORT")
+		}
+	}
+	if cfg.HTTPAddr() == "" || isUnixAddr(cfg.HTTPAddr()) {
+		return nil, nil
+	}
+
+	var tlsConfig *tls.Config
+	switch {
+	case cfg.HTTPTLSCertPath != "":
+		loaded, err := auth.LoadTLSConfig(cfg.HTTPTLSCertPath, cfg.HTTPTLSKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load HTTP TLS config: %w", err)
+		}
+		tlsConfig = loaded
+	case authenticator.HasTLS():
+		tlsConfig = authenticator.GetTLSConfig().Clone()
+	default:
+		return nil, nil
+	}
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	return tlsConfig, nil
+}
+
+// ensureSelfSignedCerts generates the configured certificates whose files do
+// not exist yet, logging each new one's fingerprint for clients to pin
+func ensureSelfSignedCerts(cfg *config.Config, logger *zap.Logger) error {
+	hosts := cfg.TLSSelfSignedHosts
+	if hostname, err := os.Hostname(); err == nil && !slices.Contains(hosts, hostname) {
+		hosts = append(slices.Clip(hosts), hostname)
+	}
+
+	configured := false
+	for _, pair := range [][2]string{{cfg.TLSCertPath, cfg.TLSKeyPath}, {cfg.HTTPTLSCertPath, cfg.HTTPTLSKeyPath}} {
+		if pair[0] == "" || pair[1] == "" {
+			continue
+		}
+		configured = true
+		fingerprint, err := auth.EnsureSelfSignedCert(pair[0], pair[1], hosts)
+		if err != nil {
+			return fmt.Errorf("failed to generate a self-signed certificate: %w", err)
+		}
+		if fingerprint != "" {
+			logger.Warn("generated a self-signed TLS certificate; replace it with a trusted one or pin its fingerprint",
+				zap.String("cert", pair[0]),
+				zap.Strings("hosts", hosts),
+				zap.String("sha256", fingerprint),
+			)
+		}
+	}
+	if !configured {
+		return fmt.Errorf("HUE_TLS_SELF_SIGNED needs HUE_TLS_CERT and HUE_TLS_KEY, or HUE_HTTP_TLS_CERT and HUE_HTTP_TLS_KEY, to know where to write the certificate")
+	}
+	return nil
+}
+
+// ensureOwnerCredential makes sure an owner key exists before any listener is
+// opened. A configured auth_secret always wins; otherwise the first run
+// generates a key, prints it once to out and stores only its hash.
+func ensureOwnerCredential(secret string, userDB *sqlite.UserDB, out io.Writer) error {
+	if secret != "" {
+		if err := userDB.UpsertOwnerAuthKey(secret); err != nil {
+			return fmt.Errorf("failed to initialize owner auth key: %w", err)
+		}
+		return nil
+	}
+
+	rawKey, err := userDB.BootstrapOwnerAuthKey()
+	if err != nil {
+		return fmt.Errorf("failed to bootstrap owner auth key: %w", err)
+	}
+	if rawKey != "" {
+		fmt.Fprintf(out, "Generated owner API key (shown only once, store it now):\n\n    %s\n\n", rawKey)
+		return nil
+	}
+
+	ok, err := userDB.HasOwnerAuthKey()
+	if err != nil {
+		return fmt.Errorf("failed to check owner auth key: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("owner auth key is revoked or expired; set HUE_AUTH_SECRET to issue a new one")
+	}
+	return nil
+}
+
+// serveUnixSocket serves the REST API on a unix socket for a reverse proxy on
+// the same host, next to its TCP listener
+func serveUnixSocket(path string, handler stdhttp.Handler, logger *zap.Logger) (*stdhttp.Server, error) {
+	lis, err := listenUnix(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on HTTP socket: %w", err)
+	}
+
+	server := &stdhttp.Server{Handler: localPeer(handler)}
+	go func() {
+		logger.Info("HTTP server starting on unix socket", zap.String("path", path))
+		if err := server.Serve(lis); err != nil && err != stdhttp.ErrServerClosed {
+			logger.Error("HTTP socket server error", zap.Error(err))
+		}
+	}()
+	return server, nil
+}
+
+// listen opens addr, a host:port or unix:/path
+func listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return listenUnix(path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// isUnixAddr reports whether addr names a unix socket
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
+}
+
+// listenUnix opens a unix socket only its owner and group may connect to
+func listenUnix(path string) (net.Listener, error) {
+	// A socket left behind by an unclean exit would block the bind; anything
+	// else at the path is left alone
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return lis, nil
+}
+
+// localPeer serves requests from a unix socket. Socket peers have no
+// address, so requests are treated as coming from 127.0.0.1 and their
+// forwarding headers count when loopback is a trusted proxy.
+func localPeer(handler stdhttp.Handler) stdhttp.Handler {
+	return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+		r.RemoteAddr = "127.0.0.1:0"
+		handler.ServeHTTP(w, r)
+	})
+}
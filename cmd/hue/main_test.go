@@ -1,9 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/auth"
+	"github.com/hiddify/hue-go/internal/config"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/engine"
+	"github.com/hiddify/hue-go/internal/jobs"
+	"github.com/hiddify/hue-go/internal/storage/cache"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 func TestCmdHueBuilds(t *testing.T) {
@@ -18,3 +35,179 @@ func TestCmdHueBuilds(t *testing.T) {
 		t.Fatalf("go build ./cmd/hue failed on %s: %v\noutput:\n%s", runtime.GOOS, err, string(out))
 	}
 }
+
+func TestEnsureOwnerCredentialBootstrapsOnce(t *testing.T) {
+	userDB, err := sqlite.NewUserDB("sqlite://" + filepath.Join(t.TempDir(), "hue.db"))
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = userDB.Close() })
+	if err := userDB.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := ensureOwnerCredential("", userDB, &out); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	fields := strings.Fields(out.String())
+	if len(fields) == 0 {
+		t.Fatalf("expected generated key in output")
+	}
+	rawKey := fields[len(fields)-1]
+
+	ok, err := userDB.ValidateOwnerAuthKey(rawKey)
+	if err != nil || !ok {
+		t.Fatalf("expected generated key to validate, ok=%v err=%v", ok, err)
+	}
+
+	out.Reset()
+	if err := ensureOwnerCredential("", userDB, &out); err != nil {
+		t.Fatalf("second start: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("expected key to be printed only once, got %q", out.String())
+	}
+
+	if _, err := userDB.Exec(`UPDATE owner_auth_key SET revoked = 1`); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if err := ensureOwnerCredential("", userDB, &out); err == nil {
+		t.Fatalf("expected refusal to start with a revoked owner key")
+	}
+	if err := ensureOwnerCredential("configured-secret", userDB, &out); err != nil {
+		t.Fatalf("configured secret: %v", err)
+	}
+}
+
+func TestExportAndApplyCommands(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HUE_DB_URL", "sqlite://"+filepath.Join(dir, "hue.db"))
+
+	statePath := filepath.Join(dir, "state.yaml")
+	doc := "version: 1\nnodes:\n  - id: node-1\n    name: edge\n    secret_key: node-secret\n"
+	if err := os.WriteFile(statePath, []byte(doc), 0o600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+
+	var out bytes.Buffer
+	apply := newRootCommand()
+	apply.SetOut(&out)
+	apply.SetArgs([]string{"apply", statePath})
+	if err := apply.Execute(); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if !strings.Contains(out.String(), "create node node-1") {
+		t.Fatalf("unexpected apply output: %q", out.String())
+	}
+
+	out.Reset()
+	export := newRootCommand()
+	export.SetOut(&out)
+	export.SetArgs([]string{"export"})
+	if err := export.Execute(); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	if !strings.Contains(out.String(), "id: node-1") || strings.Contains(out.String(), "node-secret") {
+		t.Fatalf("unexpected export output: %q", out.String())
+	}
+}
+
+func TestReloaderAppliesReloadableSettings(t *testing.T) {
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	logger := zap.NewNop()
+	memCache := cache.NewMemoryCache()
+	scheduler := jobs.NewScheduler(logger)
+	if err := scheduler.Register("usage_flush", cfg.DBFlushInterval, func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	authenticator, err := auth.NewAuthenticator("", "", "", nil)
+	if err != nil {
+		t.Fatalf("new authenticator: %v", err)
+	}
+	r := &reloader{
+		cfg:           cfg,
+		level:         zap.NewAtomicLevelAt(zapcore.InfoLevel),
+		scheduler:     scheduler,
+		penalty:       engine.NewPenaltyHandler(memCache, cfg.PenaltyDuration, logger),
+		sessions:      engine.NewSessionManager(memCache, cfg.ConcurrentWindow, logger),
+		authenticator: authenticator,
+		quota:         engine.NewQuotaEngine(nil, nil, memCache, logger),
+		logger:        logger,
+	}
+
+	next := *cfg
+	next.LogLevel = "debug"
+	next.DBFlushInterval = 30 * time.Second
+	next.ConcurrentWindow = 2 * time.Minute
+	next.AllowedNodeIPs = []string{"10.0.0.0/8"}
+	next.ManagerEnforcementMode = "soft"
+	next.Port = "60051"
+	if err := r.apply(&next); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if r.level.Level() != zapcore.DebugLevel || r.sessions.Window() != 2*time.Minute ||
+		r.quota.ManagerEnforcementMode() != domain.EnforcementModeSoft || authenticator.IsIPAllowed("192.168.1.1") {
+		t.Fatal("expected the reloadable settings to be applied")
+	}
+	if status := scheduler.Status(); status[0].Interval != "30s" {
+		t.Fatalf("expected the flush to be rescheduled, got %s", status[0].Interval)
+	}
+	if r.cfg.Port != "50051" {
+		t.Fatalf("expected the port change to wait for a restart, got %s", r.cfg.Port)
+	}
+
+	bad := next
+	bad.ConcurrentWindow = time.Minute
+	bad.ManagerEnforcementMode = "lenient"
+	if err := r.apply(&bad); err == nil {
+		t.Fatal("expected an invalid enforcement mode to be rejected")
+	}
+	if r.sessions.Window() != 2*time.Minute {
+		t.Fatal("expected a rejected reload to change nothing")
+	}
+
+	bad = next
+	bad.PenaltyDuration = -time.Minute
+	if err := r.apply(&bad); err == nil {
+		t.Fatal("expected a negative penalty duration to be rejected")
+	}
+
+	// A flush job that cannot be rescheduled leaves the node IPs alone
+	r.scheduler = jobs.NewScheduler(logger)
+	bad = next
+	bad.AllowedNodeIPs = []string{"192.168.0.0/16"}
+	if err := r.apply(&bad); err == nil {
+		t.Fatal("expected a missing flush job to fail the reload")
+	}
+	if authenticator.IsIPAllowed("192.168.1.1") {
+		t.Fatal("expected a failed reload to keep the node IPs")
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hue.sock")
+	stale, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	// Leave the socket file behind as an unclean exit would
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	lis, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced: %v", err)
+	}
+	defer lis.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0o660 {
+		t.Fatalf("expected socket mode 0660, got %v", info.Mode().Perm())
+	}
+}
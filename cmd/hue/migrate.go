@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hiddify/hue-go/internal/config"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/spf13/cobra"
+)
+
+func newMigrateCommand() *cobra.Command {
+	var only string
+	var to int
+	var dryRun, status bool
+
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply or revert schema migrations of the user, active and history databases",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if to != sqlite.LatestVersion && only == "" {
+				return fmt.Errorf("--to needs --db, since every database has its own versions")
+			}
+
+			cfg, err := config.Load()
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			dbs, err := openMigrationDBs(cfg.DatabaseURL, only)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				for _, db := range dbs {
+					db.Close()
+				}
+			}()
+
+			out := cmd.OutOrStdout()
+			for _, db := range dbs {
+				if status {
+					s, err := db.SchemaStatus()
+					if err != nil {
+						return fmt.Errorf("%s: %w", db.name, err)
+					}
+					fmt.Fprintf(out, "%s: version %d, latest %d\n", db.name, s.Current, s.Latest)
+					continue
+				}
+				steps, err := db.MigrateTo(to, dryRun)
+				if perr := printMigrationSteps(out, db.name, steps, dryRun); perr != nil {
+					return perr
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %w", db.name, err)
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&only, "db", "", "migrate only this database: user, active or history")
+	cmd.Flags().IntVar(&to, "to", sqlite.LatestVersion, "schema version to migrate to, lower than the current one to revert, -1 for the latest")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "show the migrations without applying them")
+	cmd.Flags().BoolVar(&status, "status", false, "print the current and latest schema version")
+
+	return cmd
+}
+
+// migrationDB is a database opened for migration with the name it is
+// selected and reported by
+type migrationDB struct {
+	*sqlite.DB
+	name string
+}
+
+// openMigrationDBs opens the databases named by only, or all three, without
+// migrating them
+func openMigrationDBs(dbURL, only string) ([]migrationDB, error) {
+	switch only {
+	case "", "user", "active", "history":
+	default:
+		return nil, fmt.Errorf("unknown database %q, expected user, active or history", only)
+	}
+
+	var dbs []migrationDB
+	fail := func(err error) ([]migrationDB, error) {
+		for _, db := range dbs {
+			db.Close()
+		}
+		return nil, err
+	}
+	if only == "" || only == "user" {
+		userDB, err := sqlite.NewUserDB(dbURL)
+		if err != nil {
+			return fail(fmt.Errorf("failed to open user database: %w", err))
+		}
+		dbs = append(dbs, migrationDB{DB: userDB.DB, name: "user"})
+	}
+	if only == "" || only == "active" {
+		activeDB, err := sqlite.OpenActiveDB(dbURL)
+		if err != nil {
+			return fail(fmt.Errorf("failed to open active database: %w", err))
+		}
+		dbs = append(dbs, migrationDB{DB: activeDB.DB, name: "active"})
+	}
+	if only == "" || only == "history" {
+		historyDB, err := sqlite.OpenHistoryDB(dbURL)
+		if err != nil {
+			return fail(fmt.Errorf("failed to open history database: %w", err))
+		}
+		dbs = append(dbs, migrationDB{DB: historyDB.DB, name: "history"})
+	}
+	return dbs, nil
+}
+
+func printMigrationSteps(out io.Writer, name string, steps []sqlite.MigrationStep, dryRun bool) error {
+	prefix := ""
+	if dryRun {
+		prefix = "would "
+	}
+	for _, step := range steps {
+		if _, err := fmt.Fprintf(out, "%s: %s%s\n", name, prefix, step); err != nil {
+			return err
+		}
+	}
+	if len(steps) == 0 {
+		_, err := fmt.Fprintf(out, "%s: schema is up to date\n", name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/hiddify/hue-go/internal/auth"
+	"github.com/hiddify/hue-go/internal/config"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/engine"
+	"github.com/hiddify/hue-go/internal/jobs"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// reloadableKeys are the settings a SIGHUP applies to the running server.
+// Changes to any other setting are logged and wait for a restart.
+var reloadableKeys = []string{
+	"log_level",
+	"db_flush_interval",
+	"penalty_duration",
+	"concurrent_window",
+	"allowed_node_ips",
+	"manager_enforcement_mode",
+}
+
+// reloader applies a reloaded configuration to the running server without
+// dropping sessions, penalties or unflushed usage held in memory
+type reloader struct {
+	cfg           *config.Config
+	level         zap.AtomicLevel
+	scheduler     *jobs.Scheduler
+	penalty       *engine.PenaltyHandler
+	sessions      *engine.SessionManager
+	authenticator *auth.Authenticator
+	quota         *engine.QuotaEngine
+	logger        *zap.Logger
+}
+
+// reload reads the configuration again and applies the reloadable settings.
+// When it cannot be loaded or a setting is invalid, nothing changes.
+func (r *reloader) reload() {
+	cfg, err := config.Load()
+	if err != nil {
+		r.logger.Error("config reload failed, keeping the current settings", zap.Error(err))
+		return
+	}
+	if err := r.apply(cfg); err != nil {
+		r.logger.Error("config reload failed, keeping the current settings", zap.Error(err))
+	}
+}
+
+// apply validates every reloadable setting of cfg before changing any
+func (r *reloader) apply(cfg *config.Config) error {
+	level, err := zapcore.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid HUE_LOG_LEVEL: %w", err)
+	}
+	if cfg.DBFlushInterval <= 0 {
+		return fmt.Errorf("invalid HUE_DB_FLUSH_INTERVAL %v: must be positive", cfg.DBFlushInterval)
+	}
+	if cfg.ConcurrentWindow <= 0 {
+		return fmt.Errorf("invalid HUE_CONCURRENT_WINDOW %v: must be positive", cfg.ConcurrentWindow)
+	}
+	if cfg.PenaltyDuration < 0 {
+		return fmt.Errorf("invalid HUE_PENALTY_DURATION %v: must not be negative", cfg.PenaltyDuration)
+	}
+	mode := domain.EnforcementMode(cfg.ManagerEnforcementMode)
+	if !mode.IsValid() {
+		return fmt.Errorf("invalid HUE_MANAGER_ENFORCEMENT_MODE %q, expected soft, default or hard", cfg.ManagerEnforcementMode)
+	}
+	nodeNets, err := auth.ParseAllowedNodeIPs(cfg.AllowedNodeIPs)
+	if err != nil {
+		return fmt.Errorf("invalid HUE_ALLOWED_NODE_IPS: %w", err)
+	}
+
+	// The flush job is the only setting that can still fail, so it goes
+	// first and a failure leaves the rest unchanged
+	if err := r.scheduler.SetInterval("usage_flush", cfg.DBFlushInterval); err != nil {
+		return err
+	}
+	r.authenticator.SetAllowedNodeNets(nodeNets)
+	r.level.SetLevel(level)
+	r.penalty.SetDuration(cfg.PenaltyDuration)
+	r.sessions.SetWindow(cfg.ConcurrentWindow)
+	r.quota.SetManagerEnforcementMode(mode)
+
+	var applied, pending []string
+	for _, key := range config.Diff(r.cfg, cfg) {
+		if slices.Contains(reloadableKeys, key) {
+			applied = append(applied, key)
+		} else {
+			pending = append(pending, key)
+		}
+	}
+	r.logger.Info("config reloaded", zap.Strings("changed", applied))
+	if len(pending) > 0 {
+		r.logger.Warn("changed settings need a restart to take effect", zap.Strings("settings", pending))
+	}
+
+	// The rest of r.cfg stays what the server runs with, so settings
+	// waiting for a restart are reported again on the next reload
+	r.cfg.LogLevel = cfg.LogLevel
+	r.cfg.DBFlushInterval = cfg.DBFlushInterval
+	r.cfg.PenaltyDuration = cfg.PenaltyDuration
+	r.cfg.ConcurrentWindow = cfg.ConcurrentWindow
+	r.cfg.AllowedNodeIPs = cfg.AllowedNodeIPs
+	r.cfg.ManagerEnforcementMode = cfg.ManagerEnforcementMode
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hiddify/hue-go/internal/config"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/engine"
+	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/spf13/cobra"
+)
+
+func newReplayCommand() *cobra.Command {
+	var userID string
+	var apply bool
+
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Rebuild package usage counters from the event history",
+		Long: `Replay the USAGE_RECORDED and BACKFILL events of the history database in
+the order they were stored and compare the traffic they charged with each
+package's counters, starting over at a package's last PACKAGE_RESET or
+PACKAGE_ACTIVATED. With --apply the counters that differ are overwritten.
+
+Stop the server first, so reports and unflushed usage do not race the
+rebuild. Only packages with events are compared. A package whose events may
+be incomplete, because HUE_HIST_DATA_RETENTION purged some or the history
+starts after the package was created, is reported but never overwritten.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			userDB, err := openStateDB()
+			if err != nil {
+				return err
+			}
+			defer userDB.Close()
+			historyDB, err := openHistoryDB()
+			if err != nil {
+				return err
+			}
+			defer historyDB.Close()
+
+			historyStart, err := historyDB.CreatedAt()
+			if err != nil {
+				return fmt.Errorf("failed to read the history database's age: %w", err)
+			}
+			projection := engine.NewPackageUsageProjection(userID, historyStart)
+			filter := domain.EventReplayFilter{Types: engine.PackageUsageEventTypes}
+			replayed, err := engine.Replay(eventstore.NewDBEventStore(historyDB), filter, projection)
+			if err != nil {
+				return fmt.Errorf("failed to replay events: %w", err)
+			}
+
+			changes, err := projection.Rebuild(userDB, apply)
+			if perr := printPackageUsageChanges(cmd.OutOrStdout(), replayed, changes, apply); perr != nil {
+				return perr
+			}
+			if err != nil {
+				return err
+			}
+			if refused := incompleteChanges(changes); apply && refused > 0 {
+				return fmt.Errorf("%d packages were left alone because their events may be incomplete", refused)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&userID, "user", "", "replay only this user's events")
+	cmd.Flags().BoolVar(&apply, "apply", false, "overwrite the counters that differ instead of only showing them")
+
+	return cmd
+}
+
+// openHistoryDB opens the history database of the configured DATABASE_URL
+func openHistoryDB() (*sqlite.HistoryDB, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	historyDB, err := sqlite.NewHistoryDB(cfg.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize history database: %w", err)
+	}
+	return historyDB, nil
+}
+
+func printPackageUsageChanges(out io.Writer, replayed int, changes []engine.PackageUsageChange, apply bool) error {
+	prefix := "would "
+	if apply {
+		prefix = ""
+	}
+	changed := 0
+	for _, c := range changes {
+		if !c.Changed() {
+			continue
+		}
+		if c.Incomplete != "" {
+			_, err := fmt.Fprintf(out, "package %s (user %s): cannot rebuild, %s (upload %d, download %d replayed)\n",
+				c.PackageID, c.UserID, c.Incomplete, c.Replayed.Upload, c.Replayed.Download)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		changed++
+		_, err := fmt.Fprintf(out, "package %s (user %s): %sset upload %d -> %d, download %d -> %d\n",
+			c.PackageID, c.UserID, prefix, c.Stored.Upload, c.Replayed.Upload, c.Stored.Download, c.Replayed.Download)
+		if err != nil {
+			return err
+		}
+	}
+	summary := "%d events replayed, %d packages compared, %d differ, %d incomplete\n"
+	if apply {
+		summary = "%d events replayed, %d packages compared, %d updated, %d incomplete\n"
+	}
+	_, err := fmt.Fprintf(out, summary, replayed, len(changes), changed, incompleteChanges(changes))
+	return err
+}
+
+// incompleteChanges counts the differing packages whose events may be
+// incomplete
+func incompleteChanges(changes []engine.PackageUsageChange) int {
+	n := 0
+	for _, c := range changes {
+		if c.Changed() && c.Incomplete != "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hiddify/hue-go/internal/config"
+	"github.com/hiddify/hue-go/internal/state"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/spf13/cobra"
+)
+
+func newExportCommand() *cobra.Command {
+	var to string
+	var includeSecrets bool
+
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export managers, nodes and services as declarative YAML",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			userDB, err := openStateDB()
+			if err != nil {
+				return err
+			}
+			defer userDB.Close()
+
+			s, err := state.Export(userDB, state.ExportOptions{IncludeSecrets: includeSecrets})
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			if to != "" && to != "-" {
+				f, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+				if err != nil {
+					return fmt.Errorf("failed to create %s: %w", to, err)
+				}
+				defer f.Close()
+				out = f
+			}
+			return s.Write(out)
+		},
+	}
+	cmd.Flags().StringVar(&to, "to", "", "file to write the state to (default stdout)")
+	cmd.Flags().BoolVar(&includeSecrets, "include-secrets", false, "include node and service secret keys")
+
+	return cmd
+}
+
+func newApplyCommand() *cobra.Command {
+	var prune, dryRun bool
+
+	cmd := &cobra.Command{
+		Use:   "apply <state.yaml>",
+		Short: "Reconcile managers, nodes and services with a declarative YAML file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var in io.Reader = cmd.InOrStdin()
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return fmt.Errorf("failed to open %s: %w", args[0], err)
+				}
+				defer f.Close()
+				in = f
+			}
+
+			s, err := state.Read(in)
+			if err != nil {
+				return err
+			}
+
+			userDB, err := openStateDB()
+			if err != nil {
+				return err
+			}
+			defer userDB.Close()
+
+			changes, err := state.Apply(userDB, s, state.ApplyOptions{Prune: prune, DryRun: dryRun})
+			if err != nil {
+				return err
+			}
+			return printChanges(cmd.OutOrStdout(), changes, dryRun)
+		},
+	}
+	cmd.Flags().BoolVar(&prune, "prune", false, "delete nodes and services missing from the file")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "show the changes without applying them")
+
+	return cmd
+}
+
+func printChanges(out io.Writer, changes []state.Change, dryRun bool) error {
+	prefix := ""
+	if dryRun {
+		prefix = "would "
+	}
+	for _, c := range changes {
+		if _, err := fmt.Fprintln(out, prefix+c.String()); err != nil {
+			return err
+		}
+	}
+	if len(changes) == 0 {
+		_, err := fmt.Fprintln(out, "state is up to date")
+		return err
+	}
+	return nil
+}
+
+// openStateDB opens and migrates the user database named by the configuration
+func openStateDB() (*sqlite.UserDB, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	userDB, err := sqlite.NewUserDB(cfg.DatabaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize user database: %w", err)
+	}
+	if err := userDB.Migrate(); err != nil {
+		userDB.Close()
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+	return userDB, nil
+}
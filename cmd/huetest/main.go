@@ -0,0 +1,276 @@
+// Command huetest spins up a full HUE instance on a random port and runs
+// scripted end-to-end scenarios against its real gRPC and HTTP surfaces,
+// asserting the resulting database and event state.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	pb "github.com/hiddify/hue-go/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run executes the selected scenarios and returns the process exit code
+func run() int {
+	hueFlag := flag.String("hue", "", "Path to the hue binary (built from ./cmd/hue when empty)")
+	runFlag := flag.String("run", "", "Only run scenarios matching this regular expression")
+	keepFlag := flag.Bool("keep", false, "Keep the instance's working directory after the run")
+	verboseFlag := flag.Bool("v", false, "Stream the instance's log output")
+	timeoutFlag := flag.Duration("timeout", 2*time.Minute, "Overall timeout for the run")
+	flag.Parse()
+
+	filter, err := regexp.Compile(*runFlag)
+	if err != nil {
+		log.Fatalf("Invalid -run pattern: %v", err)
+	}
+
+	dir, err := os.MkdirTemp("", "huetest-")
+	if err != nil {
+		log.Fatalf("Failed to create working directory: %v", err)
+	}
+	if *keepFlag {
+		fmt.Printf("Working directory: %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
+	defer cancel()
+
+	inst, err := startInstance(ctx, *hueFlag, dir, *verboseFlag)
+	if err != nil {
+		log.Printf("Failed to start HUE: %v", err)
+		return 1
+	}
+	defer inst.stop()
+
+	h, err := newHarness(inst)
+	if err != nil {
+		log.Printf("Failed to connect to HUE: %v", err)
+		return 1
+	}
+	defer h.close()
+
+	failed := 0
+	ran := 0
+	for _, sc := range scenarios {
+		if !filter.MatchString(sc.name) {
+			continue
+		}
+		ran++
+
+		start := time.Now()
+		if err := sc.run(ctx, h); err != nil {
+			failed++
+			fmt.Printf("FAIL %-12s %v\n", sc.name, err)
+			continue
+		}
+		fmt.Printf("PASS %-12s (%s)\n", sc.name, time.Since(start).Round(time.Millisecond))
+	}
+
+	fmt.Printf("%d scenarios, %d failed\n", ran, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// instance is a running hue serve process
+type instance struct {
+	cmd    *exec.Cmd
+	addr   string
+	dbURL  string
+	secret string
+}
+
+// startInstance launches hue serve in dir on a free port and waits until its
+// health endpoint answers
+func startInstance(ctx context.Context, binary, dir string, verbose bool) (*instance, error) {
+	if binary == "" {
+		binary = filepath.Join(dir, "hue")
+		build := exec.CommandContext(ctx, "go", "build", "-o", binary, "./cmd/hue")
+		build.Stdout = os.Stdout
+		build.Stderr = os.Stderr
+		if err := build.Run(); err != nil {
+			return nil, fmt.Errorf("failed to build hue: %w", err)
+		}
+	}
+	binary, err := filepath.Abs(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	inst := &instance{
+		addr:   net.JoinHostPort("127.0.0.1", port),
+		dbURL:  "sqlite://" + filepath.Join(dir, "hue.db"),
+		secret: hex.EncodeToString(secret),
+	}
+
+	// Run from the working directory so a config.yaml next to the caller is
+	// not picked up
+	inst.cmd = exec.Command(binary, "serve")
+	inst.cmd.Dir = dir
+	inst.cmd.Env = append(os.Environ(),
+		"HUE_PORT="+port,
+		"HUE_DB_URL="+inst.dbURL,
+		"HUE_AUTH_SECRET="+inst.secret,
+		"HUE_EVENT_STORE_TYPE=db",
+	)
+	if verbose {
+		inst.cmd.Stdout = os.Stdout
+		inst.cmd.Stderr = os.Stderr
+	}
+	if err := inst.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start hue: %w", err)
+	}
+
+	if err := inst.waitReady(ctx); err != nil {
+		inst.stop()
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (i *instance) waitReady(ctx context.Context) error {
+	url := "http://" + i.addr + "/health"
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("hue did not become ready on %s: %w", i.addr, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (i *instance) stop() {
+	if i.cmd == nil || i.cmd.Process == nil || i.cmd.ProcessState != nil {
+		return
+	}
+	i.cmd.Process.Signal(os.Interrupt)
+
+	done := make(chan struct{})
+	go func() {
+		i.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		i.cmd.Process.Kill()
+		<-done
+	}
+}
+
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
+}
+
+// harness holds the clients scenarios use to drive and inspect the instance
+type harness struct {
+	inst   *instance
+	conn   *grpc.ClientConn
+	admin  pb.AdminServiceClient
+	usage  pb.UsageServiceClient
+	node   pb.NodeServiceClient
+	http   *http.Client
+	userDB *sqlite.UserDB
+}
+
+func newHarness(inst *instance) (*harness, error) {
+	conn, err := grpc.NewClient(inst.addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the instance's database directly to assert persisted state
+	userDB, err := sqlite.NewUserDB(inst.dbURL)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &harness{
+		inst:   inst,
+		conn:   conn,
+		admin:  pb.NewAdminServiceClient(conn),
+		usage:  pb.NewUsageServiceClient(conn),
+		node:   pb.NewNodeServiceClient(conn),
+		http:   &http.Client{Timeout: 10 * time.Second},
+		userDB: userDB,
+	}, nil
+}
+
+func (h *harness) close() {
+	h.conn.Close()
+	h.userDB.Close()
+}
+
+// authed attaches the owner secret to outgoing gRPC calls
+func (h *harness) authed(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "hue-api-key", h.inst.secret)
+}
+
+// do sends an authenticated HTTP request and returns the status code
+func (h *harness) do(ctx context.Context, method, path string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+h.inst.addr+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Hue-API-Key", h.inst.secret)
+
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	pb "github.com/hiddify/hue-go/pkg/proto"
+)
+
+type scenario struct {
+	name string
+	run  func(ctx context.Context, h *harness) error
+}
+
+// scenarios run in order; each provisions its own user, node and service so
+// any subset can be selected with -run
+var scenarios = []scenario{
+	{name: "provision", run: scenarioProvision},
+	{name: "report", run: scenarioReport},
+	{name: "quota", run: scenarioQuota},
+	{name: "penalty", run: scenarioPenalty},
+	{name: "reset", run: scenarioReset},
+	{name: "overload", run: scenarioOverload},
+}
+
+// fixture is a provisioned user with an active package reachable through one
+// node and service
+type fixture struct {
+	userID    string
+	packageID string
+	nodeID    string
+	serviceID string
+}
+
+var fixtureSeq atomic.Int64
+
+// provision creates a node, service, user and package over gRPC and attaches
+// the package to the user
+func (h *harness) provision(ctx context.Context, pkgReq *pb.CreatePackageRequest) (*fixture, error) {
+	ctx = h.authed(ctx)
+	n := fixtureSeq.Add(1)
+
+	node, err := h.admin.CreateNode(ctx, &pb.CreateNodeRequest{
+		Name:      fmt.Sprintf("huetest-node-%d", n),
+		SecretKey: fmt.Sprintf("huetest-node-key-%s-%d", h.inst.secret, n),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create node: %w", err)
+	}
+
+	service, err := h.admin.CreateService(ctx, &pb.CreateServiceRequest{
+		NodeId:    node.Id,
+		SecretKey: fmt.Sprintf("huetest-service-key-%s-%d", h.inst.secret, n),
+		Name:      fmt.Sprintf("huetest-service-%d", n),
+		Protocol:  "vless",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create service: %w", err)
+	}
+
+	user, err := h.admin.CreateUser(ctx, &pb.CreateUserRequest{
+		Username: fmt.Sprintf("huetest-user-%d", n),
+		Password: "huetest",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+
+	pkgReq.UserId = user.Id
+	pkg, err := h.admin.CreatePackage(ctx, pkgReq)
+	if err != nil {
+		return nil, fmt.Errorf("create package: %w", err)
+	}
+
+	if _, err := h.admin.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		return nil, fmt.Errorf("attach package: %w", err)
+	}
+
+	return &fixture{userID: user.Id, packageID: pkg.Id, nodeID: node.Id, serviceID: service.Id}, nil
+}
+
+// report sends one usage report for the fixture's user
+func (h *harness) report(ctx context.Context, fx *fixture, sessionID, clientIP string, upload, download int64) (*pb.UsageReportResult, error) {
+	resp, err := h.usage.ReportUsage(h.authed(ctx), &pb.ReportUsageRequest{Report: &pb.UsageReport{
+		UserId:    fx.userID,
+		NodeId:    fx.nodeID,
+		ServiceId: fx.serviceID,
+		Upload:    upload,
+		Download:  download,
+		SessionId: sessionID,
+		ClientIp:  clientIP,
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("report usage: %w", err)
+	}
+	return resp.Result, nil
+}
+
+// expectPackageUsage asserts the persisted usage counters of a package
+func (h *harness) expectPackageUsage(packageID string, upload, download int64) error {
+	pkg, err := h.userDB.GetPackage(packageID)
+	if err != nil {
+		return err
+	}
+	if pkg == nil {
+		return fmt.Errorf("package %s not found in database", packageID)
+	}
+	if pkg.CurrentUpload != upload || pkg.CurrentDownload != download {
+		return fmt.Errorf("package %s usage = %d/%d, want %d/%d", packageID, pkg.CurrentUpload, pkg.CurrentDownload, upload, download)
+	}
+	return nil
+}
+
+func scenarioProvision(ctx context.Context, h *harness) error {
+	fx, err := h.provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1 << 30})
+	if err != nil {
+		return err
+	}
+
+	user, err := h.userDB.GetUser(fx.userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %s not found in database", fx.userID)
+	}
+	if user.ActivePackageID == nil || *user.ActivePackageID != fx.packageID {
+		return fmt.Errorf("user active package = %v, want %s", user.ActivePackageID, fx.packageID)
+	}
+	if user.Status != domain.UserStatusActive {
+		return fmt.Errorf("user status = %s, want %s", user.Status, domain.UserStatusActive)
+	}
+
+	service, err := h.userDB.GetService(fx.serviceID)
+	if err != nil {
+		return err
+	}
+	if service == nil || service.NodeID != fx.nodeID {
+		return fmt.Errorf("service %s is not attached to node %s", fx.serviceID, fx.nodeID)
+	}
+
+	return h.expectPackageUsage(fx.packageID, 0, 0)
+}
+
+func scenarioReport(ctx context.Context, h *harness) error {
+	fx, err := h.provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1 << 30})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		res, err := h.report(ctx, fx, "report-session", "10.0.0.1", 100, 200)
+		if err != nil {
+			return err
+		}
+		if !res.Accepted {
+			return fmt.Errorf("report %d rejected: %s (%s)", i, res.Reason, res.ReasonCode)
+		}
+		if res.PackageId != fx.packageID {
+			return fmt.Errorf("report %d charged package %s, want %s", i, res.PackageId, fx.packageID)
+		}
+	}
+
+	if err := h.expectPackageUsage(fx.packageID, 300, 600); err != nil {
+		return err
+	}
+
+	node, err := h.userDB.GetNode(fx.nodeID)
+	if err != nil {
+		return err
+	}
+	if node == nil || node.CurrentUpload != 300 || node.CurrentDownload != 600 {
+		return fmt.Errorf("node %s usage was not recorded", fx.nodeID)
+	}
+	return nil
+}
+
+func scenarioQuota(ctx context.Context, h *harness) error {
+	fx, err := h.provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1000})
+	if err != nil {
+		return err
+	}
+
+	res, err := h.report(ctx, fx, "quota-session", "10.0.0.1", 300, 300)
+	if err != nil {
+		return err
+	}
+	if !res.Accepted {
+		return fmt.Errorf("first report rejected: %s (%s)", res.Reason, res.ReasonCode)
+	}
+
+	res, err = h.report(ctx, fx, "quota-session", "10.0.0.1", 300, 300)
+	if err != nil {
+		return err
+	}
+	if res.Accepted || !res.QuotaExceeded || !res.ShouldDisconnect {
+		return fmt.Errorf("over-quota report: accepted=%v quota_exceeded=%v should_disconnect=%v", res.Accepted, res.QuotaExceeded, res.ShouldDisconnect)
+	}
+
+	// The rejected report must not be charged
+	return h.expectPackageUsage(fx.packageID, 300, 300)
+}
+
+func scenarioPenalty(ctx context.Context, h *harness) error {
+	fx, err := h.provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1 << 30, MaxConcurrent: 1})
+	if err != nil {
+		return err
+	}
+
+	res, err := h.report(ctx, fx, "penalty-a", "10.0.0.1", 10, 10)
+	if err != nil {
+		return err
+	}
+	if !res.Accepted {
+		return fmt.Errorf("first session rejected: %s (%s)", res.Reason, res.ReasonCode)
+	}
+
+	res, err = h.report(ctx, fx, "penalty-b", "10.0.0.2", 10, 10)
+	if err != nil {
+		return err
+	}
+	if !res.PenaltyApplied || res.ReasonCode != string(domain.ReasonConcurrentLimit) {
+		return fmt.Errorf("second session: penalty_applied=%v reason_code=%s, want penalty for %s", res.PenaltyApplied, res.ReasonCode, domain.ReasonConcurrentLimit)
+	}
+
+	res, err = h.report(ctx, fx, "penalty-a", "10.0.0.1", 10, 10)
+	if err != nil {
+		return err
+	}
+	if res.Accepted || res.ReasonCode != string(domain.ReasonUserPenalized) {
+		return fmt.Errorf("penalized user: accepted=%v reason_code=%s, want %s", res.Accepted, res.ReasonCode, domain.ReasonUserPenalized)
+	}
+
+	code, err := h.do(ctx, http.MethodDelete, "/api/v1/users/"+fx.userID+"/penalty")
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("clear penalty returned %d", code)
+	}
+
+	res, err = h.report(ctx, fx, "penalty-a", "10.0.0.1", 10, 10)
+	if err != nil {
+		return err
+	}
+	if !res.Accepted {
+		return fmt.Errorf("report after clearing penalty rejected: %s (%s)", res.Reason, res.ReasonCode)
+	}
+
+	return h.expectPackageUsage(fx.packageID, 20, 20)
+}
+
+func scenarioReset(ctx context.Context, h *harness) error {
+	fx, err := h.provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1000})
+	if err != nil {
+		return err
+	}
+
+	res, err := h.report(ctx, fx, "reset-session", "10.0.0.1", 500, 500)
+	if err != nil {
+		return err
+	}
+	if !res.Accepted {
+		return fmt.Errorf("first report rejected: %s (%s)", res.Reason, res.ReasonCode)
+	}
+
+	res, err = h.report(ctx, fx, "reset-session", "10.0.0.1", 10, 10)
+	if err != nil {
+		return err
+	}
+	if res.Accepted || !res.ShouldDisconnect {
+		return fmt.Errorf("exhausted package: accepted=%v should_disconnect=%v reason_code=%s", res.Accepted, res.ShouldDisconnect, res.ReasonCode)
+	}
+
+	// Using up the package finishes the user
+	user, err := h.userDB.GetUser(fx.userID)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Status == domain.UserStatusActive {
+		return fmt.Errorf("user %s is still active after exhausting its package", fx.userID)
+	}
+
+	// Renew the user onto a fresh package, as a panel does on reset
+	admin := h.authed(ctx)
+	renewed, err := h.admin.CreatePackage(admin, &pb.CreatePackageRequest{UserId: fx.userID, TotalTraffic: 1000})
+	if err != nil {
+		return fmt.Errorf("create renewal package: %w", err)
+	}
+	if _, err := h.admin.UpdateUser(admin, &pb.UpdateUserRequest{
+		Id:              fx.userID,
+		Status:          string(domain.UserStatusActive),
+		ActivePackageId: renewed.Id,
+	}); err != nil {
+		return fmt.Errorf("attach renewal package: %w", err)
+	}
+
+	res, err = h.report(ctx, fx, "reset-session", "10.0.0.1", 10, 10)
+	if err != nil {
+		return err
+	}
+	if !res.Accepted || res.PackageId != renewed.Id {
+		return fmt.Errorf("report after reset: accepted=%v package=%s reason=%s", res.Accepted, res.PackageId, res.ReasonCode)
+	}
+
+	if err := h.expectPackageUsage(fx.packageID, 500, 500); err != nil {
+		return err
+	}
+	return h.expectPackageUsage(renewed.Id, 10, 10)
+}
+
+func scenarioOverload(ctx context.Context, h *harness) error {
+	fx, err := h.provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1 << 30})
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.node.Heartbeat(h.authed(ctx), &pb.HeartbeatRequest{NodeId: fx.nodeID, Overloaded: true})
+	if err != nil {
+		return fmt.Errorf("heartbeat: %w", err)
+	}
+	if !resp.Draining {
+		return fmt.Errorf("overloaded node is not draining")
+	}
+
+	res, err := h.report(ctx, fx, "overload-session", "10.0.0.1", 10, 10)
+	if err != nil {
+		return err
+	}
+	if res.Accepted || res.ReasonCode != string(domain.ReasonNodeDraining) {
+		return fmt.Errorf("new session on draining node: accepted=%v reason_code=%s", res.Accepted, res.ReasonCode)
+	}
+
+	node, err := h.userDB.GetNode(fx.nodeID)
+	if err != nil {
+		return err
+	}
+	if node == nil || !node.Draining {
+		return fmt.Errorf("node %s is not marked draining in database", fx.nodeID)
+	}
+
+	events, err := h.admin.GetEvents(h.authed(ctx), &pb.GetEventsRequest{Type: string(domain.EventNodeOverloaded)})
+	if err != nil {
+		return fmt.Errorf("get events: %w", err)
+	}
+	for _, e := range events.Events {
+		if e.NodeId == fx.nodeID {
+			return nil
+		}
+	}
+	return fmt.Errorf("no %s event for node %s", domain.EventNodeOverloaded, fx.nodeID)
+}
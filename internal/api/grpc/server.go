@@ -2,13 +2,25 @@ package grpc
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/auth"
 	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/engine"
 	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/internal/tracing"
 	pb "github.com/hiddify/hue-go/pkg/proto"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -23,15 +35,23 @@ type Server struct {
 	pb.UnimplementedAdminServiceServer
 	pb.UnimplementedNodeServiceServer
 
+	mu         sync.Mutex // Guards grpcServer, built by the serving goroutine
 	grpcServer *grpc.Server
+	engine     *engine.Engine
 	quota      *engine.QuotaEngine
 	session    *engine.SessionManager
 	penalty    *engine.PenaltyHandler
 	geo        *engine.GeoHandler
 	events     eventstore.EventStore
 	userDB     *sqlite.UserDB
+	stats      *cache.StatsCache
+	tracer     *tracing.Tracer
 	logger     *zap.Logger
 	secret     string
+
+	// Service keys only count with a client certificate naming their node
+	nodeCertRequired bool
+	tokens           *auth.TokenIssuer // nil disables access tokens
 }
 
 // NewServer creates a new gRPC server
@@ -60,142 +80,402 @@ func (s *Server) SetUserDB(db *sqlite.UserDB) {
 	s.userDB = db
 }
 
-// UsageService implementation
+// SetStatsCache sets the stats cache busted by admin writes
+func (s *Server) SetStatsCache(stats *cache.StatsCache) {
+	s.stats = stats
+}
 
-func (s *Server) ReportUsage(ctx context.Context, req *pb.ReportUsageRequest) (*pb.ReportUsageResponse, error) {
-	report := s.protoToDomainUsageReport(req.Report)
+// SetTracer records a span for every call and usage report
+func (s *Server) SetTracer(tracer *tracing.Tracer) {
+	s.tracer = tracer
+}
 
-	// Process usage report through quota engine
-	quotaResult, err := s.quota.CheckQuota(report.UserID, report.Upload, report.Download)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "quota check failed: %v", err)
-	}
+// SetNodeCertRequired makes service keys valid only together with a client
+// certificate whose common name or a DNS name is their node's ID or name, so
+// a stolen key is useless without the node's certificate
+func (s *Server) SetNodeCertRequired(required bool) {
+	s.nodeCertRequired = required
+}
 
-	result := &domain.UsageReportResult{
-		UserID:           report.UserID,
-		Accepted:         false,
-		QuotaExceeded:    false,
-		SessionLimitHit:  false,
-		PenaltyApplied:   false,
-		ShouldDisconnect: false,
-	}
+// SetTokenIssuer accepts access tokens from the issuer in place of API keys
+func (s *Server) SetTokenIssuer(tokens *auth.TokenIssuer) {
+	s.tokens = tokens
+}
 
-	// Check penalty
-	penaltyResult := s.penalty.CheckPenalty(report.UserID)
-	if penaltyResult.HasPenalty {
-		result.ShouldDisconnect = true
-		result.Reason = "user has active penalty"
-		return &pb.ReportUsageResponse{Result: s.domainToProtoResult(result)}, nil
-	}
+// SetEngine sets the usage engine used for node load handling
+func (s *Server) SetEngine(e *engine.Engine) {
+	s.engine = e
+}
 
-	// Check session
-	if quotaResult.Pkg != nil {
-		sessionResult := s.session.CheckSession(report.UserID, report.SessionID, report.ClientIP, quotaResult.Pkg.MaxConcurrent)
-		if sessionResult.SessionLimitHit {
-			s.penalty.ApplyPenalty(report.UserID, "concurrent_session_limit_exceeded")
-			result.PenaltyApplied = true
-			result.ShouldDisconnect = true
-			result.Reason = "concurrent session limit exceeded"
-			return &pb.ReportUsageResponse{Result: s.domainToProtoResult(result)}, nil
-		}
-	}
+// UsageService implementation
 
-	// Check quota
-	if !quotaResult.CanUse {
-		result.QuotaExceeded = quotaResult.QuotaExceeded
-		result.ShouldDisconnect = true
-		result.Reason = quotaResult.Reason
-		return &pb.ReportUsageResponse{Result: s.domainToProtoResult(result)}, nil
+func (s *Server) ReportUsage(ctx context.Context, req *pb.ReportUsageRequest) (*pb.ReportUsageResponse, error) {
+	result, err := s.reportUsage(ctx, req.Report)
+	if err != nil {
+		return nil, err
 	}
+	return &pb.ReportUsageResponse{Result: result}, nil
+}
 
-	// Extract geo data
-	var geoData *domain.GeoData
-	if s.geo != nil && s.geo.IsReady() && report.ClientIP != "" {
-		geoData = s.geo.ExtractGeo(report.ClientIP)
-	}
+// reportUsage validates and processes one report; the error is a gRPC status
+func (s *Server) reportUsage(ctx context.Context, req *pb.UsageReport) (result *pb.UsageReportResult, err error) {
+	// Streamed reports have no call span, so each starts its own trace
+	ctx, span := s.tracer.StartSpan(ctx, "UsageService.reportUsage", tracing.SpanKindInternal, traceparentFromContext(ctx))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttribute("hue.user_id", req.UserId)
+	span.SetAttribute("hue.node_id", req.NodeId)
 
-	// Add session
-	s.session.AddSession(report.UserID, report.SessionID, report.ClientIP, geoData)
+	report := s.protoToDomainUsageReport(req)
 
-	// Record usage
-	if err := s.quota.RecordUsage(report.UserID, report.Upload, report.Download); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to record usage: %v", err)
+	// Only accept reports from a service running on the reported node, and
+	// from that service's own key when a service key authenticated the call
+	var callerServiceID string
+	if c := callerFromContext(ctx); c != nil && c.service != nil {
+		callerServiceID = c.service.ID
+	}
+	if err := s.quota.ValidateReportSource(report, callerServiceID); err != nil {
+		return nil, reportSourceStatus(err)
 	}
 
-	// Update node and service usage
-	if report.NodeID != "" {
-		s.userDB.UpdateNodeUsage(report.NodeID, report.Upload, report.Download)
+	if !report.CounterMode.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid counter mode %q", report.CounterMode)
 	}
-	if report.ServiceID != "" {
-		s.userDB.UpdateServiceUsage(report.ServiceID, report.Upload, report.Download)
+	if s.engine == nil {
+		return nil, status.Error(codes.FailedPrecondition, "usage engine not configured")
 	}
 
-	result.Accepted = true
-	if quotaResult.Pkg != nil {
-		result.PackageID = quotaResult.Pkg.ID
-	}
+	processed := s.engine.ProcessUsageReportContext(ctx, report)
 
 	s.logger.Debug("usage reported",
 		zap.String("user_id", report.UserID),
 		zap.Int64("upload", report.Upload),
 		zap.Int64("download", report.Download),
-		zap.Bool("accepted", result.Accepted),
+		zap.Bool("accepted", processed.Accepted),
 	)
 
-	return &pb.ReportUsageResponse{Result: s.domainToProtoResult(result)}, nil
+	return s.domainToProtoResult(processed), nil
+}
+
+// reportSourceStatus maps a report source validation error to a gRPC status
+func reportSourceStatus(err error) error {
+	switch {
+	case errors.Is(err, engine.ErrServiceKeyMismatch):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, engine.ErrUnknownService), errors.Is(err, engine.ErrServiceNodeMismatch):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return status.Errorf(codes.Internal, "report validation failed: %v", err)
+	}
 }
 
 func (s *Server) BatchReportUsage(ctx context.Context, req *pb.BatchReportUsageRequest) (*pb.BatchReportUsageResponse, error) {
 	results := make([]*pb.UsageReportResult, len(req.Reports))
 
 	for i, report := range req.Reports {
-		resp, err := s.ReportUsage(ctx, &pb.ReportUsageRequest{Report: report})
-		if err != nil {
-			results[i] = &pb.UsageReportResult{
-				UserId:   report.UserId,
-				Accepted: false,
-				Reason:   err.Error(),
+		results[i] = s.reportUsageResult(ctx, report)
+	}
+
+	return &pb.BatchReportUsageResponse{Results: results}, nil
+}
+
+// reportUsageResult is reportUsage for batches and streams, where a rejected
+// report becomes a result instead of failing the call
+func (s *Server) reportUsageResult(ctx context.Context, report *pb.UsageReport) *pb.UsageReportResult {
+	result, err := s.reportUsage(ctx, report)
+	if err != nil {
+		return &pb.UsageReportResult{
+			UserId:   report.UserId,
+			Accepted: false,
+			Reason:   err.Error(),
+		}
+	}
+	return result
+}
+
+// streamUsageBatchSize bounds the reports StreamUsage takes off the stream
+// before it answers them
+const streamUsageBatchSize = 256
+
+// StreamUsage accepts reports over one long-lived stream so busy nodes skip
+// the per-call overhead of ReportUsage. Reports that arrived together are
+// processed as a batch and answered in the order they were sent.
+func (s *Server) StreamUsage(stream pb.UsageService_StreamUsageServer) error {
+	ctx := stream.Context()
+	reports := make(chan *pb.UsageReport, streamUsageBatchSize)
+	recvErr := make(chan error, 1)
+	go func() {
+		defer close(reports)
+		for {
+			report, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF {
+					recvErr <- err
+				}
+				return
+			}
+			select {
+			case reports <- report:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	batch := make([]*pb.UsageReport, 0, streamUsageBatchSize)
+	for {
+		report, ok := <-reports
+		if !ok {
+			select {
+			case err := <-recvErr:
+				return err
+			default:
+				return nil
+			}
+		}
+
+		batch = append(batch[:0], report)
+	drain:
+		for len(batch) < streamUsageBatchSize {
+			select {
+			case next, ok := <-reports:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+
+		for _, report := range batch {
+			if err := stream.Send(s.reportUsageResult(ctx, report)); err != nil {
+				return err
 			}
-		} else {
-			results[i] = resp.Result
 		}
 	}
+}
 
-	return &pb.BatchReportUsageResponse{Results: results}, nil
+// ReserveQuota holds traffic for a session up front, so nodes that report at
+// long intervals cannot overshoot the package between reports
+func (s *Server) ReserveQuota(ctx context.Context, req *pb.ReserveQuotaRequest) (*pb.ReserveQuotaResponse, error) {
+	if req.UserId == "" || req.Amount <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "user_id and a positive amount are required")
+	}
+
+	source := &domain.UsageReport{UserID: req.UserId, NodeID: req.NodeId, ServiceID: req.ServiceId}
+	var callerServiceID string
+	if c := callerFromContext(ctx); c != nil && c.service != nil {
+		callerServiceID = c.service.ID
+	}
+	if err := s.quota.ValidateReportSource(source, callerServiceID); err != nil {
+		return nil, reportSourceStatus(err)
+	}
+
+	if s.penalty.BlockingPenalty(req.UserId, req.SessionId) != nil {
+		return &pb.ReserveQuotaResponse{
+			Reason:     "user has active penalty",
+			ReasonCode: string(domain.ReasonUserPenalized),
+		}, nil
+	}
+
+	res, err := s.quota.Reserve(req.UserId, req.SessionId, source.NodeID, req.Amount, time.Duration(req.TtlSeconds)*time.Second)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reserve quota: %v", err)
+	}
+
+	resp := &pb.ReserveQuotaResponse{
+		Granted:    res.Granted,
+		Reason:     res.Reason,
+		ReasonCode: string(res.ReasonCode),
+		Remaining:  res.Remaining,
+	}
+	if res.Reservation != nil {
+		resp.ReservationId = res.Reservation.ID
+		resp.ExpiresAt = res.Reservation.ExpiresAt.Unix()
+	}
+	return resp, nil
+}
+
+// CommitReservation releases a reservation and reports the usage it covered.
+// Usage for an expired reservation is still reported; committing twice is
+// rejected.
+func (s *Server) CommitReservation(ctx context.Context, req *pb.CommitReservationRequest) (*pb.ReportUsageResponse, error) {
+	if req.ReservationId == "" || req.Report == nil {
+		return nil, status.Error(codes.InvalidArgument, "reservation_id and report are required")
+	}
+
+	reservation, err := s.userDB.GetReservation(req.ReservationId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get reservation: %v", err)
+	}
+	if reservation == nil {
+		return nil, status.Error(codes.NotFound, "reservation not found")
+	}
+	if req.Report.UserId == "" {
+		req.Report.UserId = reservation.UserID
+	}
+	if req.Report.UserId != reservation.UserID {
+		return nil, status.Error(codes.InvalidArgument, "report is for another user")
+	}
+	if reservation.Status == domain.ReservationStatusCommitted {
+		return nil, status.Error(codes.FailedPrecondition, "reservation already committed")
+	}
+
+	var callerServiceID string
+	if c := callerFromContext(ctx); c != nil && c.service != nil {
+		callerServiceID = c.service.ID
+	}
+	if err := s.quota.ValidateReportSource(s.protoToDomainUsageReport(req.Report), callerServiceID); err != nil {
+		return nil, reportSourceStatus(err)
+	}
+
+	if reservation.Status == domain.ReservationStatusActive {
+		_, err := s.quota.ReleaseReservation(reservation.ID)
+		if errors.Is(err, sqlite.ErrReservationNotActive) {
+			// Settled concurrently; only an expiry lets the report through
+			if current, _ := s.userDB.GetReservation(reservation.ID); current == nil || current.Status != domain.ReservationStatusExpired {
+				return nil, status.Error(codes.FailedPrecondition, "reservation already committed")
+			}
+		} else if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to release reservation: %v", err)
+		}
+	}
+
+	return s.ReportUsage(ctx, &pb.ReportUsageRequest{Report: req.Report})
 }
 
+// GetDisconnectCommands returns the oldest disconnect commands queued for a
+// node, up to the request's limit and HUE_DISCONNECT_BATCH_SIZE. Commands
+// stay queued until acked with AckDisconnects and are returned again after
+// the ack timeout. A service key may only poll its own node.
 func (s *Server) GetDisconnectCommands(ctx context.Context, req *pb.GetDisconnectCommandsRequest) (*pb.GetDisconnectCommandsResponse, error) {
-	// Get disconnect batch from cache
-	sessionCache := s.session
-	_ = sessionCache // We'll use the penalty handler's disconnect queue
+	nodeID, err := callerNodeID(ctx, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	if s.engine == nil {
+		return nil, status.Error(codes.FailedPrecondition, "usage engine not configured")
+	}
+
+	cmds := s.engine.TakeDisconnects(nodeID, int(req.Limit))
+	resp := &pb.GetDisconnectCommandsResponse{Commands: make([]*pb.DisconnectCommand, 0, len(cmds))}
+	for _, cmd := range cmds {
+		resp.Commands = append(resp.Commands, domainToProtoDisconnect(cmd))
+	}
+	return resp, nil
+}
+
+// disconnectPollInterval is how often SubscribeDisconnects checks the node's
+// queue for new commands
+const disconnectPollInterval = 200 * time.Millisecond
+
+// SubscribeDisconnects pushes disconnect commands for a node as they are
+// queued. Commands stay queued until the node acks them with AckDisconnects;
+// unacked commands are sent again after the ack timeout, also on a new
+// stream if this one drops. A service key may only subscribe to its own node.
+func (s *Server) SubscribeDisconnects(req *pb.SubscribeDisconnectsRequest, stream pb.UsageService_SubscribeDisconnectsServer) error {
+	ctx := stream.Context()
+	nodeID, err := callerNodeID(ctx, req.NodeId)
+	if err != nil {
+		return err
+	}
+	if s.engine == nil {
+		return status.Error(codes.FailedPrecondition, "usage engine not configured")
+	}
+
+	ticker := time.NewTicker(disconnectPollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			cmds := s.engine.TakeDisconnects(nodeID, 0)
+			for _, cmd := range cmds {
+				if err := stream.Send(domainToProtoDisconnect(cmd)); err != nil {
+					return err
+				}
+			}
+			if len(cmds) == 0 {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// AckDisconnects confirms that a node carried out disconnect commands, so
+// they are not delivered again
+func (s *Server) AckDisconnects(ctx context.Context, req *pb.AckDisconnectsRequest) (*pb.AckDisconnectsResponse, error) {
+	nodeID, err := callerNodeID(ctx, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	if s.engine == nil {
+		return nil, status.Error(codes.FailedPrecondition, "usage engine not configured")
+	}
+
+	return &pb.AckDisconnectsResponse{Acked: int32(s.engine.AckDisconnects(nodeID, req.Ids))}, nil
+}
 
-	// For now, return empty - this would be implemented with a proper disconnect queue
-	return &pb.GetDisconnectCommandsResponse{Commands: []*pb.DisconnectCommand{}}, nil
+// callerNodeID resolves the node a node-scoped call is for. A service key
+// fills in its own node and may not name another one.
+func callerNodeID(ctx context.Context, nodeID string) (string, error) {
+	if c := callerFromContext(ctx); c != nil && c.service != nil {
+		if nodeID == "" {
+			nodeID = c.service.NodeID
+		}
+		if nodeID != c.service.NodeID {
+			return "", status.Error(codes.PermissionDenied, "service key belongs to another node")
+		}
+	}
+	if nodeID == "" {
+		return "", status.Error(codes.InvalidArgument, "node_id is required")
+	}
+	return nodeID, nil
 }
 
 // AdminService implementation - User operations
 
 func (s *Server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.User, error) {
+	if err := domain.ValidateUserPassword(req.Password); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	user := &domain.User{
 		ID:              uuid.New().String(),
 		Username:        req.Username,
 		Password:        req.Password,
 		PublicKey:       req.PublicKey,
 		PrivateKey:      req.PrivateKey,
+		ProtocolSecret:  req.ProtocolSecret,
 		CACertList:      req.CaCertList,
 		Groups:          req.Groups,
 		AllowedDevices:  req.AllowedDevices,
+		AllowedNodes:    req.AllowedNodes,
+		AllowedServices: req.AllowedServices,
 		Status:          domain.UserStatusActive,
 		ActivePackageID: nil,
+
+		AllowedCountries: req.AllowedCountries,
+		DeniedCountries:  req.DeniedCountries,
 	}
 
 	if req.ActivePackageId != "" {
 		user.ActivePackageID = &req.ActivePackageId
 	}
+	if req.ManagerId != "" {
+		user.ManagerID = &req.ManagerId
+	}
 
 	if err := s.userDB.CreateUser(user); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create user: %v", err)
 	}
+	s.quota.InvalidateUser(user.ID)
 
 	return s.domainToProtoUser(user), nil
 }
@@ -228,6 +508,9 @@ func (s *Server) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.L
 	if req.Search != "" {
 		filter.Search = &req.Search
 	}
+	if req.ManagerId != "" {
+		filter.ManagerID = &req.ManagerId
+	}
 
 	users, err := s.userDB.ListUsers(filter)
 	if err != nil {
@@ -259,6 +542,9 @@ func (s *Server) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb
 		user.Username = req.Username
 	}
 	if req.Password != "" {
+		if err := domain.ValidateUserPassword(req.Password); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 		user.Password = req.Password
 	}
 	if req.PublicKey != "" {
@@ -267,6 +553,9 @@ func (s *Server) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb
 	if req.PrivateKey != "" {
 		user.PrivateKey = req.PrivateKey
 	}
+	if req.ProtocolSecret != "" {
+		user.ProtocolSecret = req.ProtocolSecret
+	}
 	if len(req.CaCertList) > 0 {
 		user.CACertList = req.CaCertList
 	}
@@ -276,16 +565,36 @@ func (s *Server) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb
 	if len(req.AllowedDevices) > 0 {
 		user.AllowedDevices = req.AllowedDevices
 	}
+	if len(req.AllowedNodes) > 0 {
+		user.AllowedNodes = req.AllowedNodes
+	}
+	if len(req.AllowedServices) > 0 {
+		user.AllowedServices = req.AllowedServices
+	}
+	if len(req.AllowedCountries) > 0 {
+		user.AllowedCountries = req.AllowedCountries
+	}
+	if len(req.DeniedCountries) > 0 {
+		user.DeniedCountries = req.DeniedCountries
+	}
+	previousStatus := user.Status
 	if req.Status != "" {
 		user.Status = domain.UserStatus(req.Status)
 	}
 	if req.ActivePackageId != "" {
 		user.ActivePackageID = &req.ActivePackageId
 	}
+	if req.ManagerId != "" {
+		user.ManagerID = &req.ManagerId
+	}
 
 	if err := s.userDB.UpdateUser(user); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
 	}
+	s.quota.InvalidateUser(user.ID)
+	if s.engine != nil {
+		s.engine.EmitStatusChange(user.ID, previousStatus, user.Status)
+	}
 
 	return s.domainToProtoUser(user), nil
 }
@@ -294,9 +603,29 @@ func (s *Server) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb
 	if err := s.userDB.DeleteUser(req.Id); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to delete user: %v", err)
 	}
+	s.quota.InvalidateUser(req.Id)
 	return &pb.Empty{}, nil
 }
 
+func (s *Server) DisconnectUser(ctx context.Context, req *pb.DisconnectUserRequest) (*pb.DisconnectUserResponse, error) {
+	if s.engine == nil {
+		return nil, status.Error(codes.FailedPrecondition, "usage engine not configured")
+	}
+	user, err := s.userDB.GetUser(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+
+	ended := s.engine.ForceDisconnect(user.ID, req.SessionId)
+	if req.SessionId != "" && ended == 0 {
+		return nil, status.Errorf(codes.NotFound, "session not found")
+	}
+	return &pb.DisconnectUserResponse{Sessions: int32(ended)}, nil
+}
+
 // AdminService implementation - Package operations
 
 func (s *Server) CreatePackage(ctx context.Context, req *pb.CreatePackageRequest) (*pb.Package, error) {
@@ -307,10 +636,65 @@ func (s *Server) CreatePackage(ctx context.Context, req *pb.CreatePackageRequest
 		TotalTraffic:  req.TotalTraffic,
 		UploadLimit:   req.UploadLimit,
 		DownloadLimit: req.DownloadLimit,
+		CountMode:     domain.CountMode(req.CountMode),
 		ResetMode:     domain.ResetMode(req.ResetMode),
 		Duration:      req.Duration,
 		MaxConcurrent: int(req.MaxConcurrent),
-		Status:        domain.PackageStatusActive,
+		MaxIPs:        int(req.MaxIps),
+		MaxDevices:    int(req.MaxDevices),
+
+		ThrottleThreshold: int(req.ThrottleThreshold),
+		ThrottleRate:      req.ThrottleRate,
+		PenaltyDuration:   req.PenaltyDuration,
+		PenaltyAction:     domain.PenaltyAction(req.PenaltyAction),
+		Priority:          domain.PackagePriority(req.Priority),
+		Status:            domain.PackageStatusActive,
+
+		SessionIdentity: domain.SessionIdentity(req.SessionIdentity),
+		SessionReplace:  domain.SessionReplace(req.SessionReplace),
+		AllowedNodes:    req.AllowedNodes,
+		AllowedServices: req.AllowedServices,
+
+		AllowedCountries: req.AllowedCountries,
+		DeniedCountries:  req.DeniedCountries,
+	}
+
+	if req.Priority != "" && !pkg.Priority.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid priority %q", req.Priority)
+	}
+	if req.SessionIdentity != "" && !pkg.SessionIdentity.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid session identity %q", req.SessionIdentity)
+	}
+	if req.SessionReplace != "" && !pkg.SessionReplace.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid session replace mode %q", req.SessionReplace)
+	}
+	if !pkg.CountMode.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid count mode %q", req.CountMode)
+	}
+	if req.MaxIps < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_ips must not be negative")
+	}
+	if req.MaxDevices < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_devices must not be negative")
+	}
+	if req.ThrottleThreshold < 0 || req.ThrottleThreshold > 100 {
+		return nil, status.Error(codes.InvalidArgument, "throttle_threshold must be between 0 and 100")
+	}
+	if req.ThrottleRate < 0 || (req.ThrottleThreshold > 0 && req.ThrottleRate == 0) {
+		return nil, status.Error(codes.InvalidArgument, "throttle_rate must be positive when throttle_threshold is set")
+	}
+	if req.PenaltyDuration < 0 {
+		return nil, status.Error(codes.InvalidArgument, "penalty_duration must not be negative")
+	}
+	if req.PenaltyAction != "" && !pkg.PenaltyAction.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid penalty action %q", req.PenaltyAction)
+	}
+	if req.QueuePosition < 0 {
+		return nil, status.Error(codes.InvalidArgument, "queue_position must not be negative")
+	}
+	if req.Queued {
+		pkg.Status = domain.PackageStatusQueued
+		pkg.QueuePosition = int(req.QueuePosition)
 	}
 
 	if req.StartAt > 0 {
@@ -321,6 +705,7 @@ func (s *Server) CreatePackage(ctx context.Context, req *pb.CreatePackageRequest
 	if err := s.userDB.CreatePackage(pkg); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create package: %v", err)
 	}
+	s.quota.InvalidateUser(pkg.UserID)
 
 	return s.domainToProtoPackage(pkg), nil
 }
@@ -349,6 +734,20 @@ func (s *Server) GetPackageByUser(ctx context.Context, req *pb.GetPackageByUserR
 	return s.domainToProtoPackage(pkg), nil
 }
 
+// ListUserPackages returns a user's packages, queued ones last in queue order
+func (s *Server) ListUserPackages(ctx context.Context, req *pb.ListUserPackagesRequest) (*pb.ListPackagesResponse, error) {
+	packages, err := s.userDB.ListUserPackages(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list packages: %v", err)
+	}
+
+	resp := &pb.ListPackagesResponse{Packages: make([]*pb.Package, 0, len(packages))}
+	for _, pkg := range packages {
+		resp.Packages = append(resp.Packages, s.domainToProtoPackage(pkg))
+	}
+	return resp, nil
+}
+
 func (s *Server) DeletePackage(ctx context.Context, req *pb.DeletePackageRequest) (*pb.Empty, error) {
 	// Not implemented - packages are deleted via user cascade
 	return &pb.Empty{}, nil
@@ -369,6 +768,10 @@ func (s *Server) CreateNode(ctx context.Context, req *pb.CreateNodeRequest) (*pb
 		Country:           req.Country,
 		City:              req.City,
 		ISP:               req.Isp,
+		MaxActiveUsers:    int(req.MaxActiveUsers),
+	}
+	if req.ManagerId != "" {
+		node.ManagerID = &req.ManagerId
 	}
 
 	if err := s.userDB.CreateNode(node); err != nil {
@@ -386,6 +789,9 @@ func (s *Server) GetNode(ctx context.Context, req *pb.GetNodeRequest) (*pb.Node,
 	if node == nil {
 		return nil, status.Errorf(codes.NotFound, "node not found")
 	}
+	if s.engine != nil {
+		node.Health = s.engine.NodeHealth(node)
+	}
 
 	return s.domainToProtoNode(node), nil
 }
@@ -395,6 +801,9 @@ func (s *Server) ListNodes(ctx context.Context, req *pb.Empty) (*pb.ListNodesRes
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to list nodes: %v", err)
 	}
+	if s.engine != nil {
+		s.engine.AttachNodeHealth(nodes)
+	}
 
 	protoNodes := make([]*pb.Node, len(nodes))
 	for i, n := range nodes {
@@ -429,6 +838,9 @@ func (s *Server) CreateService(ctx context.Context, req *pb.CreateServiceRequest
 		AllowedAuthMethods: authMethods,
 		CallbackURL:        req.CallbackUrl,
 	}
+	if req.ManagerId != "" {
+		service.ManagerID = &req.ManagerId
+	}
 
 	if err := s.userDB.CreateService(service); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create service: %v", err)
@@ -449,6 +861,63 @@ func (s *Server) GetService(ctx context.Context, req *pb.GetServiceRequest) (*pb
 	return s.domainToProtoService(service), nil
 }
 
+func (s *Server) ListServices(ctx context.Context, req *pb.ListServicesRequest) (*pb.ListServicesResponse, error) {
+	filter := &domain.ServiceFilter{}
+	if req.NodeId != "" {
+		filter.NodeID = &req.NodeId
+	}
+	if req.ManagerId != "" {
+		filter.ManagerID = &req.ManagerId
+	}
+
+	services, err := s.userDB.ListServicesFiltered(filter)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list services: %v", err)
+	}
+
+	protoServices := make([]*pb.Service, len(services))
+	for i, service := range services {
+		protoServices[i] = s.domainToProtoService(service)
+	}
+
+	return &pb.ListServicesResponse{Services: protoServices}, nil
+}
+
+func (s *Server) UpdateService(ctx context.Context, req *pb.UpdateServiceRequest) (*pb.Service, error) {
+	service, err := s.userDB.GetService(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get service: %v", err)
+	}
+	if service == nil {
+		return nil, status.Errorf(codes.NotFound, "service not found")
+	}
+
+	// Update fields
+	if req.Name != "" {
+		service.Name = req.Name
+	}
+	if req.SecretKey != "" {
+		service.SecretKey = req.SecretKey
+		service.AccessToken = req.SecretKey
+	}
+	if len(req.AllowedAuthMethods) > 0 {
+		authMethods := make([]domain.AuthMethod, len(req.AllowedAuthMethods))
+		for i, m := range req.AllowedAuthMethods {
+			authMethods[i] = domain.AuthMethod(m)
+		}
+		service.AllowedAuthMethods = authMethods
+	}
+	if req.CallbackUrl != "" {
+		service.CallbackURL = req.CallbackUrl
+	}
+
+	if err := s.userDB.UpdateService(service); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update service: %v", err)
+	}
+
+	return s.domainToProtoService(service), nil
+}
+
 func (s *Server) DeleteService(ctx context.Context, req *pb.DeleteServiceRequest) (*pb.Empty, error) {
 	if err := s.userDB.DeleteService(req.Id); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to delete service: %v", err)
@@ -456,116 +925,799 @@ func (s *Server) DeleteService(ctx context.Context, req *pb.DeleteServiceRequest
 	return &pb.Empty{}, nil
 }
 
-// AdminService implementation - Event operations
+// AdminService implementation - Group operations
 
-func (s *Server) GetEvents(ctx context.Context, req *pb.GetEventsRequest) (*pb.GetEventsResponse, error) {
-	var eventType *domain.EventType
-	if req.Type != "" {
-		t := domain.EventType(req.Type)
-		eventType = &t
+func (s *Server) CreateGroup(ctx context.Context, req *pb.CreateGroupRequest) (*pb.Group, error) {
+	if req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "name is required")
 	}
 
-	var userID *string
-	if req.UserId != "" {
-		userID = &req.UserId
+	group := &domain.Group{
+		Name:          req.Name,
+		TotalLimit:    req.TotalLimit,
+		UploadLimit:   req.UploadLimit,
+		DownloadLimit: req.DownloadLimit,
+		MaxConcurrent: int(req.MaxConcurrent),
+		AllowedNodes:  req.AllowedNodes,
+
+		PenaltyDuration:  req.PenaltyDuration,
+		PenaltyAction:    domain.PenaltyAction(req.PenaltyAction),
+		AllowedCountries: req.AllowedCountries,
+		DeniedCountries:  req.DeniedCountries,
+	}
+	if group.HasNegativeLimits() {
+		return nil, status.Errorf(codes.InvalidArgument, "group limits must not be negative")
+	}
+	if group.PenaltyAction != "" && !group.PenaltyAction.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid penalty action %q", req.PenaltyAction)
 	}
 
-	events, err := s.events.GetEvents(eventType, userID, int(req.Limit))
+	existing, err := s.userDB.GetGroup(group.Name)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get events: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to get group: %v", err)
+	}
+	if existing != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "group already exists")
 	}
 
-	protoEvents := make([]*pb.Event, len(events))
-	for i, e := range events {
-		protoEvents[i] = s.domainToProtoEvent(e)
+	if err := s.userDB.CreateGroup(group); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create group: %v", err)
 	}
 
-	return &pb.GetEventsResponse{Events: protoEvents}, nil
+	return s.GetGroup(ctx, &pb.GetGroupRequest{Name: group.Name})
 }
 
-// NodeService implementation
-
-func (s *Server) Authenticate(ctx context.Context, req *pb.AuthenticateRequest) (*pb.AuthenticateResponse, error) {
-	node, err := s.userDB.GetNodeBySecretKey(req.SecretKey)
+func (s *Server) GetGroup(ctx context.Context, req *pb.GetGroupRequest) (*pb.Group, error) {
+	group, err := s.userDB.GetGroup(req.Name)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "authentication failed: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to get group: %v", err)
 	}
-	if node == nil {
-		return &pb.AuthenticateResponse{
-			Success: false,
-			Error:   "invalid secret key",
-		}, nil
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "group not found")
 	}
 
-	return &pb.AuthenticateResponse{
-		Success: true,
-		NodeId:  node.ID,
-	}, nil
+	return domainToProtoGroup(group), nil
 }
 
-func (s *Server) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
-	// Update node stats
-	if req.NodeId != "" {
-		// Node heartbeat - could update last_seen timestamp
-		s.logger.Debug("node heartbeat", zap.String("node_id", req.NodeId))
+func (s *Server) ListGroups(ctx context.Context, req *pb.Empty) (*pb.ListGroupsResponse, error) {
+	groups, err := s.userDB.ListGroups()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list groups: %v", err)
 	}
 
-	return &pb.HeartbeatResponse{Acknowledged: true}, nil
-}
-
-// Conversion helpers
-
-func (s *Server) protoToDomainUsageReport(pb *pb.UsageReport) *domain.UsageReport {
-	return &domain.UsageReport{
-		ID:        pb.Id,
-		UserID:    pb.UserId,
-		NodeID:    pb.NodeId,
-		ServiceID: pb.ServiceId,
-		Upload:    pb.Upload,
-		Download:  pb.Download,
-		SessionID: pb.SessionId,
-		ClientIP:  pb.ClientIp,
-		Tags:      pb.Tags,
-		Timestamp: domain.ParseTime(pb.Timestamp),
+	protoGroups := make([]*pb.Group, len(groups))
+	for i, group := range groups {
+		protoGroups[i] = domainToProtoGroup(group)
 	}
+
+	return &pb.ListGroupsResponse{Groups: protoGroups}, nil
 }
 
-func (s *Server) domainToProtoResult(r *domain.UsageReportResult) *pb.UsageReportResult {
-	return &pb.UsageReportResult{
-		UserId:           r.UserID,
-		PackageId:        r.PackageID,
-		Accepted:         r.Accepted,
-		QuotaExceeded:    r.QuotaExceeded,
-		SessionLimitHit:  r.SessionLimitHit,
-		PenaltyApplied:   r.PenaltyApplied,
-		ShouldDisconnect: r.ShouldDisconnect,
-		Reason:           r.Reason,
+func (s *Server) UpdateGroup(ctx context.Context, req *pb.UpdateGroupRequest) (*pb.Group, error) {
+	group, err := s.userDB.GetGroup(req.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get group: %v", err)
+	}
+	if group == nil {
+		return nil, status.Errorf(codes.NotFound, "group not found")
 	}
-}
 
-func (s *Server) domainToProtoUser(u *domain.User) *pb.User {
-	var firstConn, lastConn int64
-	if u.FirstConnectionAt != nil {
-		firstConn = u.FirstConnectionAt.Unix()
+	group.TotalLimit = req.TotalLimit
+	group.UploadLimit = req.UploadLimit
+	group.DownloadLimit = req.DownloadLimit
+	group.MaxConcurrent = int(req.MaxConcurrent)
+	group.AllowedNodes = req.AllowedNodes
+	group.AllowedCountries = req.AllowedCountries
+	group.DeniedCountries = req.DeniedCountries
+	group.PenaltyDuration = req.PenaltyDuration
+	group.PenaltyAction = domain.PenaltyAction(req.PenaltyAction)
+	if group.HasNegativeLimits() {
+		return nil, status.Errorf(codes.InvalidArgument, "group limits must not be negative")
 	}
-	if u.LastConnectionAt != nil {
-		lastConn = u.LastConnectionAt.Unix()
+	if group.PenaltyAction != "" && !group.PenaltyAction.IsValid() {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid penalty action %q", req.PenaltyAction)
 	}
 
-	var activePkgID string
-	if u.ActivePackageID != nil {
-		activePkgID = *u.ActivePackageID
+	if err := s.userDB.UpdateGroup(group); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update group: %v", err)
 	}
 
-	return &pb.User{
-		Id:                u.ID,
-		Username:          u.Username,
-		PublicKey:         u.PublicKey,
+	return s.GetGroup(ctx, &pb.GetGroupRequest{Name: group.Name})
+}
+
+func (s *Server) DeleteGroup(ctx context.Context, req *pb.DeleteGroupRequest) (*pb.Empty, error) {
+	if err := s.userDB.DeleteGroup(req.Name); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete group: %v", err)
+	}
+	return &pb.Empty{}, nil
+}
+
+// AdminService implementation - Device operations
+
+func (s *Server) ListUserDevices(ctx context.Context, req *pb.ListUserDevicesRequest) (*pb.ListDevicesResponse, error) {
+	user, err := s.userDB.GetUser(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get user: %v", err)
+	}
+	if user == nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+
+	devices, err := s.userDB.ListUserDevices(req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list devices: %v", err)
+	}
+
+	resp := &pb.ListDevicesResponse{Devices: make([]*pb.Device, len(devices))}
+	for i, d := range devices {
+		resp.Devices[i] = domainToProtoDevice(d)
+	}
+	return resp, nil
+}
+
+func (s *Server) ApproveDevice(ctx context.Context, req *pb.DeviceRequest) (*pb.Device, error) {
+	if req.DeviceId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "device_id is required")
+	}
+	device, err := s.quota.ApproveDevice(req.UserId, req.DeviceId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to approve device: %v", err)
+	}
+	if device == nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	return domainToProtoDevice(device), nil
+}
+
+func (s *Server) RemoveDevice(ctx context.Context, req *pb.DeviceRequest) (*pb.Empty, error) {
+	removed, err := s.quota.RemoveDevice(req.UserId, req.DeviceId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to remove device: %v", err)
+	}
+	if !removed {
+		return nil, status.Errorf(codes.NotFound, "device not found")
+	}
+	return &pb.Empty{}, nil
+}
+
+// AdminService implementation - Manager operations
+
+func (s *Server) CreateManager(ctx context.Context, req *pb.CreateManagerRequest) (*pb.Manager, error) {
+	if req.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "name is required")
+	}
+
+	manager := &domain.Manager{ID: req.Id, Name: req.Name}
+	if manager.ID == "" {
+		manager.ID = uuid.New().String()
+	} else if existing, err := s.userDB.GetManager(manager.ID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get manager: %v", err)
+	} else if existing != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "manager already exists")
+	}
+	if req.ParentId != "" {
+		manager.ParentID = &req.ParentId
+	}
+	if req.Metadata != "" {
+		if err := json.Unmarshal([]byte(req.Metadata), &manager.Metadata); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metadata: %v", err)
+		}
+	}
+	manager.Package = protoToManagerLimits(req.Package).NewPackage(manager.ID)
+	if err := s.validateManager(manager); err != nil {
+		return nil, err
+	}
+
+	if err := s.userDB.CreateManager(manager); err != nil {
+		return nil, managerError("create", err)
+	}
+
+	return s.GetManager(ctx, &pb.GetManagerRequest{Id: manager.ID})
+}
+
+func (s *Server) GetManager(ctx context.Context, req *pb.GetManagerRequest) (*pb.Manager, error) {
+	manager, err := s.userDB.GetManager(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get manager: %v", err)
+	}
+	if manager == nil {
+		return nil, status.Errorf(codes.NotFound, "manager not found")
+	}
+
+	return s.domainToProtoManager(manager), nil
+}
+
+func (s *Server) ListManagers(ctx context.Context, req *pb.ListManagersRequest) (*pb.ListManagersResponse, error) {
+	var managers []*domain.Manager
+	var err error
+	if req.ParentId != "" {
+		managers, err = s.userDB.ListManagerChildren(req.ParentId)
+	} else {
+		managers, err = s.userDB.ListManagers()
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list managers: %v", err)
+	}
+
+	protoManagers := make([]*pb.Manager, len(managers))
+	for i, m := range managers {
+		protoManagers[i] = s.domainToProtoManager(m)
+	}
+
+	return &pb.ListManagersResponse{Managers: protoManagers}, nil
+}
+
+func (s *Server) UpdateManager(ctx context.Context, req *pb.UpdateManagerRequest) (*pb.Manager, error) {
+	manager, err := s.userDB.GetManager(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get manager: %v", err)
+	}
+	if manager == nil {
+		return nil, status.Errorf(codes.NotFound, "manager not found")
+	}
+
+	// Update fields
+	if req.Name != "" {
+		manager.Name = req.Name
+	}
+	if req.ClearParent {
+		manager.ParentID = nil
+	} else if req.ParentId != "" {
+		manager.ParentID = &req.ParentId
+	}
+	if req.Metadata != "" {
+		var metadata map[string]interface{}
+		if err := json.Unmarshal([]byte(req.Metadata), &metadata); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metadata: %v", err)
+		}
+		manager.Metadata = metadata
+	}
+	if manager.Package == nil {
+		manager.Package = domain.ManagerPackageLimits{}.NewPackage(manager.ID)
+	}
+	if req.Package != nil {
+		limits := protoToManagerLimits(req.Package)
+		if limits.ResetMode == "" {
+			limits.ResetMode = manager.Package.ResetMode
+		}
+		if limits.Status == "" {
+			limits.Status = manager.Package.Status
+		}
+		manager.Package = limits.NewPackage(manager.ID)
+	}
+	if err := s.validateManager(manager); err != nil {
+		return nil, err
+	}
+
+	if err := s.userDB.UpdateManager(manager); err != nil {
+		return nil, managerError("update", err)
+	}
+
+	return s.GetManager(ctx, &pb.GetManagerRequest{Id: manager.ID})
+}
+
+func (s *Server) DeleteManager(ctx context.Context, req *pb.DeleteManagerRequest) (*pb.Empty, error) {
+	manager, err := s.userDB.GetManager(req.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get manager: %v", err)
+	}
+	if manager == nil {
+		return nil, status.Errorf(codes.NotFound, "manager not found")
+	}
+
+	if err := s.userDB.DeleteManager(req.Id); err != nil {
+		return nil, managerError("delete", err)
+	}
+	return &pb.Empty{}, nil
+}
+
+// AdminService implementation - Auth key operations
+
+// ListAuthKeys describes the owner key and the service keys without the
+// keys themselves
+func (s *Server) ListAuthKeys(ctx context.Context, _ *pb.Empty) (*pb.ListAuthKeysResponse, error) {
+	keys, err := s.userDB.ListAuthKeys()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list auth keys: %v", err)
+	}
+
+	resp := &pb.ListAuthKeysResponse{Keys: make([]*pb.AuthKey, 0, len(keys))}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, domainToProtoAuthKey(key))
+	}
+	return resp, nil
+}
+
+// RotateOwnerKey replaces the stored owner key; the old key keeps working
+// for overlap_seconds
+func (s *Server) RotateOwnerKey(ctx context.Context, req *pb.IssueAuthKeyRequest) (*pb.IssuedAuthKey, error) {
+	if s.secret != "" {
+		return nil, status.Error(codes.FailedPrecondition, "the owner key is set by HUE_AUTH_SECRET; change it there")
+	}
+	expiresAt, overlap, err := authKeyIssueParams(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rawKey, err := s.userDB.RotateOwnerAuthKey(expiresAt, overlap)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to rotate owner key: %v", err)
+	}
+	if rawKey == "" {
+		return nil, status.Error(codes.NotFound, "owner key not found")
+	}
+	s.logger.Info("rotated owner key", zap.Duration("overlap", overlap))
+	return s.issuedAuthKey("", rawKey)
+}
+
+// CreateServiceKey gives a service a new key, replacing its current one at
+// once
+func (s *Server) CreateServiceKey(ctx context.Context, req *pb.IssueAuthKeyRequest) (*pb.IssuedAuthKey, error) {
+	expiresAt, _, err := authKeyIssueParams(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueServiceKey(req.ServiceId, expiresAt, 0)
+}
+
+// RotateServiceKey gives a service a new key; the old key keeps working for
+// overlap_seconds
+func (s *Server) RotateServiceKey(ctx context.Context, req *pb.IssueAuthKeyRequest) (*pb.IssuedAuthKey, error) {
+	expiresAt, overlap, err := authKeyIssueParams(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueServiceKey(req.ServiceId, expiresAt, overlap)
+}
+
+// RevokeServiceKey revokes a service's key, and the key its last rotation
+// replaced
+func (s *Server) RevokeServiceKey(ctx context.Context, req *pb.RevokeServiceKeyRequest) (*pb.Empty, error) {
+	ok, err := s.userDB.RevokeServiceAuthKey(req.ServiceId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke service key: %v", err)
+	}
+	if !ok {
+		return nil, status.Error(codes.NotFound, "service key not found")
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *Server) issueServiceKey(serviceID string, expiresAt *time.Time, overlap time.Duration) (*pb.IssuedAuthKey, error) {
+	if serviceID == "" {
+		return nil, status.Error(codes.InvalidArgument, "service_id is required")
+	}
+	rawKey, err := s.userDB.RotateServiceAuthKey(serviceID, expiresAt, overlap)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to issue service key: %v", err)
+	}
+	if rawKey == "" {
+		return nil, status.Error(codes.NotFound, "service not found")
+	}
+	s.logger.Info("issued service key", zap.String("service_id", serviceID), zap.Duration("overlap", overlap))
+	return s.issuedAuthKey(serviceID, rawKey)
+}
+
+func (s *Server) issuedAuthKey(serviceID, rawKey string) (*pb.IssuedAuthKey, error) {
+	key, err := s.userDB.GetAuthKey(serviceID)
+	if err != nil || key == nil {
+		return nil, status.Errorf(codes.Internal, "failed to read the new key: %v", err)
+	}
+	return &pb.IssuedAuthKey{Key: rawKey, Info: domainToProtoAuthKey(key)}, nil
+}
+
+// authKeyIssueParams returns the expiry and overlap of a new key
+func authKeyIssueParams(req *pb.IssueAuthKeyRequest) (*time.Time, time.Duration, error) {
+	if req.ExpiresInSeconds < 0 || req.OverlapSeconds < 0 {
+		return nil, 0, status.Error(codes.InvalidArgument, "expires_in_seconds and overlap_seconds must not be negative")
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInSeconds > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		expiresAt = &t
+	}
+	return expiresAt, time.Duration(req.OverlapSeconds) * time.Second, nil
+}
+
+func domainToProtoAuthKey(k *domain.AuthKey) *pb.AuthKey {
+	unix := func(t *time.Time) int64 {
+		if t == nil {
+			return 0
+		}
+		return t.Unix()
+	}
+	return &pb.AuthKey{
+		Kind:              string(k.Kind),
+		ServiceId:         k.ServiceID,
+		Revoked:           k.Revoked,
+		ExpiresAt:         unix(k.ExpiresAt),
+		LastUsedAt:        unix(k.LastUsedAt),
+		PreviousExpiresAt: unix(k.PreviousExpiresAt),
+		CreatedAt:         k.CreatedAt.Unix(),
+		UpdatedAt:         k.UpdatedAt.Unix(),
+	}
+}
+
+// validateManager checks a manager's package and that its parent exists
+func (s *Server) validateManager(manager *domain.Manager) error {
+	if manager.Package.HasNegativeLimits() {
+		return status.Errorf(codes.InvalidArgument, "manager package limits must not be negative")
+	}
+	if !manager.Package.Status.IsValid() {
+		return status.Errorf(codes.InvalidArgument, "unknown manager package status %q", manager.Package.Status)
+	}
+	if !manager.HasParent() {
+		return nil
+	}
+
+	parent, err := s.userDB.GetManager(*manager.ParentID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get parent manager: %v", err)
+	}
+	if parent == nil {
+		return status.Errorf(codes.InvalidArgument, "parent manager not found")
+	}
+	return nil
+}
+
+// managerError maps a manager storage error to a status
+func managerError(action string, err error) error {
+	switch {
+	case errors.Is(err, sqlite.ErrManagerExceedsParent), errors.Is(err, sqlite.ErrManagerCycle):
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	case errors.Is(err, sqlite.ErrManagerInUse):
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	return status.Errorf(codes.Internal, "failed to %s manager: %v", action, err)
+}
+
+// AdminService implementation - Event operations
+
+func (s *Server) GetEvents(ctx context.Context, req *pb.GetEventsRequest) (*pb.GetEventsResponse, error) {
+	var eventType *domain.EventType
+	if req.Type != "" {
+		t := domain.EventType(req.Type)
+		eventType = &t
+	}
+
+	var userID *string
+	if req.UserId != "" {
+		userID = &req.UserId
+	}
+
+	events, err := s.events.GetEvents(eventType, userID, int(req.Limit))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get events: %v", err)
+	}
+
+	protoEvents := make([]*pb.Event, len(events))
+	for i, e := range events {
+		protoEvents[i] = s.domainToProtoEvent(e)
+	}
+
+	return &pb.GetEventsResponse{Events: protoEvents}, nil
+}
+
+// NodeService implementation
+
+func (s *Server) Authenticate(ctx context.Context, req *pb.AuthenticateRequest) (*pb.AuthenticateResponse, error) {
+	version, ok := pb.NegotiateAPIVersion(req.ApiVersion)
+	if !ok {
+		return &pb.AuthenticateResponse{
+			Success:       false,
+			Error:         fmt.Sprintf("API version %d is no longer supported", req.ApiVersion),
+			MinApiVersion: pb.MinAPIVersion,
+		}, nil
+	}
+
+	node, err := s.userDB.GetNodeBySecretKey(req.SecretKey)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "authentication failed: %v", err)
+	}
+	if node == nil {
+		return &pb.AuthenticateResponse{
+			Success: false,
+			Error:   "invalid secret key",
+		}, nil
+	}
+
+	return &pb.AuthenticateResponse{
+		Success:       true,
+		NodeId:        node.ID,
+		ApiVersion:    version,
+		MinApiVersion: pb.MinAPIVersion,
+	}, nil
+}
+
+func (s *Server) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	version, ok := pb.NegotiateAPIVersion(req.ApiVersion)
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "API version %d is no longer supported, need at least %d", req.ApiVersion, pb.MinAPIVersion)
+	}
+	resp := &pb.HeartbeatResponse{Acknowledged: true, ApiVersion: version, MinApiVersion: pb.MinAPIVersion}
+
+	// A service key may only report load for its own node, as in SyncNode
+	nodeID := req.NodeId
+	if c := callerFromContext(ctx); c != nil && c.service != nil {
+		if nodeID == "" {
+			nodeID = c.service.NodeID
+		}
+		if nodeID != c.service.NodeID {
+			return nil, status.Error(codes.PermissionDenied, "service key belongs to another node")
+		}
+	}
+
+	if nodeID == "" {
+		return resp, nil
+	}
+	s.logger.Debug("node heartbeat", zap.String("node_id", nodeID))
+
+	load := &domain.NodeLoad{
+		NodeID:            nodeID,
+		CPUPercent:        req.CpuPercent,
+		ActiveConnections: req.ActiveConnections,
+		BandwidthBps:      req.BandwidthBps,
+		Overloaded:        req.Overloaded,
+		ShedSessions:      int(req.ShedSessions),
+		AgentVersion:      req.AgentVersion,
+	}
+	if load.Overloaded && load.ShedSessions <= 0 {
+		load.ShedSessions = 1
+	}
+
+	if s.engine != nil {
+		res, err := s.engine.HandleNodeLoad(load)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to handle node load: %v", err)
+		}
+		resp.Draining = res.Draining
+		resp.SessionsShed = int32(res.SessionsShed)
+		return resp, nil
+	}
+
+	if err := s.userDB.RecordNodeHeartbeat(load, time.Now()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record heartbeat: %v", err)
+	}
+
+	// Without an engine, shed the lowest priority sessions first when the
+	// node itself signals congestion
+	if load.Overloaded {
+		shed := s.session.ShedNodeSessions(nodeID, load.ShedSessions, s.quota.UserPriority, string(domain.ReasonNodeOverloaded))
+		resp.SessionsShed = int32(shed)
+	}
+
+	return resp, nil
+}
+
+// SyncNode returns the users a node may serve, so it can keep enforcing
+// limits during a HUE outage. A service key may only sync its own node.
+func (s *Server) SyncNode(ctx context.Context, req *pb.SyncNodeRequest) (*pb.SyncNodeResponse, error) {
+	return s.syncNode(ctx, req.NodeId, req.Cursor)
+}
+
+// GetUsersForNode is SyncNode for agents that generate proxy configs from
+// the users of their node and keep them current with the returned cursor
+func (s *Server) GetUsersForNode(ctx context.Context, req *pb.GetUsersForNodeRequest) (*pb.SyncNodeResponse, error) {
+	return s.syncNode(ctx, req.NodeId, req.Since)
+}
+
+func (s *Server) syncNode(ctx context.Context, requestedNodeID string, cursor int64) (*pb.SyncNodeResponse, error) {
+	nodeID, err := callerNodeID(ctx, requestedNodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	sync, err := s.quota.NodeSync(nodeID, cursor)
+	if errors.Is(err, engine.ErrUnknownNode) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to sync node: %v", err)
+	}
+
+	resp := &pb.SyncNodeResponse{
+		NodeId:  sync.NodeID,
+		Cursor:  sync.Cursor,
+		Full:    sync.Full,
+		Users:   make([]*pb.NodeSyncUser, 0, len(sync.Users)),
+		Removed: sync.Removed,
+	}
+	for _, u := range sync.Users {
+		user := &pb.NodeSyncUser{
+			UserId:         u.UserID,
+			Username:       u.Username,
+			PublicKey:      u.PublicKey,
+			ProtocolSecret: u.ProtocolSecret,
+			Status:         string(u.Status),
+			Remaining:      u.Remaining,
+			MaxConcurrent:  int32(u.MaxConcurrent),
+			MaxIps:         int32(u.MaxIPs),
+		}
+		if u.ExpiresAt != nil {
+			user.ExpiresAt = u.ExpiresAt.Unix()
+		}
+		resp.Users = append(resp.Users, user)
+	}
+	return resp, nil
+}
+
+// VerifyUserPassword checks a user's password for services that
+// authenticate by password. A service key's service must allow the password
+// auth method.
+func (s *Server) VerifyUserPassword(ctx context.Context, req *pb.VerifyUserPasswordRequest) (*pb.VerifyUserPasswordResponse, error) {
+	if c := callerFromContext(ctx); c != nil && c.service != nil && !slices.Contains(c.service.AllowedAuthMethods, domain.AuthMethodPassword) {
+		return nil, status.Error(codes.PermissionDenied, "service does not allow password authentication")
+	}
+
+	user, err := s.userDB.VerifyUserPassword(req.Username, req.Password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to verify password: %v", err)
+	}
+	if user == nil {
+		return &pb.VerifyUserPasswordResponse{}, nil
+	}
+	return &pb.VerifyUserPasswordResponse{Valid: true, UserId: user.ID}, nil
+}
+
+// AuthorizeConnection answers whether a client may connect with the
+// credentials it presented, so nodes can authenticate users they do not
+// hold. The service must run on the node and allow the auth method.
+func (s *Server) AuthorizeConnection(ctx context.Context, req *pb.AuthorizeConnectionRequest) (*pb.AuthorizeConnectionResponse, error) {
+	source := &domain.UsageReport{NodeID: req.NodeId, ServiceID: req.ServiceId}
+	var callerServiceID string
+	if c := callerFromContext(ctx); c != nil && c.service != nil {
+		callerServiceID = c.service.ID
+	}
+	if err := s.quota.ValidateReportSource(source, callerServiceID); err != nil {
+		return nil, reportSourceStatus(err)
+	}
+	if source.ServiceID == "" {
+		return nil, status.Error(codes.InvalidArgument, "service_id is required")
+	}
+	if s.engine == nil {
+		return nil, status.Error(codes.FailedPrecondition, "usage engine not configured")
+	}
+
+	decision, err := s.engine.AuthorizeConnection(&domain.ConnectionRequest{
+		NodeID:    source.NodeID,
+		ServiceID: source.ServiceID,
+		SessionID: req.SessionId,
+		ClientIP:  req.ClientIp,
+		Method:    domain.AuthMethod(req.AuthMethod),
+		UserID:    req.UserId,
+		Username:  req.Username,
+		Password:  req.Password,
+		PublicKey: req.PublicKey,
+	})
+	switch {
+	case errors.Is(err, engine.ErrAuthMethodNotAllowed):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, engine.ErrUnsupportedAuthMethod):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to authorize connection: %v", err)
+	}
+
+	return &pb.AuthorizeConnectionResponse{
+		Allowed:        decision.Allowed,
+		UserId:         decision.UserID,
+		PackageId:      decision.PackageID,
+		Reason:         decision.Reason,
+		ReasonCode:     string(decision.ReasonCode),
+		MaxConcurrent:  int32(decision.MaxConcurrent),
+		MaxIps:         int32(decision.MaxIPs),
+		ActiveSessions: int32(decision.ActiveSessions),
+		RateLimit:      decision.RateLimit,
+	}, nil
+}
+
+// GetDisconnectReasons returns the reason code catalog with texts in the
+// requested language, so node agents render the same messages as the API
+func (s *Server) GetDisconnectReasons(ctx context.Context, req *pb.GetDisconnectReasonsRequest) (*pb.GetDisconnectReasonsResponse, error) {
+	lang := domain.NegotiateLanguage(req.Language)
+
+	reasons := domain.DisconnectReasons()
+	resp := &pb.GetDisconnectReasonsResponse{
+		Language: lang,
+		Reasons:  make([]*pb.DisconnectReason, 0, len(reasons)),
+	}
+	for _, r := range reasons {
+		resp.Reasons = append(resp.Reasons, &pb.DisconnectReason{
+			Code:      string(r.Code),
+			Penalty:   r.Penalty,
+			Retryable: r.Retryable,
+			Message:   r.Message(lang),
+		})
+	}
+	return resp, nil
+}
+
+// Conversion helpers
+
+func (s *Server) protoToDomainUsageReport(pb *pb.UsageReport) *domain.UsageReport {
+	return &domain.UsageReport{
+		ID:        pb.Id,
+		UserID:    pb.UserId,
+		NodeID:    pb.NodeId,
+		ServiceID: pb.ServiceId,
+		Upload:    pb.Upload,
+		Download:  pb.Download,
+		SessionID: pb.SessionId,
+		ClientIP:  pb.ClientIp,
+		DeviceID:  pb.DeviceId,
+		Tags:      pb.Tags,
+		Timestamp: domain.ParseTime(pb.Timestamp),
+
+		CounterMode: domain.CounterMode(pb.CounterMode),
+	}
+}
+
+func domainToProtoDisconnect(cmd *cache.DisconnectCommand) *pb.DisconnectCommand {
+	return &pb.DisconnectCommand{
+		Id:        cmd.ID,
+		UserId:    cmd.UserID,
+		SessionId: cmd.SessionID,
+		Reason:    cmd.Reason,
+		NodeId:    cmd.NodeID,
+	}
+}
+
+func (s *Server) domainToProtoResult(r *domain.UsageReportResult) *pb.UsageReportResult {
+	return &pb.UsageReportResult{
+		UserId:             r.UserID,
+		PackageId:          r.PackageID,
+		Accepted:           r.Accepted,
+		QuotaExceeded:      r.QuotaExceeded,
+		SessionLimitHit:    r.SessionLimitHit,
+		PenaltyApplied:     r.PenaltyApplied,
+		ShouldDisconnect:   r.ShouldDisconnect,
+		Reason:             r.Reason,
+		Priority:           string(r.Priority),
+		ReasonCode:         string(r.ReasonCode),
+		PenaltyReason:      r.PenaltyReason,
+		PenaltySecondsLeft: r.PenaltySecondsLeft,
+		RawUpload:          r.RawUpload,
+		RawDownload:        r.RawDownload,
+		BilledUpload:       r.BilledUpload,
+		BilledDownload:     r.BilledDownload,
+		Queued:             r.Queued,
+		Backfilled:         r.Backfilled,
+		RateLimit:          r.RateLimit,
+		Duplicate:          r.Duplicate,
+	}
+}
+
+func (s *Server) domainToProtoUser(u *domain.User) *pb.User {
+	var firstConn, lastConn int64
+	if u.FirstConnectionAt != nil {
+		firstConn = u.FirstConnectionAt.Unix()
+	}
+	if u.LastConnectionAt != nil {
+		lastConn = u.LastConnectionAt.Unix()
+	}
+
+	var activePkgID, managerID string
+	if u.ActivePackageID != nil {
+		activePkgID = *u.ActivePackageID
+	}
+	if u.ManagerID != nil {
+		managerID = *u.ManagerID
+	}
+
+	return &pb.User{
+		Id:                u.ID,
+		Username:          u.Username,
+		PublicKey:         u.PublicKey,
 		CaCertList:        u.CACertList,
 		Groups:            u.Groups,
 		AllowedDevices:    u.AllowedDevices,
+		AllowedNodes:      u.AllowedNodes,
+		AllowedServices:   u.AllowedServices,
+		AllowedCountries:  u.AllowedCountries,
+		DeniedCountries:   u.DeniedCountries,
 		Status:            string(u.Status),
 		ActivePackageId:   activePkgID,
+		ManagerId:         managerID,
 		FirstConnectionAt: firstConn,
 		LastConnectionAt:  lastConn,
 		CreatedAt:         u.CreatedAt.Unix(),
@@ -583,26 +1735,57 @@ func (s *Server) domainToProtoPackage(p *domain.Package) *pb.Package {
 	}
 
 	return &pb.Package{
-		Id:              p.ID,
-		UserId:          p.UserID,
-		TotalTraffic:    p.TotalTraffic,
-		UploadLimit:     p.UploadLimit,
-		DownloadLimit:   p.DownloadLimit,
-		ResetMode:       string(p.ResetMode),
-		Duration:        p.Duration,
-		StartAt:         startAt,
-		MaxConcurrent:   int32(p.MaxConcurrent),
-		Status:          string(p.Status),
-		CurrentUpload:   p.CurrentUpload,
-		CurrentDownload: p.CurrentDownload,
-		CurrentTotal:    p.CurrentTotal,
-		ExpiresAt:       expiresAt,
-		CreatedAt:       p.CreatedAt.Unix(),
-		UpdatedAt:       p.UpdatedAt.Unix(),
+		Id:                p.ID,
+		UserId:            p.UserID,
+		TotalTraffic:      p.TotalTraffic,
+		UploadLimit:       p.UploadLimit,
+		DownloadLimit:     p.DownloadLimit,
+		CountMode:         string(p.CountMode),
+		ResetMode:         string(p.ResetMode),
+		Duration:          p.Duration,
+		StartAt:           startAt,
+		MaxConcurrent:     int32(p.MaxConcurrent),
+		MaxIps:            int32(p.MaxIPs),
+		MaxDevices:        int32(p.MaxDevices),
+		ThrottleThreshold: int32(p.ThrottleThreshold),
+		ThrottleRate:      p.ThrottleRate,
+		PenaltyDuration:   p.PenaltyDuration,
+		PenaltyAction:     string(p.PenaltyAction),
+		Priority:          string(p.Priority),
+		SessionIdentity:   string(p.SessionIdentity),
+		SessionReplace:    string(p.SessionReplace),
+		AllowedNodes:      p.AllowedNodes,
+		AllowedServices:   p.AllowedServices,
+		AllowedCountries:  p.AllowedCountries,
+		DeniedCountries:   p.DeniedCountries,
+		Status:            string(p.Status),
+		CurrentUpload:     p.CurrentUpload,
+		CurrentDownload:   p.CurrentDownload,
+		CurrentTotal:      p.CurrentTotal,
+		QueuePosition:     int32(p.QueuePosition),
+		ExpiresAt:         expiresAt,
+		CreatedAt:         p.CreatedAt.Unix(),
+		UpdatedAt:         p.UpdatedAt.Unix(),
 	}
 }
 
 func (s *Server) domainToProtoNode(n *domain.Node) *pb.Node {
+	var managerID string
+	if n.ManagerID != nil {
+		managerID = *n.ManagerID
+	}
+
+	var healthScore int32
+	var online bool
+	if n.Health != nil {
+		healthScore = int32(n.Health.Score)
+		online = n.Health.Online
+	}
+	var lastSeenAt int64
+	if n.LastSeenAt != nil {
+		lastSeenAt = n.LastSeenAt.Unix()
+	}
+
 	return &pb.Node{
 		Id:                n.ID,
 		Name:              n.Name,
@@ -615,8 +1798,18 @@ func (s *Server) domainToProtoNode(n *domain.Node) *pb.Node {
 		Country:           n.Country,
 		City:              n.City,
 		Isp:               n.ISP,
+		Draining:          n.Draining,
+		ManagerId:         managerID,
 		CreatedAt:         n.CreatedAt.Unix(),
 		UpdatedAt:         n.UpdatedAt.Unix(),
+		HealthScore:       healthScore,
+		Online:            online,
+		MaxActiveUsers:    int32(n.MaxActiveUsers),
+		LastSeenAt:        lastSeenAt,
+		AgentVersion:      n.AgentVersion,
+		CpuPercent:        n.CPUPercent,
+		ActiveConnections: n.ActiveConnections,
+		BandwidthBps:      n.BandwidthBps,
 	}
 }
 
@@ -626,6 +1819,11 @@ func (srv *Server) domainToProtoService(svc *domain.Service) *pb.Service {
 		authMethods[i] = string(m)
 	}
 
+	var managerID string
+	if svc.ManagerID != nil {
+		managerID = *svc.ManagerID
+	}
+
 	return &pb.Service{
 		Id:                 svc.ID,
 		NodeId:             svc.NodeID,
@@ -633,6 +1831,7 @@ func (srv *Server) domainToProtoService(svc *domain.Service) *pb.Service {
 		Protocol:           svc.Protocol,
 		AllowedAuthMethods: authMethods,
 		CallbackUrl:        svc.CallbackURL,
+		ManagerId:          managerID,
 		CurrentUpload:      svc.CurrentUpload,
 		CurrentDownload:    svc.CurrentDownload,
 		CreatedAt:          svc.CreatedAt.Unix(),
@@ -640,6 +1839,111 @@ func (srv *Server) domainToProtoService(svc *domain.Service) *pb.Service {
 	}
 }
 
+func domainToProtoGroup(g *domain.Group) *pb.Group {
+	return &pb.Group{
+		Name:             g.Name,
+		TotalLimit:       g.TotalLimit,
+		UploadLimit:      g.UploadLimit,
+		DownloadLimit:    g.DownloadLimit,
+		MaxConcurrent:    int32(g.MaxConcurrent),
+		PenaltyDuration:  g.PenaltyDuration,
+		PenaltyAction:    string(g.PenaltyAction),
+		AllowedNodes:     g.AllowedNodes,
+		AllowedCountries: g.AllowedCountries,
+		DeniedCountries:  g.DeniedCountries,
+		CurrentUpload:    g.CurrentUpload,
+		CurrentDownload:  g.CurrentDownload,
+		CurrentTotal:     g.CurrentTotal,
+		CreatedAt:        g.CreatedAt.Unix(),
+		UpdatedAt:        g.UpdatedAt.Unix(),
+	}
+}
+
+func domainToProtoDevice(d *domain.Device) *pb.Device {
+	var approvedAt int64
+	if d.ApprovedAt != nil {
+		approvedAt = d.ApprovedAt.Unix()
+	}
+	return &pb.Device{
+		UserId:      d.UserID,
+		DeviceId:    d.DeviceID,
+		Status:      string(d.Status),
+		FirstSeenAt: d.FirstSeenAt.Unix(),
+		LastSeenAt:  d.LastSeenAt.Unix(),
+		ApprovedAt:  approvedAt,
+	}
+}
+
+func (s *Server) domainToProtoManager(m *domain.Manager) *pb.Manager {
+	var parentID, metadata string
+	if m.ParentID != nil {
+		parentID = *m.ParentID
+	}
+	if len(m.Metadata) > 0 {
+		if b, err := json.Marshal(m.Metadata); err == nil {
+			metadata = string(b)
+		}
+	}
+
+	manager := &pb.Manager{
+		Id:        m.ID,
+		Name:      m.Name,
+		ParentId:  parentID,
+		Metadata:  metadata,
+		CreatedAt: m.CreatedAt.Unix(),
+		UpdatedAt: m.UpdatedAt.Unix(),
+	}
+	if p := m.Package; p != nil {
+		var startAt int64
+		if p.StartAt != nil {
+			startAt = p.StartAt.Unix()
+		}
+		manager.Package = &pb.ManagerPackage{
+			TotalLimit:         p.TotalLimit,
+			UploadLimit:        p.UploadLimit,
+			DownloadLimit:      p.DownloadLimit,
+			ResetMode:          string(p.ResetMode),
+			Duration:           p.Duration,
+			StartAt:            startAt,
+			MaxSessions:        int32(p.MaxSessions),
+			MaxOnlineUsers:     int32(p.MaxOnlineUsers),
+			MaxActiveUsers:     int32(p.MaxActiveUsers),
+			Status:             string(p.Status),
+			CurrentUpload:      p.CurrentUpload,
+			CurrentDownload:    p.CurrentDownload,
+			CurrentTotal:       p.CurrentTotal,
+			CurrentSessions:    p.CurrentSessions,
+			CurrentOnlineUsers: p.CurrentOnline,
+			CurrentActiveUsers: p.CurrentActive,
+		}
+	}
+	return manager
+}
+
+// protoToManagerLimits reads the settable fields of a manager package; a nil
+// package has no limits
+func protoToManagerLimits(p *pb.ManagerPackage) domain.ManagerPackageLimits {
+	if p == nil {
+		return domain.ManagerPackageLimits{}
+	}
+	limits := domain.ManagerPackageLimits{
+		TotalLimit:     p.TotalLimit,
+		UploadLimit:    p.UploadLimit,
+		DownloadLimit:  p.DownloadLimit,
+		ResetMode:      domain.ResetMode(p.ResetMode),
+		Duration:       p.Duration,
+		MaxSessions:    int(p.MaxSessions),
+		MaxOnlineUsers: int(p.MaxOnlineUsers),
+		MaxActiveUsers: int(p.MaxActiveUsers),
+		Status:         domain.ManagerPackageStatus(p.Status),
+	}
+	if p.StartAt > 0 {
+		startAt := time.Unix(p.StartAt, 0)
+		limits.StartAt = &startAt
+	}
+	return limits
+}
+
 func (s *Server) domainToProtoEvent(e *domain.Event) *pb.Event {
 	var userID, packageID, nodeID, serviceID string
 	if e.UserID != nil {
@@ -670,69 +1974,335 @@ func (s *Server) domainToProtoEvent(e *domain.Event) *pb.Event {
 
 // GracefulStop gracefully stops the server
 func (srv *Server) GracefulStop() {
-	if srv.grpcServer != nil {
-		srv.grpcServer.GracefulStop()
+	if server := srv.server(); server != nil {
+		server.GracefulStop()
 	}
 }
 
-// Serve starts the gRPC server on the given listener
-func (srv *Server) Serve(lis net.Listener) error {
-	// Create the gRPC server
-	srv.grpcServer = grpc.NewServer(
-		grpc.UnaryInterceptor(srv.unaryAuthInterceptor),
-		grpc.StreamInterceptor(srv.streamAuthInterceptor),
+// Stop closes all connections and pending calls at once
+func (srv *Server) Stop() {
+	if server := srv.server(); server != nil {
+		server.Stop()
+	}
+}
+
+func (srv *Server) server() *grpc.Server {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.grpcServer
+}
+
+// Serve starts the gRPC server on the given listener. Extra options (TLS
+// credentials, transport interceptors) run ahead of the API key check.
+func (srv *Server) Serve(lis net.Listener, opts ...grpc.ServerOption) error {
+	return srv.build(opts...).Serve(lis)
+}
+
+// Handler returns the gRPC server as an http.Handler, so an HTTP/2 server
+// that terminates TLS can serve gRPC next to the REST API on one port. Extra
+// options run ahead of the API key check and must not carry TLS credentials.
+func (srv *Server) Handler(opts ...grpc.ServerOption) http.Handler {
+	return srv.build(opts...)
+}
+
+// build creates the gRPC server and registers all services
+func (srv *Server) build(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(srv.unaryTraceInterceptor, srv.unaryAuthInterceptor),
+		grpc.ChainStreamInterceptor(srv.streamAuthInterceptor),
 	)
+	server := grpc.NewServer(opts...)
+
+	pb.RegisterUsageServiceServer(server, srv)
+	pb.RegisterAdminServiceServer(server, srv)
+	pb.RegisterNodeServiceServer(server, srv)
+
+	srv.mu.Lock()
+	srv.grpcServer = server
+	srv.mu.Unlock()
+	return server
+}
+
+// IsGRPCRequest reports whether an HTTP request carries a gRPC call
+func IsGRPCRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// caller identifies who authenticated a gRPC request. service is nil when the
+// owner key was used; scope is set for scoped API keys and token for access
+// tokens.
+type caller struct {
+	service   *domain.Service
+	scope     domain.KeyScope
+	managerID *string // Set for manager-scoped keys
+	token     *auth.Claims
+}
+
+// monitorMethods are the read-only methods a monitor-scoped key may call
+var monitorMethods = map[string]bool{
+	"/hue.AdminService/GetEvents": true,
+}
+
+// managerMethods are the user and package methods a manager-scoped key may
+// call for its own manager's users
+var managerMethods = map[string]bool{
+	pb.AdminService_CreateUser_FullMethodName:       true,
+	pb.AdminService_GetUser_FullMethodName:          true,
+	pb.AdminService_ListUsers_FullMethodName:        true,
+	pb.AdminService_UpdateUser_FullMethodName:       true,
+	pb.AdminService_DeleteUser_FullMethodName:       true,
+	pb.AdminService_CreatePackage_FullMethodName:    true,
+	pb.AdminService_GetPackage_FullMethodName:       true,
+	pb.AdminService_GetPackageByUser_FullMethodName: true,
+	pb.AdminService_ListUserPackages_FullMethodName: true,
+}
+
+type callerKey struct{}
+
+// readOnlyTokenMethods are the admin reads a read-only token may call. The
+// key listing needs full.
+var readOnlyTokenMethods = map[string]bool{
+	pb.AdminService_GetUser_FullMethodName:          true,
+	pb.AdminService_ListUsers_FullMethodName:        true,
+	pb.AdminService_GetPackage_FullMethodName:       true,
+	pb.AdminService_GetPackageByUser_FullMethodName: true,
+	pb.AdminService_ListUserPackages_FullMethodName: true,
+	pb.AdminService_GetNode_FullMethodName:          true,
+	pb.AdminService_ListNodes_FullMethodName:        true,
+	pb.AdminService_GetService_FullMethodName:       true,
+	pb.AdminService_ListServices_FullMethodName:     true,
+	pb.AdminService_GetGroup_FullMethodName:         true,
+	pb.AdminService_ListGroups_FullMethodName:       true,
+	pb.AdminService_ListUserDevices_FullMethodName:  true,
+	pb.AdminService_GetManager_FullMethodName:       true,
+	pb.AdminService_ListManagers_FullMethodName:     true,
+	pb.AdminService_GetEvents_FullMethodName:        true,
+}
+
+// serviceUpdateTokenMethods are the methods a service-update token may
+// call: reading services and changing their settings
+var serviceUpdateTokenMethods = map[string]bool{
+	pb.AdminService_GetService_FullMethodName:    true,
+	pb.AdminService_ListServices_FullMethodName:  true,
+	pb.AdminService_UpdateService_FullMethodName: true,
+}
 
-	// Register all services
-	pb.RegisterUsageServiceServer(srv.grpcServer, srv)
-	pb.RegisterAdminServiceServer(srv.grpcServer, srv)
-	pb.RegisterNodeServiceServer(srv.grpcServer, srv)
+// tokenAllows reports whether a token's scopes allow a method: full allows
+// everything, the other scopes the methods they list
+func tokenAllows(scope auth.Scope, fullMethod string) bool {
+	switch {
+	case scope.Has(auth.ScopeFull):
+		return true
+	case scope.Has(auth.ScopeReadOnly) && readOnlyTokenMethods[fullMethod]:
+		return true
+	case scope.Has(auth.ScopeServiceUpdate) && serviceUpdateTokenMethods[fullMethod]:
+		return true
+	}
+	return false
+}
 
-	return srv.grpcServer.Serve(lis)
+// callerFromContext returns the authenticated caller, or nil for in-process
+// calls that did not pass through the auth interceptors
+func callerFromContext(ctx context.Context) *caller {
+	c, _ := ctx.Value(callerKey{}).(*caller)
+	return c
 }
 
 func (srv *Server) unaryAuthInterceptor(
 	ctx context.Context,
 	req interface{},
-	_ *grpc.UnaryServerInfo,
+	info *grpc.UnaryServerInfo,
 	handler grpc.UnaryHandler,
 ) (interface{}, error) {
-	apiKey := apiKeyFromContext(ctx)
-	if apiKey == "" {
-		return nil, status.Error(codes.Unauthenticated, "missing Hue-API-Key")
+	c, err := srv.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if c.managerID != nil {
+		if err := srv.scopeToManager(req, *c.managerID); err != nil {
+			return nil, err
+		}
 	}
 
-	ok, err := srv.validateAPIKey(apiKey)
-	if err != nil {
-		return nil, status.Error(codes.Internal, "auth validation failed")
+	resp, err := handler(context.WithValue(ctx, callerKey{}, c), req)
+	if err == nil && isAdminWrite(info.FullMethod) {
+		srv.stats.Bust()
 	}
+	return resp, err
+}
+
+// unaryTraceInterceptor records a server span for the call, continuing the
+// caller's trace when it sent a traceparent
+func (srv *Server) unaryTraceInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	ctx, span := srv.tracer.StartSpan(ctx, strings.TrimPrefix(info.FullMethod, "/"), tracing.SpanKindServer, traceparentFromContext(ctx))
+	if span == nil {
+		return handler(ctx, req)
+	}
+	defer span.End()
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", info.FullMethod)
+
+	resp, err := handler(ctx, req)
+	span.SetAttribute("rpc.grpc.status_code", int(status.Code(err)))
+	span.SetError(err)
+	return resp, err
+}
+
+// traceparentFromContext returns the W3C traceparent sent as gRPC metadata
+func traceparentFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		return nil, status.Error(codes.Unauthenticated, "invalid Hue-API-Key")
+		return ""
+	}
+	if vals := md.Get(tracing.TraceparentHeader); len(vals) > 0 {
+		return vals[0]
 	}
+	return ""
+}
 
-	return handler(ctx, req)
+// isAdminWrite reports whether a method changes data served by the stats API
+func isAdminWrite(fullMethod string) bool {
+	name, ok := strings.CutPrefix(fullMethod, "/hue.AdminService/")
+	return ok && !strings.HasPrefix(name, "Get") && !strings.HasPrefix(name, "List")
 }
 
 func (srv *Server) streamAuthInterceptor(
 	srvInterface interface{},
 	ss grpc.ServerStream,
-	_ *grpc.StreamServerInfo,
+	info *grpc.StreamServerInfo,
 	handler grpc.StreamHandler,
 ) error {
-	apiKey := apiKeyFromContext(ss.Context())
+	c, err := srv.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srvInterface, &callerStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), callerKey{}, c)})
+}
+
+// callerStream carries the authenticated caller in the stream context
+type callerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *callerStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize validates the request's API key. The owner key may call every
+// method; a service key is limited to the usage and node services, a
+// monitor key to the methods in monitorMethods and a manager key to those
+// in managerMethods.
+func (srv *Server) authorize(ctx context.Context, fullMethod string) (*caller, error) {
+	apiKey := apiKeyFromContext(ctx)
 	if apiKey == "" {
-		return status.Error(codes.Unauthenticated, "missing Hue-API-Key")
+		return nil, status.Error(codes.Unauthenticated, "missing Hue-API-Key")
 	}
 
-	ok, err := srv.validateAPIKey(apiKey)
+	c, err := srv.validateAPIKey(apiKey)
 	if err != nil {
-		return status.Error(codes.Internal, "auth validation failed")
+		return nil, status.Error(codes.Internal, "auth validation failed")
 	}
-	if !ok {
-		return status.Error(codes.Unauthenticated, "invalid Hue-API-Key")
+	if c == nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid Hue-API-Key")
+	}
+	if c.service != nil && strings.HasPrefix(fullMethod, "/hue.AdminService/") {
+		return nil, status.Error(codes.PermissionDenied, "service keys cannot call admin methods")
+	}
+	if c.service != nil && srv.nodeCertRequired {
+		if err := srv.checkNodeCert(ctx, c.service); err != nil {
+			return nil, err
+		}
+	}
+	if c.scope == domain.KeyScopeMonitor && !monitorMethods[fullMethod] {
+		return nil, status.Error(codes.PermissionDenied, "monitor keys are read-only")
+	}
+	if c.scope == domain.KeyScopeManager && (c.managerID == nil || !managerMethods[fullMethod]) {
+		return nil, status.Error(codes.PermissionDenied, "manager keys are limited to their users and packages")
+	}
+	if c.token != nil && !tokenAllows(c.token.Scope(), fullMethod) {
+		return nil, status.Error(codes.PermissionDenied, "token scope does not allow this method")
+	}
+
+	return c, nil
+}
+
+// scopeToManager limits a manager key's request to the manager's users. It
+// injects the manager as the filter of listings and the owner of new users,
+// and answers NotFound for a user or package of anyone else.
+func (srv *Server) scopeToManager(req interface{}, managerID string) error {
+	var userID string
+	switch r := req.(type) {
+	case *pb.ListUsersRequest:
+		r.ManagerId = managerID
+		return nil
+	case *pb.CreateUserRequest:
+		if r.ManagerId != "" && r.ManagerId != managerID {
+			return status.Error(codes.PermissionDenied, "manager keys can only create users of their own manager")
+		}
+		r.ManagerId = managerID
+		return nil
+	case *pb.UpdateUserRequest:
+		if r.ManagerId != "" && r.ManagerId != managerID {
+			return status.Error(codes.PermissionDenied, "manager keys cannot move users to another manager")
+		}
+		userID = r.Id
+	case *pb.GetUserRequest:
+		userID = r.Id
+	case *pb.DeleteUserRequest:
+		userID = r.Id
+	case *pb.CreatePackageRequest:
+		userID = r.UserId
+	case *pb.GetPackageByUserRequest:
+		userID = r.UserId
+	case *pb.ListUserPackagesRequest:
+		userID = r.UserId
+	case *pb.GetPackageRequest:
+		pkg, err := srv.userDB.GetPackage(r.Id)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to get package: %v", err)
+		}
+		if pkg == nil {
+			return status.Error(codes.NotFound, "package not found")
+		}
+		userID = pkg.UserID
+	default:
+		return status.Error(codes.PermissionDenied, "manager keys are limited to their users and packages")
 	}
 
-	return handler(srvInterface, ss)
+	user, err := srv.userDB.GetUser(userID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get user: %v", err)
+	}
+	if user == nil || user.ManagerID == nil || *user.ManagerID != managerID {
+		return status.Error(codes.NotFound, "user not found")
+	}
+	return nil
+}
+
+// checkNodeCert verifies that the call's client certificate belongs to the
+// node of the service whose key was used
+func (srv *Server) checkNodeCert(ctx context.Context, service *domain.Service) error {
+	cert := auth.ClientCertificate(ctx)
+	if cert == nil {
+		return status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	node, err := srv.userDB.GetNode(service.NodeID)
+	if err != nil {
+		return status.Error(codes.Internal, "auth validation failed")
+	}
+	if node != nil && slices.ContainsFunc(auth.CertificateNames(cert), func(name string) bool {
+		return name == node.ID || name == node.Name
+	}) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "client certificate %q does not belong to the service's node", cert.Subject.CommonName)
 }
 
 func apiKeyFromContext(ctx context.Context) string {
@@ -741,22 +2311,52 @@ func apiKeyFromContext(ctx context.Context) string {
 		return ""
 	}
 
-	vals := md.Get("hue-api-key")
-	if len(vals) == 0 {
-		return ""
+	if vals := md.Get("hue-api-key"); len(vals) > 0 {
+		return vals[0]
 	}
-
-	return vals[0]
+	// Access tokens may also come as a bearer token
+	if vals := md.Get("authorization"); len(vals) > 0 {
+		token, _ := strings.CutPrefix(vals[0], "Bearer ")
+		return token
+	}
+	return ""
 }
 
-func (srv *Server) validateAPIKey(apiKey string) (bool, error) {
+func (srv *Server) validateAPIKey(apiKey string) (*caller, error) {
 	if srv.secret != "" && apiKey == srv.secret {
-		return true, nil
+		return &caller{}, nil
+	}
+	if srv.tokens != nil && auth.IsToken(apiKey) {
+		claims, err := srv.tokens.Parse(apiKey)
+		if err != nil {
+			return nil, nil
+		}
+		return &caller{token: claims}, nil
 	}
 
 	if srv.userDB == nil {
-		return false, nil
+		return nil, nil
 	}
 
-	return srv.userDB.ValidateOwnerAuthKey(apiKey)
+	ok, err := srv.userDB.ValidateOwnerAuthKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &caller{}, nil
+	}
+
+	service, err := srv.userDB.AuthenticateServiceKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if service != nil {
+		return &caller{service: service}, nil
+	}
+
+	key, err := srv.userDB.AuthenticateAPIKey(apiKey)
+	if err != nil || key == nil {
+		return nil, err
+	}
+	return &caller{scope: key.Scope, managerID: key.ManagerID}, nil
 }
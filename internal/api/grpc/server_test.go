@@ -2,17 +2,35 @@ package grpc
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hiddify/hue-go/internal/auth"
 	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/engine"
 	"github.com/hiddify/hue-go/internal/eventstore"
 	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/internal/tracing"
 	pb "github.com/hiddify/hue-go/pkg/proto"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type grpcEventStore struct {
@@ -48,6 +66,20 @@ func (s *grpcEventStore) GetAllEvents(limit int) ([]*domain.Event, error) {
 	return s.events[:limit], nil
 }
 
+func (s *grpcEventStore) ListEvents(filter domain.EventFilter) (*domain.EventPage, error) {
+	events, err := s.GetEvents(filter.Type, filter.UserID, filter.Limit)
+	return &domain.EventPage{Events: events}, err
+}
+
+func (s *grpcEventStore) ReplayEvents(filter domain.EventReplayFilter, fn func(*domain.Event) error) error {
+	for _, e := range s.events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *grpcEventStore) Close() error { return nil }
 
 var _ eventstore.EventStore = (*grpcEventStore)(nil)
@@ -56,6 +88,7 @@ type grpcFixture struct {
 	server    *Server
 	userDB    *sqlite.UserDB
 	cache     *cache.MemoryCache
+	session   *engine.SessionManager
 	userID    string
 	packageID string
 	nodeID    string
@@ -86,8 +119,102 @@ func newGRPCFixture(t *testing.T) *grpcFixture {
 
 	s := NewServer(quota, session, penalty, nil, events, logger, "secret")
 	s.SetUserDB(userDB)
+	s.SetEngine(engine.NewEngine(quota, session, penalty, nil, events, memoryCache, userDB, logger))
+
+	return &grpcFixture{server: s, userDB: userDB, cache: memoryCache, session: session, events: events}
+}
+
+func TestGRPCDisconnectUser(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "kicked", Password: "p"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	fx.session.AddSession(user.Id, "sess-a", "sess-a", "node-a", "10.0.0.1", nil)
+	fx.session.AddSession(user.Id, "sess-b", "sess-b", "node-a", "10.0.0.2", nil)
+
+	if _, err := fx.server.DisconnectUser(ctx, &pb.DisconnectUserRequest{UserId: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for unknown user, got %v", err)
+	}
+
+	resp, err := fx.server.DisconnectUser(ctx, &pb.DisconnectUserRequest{UserId: user.Id})
+	if err != nil {
+		t.Fatalf("disconnect user: %v", err)
+	}
+	if resp.Sessions != 2 {
+		t.Fatalf("expected 2 sessions ended, got %d", resp.Sessions)
+	}
+	cmds, err := fx.server.GetDisconnectCommands(ctx, &pb.GetDisconnectCommandsRequest{NodeId: "node-a"})
+	if err != nil {
+		t.Fatalf("get disconnect commands: %v", err)
+	}
+	if len(cmds.Commands) != 2 || cmds.Commands[0].Reason != string(domain.ReasonAdminDisconnect) {
+		t.Fatalf("expected two admin disconnects, got %+v", cmds.Commands)
+	}
+}
+
+func TestGRPCManagerCRUD(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	root, err := fx.server.CreateManager(ctx, &pb.CreateManagerRequest{
+		Id:       "mgr-root",
+		Name:     "root",
+		Metadata: `{"region":"eu"}`,
+		Package:  &pb.ManagerPackage{TotalLimit: 1000, MaxActiveUsers: 10},
+	})
+	if err != nil {
+		t.Fatalf("create manager: %v", err)
+	}
+	if root.Package.GetStatus() != string(domain.ManagerPackageStatusActive) || root.Metadata != `{"region":"eu"}` {
+		t.Fatalf("unexpected manager: %+v", root)
+	}
+
+	if _, err := fx.server.CreateManager(ctx, &pb.CreateManagerRequest{
+		Name: "greedy", ParentId: root.Id, Package: &pb.ManagerPackage{TotalLimit: 2000},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for child above parent, got %v", err)
+	}
+
+	child, err := fx.server.CreateManager(ctx, &pb.CreateManagerRequest{
+		Name: "reseller", ParentId: root.Id, Package: &pb.ManagerPackage{TotalLimit: 600},
+	})
+	if err != nil {
+		t.Fatalf("create child manager: %v", err)
+	}
+
+	children, err := fx.server.ListManagers(ctx, &pb.ListManagersRequest{ParentId: root.Id})
+	if err != nil {
+		t.Fatalf("list children: %v", err)
+	}
+	if len(children.Managers) != 1 || children.Managers[0].Id != child.Id {
+		t.Fatalf("expected only the child, got %+v", children.Managers)
+	}
+
+	if _, err := fx.server.UpdateManager(ctx, &pb.UpdateManagerRequest{
+		Id: root.Id, Package: &pb.ManagerPackage{TotalLimit: 500},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument lowering parent below child, got %v", err)
+	}
+
+	updated, err := fx.server.UpdateManager(ctx, &pb.UpdateManagerRequest{
+		Id: child.Id, Name: "reseller-2", ClearParent: true, Package: &pb.ManagerPackage{TotalLimit: 5000},
+	})
+	if err != nil {
+		t.Fatalf("update manager: %v", err)
+	}
+	if updated.Name != "reseller-2" || updated.ParentId != "" || updated.Package.TotalLimit != 5000 || updated.Package.Status != string(domain.ManagerPackageStatusActive) {
+		t.Fatalf("unexpected updated manager: %+v", updated)
+	}
 
-	return &grpcFixture{server: s, userDB: userDB, cache: memoryCache, events: events}
+	if _, err := fx.server.DeleteManager(ctx, &pb.DeleteManagerRequest{Id: child.Id}); err != nil {
+		t.Fatalf("delete manager: %v", err)
+	}
+	if _, err := fx.server.GetManager(ctx, &pb.GetManagerRequest{Id: child.Id}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound after delete, got %v", err)
+	}
 }
 
 func TestGRPCAdminCRUDAndNodeService(t *testing.T) {
@@ -151,6 +278,13 @@ func TestGRPCAdminCRUDAndNodeService(t *testing.T) {
 	if !authOK.Success || authOK.NodeId != fx.nodeID {
 		t.Fatalf("expected successful auth for node %s", fx.nodeID)
 	}
+	if authOK.ApiVersion != 1 || authOK.MinApiVersion != pb.MinAPIVersion {
+		t.Fatalf("expected an unversioned agent to get API version 1, got %d (min %d)", authOK.ApiVersion, authOK.MinApiVersion)
+	}
+	authNewer, err := fx.server.Authenticate(ctx, &pb.AuthenticateRequest{SecretKey: "node-secret", ApiVersion: pb.APIVersion + 1})
+	if err != nil || !authNewer.Success || authNewer.ApiVersion != pb.APIVersion {
+		t.Fatalf("expected a newer agent to be negotiated down to %d, got %+v (%v)", pb.APIVersion, authNewer, err)
+	}
 
 	createdService, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{
 		NodeId:             fx.nodeID,
@@ -164,6 +298,24 @@ func TestGRPCAdminCRUDAndNodeService(t *testing.T) {
 	}
 	fx.serviceID = createdService.Id
 
+	listedServices, err := fx.server.ListServices(ctx, &pb.ListServicesRequest{NodeId: fx.nodeID})
+	if err != nil || len(listedServices.Services) != 1 || listedServices.Services[0].Id != fx.serviceID {
+		t.Fatalf("expected the node's service to be listed, got %+v (%v)", listedServices, err)
+	}
+	updatedService, err := fx.server.UpdateService(ctx, &pb.UpdateServiceRequest{Id: fx.serviceID, Name: "svc-renamed", SecretKey: "svc-rotated", AllowedAuthMethods: []string{"uuid"}})
+	if err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+	if updatedService.Name != "svc-renamed" || len(updatedService.AllowedAuthMethods) != 1 || updatedService.Protocol != "vless" {
+		t.Fatalf("unexpected service after update: %+v", updatedService)
+	}
+	if svc, _ := fx.userDB.AuthenticateServiceKey("svc-rotated"); svc == nil {
+		t.Fatalf("expected the rotated key to authenticate")
+	}
+	if _, err := fx.server.UpdateService(ctx, &pb.UpdateServiceRequest{Id: "missing"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for an unknown service, got %v", err)
+	}
+
 	createdPackage, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{
 		UserId:        fx.userID,
 		TotalTraffic:  10_000,
@@ -281,15 +433,7 @@ func TestGRPCUsageReportingAndEvents(t *testing.T) {
 		t.Fatalf("expected 1 batch result, got %d", len(batch.Results))
 	}
 
-	userID := fx.userID
-	fx.events.events = append(fx.events.events, &domain.Event{
-		ID:      "ev-1",
-		Type:    domain.EventUsageRecorded,
-		UserID:  &userID,
-		Tags:    []string{"grpc"},
-		Timestamp: time.Now(),
-	})
-
+	// Only the accepted first report is recorded
 	gotEvents, err := fx.server.GetEvents(ctx, &pb.GetEventsRequest{Type: string(domain.EventUsageRecorded), UserId: fx.userID, Limit: 10})
 	if err != nil {
 		t.Fatalf("get events: %v", err)
@@ -298,3 +442,1133 @@ func TestGRPCUsageReportingAndEvents(t *testing.T) {
 		t.Fatalf("expected 1 event, got %d", len(gotEvents.Events))
 	}
 }
+
+func TestGRPCAdminWritesInvalidateCachedUser(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if fx.cache.GetUser(user.Id) != nil {
+		t.Fatalf("expected creating a user not to populate the cache")
+	}
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1, ResetMode: string(domain.ResetModeNoReset)})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	service, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "s1", Name: "s1", Protocol: "vless"})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1_000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	report := func() *pb.UsageReportResult {
+		resp, err := fx.server.ReportUsage(ctx, &pb.ReportUsageRequest{Report: &pb.UsageReport{
+			UserId: user.Id, NodeId: node.Id, ServiceId: service.Id, SessionId: "s", Upload: 1, Download: 1,
+		}})
+		if err != nil {
+			t.Fatalf("report usage: %v", err)
+		}
+		return resp.Result
+	}
+
+	if result := report(); !result.Accepted {
+		t.Fatalf("expected report accepted, got reason=%s", result.Reason)
+	}
+	if fx.cache.GetUser(user.Id) == nil {
+		t.Fatalf("expected the report to cache the user")
+	}
+
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, Status: string(domain.UserStatusSuspended)}); err != nil {
+		t.Fatalf("suspend user: %v", err)
+	}
+	if result := report(); result.Accepted {
+		t.Fatalf("expected the suspension to apply to the next report")
+	}
+}
+
+func TestGRPCReportUsageFlagsSustainedSpeed(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+	fx.session.SetSpeedPolicy(time.Minute, domain.SpeedRule{ThresholdBps: 1, Sustain: 0})
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1, ResetMode: string(domain.ResetModeNoReset)})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	service, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "s1", Name: "s1", Protocol: "vless"})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1_000_000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		resp, err := fx.server.ReportUsage(ctx, &pb.ReportUsageRequest{Report: &pb.UsageReport{
+			UserId: user.Id, NodeId: node.Id, ServiceId: service.Id, SessionId: "fast", Upload: 1_000, Download: 1_000,
+		}})
+		if err != nil || !resp.Result.Accepted {
+			t.Fatalf("report %d: accepted=%v err=%v", i, resp.GetResult().GetAccepted(), err)
+		}
+	}
+
+	sessions := fx.session.GetUserSessions(user.Id)
+	if len(sessions) != 1 || sessions[0].DownloadBps <= 0 {
+		t.Fatalf("expected an estimated session rate, got %+v", sessions)
+	}
+	speedType := domain.EventUserSpeedExceeded
+	speed, _ := fx.events.GetEvents(&speedType, nil, 0)
+	if len(speed) != 1 {
+		t.Fatalf("expected one USER_SPEED_EXCEEDED event from gRPC reports, got %d", len(speed))
+	}
+}
+
+func TestGRPCReportUsageFlagsRoaming(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+	fx.session.SetRoamingPolicy(time.Minute, domain.RoamingActionFlag)
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1_000_000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	for i, name := range []string{"n1", "n2"} {
+		node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: name, SecretKey: name, TrafficMultiplier: 1, ResetMode: string(domain.ResetModeNoReset)})
+		if err != nil {
+			t.Fatalf("create node: %v", err)
+		}
+		service, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: name + "-svc", Name: name, Protocol: "vless"})
+		if err != nil {
+			t.Fatalf("create service: %v", err)
+		}
+		resp, err := fx.server.ReportUsage(ctx, &pb.ReportUsageRequest{Report: &pb.UsageReport{
+			UserId: user.Id, NodeId: node.Id, ServiceId: service.Id, SessionId: "s", Upload: 1, Download: 1,
+		}})
+		if err != nil || !resp.Result.Accepted {
+			t.Fatalf("report %d: accepted=%v err=%v", i, resp.GetResult().GetAccepted(), err)
+		}
+	}
+
+	roamingType := domain.EventSessionRoaming
+	roaming, _ := fx.events.GetEvents(&roamingType, nil, 0)
+	if len(roaming) != 1 {
+		t.Fatalf("expected one SESSION_ROAMING event from gRPC reports, got %d", len(roaming))
+	}
+}
+
+func TestGRPCServeAcceptsAuthenticatorOptions(t *testing.T) {
+	fx := newGRPCFixture(t)
+
+	authenticator, err := auth.NewAuthenticator("secret", "", "", []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("new authenticator: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fx.server.Serve(lis, authenticator.GRPCServerOptions()...)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_ = lis.Close()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("serve did not return after listener close")
+	}
+}
+
+func TestGRPCHandlerSharesTLSPortWithHTTP(t *testing.T) {
+	fx := newGRPCFixture(t)
+
+	grpcHandler := fx.server.Handler()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsGRPCRequest(r) {
+			grpcHandler.ServeHTTP(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("rest"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatalf("rest request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "rest" {
+		t.Fatalf("expected the REST handler to answer, got %q", body)
+	}
+
+	conn, err := grpc.Dial(srv.Listener.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "hue-api-key", "secret")
+	if _, err := pb.NewAdminServiceClient(conn).ListNodes(ctx, &pb.Empty{}); err != nil {
+		t.Fatalf("gRPC call over the shared TLS port: %v", err)
+	}
+}
+
+func TestGRPCReportUsageValidatesSource(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	node1, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	node2, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n2", SecretKey: "n2", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	svc1, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node1.Id, SecretKey: "svc1-key", Name: "s1", Protocol: "vless"})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	svc2, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node2.Id, SecretKey: "svc2-key", Name: "s2", Protocol: "vless"})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+
+	report := func(key, nodeID, serviceID string) error {
+		md := metadata.Pairs("hue-api-key", key)
+		callCtx := metadata.NewIncomingContext(ctx, md)
+		info := &grpc.UnaryServerInfo{FullMethod: pb.UsageService_ReportUsage_FullMethodName}
+		_, err := fx.server.unaryAuthInterceptor(callCtx, nil, info, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			return fx.server.ReportUsage(ctx, &pb.ReportUsageRequest{Report: &pb.UsageReport{
+				UserId: user.Id, NodeId: nodeID, ServiceId: serviceID, SessionId: "s", Upload: 1, Download: 1,
+			}})
+		})
+		return err
+	}
+
+	cases := []struct {
+		name      string
+		key       string
+		nodeID    string
+		serviceID string
+		code      codes.Code
+	}{
+		{"owner key on matching node", "secret", node1.Id, svc1.Id, codes.OK},
+		{"service key on its own service", "svc1-key", node1.Id, svc1.Id, codes.OK},
+		{"service key fills in its service", "svc1-key", "", "", codes.OK},
+		{"owner key without a service", "secret", node1.Id, "", codes.OK},
+		{"service on another node", "secret", node2.Id, svc1.Id, codes.InvalidArgument},
+		{"unknown service", "secret", node1.Id, "missing", codes.InvalidArgument},
+		{"service key for another service", "svc1-key", node2.Id, svc2.Id, codes.PermissionDenied},
+		{"invalid key", "nope", node1.Id, svc1.Id, codes.Unauthenticated},
+	}
+	for _, tc := range cases {
+		if got := status.Code(report(tc.key, tc.nodeID, tc.serviceID)); got != tc.code {
+			t.Fatalf("%s: expected %s, got %s", tc.name, tc.code, got)
+		}
+	}
+
+	fx.server.quota.SetRequireReportSource(true)
+	if got := status.Code(report("secret", node1.Id, "")); got != codes.InvalidArgument {
+		t.Fatalf("expected a missing service to be rejected when required, got %s", got)
+	}
+	if got := status.Code(report("svc1-key", "", "")); got != codes.OK {
+		t.Fatalf("expected a service key to supply its service when required, got %s", got)
+	}
+
+	md := metadata.Pairs("hue-api-key", "svc1-key")
+	info := &grpc.UnaryServerInfo{FullMethod: pb.AdminService_ListNodes_FullMethodName}
+	_, err = fx.server.unaryAuthInterceptor(metadata.NewIncomingContext(ctx, md), nil, info, func(context.Context, interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected service key to be denied admin methods, got %v", err)
+	}
+}
+
+func TestGRPCMonitorKeyIsReadOnly(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	rawKey, err := fx.userDB.CreateAPIKey(&domain.APIKey{ID: "k1", Name: "monitor", Scope: domain.KeyScopeMonitor})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	call := func(method string) error {
+		md := metadata.Pairs("hue-api-key", rawKey)
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := fx.server.unaryAuthInterceptor(metadata.NewIncomingContext(ctx, md), nil, info, func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+
+	if err := call(pb.AdminService_GetEvents_FullMethodName); err != nil {
+		t.Fatalf("expected monitor key to read events, got %v", err)
+	}
+	for _, method := range []string{pb.AdminService_CreateUser_FullMethodName, pb.AdminService_ListUsers_FullMethodName, pb.UsageService_ReportUsage_FullMethodName} {
+		if status.Code(call(method)) != codes.PermissionDenied {
+			t.Fatalf("expected monitor key to be denied %s", method)
+		}
+	}
+}
+
+func TestGRPCManagerKeyIsScopedToItsUsers(t *testing.T) {
+	fx := newGRPCFixture(t)
+
+	managerID := "mgr-1"
+	rawKey, err := fx.userDB.CreateAPIKey(&domain.APIKey{ID: "k1", Name: "reseller", Scope: domain.KeyScopeManager, ManagerID: &managerID})
+	if err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+	other, err := fx.server.CreateUser(context.Background(), &pb.CreateUserRequest{Username: "other", Password: "p", ManagerId: "mgr-2"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	call := func(method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+		md := metadata.Pairs("hue-api-key", rawKey)
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		return fx.server.unaryAuthInterceptor(metadata.NewIncomingContext(context.Background(), md), req, info, handler)
+	}
+	noop := func(context.Context, interface{}) (interface{}, error) { return nil, nil }
+
+	for _, method := range []string{pb.AdminService_GetEvents_FullMethodName, pb.AdminService_ListNodes_FullMethodName, pb.UsageService_ReportUsage_FullMethodName} {
+		if _, err := call(method, nil, noop); status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("expected manager key to be denied %s, got %v", method, err)
+		}
+	}
+
+	resp, err := call(pb.AdminService_CreateUser_FullMethodName, &pb.CreateUserRequest{Username: "own", Password: "p"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return fx.server.CreateUser(ctx, req.(*pb.CreateUserRequest))
+	})
+	if err != nil {
+		t.Fatalf("expected manager key to create users, got %v", err)
+	}
+	own := resp.(*pb.User)
+	if own.ManagerId != managerID {
+		t.Fatalf("expected the user to belong to the key's manager, got %q", own.ManagerId)
+	}
+	if _, err := call(pb.AdminService_CreateUser_FullMethodName, &pb.CreateUserRequest{Username: "x", ManagerId: "mgr-2"}, noop); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected creating a user for another manager to be denied, got %v", err)
+	}
+
+	resp, err = call(pb.AdminService_ListUsers_FullMethodName, &pb.ListUsersRequest{ManagerId: "mgr-2"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return fx.server.ListUsers(ctx, req.(*pb.ListUsersRequest))
+	})
+	if err != nil {
+		t.Fatalf("list users: %v", err)
+	}
+	if users := resp.(*pb.ListUsersResponse).Users; len(users) != 1 || users[0].Id != own.Id {
+		t.Fatalf("expected only the manager's own user, got %v", users)
+	}
+
+	if _, err := call(pb.AdminService_GetUser_FullMethodName, &pb.GetUserRequest{Id: own.Id}, noop); err != nil {
+		t.Fatalf("expected manager key to get its user, got %v", err)
+	}
+	for method, req := range map[string]interface{}{
+		pb.AdminService_GetUser_FullMethodName:       &pb.GetUserRequest{Id: other.Id},
+		pb.AdminService_DeleteUser_FullMethodName:    &pb.DeleteUserRequest{Id: other.Id},
+		pb.AdminService_CreatePackage_FullMethodName: &pb.CreatePackageRequest{UserId: other.Id},
+	} {
+		if _, err := call(method, req, noop); status.Code(err) != codes.NotFound {
+			t.Fatalf("expected %s on another manager's user to be NotFound, got %v", method, err)
+		}
+	}
+}
+
+func TestGRPCAccessTokenScopes(t *testing.T) {
+	fx := newGRPCFixture(t)
+	tokens, err := auth.NewTokenIssuer("test-signing-key", time.Hour)
+	if err != nil {
+		t.Fatalf("new token issuer: %v", err)
+	}
+	fx.server.SetTokenIssuer(tokens)
+
+	call := func(token, method string) error {
+		md := metadata.Pairs("authorization", "Bearer "+token)
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, err := fx.server.unaryAuthInterceptor(metadata.NewIncomingContext(context.Background(), md), nil, info, func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return err
+	}
+
+	readOnly, _, _ := tokens.Issue("grafana", auth.ScopeReadOnly, 0)
+	if err := call(readOnly, pb.AdminService_ListUsers_FullMethodName); err != nil {
+		t.Fatalf("expected read-only token to list users, got %v", err)
+	}
+	for _, method := range []string{pb.AdminService_CreateUser_FullMethodName, pb.AdminService_ListAuthKeys_FullMethodName, pb.UsageService_ReportUsage_FullMethodName} {
+		if status.Code(call(readOnly, method)) != codes.PermissionDenied {
+			t.Fatalf("expected read-only token to be denied %s", method)
+		}
+	}
+
+	serviceUpdate, _, _ := tokens.Issue("deploy", auth.ScopeServiceUpdate, 0)
+	if err := call(serviceUpdate, pb.AdminService_UpdateService_FullMethodName); err != nil {
+		t.Fatalf("expected service-update token to update services, got %v", err)
+	}
+	for _, method := range []string{pb.AdminService_DeleteUser_FullMethodName, pb.AdminService_DeleteService_FullMethodName} {
+		if status.Code(call(serviceUpdate, method)) != codes.PermissionDenied {
+			t.Fatalf("expected service-update token to be denied %s", method)
+		}
+	}
+
+	if status.Code(call(readOnly+"x", pb.AdminService_ListUsers_FullMethodName)) != codes.Unauthenticated {
+		t.Fatal("expected tampered token to be rejected")
+	}
+}
+
+func TestGRPCReserveAndCommitQuota(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	service, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "s1", Name: "s1", Protocol: "vless"})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 100, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	reserved, err := fx.server.ReserveQuota(ctx, &pb.ReserveQuotaRequest{UserId: user.Id, SessionId: "sess-1", ServiceId: service.Id, Amount: 80, TtlSeconds: 60})
+	if err != nil {
+		t.Fatalf("reserve quota: %v", err)
+	}
+	if !reserved.Granted || reserved.ReservationId == "" || reserved.Remaining != 20 {
+		t.Fatalf("expected 80 bytes reserved with 20 left, got %+v", reserved)
+	}
+
+	denied, err := fx.server.ReserveQuota(ctx, &pb.ReserveQuotaRequest{UserId: user.Id, SessionId: "sess-2", ServiceId: service.Id, Amount: 30})
+	if err != nil {
+		t.Fatalf("reserve quota: %v", err)
+	}
+	if denied.Granted || denied.ReasonCode != string(domain.ReasonQuotaExceeded) {
+		t.Fatalf("expected reservation beyond the package to be refused, got %+v", denied)
+	}
+
+	report := &pb.UsageReport{NodeId: node.Id, ServiceId: service.Id, SessionId: "sess-1", ClientIp: "1.1.1.1", Upload: 10, Download: 50}
+	committed, err := fx.server.CommitReservation(ctx, &pb.CommitReservationRequest{ReservationId: reserved.ReservationId, Report: report})
+	if err != nil {
+		t.Fatalf("commit reservation: %v", err)
+	}
+	if !committed.Result.Accepted {
+		t.Fatalf("expected committed usage to be accepted, got reason=%s", committed.Result.Reason)
+	}
+
+	_, err = fx.server.CommitReservation(ctx, &pb.CommitReservationRequest{ReservationId: reserved.ReservationId, Report: report})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected second commit to fail, got %v", err)
+	}
+
+	current, err := fx.userDB.GetPackage(pkg.Id)
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	if current.Reserved != 0 || current.CurrentTotal != 60 {
+		t.Fatalf("expected reservation settled with 60 bytes used, got reserved=%d total=%d", current.Reserved, current.CurrentTotal)
+	}
+}
+
+func TestGRPCStreamUsage(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "s1-key", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go fx.server.Serve(lis)
+	defer fx.server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	streamCtx := metadata.AppendToOutgoingContext(ctx, "hue-api-key", "s1-key")
+	stream, err := pb.NewUsageServiceClient(conn).StreamUsage(streamCtx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+
+	const reports = 50
+	for i := 0; i < reports; i++ {
+		if err := stream.Send(&pb.UsageReport{UserId: user.Id, SessionId: "sess-1", ClientIp: "1.1.1.1", Upload: 1, Download: 1}); err != nil {
+			t.Fatalf("send report %d: %v", i, err)
+		}
+	}
+	// A report for another node is rejected without ending the stream
+	if err := stream.Send(&pb.UsageReport{UserId: user.Id, NodeId: "other-node", SessionId: "sess-1", Upload: 1}); err != nil {
+		t.Fatalf("send bad report: %v", err)
+	}
+	if err := stream.Send(&pb.UsageReport{UserId: user.Id, SessionId: "sess-1", ClientIp: "1.1.1.1", Upload: 5}); err != nil {
+		t.Fatalf("send last report: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("close send: %v", err)
+	}
+
+	var results []*pb.UsageReportResult
+	for {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("receive result: %v", err)
+		}
+		results = append(results, result)
+	}
+	if len(results) != reports+2 {
+		t.Fatalf("expected one result per report, got %d", len(results))
+	}
+	for i, result := range results[:reports] {
+		if !result.Accepted {
+			t.Fatalf("expected report %d accepted, got reason=%s", i, result.Reason)
+		}
+	}
+	if bad := results[reports]; bad.Accepted || bad.Reason == "" {
+		t.Fatalf("expected the report for another node to be rejected in place, got %+v", bad)
+	}
+	if !results[reports+1].Accepted {
+		t.Fatalf("expected the stream to keep accepting after a rejection, got reason=%s", results[reports+1].Reason)
+	}
+
+	current, err := fx.userDB.GetPackage(pkg.Id)
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	if current.CurrentTotal != 2*reports+5 {
+		t.Fatalf("expected %d bytes recorded, got %d", 2*reports+5, current.CurrentTotal)
+	}
+}
+
+func TestGRPCSubscribeDisconnectsRedeliversUntilAcked(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+	fx.server.engine.SetDisconnectAckTimeout(100 * time.Millisecond)
+
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "s1-key", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go fx.server.Serve(lis)
+	defer fx.server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewUsageServiceClient(conn)
+	svcCtx := metadata.AppendToOutgoingContext(ctx, "hue-api-key", "s1-key")
+
+	other, err := client.SubscribeDisconnects(svcCtx, &pb.SubscribeDisconnectsRequest{NodeId: "other-node"})
+	if err == nil {
+		_, err = other.Recv()
+	}
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected a service key to be denied another node's stream, got %v", err)
+	}
+
+	first, cancelFirst := context.WithCancel(svcCtx)
+	stream, err := client.SubscribeDisconnects(first, &pb.SubscribeDisconnectsRequest{})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	fx.cache.QueueDisconnect("u1", "sess-1", string(domain.ReasonQuotaExceeded), node.Id)
+	fx.cache.QueueDisconnect("u2", "sess-2", string(domain.ReasonQuotaExceeded), "other-node")
+
+	cmd, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("receive command: %v", err)
+	}
+	if cmd.Id == "" || cmd.UserId != "u1" || cmd.SessionId != "sess-1" || cmd.NodeId != node.Id {
+		t.Fatalf("expected the node's own command to be pushed, got %+v", cmd)
+	}
+
+	// The stream drops before the node acks; a new stream gets the command again
+	cancelFirst()
+	stream, err = client.SubscribeDisconnects(svcCtx, &pb.SubscribeDisconnectsRequest{})
+	if err != nil {
+		t.Fatalf("resubscribe: %v", err)
+	}
+	again, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("receive redelivered command: %v", err)
+	}
+	if again.Id != cmd.Id {
+		t.Fatalf("expected the unacked command to be redelivered, got %+v", again)
+	}
+
+	acked, err := client.AckDisconnects(svcCtx, &pb.AckDisconnectsRequest{Ids: []string{cmd.Id}})
+	if err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if acked.Acked != 1 {
+		t.Fatalf("expected one command acked, got %d", acked.Acked)
+	}
+	if n := fx.cache.PendingDisconnects(node.Id); n != 0 {
+		t.Fatalf("expected the acked command to leave the queue, got %d pending", n)
+	}
+	if n := fx.cache.PendingDisconnects("other-node"); n != 1 {
+		t.Fatalf("expected the other node's command to stay queued, got %d", n)
+	}
+}
+
+func TestGRPCGetDisconnectCommandsPollsNodeQueue(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+	fx.server.engine.SetDisconnectBatchSize(2)
+	fx.server.engine.SetDisconnectAckTimeout(50 * time.Millisecond)
+
+	if _, err := fx.server.GetDisconnectCommands(ctx, &pb.GetDisconnectCommandsRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected node_id to be required, got %v", err)
+	}
+
+	for _, session := range []string{"s1", "s2", "s3"} {
+		fx.cache.QueueDisconnect("u1", session, "quota_exceeded", "node-1")
+	}
+	fx.cache.QueueDisconnect("u2", "s4", "quota_exceeded", "node-2")
+
+	first, err := fx.server.GetDisconnectCommands(ctx, &pb.GetDisconnectCommandsRequest{NodeId: "node-1", Limit: 10})
+	if err != nil {
+		t.Fatalf("get disconnect commands: %v", err)
+	}
+	if len(first.Commands) != 2 || first.Commands[0].SessionId != "s1" || first.Commands[1].SessionId != "s2" {
+		t.Fatalf("expected the two oldest commands capped by the batch size, got %+v", first.Commands)
+	}
+
+	second, err := fx.server.GetDisconnectCommands(ctx, &pb.GetDisconnectCommandsRequest{NodeId: "node-1", Limit: 1})
+	if err != nil {
+		t.Fatalf("get disconnect commands: %v", err)
+	}
+	if len(second.Commands) != 1 || second.Commands[0].SessionId != "s3" {
+		t.Fatalf("expected the next unleased command, got %+v", second.Commands)
+	}
+
+	if _, err := fx.server.AckDisconnects(ctx, &pb.AckDisconnectsRequest{NodeId: "node-1", Ids: []string{first.Commands[0].Id, second.Commands[0].Id}}); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	retry, err := fx.server.GetDisconnectCommands(ctx, &pb.GetDisconnectCommandsRequest{NodeId: "node-1"})
+	if err != nil {
+		t.Fatalf("get disconnect commands: %v", err)
+	}
+	if len(retry.Commands) != 1 || retry.Commands[0].Id != first.Commands[1].Id {
+		t.Fatalf("expected only the unacked command to be redelivered, got %+v", retry.Commands)
+	}
+}
+
+func TestGRPCSyncNodeIsScopedToServiceKey(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	node1, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 2})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	node2, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n2", SecretKey: "n2", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node1.Id, SecretKey: "svc1-key", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 3})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	sync := func(nodeID string) (*pb.SyncNodeResponse, error) {
+		callCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("hue-api-key", "svc1-key"))
+		info := &grpc.UnaryServerInfo{FullMethod: pb.NodeService_SyncNode_FullMethodName}
+		resp, err := fx.server.unaryAuthInterceptor(callCtx, &pb.SyncNodeRequest{NodeId: nodeID}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fx.server.SyncNode(ctx, req.(*pb.SyncNodeRequest))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pb.SyncNodeResponse), nil
+	}
+
+	resp, err := sync("")
+	if err != nil {
+		t.Fatalf("sync own node: %v", err)
+	}
+	if resp.NodeId != node1.Id || !resp.Full || len(resp.Users) != 1 {
+		t.Fatalf("expected full snapshot of the service's node, got %+v", resp)
+	}
+	if u := resp.Users[0]; u.UserId != user.Id || u.Remaining != 500 || u.MaxConcurrent != 3 {
+		t.Fatalf("expected remaining traffic in measured bytes, got %+v", u)
+	}
+
+	if _, err := sync(node2.Id); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected another node to be denied, got %v", err)
+	}
+}
+
+func TestGRPCHeartbeatIsScopedToServiceKey(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	node1, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	node2, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n2", SecretKey: "n2", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node1.Id, SecretKey: "svc1-key", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+
+	heartbeat := func(nodeID string) (*pb.HeartbeatResponse, error) {
+		callCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("hue-api-key", "svc1-key"))
+		info := &grpc.UnaryServerInfo{FullMethod: pb.NodeService_Heartbeat_FullMethodName}
+		resp, err := fx.server.unaryAuthInterceptor(callCtx, &pb.HeartbeatRequest{NodeId: nodeID, Overloaded: true}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fx.server.Heartbeat(ctx, req.(*pb.HeartbeatRequest))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pb.HeartbeatResponse), nil
+	}
+
+	if _, err := heartbeat(node2.Id); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected heartbeat for another node to be denied, got %v", err)
+	}
+	if node, _ := fx.userDB.GetNode(node2.Id); node.Draining {
+		t.Fatalf("expected the other node to stay untouched")
+	}
+
+	resp, err := heartbeat("")
+	if err != nil {
+		t.Fatalf("heartbeat own node: %v", err)
+	}
+	if !resp.Draining {
+		t.Fatalf("expected the service's own node to drain, got %+v", resp)
+	}
+	if node, _ := fx.userDB.GetNode(node1.Id); !node.Draining {
+		t.Fatalf("expected own node persisted as draining")
+	}
+}
+
+func TestGRPCReportUsageContinuesCallerTrace(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	service, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "s1-key", Name: "s1", Protocol: "vless"})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	type otlpSpan struct {
+		TraceID      string `json:"traceId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+	}
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected export path %s", r.URL.Path)
+		}
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode export: %v", err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	tracer := tracing.New(tracing.Options{Endpoint: collector.URL, SampleRatio: 1}, zap.NewNop())
+	tracer.Start()
+	fx.server.SetTracer(tracer)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	callCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(tracing.TraceparentHeader, "00-"+traceID+"-00f067aa0ba902b7-01"))
+	info := &grpc.UnaryServerInfo{FullMethod: pb.UsageService_ReportUsage_FullMethodName}
+	_, err = fx.server.unaryTraceInterceptor(callCtx, nil, info, func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return fx.server.ReportUsage(ctx, &pb.ReportUsageRequest{Report: &pb.UsageReport{
+			UserId: user.Id, NodeId: node.Id, ServiceId: service.Id, SessionId: "sess-1", ClientIp: "1.1.1.1", Upload: 1, Download: 1,
+		}})
+	})
+	if err != nil {
+		t.Fatalf("report usage: %v", err)
+	}
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown tracer: %v", err)
+	}
+
+	names := map[string]bool{}
+	for _, span := range spans {
+		if span.TraceID != traceID || span.ParentSpanID == "" {
+			t.Fatalf("expected every span in the caller's trace, got %+v", span)
+		}
+		names[span.Name] = true
+	}
+	for _, want := range []string{"hue.UsageService/ReportUsage", "UsageService.reportUsage", "engine.ProcessUsageReport", "quota.CheckQuota", "sqlite.GetPackageByUserID"} {
+		if !names[want] {
+			t.Fatalf("expected a %s span, got %v", want, names)
+		}
+	}
+}
+
+func TestGRPCServiceKeysNeedNodeCertificate(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+	fx.server.SetNodeCertRequired(true)
+
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "edge-1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "svc1-key", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+
+	call := func(key string, cert *x509.Certificate) codes.Code {
+		callCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("hue-api-key", key))
+		if cert != nil {
+			callCtx = peer.NewContext(callCtx, &peer.Peer{
+				Addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)},
+				AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+			})
+		}
+		info := &grpc.UnaryServerInfo{FullMethod: pb.NodeService_Heartbeat_FullMethodName}
+		_, err := fx.server.unaryAuthInterceptor(callCtx, nil, info, func(context.Context, interface{}) (interface{}, error) {
+			return nil, nil
+		})
+		return status.Code(err)
+	}
+
+	cases := []struct {
+		name string
+		key  string
+		cert *x509.Certificate
+		code codes.Code
+	}{
+		{"service key without a certificate", "svc1-key", nil, codes.Unauthenticated},
+		{"certificate named after the node", "svc1-key", &x509.Certificate{Subject: pkix.Name{CommonName: "edge-1"}}, codes.OK},
+		{"node ID as a DNS name", "svc1-key", &x509.Certificate{DNSNames: []string{node.Id}}, codes.OK},
+		{"another node's certificate", "svc1-key", &x509.Certificate{Subject: pkix.Name{CommonName: "edge-2"}}, codes.PermissionDenied},
+		{"owner key without a certificate", "secret", nil, codes.OK},
+	}
+	for _, tc := range cases {
+		if got := call(tc.key, tc.cert); got != tc.code {
+			t.Fatalf("%s: expected %s, got %s", tc.name, tc.code, got)
+		}
+	}
+}
+
+func TestGRPCVerifyUserPassword(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1"})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "pw-key", Name: "trojan", Protocol: "trojan", AllowedAuthMethods: []string{"password"}}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "uuid-key", Name: "vless", Protocol: "vless", AllowedAuthMethods: []string{"uuid"}}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if _, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "long", Password: strings.Repeat("x", domain.MaxPasswordLength+1)}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected a password bcrypt cannot hash to be rejected, got %v", err)
+	}
+
+	verify := func(key, username, password string) (*pb.VerifyUserPasswordResponse, error) {
+		callCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("hue-api-key", key))
+		info := &grpc.UnaryServerInfo{FullMethod: pb.NodeService_VerifyUserPassword_FullMethodName}
+		resp, err := fx.server.unaryAuthInterceptor(callCtx, &pb.VerifyUserPasswordRequest{Username: username, Password: password}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fx.server.VerifyUserPassword(ctx, req.(*pb.VerifyUserPasswordRequest))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pb.VerifyUserPasswordResponse), nil
+	}
+
+	if resp, err := verify("pw-key", "u1", "p1"); err != nil || !resp.Valid || resp.UserId != user.Id {
+		t.Fatalf("expected the password to verify, got %+v err=%v", resp, err)
+	}
+	if resp, err := verify("pw-key", "u1", "wrong"); err != nil || resp.Valid || resp.UserId != "" {
+		t.Fatalf("expected a wrong password to be invalid, got %+v err=%v", resp, err)
+	}
+	if resp, err := verify("pw-key", "nobody", "p1"); err != nil || resp.Valid {
+		t.Fatalf("expected an unknown user to be invalid, got %+v err=%v", resp, err)
+	}
+	if _, err := verify("uuid-key", "u1", "p1"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected a service without password auth to be denied, got %v", err)
+	}
+
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, Password: "p2"}); err != nil {
+		t.Fatalf("update password: %v", err)
+	}
+	if resp, err := verify("pw-key", "u1", "p2"); err != nil || !resp.Valid {
+		t.Fatalf("expected the new password to verify, got %+v err=%v", resp, err)
+	}
+}
+
+func TestGRPCAuthorizeConnection(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	service, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "svc-key", Name: "s1", Protocol: "vless", AllowedAuthMethods: []string{"uuid", "password", "pubkey"}})
+	if err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: "u1", Password: "p1", PublicKey: "ssh-ed25519 AAAA"})
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600, MaxConcurrent: 1, MaxIps: 2})
+	if err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+
+	authorize := func(req *pb.AuthorizeConnectionRequest) (*pb.AuthorizeConnectionResponse, error) {
+		callCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("hue-api-key", "svc-key"))
+		info := &grpc.UnaryServerInfo{FullMethod: pb.NodeService_AuthorizeConnection_FullMethodName}
+		resp, err := fx.server.unaryAuthInterceptor(callCtx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fx.server.AuthorizeConnection(ctx, req.(*pb.AuthorizeConnectionRequest))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*pb.AuthorizeConnectionResponse), nil
+	}
+
+	byUUID := &pb.AuthorizeConnectionRequest{AuthMethod: "uuid", UserId: user.Id, SessionId: "s1"}
+	if resp, err := authorize(byUUID); err != nil || resp.Allowed || resp.ReasonCode != string(domain.ReasonUserInactive) {
+		t.Fatalf("expected a user without an active package to be denied, got %+v err=%v", resp, err)
+	}
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+		t.Fatalf("attach active package: %v", err)
+	}
+
+	resp, err := authorize(byUUID)
+	if err != nil || !resp.Allowed || resp.UserId != user.Id || resp.PackageId != pkg.Id || resp.MaxConcurrent != 1 || resp.MaxIps != 2 {
+		t.Fatalf("expected the user to be allowed with the package limits, got %+v err=%v", resp, err)
+	}
+	if resp, err := authorize(&pb.AuthorizeConnectionRequest{AuthMethod: "password", Username: "u1", Password: "p1"}); err != nil || !resp.Allowed || resp.UserId != user.Id {
+		t.Fatalf("expected the password to authorize, got %+v err=%v", resp, err)
+	}
+	if resp, err := authorize(&pb.AuthorizeConnectionRequest{AuthMethod: "password", Username: "u1", Password: "wrong"}); err != nil || resp.Allowed || resp.UserId != "" || resp.ReasonCode != string(domain.ReasonInvalidCredentials) {
+		t.Fatalf("expected a wrong password to be denied, got %+v err=%v", resp, err)
+	}
+	if resp, err := authorize(&pb.AuthorizeConnectionRequest{AuthMethod: "pubkey", PublicKey: "ssh-ed25519 AAAA"}); err != nil || !resp.Allowed || resp.UserId != user.Id {
+		t.Fatalf("expected the public key to authorize, got %+v err=%v", resp, err)
+	}
+	if _, err := authorize(&pb.AuthorizeConnectionRequest{AuthMethod: "cert"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected a method the service does not allow to be denied, got %v", err)
+	}
+	if _, err := authorize(&pb.AuthorizeConnectionRequest{ServiceId: "other", AuthMethod: "uuid", UserId: user.Id}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected another service to be denied, got %v", err)
+	}
+
+	// Authorizing records no session; the first report does
+	if resp, err := authorize(&pb.AuthorizeConnectionRequest{AuthMethod: "uuid", UserId: user.Id, SessionId: "s2"}); err != nil || !resp.Allowed || resp.ActiveSessions != 0 {
+		t.Fatalf("expected a second session to be allowed before any report, got %+v err=%v", resp, err)
+	}
+	report, err := fx.server.ReportUsage(ctx, &pb.ReportUsageRequest{Report: &pb.UsageReport{UserId: user.Id, NodeId: node.Id, ServiceId: service.Id, SessionId: "s1", Download: 10}})
+	if err != nil || !report.Result.Accepted {
+		t.Fatalf("report usage: %+v err=%v", report, err)
+	}
+	if resp, err := authorize(byUUID); err != nil || !resp.Allowed || resp.ActiveSessions != 1 {
+		t.Fatalf("expected the active session to stay allowed, got %+v err=%v", resp, err)
+	}
+	if resp, err := authorize(&pb.AuthorizeConnectionRequest{AuthMethod: "uuid", UserId: user.Id, SessionId: "s2"}); err != nil || resp.Allowed || resp.ReasonCode != string(domain.ReasonConcurrentLimit) {
+		t.Fatalf("expected a second session past the limit to be denied, got %+v err=%v", resp, err)
+	}
+}
+
+func TestGRPCGetUsersForNodeSyncsChanges(t *testing.T) {
+	fx := newGRPCFixture(t)
+	ctx := context.Background()
+
+	node, err := fx.server.CreateNode(ctx, &pb.CreateNodeRequest{Name: "n1", SecretKey: "n1", TrafficMultiplier: 1})
+	if err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if _, err := fx.server.CreateService(ctx, &pb.CreateServiceRequest{NodeId: node.Id, SecretKey: "svc-key", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	var userIDs []string
+	for _, name := range []string{"u1", "u2"} {
+		user, err := fx.server.CreateUser(ctx, &pb.CreateUserRequest{Username: name, Password: "p", PublicKey: name + "-key", ProtocolSecret: name + "-trojan"})
+		if err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		pkg, err := fx.server.CreatePackage(ctx, &pb.CreatePackageRequest{UserId: user.Id, TotalTraffic: 1000, ResetMode: string(domain.ResetModeNoReset), Duration: 3600})
+		if err != nil {
+			t.Fatalf("create package: %v", err)
+		}
+		if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: pkg.Id}); err != nil {
+			t.Fatalf("attach active package: %v", err)
+		}
+		userIDs = append(userIDs, user.Id)
+	}
+
+	get := func(since int64) *pb.SyncNodeResponse {
+		t.Helper()
+		callCtx := metadata.NewIncomingContext(ctx, metadata.Pairs("hue-api-key", "svc-key"))
+		info := &grpc.UnaryServerInfo{FullMethod: pb.NodeService_GetUsersForNode_FullMethodName}
+		resp, err := fx.server.unaryAuthInterceptor(callCtx, &pb.GetUsersForNodeRequest{Since: since}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fx.server.GetUsersForNode(ctx, req.(*pb.GetUsersForNodeRequest))
+		})
+		if err != nil {
+			t.Fatalf("get users for node: %v", err)
+		}
+		return resp.(*pb.SyncNodeResponse)
+	}
+
+	full := get(0)
+	if !full.Full || full.NodeId != node.Id || len(full.Users) != 2 {
+		t.Fatalf("expected a full snapshot of both users, got %+v", full)
+	}
+	if u := full.Users[0]; u.PublicKey != u.Username+"-key" || u.ProtocolSecret != u.Username+"-trojan" || u.Status != string(domain.UserStatusActive) || u.Remaining != 1000 {
+		t.Fatalf("expected credentials, status and remaining traffic, got %+v", u)
+	}
+
+	time.Sleep(time.Millisecond)
+	if _, err := fx.server.UpdateUser(ctx, &pb.UpdateUserRequest{Id: userIDs[0], PublicKey: "rotated"}); err != nil {
+		t.Fatalf("update user: %v", err)
+	}
+	if _, err := fx.server.DeleteUser(ctx, &pb.DeleteUserRequest{Id: userIDs[1]}); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+	delta := get(full.Cursor)
+	if delta.Full || len(delta.Users) != 1 || delta.Users[0].PublicKey != "rotated" {
+		t.Fatalf("expected only the changed user, got %+v", delta)
+	}
+	if len(delta.Removed) != 1 || delta.Removed[0] != userIDs[1] {
+		t.Fatalf("expected the deleted user to be removed, got %v", delta.Removed)
+	}
+}
@@ -1,15 +1,33 @@
 package http
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/auth"
 	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/engine"
+	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/importer"
+	"github.com/hiddify/hue-go/internal/jobs"
+	"github.com/hiddify/hue-go/internal/metrics"
+	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/pkg/panelhook"
+	pb "github.com/hiddify/hue-go/pkg/proto"
 	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
 )
 
 // Server implements the HTTP REST API
@@ -17,22 +35,52 @@ type Server struct {
 	router      *gin.Engine
 	userDB      *sqlite.UserDB
 	activeDB    *sqlite.ActiveDB
+	historyDB   *sqlite.HistoryDB
 	quotaEngine *engine.QuotaEngine
+	usage       *engine.Engine
+	sessions    *engine.SessionManager
+	penalty     *engine.PenaltyHandler
+	geo         *engine.GeoHandler
+	stats       *cache.StatsCache
+	scheduler   *jobs.Scheduler
+	biller      *engine.Biller
+	digester    *engine.Digester
+	panel       *engine.PanelSync
+	hub         *eventstore.ReceiverHub
+	events      eventstore.EventStore
+	metrics     *metrics.Registry
 	logger      *zap.Logger
 	secret      string
+	tokens      *auth.TokenIssuer // nil disables access tokens
 }
 
 // NewServer creates a new HTTP server
 func NewServer(
 	userDB *sqlite.UserDB,
 	activeDB *sqlite.ActiveDB,
+	historyDB *sqlite.HistoryDB,
 	quotaEngine *engine.QuotaEngine,
+	usage *engine.Engine,
+	sessions *engine.SessionManager,
+	penalty *engine.PenaltyHandler,
+	geo *engine.GeoHandler,
+	stats *cache.StatsCache,
+	scheduler *jobs.Scheduler,
+	biller *engine.Biller,
+	digester *engine.Digester,
+	panel *engine.PanelSync,
+	hub *eventstore.ReceiverHub,
+	events eventstore.EventStore,
+	registry *metrics.Registry,
 	logger *zap.Logger,
 	secret string,
+	tokens *auth.TokenIssuer,
 ) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 
 	router := gin.New()
+	// Believe no forwarding headers until the deployment names its proxies
+	_ = router.SetTrustedProxies(nil)
 	router.Use(gin.Recovery())
 	router.Use(corsMiddleware())
 
@@ -40,9 +88,23 @@ func NewServer(
 		router:      router,
 		userDB:      userDB,
 		activeDB:    activeDB,
+		historyDB:   historyDB,
 		quotaEngine: quotaEngine,
+		usage:       usage,
+		sessions:    sessions,
+		penalty:     penalty,
+		geo:         geo,
+		stats:       stats,
+		scheduler:   scheduler,
+		biller:      biller,
+		digester:    digester,
+		panel:       panel,
+		hub:         hub,
+		events:      events,
+		metrics:     registry,
 		logger:      logger,
 		secret:      secret,
+		tokens:      tokens,
 	}
 
 	// Setup routes
@@ -51,15 +113,31 @@ func NewServer(
 	return router
 }
 
+// apiVersions are the REST API versions mounted under /api, oldest first. A
+// breaking change is served as a new prefix next to the existing ones.
+var apiVersions = []string{"v1"}
+
 func (s *Server) setupRoutes() {
+	s.router.Use(apiVersionHeader())
+
 	// Health check (no auth required)
 	s.router.GET("/health", s.healthCheck)
+	s.router.GET("/api/versions", s.listAPIVersions)
 	s.router.GET("/swagger", s.swaggerUI)
 	s.router.GET("/swagger/", s.swaggerUI)
+	s.router.GET("/api/v1/reasons", s.listReasons)
+	s.router.GET("/api/v1/messages", s.listMessages)
+
+	// Prometheus metrics, readable by monitor keys
+	if s.metrics != nil {
+		s.router.GET(metricsRoute, s.authMiddleware(), s.serveMetrics)
+	}
 
 	// API v1 routes with auth
 	api := s.router.Group("/api/v1")
 	api.Use(s.authMiddleware())
+	api.Use(s.managerFilterMiddleware())
+	api.Use(s.statsBustMiddleware())
 	{
 		// User routes
 		api.GET("/users", s.listUsers)
@@ -67,26 +145,274 @@ func (s *Server) setupRoutes() {
 		api.GET("/users/:id", s.getUser)
 		api.PUT("/users/:id", s.updateUser)
 		api.DELETE("/users/:id", s.deleteUser)
+		api.GET("/users/:id/sessions", s.getUserSessions)
+		api.GET("/users/:id/subscription", s.getUserSubscription)
+		api.POST("/users/:id/disconnect", s.disconnectUser)
+		api.GET("/users/:id/reservations", s.listUserReservations)
+		api.GET("/users/:id/penalty", s.getUserPenalty)
+		api.DELETE("/users/:id/penalty", s.clearUserPenalty)
+		api.GET("/users/:id/devices", s.listUserDevices)
+		api.POST("/users/:id/devices/:device_id/approve", s.approveUserDevice)
+		api.DELETE("/users/:id/devices/:device_id", s.deleteUserDevice)
+		api.POST("/cache/users/:id/refresh", s.refreshUserCache)
 
 		// Package routes
 		api.POST("/packages", s.createPackage)
 		api.GET("/packages/:id", s.getPackage)
 		api.GET("/users/:id/package", s.getUserPackage)
+		api.GET("/users/:id/packages", s.listUserPackages)
 
 		// Node routes
 		api.GET("/nodes", s.listNodes)
 		api.POST("/nodes", s.createNode)
+		api.GET("/nodes/recommended", s.recommendNodes)
 		api.GET("/nodes/:id", s.getNode)
+		api.PUT("/nodes/:id/manager", s.assignNodeManager)
 		api.DELETE("/nodes/:id", s.deleteNode)
+		api.GET("/nodes/:id/sync", s.syncNode)
 
 		// Service routes
+		api.GET("/services", s.listServices)
 		api.POST("/services", s.createService)
 		api.GET("/services/:id", s.getService)
+		api.PUT("/services/:id", s.updateService)
+		api.PUT("/services/:id/manager", s.assignServiceManager)
 		api.DELETE("/services/:id", s.deleteService)
 
+		// Group routes
+		api.GET("/groups", s.listGroups)
+		api.POST("/groups", s.createGroup)
+		api.GET("/groups/:name", s.getGroup)
+		api.PUT("/groups/:name", s.updateGroup)
+		api.DELETE("/groups/:name", s.deleteGroup)
+
 		// Stats routes
 		api.GET("/stats", s.getStats)
+		api.GET("/stats/tags", s.getTagStats)
+		api.GET("/stats/nodes/active-users", s.getNodeActiveUsers)
+		api.GET("/stats/top/users", s.getTopUsers)
+		api.GET("/stats/top/nodes", s.getTopNodes)
+		api.GET("/stats/usage", s.getUsageRollups)
+
+		// Export routes
+		api.GET("/export/users", s.exportUsers)
+		api.GET("/export/usage", s.exportUsage)
+		api.POST("/import", s.importUsers)
+
+		// Event routes
+		api.GET("/events", s.listEvents)
+		api.GET("/events/ws", s.streamEvents)
+		api.GET("/events/stream", s.streamEventsSSE)
+		api.GET("/events/replay", s.replayEvents)
+
+		// Admin routes
+		api.GET("/admin/jobs", s.listJobs)
+		api.GET("/admin/jobs/:name", s.getJob)
+		api.POST("/admin/jobs/:name/run", s.runJob)
+		api.GET("/admin/geo", s.getGeoStatus)
+		api.PUT("/admin/geo", s.loadGeoDatabase)
+		api.GET("/admin/keys", s.listAPIKeys)
+		api.POST("/admin/keys", s.createAPIKey)
+		api.DELETE("/admin/keys/:id", s.revokeAPIKey)
+		api.GET("/admin/auth-keys", s.listAuthKeys)
+		api.POST("/admin/auth-keys/owner/rotate", s.rotateOwnerAuthKey)
+		api.POST("/admin/auth-keys/services/:id", s.createServiceAuthKey)
+		api.POST("/admin/auth-keys/services/:id/rotate", s.rotateServiceAuthKey)
+		api.DELETE("/admin/auth-keys/services/:id", s.revokeServiceAuthKey)
+		api.POST("/auth/token", s.issueToken)
+
+		// Manager routes
+		api.GET("/managers", s.listManagers)
+		api.POST("/managers", s.createManager)
+		api.GET("/managers/:id", s.getManager)
+		api.PUT("/managers/:id", s.updateManager)
+		api.DELETE("/managers/:id", s.deleteManager)
+		api.GET("/managers/:id/children", s.listManagerChildren)
+		api.GET("/managers/:id/tree", s.getManagerTree)
+
+		// Manager top-up routes
+		api.GET("/managers/:id/topups", s.listTopUps)
+		api.POST("/managers/:id/topups", s.requestTopUp)
+		api.GET("/managers/:id/topups/incoming", s.listIncomingTopUps)
+		api.POST("/topups/:id/approve", s.approveTopUp)
+		api.POST("/topups/:id/reject", s.rejectTopUp)
+
+		// Billing routes
+		api.GET("/billing", s.listBilling)
+		api.POST("/billing/generate", s.generateBilling)
+		api.GET("/managers/:id/billing", s.listManagerBilling)
+
+		// Manager digest routes
+		api.GET("/managers/:id/digest", s.getDigestSubscription)
+		api.PUT("/managers/:id/digest", s.updateDigestSubscription)
+		api.GET("/managers/:id/digest/preview", s.previewDigest)
+
+		// Hiddify panel sync routes
+		api.GET("/panel/callbacks", s.listPanelCallbacks)
+		api.POST("/panel/callbacks/replay", s.replayPanelCallbacks)
+	}
+}
+
+// monitorRoutes are the GET routes a monitor-scoped key may read. /health is
+// public and needs no key at all.
+var monitorRoutes = map[string]bool{
+	"/api/v1/stats":                    true,
+	"/api/v1/stats/tags":               true,
+	"/api/v1/stats/nodes/active-users": true,
+	"/api/v1/stats/top/users":          true,
+	"/api/v1/stats/top/nodes":          true,
+	"/api/v1/stats/usage":              true,
+	"/api/v1/events":                   true,
+	"/api/v1/events/replay":            true,
+	eventsWSRoute:                      true,
+	eventsSSERoute:                     true,
+	metricsRoute:                       true,
+}
+
+// managerRoutes are the routes a manager-scoped key may call; the handlers
+// check that the key's manager is the one concerned
+var managerRoutes = map[string]bool{
+	"/api/v1/managers/:id/billing":         true,
+	"/api/v1/managers/:id/digest":          true,
+	"/api/v1/managers/:id/digest/preview":  true,
+	"/api/v1/managers/:id/topups":          true,
+	"/api/v1/managers/:id/topups/incoming": true,
+	"/api/v1/managers/:id/tree":            true,
+	"/api/v1/topups/:id/approve":           true,
+	"/api/v1/topups/:id/reject":            true,
+}
+
+// managerUserRoutes are the user and package routes a manager-scoped key may
+// call; managerFilterMiddleware limits them to the key's manager's users
+var managerUserRoutes = map[string]bool{
+	"/api/v1/users":                  true,
+	"/api/v1/users/:id":              true,
+	"/api/v1/users/:id/package":      true,
+	"/api/v1/users/:id/packages":     true,
+	"/api/v1/users/:id/subscription": true,
+	"/api/v1/packages":               true,
+	"/api/v1/packages/:id":           true,
+}
+
+// apiKeyContextKey holds the scoped key that authenticated a request; it is
+// unset for the owner key
+const apiKeyContextKey = "api_key"
+
+// keyAllows reports whether a scoped key may make the request
+func keyAllows(key *domain.APIKey, c *gin.Context) bool {
+	switch key.Scope {
+	case domain.KeyScopeMonitor:
+		return c.Request.Method == http.MethodGet && monitorRoutes[c.FullPath()]
+	case domain.KeyScopeManager:
+		return key.ManagerID != nil && (managerRoutes[c.FullPath()] || managerUserRoutes[c.FullPath()])
+	}
+	return false
+}
+
+// managerFilterContextKey holds the manager a manager-scoped key's user and
+// package requests are limited to
+const managerFilterContextKey = "manager_filter"
+
+// managerFilter returns the manager the request is limited to, or nil when
+// it may see every user
+func managerFilter(c *gin.Context) *string {
+	if v, ok := c.Get(managerFilterContextKey); ok {
+		managerID := v.(string)
+		return &managerID
+	}
+	return nil
+}
+
+// tokenContextKey holds the claims of the access token that authenticated a
+// request
+const tokenContextKey = "token_claims"
+
+// readOnlyTokenRoutes are the requests a read-only token may make, by
+// method and route. Keys, panel callbacks, node sync and the user export
+// carry credentials and need full.
+var readOnlyTokenRoutes = map[string]bool{
+	"GET /api/v1/users":                        true,
+	"GET /api/v1/users/:id":                    true,
+	"GET /api/v1/users/:id/sessions":           true,
+	"GET /api/v1/users/:id/subscription":       true,
+	"GET /api/v1/users/:id/reservations":       true,
+	"GET /api/v1/users/:id/penalty":            true,
+	"GET /api/v1/users/:id/devices":            true,
+	"GET /api/v1/users/:id/package":            true,
+	"GET /api/v1/users/:id/packages":           true,
+	"GET /api/v1/packages/:id":                 true,
+	"GET /api/v1/nodes":                        true,
+	"GET /api/v1/nodes/recommended":            true,
+	"GET /api/v1/nodes/:id":                    true,
+	"GET /api/v1/services":                     true,
+	"GET /api/v1/services/:id":                 true,
+	"GET /api/v1/groups":                       true,
+	"GET /api/v1/groups/:name":                 true,
+	"GET /api/v1/stats":                        true,
+	"GET /api/v1/stats/tags":                   true,
+	"GET /api/v1/stats/nodes/active-users":     true,
+	"GET /api/v1/stats/top/users":              true,
+	"GET /api/v1/stats/top/nodes":              true,
+	"GET /api/v1/stats/usage":                  true,
+	"GET /api/v1/export/usage":                 true,
+	"GET /api/v1/events":                       true,
+	"GET " + eventsWSRoute:                     true,
+	"GET " + eventsSSERoute:                    true,
+	"GET /api/v1/events/replay":                true,
+	"GET /api/v1/admin/jobs":                   true,
+	"GET /api/v1/admin/jobs/:name":             true,
+	"GET /api/v1/admin/geo":                    true,
+	"GET /api/v1/managers":                     true,
+	"GET /api/v1/managers/:id":                 true,
+	"GET /api/v1/managers/:id/children":        true,
+	"GET /api/v1/managers/:id/tree":            true,
+	"GET /api/v1/managers/:id/topups":          true,
+	"GET /api/v1/managers/:id/topups/incoming": true,
+	"GET /api/v1/billing":                      true,
+	"GET /api/v1/managers/:id/billing":         true,
+	"GET /api/v1/managers/:id/digest":          true,
+	"GET /api/v1/managers/:id/digest/preview":  true,
+	"GET " + metricsRoute:                      true,
+}
+
+// serviceUpdateTokenRoutes are the requests a service-update token may
+// make: reading services and changing their settings
+var serviceUpdateTokenRoutes = map[string]bool{
+	"GET /api/v1/services":     true,
+	"GET /api/v1/services/:id": true,
+	"PUT /api/v1/services/:id": true,
+}
+
+// tokenAllows reports whether a token's scopes allow the request: full
+// allows everything, the other scopes the requests they list
+func tokenAllows(scope auth.Scope, c *gin.Context) bool {
+	route := c.Request.Method + " " + c.FullPath()
+	switch {
+	case scope.Has(auth.ScopeFull):
+		return true
+	case scope.Has(auth.ScopeReadOnly) && readOnlyTokenRoutes[route]:
+		return true
+	case scope.Has(auth.ScopeServiceUpdate) && serviceUpdateTokenRoutes[route]:
+		return true
+	}
+	return false
+}
+
+// requestScope returns the scopes of the credential behind a request: the
+// token's, or full for the owner key
+func requestScope(c *gin.Context) auth.Scope {
+	if v, ok := c.Get(tokenContextKey); ok {
+		return v.(*auth.Claims).Scope()
 	}
+	return auth.ScopeFull
+}
+
+// requestKey returns the scoped key behind a request, or nil for the owner
+func requestKey(c *gin.Context) *domain.APIKey {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		return v.(*domain.APIKey)
+	}
+	return nil
 }
 
 // Middleware
@@ -109,6 +435,14 @@ func corsMiddleware() gin.HandlerFunc {
 func (s *Server) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		secret := c.GetHeader("Hue-API-Key")
+		// Browsers cannot set headers on a WebSocket handshake or EventSource
+		if secret == "" && (c.FullPath() == eventsWSRoute || c.FullPath() == eventsSSERoute) {
+			secret = c.Query("api_key")
+		}
+		// Access tokens and Prometheus scrapers use a bearer token
+		if secret == "" {
+			secret, _ = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
 
 		if secret == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
@@ -116,6 +450,23 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if s.tokens != nil && auth.IsToken(secret) {
+			claims, err := s.tokens.Parse(secret)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+				c.Abort()
+				return
+			}
+			if !tokenAllows(claims.Scope(), c) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "token scope does not allow this request"})
+				c.Abort()
+				return
+			}
+			c.Set(tokenContextKey, claims)
+			c.Next()
+			return
+		}
+
 		if s.secret != "" && secret == s.secret {
 			c.Next()
 			return
@@ -133,18 +484,107 @@ func (s *Server) authMiddleware() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-		if !ok {
+		if ok {
+			c.Next()
+			return
+		}
+
+		key, err := s.userDB.AuthenticateAPIKey(secret)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "auth validation failed"})
+			c.Abort()
+			return
+		}
+		if key == nil {
+			s.logger.Warn("rejected API key",
+				zap.String("client_ip", c.ClientIP()),
+				zap.String("path", c.Request.URL.Path),
+			)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 			c.Abort()
 			return
 		}
+		if !keyAllows(key, c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "api key scope does not allow this request"})
+			c.Abort()
+			return
+		}
+
+		c.Set(apiKeyContextKey, key)
+		c.Next()
+	}
+}
+
+// managerFilterMiddleware limits manager-scoped keys to their manager's
+// users and packages. It injects the manager as a filter for the handlers
+// and answers 404 for a user or package of anyone else.
+func (s *Server) managerFilterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := requestKey(c)
+		if key == nil || key.ManagerID == nil || key.Scope != domain.KeyScopeManager || !managerUserRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		c.Set(managerFilterContextKey, *key.ManagerID)
+
+		var userID string
+		switch c.FullPath() {
+		case "/api/v1/users", "/api/v1/packages":
+			// Listings and creation apply the filter themselves
+			c.Next()
+			return
+		case "/api/v1/packages/:id":
+			pkg, err := s.userDB.GetPackage(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
+			if pkg == nil {
+				c.Next()
+				return
+			}
+			userID = pkg.UserID
+		default:
+			userID = c.Param("id")
+		}
 
+		if !s.managesUser(c, *key.ManagerID, userID) {
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
 
+// managesUser reports whether a user exists and belongs to managerID,
+// answering the request with 404 when it does not
+func (s *Server) managesUser(c *gin.Context, managerID, userID string) bool {
+	user, err := s.userDB.GetUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if user == nil || user.ManagerID == nil || *user.ManagerID != managerID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return false
+	}
+	return true
+}
+
 // Health check
 
+// metricsRoute serves the Prometheus metrics
+const metricsRoute = "/metrics"
+
+func (s *Server) serveMetrics(c *gin.Context) {
+	c.Header("Content-Type", metrics.ContentType)
+	c.Status(http.StatusOK)
+	if _, err := s.metrics.WriteTo(c.Writer); err != nil {
+		s.logger.Debug("failed to write metrics", zap.Error(err))
+	}
+}
+
 func (s *Server) healthCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"status":  "healthy",
@@ -174,6 +614,12 @@ func (s *Server) listUsers(c *gin.Context) {
 	if search := c.Query("search"); search != "" {
 		filter.Search = &search
 	}
+	if managerID := c.Query("manager_id"); managerID != "" {
+		filter.ManagerID = &managerID
+	}
+	if managerID := managerFilter(c); managerID != nil {
+		filter.ManagerID = managerID
+	}
 
 	users, err := s.userDB.ListUsers(filter)
 	if err != nil {
@@ -193,25 +639,48 @@ func (s *Server) createUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := domain.ValidateUserAttributes(req.Attributes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := domain.ValidateUserPassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if managerID := managerFilter(c); managerID != nil {
+		if req.ManagerID != nil && *req.ManagerID != *managerID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "manager keys can only create users of their own manager"})
+			return
+		}
+		req.ManagerID = managerID
+	}
 
 	user := &domain.User{
-		ID:             uuid.New().String(),
-		ManagerID:      req.ManagerID,
-		Username:       req.Username,
-		Password:       req.Password,
-		PublicKey:      req.PublicKey,
-		PrivateKey:     req.PrivateKey,
-		CACertList:     req.CACertList,
-		Groups:         req.Groups,
-		AllowedDevices: req.AllowedDevices,
-		Status:         domain.UserStatusActive,
+		ID:              uuid.New().String(),
+		ManagerID:       req.ManagerID,
+		Username:        req.Username,
+		Password:        req.Password,
+		PublicKey:       req.PublicKey,
+		PrivateKey:      req.PrivateKey,
+		ProtocolSecret:  req.ProtocolSecret,
+		CACertList:      req.CACertList,
+		Groups:          req.Groups,
+		AllowedDevices:  req.AllowedDevices,
+		AllowedNodes:    req.AllowedNodes,
+		AllowedServices: req.AllowedServices,
+		Attributes:      req.Attributes,
+		Status:          domain.UserStatusActive,
 		ActivePackageID: req.ActivePackageID,
+
+		AllowedCountries: req.AllowedCountries,
+		DeniedCountries:  req.DeniedCountries,
 	}
 
 	if err := s.userDB.CreateUser(user); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.quotaEngine.InvalidateUser(user.ID)
 
 	c.JSON(http.StatusCreated, user)
 }
@@ -256,9 +725,17 @@ func (s *Server) updateUser(c *gin.Context) {
 		user.Username = *req.Username
 	}
 	if req.ManagerID != nil {
+		if managerID := managerFilter(c); managerID != nil && *req.ManagerID != *managerID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "manager keys cannot move users to another manager"})
+			return
+		}
 		user.ManagerID = req.ManagerID
 	}
 	if req.Password != nil {
+		if err := domain.ValidateUserPassword(*req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		user.Password = *req.Password
 	}
 	if req.PublicKey != nil {
@@ -267,6 +744,9 @@ func (s *Server) updateUser(c *gin.Context) {
 	if req.PrivateKey != nil {
 		user.PrivateKey = *req.PrivateKey
 	}
+	if req.ProtocolSecret != nil {
+		user.ProtocolSecret = *req.ProtocolSecret
+	}
 	if req.CACertList != nil {
 		user.CACertList = *req.CACertList
 	}
@@ -276,6 +756,26 @@ func (s *Server) updateUser(c *gin.Context) {
 	if req.AllowedDevices != nil {
 		user.AllowedDevices = *req.AllowedDevices
 	}
+	if req.AllowedNodes != nil {
+		user.AllowedNodes = *req.AllowedNodes
+	}
+	if req.AllowedServices != nil {
+		user.AllowedServices = *req.AllowedServices
+	}
+	if req.AllowedCountries != nil {
+		user.AllowedCountries = *req.AllowedCountries
+	}
+	if req.DeniedCountries != nil {
+		user.DeniedCountries = *req.DeniedCountries
+	}
+	if req.Attributes != nil {
+		if err := domain.ValidateUserAttributes(*req.Attributes); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user.Attributes = *req.Attributes
+	}
+	previousStatus := user.Status
 	if req.Status != nil {
 		user.Status = *req.Status
 	}
@@ -287,6 +787,10 @@ func (s *Server) updateUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.quotaEngine.InvalidateUser(user.ID)
+	if s.usage != nil {
+		s.usage.EmitStatusChange(user.ID, previousStatus, user.Status)
+	}
 
 	c.JSON(http.StatusOK, user)
 }
@@ -298,230 +802,3031 @@ func (s *Server) deleteUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	s.quotaEngine.InvalidateUser(id)
 
 	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
 }
 
-// Package handlers
+// disconnectRequest is the optional body of the disconnect endpoint
+type disconnectRequest struct {
+	SessionID string `json:"session_id"` // Empty ends every session
+}
 
-func (s *Server) createPackage(c *gin.Context) {
-	var req domain.PackageCreate
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// disconnectUser ends a user's sessions, or one of them, and queues a
+// disconnect command for each session's node
+func (s *Server) disconnectUser(c *gin.Context) {
+	if s.usage == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "usage engine unavailable"})
 		return
 	}
 
-	pkg := &domain.Package{
-		ID:            uuid.New().String(),
-		UserID:        req.UserID,
-		TotalLimit:    req.TotalTraffic,
-		TotalTraffic:  req.TotalTraffic,
-		UploadLimit:   req.UploadLimit,
-		DownloadLimit: req.DownloadLimit,
-		ResetMode:     req.ResetMode,
-		Duration:      req.Duration,
-		StartAt:       req.StartAt,
-		MaxConcurrent: req.MaxConcurrent,
-		Status:        domain.PackageStatusActive,
+	user, err := s.userDB.GetUser(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
 	}
 
-	if err := s.userDB.CreatePackage(pkg); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var req disconnectRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ended := s.usage.ForceDisconnect(user.ID, req.SessionID)
+	if req.SessionID != "" && ended == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, pkg)
+	c.JSON(http.StatusOK, gin.H{"user_id": user.ID, "sessions": ended})
 }
 
-func (s *Server) getPackage(c *gin.Context) {
-	id := c.Param("id")
+// penaltyResponse describes a user's penalty state
+type penaltyResponse struct {
+	UserID      string               `json:"user_id"`
+	Active      bool                 `json:"active"`
+	Reason      string               `json:"reason,omitempty"`
+	Action      domain.PenaltyAction `json:"action,omitempty"`
+	Message     string               `json:"message,omitempty"` // In the user's language
+	ExpiresAt   *time.Time           `json:"expires_at,omitempty"`
+	SecondsLeft int64                `json:"seconds_left,omitempty"`
+}
 
-	pkg, err := s.userDB.GetPackage(id)
+// getUserSessions lists a user's tracked sessions with their estimated
+// throughput
+func (s *Server) getUserSessions(c *gin.Context) {
+	if s.sessions == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "sessions are not available"})
+		return
+	}
+
+	id := c.Param("id")
+	user, err := s.userDB.GetUser(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if pkg == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "package not found"})
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, pkg)
+	sessions := s.sessions.GetUserSessions(id)
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartedAt.Before(sessions[j].StartedAt)
+	})
+	uploadBps, downloadBps := s.sessions.UserThroughput(id)
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":      id,
+		"sessions":     sessions,
+		"upload_bps":   uploadBps,
+		"download_bps": downloadBps,
+	})
 }
 
-func (s *Server) getUserPackage(c *gin.Context) {
-	userID := c.Param("id")
+// subscriptionResponse is what a subscription page shows a user: the state
+// of the active package, live sessions and where the traffic went
+type subscriptionResponse struct {
+	UserID         string               `json:"user_id"`
+	Username       string               `json:"username"`
+	Status         domain.UserStatus    `json:"status"`
+	PackageID      string               `json:"package_id,omitempty"`
+	PackageStatus  domain.PackageStatus `json:"package_status,omitempty"`
+	TotalTraffic   int64                `json:"total_traffic"` // Bytes, 0 = unlimited
+	UsedTraffic    int64                `json:"used_traffic"`
+	Remaining      int64                `json:"remaining_traffic"` // Bytes, -1 = unlimited, 0 without an active package
+	ExpiresAt      *time.Time           `json:"expires_at,omitempty"`
+	ActiveSessions int                  `json:"active_sessions"`
+	Nodes          []*subscriptionNode  `json:"nodes"`
+}
 
-	pkg, err := s.userDB.GetPackageByUserID(userID)
+// subscriptionNode is a user's traffic and sessions on one node
+type subscriptionNode struct {
+	NodeID         string `json:"node_id"`
+	Name           string `json:"name,omitempty"`
+	Upload         int64  `json:"upload"` // Billed bytes since the package started
+	Download       int64  `json:"download"`
+	ActiveSessions int    `json:"active_sessions"`
+}
+
+// getUserSubscription returns a user's remaining traffic, expiry, status,
+// active sessions and per-node breakdown in one call. The breakdown only
+// covers reports still within the active database's retention.
+func (s *Server) getUserSubscription(c *gin.Context) {
+	id := c.Param("id")
+	user, err := s.userDB.GetUser(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if pkg == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "package not found"})
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, pkg)
-}
-
-// Node handlers
+	resp := subscriptionResponse{UserID: user.ID, Username: user.Username, Status: user.Status}
+	nodes := map[string]*subscriptionNode{}
+	nodeOf := func(nodeID string) *subscriptionNode {
+		if nodes[nodeID] == nil {
+			nodes[nodeID] = &subscriptionNode{NodeID: nodeID}
+		}
+		return nodes[nodeID]
+	}
 
-func (s *Server) listNodes(c *gin.Context) {
-	nodes, err := s.userDB.ListNodes()
+	pkg, err := s.userDB.GetPackageByUserID(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"nodes": nodes,
-		"total": len(nodes),
-	})
-}
-
-func (s *Server) createNode(c *gin.Context) {
-	var req domain.NodeCreate
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	if pkg != nil {
+		resp.PackageID = pkg.ID
+		resp.PackageStatus = pkg.Status
+		resp.TotalTraffic = pkg.TotalTraffic
+		resp.UsedTraffic = s.quotaEngine.PackageUsage(id, pkg)
+		resp.Remaining = s.quotaEngine.Remaining(id, pkg)
+		resp.ExpiresAt = pkg.ExpiryTime()
+
+		since := pkg.CreatedAt
+		if pkg.StartAt != nil {
+			since = *pkg.StartAt
+		}
+		usage, err := s.activeDB.GetUserUsageByNode(id, since, time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, u := range usage {
+			node := nodeOf(u.NodeID)
+			node.Upload = u.BilledUpload + u.UnbilledUpload
+			node.Download = u.BilledDownload + u.UnbilledDownload
+		}
 	}
 
-	node := &domain.Node{
-		ID:                uuid.New().String(),
-		SecretKey:         req.SecretKey,
-		Name:              req.Name,
-		IPs:               req.AllowedIPs,
-		AllowedIPs:        req.AllowedIPs,
-		TrafficMultiplier: req.TrafficMultiplier,
-		ResetMode:         req.ResetMode,
-		ResetDay:          req.ResetDay,
-		Country:           req.Country,
-		City:              req.City,
-		ISP:               req.ISP,
+	if s.sessions != nil {
+		for _, session := range s.sessions.GetUserSessions(id) {
+			resp.ActiveSessions++
+			nodeOf(session.NodeID).ActiveSessions++
+		}
 	}
 
-	if err := s.userDB.CreateNode(node); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	resp.Nodes = make([]*subscriptionNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node.NodeID != "" {
+			n, err := s.userDB.GetNode(node.NodeID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if n != nil {
+				node.Name = n.Name
+			}
+		}
+		resp.Nodes = append(resp.Nodes, node)
 	}
+	sort.Slice(resp.Nodes, func(i, j int) bool { return resp.Nodes[i].NodeID < resp.Nodes[j].NodeID })
 
-	c.JSON(http.StatusCreated, node)
+	c.JSON(http.StatusOK, resp)
 }
 
-func (s *Server) getNode(c *gin.Context) {
+// listUserReservations lists a user's quota reservations, optionally filtered
+// by ?status=active|committed|expired
+func (s *Server) listUserReservations(c *gin.Context) {
 	id := c.Param("id")
-
-	node, err := s.userDB.GetNode(id)
+	user, err := s.userDB.GetUser(id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if node == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, node)
-}
-
-func (s *Server) deleteNode(c *gin.Context) {
-	id := c.Param("id")
-
-	if err := s.userDB.DeleteNode(id); err != nil {
+	reservations, err := s.userDB.ListReservations(id, domain.ReservationStatus(c.Query("status")))
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "node deleted"})
+	c.JSON(http.StatusOK, gin.H{"user_id": id, "reservations": reservations})
 }
 
-// Service handlers
-
-func (s *Server) createService(c *gin.Context) {
-	var req domain.ServiceCreate
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func (s *Server) getUserPenalty(c *gin.Context) {
+	if s.penalty == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "penalties are not available"})
 		return
 	}
 
-	authMethods := make([]domain.AuthMethod, len(req.AllowedAuthMethods))
-	for i, m := range req.AllowedAuthMethods {
-		authMethods[i] = m
+	id := c.Param("id")
+	user, err := s.userDB.GetUser(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
 	}
 
-	service := &domain.Service{
-		ID:                uuid.New().String(),
-		SecretKey:         req.SecretKey,
-		AccessToken:       req.AccessToken,
-		NodeID:            req.NodeID,
-		Name:              req.Name,
-		Protocol:          req.Protocol,
-		AllowedAuthMethods: authMethods,
-		CallbackURL:       req.CallbackURL,
+	resp := penaltyResponse{UserID: id}
+	if p := s.penalty.CheckPenalty(id); p.HasPenalty {
+		var result domain.UsageReportResult
+		result.SetPenalty(p.Reason, p.TimeLeft)
+
+		expiresAt := p.ExpiresAt
+		resp.Active = true
+		resp.Reason = p.Reason
+		resp.Action = p.Action
+		reason, ok := domain.LookupReason(domain.ReasonCode(p.Reason))
+		if !ok {
+			reason, _ = domain.LookupReason(domain.ReasonUserPenalized)
+		}
+		resp.Message = reason.Message(requestLanguage(c, user))
+		resp.ExpiresAt = &expiresAt
+		resp.SecondsLeft = result.PenaltySecondsLeft
 	}
 
-	if err := s.userDB.CreateService(service); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) clearUserPenalty(c *gin.Context) {
+	if s.penalty == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "penalties are not available"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, service)
+	s.penalty.ClearPenalty(c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "penalty cleared"})
 }
 
-func (s *Server) getService(c *gin.Context) {
+func (s *Server) listUserDevices(c *gin.Context) {
 	id := c.Param("id")
+	user, err := s.userDB.GetUser(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	devices, err := s.userDB.ListUserDevices(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"devices": devices,
+		"total":   len(devices),
+	})
+}
+
+// approveUserDevice approves a pending or unseen device, letting it connect
+// even past the package's max_devices
+func (s *Server) approveUserDevice(c *gin.Context) {
+	device, err := s.quotaEngine.ApproveDevice(c.Param("id"), c.Param("device_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if device == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
+}
+
+func (s *Server) deleteUserDevice(c *gin.Context) {
+	removed, err := s.quotaEngine.RemoveDevice(c.Param("id"), c.Param("device_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "device removed"})
+}
+
+// refreshUserCache reloads a user's cached status and package, dropping any
+// cached rejection
+func (s *Server) refreshUserCache(c *gin.Context) {
+	id := c.Param("id")
+
+	user, err := s.userDB.GetUser(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := s.quotaEngine.RefreshCache(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "user cache refreshed", "user_id": id})
+}
+
+// Package handlers
+
+func (s *Server) createPackage(c *gin.Context) {
+	var req domain.PackageCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if managerID := managerFilter(c); managerID != nil && !s.managesUser(c, *managerID, req.UserID) {
+		return
+	}
+
+	pkg := &domain.Package{
+		ID:            uuid.New().String(),
+		UserID:        req.UserID,
+		TotalLimit:    req.TotalTraffic,
+		TotalTraffic:  req.TotalTraffic,
+		UploadLimit:   req.UploadLimit,
+		DownloadLimit: req.DownloadLimit,
+		CountMode:     req.CountMode,
+		ResetMode:     req.ResetMode,
+		Duration:      req.Duration,
+		StartAt:       req.StartAt,
+		MaxConcurrent: req.MaxConcurrent,
+		MaxIPs:        req.MaxIPs,
+		MaxDevices:    req.MaxDevices,
+
+		ThrottleThreshold: req.ThrottleThreshold,
+		ThrottleRate:      req.ThrottleRate,
+		PenaltyDuration:   req.PenaltyDuration,
+		PenaltyAction:     req.PenaltyAction,
+		Priority:          req.Priority,
+		Status:            domain.PackageStatusActive,
+
+		SessionIdentity: req.SessionIdentity,
+		SessionReplace:  req.SessionReplace,
+		AllowedNodes:    req.AllowedNodes,
+		AllowedServices: req.AllowedServices,
+
+		AllowedCountries: req.AllowedCountries,
+		DeniedCountries:  req.DeniedCountries,
+	}
+
+	if req.Priority != "" && !req.Priority.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid priority, expected bronze, silver or gold"})
+		return
+	}
+	if req.SessionIdentity != "" && !req.SessionIdentity.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session_identity, expected session, subnet or device"})
+		return
+	}
+	if req.SessionReplace != "" && !req.SessionReplace.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session_replace, expected off or same_ip"})
+		return
+	}
+	if !req.CountMode.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid count_mode, expected total, download or upload"})
+		return
+	}
+	if req.MaxIPs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_ips must not be negative"})
+		return
+	}
+	if req.MaxDevices < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_devices must not be negative"})
+		return
+	}
+	if req.ThrottleThreshold < 0 || req.ThrottleThreshold > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "throttle_threshold must be between 0 and 100"})
+		return
+	}
+	if req.ThrottleRate < 0 || (req.ThrottleThreshold > 0 && req.ThrottleRate == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "throttle_rate must be positive when throttle_threshold is set"})
+		return
+	}
+	if req.PenaltyDuration < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "penalty_duration must not be negative"})
+		return
+	}
+	if req.PenaltyAction != "" && !req.PenaltyAction.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid penalty_action, expected disconnect, reject or none"})
+		return
+	}
+	if req.QueuePosition < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "queue_position must not be negative"})
+		return
+	}
+	if req.Queued {
+		pkg.Status = domain.PackageStatusQueued
+		pkg.QueuePosition = req.QueuePosition
+	}
+
+	if err := s.userDB.CreatePackage(pkg); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.quotaEngine.InvalidateUser(pkg.UserID)
+
+	c.JSON(http.StatusCreated, pkg)
+}
+
+func (s *Server) getPackage(c *gin.Context) {
+	id := c.Param("id")
+
+	pkg, err := s.userDB.GetPackage(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if pkg == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "package not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg)
+}
+
+func (s *Server) getUserPackage(c *gin.Context) {
+	userID := c.Param("id")
+
+	pkg, err := s.userDB.GetPackageByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if pkg == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "package not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, pkg)
+}
+
+// listUserPackages returns a user's packages, queued ones last in queue
+// order
+func (s *Server) listUserPackages(c *gin.Context) {
+	packages, err := s.userDB.ListUserPackages(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"packages": packages})
+}
+
+// Node handlers
+
+func (s *Server) listNodes(c *gin.Context) {
+	var (
+		nodes []*domain.Node
+		err   error
+	)
+	if managerID := c.Query("manager_id"); managerID != "" {
+		nodes, err = s.userDB.ListNodesForManager(managerID)
+	} else {
+		nodes, err = s.userDB.ListNodes()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if s.usage != nil {
+		s.usage.AttachNodeHealth(nodes)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"nodes": nodes,
+		"total": len(nodes),
+	})
+}
+
+// recommendNodes lists the nodes a panel should hand out, healthiest first:
+// draining nodes are skipped, and offline ones too while any node is online
+func (s *Server) recommendNodes(c *gin.Context) {
+	if s.usage == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "node health unavailable"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil || limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	var nodes []*domain.Node
+	if managerID := c.Query("manager_id"); managerID != "" {
+		nodes, err = s.userDB.ListNodesForManager(managerID)
+	} else {
+		nodes, err = s.userDB.ListNodes()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if country := c.Query("country"); country != "" {
+		matching := nodes[:0]
+		for _, node := range nodes {
+			if strings.EqualFold(node.Country, country) {
+				matching = append(matching, node)
+			}
+		}
+		nodes = matching
+	}
+
+	nodes = s.usage.RecommendNodes(nodes, limit)
+	c.JSON(http.StatusOK, gin.H{
+		"nodes": nodes,
+		"total": len(nodes),
+	})
+}
+
+func (s *Server) createNode(c *gin.Context) {
+	var req domain.NodeCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	node := &domain.Node{
+		ID:                uuid.New().String(),
+		SecretKey:         req.SecretKey,
+		Name:              req.Name,
+		IPs:               req.AllowedIPs,
+		AllowedIPs:        req.AllowedIPs,
+		TrafficMultiplier: req.TrafficMultiplier,
+		ResetMode:         req.ResetMode,
+		ResetDay:          req.ResetDay,
+		Country:           req.Country,
+		City:              req.City,
+		ISP:               req.ISP,
+		ManagerID:         req.ManagerID,
+		MaxActiveUsers:    req.MaxActiveUsers,
+	}
+
+	if !s.validateManagerRef(c, node.ManagerID) {
+		return
+	}
+
+	if err := s.userDB.CreateNode(node); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, node)
+}
+
+func (s *Server) getNode(c *gin.Context) {
+	id := c.Param("id")
+
+	node, err := s.userDB.GetNode(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if node == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+	if s.usage != nil {
+		node.Health = s.usage.NodeHealth(node)
+	}
+
+	c.JSON(http.StatusOK, node)
+}
+
+// managerAssignment is the body of the node and service manager assignment
+// endpoints; a null manager_id makes the resource shared again
+type managerAssignment struct {
+	ManagerID *string `json:"manager_id"`
+}
+
+func (s *Server) assignNodeManager(c *gin.Context) {
+	id := c.Param("id")
+
+	var req managerAssignment
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ManagerID != nil && *req.ManagerID == "" {
+		req.ManagerID = nil
+	}
+	if !s.validateManagerRef(c, req.ManagerID) {
+		return
+	}
+
+	node, err := s.userDB.GetNode(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if node == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+
+	if err := s.userDB.SetNodeManager(id, req.ManagerID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	node.ManagerID = req.ManagerID
+
+	c.JSON(http.StatusOK, node)
+}
+
+func (s *Server) deleteNode(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := s.userDB.DeleteNode(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "node deleted"})
+}
+
+// syncNode returns the users a node may serve; pass the returned cursor as
+// ?cursor= to receive only later changes
+func (s *Server) syncNode(c *gin.Context) {
+	var cursor int64
+	if raw := c.Query("cursor"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		cursor = parsed
+	}
+
+	sync, err := s.quotaEngine.NodeSync(c.Param("id"), cursor)
+	if errors.Is(err, engine.ErrUnknownNode) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "node not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, sync)
+}
+
+// Service handlers
+
+func (s *Server) listServices(c *gin.Context) {
+	filter := &domain.ServiceFilter{}
+	if nodeID := c.Query("node_id"); nodeID != "" {
+		filter.NodeID = &nodeID
+	}
+	if managerID := c.Query("manager_id"); managerID != "" {
+		filter.ManagerID = &managerID
+	}
+
+	services, err := s.userDB.ListServicesFiltered(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"services": services,
+		"total":    len(services),
+	})
+}
+
+func (s *Server) createService(c *gin.Context) {
+	var req domain.ServiceCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	authMethods := make([]domain.AuthMethod, len(req.AllowedAuthMethods))
+	for i, m := range req.AllowedAuthMethods {
+		authMethods[i] = m
+	}
+
+	service := &domain.Service{
+		ID:                 uuid.New().String(),
+		SecretKey:          req.SecretKey,
+		AccessToken:        req.AccessToken,
+		NodeID:             req.NodeID,
+		Name:               req.Name,
+		Protocol:           req.Protocol,
+		AllowedAuthMethods: authMethods,
+		CallbackURL:        req.CallbackURL,
+		ManagerID:          req.ManagerID,
+	}
+
+	if !s.validateManagerRef(c, service.ManagerID) {
+		return
+	}
+
+	if err := s.userDB.CreateService(service); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, service)
+}
+
+func (s *Server) getService(c *gin.Context) {
+	id := c.Param("id")
+
+	service, err := s.userDB.GetService(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if service == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "service not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, service)
+}
+
+func (s *Server) updateService(c *gin.Context) {
+	id := c.Param("id")
+
+	service, err := s.userDB.GetService(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if service == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "service not found"})
+		return
+	}
+
+	var req domain.ServiceUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Update fields
+	if req.Name != nil {
+		service.Name = *req.Name
+	}
+	if req.SecretKey != nil {
+		if *req.SecretKey == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "secret_key cannot be empty"})
+			return
+		}
+		service.SecretKey = *req.SecretKey
+		service.AccessToken = *req.SecretKey
+	}
+	if req.AllowedAuthMethods != nil {
+		service.AllowedAuthMethods = *req.AllowedAuthMethods
+	}
+	if req.CallbackURL != nil {
+		service.CallbackURL = *req.CallbackURL
+	}
+
+	if err := s.userDB.UpdateService(service); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, service)
+}
+
+func (s *Server) assignServiceManager(c *gin.Context) {
+	id := c.Param("id")
+
+	var req managerAssignment
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ManagerID != nil && *req.ManagerID == "" {
+		req.ManagerID = nil
+	}
+	if !s.validateManagerRef(c, req.ManagerID) {
+		return
+	}
+
+	service, err := s.userDB.GetService(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if service == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "service not found"})
+		return
+	}
+
+	if err := s.userDB.SetServiceManager(id, req.ManagerID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	service.ManagerID = req.ManagerID
+
+	c.JSON(http.StatusOK, service)
+}
+
+// validateManagerRef writes a 400 response and returns false when managerID
+// names a manager that does not exist
+func (s *Server) validateManagerRef(c *gin.Context, managerID *string) bool {
+	if managerID == nil || *managerID == "" {
+		return true
+	}
+
+	manager, err := s.userDB.GetManager(*managerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if manager == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "manager not found"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) deleteService(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := s.userDB.DeleteService(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "service deleted"})
+}
+
+// Group handlers
+
+func (s *Server) listGroups(c *gin.Context) {
+	groups, err := s.userDB.ListGroups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"groups": groups,
+		"total":  len(groups),
+	})
+}
+
+func (s *Server) createGroup(c *gin.Context) {
+	var req domain.GroupCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	group := &domain.Group{
+		Name:          req.Name,
+		TotalLimit:    req.TotalLimit,
+		UploadLimit:   req.UploadLimit,
+		DownloadLimit: req.DownloadLimit,
+		MaxConcurrent: req.MaxConcurrent,
+		AllowedNodes:  req.AllowedNodes,
+
+		PenaltyDuration:  req.PenaltyDuration,
+		PenaltyAction:    req.PenaltyAction,
+		AllowedCountries: req.AllowedCountries,
+		DeniedCountries:  req.DeniedCountries,
+	}
+	if group.HasNegativeLimits() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group limits must not be negative"})
+		return
+	}
+	if group.PenaltyAction != "" && !group.PenaltyAction.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid penalty_action, expected disconnect, reject or none"})
+		return
+	}
+
+	existing, err := s.userDB.GetGroup(group.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "group already exists"})
+		return
+	}
+
+	if err := s.userDB.CreateGroup(group); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	created, err := s.userDB.GetGroup(group.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *Server) getGroup(c *gin.Context) {
+	group, err := s.userDB.GetGroup(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if group == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+func (s *Server) updateGroup(c *gin.Context) {
+	group, err := s.userDB.GetGroup(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if group == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+		return
+	}
+
+	var req domain.GroupUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Apply(group)
+	if group.HasNegativeLimits() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group limits must not be negative"})
+		return
+	}
+	if group.PenaltyAction != "" && !group.PenaltyAction.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid penalty_action, expected disconnect, reject or none"})
+		return
+	}
+
+	if err := s.userDB.UpdateGroup(group); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, group)
+}
+
+func (s *Server) deleteGroup(c *gin.Context) {
+	if err := s.userDB.DeleteGroup(c.Param("name")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "group deleted"})
+}
+
+// Stats handlers
+
+// statsBustMiddleware drops cached stats after every successful write
+func (s *Server) statsBustMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			return
+		}
+		if c.Writer.Status() < http.StatusBadRequest {
+			s.stats.Bust()
+		}
+	}
+}
+
+// serveStats answers a stats request from the cache when possible and
+// otherwise renders it with compute. Responses carry an ETag, and a matching
+// If-None-Match gets 304 Not Modified.
+func (s *Server) serveStats(c *gin.Context, compute func() (any, error)) {
+	key := c.Request.URL.Path + "?" + c.Request.URL.RawQuery
+
+	entry, ok := s.stats.Get(key)
+	if !ok {
+		value, err := compute()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		body, err := json.Marshal(value)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		entry = s.stats.Set(key, body)
+	}
+
+	c.Header("ETag", entry.ETag)
+	c.Header("Cache-Control", "no-cache")
+	if etagMatches(c.GetHeader("If-None-Match"), entry.ETag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", entry.Body)
+}
+
+// etagMatches reports whether an If-None-Match header matches etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// statsRateWindow is how far back /stats averages reports per second
+const statsRateWindow = time.Minute
+
+// getStats returns user counts by status, today's traffic (UTC), online
+// users and nodes, and the report rate over the last statsRateWindow
+func (s *Server) getStats(c *gin.Context) {
+	s.serveStats(c, func() (any, error) {
+		counts, err := s.userDB.CountUsersByStatus()
+		if err != nil {
+			return nil, err
+		}
+		var totalUsers int64
+		for _, n := range counts {
+			totalUsers += n
+		}
+
+		nodes, err := s.userDB.ListNodes()
+		if err != nil {
+			return nil, err
+		}
+		onlineNodes := 0
+		if s.usage != nil {
+			s.usage.AttachNodeHealth(nodes)
+			for _, node := range nodes {
+				if node.Health.Online {
+					onlineNodes++
+				}
+			}
+		}
+
+		now := time.Now()
+		upload, download, _, err := s.activeDB.GetUsageTotals(now.UTC().Truncate(24*time.Hour), now)
+		if err != nil {
+			return nil, err
+		}
+		// Counted by arrival, since backfilled or skewed reports carry
+		// timestamps outside the window
+		recentReports, err := s.activeDB.CountReportsReceived(now.Add(-statsRateWindow), now)
+		if err != nil {
+			return nil, err
+		}
+
+		stats := gin.H{
+			"total_users":     totalUsers,
+			"active_users":    counts[domain.UserStatusActive],
+			"suspended_users": counts[domain.UserStatusSuspended],
+			"expired_users":   counts[domain.UserStatusExpired],
+			"finished_users":  counts[domain.UserStatusFinish],
+			"upload_today":    upload,
+			"download_today":  download,
+			"traffic_today":   upload + download,
+			"total_nodes":     len(nodes),
+			"online_nodes":    onlineNodes,
+			"reports_per_sec": float64(recentReports) / statsRateWindow.Seconds(),
+		}
+		if s.sessions != nil {
+			stats["online_users"] = s.sessions.OnlineUsers()
+			stats["upload_bps"], stats["download_bps"] = s.sessions.TotalThroughput()
+		}
+		return stats, nil
+	})
+}
+
+// Event handlers
+
+// listEvents returns a page of stored events, newest first. from and to take
+// RFC 3339 times or Unix seconds; pass the returned next_cursor as cursor to
+// fetch the following page.
+func (s *Server) listEvents(c *gin.Context) {
+	if s.events == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "event store is not enabled"})
+		return
+	}
+
+	filter := domain.EventFilter{Cursor: c.Query("cursor")}
+	if eventType := c.Query("type"); eventType != "" {
+		t := domain.EventType(strings.ToUpper(eventType))
+		filter.Type = &t
+	}
+	if userID := c.Query("user_id"); userID != "" {
+		filter.UserID = &userID
+	}
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		raw := c.Query(bound.name)
+		if raw == "" {
+			continue
+		}
+		t, err := parseTimeQuery(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s: %v", bound.name, err)})
+			return
+		}
+		*bound.dst = &t
+	}
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit = parseInt(limit, sqlite.DefaultEventPageSize)
+	}
+
+	page, err := s.events.ListEvents(filter)
+	if errors.Is(err, sqlite.ErrInvalidEventCursor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// replayEvents streams the stored events matching the types, user_id, from,
+// to and after filters as a JSON array in the order they were stored, so
+// clients can rebuild their own state from the history
+func (s *Server) replayEvents(c *gin.Context) {
+	if s.events == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "event store is not enabled"})
+		return
+	}
+
+	filter := domain.EventReplayFilter{Types: parseEventTypes(c.Query("types")), AfterID: c.Query("after")}
+	if userID := c.Query("user_id"); userID != "" {
+		filter.UserID = &userID
+	}
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		raw := c.Query(bound.name)
+		if raw == "" {
+			continue
+		}
+		t, err := parseTimeQuery(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s: %v", bound.name, err)})
+			return
+		}
+		*bound.dst = &t
+	}
+
+	// Nothing is written before the first event, so a failed start still
+	// gets an error response
+	ew := &exportWriter{w: c.Writer}
+	c.Header("Content-Type", "application/json")
+	err := s.events.ReplayEvents(filter, func(event *domain.Event) error {
+		return ew.write(event, nil)
+	})
+	if err != nil && ew.rows == 0 {
+		if errors.Is(err, sqlite.ErrEventNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "after names an unknown event"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		err = ew.close()
+	}
+	if err != nil {
+		// The status is already sent; the client sees a truncated replay
+		s.logger.Warn("event replay failed", zap.Error(err))
+	}
+}
+
+// parseEventTypes reads a comma separated list of event types, in any case
+func parseEventTypes(raw string) []domain.EventType {
+	var types []domain.EventType
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, domain.EventType(strings.ToUpper(t)))
+		}
+	}
+	return types
+}
+
+// parseTimeQuery reads an RFC 3339 time or Unix seconds
+func parseTimeQuery(raw string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// Event stream handlers
+
+// eventsWSRoute streams live events over a WebSocket
+const eventsWSRoute = "/api/v1/events/ws"
+
+// eventsWSBuffer is how many events a slow WebSocket client may fall behind
+// before further events are dropped for it
+const eventsWSBuffer = 256
+
+// streamEvents upgrades to a WebSocket and sends every event the engine
+// publishes as a JSON message. The types query parameter takes a comma
+// separated list of event types to send; by default all are sent.
+func (s *Server) streamEvents(c *gin.Context) {
+	if s.hub == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "live events are not enabled"})
+		return
+	}
+
+	types := parseEventTypes(c.Query("types"))
+
+	server := websocket.Server{
+		// Access is checked by the API key, not the page origin
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			id := uuid.New().String()
+			events := s.hub.Subscribe(id, eventsWSBuffer, types)
+			defer s.hub.Unsubscribe(id)
+
+			// Clients only listen; a read returning means the socket closed
+			closed := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(io.Discard, ws)
+				close(closed)
+			}()
+
+			for {
+				select {
+				case <-closed:
+					return
+				case event, ok := <-events:
+					if !ok {
+						return
+					}
+					if err := websocket.JSON.Send(ws, event); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// eventsSSERoute streams live events as Server-Sent Events
+const eventsSSERoute = "/api/v1/events/stream"
+
+// eventsSSEHeartbeat is how often an idle event stream gets a comment, so
+// proxies do not close it
+const eventsSSEHeartbeat = 15 * time.Second
+
+// streamEventsSSE sends every event the engine publishes as a Server-Sent
+// Event named after its type, with the event ID as SSE id. A client that
+// reconnects with Last-Event-ID, or passes last_event_id, first gets the
+// stored events it missed. The types query parameter works as on the
+// WebSocket stream. When the live buffer fills up, the hub may have dropped
+// events, so the stream ends and the client resumes from the last event it
+// got.
+func (s *Server) streamEventsSSE(c *gin.Context) {
+	if s.hub == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "live events are not enabled"})
+		return
+	}
+
+	types := parseEventTypes(c.Query("types"))
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+
+	// Subscribe before replaying, so no event falls between the stored ones
+	// and the live ones
+	id := uuid.New().String()
+	events := s.hub.Subscribe(id, eventsWSBuffer, types)
+	defer s.hub.Unsubscribe(id)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	// Events stored and published while replaying arrive twice; live events
+	// stored at or before the last replayed one are skipped
+	var replayedSeq int64
+	if lastEventID != "" && s.events != nil {
+		err := s.events.ReplayEvents(domain.EventReplayFilter{Types: types, AfterID: lastEventID}, func(event *domain.Event) error {
+			replayedSeq = event.Seq
+			return writeSSEEvent(c.Writer, event)
+		})
+		// An unknown ID was purged or never stored; the client gets live
+		// events only
+		if err != nil && !errors.Is(err, sqlite.ErrEventNotFound) {
+			s.logger.Warn("event stream replay failed", zap.String("last_event_id", lastEventID), zap.Error(err))
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventsSSEHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if len(events) >= cap(events)-1 {
+				// The buffer was full before this receive, so the hub may
+				// have dropped events; they are stored and the client
+				// replays them when it reconnects
+				return
+			}
+			if event.Seq != 0 && event.Seq <= replayedSeq {
+				continue
+			}
+			if err := writeSSEEvent(c.Writer, event); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+// writeSSEEvent writes one event in the text/event-stream format
+func writeSSEEvent(w io.Writer, event *domain.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// Admin handlers
+
+func (s *Server) listJobs(c *gin.Context) {
+	if s.scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "job scheduler not available"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"jobs": s.scheduler.Status()})
+}
+
+func (s *Server) getJob(c *gin.Context) {
+	if s.scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "job scheduler not available"})
+		return
+	}
+
+	status, ok := s.scheduler.Get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *Server) runJob(c *gin.Context) {
+	if s.scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "job scheduler not available"})
+		return
+	}
+
+	name := c.Param("name")
+	switch err := s.scheduler.RunNow(name); {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, jobs.ErrJobRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, jobs.ErrSchedulerStopped):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "job triggered", "job": name})
+}
+
+// maxGeoUploadSize caps an uploaded MaxMind database; GeoLite2-City is
+// well below it
+const maxGeoUploadSize = 256 << 20
+
+type geoStatusResponse struct {
+	Ready     bool   `json:"ready"`
+	Source    string `json:"source,omitempty"`
+	ASNReady  bool   `json:"asn_ready"`
+	ASNSource string `json:"asn_source,omitempty"`
+}
+
+func (s *Server) geoStatus() geoStatusResponse {
+	return geoStatusResponse{
+		Ready:     s.geo.IsReady(),
+		Source:    s.geo.Source(),
+		ASNReady:  s.geo.HasASN(),
+		ASNSource: s.geo.ASNSource(),
+	}
+}
+
+func (s *Server) getGeoStatus(c *gin.Context) {
+	if s.geo == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "geo handler not available"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.geoStatus())
+}
+
+// loadGeoDatabase loads a MaxMind database without a restart: the city
+// database, or the ASN database with ?database=asn. A JSON body
+// {"path": "..."} points at a file on the server; any other body is taken as
+// the database itself and kept in memory only.
+func (s *Server) loadGeoDatabase(c *gin.Context) {
+	if s.geo == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "geo handler not available"})
+		return
+	}
+
+	database := c.DefaultQuery("database", "city")
+	load, loadBytes := s.geo.Load, s.geo.LoadBytes
+	switch database {
+	case "city":
+	case "asn":
+		load, loadBytes = s.geo.LoadASN, s.geo.LoadASNBytes
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid database %q, expected city or asn", database)})
+		return
+	}
+
+	var err error
+	if strings.HasPrefix(c.ContentType(), "application/json") {
+		var req struct {
+			Path string `json:"path"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		err = load(req.Path)
+	} else {
+		data, readErr := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxGeoUploadSize))
+		if readErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": readErr.Error()})
+			return
+		}
+		err = loadBytes(data)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.Info("geo database loaded", zap.String("database", database))
+	c.JSON(http.StatusOK, s.geoStatus())
+}
+
+func (s *Server) listAPIKeys(c *gin.Context) {
+	keys, err := s.userDB.ListAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// createAPIKeyResponse carries the raw key, which is only ever returned here
+type createAPIKeyResponse struct {
+	*domain.APIKey
+	Key string `json:"key"`
+}
+
+func (s *Server) createAPIKey(c *gin.Context) {
+	var req domain.APIKeyCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = domain.KeyScopeMonitor
+	}
+	if !req.Scope.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown key scope %q", req.Scope)})
+		return
+	}
+	if req.Scope == domain.KeyScopeManager {
+		if req.ManagerID == nil || *req.ManagerID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "manager_id is required for manager keys"})
+			return
+		}
+		if !s.validateManagerRef(c, req.ManagerID) {
+			return
+		}
+	} else if req.ManagerID != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "manager_id is only allowed for manager keys"})
+		return
+	}
+
+	key := &domain.APIKey{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		Scope:     req.Scope,
+		ManagerID: req.ManagerID,
+	}
+	rawKey, err := s.userDB.CreateAPIKey(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, createAPIKeyResponse{APIKey: key, Key: rawKey})
+}
+
+// tokenRequest asks for an access token. Scopes default to read-only and
+// the lifetime to the longest allowed.
+type tokenRequest struct {
+	Subject    string   `json:"subject"`
+	Scopes     []string `json:"scopes"`
+	TTLSeconds int64    `json:"ttl_seconds"`
+}
+
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// issueToken exchanges the owner key, or a full-scope token, for a
+// short-lived token with at most the caller's scopes. A token cannot issue
+// full tokens, and the tokens it issues expire no later than it does, so a
+// leaked token cannot be renewed forever.
+func (s *Server) issueToken(c *gin.Context) {
+	if s.tokens == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "access tokens are disabled"})
+		return
+	}
+	var req tokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{"read-only"}
+	}
+	scope, err := auth.ParseScopes(req.Scopes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !requestScope(c).Has(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot grant scopes the caller does not have"})
+		return
+	}
+	if req.TTLSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds must not be negative"})
+		return
+	}
+	if req.Subject == "" {
+		req.Subject = "owner"
+	}
+
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if ttl <= 0 || ttl > s.tokens.MaxTTL() {
+		ttl = s.tokens.MaxTTL()
+	}
+	if v, ok := c.Get(tokenContextKey); ok {
+		if scope.Has(auth.ScopeFull) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "full tokens can only be issued with the owner key"})
+			return
+		}
+		remaining := time.Until(time.Unix(v.(*auth.Claims).ExpiresAt, 0))
+		if remaining <= 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+			return
+		}
+		if remaining < ttl {
+			ttl = remaining
+		}
+	}
+
+	token, claims, err := s.tokens.Issue(req.Subject, scope, ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.logger.Info("issued access token",
+		zap.String("id", claims.ID),
+		zap.String("subject", claims.Subject),
+		zap.Strings("scopes", claims.Scopes),
+	)
+	c.JSON(http.StatusCreated, tokenResponse{
+		Token:     token,
+		TokenType: "Bearer",
+		Scopes:    claims.Scopes,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+func (s *Server) revokeAPIKey(c *gin.Context) {
+	ok, err := s.userDB.RevokeAPIKey(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "api key revoked"})
+}
+
+// issuedAuthKeyResponse carries a new owner or service key, shown only here
+type issuedAuthKeyResponse struct {
+	*domain.AuthKey
+	Key string `json:"key"`
+}
+
+// listAuthKeys describes the owner key and the service keys without the
+// keys themselves
+func (s *Server) listAuthKeys(c *gin.Context) {
+	keys, err := s.userDB.ListAuthKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// bindAuthKeyIssue reads the optional expiry and overlap of a new key
+func bindAuthKeyIssue(c *gin.Context) (*time.Time, time.Duration, bool) {
+	var req domain.AuthKeyIssue
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, 0, false
+	}
+	if req.ExpiresInSeconds < 0 || req.OverlapSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_seconds and overlap_seconds must not be negative"})
+		return nil, 0, false
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInSeconds > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		expiresAt = &t
+	}
+	return expiresAt, time.Duration(req.OverlapSeconds) * time.Second, true
+}
+
+// rotateOwnerAuthKey replaces the stored owner key. The old key keeps
+// working for overlap_seconds.
+func (s *Server) rotateOwnerAuthKey(c *gin.Context) {
+	if s.secret != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "the owner key is set by HUE_AUTH_SECRET; change it there"})
+		return
+	}
+	expiresAt, overlap, ok := bindAuthKeyIssue(c)
+	if !ok {
+		return
+	}
+
+	rawKey, err := s.userDB.RotateOwnerAuthKey(expiresAt, overlap)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rawKey == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "owner key not found"})
+		return
+	}
+	s.logger.Info("rotated owner key", zap.Duration("overlap", overlap))
+	s.respondIssuedAuthKey(c, "", rawKey)
+}
+
+// createServiceAuthKey gives a service a new key, replacing its current one
+// at once
+func (s *Server) createServiceAuthKey(c *gin.Context) {
+	expiresAt, _, ok := bindAuthKeyIssue(c)
+	if !ok {
+		return
+	}
+	s.issueServiceAuthKey(c, expiresAt, 0)
+}
+
+// rotateServiceAuthKey gives a service a new key. The old key keeps working
+// for overlap_seconds, so the node can be updated without downtime.
+func (s *Server) rotateServiceAuthKey(c *gin.Context) {
+	expiresAt, overlap, ok := bindAuthKeyIssue(c)
+	if !ok {
+		return
+	}
+	s.issueServiceAuthKey(c, expiresAt, overlap)
+}
+
+func (s *Server) issueServiceAuthKey(c *gin.Context, expiresAt *time.Time, overlap time.Duration) {
+	id := c.Param("id")
+	rawKey, err := s.userDB.RotateServiceAuthKey(id, expiresAt, overlap)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rawKey == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "service not found"})
+		return
+	}
+	s.logger.Info("issued service key", zap.String("service_id", id), zap.Duration("overlap", overlap))
+	s.respondIssuedAuthKey(c, id, rawKey)
+}
+
+func (s *Server) respondIssuedAuthKey(c *gin.Context, serviceID, rawKey string) {
+	key, err := s.userDB.GetAuthKey(serviceID)
+	if err != nil || key == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read the new key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, issuedAuthKeyResponse{AuthKey: key, Key: rawKey})
+}
+
+// revokeServiceAuthKey revokes a service's key, and the key its last
+// rotation replaced
+func (s *Server) revokeServiceAuthKey(c *gin.Context) {
+	ok, err := s.userDB.RevokeServiceAuthKey(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "service key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "service key revoked"})
+}
+
+// reasonResponse is a catalog entry with the message in the requested language
+type reasonResponse struct {
+	domain.DisconnectReason
+	Message string `json:"message"`
+}
+
+// apiVersionHeader tells clients which REST API version answered, taken from
+// the /api/<version>/ prefix of the request
+func apiVersionHeader() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rest, ok := strings.CutPrefix(c.Request.URL.Path, "/api/"); ok {
+			if version, _, found := strings.Cut(rest, "/"); found {
+				c.Header("Hue-API-Version", version)
+			}
+		}
+		c.Next()
+	}
+}
+
+// listAPIVersions lists the REST API versions and the gRPC wire API range so
+// clients can pick what to speak before authenticating
+func (s *Server) listAPIVersions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"current":   apiVersions[len(apiVersions)-1],
+		"supported": apiVersions,
+		"grpc": gin.H{
+			"api_version":     pb.APIVersion,
+			"min_api_version": pb.MinAPIVersion,
+		},
+	})
+}
+
+// listReasons returns the disconnect reason catalog. It needs no API key so
+// client apps can fetch it directly; the language comes from ?lang= or the
+// Accept-Language header.
+func (s *Server) listReasons(c *gin.Context) {
+	lang := requestLanguage(c, nil)
+
+	catalog := domain.DisconnectReasons()
+	reasons := make([]reasonResponse, 0, len(catalog))
+	for _, r := range catalog {
+		reasons = append(reasons, reasonResponse{DisconnectReason: r, Message: r.Message(lang)})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"language": lang, "reasons": reasons})
+}
+
+// listMessages returns the full message catalog, reason texts and
+// notification templates, in the negotiated language
+func (s *Server) listMessages(c *gin.Context) {
+	lang := requestLanguage(c, nil)
+	c.JSON(http.StatusOK, gin.H{
+		"language":  lang,
+		"languages": domain.SupportedLanguages(),
+		"messages":  domain.Messages(lang),
+	})
+}
+
+// requestLanguage picks the response language from ?lang=, then the user's
+// locale attribute, then Accept-Language, falling back to the default
+func requestLanguage(c *gin.Context, user *domain.User) string {
+	return domain.NegotiateLanguage(c.Query("lang"), user.Locale(), c.GetHeader("Accept-Language"))
+}
+
+// getTagStats aggregates usage by report tag, optionally filtered to one tag
+// and a unix-seconds time range (?tag=vless&start=...&end=...)
+func (s *Server) getTagStats(c *gin.Context) {
+	if s.activeDB == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "usage stats unavailable"})
+		return
+	}
+
+	start := time.Time{}
+	end := time.Now()
+	if v := c.Query("start"); v != "" {
+		start = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+	if v := c.Query("end"); v != "" {
+		end = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+
+	s.serveStats(c, func() (any, error) {
+		usage, err := s.activeDB.GetUsageByTag(c.Query("tag"), start, end)
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{"tags": usage}, nil
+	})
+}
+
+// getNodeActiveUsers counts distinct users per node and day, or per month
+// with ?period=month, optionally for one node and a unix-seconds time range
+// (?node_id=...&start=...&end=...). The range defaults to the last 30 days.
+func (s *Server) getNodeActiveUsers(c *gin.Context) {
+	if s.activeDB == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "usage stats unavailable"})
+		return
+	}
+
+	period := c.DefaultQuery("period", "day")
+	if period != "day" && period != "month" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be day or month"})
+		return
+	}
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	if v := c.Query("start"); v != "" {
+		start = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+	if v := c.Query("end"); v != "" {
+		end = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+
+	s.serveStats(c, func() (any, error) {
+		counts, err := s.activeDB.GetActiveUsersByNode(c.Query("node_id"), period == "month", start, end)
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{"period": period, "nodes": counts}, nil
+	})
+}
+
+// Default and largest ?limit of the top users and nodes reports
+const (
+	defaultTopLimit = 10
+	maxTopLimit     = 1000
+)
+
+// getTopUsers returns the users with the most billed traffic, with their
+// usernames
+func (s *Server) getTopUsers(c *gin.Context) {
+	s.serveTopUsage(c, s.historyDB.GetTopUsers, func(id string) (string, error) {
+		user, err := s.userDB.GetUser(id)
+		if err != nil || user == nil {
+			return "", err
+		}
+		return user.Username, nil
+	})
+}
+
+// getTopNodes returns the nodes with the most billed traffic, with their
+// names
+func (s *Server) getTopNodes(c *gin.Context) {
+	s.serveTopUsage(c, s.historyDB.GetTopNodes, func(id string) (string, error) {
+		node, err := s.userDB.GetNode(id)
+		if err != nil || node == nil {
+			return "", err
+		}
+		return node.Name, nil
+	})
+}
+
+// serveTopUsage serves a top-N report from the usage history for a
+// unix-seconds time range (?start=...&end=...&limit=...). The range
+// defaults to the last 24 hours and limit to defaultTopLimit.
+func (s *Server) serveTopUsage(c *gin.Context, top func(start, end time.Time, limit int) ([]*sqlite.TopUsage, error), nameOf func(id string) (string, error)) {
+	if s.historyDB == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "usage history is not enabled"})
+		return
+	}
+
+	end := time.Now()
+	start := end.Add(-24 * time.Hour)
+	if v := c.Query("start"); v != "" {
+		start = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+	if v := c.Query("end"); v != "" {
+		end = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+	limit := parseInt(c.Query("limit"), defaultTopLimit)
+	if limit <= 0 || limit > maxTopLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxTopLimit)})
+		return
+	}
+
+	s.serveStats(c, func() (any, error) {
+		entries, err := top(start, end, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Name, err = nameOf(e.ID); err != nil {
+				return nil, err
+			}
+		}
+		return gin.H{"start": start, "end": end, "top": entries}, nil
+	})
+}
+
+// getUsageRollups returns traffic per hour or day (?granularity=hour|day)
+// from the usage rollups, optionally for one user or node and a unix-seconds
+// time range (?user_id=...&node_id=...&start=...&end=...). Rows stored since
+// the last rollup job are rolled up first. The range defaults to the last 24
+// hours by hour and the last 30 days by day.
+func (s *Server) getUsageRollups(c *gin.Context) {
+	if s.historyDB == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "usage history is not enabled"})
+		return
+	}
+
+	granularity, err := sqlite.ParseRollupGranularity(c.DefaultQuery("granularity", string(sqlite.RollupDaily)))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter := sqlite.UsageRollupFilter{
+		Granularity: granularity,
+		UserID:      c.Query("user_id"),
+		NodeID:      c.Query("node_id"),
+		To:          time.Now(),
+	}
+	filter.From = filter.To.AddDate(0, 0, -30)
+	if granularity == sqlite.RollupHourly {
+		filter.From = filter.To.Add(-24 * time.Hour)
+	}
+	if v := c.Query("start"); v != "" {
+		filter.From = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+	if v := c.Query("end"); v != "" {
+		filter.To = domain.ParseTime(int64(parseInt(v, 0)))
+	}
+
+	s.serveStats(c, func() (any, error) {
+		if _, err := s.historyDB.RollupUsage(); err != nil {
+			return nil, err
+		}
+		usage, err := s.historyDB.GetUsageRollups(filter)
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{"granularity": granularity, "usage": usage}, nil
+	})
+}
+
+// Helper functions
+
+func parseInt(s string, defaultVal int) int {
+	var val int
+	if _, err := fmt.Sscanf(s, "%d", &val); err != nil {
+		return defaultVal
+	}
+	return val
+}
+
+// Manager handlers
+
+func (s *Server) listManagers(c *gin.Context) {
+	var managers []*domain.Manager
+	var err error
+	if parentID := c.Query("parent_id"); parentID != "" {
+		managers, err = s.userDB.ListManagerChildren(parentID)
+	} else {
+		managers, err = s.userDB.ListManagers()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"managers": managers,
+		"total":    len(managers),
+	})
+}
+
+func (s *Server) createManager(c *gin.Context) {
+	var req domain.ManagerCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	manager := &domain.Manager{
+		ID:       req.ID,
+		Name:     req.Name,
+		ParentID: req.ParentID,
+		Metadata: req.Metadata,
+	}
+	if manager.ID == "" {
+		manager.ID = uuid.New().String()
+	} else if existing, err := s.userDB.GetManager(manager.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	} else if existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "manager already exists"})
+		return
+	}
+	if manager.ParentID != nil && *manager.ParentID == "" {
+		manager.ParentID = nil
+	}
+	manager.Package = req.Package.NewPackage(manager.ID)
+	if !validManagerPackage(c, manager.Package) || !s.validateManagerRef(c, manager.ParentID) {
+		return
+	}
+
+	if err := s.userDB.CreateManager(manager); err != nil {
+		writeManagerError(c, err)
+		return
+	}
+
+	created, err := s.userDB.GetManager(manager.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *Server) getManager(c *gin.Context) {
+	manager, err := s.userDB.GetManager(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if manager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "manager not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, manager)
+}
+
+func (s *Server) updateManager(c *gin.Context) {
+	manager, err := s.userDB.GetManager(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if manager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "manager not found"})
+		return
+	}
+
+	var req domain.ManagerUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Update fields
+	if req.Name != nil {
+		if *req.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name must not be empty"})
+			return
+		}
+		manager.Name = *req.Name
+	}
+	if req.ParentID != nil {
+		if *req.ParentID == "" {
+			manager.ParentID = nil
+		} else {
+			manager.ParentID = req.ParentID
+		}
+	}
+	if req.Metadata != nil {
+		manager.Metadata = *req.Metadata
+	}
+	if manager.Package == nil {
+		manager.Package = domain.ManagerPackageLimits{}.NewPackage(manager.ID)
+	}
+	if req.Package != nil {
+		req.Package.Apply(manager.Package)
+	}
+	if !validManagerPackage(c, manager.Package) || !s.validateManagerRef(c, manager.ParentID) {
+		return
+	}
+
+	if err := s.userDB.UpdateManager(manager); err != nil {
+		writeManagerError(c, err)
+		return
+	}
+
+	updated, err := s.userDB.GetManager(manager.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+func (s *Server) deleteManager(c *gin.Context) {
+	id := c.Param("id")
+
+	manager, err := s.userDB.GetManager(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if manager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "manager not found"})
+		return
+	}
+
+	if err := s.userDB.DeleteManager(id); err != nil {
+		writeManagerError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "manager deleted"})
+}
+
+func (s *Server) listManagerChildren(c *gin.Context) {
+	id := c.Param("id")
+
+	manager, err := s.userDB.GetManager(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if manager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "manager not found"})
+		return
+	}
+
+	children, err := s.userDB.ListManagerChildren(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"managers": children,
+		"total":    len(children),
+	})
+}
+
+// getManagerTree returns a manager's subtree with limits, usage and user
+// counts rolled up from its descendants
+func (s *Server) getManagerTree(c *gin.Context) {
+	id := c.Param("id")
+	if !actsFor(c, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key scope does not allow this request"})
+		return
+	}
+
+	tree, err := s.userDB.GetManagerTree(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if tree == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "manager not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tree)
+}
+
+// validManagerPackage writes a 400 response and returns false when the
+// package has a negative limit or an unknown status
+func validManagerPackage(c *gin.Context, pkg *domain.ManagerPackage) bool {
+	if pkg.HasNegativeLimits() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "manager package limits must not be negative"})
+		return false
+	}
+	if !pkg.Status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown manager package status %q", pkg.Status)})
+		return false
+	}
+	return true
+}
+
+// writeManagerError maps a manager storage error to a response
+func writeManagerError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, sqlite.ErrManagerExceedsParent), errors.Is(err, sqlite.ErrManagerCycle):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, sqlite.ErrManagerInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// Manager top-up handlers
+
+// actsFor reports whether the request may act for managerID: the owner acts
+// for everyone, a manager key only for its own manager
+func actsFor(c *gin.Context, managerID string) bool {
+	key := requestKey(c)
+	return key == nil || (key.ManagerID != nil && *key.ManagerID == managerID)
+}
+
+// requesterID names who made a request in the top-up audit trail
+func requesterID(c *gin.Context) string {
+	if key := requestKey(c); key != nil {
+		return key.ID
+	}
+	return "owner"
+}
+
+func (s *Server) requestTopUp(c *gin.Context) {
+	id := c.Param("id")
+	if !actsFor(c, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key scope does not allow this request"})
+		return
+	}
+
+	manager, err := s.userDB.GetManager(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if manager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "manager not found"})
+		return
+	}
+	if !manager.HasParent() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "manager has no parent to approve top-ups"})
+		return
+	}
+
+	var req domain.ManagerTopUpCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	topUp := &domain.ManagerTopUp{
+		ID:             uuid.New().String(),
+		ManagerID:      manager.ID,
+		ParentID:       *manager.ParentID,
+		TotalLimit:     req.TotalLimit,
+		UploadLimit:    req.UploadLimit,
+		DownloadLimit:  req.DownloadLimit,
+		MaxSessions:    req.MaxSessions,
+		MaxOnlineUsers: req.MaxOnlineUsers,
+		MaxActiveUsers: req.MaxActiveUsers,
+		Note:           req.Note,
+		RequestedBy:    requesterID(c),
+	}
+	if topUp.HasNegative() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "top-up amounts must not be negative"})
+		return
+	}
+	if topUp.IsEmpty() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "top-up must request at least one amount"})
+		return
+	}
+
+	if err := s.userDB.CreateManagerTopUp(topUp); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.Info("manager top-up requested",
+		zap.String("topup_id", topUp.ID),
+		zap.String("manager_id", topUp.ManagerID),
+		zap.String("requested_by", topUp.RequestedBy),
+	)
+	c.JSON(http.StatusCreated, topUp)
+}
+
+func (s *Server) listTopUps(c *gin.Context) {
+	s.writeTopUps(c, false)
+}
+
+func (s *Server) listIncomingTopUps(c *gin.Context) {
+	s.writeTopUps(c, true)
+}
+
+// writeTopUps lists a manager's own requests, or those awaiting its
+// decision when incoming is set
+func (s *Server) writeTopUps(c *gin.Context, incoming bool) {
+	id := c.Param("id")
+	if !actsFor(c, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key scope does not allow this request"})
+		return
+	}
+
+	status := domain.TopUpStatus(c.Query("status"))
+	if status != "" && !status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown top-up status %q", status)})
+		return
+	}
+
+	topUps, err := s.userDB.ListManagerTopUps(id, incoming, status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"topups": topUps})
+}
 
-	service, err := s.userDB.GetService(id)
+func (s *Server) approveTopUp(c *gin.Context) {
+	s.decideTopUp(c, true)
+}
+
+func (s *Server) rejectTopUp(c *gin.Context) {
+	s.decideTopUp(c, false)
+}
+
+// decideTopUp approves or rejects a pending request. Only the parent
+// manager the request is addressed to, or the owner, may decide it.
+func (s *Server) decideTopUp(c *gin.Context, approve bool) {
+	topUp, err := s.userDB.GetManagerTopUp(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if service == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "service not found"})
+	if topUp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "top-up not found"})
+		return
+	}
+	if !actsFor(c, topUp.ParentID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the parent manager can decide this top-up"})
 		return
 	}
 
-	c.JSON(http.StatusOK, service)
+	var req domain.TopUpDecision
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if approve {
+		topUp, err = s.userDB.ApproveManagerTopUp(topUp.ID, requesterID(c), req.Note)
+	} else {
+		topUp, err = s.userDB.RejectManagerTopUp(topUp.ID, requesterID(c), req.Note)
+	}
+	if errors.Is(err, sqlite.ErrTopUpDecided) || errors.Is(err, sqlite.ErrTopUpExceedsParent) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.Info("manager top-up decided",
+		zap.String("topup_id", topUp.ID),
+		zap.String("manager_id", topUp.ManagerID),
+		zap.String("status", string(topUp.Status)),
+		zap.String("decided_by", topUp.DecidedBy),
+	)
+	c.JSON(http.StatusOK, topUp)
 }
 
-func (s *Server) deleteService(c *gin.Context) {
+// Billing handlers
+
+func (s *Server) listBilling(c *gin.Context) {
+	s.writeBilling(c, c.Query("manager_id"))
+}
+
+func (s *Server) listManagerBilling(c *gin.Context) {
 	id := c.Param("id")
+	if !actsFor(c, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key scope does not allow this request"})
+		return
+	}
+	s.writeBilling(c, id)
+}
 
-	if err := s.userDB.DeleteService(id); err != nil {
+// writeBilling renders a period's records as JSON, or as CSV when
+// format=csv. The period defaults to the current month.
+func (s *Server) writeBilling(c *gin.Context, managerID string) {
+	period := c.DefaultQuery("period", domain.BillingPeriod(time.Now()))
+	if _, _, err := domain.ParseBillingPeriod(period); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	records, err := s.userDB.ListBillingRecords(period, managerID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "service deleted"})
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"period": period, "records": records})
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="billing-%s.csv"`, period))
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		if err := writeBillingCSV(c.Writer, records); err != nil {
+			s.logger.Warn("failed to write billing CSV", zap.Error(err))
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+	}
+}
+
+// billingCSVHeader is the column order of billing CSV exports
+var billingCSVHeader = []string{
+	"period", "manager_id", "user_id", "username", "node_group",
+	"upload", "download", "total", "rate", "amount", "currency",
+}
+
+func writeBillingCSV(w io.Writer, records []*domain.BillingRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(billingCSVHeader); err != nil {
+		return err
+	}
+	for _, r := range records {
+		managerID := ""
+		if r.ManagerID != nil {
+			managerID = *r.ManagerID
+		}
+		if err := cw.Write([]string{
+			r.Period,
+			managerID,
+			r.UserID,
+			r.Username,
+			r.NodeGroup,
+			strconv.FormatInt(r.Upload, 10),
+			strconv.FormatInt(r.Download, 10),
+			strconv.FormatInt(r.Total, 10),
+			strconv.FormatFloat(r.Rate, 'f', -1, 64),
+			strconv.FormatFloat(r.Amount, 'f', 4, 64),
+			r.Currency,
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
 }
 
-// Stats handler
+// Export handlers
 
-func (s *Server) getStats(c *gin.Context) {
-	users, _ := s.userDB.ListUsers(&domain.UserFilter{Limit: 1})
-	nodes, _ := s.userDB.ListNodes()
+// exportFlushEvery is how many exported rows are written between flushes to
+// the client
+const exportFlushEvery = 500
+
+// exportWriter streams rows as a JSON array or as CSV with a header row
+type exportWriter struct {
+	w      gin.ResponseWriter
+	csv    *csv.Writer
+	header []string
+	rows   int
+}
+
+// startExport checks the format query parameter and starts the response. It
+// writes the error response itself and returns nil on a bad format.
+func startExport(c *gin.Context, name string, header []string) *exportWriter {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return nil
+	}
+
+	ew := &exportWriter{w: c.Writer}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		ew.csv = csv.NewWriter(c.Writer)
+		ew.header = header
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
+	c.Status(http.StatusOK)
+	return ew
+}
+
+// write adds one row: v as a JSON array element, or record as a CSV line
+func (ew *exportWriter) write(v any, record func() []string) error {
+	if ew.csv != nil {
+		if ew.rows == 0 {
+			if err := ew.csv.Write(ew.header); err != nil {
+				return err
+			}
+		}
+		if err := ew.csv.Write(record()); err != nil {
+			return err
+		}
+	} else {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		sep := ","
+		if ew.rows == 0 {
+			sep = "["
+		}
+		if _, err := ew.w.WriteString(sep); err != nil {
+			return err
+		}
+		if _, err := ew.w.Write(data); err != nil {
+			return err
+		}
+	}
+	ew.rows++
+	if ew.rows%exportFlushEvery == 0 {
+		return ew.flush()
+	}
+	return nil
+}
+
+func (ew *exportWriter) flush() error {
+	if ew.csv != nil {
+		ew.csv.Flush()
+		if err := ew.csv.Error(); err != nil {
+			return err
+		}
+	}
+	ew.w.Flush()
+	return nil
+}
+
+// close ends the JSON array, or writes the CSV header of an empty export
+func (ew *exportWriter) close() error {
+	if ew.csv != nil {
+		if ew.rows == 0 {
+			if err := ew.csv.Write(ew.header); err != nil {
+				return err
+			}
+		}
+	} else {
+		end := "]"
+		if ew.rows == 0 {
+			end = "[]"
+		}
+		if _, err := ew.w.WriteString(end); err != nil {
+			return err
+		}
+	}
+	return ew.flush()
+}
+
+// userExportHeader is the column order of user CSV exports
+var userExportHeader = []string{
+	"id", "username", "manager_id", "status", "groups", "active_package_id",
+	"first_connection_at", "last_connection_at", "created_at",
+}
+
+// exportUsers streams every user matching the status, manager_id and search
+// filters as JSON or CSV
+func (s *Server) exportUsers(c *gin.Context) {
+	filter := &domain.UserFilter{}
+	if status := c.Query("status"); status != "" {
+		s := domain.UserStatus(status)
+		filter.Status = &s
+	}
+	if managerID := c.Query("manager_id"); managerID != "" {
+		filter.ManagerID = &managerID
+	}
+	if search := c.Query("search"); search != "" {
+		filter.Search = &search
+	}
+
+	ew := startExport(c, "users", userExportHeader)
+	if ew == nil {
+		return
+	}
+	err := s.userDB.RangeUsers(filter, func(u *domain.User) error {
+		return ew.write(u, func() []string {
+			return []string{
+				u.ID,
+				u.Username,
+				derefString(u.ManagerID),
+				string(u.Status),
+				strings.Join(u.Groups, ";"),
+				derefString(u.ActivePackageID),
+				formatExportTime(u.FirstConnectionAt),
+				formatExportTime(u.LastConnectionAt),
+				formatExportTime(&u.CreatedAt),
+			}
+		})
+	})
+	if err == nil {
+		err = ew.close()
+	}
+	if err != nil {
+		// The status is already sent; the client sees a truncated export
+		s.logger.Warn("user export failed", zap.Error(err))
+	}
+}
+
+// usageExportHeader is the column order of usage CSV exports
+var usageExportHeader = []string{
+	"timestamp", "user_id", "package_id", "node_id", "service_id",
+	"upload", "download", "raw_upload", "raw_download", "session_id",
+	"country", "city", "isp", "asn", "tags",
+}
+
+// exportUsage streams the usage history matching the user_id, node_id,
+// service_id, from and to filters as JSON or CSV, oldest first
+func (s *Server) exportUsage(c *gin.Context) {
+	if s.historyDB == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "usage history is not enabled"})
+		return
+	}
+
+	filter := sqlite.UsageHistoryFilter{
+		UserID:    c.Query("user_id"),
+		NodeID:    c.Query("node_id"),
+		ServiceID: c.Query("service_id"),
+	}
+	for _, bound := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		raw := c.Query(bound.name)
+		if raw == "" {
+			continue
+		}
+		t, err := parseTimeQuery(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid %s: %v", bound.name, err)})
+			return
+		}
+		*bound.dst = &t
+	}
+
+	ew := startExport(c, "usage", usageExportHeader)
+	if ew == nil {
+		return
+	}
+	err := s.historyDB.RangeUsageHistory(filter, func(e *sqlite.UsageHistoryEntry) error {
+		return ew.write(e, func() []string {
+			return []string{
+				formatExportTime(&e.Timestamp),
+				e.UserID,
+				e.PackageID,
+				e.NodeID,
+				e.ServiceID,
+				strconv.FormatInt(e.Upload, 10),
+				strconv.FormatInt(e.Download, 10),
+				strconv.FormatInt(e.RawUpload, 10),
+				strconv.FormatInt(e.RawDownload, 10),
+				e.SessionID,
+				e.Country,
+				e.City,
+				e.ISP,
+				strconv.FormatUint(uint64(e.ASN), 10),
+				strings.Join(e.Tags, ";"),
+			}
+		})
+	})
+	if err == nil {
+		err = ew.close()
+	}
+	if err != nil {
+		s.logger.Warn("usage export failed", zap.Error(err))
+	}
+}
+
+// formatExportTime renders t as RFC 3339 in UTC, or "" when unset
+func formatExportTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// derefString returns *s, or "" for nil
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// maxImportSize caps an uploaded panel dump
+const maxImportSize = 512 << 20
+
+// importUsers imports the users of a Marzban database or Hiddify backup sent
+// as the request body. The source query parameter names the panel, dry_run
+// reports without writing and manager_id assigns the users to a manager.
+func (s *Server) importUsers(c *gin.Context) {
+	source, err := importer.ParseSource(c.Query("source"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dryRun := false
+	if v := c.Query("dry_run"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dry_run"})
+			return
+		}
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	var records []importer.Record
+	if source == importer.SourceMarzban {
+		// SQLite needs a file to open
+		records, err = readMarzbanUpload(body)
+	} else {
+		records, err = importer.Read(source, "", body)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	activeUsers := 0
-	for _, u := range users {
-		if u.Status == domain.UserStatusActive {
-			activeUsers++
+	outcomes, err := importer.Import(s.userDB, records, importer.Options{ManagerID: c.Query("manager_id"), DryRun: dryRun})
+	imported := 0
+	for _, o := range outcomes {
+		if o.Imported {
+			imported++
+			if !dryRun {
+				s.quotaEngine.InvalidateUser(o.UserID)
+			}
 		}
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "users": outcomes})
+		return
+	}
+	if imported > 0 && !dryRun {
+		s.logger.Info("users imported", zap.String("source", string(source)), zap.Int("count", imported))
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"total_users":   len(users),
-		"active_users":  activeUsers,
-		"total_nodes":   len(nodes),
+		"dry_run":  dryRun,
+		"imported": imported,
+		"skipped":  len(outcomes) - imported,
+		"users":    outcomes,
 	})
 }
 
-// Helper functions
+// readMarzbanUpload copies an uploaded Marzban database to a temporary file
+// and reads it
+func readMarzbanUpload(body io.Reader) ([]importer.Record, error) {
+	f, err := os.CreateTemp("", "hue-import-*.sqlite3")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
 
-func parseInt(s string, defaultVal int) int {
-	var val int
-	if _, err := fmt.Sscanf(s, "%d", &val); err != nil {
-		return defaultVal
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	return val
+	if err != nil {
+		return nil, fmt.Errorf("failed to store upload: %w", err)
+	}
+	return importer.ReadMarzban(f.Name())
+}
+
+// generateBilling recomputes a period right away instead of waiting for the
+// billing job
+func (s *Server) generateBilling(c *gin.Context) {
+	period := c.DefaultQuery("period", domain.BillingPeriod(time.Now()))
+	if _, _, err := domain.ParseBillingPeriod(period); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	records, err := s.biller.Generate(period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"period": period, "records": records})
+}
+
+// Manager digest handlers
+
+// digestManager resolves the manager of a digest request, answering the
+// request itself when it may not proceed
+func (s *Server) digestManager(c *gin.Context) (*domain.Manager, bool) {
+	id := c.Param("id")
+	if !actsFor(c, id) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "api key scope does not allow this request"})
+		return nil, false
+	}
+
+	manager, err := s.userDB.GetManager(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if manager == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "manager not found"})
+		return nil, false
+	}
+	return manager, true
+}
+
+func (s *Server) getDigestSubscription(c *gin.Context) {
+	manager, ok := s.digestManager(c)
+	if !ok {
+		return
+	}
+
+	sub, err := s.userDB.GetDigestSubscription(manager.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if sub == nil {
+		sub = &domain.DigestSubscription{ManagerID: manager.ID, Frequency: domain.DigestFrequencyOff}
+	}
+
+	c.JSON(http.StatusOK, sub)
+}
+
+func (s *Server) updateDigestSubscription(c *gin.Context) {
+	manager, ok := s.digestManager(c)
+	if !ok {
+		return
+	}
+
+	var req domain.DigestSubscriptionUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.Frequency.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "frequency must be off, daily or weekly"})
+		return
+	}
+	if req.Frequency != domain.DigestFrequencyOff && !strings.HasPrefix(req.WebhookURL, "http://") && !strings.HasPrefix(req.WebhookURL, "https://") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "webhook_url must be an http(s) URL"})
+		return
+	}
+	if req.Language != "" && !domain.IsSupportedLanguage(req.Language) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported language %q", req.Language)})
+		return
+	}
+
+	sub := &domain.DigestSubscription{
+		ManagerID:  manager.ID,
+		Frequency:  req.Frequency,
+		WebhookURL: req.WebhookURL,
+		Language:   req.Language,
+	}
+	if err := s.userDB.SaveDigestSubscription(sub); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	saved, err := s.userDB.GetDigestSubscription(manager.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+// previewDigest compiles the digest a manager would receive now without
+// delivering it
+func (s *Server) previewDigest(c *gin.Context) {
+	if s.digester == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "digests are not available"})
+		return
+	}
+	manager, ok := s.digestManager(c)
+	if !ok {
+		return
+	}
+
+	frequency := domain.DigestFrequency(c.DefaultQuery("frequency", string(domain.DigestFrequencyDaily)))
+	if frequency.Period() == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "frequency must be daily or weekly"})
+		return
+	}
+
+	lang := c.Query("lang")
+	if sub, err := s.userDB.GetDigestSubscription(manager.ID); err == nil && sub != nil && lang == "" {
+		lang = sub.Language
+	}
+
+	now := time.Now()
+	digest, err := s.digester.Build(manager.ID, frequency, now.Add(-frequency.Period()), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.digester.Render(digest, lang))
+}
+
+// listPanelCallbacks lists panel callbacks after ?after=<sequence>, so the
+// panel can fetch status changes it missed
+func (s *Server) listPanelCallbacks(c *gin.Context) {
+	if s.panel == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "panel sync is not configured"})
+		return
+	}
+
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid after"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	callbacks, err := s.panel.Callbacks(after, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	payloads := make([]*panelhook.Callback, 0, len(callbacks))
+	for _, cb := range callbacks {
+		payloads = append(payloads, s.panel.Payload(cb))
+	}
+	c.JSON(http.StatusOK, gin.H{"callbacks": payloads, "total": len(payloads)})
+}
+
+// replayPanelCallbacks queues delivered callbacks after {"after": <sequence>}
+// for delivery again
+func (s *Server) replayPanelCallbacks(c *gin.Context) {
+	if s.panel == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "panel sync is not configured"})
+		return
+	}
+
+	var req struct {
+		After int64 `json:"after"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	requeued, err := s.panel.Replay(req.After)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requeued": requeued})
 }
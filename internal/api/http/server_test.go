@@ -1,25 +1,49 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/hiddify/hue-go/internal/auth"
 	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/engine"
+	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/jobs"
+	"github.com/hiddify/hue-go/internal/metrics"
 	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/pkg/panelhook"
 	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
 )
 
 type httpFixture struct {
-	router *gin.Engine
-	userDB *sqlite.UserDB
-	secret string
+	router    *gin.Engine
+	userDB    *sqlite.UserDB
+	activeDB  *sqlite.ActiveDB
+	scheduler *jobs.Scheduler
+	penalty   *engine.PenaltyHandler
+	quota     *engine.QuotaEngine
+	panel     *engine.PanelSync
+	hub       *eventstore.ReceiverHub
+	historyDB *sqlite.HistoryDB
+	usage     *engine.Engine
+	sessions  *engine.SessionManager
+	metrics   *metrics.Metrics
+	secret    string
 }
 
 func newHTTPFixture(t *testing.T) *httpFixture {
@@ -36,12 +60,42 @@ func newHTTPFixture(t *testing.T) *httpFixture {
 		t.Fatalf("migrate user db: %v", err)
 	}
 
-	cache := cache.NewMemoryCache()
-	quota := engine.NewQuotaEngine(userDB, nil, cache, zap.NewNop())
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("new active db: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+
+	memCache := cache.NewMemoryCache()
+	quota := engine.NewQuotaEngine(userDB, activeDB, memCache, zap.NewNop())
 	secret := "test-secret"
-	router := NewServer(userDB, nil, quota, zap.NewNop(), secret)
+	scheduler := jobs.NewScheduler(zap.NewNop())
+	t.Cleanup(scheduler.Stop)
+	penalty := engine.NewPenaltyHandler(memCache, time.Minute, zap.NewNop())
+	biller := engine.NewBiller(userDB, activeDB, domain.BillingRates{
+		NodeGroups: map[string]string{"node-premium": "premium"},
+		Rates:      map[string]float64{domain.DefaultNodeGroup: 1, "premium": 4},
+		Currency:   "USD",
+	}, zap.NewNop())
+	sessions := engine.NewSessionManager(memCache, 5*time.Minute, zap.NewNop())
+	digester := engine.NewDigester(userDB, activeDB, nil, engine.NewWebhookNotifier(time.Second), zap.NewNop())
+	hub := eventstore.NewReceiverHub()
+	historyDB, err := sqlite.NewHistoryDB("sqlite://" + filepath.Join(t.TempDir(), "http-api_history.db"))
+	if err != nil {
+		t.Fatalf("new history db: %v", err)
+	}
+	t.Cleanup(func() { _ = historyDB.Close() })
+	events := eventstore.NewDBEventStore(historyDB)
+	usage := engine.NewEngine(quota, sessions, penalty, engine.NewStandbyGeoHandler(), events, memCache, userDB, zap.NewNop())
+	panel := engine.NewPanelSync(userDB, "http://127.0.0.1:0/panel", "panel-secret", time.Second, zap.NewNop())
+	hueMetrics := metrics.New()
+	tokens, err := auth.NewTokenIssuer("test-signing-key", time.Hour)
+	if err != nil {
+		t.Fatalf("new token issuer: %v", err)
+	}
+	router := NewServer(userDB, activeDB, historyDB, quota, usage, sessions, penalty, engine.NewStandbyGeoHandler(), cache.NewStatsCache(time.Minute), scheduler, biller, digester, panel, hub, events, hueMetrics.Registry, zap.NewNop(), secret, tokens)
 
-	return &httpFixture{router: router, userDB: userDB, secret: secret}
+	return &httpFixture{router: router, userDB: userDB, activeDB: activeDB, historyDB: historyDB, usage: usage, sessions: sessions, scheduler: scheduler, penalty: penalty, quota: quota, panel: panel, hub: hub, metrics: hueMetrics, secret: secret}
 }
 
 func (f *httpFixture) doJSON(t *testing.T, method, path string, body any, auth bool) *httptest.ResponseRecorder {
@@ -88,6 +142,18 @@ func TestHTTPHealthAndAuth(t *testing.T) {
 	if unauth.Code != http.StatusUnauthorized {
 		t.Fatalf("expected 401 without auth secret, got %d", unauth.Code)
 	}
+	if got := unauth.Header().Get("Hue-API-Version"); got != "v1" {
+		t.Fatalf("expected Hue-API-Version v1, got %q", got)
+	}
+
+	versions := fx.doJSON(t, http.MethodGet, "/api/versions", nil, false)
+	if versions.Code != http.StatusOK {
+		t.Fatalf("expected 200 for versions, got %d", versions.Code)
+	}
+	body := decodeBodyMap(t, versions)
+	if body["current"] != "v1" {
+		t.Fatalf("expected current API version v1, got %v", body["current"])
+	}
 }
 
 func TestHTTPOwnerDBAuthKey(t *testing.T) {
@@ -166,19 +232,27 @@ func TestHTTPUserPackageNodeServiceFlow(t *testing.T) {
 	serviceID := createdService["id"].(string)
 
 	createPackage := fx.doJSON(t, http.MethodPost, "/api/v1/packages", map[string]any{
-		"user_id":        userID,
-		"total_traffic":  10_000,
-		"upload_limit":   0,
-		"download_limit": 0,
-		"reset_mode":     string(domain.ResetModeMonthly),
-		"duration":       3600,
-		"max_concurrent": 2,
+		"user_id":            userID,
+		"total_traffic":      10_000,
+		"upload_limit":       0,
+		"download_limit":     0,
+		"reset_mode":         string(domain.ResetModeMonthly),
+		"duration":           3600,
+		"max_concurrent":     2,
+		"throttle_threshold": 90,
+		"throttle_rate":      2048,
 	}, true)
 	if createPackage.Code != http.StatusCreated {
 		t.Fatalf("expected 201 create package, got %d body=%s", createPackage.Code, createPackage.Body.String())
 	}
 	createdPackage := decodeBodyMap(t, createPackage)
 	pkgID := createdPackage["id"].(string)
+	if createdPackage["throttle_threshold"].(float64) != 90 || createdPackage["throttle_rate"].(float64) != 2048 {
+		t.Fatalf("expected throttle settings to be kept, got %+v", createdPackage)
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/packages", map[string]any{"user_id": userID, "throttle_threshold": 90}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a throttle threshold without a rate, got %d", rr.Code)
+	}
 
 	_, err := fx.userDB.Exec(`UPDATE users SET active_package_id = ? WHERE id = ?`, pkgID, userID)
 	if err != nil {
@@ -190,10 +264,68 @@ func TestHTTPUserPackageNodeServiceFlow(t *testing.T) {
 		t.Fatalf("expected 200 get user package, got %d body=%s", userPkg.Code, userPkg.Body.String())
 	}
 
+	queuedPackage := fx.doJSON(t, http.MethodPost, "/api/v1/packages", map[string]any{
+		"user_id":        userID,
+		"total_traffic":  5_000,
+		"reset_mode":     string(domain.ResetModeNoReset),
+		"duration":       3600,
+		"max_concurrent": 1,
+		"queued":         true,
+	}, true)
+	if queuedPackage.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create queued package, got %d body=%s", queuedPackage.Code, queuedPackage.Body.String())
+	}
+	if queued := decodeBodyMap(t, queuedPackage); queued["status"] != string(domain.PackageStatusQueued) || queued["queue_position"] != float64(1) {
+		t.Fatalf("expected a queued package at position 1, got %v", queued)
+	}
+	userPackages := fx.doJSON(t, http.MethodGet, "/api/v1/users/"+userID+"/packages", nil, true)
+	if packages, _ := decodeBodyMap(t, userPackages)["packages"].([]any); len(packages) != 2 || packages[0].(map[string]any)["id"] != pkgID {
+		t.Fatalf("expected the active package before the queued one, got %s", userPackages.Body.String())
+	}
+
 	stats := fx.doJSON(t, http.MethodGet, "/api/v1/stats", nil, true)
 	if stats.Code != http.StatusOK {
 		t.Fatalf("expected 200 stats, got %d", stats.Code)
 	}
+	if _, ok := decodeBodyMap(t, stats)["download_bps"]; !ok {
+		t.Fatalf("expected stats to carry throughput, got %s", stats.Body.String())
+	}
+
+	userSessions := fx.doJSON(t, http.MethodGet, "/api/v1/users/"+userID+"/sessions", nil, true)
+	if userSessions.Code != http.StatusOK {
+		t.Fatalf("expected 200 user sessions, got %d body=%s", userSessions.Code, userSessions.Body.String())
+	}
+	if missing := fx.doJSON(t, http.MethodGet, "/api/v1/users/missing/sessions", nil, true); missing.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 sessions of unknown user, got %d", missing.Code)
+	}
+
+	listServices := fx.doJSON(t, http.MethodGet, "/api/v1/services?node_id="+nodeID, nil, true)
+	if listServices.Code != http.StatusOK || decodeBodyMap(t, listServices)["total"] != float64(1) {
+		t.Fatalf("expected the node's service to be listed, got %d body=%s", listServices.Code, listServices.Body.String())
+	}
+	if other := fx.doJSON(t, http.MethodGet, "/api/v1/services?node_id=missing", nil, true); decodeBodyMap(t, other)["total"] != float64(0) {
+		t.Fatalf("expected no services for another node, got %s", other.Body.String())
+	}
+
+	updateService := fx.doJSON(t, http.MethodPut, "/api/v1/services/"+serviceID, map[string]any{
+		"name":       "svc-renamed",
+		"secret_key": "svc-rotated",
+	}, true)
+	if updateService.Code != http.StatusOK || decodeBodyMap(t, updateService)["name"] != "svc-renamed" {
+		t.Fatalf("expected 200 update service, got %d body=%s", updateService.Code, updateService.Body.String())
+	}
+	if svc, _ := fx.userDB.AuthenticateServiceKey("svc-secret"); svc != nil {
+		t.Fatalf("expected the old service key to stop working")
+	}
+	if svc, _ := fx.userDB.AuthenticateServiceKey("svc-rotated"); svc == nil || svc.ID != serviceID {
+		t.Fatalf("expected the rotated service key to authenticate")
+	}
+	if empty := fx.doJSON(t, http.MethodPut, "/api/v1/services/"+serviceID, map[string]any{"secret_key": ""}, true); empty.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty secret, got %d", empty.Code)
+	}
+	if missing := fx.doJSON(t, http.MethodPut, "/api/v1/services/missing", map[string]any{"name": "x"}, true); missing.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 updating an unknown service, got %d", missing.Code)
+	}
 
 	deleteService := fx.doJSON(t, http.MethodDelete, "/api/v1/services/"+serviceID, nil, true)
 	if deleteService.Code != http.StatusOK {
@@ -210,3 +342,1692 @@ func TestHTTPUserPackageNodeServiceFlow(t *testing.T) {
 		t.Fatalf("expected 200 delete user, got %d", deleteUser.Code)
 	}
 }
+
+func TestHTTPTagStats(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	reports := []*domain.UsageReport{
+		{ID: "r1", UserID: "u1", NodeID: "n1", ServiceID: "s1", Upload: 10, Download: 20, Tags: []string{"vless", "campaign-a"}, Timestamp: time.Now()},
+		{ID: "r2", UserID: "u2", NodeID: "n2", ServiceID: "s2", Upload: 5, Download: 5, Tags: []string{"vless"}, Timestamp: time.Now()},
+		{ID: "r3", UserID: "u2", NodeID: "n2", ServiceID: "s2", Upload: 1, Download: 1, Tags: []string{"trojan"}, Timestamp: time.Now()},
+	}
+	for _, r := range reports {
+		if err := fx.activeDB.BufferUsage(r); err != nil {
+			t.Fatalf("buffer usage: %v", err)
+		}
+	}
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/stats/tags?tag=vless", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 tag stats, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	var body struct {
+		Tags []*sqlite.TagUsage `json:"tags"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode tag stats: %v", err)
+	}
+	if len(body.Tags) != 1 {
+		t.Fatalf("expected only the vless tag, got %d", len(body.Tags))
+	}
+	vless := body.Tags[0]
+	if vless.Tag != "vless" || vless.Total != 40 || vless.Reports != 2 || len(vless.Nodes) != 2 {
+		t.Fatalf("unexpected vless aggregation: %+v", vless)
+	}
+
+	all := fx.doJSON(t, http.MethodGet, "/api/v1/stats/tags", nil, true)
+	allBody := decodeBodyMap(t, all)
+	if tags, _ := allBody["tags"].([]any); len(tags) != 3 {
+		t.Fatalf("expected 3 tags without filter, got %v", allBody["tags"])
+	}
+}
+
+func TestHTTPDisconnectReasons(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/reasons?lang=fa", nil, false)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 reasons without auth, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	var body struct {
+		Language string `json:"language"`
+		Reasons  []struct {
+			Code    domain.ReasonCode `json:"code"`
+			Message string            `json:"message"`
+		} `json:"reasons"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode reasons: %v", err)
+	}
+	if body.Language != "fa" || len(body.Reasons) != len(domain.DisconnectReasons()) {
+		t.Fatalf("unexpected reasons response: lang=%s count=%d", body.Language, len(body.Reasons))
+	}
+	want, _ := domain.LookupReason(body.Reasons[0].Code)
+	if body.Reasons[0].Message != want.Messages["fa"] {
+		t.Fatalf("expected persian message, got %q", body.Reasons[0].Message)
+	}
+}
+
+func TestHTTPAdminJobs(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	ran := make(chan struct{}, 1)
+	if err := fx.scheduler.Register("test_job", 0, func(context.Context) error {
+		ran <- struct{}{}
+		return nil
+	}); err != nil {
+		t.Fatalf("register job: %v", err)
+	}
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/admin/jobs", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 job list, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	var list struct {
+		Jobs []jobs.Status `json:"jobs"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decode jobs: %v", err)
+	}
+	if len(list.Jobs) != 1 || list.Jobs[0].Name != "test_job" || list.Jobs[0].Interval != "manual" {
+		t.Fatalf("unexpected job list: %+v", list.Jobs)
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/admin/jobs/test_job/run", nil, true)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 run, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	select {
+	case <-ran:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("job was not run")
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/admin/jobs/missing/run", nil, true)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown job, got %d", rr.Code)
+	}
+}
+
+func TestHTTPDisconnectUser(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	createUser := fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{"username": "kicked", "password": "p@ss"}, true)
+	if createUser.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create user, got %d body=%s", createUser.Code, createUser.Body.String())
+	}
+	userID := decodeBodyMap(t, createUser)["id"].(string)
+	fx.sessions.AddSession(userID, "sess-a", "sess-a", "node-a", "10.0.0.1", nil)
+	fx.sessions.AddSession(userID, "sess-b", "sess-b", "node-b", "10.0.0.2", nil)
+
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/users/"+userID+"/disconnect", map[string]any{"session_id": "missing"}, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown session, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/users/missing/disconnect", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown user, got %d", rr.Code)
+	}
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/users/"+userID+"/disconnect", map[string]any{"session_id": "sess-a"}, true)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["sessions"].(float64) != 1 {
+		t.Fatalf("expected one session ended, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	cmds := fx.usage.TakeDisconnects("node-a", 0)
+	if len(cmds) != 1 || cmds[0].SessionID != "sess-a" || cmds[0].Reason != string(domain.ReasonAdminDisconnect) {
+		t.Fatalf("expected an admin disconnect for sess-a on node-a, got %+v", cmds)
+	}
+	if sessions := fx.sessions.GetUserSessions(userID); len(sessions) != 1 || sessions[0].SessionID != "sess-b" {
+		t.Fatalf("expected only sess-b left, got %+v", sessions)
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/users/"+userID+"/disconnect", nil, true)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["sessions"].(float64) != 1 {
+		t.Fatalf("expected the remaining session ended, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if cmds := fx.usage.TakeDisconnects("node-b", 0); len(cmds) != 1 || cmds[0].SessionID != "sess-b" {
+		t.Fatalf("expected a disconnect for sess-b on node-b, got %+v", cmds)
+	}
+	if sessions := fx.sessions.GetUserSessions(userID); len(sessions) != 0 {
+		t.Fatalf("expected no sessions left, got %+v", sessions)
+	}
+}
+
+func TestHTTPUserSubscription(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	if err := fx.userDB.CreateNode(&domain.Node{ID: "n1", SecretKey: "node-key", Name: "frankfurt", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if err := fx.userDB.CreateUser(&domain.User{ID: "u1", Username: "alice", Password: "pw", Status: domain.UserStatusActive}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	pkg := &domain.Package{ID: "p1", UserID: "u1", TotalTraffic: 10_000, ResetMode: domain.ResetModeNoReset, Duration: 86400,
+		MaxConcurrent: 2, Status: domain.PackageStatusActive, CurrentUpload: 1000, CurrentDownload: 2000, CurrentTotal: 3000}
+	pkg.Start(time.Now().Add(-time.Hour))
+	if err := fx.userDB.CreatePackage(pkg); err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if _, err := fx.userDB.Exec(`UPDATE users SET active_package_id = ? WHERE id = ?`, pkg.ID, "u1"); err != nil {
+		t.Fatalf("attach package: %v", err)
+	}
+
+	for i, at := range []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-30 * time.Minute)} {
+		report := &domain.UsageReport{ID: fmt.Sprintf("r%d", i), UserID: "u1", NodeID: "n1", ServiceID: "s1", Upload: 100, Download: 200, Timestamp: at}
+		if err := fx.activeDB.BufferBilledUsage(report, domain.UsageTraffic{RawUpload: 100, RawDownload: 200, BilledUpload: 100, BilledDownload: 200}); err != nil {
+			t.Fatalf("buffer usage: %v", err)
+		}
+	}
+	fx.sessions.AddSession("u1", "sess-a", "sess-a", "n1", "10.0.0.1", nil)
+	fx.sessions.AddSession("u1", "sess-b", "sess-b", "n2", "10.0.0.2", nil)
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/users/u1/subscription", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 subscription, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	var sub subscriptionResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &sub); err != nil {
+		t.Fatalf("decode subscription: %v", err)
+	}
+	if sub.Username != "alice" || sub.PackageID != "p1" || sub.TotalTraffic != 10_000 || sub.UsedTraffic != 3000 || sub.Remaining != 7000 {
+		t.Fatalf("unexpected traffic in %+v", sub)
+	}
+	if sub.ExpiresAt == nil || sub.ActiveSessions != 2 || len(sub.Nodes) != 2 {
+		t.Fatalf("expected an expiry, two sessions and two nodes, got %s", rr.Body.String())
+	}
+	// Only the report since the package started counts
+	if n := sub.Nodes[0]; n.NodeID != "n1" || n.Name != "frankfurt" || n.Upload != 100 || n.Download != 200 || n.ActiveSessions != 1 {
+		t.Fatalf("unexpected n1 breakdown %+v", n)
+	}
+	if n := sub.Nodes[1]; n.NodeID != "n2" || n.Upload != 0 || n.ActiveSessions != 1 {
+		t.Fatalf("unexpected n2 breakdown %+v", n)
+	}
+
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/users/missing/subscription", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d", rr.Code)
+	}
+}
+
+func TestHTTPUserPenalty(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	createUser := fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{
+		"username": "penalized",
+		"password": "p@ss",
+	}, true)
+	if createUser.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create user, got %d body=%s", createUser.Code, createUser.Body.String())
+	}
+	userID := decodeBodyMap(t, createUser)["id"].(string)
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/users/"+userID+"/penalty", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 penalty status, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if body := decodeBodyMap(t, rr); body["active"] != false {
+		t.Fatalf("expected no active penalty, got %+v", body)
+	}
+
+	fx.penalty.ApplyPenalty(userID, "concurrent session limit exceeded", domain.PenaltyPolicy{})
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/users/"+userID+"/penalty", nil, true)
+	body := decodeBodyMap(t, rr)
+	if body["active"] != true || body["reason"] != "concurrent session limit exceeded" {
+		t.Fatalf("expected active penalty, got %+v", body)
+	}
+	if left, _ := body["seconds_left"].(float64); left <= 0 || left > 60 {
+		t.Fatalf("expected seconds_left within penalty duration, got %v", body["seconds_left"])
+	}
+
+	rr = fx.doJSON(t, http.MethodDelete, "/api/v1/users/"+userID+"/penalty", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 clear penalty, got %d", rr.Code)
+	}
+	if fx.penalty.CheckPenalty(userID).HasPenalty {
+		t.Fatalf("expected penalty to be cleared")
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/users/missing/penalty", nil, true)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown user, got %d", rr.Code)
+	}
+}
+
+func TestHTTPStatsETagAndBustOnWrite(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/stats", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 stats, got %d", rr.Code)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected ETag on stats response")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil)
+	req.Header.Set("Hue-API-Key", fx.secret)
+	req.Header.Set("If-None-Match", etag)
+	notModified := httptest.NewRecorder()
+	fx.router.ServeHTTP(notModified, req)
+	if notModified.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching If-None-Match, got %d", notModified.Code)
+	}
+
+	createUser := fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{
+		"username": "stats-user",
+		"password": "p@ss",
+	}, true)
+	if createUser.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create user, got %d", createUser.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/stats", nil, true)
+	if rr.Header().Get("ETag") == etag {
+		t.Fatalf("expected write to bust cached stats")
+	}
+	if body := decodeBodyMap(t, rr); body["total_users"] != float64(1) {
+		t.Fatalf("expected fresh stats after write, got %+v", body)
+	}
+}
+
+func TestHTTPStatsAggregates(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	for i, status := range []domain.UserStatus{domain.UserStatusActive, domain.UserStatusActive, domain.UserStatusSuspended, domain.UserStatusFinish} {
+		id := fmt.Sprintf("u%d", i)
+		if err := fx.userDB.CreateUser(&domain.User{ID: id, Username: id, Password: "pw", Status: status}); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	for _, id := range []string{"n1", "n2"} {
+		if err := fx.userDB.CreateNode(&domain.Node{ID: id, SecretKey: id + "-key", Name: id, TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+			t.Fatalf("create node: %v", err)
+		}
+	}
+	if err := fx.userDB.RecordNodeHeartbeat(&domain.NodeLoad{NodeID: "n1"}, time.Now()); err != nil {
+		t.Fatalf("record heartbeat: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		report := &domain.UsageReport{ID: fmt.Sprintf("r%d", i), UserID: "u0", NodeID: "n1", ServiceID: "s1", Upload: 100, Download: 200, Timestamp: time.Now()}
+		if err := fx.activeDB.BufferUsage(report); err != nil {
+			t.Fatalf("buffer usage: %v", err)
+		}
+	}
+	// A backfilled report counts toward the rate when it arrives
+	backfilled := &domain.UsageReport{ID: "r-old", UserID: "u0", NodeID: "n1", ServiceID: "s1", Timestamp: time.Now().Add(-48 * time.Hour)}
+	if err := fx.activeDB.BufferUsage(backfilled); err != nil {
+		t.Fatalf("buffer usage: %v", err)
+	}
+	fx.sessions.AddSession("u0", "sess-a", "sess-a", "n1", "10.0.0.1", nil)
+	fx.sessions.AddSession("u0", "sess-b", "sess-b", "n1", "10.0.0.2", nil)
+	fx.sessions.AddSession("u1", "sess-c", "sess-c", "n1", "10.0.0.3", nil)
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/stats", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 stats, got %d", rr.Code)
+	}
+	body := decodeBodyMap(t, rr)
+	for key, want := range map[string]float64{
+		"total_users": 4, "active_users": 2, "suspended_users": 1, "finished_users": 1,
+		"traffic_today": 900, "online_users": 2, "total_nodes": 2, "online_nodes": 1, "reports_per_sec": 4.0 / 60,
+	} {
+		if body[key] != want {
+			t.Fatalf("expected %s %v, got %v in %s", key, want, body[key], rr.Body.String())
+		}
+	}
+}
+
+func TestHTTPUserLocaleSelectsLanguage(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{
+		"username":   "localized",
+		"password":   "p@ss",
+		"attributes": map[string]string{"locale": "xx"},
+	}, true)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unsupported locale, got %d", rr.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{
+		"username":   "localized",
+		"password":   "p@ss",
+		"attributes": map[string]string{"locale": "fa"},
+	}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create user, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	userID := decodeBodyMap(t, rr)["id"].(string)
+
+	fx.penalty.ApplyPenalty(userID, string(domain.ReasonConcurrentLimit), domain.PenaltyPolicy{})
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/users/"+userID+"/penalty", nil, true)
+	reason, _ := domain.LookupReason(domain.ReasonConcurrentLimit)
+	if body := decodeBodyMap(t, rr); body["message"] != reason.Messages["fa"] {
+		t.Fatalf("expected penalty message in the user's locale, got %v", body["message"])
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/messages", nil)
+	req.Header.Set("Accept-Language", "de, fa-IR;q=0.9")
+	rec := httptest.NewRecorder()
+	fx.router.ServeHTTP(rec, req)
+	var catalog struct {
+		Language string            `json:"language"`
+		Messages map[string]string `json:"messages"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &catalog); err != nil {
+		t.Fatalf("decode messages: %v", err)
+	}
+	if catalog.Language != "fa" || catalog.Messages[string(domain.MessageUserSuspended)] == "" {
+		t.Fatalf("unexpected message catalog: %+v", catalog)
+	}
+}
+
+func TestHTTPMonitorKeyScope(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": "grafana"}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	created := decodeBodyMap(t, rr)
+	if created["scope"] != string(domain.KeyScopeMonitor) || created["key"] == "" {
+		t.Fatalf("unexpected created key: %v", created)
+	}
+	rawKey, keyID := created["key"].(string), created["id"].(string)
+
+	get := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Hue-API-Key", rawKey)
+		rec := httptest.NewRecorder()
+		fx.router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get("/api/v1/stats"); code != http.StatusOK {
+		t.Fatalf("expected monitor key to read stats, got %d", code)
+	}
+	if code := get("/api/v1/users"); code != http.StatusForbidden {
+		t.Fatalf("expected monitor key to be denied users, got %d", code)
+	}
+	if code := get("/api/v1/admin/keys"); code != http.StatusForbidden {
+		t.Fatalf("expected monitor key to be denied key management, got %d", code)
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": "x", "scope": "admin"}, true)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown scope, got %d", rr.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodDelete, "/api/v1/admin/keys/"+keyID, nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 revoke key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if code := get("/api/v1/stats"); code != http.StatusUnauthorized {
+		t.Fatalf("expected revoked key to be rejected, got %d", code)
+	}
+}
+
+func TestHTTPAuthKeyLifecycle(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	if err := fx.userDB.CreateNode(&domain.Node{ID: "n1", SecretKey: "node-key", Name: "n1", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if err := fx.userDB.CreateService(&domain.Service{ID: "s1", SecretKey: "svc-v1", NodeID: "n1", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/auth-keys/services/s1/rotate", map[string]any{"overlap_seconds": 600, "expires_in_seconds": 86400}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 rotate service key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	rotated := decodeBodyMap(t, rr)
+	newKey, _ := rotated["key"].(string)
+	if newKey == "" || rotated["service_id"] != "s1" || rotated["expires_at"] == nil || rotated["previous_expires_at"] == nil {
+		t.Fatalf("unexpected rotated key: %v", rotated)
+	}
+	for _, key := range []string{"svc-v1", newKey} {
+		if svc, _ := fx.userDB.AuthenticateServiceKey(key); svc == nil {
+			t.Fatalf("expected %q to work during the overlap", key)
+		}
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/admin/auth-keys/services/s1", nil, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create service key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	created := decodeBodyMap(t, rr)["key"].(string)
+	if svc, _ := fx.userDB.AuthenticateServiceKey(newKey); svc != nil {
+		t.Fatal("expected a created key to replace the old one at once")
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/admin/auth-keys", nil, true)
+	keys, _ := decodeBodyMap(t, rr)["keys"].([]any)
+	if rr.Code != http.StatusOK || len(keys) != 1 || keys[0].(map[string]any)["kind"] != "service" {
+		t.Fatalf("expected the service key to be listed, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), created) {
+		t.Fatal("expected the listing not to contain keys")
+	}
+
+	if rr := fx.doJSON(t, http.MethodDelete, "/api/v1/admin/auth-keys/services/s1", nil, true); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 revoke service key, got %d", rr.Code)
+	}
+	if svc, _ := fx.userDB.AuthenticateServiceKey(created); svc != nil {
+		t.Fatal("expected the revoked key to be rejected")
+	}
+
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/auth-keys/services/missing/rotate", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing service, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/auth-keys/services/s1", map[string]any{"expires_in_seconds": -1}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative expiry, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/auth-keys/owner/rotate", nil, true); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 rotating an owner key set by HUE_AUTH_SECRET, got %d", rr.Code)
+	}
+}
+
+func TestHTTPAccessTokenScopes(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/auth/token", map[string]any{"subject": "grafana", "ttl_seconds": 600}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 issue token, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	issued := decodeBodyMap(t, rr)
+	token, _ := issued["token"].(string)
+	if issued["token_type"] != "Bearer" || token == "" {
+		t.Fatalf("unexpected token response: %v", issued)
+	}
+
+	do := func(method, path, bearer string, body any) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		fx.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodGet, "/api/v1/users", token, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected read-only token to list users, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/v1/users", token, map[string]any{"username": "x", "password": "y"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected read-only token to be denied writes, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/api/v1/auth/token", token, map[string]any{"scopes": []string{"full"}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected read-only token not to mint a full token, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/api/v1/users", token[:len(token)-2]+"xx", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected tampered token to be rejected, got %d", rec.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/auth/token", map[string]any{"scopes": []string{"admin"}}, true)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown scope, got %d", rr.Code)
+	}
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/auth/token", map[string]any{"scopes": []string{"full"}}, true)
+	full, _ := decodeBodyMap(t, rr)["token"].(string)
+	if rec := do(http.MethodPost, "/api/v1/users", full, map[string]any{"username": "tokenuser", "password": "y"}); rec.Code != http.StatusCreated {
+		t.Fatalf("expected full token to create users, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	for _, path := range []string{"/api/v1/admin/keys", "/api/v1/admin/auth-keys", "/api/v1/export/users", "/api/v1/panel/callbacks"} {
+		if rec := do(http.MethodGet, path, token, nil); rec.Code != http.StatusForbidden {
+			t.Fatalf("expected read-only token to be denied %s, got %d", path, rec.Code)
+		}
+	}
+
+	// A full token cannot renew itself, and what it issues expires with it
+	if rec := do(http.MethodPost, "/api/v1/auth/token", full, map[string]any{"scopes": []string{"full"}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected full token not to mint a full token, got %d", rec.Code)
+	}
+	short := fx.doJSON(t, http.MethodPost, "/api/v1/auth/token", map[string]any{"scopes": []string{"full"}, "ttl_seconds": 60}, true)
+	shortBody := decodeBodyMap(t, short)
+	rec := do(http.MethodPost, "/api/v1/auth/token", shortBody["token"].(string), map[string]any{"scopes": []string{"service-update"}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected full token to mint a service-update token, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	derived := decodeBodyMap(t, rec)
+	if derived["expires_at"] != shortBody["expires_at"] {
+		t.Fatalf("expected the derived token to expire with its issuer at %v, got %v", shortBody["expires_at"], derived["expires_at"])
+	}
+
+	serviceUpdate := derived["token"].(string)
+	if rec := do(http.MethodGet, "/api/v1/services", serviceUpdate, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected service-update token to list services, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/v1/services/s1", serviceUpdate, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected service-update token to be denied deleting services, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/api/v1/services/s1/manager", serviceUpdate, map[string]any{}); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected service-update token to be denied reassigning services, got %d", rec.Code)
+	}
+}
+
+func TestHTTPMetricsServesPrometheusText(t *testing.T) {
+	fx := newHTTPFixture(t)
+	fx.metrics.Reports.Inc("accepted")
+	fx.metrics.Rejections.Inc(string(domain.ReasonQuotaExceeded))
+	fx.metrics.FlushDuration.Observe(0.02)
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": "prometheus"}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	rawKey := decodeBodyMap(t, rr)["key"].(string)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	fx.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected metrics to need a key, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+rawKey)
+	rec = httptest.NewRecorder()
+	fx.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a monitor key to read metrics, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != metrics.ContentType {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE hue_usage_reports_total counter",
+		`hue_usage_reports_total{result="accepted"} 1`,
+		`hue_usage_rejections_total{reason="quota_exceeded"} 1`,
+		`hue_db_flush_duration_seconds_bucket{le="0.025"} 1`,
+		"hue_db_flush_duration_seconds_count 1",
+		"hue_cache_hit_ratio 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestHTTPAdminWritesRefreshUserCache(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{"username": "cached", "password": "p"}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create user, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	userID := decodeBodyMap(t, rr)["id"].(string)
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/packages", map[string]any{
+		"user_id": userID, "total_traffic": 1000, "reset_mode": "no_reset", "duration": 3600, "max_concurrent": 1,
+	}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create package, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	pkgID := decodeBodyMap(t, rr)["id"].(string)
+
+	rr = fx.doJSON(t, http.MethodPut, "/api/v1/users/"+userID, map[string]any{"active_package_id": pkgID}, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 update user, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	canUse := func() bool {
+		res, err := fx.quota.CheckQuota(userID, 1, 1)
+		if err != nil {
+			t.Fatalf("check quota: %v", err)
+		}
+		return res.CanUse
+	}
+	if !canUse() {
+		t.Fatalf("expected user to be allowed after the package was attached")
+	}
+
+	// A change made behind the API's back stays invisible until a refresh
+	if err := fx.userDB.UpdateUserStatus(userID, domain.UserStatusSuspended); err != nil {
+		t.Fatalf("suspend user: %v", err)
+	}
+	if !canUse() {
+		t.Fatalf("expected the cached status to still be served")
+	}
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/cache/users/"+userID+"/refresh", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 refresh, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if canUse() {
+		t.Fatalf("expected refreshed cache to reject the suspended user")
+	}
+
+	rr = fx.doJSON(t, http.MethodPut, "/api/v1/users/"+userID, map[string]any{"status": "active"}, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 update user, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if !canUse() {
+		t.Fatalf("expected reactivation through the API to apply immediately")
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/cache/users/missing/refresh", nil, true)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 refreshing an unknown user, got %d", rr.Code)
+	}
+}
+
+func TestHTTPGeoStandbyAndLoadErrors(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/admin/geo", nil, true)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["ready"] != false {
+		t.Fatalf("expected geo handler on standby, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	rr = fx.doJSON(t, http.MethodPut, "/api/v1/admin/geo", map[string]any{"path": filepath.Join(t.TempDir(), "missing.mmdb")}, true)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a missing database file, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/admin/geo", bytes.NewReader([]byte("not a maxmind database")))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Hue-API-Key", fx.secret)
+	rec := httptest.NewRecorder()
+	fx.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid upload, got %d", rec.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodPut, "/api/v1/admin/geo?database=asn", map[string]any{"path": filepath.Join(t.TempDir(), "missing.mmdb")}, true)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a missing ASN database file, got %d", rr.Code)
+	}
+	rr = fx.doJSON(t, http.MethodPut, "/api/v1/admin/geo?database=isp", map[string]any{"path": "x.mmdb"}, true)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown database, got %d", rr.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/admin/geo", nil, true)
+	if status := decodeBodyMap(t, rr); status["ready"] != false || status["asn_ready"] != false {
+		t.Fatalf("expected failed loads to leave the handler on standby, got %+v", status)
+	}
+}
+
+func TestHTTPManagerCRUD(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/managers", map[string]any{
+		"id":       "mgr-root",
+		"name":     "root",
+		"metadata": map[string]any{"region": "eu"},
+		"package":  map[string]any{"total_limit": 1000, "max_active_users": 10},
+	}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create manager, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	root := decodeBodyMap(t, rr)
+	pkg := root["package"].(map[string]any)
+	if pkg["status"] != string(domain.ManagerPackageStatusActive) || pkg["reset_mode"] != string(domain.ResetModeNoReset) {
+		t.Fatalf("expected package defaults, got %v", pkg)
+	}
+
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/managers", map[string]any{"id": "mgr-root", "name": "again"}, true); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for duplicate manager, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/managers", map[string]any{"name": "orphan", "parent_id": "missing"}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown parent, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/managers", map[string]any{
+		"name": "greedy", "parent_id": "mgr-root", "package": map[string]any{"total_limit": 2000},
+	}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for child above parent limits, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/managers", map[string]any{
+		"name": "reseller", "parent_id": "mgr-root", "package": map[string]any{"total_limit": 600, "max_active_users": 5},
+	}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create child manager, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	childID := decodeBodyMap(t, rr)["id"].(string)
+
+	for _, path := range []string{"/api/v1/managers/mgr-root/children", "/api/v1/managers?parent_id=mgr-root"} {
+		rr := fx.doJSON(t, http.MethodGet, path, nil, true)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 from %s, got %d", path, rr.Code)
+		}
+		children := decodeBodyMap(t, rr)["managers"].([]any)
+		if len(children) != 1 || children[0].(map[string]any)["id"] != childID {
+			t.Fatalf("expected only the child from %s, got %v", path, children)
+		}
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/managers", nil, true); decodeBodyMap(t, rr)["total"].(float64) != 2 {
+		t.Fatalf("expected 2 managers, got %s", rr.Body.String())
+	}
+
+	if rr := fx.doJSON(t, http.MethodPut, "/api/v1/managers/"+childID, map[string]any{"package": map[string]any{"total_limit": 1500}}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 raising child above parent, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPut, "/api/v1/managers/mgr-root", map[string]any{"package": map[string]any{"total_limit": 500}}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 lowering parent below child, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPut, "/api/v1/managers/mgr-root", map[string]any{"parent_id": childID}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a parent cycle, got %d", rr.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodPut, "/api/v1/managers/"+childID, map[string]any{
+		"name": "reseller-2", "package": map[string]any{"total_limit": 800, "status": "inactive"},
+	}, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 update manager, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	updated := decodeBodyMap(t, rr)
+	pkg = updated["package"].(map[string]any)
+	if updated["name"] != "reseller-2" || pkg["total_limit"].(float64) != 800 || pkg["max_active_users"].(float64) != 5 || pkg["status"] != "inactive" {
+		t.Fatalf("unexpected updated manager: %v", updated)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/managers/mgr-root/tree", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 manager tree, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	tree := decodeBodyMap(t, rr)
+	if children := tree["children"].([]any); len(children) != 1 || children[0].(map[string]any)["name"] != "reseller-2" {
+		t.Fatalf("unexpected manager tree: %v", tree)
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/managers/missing/tree", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 tree for unknown manager, got %d", rr.Code)
+	}
+
+	if rr := fx.doJSON(t, http.MethodDelete, "/api/v1/managers/mgr-root", nil, true); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deleting a manager with children, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodDelete, "/api/v1/managers/"+childID, nil, true); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 delete manager, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/managers/"+childID, nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rr.Code)
+	}
+	if pkg, err := fx.userDB.GetManagerPackage(childID); err != nil || pkg != nil {
+		t.Fatalf("expected manager package deleted, got %v err=%v", pkg, err)
+	}
+}
+
+func TestHTTPGroupCRUD(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/groups", map[string]any{"name": "team", "total_limit": -1}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a negative limit, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/groups", map[string]any{"name": "team", "penalty_action": "ban"}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown penalty action, got %d", rr.Code)
+	}
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/groups", map[string]any{
+		"name":           "team",
+		"total_limit":    1_000,
+		"max_concurrent": 2,
+		"allowed_nodes":  []string{"node-a"},
+	}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create group, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/groups", map[string]any{"name": "team"}, true); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate group, got %d", rr.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodPut, "/api/v1/groups/team", map[string]any{"max_concurrent": 4, "penalty_duration": 300, "penalty_action": "reject"}, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 update group, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	group := decodeBodyMap(t, rr)
+	if group["max_concurrent"].(float64) != 4 || group["total_limit"].(float64) != 1_000 {
+		t.Fatalf("expected only max_concurrent to change, got %+v", group)
+	}
+	if group["penalty_duration"].(float64) != 300 || group["penalty_action"] != "reject" {
+		t.Fatalf("expected the penalty policy to be stored, got %+v", group)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/groups", nil, true)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["total"].(float64) != 1 {
+		t.Fatalf("expected one group listed, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	if rr := fx.doJSON(t, http.MethodDelete, "/api/v1/groups/team", nil, true); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 delete group, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/groups/team", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rr.Code)
+	}
+}
+
+func TestHTTPUserDeviceRegistry(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	createUser := fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{"username": "phones", "password": "p@ss"}, true)
+	if createUser.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create user, got %d body=%s", createUser.Code, createUser.Body.String())
+	}
+	userID := decodeBodyMap(t, createUser)["id"].(string)
+
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/packages", map[string]any{"user_id": userID, "max_devices": -1}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for negative max_devices, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/users/missing/devices", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d", rr.Code)
+	}
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/users/"+userID+"/devices/phone-1/approve", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 approve device, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if device := decodeBodyMap(t, rr); device["status"] != "approved" || device["device_id"] != "phone-1" {
+		t.Fatalf("expected phone-1 approved, got %+v", device)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/users/"+userID+"/devices", nil, true)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["total"].(float64) != 1 {
+		t.Fatalf("expected one device listed, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	if rr := fx.doJSON(t, http.MethodDelete, "/api/v1/users/"+userID+"/devices/phone-1", nil, true); rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 remove device, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodDelete, "/api/v1/users/"+userID+"/devices/phone-1", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 removing a missing device, got %d", rr.Code)
+	}
+}
+
+func TestHTTPManagerTopUpWorkflow(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	parentID := "mgr-parent"
+	for _, m := range []*domain.Manager{
+		{ID: parentID, Name: "parent", Package: &domain.ManagerPackage{TotalLimit: 1000, MaxActiveUsers: 10, Status: domain.ManagerPackageStatusActive}},
+		{ID: "mgr-child", Name: "child", ParentID: &parentID, Package: &domain.ManagerPackage{TotalLimit: 400, MaxActiveUsers: 2, Status: domain.ManagerPackageStatusActive}},
+	} {
+		if err := fx.userDB.CreateManager(m); err != nil {
+			t.Fatalf("create manager: %v", err)
+		}
+	}
+
+	managerKey := func(managerID string) string {
+		rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": managerID, "scope": "manager", "manager_id": managerID}, true)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected 201 create manager key, got %d body=%s", rr.Code, rr.Body.String())
+		}
+		return decodeBodyMap(t, rr)["key"].(string)
+	}
+	childKey, parentKey := managerKey("mgr-child"), managerKey(parentID)
+
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": "x", "scope": "manager"}, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for manager key without manager_id, got %d", rr.Code)
+	}
+
+	do := func(method, path string, body any, key string) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		if body == nil {
+			payload = nil
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Hue-API-Key", key)
+		rr := httptest.NewRecorder()
+		fx.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodGet, "/api/v1/nodes", nil, childKey); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected manager key to be denied nodes, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/v1/managers/"+parentID+"/topups", map[string]any{"total_limit": 100}, childKey); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected child key to be denied requests for its parent, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/api/v1/managers/mgr-child/topups", map[string]any{"total_limit": -1}, childKey); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for negative top-up, got %d", rr.Code)
+	}
+
+	rr := do(http.MethodPost, "/api/v1/managers/mgr-child/topups", map[string]any{"total_limit": 300, "max_active_users": 3, "note": "campaign"}, childKey)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 request top-up, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	topUp := decodeBodyMap(t, rr)
+	topUpID := topUp["id"].(string)
+	if topUp["status"] != string(domain.TopUpStatusPending) || topUp["parent_id"] != parentID {
+		t.Fatalf("unexpected top-up: %v", topUp)
+	}
+
+	if rr := do(http.MethodPost, "/api/v1/topups/"+topUpID+"/approve", nil, childKey); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected child to be denied approving its own top-up, got %d", rr.Code)
+	}
+
+	rr = do(http.MethodGet, "/api/v1/managers/"+parentID+"/topups/incoming?status=pending", nil, parentKey)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 incoming top-ups, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if incoming := decodeBodyMap(t, rr)["topups"].([]any); len(incoming) != 1 {
+		t.Fatalf("expected 1 incoming top-up, got %d", len(incoming))
+	}
+
+	rr = do(http.MethodPost, "/api/v1/topups/"+topUpID+"/approve", map[string]any{"note": "ok"}, parentKey)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 approve, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if decided := decodeBodyMap(t, rr); decided["status"] != string(domain.TopUpStatusApproved) || decided["decision_note"] != "ok" {
+		t.Fatalf("unexpected approved top-up: %v", decided)
+	}
+
+	pkg, err := fx.userDB.GetManagerPackage("mgr-child")
+	if err != nil {
+		t.Fatalf("get child package: %v", err)
+	}
+	if pkg.TotalLimit != 700 || pkg.MaxActiveUsers != 5 {
+		t.Fatalf("expected raised limits 700/5, got %d/%d", pkg.TotalLimit, pkg.MaxActiveUsers)
+	}
+
+	if rr := do(http.MethodPost, "/api/v1/topups/"+topUpID+"/reject", nil, parentKey); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 deciding a decided top-up, got %d", rr.Code)
+	}
+
+	// Raising the child above its parent is refused and leaves the request pending
+	rr = do(http.MethodPost, "/api/v1/managers/mgr-child/topups", map[string]any{"total_limit": 500}, childKey)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 request top-up, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	bigID := decodeBodyMap(t, rr)["id"].(string)
+	if rr := do(http.MethodPost, "/api/v1/topups/"+bigID+"/approve", nil, parentKey); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 approving above parent limits, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if pkg, _ := fx.userDB.GetManagerPackage("mgr-child"); pkg.TotalLimit != 700 {
+		t.Fatalf("expected limits unchanged after refused approval, got %d", pkg.TotalLimit)
+	}
+
+	rr = do(http.MethodPost, "/api/v1/topups/"+bigID+"/reject", map[string]any{"note": "too much"}, parentKey)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["status"] != string(domain.TopUpStatusRejected) {
+		t.Fatalf("expected 200 reject, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	rr = do(http.MethodGet, "/api/v1/managers/mgr-child/topups", nil, childKey)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 own top-ups, got %d", rr.Code)
+	}
+	if own := decodeBodyMap(t, rr)["topups"].([]any); len(own) != 2 {
+		t.Fatalf("expected 2 top-ups in the audit trail, got %d", len(own))
+	}
+}
+
+func TestHTTPManagerKeySeesOnlyItsUsers(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	for _, id := range []string{"mgr-a", "mgr-b"} {
+		if err := fx.userDB.CreateManager(&domain.Manager{ID: id, Name: id, Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}}); err != nil {
+			t.Fatalf("create manager: %v", err)
+		}
+	}
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": "reseller", "scope": "manager", "manager_id": "mgr-a"}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create manager key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	key := decodeBodyMap(t, rr)["key"].(string)
+
+	do := func(method, path string, body any) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Hue-API-Key", key)
+		rec := httptest.NewRecorder()
+		fx.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/users", map[string]any{"username": "other", "password": "p", "manager_id": "mgr-b"}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create user, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	otherID := decodeBodyMap(t, rr)["id"].(string)
+
+	rr = do(http.MethodPost, "/api/v1/users", map[string]any{"username": "own", "password": "p"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected manager key to create users, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	own := decodeBodyMap(t, rr)
+	ownID := own["id"].(string)
+	if own["manager_id"] != "mgr-a" {
+		t.Fatalf("expected the user to belong to the key's manager, got %v", own["manager_id"])
+	}
+	if rr := do(http.MethodPost, "/api/v1/users", map[string]any{"username": "x", "password": "p", "manager_id": "mgr-b"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 creating a user for another manager, got %d", rr.Code)
+	}
+
+	rr = do(http.MethodGet, "/api/v1/users", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected manager key to list users, got %d", rr.Code)
+	}
+	if users := decodeBodyMap(t, rr)["users"].([]any); len(users) != 1 || users[0].(map[string]any)["id"] != ownID {
+		t.Fatalf("expected only the manager's own user, got %v", users)
+	}
+
+	if rr := do(http.MethodGet, "/api/v1/users/"+ownID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected manager key to get its user, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, "/api/v1/users/"+otherID, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another manager's user, got %d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, "/api/v1/users/"+otherID, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 deleting another manager's user, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPut, "/api/v1/users/"+ownID, map[string]any{"manager_id": "mgr-b"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 moving a user to another manager, got %d", rr.Code)
+	}
+
+	rr = do(http.MethodPost, "/api/v1/packages", map[string]any{"user_id": ownID, "total_traffic": 1000})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected manager key to create packages, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	pkgID := decodeBodyMap(t, rr)["id"].(string)
+	if rr := do(http.MethodPost, "/api/v1/packages", map[string]any{"user_id": otherID, "total_traffic": 1000}); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 creating a package for another manager's user, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, "/api/v1/packages/"+pkgID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected manager key to get its package, got %d", rr.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/packages", map[string]any{"user_id": otherID, "total_traffic": 1000}, true)
+	otherPkgID := decodeBodyMap(t, rr)["id"].(string)
+	if rr := do(http.MethodGet, "/api/v1/packages/"+otherPkgID, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another manager's package, got %d", rr.Code)
+	}
+	if rr := do(http.MethodGet, "/api/v1/users/"+ownID+"/sessions", nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected manager key to be denied sessions, got %d", rr.Code)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/users?manager_id=mgr-b", nil, true)
+	if users := decodeBodyMap(t, rr)["users"].([]any); len(users) != 1 || users[0].(map[string]any)["id"] != otherID {
+		t.Fatalf("expected the owner to filter users by manager, got %v", users)
+	}
+}
+
+func TestHTTPBillingGenerateAndExport(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	managerID := "mgr-reseller"
+	if err := fx.userDB.CreateManager(&domain.Manager{ID: managerID, Name: "reseller", Package: &domain.ManagerPackage{TotalLimit: 1000, MaxActiveUsers: 10, Status: domain.ManagerPackageStatusActive}}); err != nil {
+		t.Fatalf("create manager: %v", err)
+	}
+	for _, n := range []*domain.Node{
+		{ID: "node-basic", SecretKey: "a", Name: "basic", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset},
+		{ID: "node-premium", SecretKey: "b", Name: "premium", TrafficMultiplier: 2, ResetMode: domain.ResetModeNoReset},
+	} {
+		if err := fx.userDB.CreateNode(n); err != nil {
+			t.Fatalf("create node: %v", err)
+		}
+	}
+	for _, u := range []*domain.User{
+		{ID: "u-resold", Username: "resold", Password: "x", Status: domain.UserStatusActive, ManagerID: &managerID},
+		{ID: "u-direct", Username: "direct", Password: "x", Status: domain.UserStatusActive},
+	} {
+		if err := fx.userDB.CreateUser(u); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	now := time.Now()
+	for _, r := range []*domain.UsageReport{
+		{ID: "r1", UserID: "u-resold", NodeID: "node-basic", ServiceID: "svc", Upload: 500_000_000, Download: 500_000_000, Timestamp: now},
+		{ID: "r2", UserID: "u-resold", NodeID: "node-premium", ServiceID: "svc", Upload: 0, Download: 250_000_000, Timestamp: now},
+		{ID: "r3", UserID: "u-direct", NodeID: "node-basic", ServiceID: "svc", Upload: 0, Download: 2_000_000_000, Timestamp: now},
+		{ID: "r4", UserID: "u-direct", NodeID: "node-basic", ServiceID: "svc", Upload: 0, Download: 9_000_000_000, Timestamp: now.AddDate(0, -2, 0)},
+	} {
+		if err := fx.activeDB.BufferUsage(r); err != nil {
+			t.Fatalf("buffer usage: %v", err)
+		}
+	}
+
+	period := domain.BillingPeriod(now)
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/billing/generate?period="+period, nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 generate, got %d body=%s", rr.Code, rr.Body.String())
+	}
+
+	var body struct {
+		Records []domain.BillingRecord `json:"records"`
+	}
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/billing?period="+period, nil, true)
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode billing: %v", err)
+	}
+	if len(body.Records) != 3 {
+		t.Fatalf("expected 3 records, got %+v", body.Records)
+	}
+
+	amounts := map[string]float64{}
+	for _, r := range body.Records {
+		amounts[r.UserID+"/"+r.NodeGroup] = r.Amount
+	}
+	// Premium traffic is billed through the node's 2x multiplier at 4 per GB
+	want := map[string]float64{"u-resold/default": 1, "u-resold/premium": 2, "u-direct/default": 2}
+	for k, v := range want {
+		if math.Abs(amounts[k]-v) > 1e-9 {
+			t.Fatalf("expected %s amount %v, got %v (all: %v)", k, v, amounts[k], amounts)
+		}
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/billing?format=csv&manager_id="+managerID+"&period="+period, nil, true)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected CSV export, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "period" || rows[1][1] != managerID {
+		t.Fatalf("unexpected CSV rows: %v", rows)
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": "reseller", "scope": "manager", "manager_id": managerID}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create manager key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	key := decodeBodyMap(t, rr)["key"].(string)
+
+	get := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Hue-API-Key", key)
+		rr := httptest.NewRecorder()
+		fx.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := get("/api/v1/managers/" + managerID + "/billing"); code != http.StatusOK {
+		t.Fatalf("expected manager key to read its billing, got %d", code)
+	}
+	if code := get("/api/v1/managers/other/billing"); code != http.StatusForbidden {
+		t.Fatalf("expected manager key to be denied another manager's billing, got %d", code)
+	}
+	if code := get("/api/v1/billing"); code != http.StatusForbidden {
+		t.Fatalf("expected manager key to be denied the full billing export, got %d", code)
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/billing?period=2024-13", nil, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid period, got %d", rr.Code)
+	}
+}
+
+func TestHTTPManagerDigestSubscription(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	managerID := "mgr-digest"
+	if err := fx.userDB.CreateManager(&domain.Manager{ID: managerID, Name: "reseller", Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}}); err != nil {
+		t.Fatalf("create manager: %v", err)
+	}
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/admin/keys", map[string]any{"name": "reseller", "scope": "manager", "manager_id": managerID}, true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201 create manager key, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	key := decodeBodyMap(t, rr)["key"].(string)
+
+	do := func(method, path string, body any) *httptest.ResponseRecorder {
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Hue-API-Key", key)
+		rec := httptest.NewRecorder()
+		fx.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rr := do(http.MethodGet, "/api/v1/managers/"+managerID+"/digest", nil); rr.Code != http.StatusOK || decodeBodyMap(t, rr)["frequency"] != "off" {
+		t.Fatalf("expected digests off by default, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodPut, "/api/v1/managers/"+managerID+"/digest", map[string]any{"frequency": "hourly"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown frequency, got %d", rr.Code)
+	}
+	if rr := do(http.MethodPut, "/api/v1/managers/"+managerID+"/digest", map[string]any{"frequency": "weekly"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a webhook URL, got %d", rr.Code)
+	}
+
+	rr = do(http.MethodPut, "/api/v1/managers/"+managerID+"/digest", map[string]any{"frequency": "weekly", "webhook_url": "https://example.com/hook", "language": "fa"})
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["frequency"] != "weekly" {
+		t.Fatalf("expected weekly subscription saved, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do(http.MethodGet, "/api/v1/managers/"+managerID+"/digest/preview?frequency=weekly", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 preview, got %d %s", rr.Code, rr.Body.String())
+	}
+	preview := decodeBodyMap(t, rr)
+	if preview["key"] != string(domain.MessageManagerDigestWeekly) || preview["language"] != "fa" || preview["text"] == "" {
+		t.Fatalf("unexpected digest preview: %v", preview)
+	}
+
+	if rr := do(http.MethodGet, "/api/v1/managers/other/digest", nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected manager key to be denied another manager's digest, got %d", rr.Code)
+	}
+}
+
+func TestHTTPPanelCallbacksListAndReplay(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	userID, packageID := "user-panel", "pkg-panel"
+	for _, ev := range []*domain.Event{
+		{ID: "ev-1", Type: domain.EventUsageRecorded, UserID: &userID, Timestamp: time.Now()},
+		{ID: "ev-2", Type: domain.EventUserSuspended, UserID: &userID, PackageID: &packageID, Tags: []string{"quota_exceeded"}, Timestamp: time.Now()},
+		{ID: "ev-3", Type: domain.EventUserActivated, UserID: &userID, Timestamp: time.Now()},
+	} {
+		fx.panel.Enqueue(ev)
+	}
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/panel/callbacks", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 listing callbacks, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	var listed struct {
+		Callbacks []panelhook.Callback `json:"callbacks"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("decode callbacks: %v", err)
+	}
+	if len(listed.Callbacks) != 2 {
+		t.Fatalf("expected only status changes to be queued, got %+v", listed.Callbacks)
+	}
+	first := listed.Callbacks[0]
+	if first.Version != panelhook.Version || first.Status != panelhook.StatusSuspended || first.Reason != "quota_exceeded" || first.PackageID != packageID {
+		t.Fatalf("unexpected suspension callback %+v", first)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/panel/callbacks?after="+strconv.FormatInt(first.Sequence, 10), nil, true)
+	if body := decodeBodyMap(t, rr); body["total"] != float64(1) {
+		t.Fatalf("expected one callback after the first, got %v", body)
+	}
+
+	// Nothing was delivered yet, so there is nothing to replay
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/panel/callbacks/replay", map[string]any{"after": 0}, true)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["requeued"] != float64(0) {
+		t.Fatalf("expected no callbacks requeued, got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := fx.userDB.MarkPanelCallbackDelivered(first.Sequence, time.Now()); err != nil {
+		t.Fatalf("mark delivered: %v", err)
+	}
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/panel/callbacks/replay", map[string]any{"after": 0}, true)
+	if rr.Code != http.StatusOK || decodeBodyMap(t, rr)["requeued"] != float64(1) {
+		t.Fatalf("expected the delivered callback requeued, got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHTTPExportUsersAndUsage(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	for _, u := range []*domain.User{
+		{ID: "u1", Username: "alice", Password: "pw", Status: domain.UserStatusActive, Groups: []string{"gold", "eu"}},
+		{ID: "u2", Username: "bob", Password: "pw", Status: domain.UserStatusSuspended},
+	} {
+		if err := fx.userDB.CreateUser(u); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, userID := range []string{"u1", "u1", "u2"} {
+		traffic := domain.UsageTraffic{RawUpload: 10, RawDownload: 20, BilledUpload: 10, BilledDownload: 20}
+		if err := fx.historyDB.StoreUsageHistory(userID, "p1", "n1", "s1", traffic, "", &domain.GeoData{Country: "DE"}, []string{"a", "b"}, base.Add(time.Duration(i)*time.Hour)); err != nil {
+			t.Fatalf("store usage history: %v", err)
+		}
+	}
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/export/usage?format=csv&user_id=u1", nil, true)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("expected CSV usage export, got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse CSV: %v", err)
+	}
+	if len(rows) != 3 || rows[0][0] != "timestamp" || rows[1][0] != "2026-03-01T12:00:00Z" || rows[1][1] != "u1" || rows[2][14] != "a;b" {
+		t.Fatalf("unexpected usage CSV rows: %v", rows)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/export/usage?from="+base.Add(30*time.Minute).Format(time.RFC3339), nil, true)
+	var usage []map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &usage); err != nil {
+		t.Fatalf("decode usage export: %v body=%s", err, rr.Body.String())
+	}
+	if len(usage) != 2 || usage[0]["user_id"] != "u1" || usage[1]["user_id"] != "u2" {
+		t.Fatalf("unexpected usage export: %v", usage)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/export/users?status=active", nil, true)
+	var users []map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &users); err != nil {
+		t.Fatalf("decode user export: %v body=%s", err, rr.Body.String())
+	}
+	if len(users) != 1 || users[0]["username"] != "alice" || users[0]["password"] != nil {
+		t.Fatalf("unexpected user export: %v", users)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/export/users?format=csv&search=nobody", nil, true)
+	if rows, err := csv.NewReader(rr.Body).ReadAll(); err != nil || len(rows) != 1 || rows[0][0] != "id" {
+		t.Fatalf("expected only the header for an empty export, got %v err=%v", rows, err)
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/export/users?format=xml", nil, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown format, got %d", rr.Code)
+	}
+}
+
+func TestHTTPTopUsersAndNodes(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	if err := fx.userDB.CreateUser(&domain.User{ID: "u1", Username: "alice", Password: "pw", Status: domain.UserStatusActive}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if err := fx.userDB.CreateNode(&domain.Node{ID: "n1", SecretKey: "node-key", Name: "frankfurt", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	for _, userID := range []string{"u1", "u1", "gone"} {
+		traffic := domain.UsageTraffic{RawUpload: 10, RawDownload: 20, BilledUpload: 10, BilledDownload: 20}
+		if err := fx.historyDB.StoreUsageHistory(userID, "p1", "n1", "s1", traffic, "", &domain.GeoData{}, nil, time.Now()); err != nil {
+			t.Fatalf("store usage history: %v", err)
+		}
+	}
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/stats/top/users?limit=5", nil, true)
+	top, _ := decodeBodyMap(t, rr)["top"].([]any)
+	if rr.Code != http.StatusOK || len(top) != 2 {
+		t.Fatalf("expected two users, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if first := top[0].(map[string]any); first["id"] != "u1" || first["name"] != "alice" || first["total"] != float64(60) {
+		t.Fatalf("expected alice first with her username, got %v", first)
+	}
+	if second := top[1].(map[string]any); second["id"] != "gone" || second["name"] != nil {
+		t.Fatalf("expected a deleted user without a name, got %v", second)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/stats/top/nodes", nil, true)
+	top, _ = decodeBodyMap(t, rr)["top"].([]any)
+	if len(top) != 1 || top[0].(map[string]any)["name"] != "frankfurt" || top[0].(map[string]any)["reports"] != float64(3) {
+		t.Fatalf("expected frankfurt with three reports, got %s", rr.Body.String())
+	}
+
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/stats/top/users?limit=0", nil, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a zero limit, got %d", rr.Code)
+	}
+}
+
+func TestHTTPUsageRollups(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	now := time.Now()
+	for _, userID := range []string{"u1", "u1", "u2"} {
+		traffic := domain.UsageTraffic{RawUpload: 10, RawDownload: 20, BilledUpload: 10, BilledDownload: 20}
+		if err := fx.historyDB.StoreUsageHistory(userID, "p1", "n1", "s1", traffic, "", &domain.GeoData{}, nil, now); err != nil {
+			t.Fatalf("store usage history: %v", err)
+		}
+	}
+
+	rr := fx.doJSON(t, http.MethodGet, "/api/v1/stats/usage?granularity=hour&user_id=u1", nil, true)
+	body := decodeBodyMap(t, rr)
+	usage, _ := body["usage"].([]any)
+	if rr.Code != http.StatusOK || body["granularity"] != "hour" || len(usage) != 1 {
+		t.Fatalf("expected one hourly bucket, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if bucket := usage[0].(map[string]any); bucket["period"] != now.Format("2006-01-02 15:00") || bucket["total"] != float64(60) || bucket["reports"] != float64(2) {
+		t.Fatalf("unexpected bucket %v", bucket)
+	}
+
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/stats/usage", nil, true)
+	if usage, _ := decodeBodyMap(t, rr)["usage"].([]any); len(usage) != 1 || usage[0].(map[string]any)["reports"] != float64(3) {
+		t.Fatalf("expected one daily bucket with every report, got %s", rr.Body.String())
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/stats/usage?granularity=week", nil, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown granularity, got %d", rr.Code)
+	}
+}
+
+func TestHTTPImportHiddifyBackup(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	backup := json.RawMessage(`{"users": [
+		{"uuid": "6b0c1e3e-8a4e-4b43-9b1c-1f3f4c1d2e01", "name": "alice", "usage_limit_GB": 10, "current_usage_GB": 1, "package_days": 30, "mode": "monthly", "enable": true}
+	]}`)
+
+	rr := fx.doJSON(t, http.MethodPost, "/api/v1/import?source=hiddify&dry_run=true", backup, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected dry run to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if body := decodeBodyMap(t, rr); body["imported"] != float64(1) || body["dry_run"] != true {
+		t.Fatalf("unexpected dry run response %v", body)
+	}
+	if user, _ := fx.userDB.GetUserByUsername("alice"); user != nil {
+		t.Fatal("expected dry run not to create the user")
+	}
+
+	rr = fx.doJSON(t, http.MethodPost, "/api/v1/import?source=hiddify", backup, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected import to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	user, err := fx.userDB.GetUser("6b0c1e3e-8a4e-4b43-9b1c-1f3f4c1d2e01")
+	if err != nil || user == nil || user.ActivePackageID == nil {
+		t.Fatalf("expected alice to be imported with a package: %+v %v", user, err)
+	}
+
+	if rr := fx.doJSON(t, http.MethodPost, "/api/v1/import?source=xui", backup, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown source to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestHTTPEventsPaginationAndFilters(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	userID := "user-events"
+	for i := 0; i < 5; i++ {
+		event := &domain.Event{ID: fmt.Sprintf("ev-%d", i), Type: domain.EventUserConnected, UserID: &userID, Timestamp: base.Add(time.Duration(i) * time.Minute)}
+		if i == 4 {
+			event.Type = domain.EventUserDisconnected
+			event.Metadata = domain.SessionDisconnected{SessionID: "s1"}.Metadata()
+		}
+		if err := fx.historyDB.StoreEvent(event); err != nil {
+			t.Fatalf("store event: %v", err)
+		}
+	}
+	// Same timestamp as ev-2, so the cursor must break ties
+	if err := fx.historyDB.StoreEvent(&domain.Event{ID: "ev-tie", Type: domain.EventUserConnected, UserID: &userID, Timestamp: base.Add(2 * time.Minute)}); err != nil {
+		t.Fatalf("store event: %v", err)
+	}
+
+	var ids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("pagination did not end")
+		}
+		rr := fx.doJSON(t, http.MethodGet, "/api/v1/events?type=user_connected&limit=2&cursor="+cursor, nil, true)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 list events, got %d body=%s", rr.Code, rr.Body.String())
+		}
+		page := decodeBodyMap(t, rr)
+		for _, ev := range page["events"].([]any) {
+			ids = append(ids, ev.(map[string]any)["id"].(string))
+		}
+		next, _ := page["next_cursor"].(string)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if got := strings.Join(ids, ","); got != "ev-3,ev-tie,ev-2,ev-1,ev-0" {
+		t.Fatalf("expected every connected event once, newest first, got %s", got)
+	}
+
+	rr := fx.doJSON(t, http.MethodGet, fmt.Sprintf("/api/v1/events?user_id=%s&from=%s&to=%d", userID, base.Add(time.Minute).Format(time.RFC3339), base.Add(3*time.Minute).Unix()), nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 list events, got %d body=%s", rr.Code, rr.Body.String())
+	}
+	if events := decodeBodyMap(t, rr)["events"].([]any); len(events) != 4 {
+		t.Fatalf("expected 4 events between minutes 1 and 3, got %d", len(events))
+	}
+
+	// Metadata is served as JSON, not as an encoded blob
+	rr = fx.doJSON(t, http.MethodGet, "/api/v1/events?type=user_disconnected", nil, true)
+	events := decodeBodyMap(t, rr)["events"].([]any)
+	if len(events) != 1 {
+		t.Fatalf("expected one disconnect event, got %d", len(events))
+	}
+	if metadata, ok := events[0].(map[string]any)["metadata"].(map[string]any); !ok || metadata["session_id"] != "s1" {
+		t.Fatalf("expected structured metadata, got %v", events[0].(map[string]any)["metadata"])
+	}
+
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/events?cursor=bogus", nil, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid cursor, got %d", rr.Code)
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/events?from=yesterday", nil, true); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid from, got %d", rr.Code)
+	}
+}
+
+func TestHTTPEventsReplay(t *testing.T) {
+	fx := newHTTPFixture(t)
+
+	userID := "user-replay"
+	for i, eventType := range []domain.EventType{domain.EventUserConnected, domain.EventUsageRecorded, domain.EventUsageRecorded} {
+		event := &domain.Event{ID: fmt.Sprintf("ev-%d", i), Type: eventType, UserID: &userID, Timestamp: time.Now()}
+		if err := fx.historyDB.StoreEvent(event); err != nil {
+			t.Fatalf("store event: %v", err)
+		}
+	}
+
+	replay := func(query string) []string {
+		t.Helper()
+		rr := fx.doJSON(t, http.MethodGet, "/api/v1/events/replay"+query, nil, true)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200 replay, got %d body=%s", rr.Code, rr.Body.String())
+		}
+		var events []domain.Event
+		if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+			t.Fatalf("decode replay: %v body=%s", err, rr.Body.String())
+		}
+		ids := []string{}
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	if got := strings.Join(replay(""), ","); got != "ev-0,ev-1,ev-2" {
+		t.Fatalf("expected every event oldest first, got %s", got)
+	}
+	if got := strings.Join(replay("?types=usage_recorded&after=ev-1"), ","); got != "ev-2" {
+		t.Fatalf("expected the usage event after ev-1, got %s", got)
+	}
+	if got := replay("?user_id=nobody"); len(got) != 0 {
+		t.Fatalf("expected an empty replay, got %v", got)
+	}
+	if rr := fx.doJSON(t, http.MethodGet, "/api/v1/events/replay?after=missing", nil, true); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after an unknown event, got %d", rr.Code)
+	}
+}
+
+func TestHTTPEventsWebSocketStreamsFilteredEvents(t *testing.T) {
+	fx := newHTTPFixture(t)
+	srv := httptest.NewServer(fx.router)
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/events/ws"
+	if _, err := websocket.Dial(wsURL, "", srv.URL); err == nil {
+		t.Fatalf("expected the stream to require an API key")
+	}
+
+	ws, err := websocket.Dial(wsURL+"?types=user_connected,USER_USAGE_FINISHED&api_key="+fx.secret, "", srv.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// The subscription starts after the handshake, so publish until it lands
+	userID := "u1"
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			fx.hub.Publish(&domain.Event{ID: "e1", Type: domain.EventUsageRecorded, UserID: &userID, Timestamp: time.Now()})
+			fx.hub.Publish(&domain.Event{ID: "e2", Type: domain.EventUserConnected, UserID: &userID, Timestamp: time.Now()})
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	_ = ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event domain.Event
+	if err := websocket.JSON.Receive(ws, &event); err != nil {
+		t.Fatalf("receive event: %v", err)
+	}
+	if event.ID != "e2" || event.Type != domain.EventUserConnected || event.UserID == nil || *event.UserID != userID {
+		t.Fatalf("expected only the USER_CONNECTED event, got %+v", event)
+	}
+}
+
+func TestHTTPEventsSSEResumesAfterLastEventID(t *testing.T) {
+	fx := newHTTPFixture(t)
+	srv := httptest.NewServer(fx.router)
+	defer srv.Close()
+
+	userID := "u1"
+	var stored []*domain.Event
+	for i, eventType := range []domain.EventType{domain.EventUserConnected, domain.EventUsageRecorded} {
+		event := &domain.Event{ID: fmt.Sprintf("ev-%d", i), Type: eventType, UserID: &userID, Timestamp: time.Now()}
+		if err := fx.historyDB.StoreEvent(event); err != nil {
+			t.Fatalf("store event: %v", err)
+		}
+		stored = append(stored, event)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/events/stream?api_key="+fx.secret, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", "ev-0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	next := func() (id, eventType string, event domain.Event) {
+		t.Helper()
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read stream: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && id != "":
+				return id, eventType, event
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+					t.Fatalf("decode data %q: %v", line, err)
+				}
+			}
+		}
+	}
+
+	if id, eventType, event := next(); id != "ev-1" || eventType != string(domain.EventUsageRecorded) || event.ID != "ev-1" {
+		t.Fatalf("expected the missed ev-1 first, got id=%s event=%s %+v", id, eventType, event)
+	}
+
+	// A live copy of a replayed event is skipped; the live event after it follows
+	replayed := &domain.Event{ID: "ev-1", Type: domain.EventUsageRecorded, UserID: &userID, Timestamp: time.Now(), Seq: stored[1].Seq}
+	fx.hub.Publish(replayed)
+	fx.hub.Publish(&domain.Event{ID: "ev-2", Type: domain.EventUserDisconnected, UserID: &userID, Timestamp: time.Now()})
+	if id, eventType, _ := next(); id != "ev-2" || eventType != string(domain.EventUserDisconnected) {
+		t.Fatalf("expected the live ev-2, got id=%s event=%s", id, eventType)
+	}
+}
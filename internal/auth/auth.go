@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
@@ -17,11 +18,15 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// Scope is a set of permissions carried by an access token
 type Scope uint32
 
 const (
+	// ScopeFull grants everything the owner key may do
 	ScopeFull Scope = 1 << iota
+	// ScopeServiceUpdate grants reading and changing services
 	ScopeServiceUpdate
+	// ScopeReadOnly grants every read
 	ScopeReadOnly
 )
 
@@ -45,18 +50,56 @@ type OwnerAPIKey struct {
 // Authenticator handles authentication for gRPC and HTTP
 type Authenticator struct {
 	secret         string
-	allowedNodeIPs []*net.IPNet
+	allowedNodeIPs atomic.Pointer[[]*net.IPNet] // Changes on config reload
 	tlsConfig      *tls.Config
+
+	// Node and usage RPCs need a client certificate signed by the client CA
+	requireClientCert bool
 }
 
 // NewAuthenticator creates a new Authenticator instance
 func NewAuthenticator(secret, tlsCertPath, tlsKeyPath string, allowedNodeIPs []string) (*Authenticator, error) {
 	auth := &Authenticator{
-		secret:         secret,
-		allowedNodeIPs: make([]*net.IPNet, 0),
+		secret: secret,
+	}
+	if err := auth.SetAllowedNodeIPs(allowedNodeIPs); err != nil {
+		return nil, err
+	}
+
+	// Load TLS config if provided
+	if tlsCertPath != "" && tlsKeyPath != "" {
+		tlsConfig, err := LoadTLSConfig(tlsCertPath, tlsKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS config: %w", err)
+		}
+		auth.tlsConfig = tlsConfig
 	}
 
-	// Parse allowed IP CIDRs
+	return auth, nil
+}
+
+// SetAllowedNodeIPs replaces the IPs and CIDRs gRPC clients may connect
+// from; an empty list allows every address. On an invalid entry the current
+// list is kept.
+func (a *Authenticator) SetAllowedNodeIPs(allowedNodeIPs []string) error {
+	nets, err := ParseAllowedNodeIPs(allowedNodeIPs)
+	if err != nil {
+		return err
+	}
+	a.SetAllowedNodeNets(nets)
+	return nil
+}
+
+// SetAllowedNodeNets replaces the networks gRPC clients may connect from
+// with ones parsed by ParseAllowedNodeIPs
+func (a *Authenticator) SetAllowedNodeNets(nets []*net.IPNet) {
+	a.allowedNodeIPs.Store(&nets)
+}
+
+// ParseAllowedNodeIPs parses IPs and CIDRs; a single IP becomes a /32 or
+// /128 network
+func ParseAllowedNodeIPs(allowedNodeIPs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(allowedNodeIPs))
 	for _, cidr := range allowedNodeIPs {
 		_, ipNet, err := net.ParseCIDR(cidr)
 		if err != nil {
@@ -72,23 +115,60 @@ func NewAuthenticator(secret, tlsCertPath, tlsKeyPath string, allowedNodeIPs []s
 				_, ipNet, _ = net.ParseCIDR(ip.String() + "/128")
 			}
 		}
-		auth.allowedNodeIPs = append(auth.allowedNodeIPs, ipNet)
+		nets = append(nets, ipNet)
 	}
+	return nets, nil
+}
 
-	// Load TLS config if provided
-	if tlsCertPath != "" && tlsKeyPath != "" {
-		tlsConfig, err := loadTLSConfig(tlsCertPath, tlsKeyPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load TLS config: %w", err)
-		}
-		auth.tlsConfig = tlsConfig
+// SetClientCA makes node agents authenticate with a client certificate
+// signed by the CAs in caPath. NodeService and UsageService calls without one
+// are rejected; other clients may still connect without a certificate. Call
+// it before the TLS config is handed to a server.
+func (a *Authenticator) SetClientCA(caPath string) error {
+	if a.tlsConfig == nil {
+		return fmt.Errorf("client certificates need TLS")
+	}
+	pool, err := LoadCACerts(caPath)
+	if err != nil {
+		return fmt.Errorf("failed to load client CA: %w", err)
 	}
+	a.tlsConfig.ClientCAs = pool
+	a.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	a.requireClientCert = true
+	return nil
+}
 
-	return auth, nil
+// RequiresClientCert reports whether node agents need a client certificate
+func (a *Authenticator) RequiresClientCert() bool {
+	return a.requireClientCert
 }
 
-// loadTLSConfig loads TLS certificate and key
-func loadTLSConfig(certPath, keyPath string) (*tls.Config, error) {
+// ClientCertificate returns the verified client certificate of a gRPC
+// call, or nil when the caller sent none
+func ClientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return info.State.VerifiedChains[0][0]
+}
+
+// CertificateNames returns the common name and DNS names of a certificate,
+// the names a node identifies itself by
+func CertificateNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, 1+len(cert.DNSNames))
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return append(names, cert.DNSNames...)
+}
+
+// LoadTLSConfig loads TLS certificate and key
+func LoadTLSConfig(certPath, keyPath string) (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
 	if err != nil {
 		return nil, err
@@ -107,7 +187,8 @@ func (a *Authenticator) ValidateSecret(providedSecret string) bool {
 
 // IsIPAllowed checks if an IP is in the allowed list
 func (a *Authenticator) IsIPAllowed(ipStr string) bool {
-	if len(a.allowedNodeIPs) == 0 {
+	allowed := *a.allowedNodeIPs.Load()
+	if len(allowed) == 0 {
 		return true // No restrictions
 	}
 
@@ -116,7 +197,7 @@ func (a *Authenticator) IsIPAllowed(ipStr string) bool {
 		return false
 	}
 
-	for _, ipNet := range a.allowedNodeIPs {
+	for _, ipNet := range allowed {
 		if ipNet.Contains(ip) {
 			return true
 		}
@@ -131,6 +212,10 @@ func (a *Authenticator) GetClientIP(ctx context.Context) string {
 	if !ok {
 		return ""
 	}
+	// Unix socket peers have no address and are on this host
+	if p.Addr.Network() == "unix" {
+		return "127.0.0.1"
+	}
 
 	addr := p.Addr.String()
 	host, _, err := net.SplitHostPort(addr)
@@ -158,13 +243,16 @@ func (a *Authenticator) GRPCServerOptions() []grpc.ServerOption {
 		opts = append(opts, grpc.Creds(credentials.NewTLS(a.tlsConfig)))
 	}
 
-	// Add auth interceptor
-	unaryInterceptor := grpc.UnaryInterceptor(a.unaryAuthInterceptor)
-	streamInterceptor := grpc.StreamInterceptor(a.streamAuthInterceptor)
-
-	opts = append(opts, unaryInterceptor, streamInterceptor)
+	return append(opts, a.GRPCInterceptors()...)
+}
 
-	return opts
+// GRPCInterceptors returns the authentication interceptors without TLS
+// credentials, for a gRPC server behind a listener that terminates TLS itself
+func (a *Authenticator) GRPCInterceptors() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(a.unaryAuthInterceptor),
+		grpc.StreamInterceptor(a.streamAuthInterceptor),
+	}
 }
 
 // unaryAuthInterceptor is a gRPC unary interceptor for authentication
@@ -185,6 +273,9 @@ func (a *Authenticator) unaryAuthInterceptor(
 		if !a.IsIPAllowed(clientIP) {
 			return nil, status.Errorf(codes.PermissionDenied, "IP %s not allowed", clientIP)
 		}
+		if a.requireClientCert && ClientCertificate(ctx) == nil {
+			return nil, status.Error(codes.Unauthenticated, "client certificate required")
+		}
 	}
 
 	return handler(ctx, req)
@@ -208,6 +299,9 @@ func (a *Authenticator) streamAuthInterceptor(
 		if !a.IsIPAllowed(clientIP) {
 			return status.Errorf(codes.PermissionDenied, "IP %s not allowed", clientIP)
 		}
+		if a.requireClientCert && ClientCertificate(ss.Context()) == nil {
+			return status.Error(codes.Unauthenticated, "client certificate required")
+		}
 	}
 
 	return handler(srv, ss)
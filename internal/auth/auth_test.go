@@ -2,8 +2,11 @@ package auth
 
 import (
 	"context"
+	"crypto/x509"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"google.golang.org/grpc/peer"
 )
@@ -49,3 +52,86 @@ func TestAuthenticatorRejectsInvalidCIDR(t *testing.T) {
 		t.Fatalf("expected invalid CIDR/IP to return error")
 	}
 }
+
+func TestEnsureSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := dir+"/tls/cert.pem", dir+"/tls/key.pem"
+
+	fingerprint, err := EnsureSelfSignedCert(certPath, keyPath, []string{"localhost", "127.0.0.1", "hue.example.com"})
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if len(fingerprint) != 64 {
+		t.Fatalf("expected a SHA-256 fingerprint, got %q", fingerprint)
+	}
+	cfg, err := LoadTLSConfig(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load generated pair: %v", err)
+	}
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := cert.VerifyHostname("hue.example.com"); err != nil {
+		t.Fatalf("expected the certificate to cover the host: %v", err)
+	}
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Fatalf("expected the certificate to cover the IP: %v", err)
+	}
+
+	if again, err := EnsureSelfSignedCert(certPath, keyPath, nil); err != nil || again != "" {
+		t.Fatalf("expected existing files to be kept, got %q (%v)", again, err)
+	}
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatalf("remove key: %v", err)
+	}
+	if _, err := EnsureSelfSignedCert(certPath, keyPath, nil); err == nil {
+		t.Fatal("expected a certificate without its key to be rejected")
+	}
+}
+
+func TestTokenIssuerScopesAndExpiry(t *testing.T) {
+	issuer, err := NewTokenIssuer("signing-key", time.Hour)
+	if err != nil {
+		t.Fatalf("new issuer: %v", err)
+	}
+	token, claims, err := issuer.Issue("alice", ScopeReadOnly|ScopeServiceUpdate, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("issue: %v", err)
+	}
+	if !IsToken(token) {
+		t.Fatalf("expected %q to look like a token", token)
+	}
+	if claims.ExpiresAt-claims.IssuedAt != int64(time.Hour/time.Second) {
+		t.Fatalf("expected ttl to be capped to an hour, got %ds", claims.ExpiresAt-claims.IssuedAt)
+	}
+
+	parsed, err := issuer.Parse(token)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	scope := parsed.Scope()
+	if parsed.Subject != "alice" || !scope.Has(ScopeReadOnly) || !scope.Has(ScopeServiceUpdate) || scope.Has(ScopeFull) {
+		t.Fatalf("unexpected claims %+v", parsed)
+	}
+	if !Scope(ScopeFull).Has(ScopeServiceUpdate) {
+		t.Fatal("expected full scope to grant every scope")
+	}
+
+	if _, err := issuer.Parse(token[:len(token)-2] + "xx"); err != ErrInvalidToken {
+		t.Fatalf("expected tampered token to be rejected, got %v", err)
+	}
+	other, _ := NewTokenIssuer("", time.Hour)
+	if _, err := other.Parse(token); err != ErrInvalidToken {
+		t.Fatalf("expected token of another key to be rejected, got %v", err)
+	}
+	expired, _ := NewTokenIssuer("signing-key", -time.Second)
+	stale, _, _ := expired.Issue("alice", ScopeFull, 0)
+	if _, err := issuer.Parse(stale); err != ErrInvalidToken {
+		t.Fatalf("expected expired token to be rejected, got %v", err)
+	}
+
+	if _, err := ParseScopes([]string{"read-only", "admin"}); err == nil {
+		t.Fatal("expected unknown scope to be rejected")
+	}
+}
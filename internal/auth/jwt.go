@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scopeNames are the names scopes have in tokens and token requests
+var scopeNames = []struct {
+	scope Scope
+	name  string
+}{
+	{ScopeFull, "full"},
+	{ScopeServiceUpdate, "service-update"},
+	{ScopeReadOnly, "read-only"},
+}
+
+// ParseScopes combines scope names into a Scope
+func ParseScopes(names []string) (Scope, error) {
+	var scope Scope
+	for _, name := range names {
+		found := false
+		for _, s := range scopeNames {
+			if s.name == name {
+				scope |= s.scope
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown scope %q, expected full, service-update or read-only", name)
+		}
+	}
+	return scope, nil
+}
+
+// Names returns the names of the scopes in s
+func (s Scope) Names() []string {
+	names := []string{}
+	for _, n := range scopeNames {
+		if s&n.scope != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+// Has reports whether s grants every scope in other. Full grants all.
+func (s Scope) Has(other Scope) bool {
+	return s&ScopeFull != 0 || s&other == other
+}
+
+// ErrInvalidToken is returned for tokens that are malformed, badly signed
+// or expired
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the contents of an access token
+type Claims struct {
+	ID        string   `json:"jti"`
+	Subject   string   `json:"sub"`
+	Scopes    []string `json:"scopes"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// Scope returns the scopes the token grants
+func (c *Claims) Scope() Scope {
+	scope, _ := ParseScopes(c.Scopes)
+	return scope
+}
+
+// tokenHeader is the JOSE header of every token, base64url encoded
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// TokenIssuer issues and validates HS256 JWT access tokens
+type TokenIssuer struct {
+	key    []byte
+	maxTTL time.Duration
+}
+
+// NewTokenIssuer creates a TokenIssuer signing with key. Tokens live at most
+// maxTTL. An empty key is replaced by a random one, so tokens stop working
+// when the process restarts.
+func NewTokenIssuer(key string, maxTTL time.Duration) (*TokenIssuer, error) {
+	raw := []byte(key)
+	if len(raw) == 0 {
+		raw = make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+	}
+	return &TokenIssuer{key: raw, maxTTL: maxTTL}, nil
+}
+
+// MaxTTL returns the longest lifetime of an issued token
+func (t *TokenIssuer) MaxTTL() time.Duration {
+	return t.maxTTL
+}
+
+// Issue signs a token for subject granting scope. A ttl of zero or above
+// the maximum is capped to the maximum.
+func (t *TokenIssuer) Issue(subject string, scope Scope, ttl time.Duration) (string, *Claims, error) {
+	if ttl <= 0 || ttl > t.maxTTL {
+		ttl = t.maxTTL
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	claims := &Claims{
+		ID:        hex.EncodeToString(id),
+		Subject:   subject,
+		Scopes:    scope.Names(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + t.sign(signed), claims, nil
+}
+
+// Parse validates a token's signature and expiry and returns its claims
+func (t *TokenIssuer) Parse(token string) (*Claims, error) {
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != tokenHeader {
+		return nil, ErrInvalidToken
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.sign(header+"."+payload))) {
+		return nil, ErrInvalidToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidToken
+	}
+	return &claims, nil
+}
+
+func (t *TokenIssuer) sign(signed string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IsToken reports whether a credential is shaped like a JWT rather than an
+// API key
+func IsToken(credential string) bool {
+	return strings.HasPrefix(credential, "eyJ") && strings.Count(credential, ".") == 2
+}
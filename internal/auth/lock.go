@@ -1,145 +1,116 @@
 package auth
 
 import (
-	"sync"
+	"github.com/hiddify/hue-go/internal/keylock"
 )
 
-// LockManager provides fine-grained locking for users, nodes, and services
+// LockManager provides fine-grained locking for users, nodes, and services.
+// Locks are reclaimed once nobody holds or waits for them.
 type LockManager struct {
-	userLocks    sync.Map // map[string]*sync.RWMutex
-	nodeLocks    sync.Map // map[string]*sync.RWMutex
-	serviceLocks sync.Map // map[string]*sync.RWMutex
+	userLocks    *keylock.Pool
+	nodeLocks    *keylock.Pool
+	serviceLocks *keylock.Pool
 }
 
 // NewLockManager creates a new LockManager instance
 func NewLockManager() *LockManager {
-	return &LockManager{}
+	return &LockManager{
+		userLocks:    keylock.New(),
+		nodeLocks:    keylock.New(),
+		serviceLocks: keylock.New(),
+	}
 }
 
 // User Locks
 
-// GetUserLock gets or creates a lock for a user
-func (lm *LockManager) GetUserLock(userID string) *sync.RWMutex {
-	if v, ok := lm.userLocks.Load(userID); ok {
-		return v.(*sync.RWMutex)
-	}
-
-	lock := &sync.RWMutex{}
-	actual, _ := lm.userLocks.LoadOrStore(userID, lock)
-	return actual.(*sync.RWMutex)
-}
-
 // LockUser locks a user exclusively
 func (lm *LockManager) LockUser(userID string) {
-	lm.GetUserLock(userID).Lock()
+	lm.userLocks.Lock(userID)
 }
 
 // UnlockUser unlocks a user
 func (lm *LockManager) UnlockUser(userID string) {
-	lm.GetUserLock(userID).Unlock()
+	lm.userLocks.Unlock(userID)
 }
 
 // RLockUser locks a user for reading
 func (lm *LockManager) RLockUser(userID string) {
-	lm.GetUserLock(userID).RLock()
+	lm.userLocks.RLock(userID)
 }
 
 // RUnlockUser unlocks a user for reading
 func (lm *LockManager) RUnlockUser(userID string) {
-	lm.GetUserLock(userID).RUnlock()
+	lm.userLocks.RUnlock(userID)
 }
 
 // Node Locks
 
-// GetNodeLock gets or creates a lock for a node
-func (lm *LockManager) GetNodeLock(nodeID string) *sync.RWMutex {
-	if v, ok := lm.nodeLocks.Load(nodeID); ok {
-		return v.(*sync.RWMutex)
-	}
-
-	lock := &sync.RWMutex{}
-	actual, _ := lm.nodeLocks.LoadOrStore(nodeID, lock)
-	return actual.(*sync.RWMutex)
-}
-
 // LockNode locks a node exclusively
 func (lm *LockManager) LockNode(nodeID string) {
-	lm.GetNodeLock(nodeID).Lock()
+	lm.nodeLocks.Lock(nodeID)
 }
 
 // UnlockNode unlocks a node
 func (lm *LockManager) UnlockNode(nodeID string) {
-	lm.GetNodeLock(nodeID).Unlock()
+	lm.nodeLocks.Unlock(nodeID)
 }
 
 // RLockNode locks a node for reading
 func (lm *LockManager) RLockNode(nodeID string) {
-	lm.GetNodeLock(nodeID).RLock()
+	lm.nodeLocks.RLock(nodeID)
 }
 
 // RUnlockNode unlocks a node for reading
 func (lm *LockManager) RUnlockNode(nodeID string) {
-	lm.GetNodeLock(nodeID).RUnlock()
+	lm.nodeLocks.RUnlock(nodeID)
 }
 
 // Service Locks
 
-// GetServiceLock gets or creates a lock for a service
-func (lm *LockManager) GetServiceLock(serviceID string) *sync.RWMutex {
-	if v, ok := lm.serviceLocks.Load(serviceID); ok {
-		return v.(*sync.RWMutex)
-	}
-
-	lock := &sync.RWMutex{}
-	actual, _ := lm.serviceLocks.LoadOrStore(serviceID, lock)
-	return actual.(*sync.RWMutex)
-}
-
 // LockService locks a service exclusively
 func (lm *LockManager) LockService(serviceID string) {
-	lm.GetServiceLock(serviceID).Lock()
+	lm.serviceLocks.Lock(serviceID)
 }
 
 // UnlockService unlocks a service
 func (lm *LockManager) UnlockService(serviceID string) {
-	lm.GetServiceLock(serviceID).Unlock()
+	lm.serviceLocks.Unlock(serviceID)
 }
 
 // RLockService locks a service for reading
 func (lm *LockManager) RLockService(serviceID string) {
-	lm.GetServiceLock(serviceID).RLock()
+	lm.serviceLocks.RLock(serviceID)
 }
 
 // RUnlockService unlocks a service for reading
 func (lm *LockManager) RUnlockService(serviceID string) {
-	lm.GetServiceLock(serviceID).RUnlock()
+	lm.serviceLocks.RUnlock(serviceID)
 }
 
 // ScopedLock provides RAII-style locking
 type ScopedLock struct {
-	lock   *sync.RWMutex
+	locks  *keylock.Pool
+	userID string
 	write  bool
 }
 
 // NewScopedReadLock creates a scoped read lock
 func (lm *LockManager) NewScopedReadLock(userID string) *ScopedLock {
-	lock := lm.GetUserLock(userID)
-	lock.RLock()
-	return &ScopedLock{lock: lock, write: false}
+	lm.userLocks.RLock(userID)
+	return &ScopedLock{locks: lm.userLocks, userID: userID, write: false}
 }
 
 // NewScopedWriteLock creates a scoped write lock
 func (lm *LockManager) NewScopedWriteLock(userID string) *ScopedLock {
-	lock := lm.GetUserLock(userID)
-	lock.Lock()
-	return &ScopedLock{lock: lock, write: true}
+	lm.userLocks.Lock(userID)
+	return &ScopedLock{locks: lm.userLocks, userID: userID, write: true}
 }
 
 // Release releases the lock
 func (sl *ScopedLock) Release() {
 	if sl.write {
-		sl.lock.Unlock()
+		sl.locks.Unlock(sl.userID)
 	} else {
-		sl.lock.RUnlock()
+		sl.locks.RUnlock(sl.userID)
 	}
 }
@@ -2,25 +2,18 @@ package auth
 
 import "testing"
 
-func TestLockManagerReturnsStableLocks(t *testing.T) {
+func TestLockManagerReclaimsReleasedLocks(t *testing.T) {
 	lm := NewLockManager()
 
-	userLock1 := lm.GetUserLock("u1")
-	userLock2 := lm.GetUserLock("u1")
-	if userLock1 != userLock2 {
-		t.Fatalf("expected same user lock instance for same key")
-	}
-
-	nodeLock1 := lm.GetNodeLock("n1")
-	nodeLock2 := lm.GetNodeLock("n1")
-	if nodeLock1 != nodeLock2 {
-		t.Fatalf("expected same node lock instance for same key")
-	}
+	lm.LockUser("u1")
+	lm.UnlockUser("u1")
+	lm.RLockNode("n1")
+	lm.RUnlockNode("n1")
+	lm.LockService("s1")
+	lm.UnlockService("s1")
 
-	svcLock1 := lm.GetServiceLock("s1")
-	svcLock2 := lm.GetServiceLock("s1")
-	if svcLock1 != svcLock2 {
-		t.Fatalf("expected same service lock instance for same key")
+	if n := lm.userLocks.Len() + lm.nodeLocks.Len() + lm.serviceLocks.Len(); n != 0 {
+		t.Fatalf("expected released locks to be reclaimed, %d left", n)
 	}
 }
 
@@ -32,4 +25,8 @@ func TestScopedLocksRelease(t *testing.T) {
 
 	w := lm.NewScopedWriteLock("u1")
 	w.Release()
+
+	if n := lm.userLocks.Len(); n != 0 {
+		t.Fatalf("expected scoped locks to be reclaimed, %d left", n)
+	}
 }
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,58 +22,398 @@ type Config struct {
 	LogLevel    string `koanf:"log_level"`
 	LogFile     string `koanf:"log_file"`
 
+	// Listeners: gRPC and the REST API share Port unless HTTPPort or
+	// HTTPListen gives the REST API its own. The listen settings take a
+	// host:port or unix:/path and win over the ports.
+	HTTPPort   string `koanf:"http_port"`
+	GRPCListen string `koanf:"grpc_listen"`
+	HTTPListen string `koanf:"http_listen"`
+
+	// SQLite tuning; zero keeps SQLite's default
+	DBBusyTimeout time.Duration `koanf:"db_busy_timeout"`
+	DBSynchronous string        `koanf:"db_synchronous"`
+	DBCacheSize   int           `koanf:"db_cache_size"`
+	DBMmapSize    int64         `koanf:"db_mmap_size"`
+	DBReadConns   int           `koanf:"db_read_conns"` // 0 = reads share the writer
+
 	// Performance & Quota Engine
-	ReportInterval      time.Duration `koanf:"report_interval"`
-	DBFlushInterval     time.Duration `koanf:"db_flush_interval"`
-	DisconnectBatchSize int           `koanf:"disconnect_batch_size"`
-	UsageDataRetention  time.Duration `koanf:"usage_data_retention"`
-	HistDataRetention   time.Duration `koanf:"hist_data_retention"`
+	ReportInterval       time.Duration `koanf:"report_interval"`
+	DBFlushInterval      time.Duration `koanf:"db_flush_interval"`
+	DisconnectBatchSize  int           `koanf:"disconnect_batch_size"`
+	DisconnectAckTimeout time.Duration `koanf:"disconnect_ack_timeout"`
+	UsageDataRetention   time.Duration `koanf:"usage_data_retention"`
+	HistDataRetention    time.Duration `koanf:"hist_data_retention"`
+	StatsCacheTTL        time.Duration `koanf:"stats_cache_ttl"`
+	NegativeCacheTTL     time.Duration `koanf:"negative_cache_ttl"`
+	CacheWarmup          bool          `koanf:"cache_warmup"`
+	CacheWarmupLimit     int           `koanf:"cache_warmup_limit"` // 0 = every active user
+	CacheTTL             time.Duration `koanf:"cache_ttl"`          // 0 = cached users never expire
+	CacheMaxEntries      int           `koanf:"cache_max_entries"`  // 0 = unbounded
+	ReservationTTL       time.Duration `koanf:"reservation_ttl"`
+	BackfillAfter        time.Duration `koanf:"backfill_after"`
+	ReportDedupWindow    time.Duration `koanf:"report_dedup_window"`
+	// Keep charged traffic in memory and write it every DBFlushInterval
+	UsageWriteBehind bool `koanf:"usage_write_behind"`
 
 	// Concurrent & Penalty Logic
 	ConcurrentWindow time.Duration `koanf:"concurrent_window"`
 	PenaltyDuration  time.Duration `koanf:"penalty_duration"`
+	// Escalating durations for repeat penalties within PenaltyWindow, e.g.
+	// 1m,10m,1h; empty keeps every penalty at PenaltyDuration
+	PenaltySteps  []string      `koanf:"penalty_steps"`
+	PenaltyWindow time.Duration `koanf:"penalty_window"`
+	RoamingWindow time.Duration `koanf:"roaming_window"`
+	RoamingAction string        `koanf:"roaming_action"`
+
+	// Managers over their limits: soft, default or hard
+	ManagerEnforcementMode string `koanf:"manager_enforcement_mode"`
+
+	// Reports from devices past a package's max_devices: reject or penalize
+	DeviceLimitAction string `koanf:"device_limit_action"`
+
+	// Session identity: session, subnet or device. Group overrides are
+	// "group=strategy" entries.
+	SessionIdentity       string   `koanf:"session_identity"`
+	SessionIdentityGroups []string `koanf:"session_identity_groups"`
+
+	// Stale session replacement: off or same_ip. A session counts as stale
+	// once it has not reported for SessionReplaceAfter.
+	SessionReplace      string        `koanf:"session_replace"`
+	SessionReplaceAfter time.Duration `koanf:"session_replace_after"`
+
+	// Throughput estimation: session rates go stale after SpeedStaleAfter
+	// without reports. Users above SpeedAlertBps (bits per second) for
+	// SpeedAlertDuration are flagged; 0 disables the alert.
+	SpeedStaleAfter    time.Duration `koanf:"speed_stale_after"`
+	SpeedAlertBps      int64         `koanf:"speed_alert_bps"`
+	SpeedAlertDuration time.Duration `koanf:"speed_alert_duration"`
+
+	// Reject usage reports that name no service. Reports authenticated with
+	// a service key always get that service.
+	RequireReportSource bool `koanf:"require_report_source"`
+
+	// Unknown users in reports: reject, queue or provision. Queued reports
+	// are dropped after UnknownUserQueueTTL and at most UnknownUserQueueMax
+	// are held; provision posts the user to UnknownUserHookURL and retries,
+	// waiting UnknownUserRetryAfter after a failed attempt for that user.
+	UnknownUserAction     string        `koanf:"unknown_user_action"`
+	UnknownUserQueueTTL   time.Duration `koanf:"unknown_user_queue_ttl"`
+	UnknownUserQueueMax   int           `koanf:"unknown_user_queue_max"`
+	UnknownUserHookURL    string        `koanf:"unknown_user_hook_url"`
+	UnknownUserRetryAfter time.Duration `koanf:"unknown_user_retry_after"`
+
+	// Node Load. A node counts as online for health scores while its last
+	// heartbeat is younger than NodeHeartbeatTimeout.
+	NodeMaxCPUPercent    float64       `koanf:"node_max_cpu_percent"`
+	NodeMaxConnections   int64         `koanf:"node_max_connections"`
+	NodeMaxBandwidth     int64         `koanf:"node_max_bandwidth"`
+	NodeHeartbeatTimeout time.Duration `koanf:"node_heartbeat_timeout"`
+
+	// Billing: rates are "group=price_per_gb" entries and node groups are
+	// "node_id_or_name=group" entries. Nodes without a group bill as
+	// "default".
+	BillingRates      []string `koanf:"billing_rates"`
+	BillingNodeGroups []string `koanf:"billing_node_groups"`
+	BillingCurrency   string   `koanf:"billing_currency"`
 
 	// Geo-IP & Privacy
-	MaxMindDBPath string `koanf:"maxmind_db_path"`
+	MaxMindDBPath    string `koanf:"maxmind_db_path"`
+	MaxMindASNDBPath string `koanf:"maxmind_asn_db_path"`
+
+	// Report tagging: "tag=field:values" rules applied before storage.
+	// Hour rules are evaluated in TagRuleTimezone, the server's local time
+	// when empty.
+	TagRules        []string `koanf:"tag_rules"`
+	TagRuleTimezone string   `koanf:"tag_rule_timezone"`
 
-	// Security
+	// Security. With TLSSinglePort the shared port terminates TLS itself and
+	// serves gRPC and HTTPS side by side; otherwise TLS is for gRPC only.
 	AuthSecret     string   `koanf:"auth_secret"`
 	TLSCertPath    string   `koanf:"tls_cert"`
 	TLSKeyPath     string   `koanf:"tls_key"`
+	TLSSinglePort  bool     `koanf:"tls_single_port"`
 	AllowedNodeIPs []string `koanf:"allowed_node_ips"`
 
+	// Access tokens are signed with JWTSecret, a random key per process when
+	// empty, and live at most JWTMaxTTL
+	JWTSecret string        `koanf:"jwt_secret"`
+	JWTMaxTTL time.Duration `koanf:"jwt_max_ttl"`
+
+	// Node agents present a client certificate signed by TLSClientCA whose
+	// common name or a DNS name is their node's ID or name
+	TLSClientCA string `koanf:"tls_client_ca"`
+
+	// HTTPS for the REST API's own listener, with HTTPTLSCertPath or else
+	// TLSCertPath. With TLSSelfSigned, missing certificate files are
+	// generated on start for TLSSelfSignedHosts.
+	HTTPTLSCertPath    string   `koanf:"http_tls_cert"`
+	HTTPTLSKeyPath     string   `koanf:"http_tls_key"`
+	TLSSelfSigned      bool     `koanf:"tls_self_signed"`
+	TLSSelfSignedHosts []string `koanf:"tls_self_signed_hosts"`
+
+	// Reverse proxy deployment: the REST API is also served on HTTPSocket
+	// when set. X-Forwarded-For and X-Real-IP are only believed from
+	// TrustedProxies; socket connections count as coming from 127.0.0.1.
+	HTTPSocket     string   `koanf:"http_socket"`
+	TrustedProxies []string `koanf:"trusted_proxies"`
+
 	// Event Sourcing
 	EventStoreType string `koanf:"event_store_type"`
 
-	// HTTP Port (derived)
-	HTTPPort string
+	// Hot state cache: "memory" keeps it per process, "redis" shares
+	// sessions, penalties and the disconnect queue between instances
+	CacheBackend string `koanf:"cache_backend"`
+	RedisURL     string `koanf:"redis_url"`
+	RedisPrefix  string `koanf:"redis_prefix"`
+
+	// Hiddify panel sync: status callbacks are posted to PanelWebhookURL,
+	// signed with PanelWebhookSecret. An empty URL disables them.
+	PanelWebhookURL    string `koanf:"panel_webhook_url"`
+	PanelWebhookSecret string `koanf:"panel_webhook_secret"`
+
+	// Event webhooks: events are posted to EventWebhookURLs and to their
+	// service's callback_url, signed with EventWebhookSecret. An empty
+	// secret disables them. EventWebhookTypes limits the dispatched types.
+	EventWebhookURLs        []string      `koanf:"event_webhook_urls"`
+	EventWebhookSecret      string        `koanf:"event_webhook_secret"`
+	EventWebhookTypes       []string      `koanf:"event_webhook_types"`
+	EventWebhookMaxAttempts int           `koanf:"event_webhook_max_attempts"`
+	EventWebhookBackoff     time.Duration `koanf:"event_webhook_backoff"`
+
+	// OpenTelemetry tracing: spans are exported over OTLP/HTTP to
+	// OTelEndpoint. An empty endpoint disables tracing.
+	OTelEndpoint    string  `koanf:"otel_endpoint"`
+	OTelServiceName string  `koanf:"otel_service_name"`
+	OTelSampleRatio float64 `koanf:"otel_sample_ratio"`
 }
 
 // defaults returns default configuration values
 func defaults() Config {
 	return Config{
-		DatabaseURL:         "sqlite://./hue.db",
-		Port:                "50051",
-		HTTPPort:            "50052",
-		LogLevel:            "info",
-		LogFile:             "",
-		ReportInterval:      60 * time.Second,
-		DBFlushInterval:     5 * time.Minute,
-		DisconnectBatchSize: 50,
-		UsageDataRetention:  30 * 24 * time.Hour,
-		HistDataRetention:   365 * 24 * time.Hour,
-		ConcurrentWindow:    5 * time.Minute,
-		PenaltyDuration:     10 * time.Minute,
-		MaxMindDBPath:       "",
-		AuthSecret:          "",
-		TLSCertPath:         "",
-		TLSKeyPath:          "",
-		AllowedNodeIPs:      []string{},
-		EventStoreType:      "db",
+		DatabaseURL:             "sqlite://./hue.db",
+		Port:                    "50051",
+		LogLevel:                "info",
+		LogFile:                 "",
+		DBBusyTimeout:           5 * time.Second,
+		DBSynchronous:           "NORMAL",
+		DBReadConns:             4,
+		ReportInterval:          60 * time.Second,
+		DBFlushInterval:         5 * time.Minute,
+		DisconnectBatchSize:     50,
+		DisconnectAckTimeout:    30 * time.Second,
+		UsageDataRetention:      30 * 24 * time.Hour,
+		HistDataRetention:       365 * 24 * time.Hour,
+		StatsCacheTTL:           10 * time.Second,
+		NegativeCacheTTL:        15 * time.Second,
+		CacheWarmup:             true,
+		CacheWarmupLimit:        10000,
+		CacheTTL:                15 * time.Minute,
+		CacheMaxEntries:         100000,
+		ReservationTTL:          10 * time.Minute,
+		BackfillAfter:           15 * time.Minute,
+		ReportDedupWindow:       10 * time.Minute,
+		ConcurrentWindow:        5 * time.Minute,
+		PenaltyDuration:         10 * time.Minute,
+		PenaltyWindow:           24 * time.Hour,
+		RoamingWindow:           10 * time.Minute,
+		RoamingAction:           "flag",
+		DeviceLimitAction:       "reject",
+		ManagerEnforcementMode:  "default",
+		SessionIdentity:         "session",
+		SessionReplace:          "off",
+		SessionReplaceAfter:     30 * time.Second,
+		SpeedStaleAfter:         2 * time.Minute,
+		SpeedAlertBps:           0,
+		SpeedAlertDuration:      10 * time.Minute,
+		UnknownUserAction:       "reject",
+		UnknownUserQueueTTL:     time.Hour,
+		UnknownUserQueueMax:     10000,
+		UnknownUserRetryAfter:   time.Minute,
+		NodeMaxCPUPercent:       90,
+		NodeMaxConnections:      0,
+		NodeMaxBandwidth:        0,
+		NodeHeartbeatTimeout:    2 * time.Minute,
+		BillingCurrency:         "USD",
+		MaxMindDBPath:           "",
+		AuthSecret:              "",
+		TLSCertPath:             "",
+		TLSKeyPath:              "",
+		AllowedNodeIPs:          []string{},
+		TLSSelfSignedHosts:      []string{"localhost", "127.0.0.1", "::1"},
+		JWTMaxTTL:               time.Hour,
+		TrustedProxies:          []string{"127.0.0.1", "::1"},
+		EventStoreType:          "db",
+		CacheBackend:            "memory",
+		RedisURL:                "redis://127.0.0.1:6379/0",
+		RedisPrefix:             "hue:",
+		EventWebhookURLs:        []string{},
+		EventWebhookTypes:       []string{},
+		EventWebhookMaxAttempts: 5,
+		EventWebhookBackoff:     time.Second,
+		OTelServiceName:         "hue",
+		OTelSampleRatio:         1,
 	}
 }
 
-// Load reads configuration from environment variables and optional config file
+// GRPCAddr returns the address gRPC listens on, shared with the REST API
+// when HTTPAddr is empty
+func (c *Config) GRPCAddr() string {
+	if c.GRPCListen != "" {
+		return c.GRPCListen
+	}
+	return ":" + c.Port
+}
+
+// HTTPAddr returns the address the REST API listens on by itself, or empty
+// when it shares the gRPC listener
+func (c *Config) HTTPAddr() string {
+	if c.HTTPListen != "" {
+		return c.HTTPListen
+	}
+	if c.HTTPPort != "" {
+		return ":" + c.HTTPPort
+	}
+	return ""
+}
+
+// SessionIdentityGroupMap parses SessionIdentityGroups into a group → strategy
+// map, skipping malformed entries
+func (c *Config) SessionIdentityGroupMap() map[string]string {
+	groups := make(map[string]string, len(c.SessionIdentityGroups))
+	for _, entry := range c.SessionIdentityGroups {
+		group, identity, ok := strings.Cut(entry, "=")
+		group = strings.TrimSpace(group)
+		identity = strings.TrimSpace(identity)
+		if !ok || group == "" || identity == "" {
+			continue
+		}
+		groups[group] = identity
+	}
+	return groups
+}
+
+// PenaltyStepDurations parses PenaltySteps
+func (c *Config) PenaltyStepDurations() ([]time.Duration, error) {
+	steps := make([]time.Duration, 0, len(c.PenaltySteps))
+	for _, entry := range c.PenaltySteps {
+		step, err := time.ParseDuration(strings.TrimSpace(entry))
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid penalty step %q, expected a positive duration", entry)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// BillingNodeGroupMap parses BillingNodeGroups into a node → group map,
+// skipping malformed entries
+func (c *Config) BillingNodeGroupMap() map[string]string {
+	return parsePairs(c.BillingNodeGroups)
+}
+
+// BillingRateMap parses BillingRates into a group → price per GB map,
+// skipping malformed entries
+func (c *Config) BillingRateMap() map[string]float64 {
+	rates := make(map[string]float64, len(c.BillingRates))
+	for group, value := range parsePairs(c.BillingRates) {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			continue
+		}
+		rates[group] = rate
+	}
+	return rates
+}
+
+// parsePairs parses "key=value" entries, skipping malformed ones
+func parsePairs(entries []string) map[string]string {
+	pairs := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			continue
+		}
+		pairs[key] = value
+	}
+	return pairs
+}
+
+// listKeys returns the koanf keys of the list settings
+func listKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if tag := field.Tag.Get("koanf"); tag != "" && field.Type.Kind() == reflect.Slice {
+			keys[tag] = true
+		}
+	}
+	return keys
+}
+
+// splitList splits a comma separated setting, dropping empty entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Diff returns the keys of the settings that differ between old and new
+func Diff(old, new *Config) []string {
+	var keys []string
+	a, b := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("koanf")
+		if tag == "" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			keys = append(keys, tag)
+		}
+	}
+	return keys
+}
+
+// readEnvFile reads the HUE_ settings of an env file of KEY=VALUE lines.
+// Blank lines, comments and an "export " prefix are allowed, and values may
+// be quoted.
+func readEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n+1)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if strings.HasPrefix(key, "HUE_") {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// Load reads configuration from environment variables and optional config
+// file. Settings in the env file named by HUE_ENV_FILE override both, so
+// editing it and sending SIGHUP changes the reloadable settings.
 func Load() (*Config, error) {
 	k := koanf.New(".")
 
@@ -88,23 +431,40 @@ func Load() (*Config, error) {
 	// We use "." as the koanf delimiter here so that underscores in the key
 	// name are preserved as-is (e.g. HUE_AUTH_SECRET → auth_secret, not
 	// split into a nested path auth.secret).
-	if err := k.Load(env.Provider("HUE_", ".", func(s string) string {
-		return strings.ToLower(strings.TrimPrefix(s, "HUE_"))
+	// List settings are comma separated, e.g. HUE_TRUSTED_PROXIES=a,b.
+	lists := listKeys()
+	if err := k.Load(env.ProviderWithValue("HUE_", ".", func(key, value string) (string, interface{}) {
+		key = strings.ToLower(strings.TrimPrefix(key, "HUE_"))
+		if lists[key] {
+			return key, splitList(value)
+		}
+		return key, value
 	}), nil); err != nil {
 		return nil, err
 	}
 
+	if path := os.Getenv("HUE_ENV_FILE"); path != "" {
+		values, err := readEnvFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env file: %w", err)
+		}
+		for name, value := range values {
+			key := strings.ToLower(strings.TrimPrefix(name, "HUE_"))
+			if lists[key] {
+				err = k.Set(key, splitList(value))
+			} else {
+				err = k.Set(key, value)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// Unmarshal into config struct
 	if err := k.Unmarshal("", &cfg); err != nil {
 		return nil, err
 	}
 
-	// Set HTTP port (gRPC port + 1 if not explicitly set)
-	cfg.HTTPPort = "50052"
-	if cfg.Port != "50051" {
-		// If custom gRPC port, calculate HTTP port
-		cfg.HTTPPort = "50052"
-	}
-
 	return &cfg, nil
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"testing"
 	"time"
 )
@@ -14,8 +15,8 @@ func TestLoadConfigDefaults(t *testing.T) {
 	if cfg.Port != "50051" {
 		t.Fatalf("unexpected default port: %s", cfg.Port)
 	}
-	if cfg.HTTPPort != "50052" {
-		t.Fatalf("unexpected default http port: %s", cfg.HTTPPort)
+	if cfg.GRPCAddr() != ":50051" || cfg.HTTPAddr() != "" {
+		t.Fatalf("expected gRPC and HTTP to share :50051, got %q and %q", cfg.GRPCAddr(), cfg.HTTPAddr())
 	}
 	if cfg.DBFlushInterval != 5*time.Minute {
 		t.Fatalf("unexpected default flush interval: %v", cfg.DBFlushInterval)
@@ -29,6 +30,11 @@ func TestLoadConfigEnvOverride(t *testing.T) {
 	t.Setenv("HUE_DB_FLUSH_INTERVAL", "30s")
 	t.Setenv("HUE_CONCURRENT_WINDOW", "90s")
 	t.Setenv("HUE_ALLOWED_NODE_IPS", "10.0.0.0/8,127.0.0.1")
+	t.Setenv("HUE_TRUSTED_PROXIES", "10.0.0.1,192.168.0.0/16")
+	t.Setenv("HUE_HTTP_SOCKET", "/run/hue/http.sock")
+	t.Setenv("HUE_PENALTY_STEPS", "1m, 10m,1h")
+	t.Setenv("HUE_HTTP_PORT", "60052")
+	t.Setenv("HUE_GRPC_LISTEN", "127.0.0.1:60051")
 
 	cfg, err := Load()
 	if err != nil {
@@ -50,4 +56,58 @@ func TestLoadConfigEnvOverride(t *testing.T) {
 	if cfg.ConcurrentWindow != 90*time.Second {
 		t.Fatalf("expected concurrent window override, got %v", cfg.ConcurrentWindow)
 	}
+	if len(cfg.AllowedNodeIPs) != 2 || cfg.AllowedNodeIPs[0] != "10.0.0.0/8" {
+		t.Fatalf("expected the node IP list to be split on commas, got %v", cfg.AllowedNodeIPs)
+	}
+	if len(cfg.TrustedProxies) != 2 || cfg.TrustedProxies[1] != "192.168.0.0/16" {
+		t.Fatalf("expected trusted proxies override, got %v", cfg.TrustedProxies)
+	}
+	if cfg.GRPCAddr() != "127.0.0.1:60051" || cfg.HTTPAddr() != ":60052" {
+		t.Fatalf("expected separate listeners, got %q and %q", cfg.GRPCAddr(), cfg.HTTPAddr())
+	}
+	if cfg.HTTPSocket != "/run/hue/http.sock" {
+		t.Fatalf("expected http socket override, got %q", cfg.HTTPSocket)
+	}
+	steps, err := cfg.PenaltyStepDurations()
+	if err != nil || len(steps) != 3 || steps[0] != time.Minute || steps[2] != time.Hour {
+		t.Fatalf("expected penalty steps 1m,10m,1h, got %v (%v)", steps, err)
+	}
+
+	cfg.PenaltySteps = []string{"10m", "soon"}
+	if _, err := cfg.PenaltyStepDurations(); err == nil {
+		t.Fatalf("expected an invalid penalty step to be rejected")
+	}
+}
+
+func TestLoadConfigEnvFileAndDiff(t *testing.T) {
+	path := t.TempDir() + "/hue.env"
+	env := "# reloadable\nHUE_PENALTY_DURATION=20m\nexport HUE_ALLOWED_NODE_IPS=\"10.0.0.0/8, 10.1.0.0/16\"\n\nOTHER=ignored\n"
+	if err := os.WriteFile(path, []byte(env), 0o600); err != nil {
+		t.Fatalf("write env file: %v", err)
+	}
+	t.Setenv("HUE_ENV_FILE", path)
+	t.Setenv("HUE_PENALTY_DURATION", "5m")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.PenaltyDuration != 20*time.Minute {
+		t.Fatalf("expected the env file to win over the environment, got %v", cfg.PenaltyDuration)
+	}
+	if len(cfg.AllowedNodeIPs) != 2 || cfg.AllowedNodeIPs[1] != "10.1.0.0/16" {
+		t.Fatalf("expected a quoted list from the env file, got %v", cfg.AllowedNodeIPs)
+	}
+
+	old := defaults()
+	if keys := Diff(&old, cfg); len(keys) != 2 || keys[0] != "penalty_duration" || keys[1] != "allowed_node_ips" {
+		t.Fatalf("expected penalty_duration and allowed_node_ips to differ, got %v", keys)
+	}
+
+	if err := os.WriteFile(path, []byte("HUE_LOG_LEVEL\n"), 0o600); err != nil {
+		t.Fatalf("write env file: %v", err)
+	}
+	if _, err := Load(); err == nil {
+		t.Fatal("expected a malformed env file to be rejected")
+	}
 }
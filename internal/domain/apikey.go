@@ -0,0 +1,70 @@
+package domain
+
+import (
+	"time"
+)
+
+// KeyScope limits what a scoped API key may call
+type KeyScope string
+
+const (
+	// KeyScopeMonitor grants read access to health, metrics, stats and events
+	KeyScopeMonitor KeyScope = "monitor"
+	// KeyScopeManager acts for one manager: it may request quota top-ups for
+	// that manager and decide those of its direct children
+	KeyScopeManager KeyScope = "manager"
+)
+
+// IsValid reports whether the scope is known
+func (s KeyScope) IsValid() bool {
+	return s == KeyScopeMonitor || s == KeyScopeManager
+}
+
+// APIKey is a named API key with a limited scope. Only the key's hash is
+// stored; the raw key is shown once when the key is created.
+type APIKey struct {
+	ID        string    `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Scope     KeyScope  `json:"scope" db:"scope"`
+	ManagerID *string   `json:"manager_id,omitempty" db:"manager_id"` // Set for manager-scoped keys
+	Revoked   bool      `json:"revoked" db:"revoked"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// APIKeyCreate represents the input for creating a scoped API key
+type APIKeyCreate struct {
+	Name      string   `json:"name" validate:"required"`
+	Scope     KeyScope `json:"scope"`
+	ManagerID *string  `json:"manager_id,omitempty"` // Required for the manager scope
+}
+
+// AuthKeyKind tells the owner key from a service key
+type AuthKeyKind string
+
+const (
+	AuthKeyKindOwner   AuthKeyKind = "owner"
+	AuthKeyKindService AuthKeyKind = "service"
+)
+
+// AuthKey describes the owner key or a service's key. Only hashes are
+// stored; a new key is shown once when it is created or rotated.
+type AuthKey struct {
+	Kind       AuthKeyKind `json:"kind"`
+	ServiceID  string      `json:"service_id,omitempty"`
+	Revoked    bool        `json:"revoked"`
+	ExpiresAt  *time.Time  `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time  `json:"last_used_at,omitempty"`
+	// PreviousExpiresAt is when the key replaced by the last rotation stops
+	// working
+	PreviousExpiresAt *time.Time `json:"previous_expires_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// AuthKeyIssue represents the input for creating or rotating the owner key
+// or a service key
+type AuthKeyIssue struct {
+	ExpiresInSeconds int64 `json:"expires_in_seconds,omitempty"` // 0 never expires
+	OverlapSeconds   int64 `json:"overlap_seconds,omitempty"`    // How long a rotated key keeps working
+}
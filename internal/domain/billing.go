@@ -0,0 +1,82 @@
+package domain
+
+import (
+	"fmt"
+	"time"
+)
+
+// bytesPerGB is the unit billing rates are quoted in
+const bytesPerGB = 1_000_000_000
+
+// DefaultNodeGroup is the billing group of nodes that are not assigned one,
+// and the rate applied to groups without their own rate
+const DefaultNodeGroup = "default"
+
+// BillingRates prices billed traffic per node group
+type BillingRates struct {
+	// NodeGroups maps a node ID or name to its billing group
+	NodeGroups map[string]string
+	// Rates maps a group to its price per GB (10^9 billed bytes)
+	Rates    map[string]float64
+	Currency string
+}
+
+// GroupFor returns the billing group of a node, matching its ID first and
+// then its name
+func (r BillingRates) GroupFor(node *Node) string {
+	if node != nil {
+		if group, ok := r.NodeGroups[node.ID]; ok {
+			return group
+		}
+		if group, ok := r.NodeGroups[node.Name]; ok {
+			return group
+		}
+	}
+	return DefaultNodeGroup
+}
+
+// RateFor returns the price per GB of a group, falling back to the default
+// group's rate
+func (r BillingRates) RateFor(group string) float64 {
+	if rate, ok := r.Rates[group]; ok {
+		return rate
+	}
+	return r.Rates[DefaultNodeGroup]
+}
+
+// Amount prices billed bytes at a rate per GB
+func (r BillingRates) Amount(bytes int64, rate float64) float64 {
+	return float64(bytes) / bytesPerGB * rate
+}
+
+// BillingRecord is one user's billed traffic through one node group in a
+// billing period
+type BillingRecord struct {
+	ID        string    `json:"id" db:"id"`
+	Period    string    `json:"period" db:"period"` // YYYY-MM
+	ManagerID *string   `json:"manager_id,omitempty" db:"manager_id"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	Username  string    `json:"username" db:"username"`
+	NodeGroup string    `json:"node_group" db:"node_group"`
+	Upload    int64     `json:"upload" db:"upload"`     // Billed bytes
+	Download  int64     `json:"download" db:"download"` // Billed bytes
+	Total     int64     `json:"total" db:"total"`
+	Rate      float64   `json:"rate" db:"rate"` // Price per GB
+	Amount    float64   `json:"amount" db:"amount"`
+	Currency  string    `json:"currency" db:"currency"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// BillingPeriod formats the month containing t as a billing period
+func BillingPeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// ParseBillingPeriod returns the UTC bounds [start, end) of a YYYY-MM period
+func ParseBillingPeriod(period string) (start, end time.Time, err error) {
+	start, err = time.Parse("2006-01", period)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid billing period %q, want YYYY-MM", period)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
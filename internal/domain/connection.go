@@ -0,0 +1,29 @@
+package domain
+
+// ConnectionRequest is a client connecting to a service, with the
+// credentials of one of the service's auth methods
+type ConnectionRequest struct {
+	NodeID    string
+	ServiceID string
+	SessionID string
+	ClientIP  string
+	Method    AuthMethod
+	UserID    string // uuid
+	Username  string // password
+	Password  string // password
+	PublicKey string // pubkey
+}
+
+// ConnectionDecision answers a ConnectionRequest with the limits the node
+// should apply to an allowed connection
+type ConnectionDecision struct {
+	Allowed        bool
+	UserID         string
+	PackageID      string
+	Reason         string
+	ReasonCode     ReasonCode
+	MaxConcurrent  int
+	MaxIPs         int
+	ActiveSessions int
+	RateLimit      int64 // Bytes/sec to throttle to, 0 when not throttled
+}
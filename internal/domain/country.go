@@ -0,0 +1,45 @@
+package domain
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// CountryPermits returns true if the allow and deny lists permit the country
+// in geo. Entries match the ISO code or the English name, case-insensitively;
+// a denied country wins over an allowed one. Reports whose country is unknown
+// are not restricted.
+func CountryPermits(allowed, denied []string, geo *GeoData) bool {
+	if geo == nil || (geo.Country == "" && geo.CountryCode == "") {
+		return true
+	}
+	if countryListed(denied, geo) {
+		return false
+	}
+	return len(allowed) == 0 || countryListed(allowed, geo)
+}
+
+func countryListed(list []string, geo *GeoData) bool {
+	for _, entry := range list {
+		if (geo.CountryCode != "" && strings.EqualFold(entry, geo.CountryCode)) ||
+			(geo.Country != "" && strings.EqualFold(entry, geo.Country)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountryRejection is the metadata of a COUNTRY_REJECTED event
+type CountryRejection struct {
+	Country     string `json:"country,omitempty"`
+	CountryCode string `json:"country_code,omitempty"`
+	// Rule is the list that rejected the report: "user", "package" or
+	// "group:<name>"
+	Rule string `json:"rule"`
+}
+
+// Metadata encodes the rejection as event metadata
+func (r CountryRejection) Metadata() []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
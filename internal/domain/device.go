@@ -0,0 +1,51 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DeviceStatus is the state of a device in a user's device registry
+type DeviceStatus string
+
+const (
+	DeviceStatusApproved DeviceStatus = "approved"
+	DeviceStatusPending  DeviceStatus = "pending" // Seen but held for approval
+)
+
+// Device is a device a user has connected from, keyed by the device ID
+// reported by node agents
+type Device struct {
+	UserID      string       `json:"user_id" db:"user_id"`
+	DeviceID    string       `json:"device_id" db:"device_id"`
+	Status      DeviceStatus `json:"status" db:"status"`
+	FirstSeenAt time.Time    `json:"first_seen_at" db:"first_seen_at"`
+	LastSeenAt  time.Time    `json:"last_seen_at" db:"last_seen_at"`
+	ApprovedAt  *time.Time   `json:"approved_at,omitempty" db:"approved_at"`
+}
+
+// DeviceLimitAction controls what happens to reports from devices beyond a
+// package's max_devices
+type DeviceLimitAction string
+
+const (
+	DeviceLimitActionReject   DeviceLimitAction = "reject"
+	DeviceLimitActionPenalize DeviceLimitAction = "penalize"
+)
+
+// IsValid reports whether the action is known
+func (a DeviceLimitAction) IsValid() bool {
+	return a == DeviceLimitActionReject || a == DeviceLimitActionPenalize
+}
+
+// DevicePending is the metadata of a DEVICE_PENDING event
+type DevicePending struct {
+	DeviceID string     `json:"device_id"`
+	Reason   ReasonCode `json:"reason"`
+}
+
+// Metadata encodes the pending device as event metadata
+func (d DevicePending) Metadata() []byte {
+	data, _ := json.Marshal(d)
+	return data
+}
@@ -0,0 +1,82 @@
+package domain
+
+import "time"
+
+// DigestFrequency is how often a manager receives its summary digest
+type DigestFrequency string
+
+const (
+	DigestFrequencyOff    DigestFrequency = "off"
+	DigestFrequencyDaily  DigestFrequency = "daily"
+	DigestFrequencyWeekly DigestFrequency = "weekly"
+)
+
+// IsValid reports whether f is a known frequency
+func (f DigestFrequency) IsValid() bool {
+	switch f {
+	case DigestFrequencyOff, DigestFrequencyDaily, DigestFrequencyWeekly:
+		return true
+	}
+	return false
+}
+
+// Period returns the span a digest of this frequency covers, or 0 when off
+func (f DigestFrequency) Period() time.Duration {
+	switch f {
+	case DigestFrequencyDaily:
+		return 24 * time.Hour
+	case DigestFrequencyWeekly:
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+// MessageKey returns the notification template of the frequency
+func (f DigestFrequency) MessageKey() MessageKey {
+	if f == DigestFrequencyWeekly {
+		return MessageManagerDigestWeekly
+	}
+	return MessageManagerDigestDaily
+}
+
+// DigestSubscription is a manager's opt-in to scheduled digests
+type DigestSubscription struct {
+	ManagerID  string          `json:"manager_id" db:"manager_id"`
+	Frequency  DigestFrequency `json:"frequency" db:"frequency"`
+	WebhookURL string          `json:"webhook_url" db:"webhook_url"`
+	Language   string          `json:"language,omitempty" db:"language"`
+	LastSentAt *time.Time      `json:"last_sent_at,omitempty" db:"last_sent_at"`
+	UpdatedAt  time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// DigestSubscriptionUpdate represents the input for changing a subscription
+type DigestSubscriptionUpdate struct {
+	Frequency  DigestFrequency `json:"frequency"`
+	WebhookURL string          `json:"webhook_url"`
+	Language   string          `json:"language,omitempty"`
+}
+
+// ManagerDigest summarizes a manager's users and nodes over a period
+type ManagerDigest struct {
+	ManagerID    string          `json:"manager_id"`
+	ManagerName  string          `json:"manager_name"`
+	Frequency    DigestFrequency `json:"frequency"`
+	PeriodStart  time.Time       `json:"period_start"`
+	PeriodEnd    time.Time       `json:"period_end"`
+	NewUsers     int             `json:"new_users"`
+	Upload       int64           `json:"upload"`
+	Download     int64           `json:"download"`
+	Total        int64           `json:"total"`
+	Suspensions  int             `json:"suspensions"`
+	NodesOffline []string        `json:"nodes_offline"`
+}
+
+// Notification is a rendered message on its way to a recipient
+type Notification struct {
+	Key       MessageKey `json:"key"`
+	Recipient string     `json:"recipient"`
+	Language  string     `json:"language"`
+	Text      string     `json:"text"`
+	Data      any        `json:"data,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -27,6 +27,14 @@ func TestUserAndPackageStateMethods(t *testing.T) {
 	if p.HasTrafficRemaining() {
 		t.Fatalf("expected no remaining traffic at full usage")
 	}
+
+	u.AllowedNodes = []string{"node-gold"}
+	if u.Permits("node-basic", "") || !u.Permits("node-gold", "svc-1") {
+		t.Fatalf("expected user node allow-list to be enforced")
+	}
+	if !p.Permits("any-node", "any-service") {
+		t.Fatalf("expected empty package allow-lists to permit everything")
+	}
 }
 
 func TestPackageResetAndUsageAccounting(t *testing.T) {
@@ -42,6 +50,45 @@ func TestPackageResetAndUsageAccounting(t *testing.T) {
 	}
 }
 
+func TestNodeLastScheduledReset(t *testing.T) {
+	now := time.Date(2024, time.February, 10, 15, 30, 0, 0, time.UTC) // Saturday
+	cases := []struct {
+		mode ResetMode
+		day  int
+		want time.Time
+	}{
+		{ResetModeNoReset, 0, time.Time{}},
+		{ResetModeHourly, 0, time.Date(2024, time.February, 10, 15, 0, 0, 0, time.UTC)},
+		{ResetModeDaily, 0, time.Date(2024, time.February, 10, 0, 0, 0, 0, time.UTC)},
+		{ResetModeWeekly, 1, time.Date(2024, time.February, 5, 0, 0, 0, 0, time.UTC)},
+		{ResetModeWeekly, 6, time.Date(2024, time.February, 10, 0, 0, 0, 0, time.UTC)},
+		{ResetModeMonthly, 5, time.Date(2024, time.February, 5, 0, 0, 0, 0, time.UTC)},
+		{ResetModeMonthly, 31, time.Date(2024, time.January, 31, 0, 0, 0, 0, time.UTC)},
+		{ResetModeYearly, 1, time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{ResetModeYearly, 100, time.Date(2023, time.April, 10, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		n := &Node{ResetMode: tc.mode, ResetDay: tc.day}
+		if got := n.LastScheduledReset(now); !got.Equal(tc.want) {
+			t.Fatalf("%s day %d: expected %v, got %v", tc.mode, tc.day, tc.want, got)
+		}
+	}
+
+	// Day 31 falls on the last day of February
+	n := &Node{ResetMode: ResetModeMonthly, ResetDay: 31, CreatedAt: now}
+	if n.ResetDue(now) {
+		t.Fatalf("expected no reset due right after creation")
+	}
+	if !n.ResetDue(time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected a reset due on the last day of February")
+	}
+	resetAt := time.Date(2024, time.February, 29, 0, 1, 0, 0, time.UTC)
+	n.LastResetAt = &resetAt
+	if n.ResetDue(time.Date(2024, time.March, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected no reset before March 31")
+	}
+}
+
 func TestNodeServiceAndTimeHelpers(t *testing.T) {
 	n := &Node{TrafficMultiplier: 1.5}
 	up, down := n.ApplyMultiplier(10, 20)
@@ -63,3 +110,169 @@ func TestNodeServiceAndTimeHelpers(t *testing.T) {
 		t.Fatalf("parse/format time mismatch")
 	}
 }
+
+func TestDisconnectReasonCatalog(t *testing.T) {
+	seen := map[ReasonCode]bool{}
+	for _, r := range DisconnectReasons() {
+		if seen[r.Code] {
+			t.Fatalf("duplicate reason code %s", r.Code)
+		}
+		seen[r.Code] = true
+		for _, lang := range []string{"en", "fa"} {
+			if r.Messages[lang] == "" {
+				t.Fatalf("reason %s has no %s message", r.Code, lang)
+			}
+		}
+	}
+
+	r, ok := LookupReason(ReasonConcurrentLimit)
+	if !ok || !r.Penalty {
+		t.Fatalf("expected concurrent limit to be a penalty reason")
+	}
+	if r.Message("de") != r.Messages[DefaultReasonLanguage] {
+		t.Fatalf("expected unknown language to fall back to %s", DefaultReasonLanguage)
+	}
+}
+
+func TestMessageCatalogTranslateAndNegotiate(t *testing.T) {
+	for key, texts := range messageCatalog {
+		for _, lang := range SupportedLanguages() {
+			if texts[lang] == "" {
+				t.Fatalf("message %s has no %s text", key, lang)
+			}
+		}
+	}
+
+	got := Translate(MessageQuotaWarning, "en", map[string]string{"percent": "80"})
+	if got != "You have used 80% of your traffic." {
+		t.Fatalf("unexpected template result: %q", got)
+	}
+	if Translate(MessageUserSuspended, "de", nil) != Translate(MessageUserSuspended, DefaultLanguage, nil) {
+		t.Fatalf("expected unknown language to fall back to %s", DefaultLanguage)
+	}
+
+	cases := []struct {
+		candidates []string
+		want       string
+	}{
+		{[]string{"fa-IR,en;q=0.8"}, "fa"},
+		{[]string{"de, en;q=0.5, fa;q=0.9"}, "fa"},
+		{[]string{"", "fa", "en"}, "fa"},
+		{[]string{"de"}, DefaultLanguage},
+		{[]string{"fa;q=0, en"}, "en"},
+	}
+	for _, tc := range cases {
+		if got := NegotiateLanguage(tc.candidates...); got != tc.want {
+			t.Fatalf("NegotiateLanguage(%q) = %s, want %s", tc.candidates, got, tc.want)
+		}
+	}
+
+	u := &User{Attributes: map[string]string{UserAttributeLocale: "fa"}}
+	if u.Locale() != "fa" {
+		t.Fatalf("expected locale attribute")
+	}
+	if err := ValidateUserAttributes(map[string]string{UserAttributeLocale: "xx"}); err == nil {
+		t.Fatalf("expected unsupported locale to be rejected")
+	}
+}
+
+func TestTagRulesParseAndApply(t *testing.T) {
+	var rules []TagRule
+	for _, entry := range []string{"mobile=isp:Irancell|MCI", "night=hour:22-06:00", "edge=node:node-1"} {
+		rule, err := ParseTagRule(entry)
+		if err != nil {
+			t.Fatalf("parse %q: %v", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	for _, entry := range []string{"mobile", "x=isp:", "x=hour:5-5", "x=hour:1-25", "x=color:red"} {
+		if _, err := ParseTagRule(entry); err == nil {
+			t.Fatalf("expected %q to be rejected", entry)
+		}
+	}
+
+	sent := []string{"vless"}
+	report := &UsageReport{
+		NodeID:    "node-1",
+		Tags:      sent,
+		Timestamp: time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC),
+	}
+	ApplyTagRules(rules, report, &GeoData{ISP: "Mobile Communication Company of Iran (MCI)"}, time.UTC)
+	if len(report.Tags) != 4 || report.Tags[1] != "mobile" || report.Tags[2] != "night" || report.Tags[3] != "edge" {
+		t.Fatalf("unexpected tags %v", report.Tags)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("expected the sent tags to be left untouched")
+	}
+
+	report = &UsageReport{NodeID: "node-2", Tags: []string{"night"}, Timestamp: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)}
+	ApplyTagRules(rules, report, nil, time.UTC)
+	if len(report.Tags) != 1 {
+		t.Fatalf("expected no rule to match at noon without geo data, got %v", report.Tags)
+	}
+}
+
+func TestCountryPermits(t *testing.T) {
+	iran := &GeoData{Country: "Iran", CountryCode: "IR"}
+	germany := &GeoData{Country: "Germany", CountryCode: "DE"}
+
+	if !CountryPermits(nil, nil, iran) {
+		t.Fatalf("expected empty lists to permit every country")
+	}
+	if !CountryPermits([]string{"ir"}, nil, iran) || CountryPermits([]string{"ir"}, nil, germany) {
+		t.Fatalf("expected the allow-list to match ISO codes case-insensitively")
+	}
+	if CountryPermits(nil, []string{"Germany"}, germany) || !CountryPermits(nil, []string{"Germany"}, iran) {
+		t.Fatalf("expected the deny-list to match English names")
+	}
+	if CountryPermits([]string{"DE"}, []string{"DE"}, germany) {
+		t.Fatalf("expected a denied country to win over an allowed one")
+	}
+	if !CountryPermits([]string{"DE"}, nil, &GeoData{}) || !CountryPermits([]string{"DE"}, nil, nil) {
+		t.Fatalf("expected an unknown country not to be restricted")
+	}
+}
+
+func TestResolvePenaltyPolicy(t *testing.T) {
+	pkg := &Package{PenaltyDuration: 60, PenaltyAction: PenaltyActionReject}
+
+	if got := ResolvePenaltyPolicy(nil, pkg); got.Duration != time.Minute || got.Action != PenaltyActionReject {
+		t.Fatalf("expected the package policy without groups, got %+v", got)
+	}
+	if got := ResolvePenaltyPolicy(nil, &Package{}); got.Duration != 0 || got.Action != "" {
+		t.Fatalf("expected an empty policy to keep the server defaults, got %+v", got)
+	}
+
+	groups := []*Group{
+		{Name: "a", PenaltyDuration: 300, PenaltyAction: PenaltyActionNone},
+		{Name: "b", PenaltyDuration: 120, PenaltyAction: PenaltyActionDisconnect},
+		{Name: "c"},
+	}
+	if got := ResolvePenaltyPolicy(groups, pkg); got.Duration != 5*time.Minute || got.Action != PenaltyActionDisconnect {
+		t.Fatalf("expected the longest group duration and the strictest group action, got %+v", got)
+	}
+	if got := ResolvePenaltyPolicy(groups[2:], pkg); got.Duration != time.Minute || got.Action != PenaltyActionReject {
+		t.Fatalf("expected a group without overrides to keep the package policy, got %+v", got)
+	}
+}
+
+func TestEventDecodeMetadata(t *testing.T) {
+	geo := &GeoData{Country: "Germany", CountryCode: "DE", ASN: 3320}
+	event := NewEvent(EventUserConnected, nil, nil, nil, nil, nil, SessionConnected{SessionID: "s1", Sessions: 2, Geo: geo}.Metadata())
+	decoded, err := event.DecodeMetadata()
+	if err != nil {
+		t.Fatalf("decode metadata: %v", err)
+	}
+	connected, ok := decoded.(*SessionConnected)
+	if !ok || connected.SessionID != "s1" || connected.Sessions != 2 || connected.Geo == nil || *connected.Geo != *geo {
+		t.Fatalf("expected the typed session payload, got %#v", decoded)
+	}
+
+	event = NewEvent(EventPackageReset, nil, nil, nil, nil, nil, []byte(`{"by":"admin"}`))
+	if decoded, err := event.DecodeMetadata(); err != nil || (*decoded.(*map[string]interface{}))["by"] != "admin" {
+		t.Fatalf("expected a type without a payload decoded into a map, got %#v, %v", decoded, err)
+	}
+	if decoded, err := NewEvent(EventUserConnected, nil, nil, nil, nil, nil, nil).DecodeMetadata(); decoded != nil || err != nil {
+		t.Fatalf("expected nothing to decode without metadata, got %#v, %v", decoded, err)
+	}
+}
@@ -0,0 +1,194 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// SessionConnected is the metadata of a USER_CONNECTED event
+type SessionConnected struct {
+	SessionID string   `json:"session_id,omitempty"`
+	Sessions  int      `json:"sessions"`      // The user's sessions, this one included
+	Geo       *GeoData `json:"geo,omitempty"` // Where the client connected from, when known
+}
+
+// Metadata encodes the session as event metadata
+func (s SessionConnected) Metadata() []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// SessionDisconnected is the metadata of a USER_DISCONNECTED event
+type SessionDisconnected struct {
+	SessionID string `json:"session_id,omitempty"`
+	Sessions  int    `json:"sessions"` // The user's sessions left
+}
+
+// Metadata encodes the session as event metadata
+func (s SessionDisconnected) Metadata() []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// SessionRoaming is the metadata of a SESSION_ROAMING event
+type SessionRoaming struct {
+	SessionID       string `json:"session_id,omitempty"`
+	Reason          string `json:"reason"`
+	NodeID          string `json:"node_id,omitempty"`
+	PreviousNodeID  string `json:"previous_node_id,omitempty"`
+	Country         string `json:"country,omitempty"`
+	PreviousCountry string `json:"previous_country,omitempty"`
+	Penalized       bool   `json:"penalized"`
+}
+
+// Metadata encodes the roaming as event metadata
+func (r SessionRoaming) Metadata() []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+// TrafficUsage is the billed traffic a package has used against its limit
+type TrafficUsage struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Total    int64 `json:"total"`
+	Limit    int64 `json:"limit"` // 0 = unlimited
+}
+
+// PackageTrafficUsage returns the traffic pkg has used
+func PackageTrafficUsage(pkg *Package) TrafficUsage {
+	return TrafficUsage{
+		Upload:   pkg.CurrentUpload,
+		Download: pkg.CurrentDownload,
+		Total:    pkg.CurrentTotal,
+		Limit:    pkg.TotalTraffic,
+	}
+}
+
+// StatusChange is the metadata of a USER_SUSPENDED or USER_ACTIVATED event
+type StatusChange struct {
+	From   UserStatus    `json:"from,omitempty"`
+	To     UserStatus    `json:"to"`
+	Reason string        `json:"reason"`          // "admin" or "quota_exceeded"
+	Usage  *TrafficUsage `json:"usage,omitempty"` // The package's usage when its quota ran out
+}
+
+// Metadata encodes the change as event metadata
+func (s StatusChange) Metadata() []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// PackageExpiry is the metadata of a PACKAGE_EXPIRED event
+type PackageExpiry struct {
+	Reason    string       `json:"reason"` // "traffic" when its traffic ran out, "expired" when its time did
+	Usage     TrafficUsage `json:"usage"`
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"`
+}
+
+// Metadata encodes the expiry as event metadata
+func (p PackageExpiry) Metadata() []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
+
+// PackageActivated is the metadata of a PACKAGE_ACTIVATED event
+type PackageActivated struct {
+	PreviousPackageID string `json:"previous_package_id"`
+}
+
+// Metadata encodes the activation as event metadata
+func (p PackageActivated) Metadata() []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
+
+// ManagerLimitReached is the metadata of a MANAGER_LIMIT_REACHED event
+type ManagerLimitReached struct {
+	ManagerID string `json:"manager_id"`
+	Reason    string `json:"reason"`
+}
+
+// Metadata encodes the limit as event metadata
+func (m ManagerLimitReached) Metadata() []byte {
+	data, _ := json.Marshal(m)
+	return data
+}
+
+// NodeOverloaded is the metadata of a NODE_OVERLOADED event
+type NodeOverloaded struct {
+	Reason            string  `json:"reason"` // The exceeded threshold, or "node_signal" when the node reported it
+	CPUPercent        float64 `json:"cpu_percent"`
+	ActiveConnections int64   `json:"active_connections"`
+	BandwidthBps      int64   `json:"bandwidth_bps"`
+}
+
+// Metadata encodes the load as event metadata
+func (n NodeOverloaded) Metadata() []byte {
+	data, _ := json.Marshal(n)
+	return data
+}
+
+// NodeDown is the metadata of a NODE_DOWN event
+type NodeDown struct {
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+// Metadata encodes the outage as event metadata
+func (n NodeDown) Metadata() []byte {
+	data, _ := json.Marshal(n)
+	return data
+}
+
+// DataPurged is the metadata of a DATA_PURGED event
+type DataPurged struct {
+	Database  string           `json:"database"` // "active" or "history"
+	OlderThan time.Time        `json:"older_than"`
+	Rows      map[string]int64 `json:"rows"` // Rows removed per table
+}
+
+// Metadata encodes the purge as event metadata
+func (d DataPurged) Metadata() []byte {
+	data, _ := json.Marshal(d)
+	return data
+}
+
+// eventMetadataTypes returns an empty payload of each event type's metadata
+var eventMetadataTypes = map[EventType]func() interface{}{
+	EventUserConnected:       func() interface{} { return &SessionConnected{} },
+	EventUserDisconnected:    func() interface{} { return &SessionDisconnected{} },
+	EventUsageRecorded:       func() interface{} { return &UsageTraffic{} },
+	EventPackageExpired:      func() interface{} { return &PackageExpiry{} },
+	EventPackageActivated:    func() interface{} { return &PackageActivated{} },
+	EventNodeReset:           func() interface{} { return &NodeUsageSnapshot{} },
+	EventUserSuspended:       func() interface{} { return &StatusChange{} },
+	EventUserActivated:       func() interface{} { return &StatusChange{} },
+	EventPenaltyApplied:      func() interface{} { return &PenaltyInfo{} },
+	EventUserPackageStarted:  func() interface{} { return &PackageStarted{} },
+	EventManagerLimitReached: func() interface{} { return &ManagerLimitReached{} },
+	EventSessionRoaming:      func() interface{} { return &SessionRoaming{} },
+	EventNodeOverloaded:      func() interface{} { return &NodeOverloaded{} },
+	EventNodeDown:            func() interface{} { return &NodeDown{} },
+	EventUserSpeedExceeded:   func() interface{} { return &SpeedExceeded{} },
+	EventBackfill:            func() interface{} { return &Backfill{} },
+	EventDevicePending:       func() interface{} { return &DevicePending{} },
+	EventCountryRejected:     func() interface{} { return &CountryRejection{} },
+	EventDataPurged:          func() interface{} { return &DataPurged{} },
+}
+
+// DecodeMetadata returns the event's metadata as a pointer to its type's
+// payload, e.g. *UsageTraffic for USAGE_RECORDED. Types without a payload
+// decode into a map. It returns nil for an event without metadata.
+func (e *Event) DecodeMetadata() (interface{}, error) {
+	if len(e.Metadata) == 0 {
+		return nil, nil
+	}
+	var payload interface{} = &map[string]interface{}{}
+	if newPayload, ok := eventMetadataTypes[e.Type]; ok {
+		payload = newPayload()
+	}
+	if err := json.Unmarshal(e.Metadata, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
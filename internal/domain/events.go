@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -8,81 +9,306 @@ import (
 type EventType string
 
 const (
-	EventUserConnected    EventType = "USER_CONNECTED"
-	EventUserDisconnected EventType = "USER_DISCONNECTED"
-	EventUsageRecorded    EventType = "USAGE_RECORDED"
-	EventPackageExpired   EventType = "PACKAGE_EXPIRED"
-	EventPackageReset     EventType = "PACKAGE_RESET"
-	EventNodeReset        EventType = "NODE_RESET"
-	EventUserSuspended    EventType = "USER_SUSPENDED"
-	EventUserActivated    EventType = "USER_ACTIVATED"
-	EventPenaltyApplied   EventType = "PENALTY_APPLIED"
-	EventPenaltyExpired   EventType = "PENALTY_EXPIRED"
-	EventManagerExpired       EventType = "MANAGER_EXPIRED"
-	EventUserUsageFinished    EventType = "USER_USAGE_FINISHED"
-	EventUserPackageStarted   EventType = "USER_PACKAGE_STARTED"
+	EventUserConnected         EventType = "USER_CONNECTED"
+	EventUserDisconnected      EventType = "USER_DISCONNECTED"
+	EventUsageRecorded         EventType = "USAGE_RECORDED"
+	EventPackageExpired        EventType = "PACKAGE_EXPIRED"
+	EventPackageReset          EventType = "PACKAGE_RESET"
+	EventPackageActivated      EventType = "PACKAGE_ACTIVATED"
+	EventNodeReset             EventType = "NODE_RESET"
+	EventUserSuspended         EventType = "USER_SUSPENDED"
+	EventUserActivated         EventType = "USER_ACTIVATED"
+	EventPenaltyApplied        EventType = "PENALTY_APPLIED"
+	EventPenaltyExpired        EventType = "PENALTY_EXPIRED"
+	EventManagerExpired        EventType = "MANAGER_EXPIRED"
+	EventUserUsageFinished     EventType = "USER_USAGE_FINISHED"
+	EventUserPackageStarted    EventType = "USER_PACKAGE_STARTED"
 	EventManagerPackageStarted EventType = "MANAGER_PACKAGE_STARTED"
-	EventManagerLimitReached  EventType = "MANAGER_LIMIT_REACHED"
-	EventUserLimitReached     EventType = "USER_LIMIT_REACHED"
+	EventManagerLimitReached   EventType = "MANAGER_LIMIT_REACHED"
+	EventUserLimitReached      EventType = "USER_LIMIT_REACHED"
+	EventSessionRoaming        EventType = "SESSION_ROAMING"
+	EventNodeOverloaded        EventType = "NODE_OVERLOADED"
+	EventNodeDown              EventType = "NODE_DOWN"
+	EventUserSpeedExceeded     EventType = "USER_SPEED_EXCEEDED"
+	EventBackfill              EventType = "BACKFILL"
+	EventDevicePending         EventType = "DEVICE_PENDING"
+	EventCountryRejected       EventType = "COUNTRY_REJECTED"
+	EventDataPurged            EventType = "DATA_PURGED"
 )
 
 // Event represents an immutable event in the system
 type Event struct {
-	ID          string      `json:"id" db:"id"`
-	Type        EventType   `json:"type" db:"type"`
-	UserID      *string     `json:"user_id,omitempty" db:"user_id"`
-	PackageID   *string     `json:"package_id,omitempty" db:"package_id"`
-	NodeID      *string     `json:"node_id,omitempty" db:"node_id"`
-	ServiceID   *string     `json:"service_id,omitempty" db:"service_id"`
-	Tags        []string    `json:"tags,omitempty" db:"tags"`
-	Metadata    []byte      `json:"metadata,omitempty" db:"metadata"` // JSON encoded additional data
-	Timestamp   time.Time   `json:"timestamp" db:"timestamp"`
+	ID        string          `json:"id" db:"id"`
+	Type      EventType       `json:"type" db:"type"`
+	UserID    *string         `json:"user_id,omitempty" db:"user_id"`
+	PackageID *string         `json:"package_id,omitempty" db:"package_id"`
+	NodeID    *string         `json:"node_id,omitempty" db:"node_id"`
+	ServiceID *string         `json:"service_id,omitempty" db:"service_id"`
+	Tags      []string        `json:"tags,omitempty" db:"tags"`
+	Metadata  json.RawMessage `json:"metadata,omitempty" db:"metadata"` // Payload of the event type, see DecodeMetadata
+	Timestamp time.Time       `json:"timestamp" db:"timestamp"`
+	Seq       int64           `json:"-" db:"rowid"` // Position in the history database, 0 when not stored
+}
+
+// EventFilter selects a page of events, newest first
+type EventFilter struct {
+	Type   *EventType
+	UserID *string
+	From   *time.Time
+	To     *time.Time
+	Limit  int
+	// Cursor continues after the page that returned it as NextCursor
+	Cursor string
+}
+
+// EventPage is one page of events
+type EventPage struct {
+	Events []*Event `json:"events"`
+	// NextCursor fetches the following page; empty on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// EventReplayFilter selects the stored events to replay, in the order they
+// were stored; empty fields match all
+type EventReplayFilter struct {
+	Types  []EventType
+	UserID *string
+	From   *time.Time
+	To     *time.Time
+	// AfterID replays only the events stored after the event with this ID
+	AfterID string
 }
 
 // UsageReport represents a usage report from a service/node
 type UsageReport struct {
-	ID           string    `json:"id"`
-	UserID       string    `json:"user_id" validate:"required"`
-	NodeID       string    `json:"node_id" validate:"required"`
-	ServiceID    string    `json:"service_id" validate:"required"`
-	Upload       int64     `json:"upload" validate:"min=0"`
-	Download     int64     `json:"download" validate:"min=0"`
-	SessionID    string    `json:"session_id,omitempty"`
-	ClientIP     string    `json:"client_ip,omitempty"` // Will be deleted after geo extraction
-	Tags         []string  `json:"tags,omitempty"`
-	Timestamp    time.Time `json:"timestamp"`
+	ID          string      `json:"id"`
+	UserID      string      `json:"user_id" validate:"required"`
+	NodeID      string      `json:"node_id" validate:"required"`
+	ServiceID   string      `json:"service_id" validate:"required"`
+	Upload      int64       `json:"upload" validate:"min=0"`
+	Download    int64       `json:"download" validate:"min=0"`
+	SessionID   string      `json:"session_id,omitempty"`
+	DeviceID    string      `json:"device_id,omitempty"`
+	ClientIP    string      `json:"client_ip,omitempty"` // Will be deleted after geo extraction
+	Tags        []string    `json:"tags,omitempty"`
+	Timestamp   time.Time   `json:"timestamp"`
+	CounterMode CounterMode `json:"counter_mode,omitempty"` // Empty = delta
+}
+
+// CounterMode tells how Upload and Download in a usage report are counted
+type CounterMode string
+
+const (
+	// CounterModeDelta reports the bytes since the previous report
+	CounterModeDelta CounterMode = "delta"
+	// CounterModeAbsolute reports the backend's cumulative counters; HUE
+	// keeps the last value per user and service and computes the delta
+	CounterModeAbsolute CounterMode = "absolute"
+)
+
+// IsValid reports whether the mode is known. The empty mode means delta.
+func (m CounterMode) IsValid() bool {
+	return m == "" || m == CounterModeDelta || m == CounterModeAbsolute
+}
+
+// UsageTraffic records the bytes a node measured next to the bytes charged
+// to the user once the node's traffic multiplier is applied
+type UsageTraffic struct {
+	RawUpload      int64   `json:"raw_upload"`
+	RawDownload    int64   `json:"raw_download"`
+	BilledUpload   int64   `json:"billed_upload"`
+	BilledDownload int64   `json:"billed_download"`
+	Multiplier     float64 `json:"multiplier"`
+}
+
+// UnbilledTraffic returns traffic charged one to one, for reports whose node
+// is unknown
+func UnbilledTraffic(upload, download int64) UsageTraffic {
+	return UsageTraffic{
+		RawUpload:      upload,
+		RawDownload:    download,
+		BilledUpload:   upload,
+		BilledDownload: download,
+		Multiplier:     1,
+	}
+}
+
+// Metadata encodes the traffic split as event metadata
+func (t UsageTraffic) Metadata() []byte {
+	data, _ := json.Marshal(t)
+	return data
+}
+
+// Capped scales the traffic down so at most limit bytes are billed, keeping
+// the upload/download and measured/billed proportions
+func (t UsageTraffic) Capped(limit int64) UsageTraffic {
+	billed := t.Total()
+	if billed <= limit {
+		return t
+	}
+	if limit <= 0 {
+		return UsageTraffic{Multiplier: t.Multiplier}
+	}
+	ratio := float64(limit) / float64(billed)
+	capped := UsageTraffic{
+		RawUpload:    int64(float64(t.RawUpload) * ratio),
+		RawDownload:  int64(float64(t.RawDownload) * ratio),
+		BilledUpload: int64(float64(t.BilledUpload) * ratio),
+		Multiplier:   t.Multiplier,
+	}
+	capped.BilledDownload = limit - capped.BilledUpload
+	return capped
+}
+
+// Total returns the billed bytes
+func (t UsageTraffic) Total() int64 {
+	return t.BilledUpload + t.BilledDownload
 }
 
 // UsageReportResult represents the result of processing a usage report
 type UsageReportResult struct {
-	UserID         string `json:"user_id"`
-	PackageID      string `json:"package_id"`
-	Accepted       bool   `json:"accepted"`
-	QuotaExceeded  bool   `json:"quota_exceeded"`
-	SessionLimitHit bool  `json:"session_limit_hit"`
-	PenaltyApplied bool   `json:"penalty_applied"`
-	ShouldDisconnect bool `json:"should_disconnect"`
-	Reason         string `json:"reason,omitempty"`
+	UserID             string          `json:"user_id"`
+	PackageID          string          `json:"package_id"`
+	Accepted           bool            `json:"accepted"`
+	QuotaExceeded      bool            `json:"quota_exceeded"`
+	SessionLimitHit    bool            `json:"session_limit_hit"`
+	PenaltyApplied     bool            `json:"penalty_applied"`
+	ShouldDisconnect   bool            `json:"should_disconnect"`
+	Reason             string          `json:"reason,omitempty"`
+	ReasonCode         ReasonCode      `json:"reason_code,omitempty"`
+	Priority           PackagePriority `json:"priority,omitempty"`
+	PenaltyReason      string          `json:"penalty_reason,omitempty"`
+	PenaltySecondsLeft int64           `json:"penalty_seconds_left,omitempty"`
+	RawUpload          int64           `json:"raw_upload,omitempty"`
+	RawDownload        int64           `json:"raw_download,omitempty"`
+	BilledUpload       int64           `json:"billed_upload,omitempty"`
+	BilledDownload     int64           `json:"billed_download,omitempty"`
+	Queued             bool            `json:"queued,omitempty"`     // Held until the unknown user exists
+	Backfilled         bool            `json:"backfilled,omitempty"` // Charged at the report's own time after a node outage
+	RateLimit          int64           `json:"rate_limit,omitempty"` // Suggested bytes/sec for the user, 0 = unthrottled
+	Duplicate          bool            `json:"duplicate,omitempty"`  // The report ID was already processed; this is the original result
+}
+
+// SetTraffic records the measured and charged bytes of an accepted report
+func (r *UsageReportResult) SetTraffic(t UsageTraffic) {
+	r.RawUpload = t.RawUpload
+	r.RawDownload = t.RawDownload
+	r.BilledUpload = t.BilledUpload
+	r.BilledDownload = t.BilledDownload
+}
+
+// SetPenalty records an active penalty on the result, rounding the time left
+// up to whole seconds
+func (r *UsageReportResult) SetPenalty(reason string, timeLeft time.Duration) {
+	r.PenaltyReason = reason
+	r.PenaltySecondsLeft = int64((timeLeft + time.Second - 1) / time.Second)
+	if r.PenaltySecondsLeft < 0 {
+		r.PenaltySecondsLeft = 0
+	}
 }
 
 // SessionInfo represents information about an active session
 type SessionInfo struct {
 	UserID     string    `json:"user_id"`
 	SessionID  string    `json:"session_id"`
+	NodeID     string    `json:"node_id,omitempty"`
 	IPHash     string    `json:"ip_hash"` // Hashed IP for privacy
 	Country    string    `json:"country,omitempty"`
 	City       string    `json:"city,omitempty"`
 	ISP        string    `json:"isp,omitempty"`
+	ASN        uint      `json:"asn,omitempty"`
 	StartedAt  time.Time `json:"started_at"`
 	LastSeenAt time.Time `json:"last_seen_at"`
+
+	// Estimated current throughput in bits per second, 0 once the session
+	// goes quiet
+	UploadBps   int64 `json:"upload_bps"`
+	DownloadBps int64 `json:"download_bps"`
+}
+
+// SpeedRule flags users whose combined upload and download throughput stays
+// above ThresholdBps (bits per second) for at least Sustain
+type SpeedRule struct {
+	ThresholdBps int64
+	Sustain      time.Duration
+}
+
+// Enabled reports whether the rule is configured
+func (r SpeedRule) Enabled() bool {
+	return r.ThresholdBps > 0
+}
+
+// SpeedExceeded is the metadata of a USER_SPEED_EXCEEDED event
+type SpeedExceeded struct {
+	Bps          int64     `json:"bps"`
+	ThresholdBps int64     `json:"threshold_bps"`
+	Since        time.Time `json:"since"`
+}
+
+// Metadata encodes the measurement as event metadata
+func (s SpeedExceeded) Metadata() []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// Backfill is the metadata of a BACKFILL event: traffic a node buffered
+// during an outage, billed at its original time and capped at the quota
+type Backfill struct {
+	ReportedAt time.Time    `json:"reported_at"`
+	Billed     int64        `json:"billed"`  // Bytes the report would have been charged
+	Charged    UsageTraffic `json:"charged"` // Traffic charged after the cap
+	Capped     bool         `json:"capped"`
+}
+
+// Metadata encodes the backfill as event metadata
+func (b Backfill) Metadata() []byte {
+	data, _ := json.Marshal(b)
+	return data
+}
+
+// PackageStarted is the metadata of a USER_PACKAGE_STARTED event
+type PackageStarted struct {
+	StartAt   time.Time  `json:"start_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Metadata encodes the start as event metadata
+func (p PackageStarted) Metadata() []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
+
+// RoamingAction controls how cross-node or impossible roaming is handled
+type RoamingAction string
+
+const (
+	RoamingActionOff      RoamingAction = "off"
+	RoamingActionFlag     RoamingAction = "flag"
+	RoamingActionPenalize RoamingAction = "penalize"
+)
+
+// UnknownUserAction controls what happens to reports for users HUE does not
+// know, e.g. when panel sync lags behind node config
+type UnknownUserAction string
+
+const (
+	UnknownUserActionReject    UnknownUserAction = "reject"
+	UnknownUserActionQueue     UnknownUserAction = "queue"
+	UnknownUserActionProvision UnknownUserAction = "provision"
+)
+
+// IsValid reports whether the action is known
+func (a UnknownUserAction) IsValid() bool {
+	return a == UnknownUserActionReject || a == UnknownUserActionQueue || a == UnknownUserActionProvision
 }
 
 // GeoData represents extracted geo information
 type GeoData struct {
-	Country string `json:"country,omitempty"`
-	City    string `json:"city,omitempty"`
-	ISP     string `json:"isp,omitempty"`
-	ASN     uint   `json:"asn,omitempty"`
+	Country     string `json:"country,omitempty"`
+	CountryCode string `json:"country_code,omitempty"` // ISO 3166-1 alpha-2
+	City        string `json:"city,omitempty"`
+	ISP         string `json:"isp,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
 }
 
 // NewEvent creates a new event with the current timestamp
@@ -0,0 +1,129 @@
+package domain
+
+import "time"
+
+// Group holds limits shared by every user listed in it. Users reference
+// groups by name through User.Groups. Traffic limits are a pool: the usage of
+// all members counts against them together.
+type Group struct {
+	Name             string        `json:"name" db:"name"`
+	TotalLimit       int64         `json:"total_limit" db:"total_limit"`                     // Bytes, 0 = unlimited
+	UploadLimit      int64         `json:"upload_limit" db:"upload_limit"`                   // Bytes, 0 = unlimited
+	DownloadLimit    int64         `json:"download_limit" db:"download_limit"`               // Bytes, 0 = unlimited
+	MaxConcurrent    int           `json:"max_concurrent" db:"max_concurrent"`               // Overrides the package's, 0 = keep it
+	PenaltyDuration  int64         `json:"penalty_duration,omitempty" db:"penalty_duration"` // Seconds, overrides the package's, 0 = keep it
+	PenaltyAction    PenaltyAction `json:"penalty_action,omitempty" db:"penalty_action"`     // Overrides the package's, empty = keep it
+	AllowedNodes     []string      `json:"allowed_nodes,omitempty" db:"allowed_nodes"`
+	AllowedCountries []string      `json:"allowed_countries,omitempty" db:"allowed_countries"` // Empty = all countries
+	DeniedCountries  []string      `json:"denied_countries,omitempty" db:"denied_countries"`
+	CurrentUpload    int64         `json:"current_upload" db:"current_upload"`
+	CurrentDownload  int64         `json:"current_download" db:"current_download"`
+	CurrentTotal     int64         `json:"current_total" db:"current_total"`
+	CreatedAt        time.Time     `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time     `json:"updated_at" db:"updated_at"`
+}
+
+// GroupCreate represents the input for creating a group
+type GroupCreate struct {
+	Name             string        `json:"name" validate:"required"`
+	TotalLimit       int64         `json:"total_limit"`
+	UploadLimit      int64         `json:"upload_limit"`
+	DownloadLimit    int64         `json:"download_limit"`
+	MaxConcurrent    int           `json:"max_concurrent"`
+	PenaltyDuration  int64         `json:"penalty_duration,omitempty"` // Seconds
+	PenaltyAction    PenaltyAction `json:"penalty_action,omitempty"`
+	AllowedNodes     []string      `json:"allowed_nodes,omitempty"`
+	AllowedCountries []string      `json:"allowed_countries,omitempty"`
+	DeniedCountries  []string      `json:"denied_countries,omitempty"`
+}
+
+// GroupUpdate represents the input for updating a group; nil fields are left
+// unchanged
+type GroupUpdate struct {
+	TotalLimit       *int64         `json:"total_limit,omitempty"`
+	UploadLimit      *int64         `json:"upload_limit,omitempty"`
+	DownloadLimit    *int64         `json:"download_limit,omitempty"`
+	MaxConcurrent    *int           `json:"max_concurrent,omitempty"`
+	PenaltyDuration  *int64         `json:"penalty_duration,omitempty"`
+	PenaltyAction    *PenaltyAction `json:"penalty_action,omitempty"`
+	AllowedNodes     *[]string      `json:"allowed_nodes,omitempty"`
+	AllowedCountries *[]string      `json:"allowed_countries,omitempty"`
+	DeniedCountries  *[]string      `json:"denied_countries,omitempty"`
+}
+
+// Apply copies the set fields onto g
+func (u *GroupUpdate) Apply(g *Group) {
+	if u.TotalLimit != nil {
+		g.TotalLimit = *u.TotalLimit
+	}
+	if u.UploadLimit != nil {
+		g.UploadLimit = *u.UploadLimit
+	}
+	if u.DownloadLimit != nil {
+		g.DownloadLimit = *u.DownloadLimit
+	}
+	if u.MaxConcurrent != nil {
+		g.MaxConcurrent = *u.MaxConcurrent
+	}
+	if u.PenaltyDuration != nil {
+		g.PenaltyDuration = *u.PenaltyDuration
+	}
+	if u.PenaltyAction != nil {
+		g.PenaltyAction = *u.PenaltyAction
+	}
+	if u.AllowedNodes != nil {
+		g.AllowedNodes = *u.AllowedNodes
+	}
+	if u.AllowedCountries != nil {
+		g.AllowedCountries = *u.AllowedCountries
+	}
+	if u.DeniedCountries != nil {
+		g.DeniedCountries = *u.DeniedCountries
+	}
+}
+
+// HasNegativeLimits reports whether any limit is negative
+func (g *Group) HasNegativeLimits() bool {
+	return g.TotalLimit < 0 || g.UploadLimit < 0 || g.DownloadLimit < 0 || g.MaxConcurrent < 0 || g.PenaltyDuration < 0
+}
+
+// Permits returns true if the group's allow-list permits the node
+func (g *Group) Permits(nodeID string) bool {
+	return AllowListPermits(g.AllowedNodes, nodeID)
+}
+
+// PermitsCountry returns true if the group's country lists permit geo
+func (g *Group) PermitsCountry(geo *GeoData) bool {
+	return CountryPermits(g.AllowedCountries, g.DeniedCountries, geo)
+}
+
+// ExceededLimit returns a description of the first limit the extra traffic
+// would push past, or an empty string if it fits
+func (g *Group) ExceededLimit(upload, download int64) string {
+	if g.TotalLimit > 0 && g.CurrentTotal+upload+download > g.TotalLimit {
+		return "group total traffic limit exceeded"
+	}
+	if g.UploadLimit > 0 && g.CurrentUpload+upload > g.UploadLimit {
+		return "group upload limit exceeded"
+	}
+	if g.DownloadLimit > 0 && g.CurrentDownload+download > g.DownloadLimit {
+		return "group download limit exceeded"
+	}
+	return ""
+}
+
+// GroupMaxConcurrent returns the concurrent session limit for a package's
+// user: the smallest override among the user's groups, or the package's own
+// limit when none sets one
+func GroupMaxConcurrent(groups []*Group, packageLimit int) int {
+	limit := 0
+	for _, g := range groups {
+		if g.MaxConcurrent > 0 && (limit == 0 || g.MaxConcurrent < limit) {
+			limit = g.MaxConcurrent
+		}
+	}
+	if limit == 0 {
+		return packageLimit
+	}
+	return limit
+}
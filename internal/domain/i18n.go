@@ -0,0 +1,257 @@
+package domain
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLanguage is used when a message is not available in the requested
+// language
+const DefaultLanguage = "en"
+
+// supportedLanguages lists every language the catalog translates, default
+// first
+var supportedLanguages = []string{"en", "fa"}
+
+// MessageKey identifies a user-facing message in the catalog. Reason texts use
+// "reason.<code>" keys; notification templates use "notify.*" keys and may
+// contain {placeholders}.
+type MessageKey string
+
+const (
+	MessageQuotaWarning    MessageKey = "notify.quota_warning"
+	MessagePackageExpiring MessageKey = "notify.package_expiring"
+	MessagePackageExpired  MessageKey = "notify.package_expired"
+	MessagePenaltyApplied  MessageKey = "notify.penalty_applied"
+	MessageUserSuspended   MessageKey = "notify.user_suspended"
+
+	MessageManagerDigestDaily  MessageKey = "notify.manager_digest_daily"
+	MessageManagerDigestWeekly MessageKey = "notify.manager_digest_weekly"
+)
+
+var messageCatalog = map[MessageKey]map[string]string{
+	ReasonUserPenalized.MessageKey(): {
+		"en": "Your account is temporarily blocked. Please try again in a few minutes.",
+		"fa": "حساب شما موقتاً مسدود شده است. لطفاً چند دقیقه دیگر دوباره تلاش کنید.",
+	},
+	ReasonConcurrentLimit.MessageKey(): {
+		"en": "Too many devices are connected at the same time.",
+		"fa": "تعداد دستگاه‌های متصل به‌طور هم‌زمان بیش از حد مجاز است.",
+	},
+	ReasonIPLimit.MessageKey(): {
+		"en": "Your account is being used from too many different IP addresses.",
+		"fa": "حساب شما از تعداد زیادی نشانی IP متفاوت استفاده می‌شود.",
+	},
+	ReasonCrossNodeRoaming.MessageKey(): {
+		"en": "Your session moved to another server and was reset.",
+		"fa": "نشست شما به سرور دیگری منتقل شد و بازنشانی شد.",
+	},
+	ReasonImpossibleRoaming.MessageKey(): {
+		"en": "Your account was used from different locations at the same time.",
+		"fa": "حساب شما هم‌زمان از مکان‌های مختلف استفاده شده است.",
+	},
+	ReasonNodeOverloaded.MessageKey(): {
+		"en": "This server is overloaded. Please reconnect to use another server.",
+		"fa": "این سرور بیش از حد شلوغ است. برای استفاده از سرور دیگر دوباره متصل شوید.",
+	},
+	ReasonNodeDraining.MessageKey(): {
+		"en": "This server is not accepting new connections right now.",
+		"fa": "این سرور در حال حاضر اتصال جدید نمی‌پذیرد.",
+	},
+	ReasonNodeUserLimit.MessageKey(): {
+		"en": "This server has reached its user limit. Please reconnect to use another server.",
+		"fa": "ظرفیت کاربران این سرور تکمیل است. برای استفاده از سرور دیگر دوباره متصل شوید.",
+	},
+	ReasonNodeNotAllowed.MessageKey(): {
+		"en": "Your account cannot use this server.",
+		"fa": "حساب شما اجازه استفاده از این سرور را ندارد.",
+	},
+	ReasonNodeNotInPlan.MessageKey(): {
+		"en": "This server is not included in your plan.",
+		"fa": "این سرور در طرح شما گنجانده نشده است.",
+	},
+	ReasonQuotaExceeded.MessageKey(): {
+		"en": "Your traffic quota has been used up.",
+		"fa": "حجم ترافیک شما به پایان رسیده است.",
+	},
+	ReasonUploadQuotaExceeded.MessageKey(): {
+		"en": "Your upload quota has been used up.",
+		"fa": "حجم آپلود شما به پایان رسیده است.",
+	},
+	ReasonDownloadQuotaExceeded.MessageKey(): {
+		"en": "Your download quota has been used up.",
+		"fa": "حجم دانلود شما به پایان رسیده است.",
+	},
+	ReasonManagerLimit.MessageKey(): {
+		"en": "Your provider has reached its capacity. Please contact support.",
+		"fa": "ظرفیت ارائه‌دهنده شما تکمیل شده است. لطفاً با پشتیبانی تماس بگیرید.",
+	},
+	ReasonGroupLimit.MessageKey(): {
+		"en": "Your group has used up its traffic.",
+		"fa": "ترافیک گروه شما به پایان رسیده است.",
+	},
+	ReasonDeviceNotAllowed.MessageKey(): {
+		"en": "This device is waiting for approval.",
+		"fa": "این دستگاه در انتظار تأیید است.",
+	},
+	ReasonDeviceLimit.MessageKey(): {
+		"en": "Your account is already in use on the maximum number of devices.",
+		"fa": "حساب شما روی حداکثر تعداد دستگاه مجاز در حال استفاده است.",
+	},
+	ReasonCountryNotAllowed.MessageKey(): {
+		"en": "Connections from your country are not allowed.",
+		"fa": "اتصال از کشور شما مجاز نیست.",
+	},
+	ReasonUserNotFound.MessageKey(): {
+		"en": "This account does not exist.",
+		"fa": "این حساب وجود ندارد.",
+	},
+	ReasonInvalidCredentials.MessageKey(): {
+		"en": "Your login details are not valid.",
+		"fa": "اطلاعات ورود شما معتبر نیست.",
+	},
+	ReasonUserInactive.MessageKey(): {
+		"en": "Your account is not active.",
+		"fa": "حساب شما فعال نیست.",
+	},
+	ReasonNoActivePackage.MessageKey(): {
+		"en": "You do not have an active package.",
+		"fa": "شما بسته فعالی ندارید.",
+	},
+	ReasonPackageInactive.MessageKey(): {
+		"en": "Your package is not active.",
+		"fa": "بسته شما فعال نیست.",
+	},
+	ReasonPackageExpired.MessageKey(): {
+		"en": "Your package has expired.",
+		"fa": "بسته شما منقضی شده است.",
+	},
+	ReasonInternalError.MessageKey(): {
+		"en": "A temporary server error occurred. Please try again.",
+		"fa": "خطای موقت سرور رخ داد. لطفاً دوباره تلاش کنید.",
+	},
+	ReasonAdminDisconnect.MessageKey(): {
+		"en": "Your connection was closed by an administrator.",
+		"fa": "اتصال شما توسط مدیر قطع شد.",
+	},
+	MessageQuotaWarning: {
+		"en": "You have used {percent}% of your traffic.",
+		"fa": "شما {percent}٪ از ترافیک خود را مصرف کرده‌اید.",
+	},
+	MessagePackageExpiring: {
+		"en": "Your package expires in {days} days.",
+		"fa": "بسته شما {days} روز دیگر منقضی می‌شود.",
+	},
+	MessagePackageExpired: {
+		"en": "Your package has expired. Renew it to keep using the service.",
+		"fa": "بسته شما منقضی شده است. برای ادامه استفاده آن را تمدید کنید.",
+	},
+	MessagePenaltyApplied: {
+		"en": "Your account is blocked for {minutes} minutes.",
+		"fa": "حساب شما به مدت {minutes} دقیقه مسدود شده است.",
+	},
+	MessageUserSuspended: {
+		"en": "Your account has been suspended.",
+		"fa": "حساب شما تعلیق شده است.",
+	},
+	MessageManagerDigestDaily: {
+		"en": "Daily report for {manager}: {new_users} new users, {traffic} GB traffic, {suspensions} suspensions, {nodes_offline} nodes offline.",
+		"fa": "گزارش روزانه {manager}: {new_users} کاربر جدید، {traffic} گیگابایت ترافیک، {suspensions} تعلیق، {nodes_offline} سرور آفلاین.",
+	},
+	MessageManagerDigestWeekly: {
+		"en": "Weekly report for {manager}: {new_users} new users, {traffic} GB traffic, {suspensions} suspensions, {nodes_offline} nodes offline.",
+		"fa": "گزارش هفتگی {manager}: {new_users} کاربر جدید، {traffic} گیگابایت ترافیک، {suspensions} تعلیق، {nodes_offline} سرور آفلاین.",
+	},
+}
+
+// SupportedLanguages returns the languages the catalog translates, default
+// first
+func SupportedLanguages() []string {
+	return append([]string(nil), supportedLanguages...)
+}
+
+// IsSupportedLanguage reports whether the catalog translates lang
+func IsSupportedLanguage(lang string) bool {
+	for _, l := range supportedLanguages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// Translate returns the message for key in lang, falling back to the default
+// language, with each {name} placeholder replaced from params. Unknown keys
+// are returned as is.
+func Translate(key MessageKey, lang string, params map[string]string) string {
+	texts, ok := messageCatalog[key]
+	if !ok {
+		return string(key)
+	}
+	msg, ok := texts[lang]
+	if !ok {
+		msg = texts[DefaultLanguage]
+	}
+	for name, value := range params {
+		msg = strings.ReplaceAll(msg, "{"+name+"}", value)
+	}
+	return msg
+}
+
+// Messages returns every catalog message in lang
+func Messages(lang string) map[MessageKey]string {
+	out := make(map[MessageKey]string, len(messageCatalog))
+	for key := range messageCatalog {
+		out[key] = Translate(key, lang, nil)
+	}
+	return out
+}
+
+// NegotiateLanguage returns the first supported language from candidates,
+// or the default language. A candidate may be a plain tag ("fa", "fa-IR") or
+// an Accept-Language header, whose entries are tried in q-value order.
+func NegotiateLanguage(candidates ...string) string {
+	for _, candidate := range candidates {
+		for _, tag := range acceptedLanguages(candidate) {
+			if IsSupportedLanguage(tag) {
+				return tag
+			}
+		}
+	}
+	return DefaultLanguage
+}
+
+// acceptedLanguages parses an Accept-Language value into primary subtags,
+// highest quality first
+func acceptedLanguages(header string) []string {
+	type entry struct {
+		tag string
+		q   float64
+	}
+	var entries []entry
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), "-")
+		tag = strings.ToLower(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			entries = append(entries, entry{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+
+	tags := make([]string, len(entries))
+	for i, e := range entries {
+		tags[i] = e.tag
+	}
+	return tags
+}
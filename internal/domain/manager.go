@@ -10,6 +10,15 @@ const (
 	EnforcementModeHard    EnforcementMode = "hard"
 )
 
+// IsValid reports whether the mode is known
+func (m EnforcementMode) IsValid() bool {
+	switch m {
+	case EnforcementModeSoft, EnforcementModeDefault, EnforcementModeHard:
+		return true
+	}
+	return false
+}
+
 type ManagerPackageStatus string
 
 const (
@@ -17,6 +26,11 @@ const (
 	ManagerPackageStatusActive   ManagerPackageStatus = "active"
 )
 
+// IsValid reports whether the status is known
+func (s ManagerPackageStatus) IsValid() bool {
+	return s == ManagerPackageStatusActive || s == ManagerPackageStatusInactive
+}
+
 type ManagerPackage struct {
 	ManagerID       string               `json:"manager_id" db:"manager_id"`
 	TotalLimit      int64                `json:"total_limit" db:"total_limit"`
@@ -43,6 +57,12 @@ func (p *ManagerPackage) IsActive() bool {
 	return p != nil && p.Status == ManagerPackageStatusActive
 }
 
+// HasNegativeLimits reports whether any limit is negative
+func (p *ManagerPackage) HasNegativeLimits() bool {
+	return p.TotalLimit < 0 || p.UploadLimit < 0 || p.DownloadLimit < 0 || p.Duration < 0 ||
+		p.MaxSessions < 0 || p.MaxOnlineUsers < 0 || p.MaxActiveUsers < 0
+}
+
 type Manager struct {
 	ID        string                 `json:"id" db:"id"`
 	Name      string                 `json:"name" db:"name"`
@@ -56,3 +76,215 @@ type Manager struct {
 func (m *Manager) HasParent() bool {
 	return m != nil && m.ParentID != nil && *m.ParentID != ""
 }
+
+// ManagerPackageLimits are the settable fields of a manager's package
+type ManagerPackageLimits struct {
+	TotalLimit     int64                `json:"total_limit"`
+	UploadLimit    int64                `json:"upload_limit"`
+	DownloadLimit  int64                `json:"download_limit"`
+	ResetMode      ResetMode            `json:"reset_mode"`
+	Duration       int64                `json:"duration"` // Seconds
+	StartAt        *time.Time           `json:"start_at,omitempty"`
+	MaxSessions    int                  `json:"max_sessions"`
+	MaxOnlineUsers int                  `json:"max_online_users"`
+	MaxActiveUsers int                  `json:"max_active_users"`
+	Status         ManagerPackageStatus `json:"status"`
+}
+
+// NewPackage builds a manager's package from the limits. An empty reset mode
+// means no reset and an empty status means active.
+func (l ManagerPackageLimits) NewPackage(managerID string) *ManagerPackage {
+	pkg := &ManagerPackage{
+		ManagerID:      managerID,
+		TotalLimit:     l.TotalLimit,
+		UploadLimit:    l.UploadLimit,
+		DownloadLimit:  l.DownloadLimit,
+		ResetMode:      l.ResetMode,
+		Duration:       l.Duration,
+		StartAt:        l.StartAt,
+		MaxSessions:    l.MaxSessions,
+		MaxOnlineUsers: l.MaxOnlineUsers,
+		MaxActiveUsers: l.MaxActiveUsers,
+		Status:         l.Status,
+	}
+	if pkg.ResetMode == "" {
+		pkg.ResetMode = ResetModeNoReset
+	}
+	if pkg.Status == "" {
+		pkg.Status = ManagerPackageStatusActive
+	}
+	return pkg
+}
+
+// ManagerCreate represents the input for creating a manager
+type ManagerCreate struct {
+	ID       string                 `json:"id,omitempty"` // Generated when empty
+	Name     string                 `json:"name" validate:"required"`
+	ParentID *string                `json:"parent_id,omitempty"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Package  ManagerPackageLimits   `json:"package"`
+}
+
+// ManagerPackageUpdate represents the input for updating a manager's
+// package limits
+type ManagerPackageUpdate struct {
+	TotalLimit     *int64                `json:"total_limit,omitempty"`
+	UploadLimit    *int64                `json:"upload_limit,omitempty"`
+	DownloadLimit  *int64                `json:"download_limit,omitempty"`
+	ResetMode      *ResetMode            `json:"reset_mode,omitempty"`
+	Duration       *int64                `json:"duration,omitempty"`
+	StartAt        *time.Time            `json:"start_at,omitempty"`
+	MaxSessions    *int                  `json:"max_sessions,omitempty"`
+	MaxOnlineUsers *int                  `json:"max_online_users,omitempty"`
+	MaxActiveUsers *int                  `json:"max_active_users,omitempty"`
+	Status         *ManagerPackageStatus `json:"status,omitempty"`
+}
+
+// Apply copies the set fields onto pkg
+func (u *ManagerPackageUpdate) Apply(pkg *ManagerPackage) {
+	if u.TotalLimit != nil {
+		pkg.TotalLimit = *u.TotalLimit
+	}
+	if u.UploadLimit != nil {
+		pkg.UploadLimit = *u.UploadLimit
+	}
+	if u.DownloadLimit != nil {
+		pkg.DownloadLimit = *u.DownloadLimit
+	}
+	if u.ResetMode != nil {
+		pkg.ResetMode = *u.ResetMode
+	}
+	if u.Duration != nil {
+		pkg.Duration = *u.Duration
+	}
+	if u.StartAt != nil {
+		pkg.StartAt = u.StartAt
+	}
+	if u.MaxSessions != nil {
+		pkg.MaxSessions = *u.MaxSessions
+	}
+	if u.MaxOnlineUsers != nil {
+		pkg.MaxOnlineUsers = *u.MaxOnlineUsers
+	}
+	if u.MaxActiveUsers != nil {
+		pkg.MaxActiveUsers = *u.MaxActiveUsers
+	}
+	if u.Status != nil {
+		pkg.Status = *u.Status
+	}
+}
+
+// ManagerUpdate represents the input for updating a manager. An empty
+// parent_id detaches the manager from its parent.
+type ManagerUpdate struct {
+	Name     *string                 `json:"name,omitempty"`
+	ParentID *string                 `json:"parent_id,omitempty"`
+	Metadata *map[string]interface{} `json:"metadata,omitempty"`
+	Package  *ManagerPackageUpdate   `json:"package,omitempty"`
+}
+
+// ManagerTreeNode is a manager in a subtree with its children. A package's
+// usage counters already include its descendants' usage; the subtree counts
+// roll the user counts up the same way.
+type ManagerTreeNode struct {
+	ID                 string                 `json:"id"`
+	Name               string                 `json:"name"`
+	ParentID           *string                `json:"parent_id,omitempty"`
+	Metadata           map[string]interface{} `json:"metadata,omitempty"`
+	Package            *ManagerPackage        `json:"package,omitempty"`
+	Users              int64                  `json:"users"`        // Owned by this manager
+	ActiveUsers        int64                  `json:"active_users"` // Owned by this manager and active
+	SubtreeUsers       int64                  `json:"subtree_users"`
+	SubtreeActiveUsers int64                  `json:"subtree_active_users"`
+	Children           []*ManagerTreeNode     `json:"children"`
+	CreatedAt          time.Time              `json:"created_at"`
+	UpdatedAt          time.Time              `json:"updated_at"`
+}
+
+// Rollup sets the subtree counts of n and its descendants
+func (n *ManagerTreeNode) Rollup() {
+	n.SubtreeUsers, n.SubtreeActiveUsers = n.Users, n.ActiveUsers
+	for _, child := range n.Children {
+		child.Rollup()
+		n.SubtreeUsers += child.SubtreeUsers
+		n.SubtreeActiveUsers += child.SubtreeActiveUsers
+	}
+}
+
+// ManagerScopeAllows reports whether infrastructure owned by ownerID may be
+// seen or used by a manager whose chain (self first, then ancestors) is given.
+// Infrastructure without an owner is shared by everyone.
+func ManagerScopeAllows(ownerID *string, chain []string) bool {
+	if ownerID == nil || *ownerID == "" {
+		return true
+	}
+	for _, id := range chain {
+		if id == *ownerID {
+			return true
+		}
+	}
+	return false
+}
+
+type TopUpStatus string
+
+const (
+	TopUpStatusPending  TopUpStatus = "pending"
+	TopUpStatusApproved TopUpStatus = "approved"
+	TopUpStatusRejected TopUpStatus = "rejected"
+)
+
+// IsValid reports whether the status is known
+func (s TopUpStatus) IsValid() bool {
+	return s == TopUpStatusPending || s == TopUpStatusApproved || s == TopUpStatusRejected
+}
+
+// ManagerTopUp is a manager's request for more quota. The amounts are added
+// to the manager's package limits when its parent approves; the record is
+// kept either way as an audit trail.
+type ManagerTopUp struct {
+	ID             string      `json:"id" db:"id"`
+	ManagerID      string      `json:"manager_id" db:"manager_id"`
+	ParentID       string      `json:"parent_id" db:"parent_id"` // Manager that decides the request
+	TotalLimit     int64       `json:"total_limit" db:"total_limit"`
+	UploadLimit    int64       `json:"upload_limit" db:"upload_limit"`
+	DownloadLimit  int64       `json:"download_limit" db:"download_limit"`
+	MaxSessions    int         `json:"max_sessions" db:"max_sessions"`
+	MaxOnlineUsers int         `json:"max_online_users" db:"max_online_users"`
+	MaxActiveUsers int         `json:"max_active_users" db:"max_active_users"`
+	Note           string      `json:"note,omitempty" db:"note"`
+	Status         TopUpStatus `json:"status" db:"status"`
+	RequestedBy    string      `json:"requested_by" db:"requested_by"` // API key ID, or "owner"
+	DecidedBy      string      `json:"decided_by,omitempty" db:"decided_by"`
+	DecisionNote   string      `json:"decision_note,omitempty" db:"decision_note"`
+	CreatedAt      time.Time   `json:"created_at" db:"created_at"`
+	DecidedAt      *time.Time  `json:"decided_at,omitempty" db:"decided_at"`
+}
+
+// IsEmpty reports whether the request asks for nothing
+func (t *ManagerTopUp) IsEmpty() bool {
+	return t.TotalLimit == 0 && t.UploadLimit == 0 && t.DownloadLimit == 0 &&
+		t.MaxSessions == 0 && t.MaxOnlineUsers == 0 && t.MaxActiveUsers == 0
+}
+
+// HasNegative reports whether any requested amount is negative
+func (t *ManagerTopUp) HasNegative() bool {
+	return t.TotalLimit < 0 || t.UploadLimit < 0 || t.DownloadLimit < 0 ||
+		t.MaxSessions < 0 || t.MaxOnlineUsers < 0 || t.MaxActiveUsers < 0
+}
+
+// ManagerTopUpCreate represents the input for requesting a top-up
+type ManagerTopUpCreate struct {
+	TotalLimit     int64  `json:"total_limit"`
+	UploadLimit    int64  `json:"upload_limit"`
+	DownloadLimit  int64  `json:"download_limit"`
+	MaxSessions    int    `json:"max_sessions"`
+	MaxOnlineUsers int    `json:"max_online_users"`
+	MaxActiveUsers int    `json:"max_active_users"`
+	Note           string `json:"note"`
+}
+
+// TopUpDecision is the body of the approve and reject endpoints
+type TopUpDecision struct {
+	Note string `json:"note"`
+}
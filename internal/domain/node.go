@@ -6,22 +6,57 @@ import (
 
 // Node represents a server hosting services
 type Node struct {
-	ID               string     `json:"id" db:"id"`
-	SecretKey        string     `json:"-" db:"secret_key"` // Omit from JSON responses
-	Name             string     `json:"name" db:"name"`
-	IPs              []string   `json:"ips,omitempty" db:"allowed_ips"`
-	AllowedIPs       []string   `json:"allowed_ips,omitempty" db:"allowed_ips"`
-	TrafficMultiplier float64   `json:"traffic_multiplier" db:"traffic_multiplier"`
-	ResetMode        ResetMode  `json:"reset_mode" db:"reset_mode"`
-	ResetDay         int        `json:"reset_day,omitempty" db:"reset_day"` // Day of week/month for reset
-	CurrentUpload    int64      `json:"current_upload" db:"current_upload"`
-	CurrentDownload  int64      `json:"current_download" db:"current_download"`
-	CurrentTotal     int64      `json:"current_total" db:"-"`
-	Country          string     `json:"country,omitempty" db:"country"`
-	City             string     `json:"city,omitempty" db:"city"`
-	ISP              string     `json:"isp,omitempty" db:"isp"`
-	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt        time.Time  `json:"updated_at" db:"updated_at"`
+	ID                string     `json:"id" db:"id"`
+	SecretKey         string     `json:"-" db:"secret_key"` // Omit from JSON responses
+	Name              string     `json:"name" db:"name"`
+	IPs               []string   `json:"ips,omitempty" db:"allowed_ips"`
+	AllowedIPs        []string   `json:"allowed_ips,omitempty" db:"allowed_ips"`
+	TrafficMultiplier float64    `json:"traffic_multiplier" db:"traffic_multiplier"`
+	ResetMode         ResetMode  `json:"reset_mode" db:"reset_mode"`
+	ResetDay          int        `json:"reset_day,omitempty" db:"reset_day"` // Day of week/month for reset
+	CurrentUpload     int64      `json:"current_upload" db:"current_upload"`
+	CurrentDownload   int64      `json:"current_download" db:"current_download"`
+	CurrentTotal      int64      `json:"current_total" db:"-"`
+	Country           string     `json:"country,omitempty" db:"country"`
+	City              string     `json:"city,omitempty" db:"city"`
+	ISP               string     `json:"isp,omitempty" db:"isp"`
+	Draining          bool       `json:"draining" db:"draining"`                 // Set while the node reports overload
+	ManagerID         *string    `json:"manager_id,omitempty" db:"manager_id"`   // Owning reseller; nil for shared nodes
+	MaxActiveUsers    int        `json:"max_active_users" db:"max_active_users"` // Distinct users served at once; 0 is unlimited
+	LastResetAt       *time.Time `json:"last_reset_at,omitempty" db:"last_reset_at"`
+	LastSeenAt        *time.Time `json:"last_seen_at,omitempty" db:"last_seen_at"`   // Last heartbeat
+	AgentVersion      string     `json:"agent_version,omitempty" db:"agent_version"` // Reported with heartbeats
+	CPUPercent        float64    `json:"cpu_percent,omitempty" db:"cpu_percent"`     // Load from the last heartbeat
+	ActiveConnections int64      `json:"active_connections,omitempty" db:"active_connections"`
+	BandwidthBps      int64      `json:"bandwidth_bps,omitempty" db:"bandwidth_bps"`
+	DownAt            *time.Time `json:"down_at,omitempty" db:"down_at"` // When NODE_DOWN was emitted; cleared by the next heartbeat
+	CreatedAt         time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+
+	Health *NodeHealth `json:"health,omitempty" db:"-"` // Filled in by listings, not stored
+}
+
+// NodeHealth scores how well a node is serving right now, from 0 (keep users
+// away) to 100, so panels can prefer healthy nodes when generating configs
+type NodeHealth struct {
+	Score             int        `json:"score"`
+	Online            bool       `json:"online"` // Sent a heartbeat within the heartbeat timeout
+	Draining          bool       `json:"draining"`
+	LastHeartbeatAt   *time.Time `json:"last_heartbeat_at,omitempty"`
+	ErrorRate         float64    `json:"error_rate"`         // Share of recent reports that were rejected
+	DisconnectBacklog int        `json:"disconnect_backlog"` // Disconnects queued and not yet fetched
+}
+
+// NodeUsageSnapshot records a node's counters at the moment they were reset
+type NodeUsageSnapshot struct {
+	ID          string    `json:"id"`
+	NodeID      string    `json:"node_id"`
+	ResetMode   ResetMode `json:"reset_mode"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+	Total       int64     `json:"total"`
+	PeriodStart time.Time `json:"period_start"` // Previous reset, or when the node was created
+	ResetAt     time.Time `json:"reset_at"`
 }
 
 // NodeCreate represents the input for creating a new node
@@ -35,19 +70,54 @@ type NodeCreate struct {
 	Country           string    `json:"country,omitempty"`
 	City              string    `json:"city,omitempty"`
 	ISP               string    `json:"isp,omitempty"`
+	ManagerID         *string   `json:"manager_id,omitempty"`
+	MaxActiveUsers    int       `json:"max_active_users,omitempty"`
 }
 
 // NodeUpdate represents the input for updating a node
 type NodeUpdate struct {
-	Name              *string   `json:"name,omitempty"`
-	SecretKey         *string   `json:"secret_key,omitempty"`
-	AllowedIPs        *[]string `json:"allowed_ips,omitempty"`
-	TrafficMultiplier *float64  `json:"traffic_multiplier,omitempty"`
+	Name              *string    `json:"name,omitempty"`
+	SecretKey         *string    `json:"secret_key,omitempty"`
+	AllowedIPs        *[]string  `json:"allowed_ips,omitempty"`
+	TrafficMultiplier *float64   `json:"traffic_multiplier,omitempty"`
 	ResetMode         *ResetMode `json:"reset_mode,omitempty"`
-	ResetDay          *int      `json:"reset_day,omitempty"`
-	Country           *string   `json:"country,omitempty"`
-	City              *string   `json:"city,omitempty"`
-	ISP               *string   `json:"isp,omitempty"`
+	ResetDay          *int       `json:"reset_day,omitempty"`
+	Country           *string    `json:"country,omitempty"`
+	City              *string    `json:"city,omitempty"`
+	ISP               *string    `json:"isp,omitempty"`
+	MaxActiveUsers    *int       `json:"max_active_users,omitempty"`
+}
+
+// NodeLoad is the load snapshot a node reports with its heartbeat
+type NodeLoad struct {
+	NodeID            string  `json:"node_id"`
+	CPUPercent        float64 `json:"cpu_percent"`
+	ActiveConnections int64   `json:"active_connections"`
+	BandwidthBps      int64   `json:"bandwidth_bps"`
+	Overloaded        bool    `json:"overloaded"` // Node's own overload signal
+	ShedSessions      int     `json:"shed_sessions,omitempty"`
+	AgentVersion      string  `json:"agent_version,omitempty"`
+}
+
+// NodeLoadThresholds define when HUE considers a node overloaded on its own.
+// Zero values disable the corresponding check.
+type NodeLoadThresholds struct {
+	MaxCPUPercent   float64
+	MaxConnections  int64
+	MaxBandwidthBps int64
+}
+
+// Exceeded returns whether the load is above any threshold, and which one
+func (t NodeLoadThresholds) Exceeded(load *NodeLoad) (bool, string) {
+	switch {
+	case t.MaxCPUPercent > 0 && load.CPUPercent >= t.MaxCPUPercent:
+		return true, "cpu"
+	case t.MaxConnections > 0 && load.ActiveConnections >= t.MaxConnections:
+		return true, "connections"
+	case t.MaxBandwidthBps > 0 && load.BandwidthBps >= t.MaxBandwidthBps:
+		return true, "bandwidth"
+	}
+	return false, ""
 }
 
 // AddUsage adds upload and download bytes to the node counters
@@ -65,8 +135,102 @@ func (n *Node) ApplyMultiplier(upload, download int64) (int64, int64) {
 	if n.TrafficMultiplier == 0 || n.TrafficMultiplier == 1 {
 		return upload, download
 	}
-	return int64(float64(upload) * n.TrafficMultiplier), 
-	       int64(float64(download) * n.TrafficMultiplier)
+	return int64(float64(upload) * n.TrafficMultiplier),
+		int64(float64(download) * n.TrafficMultiplier)
+}
+
+// Bill splits reported traffic into the measured bytes and the bytes charged
+// after the traffic multiplier
+func (n *Node) Bill(upload, download int64) UsageTraffic {
+	billedUp, billedDown := n.ApplyMultiplier(upload, download)
+	multiplier := n.TrafficMultiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	return UsageTraffic{
+		RawUpload:      upload,
+		RawDownload:    download,
+		BilledUpload:   billedUp,
+		BilledDownload: billedDown,
+		Multiplier:     multiplier,
+	}
+}
+
+// LastScheduledReset returns the latest reset boundary at or before now, in
+// now's location, or the zero time when the node never resets. ResetDay is
+// the weekday for weekly resets (0 = Sunday), the day of the month for
+// monthly resets and the day of the year for yearly resets. A day past the
+// end of a month or year falls on its last day.
+func (n *Node) LastScheduledReset(now time.Time) time.Time {
+	loc := now.Location()
+	year, month, day := now.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, loc)
+
+	switch n.ResetMode {
+	case ResetModeHourly:
+		return time.Date(year, month, day, now.Hour(), 0, 0, 0, loc)
+	case ResetModeDaily:
+		return midnight
+	case ResetModeWeekly:
+		weekday := ((n.ResetDay % 7) + 7) % 7
+		back := (int(now.Weekday()) - weekday + 7) % 7
+		return midnight.AddDate(0, 0, -back)
+	case ResetModeMonthly:
+		boundary := monthlyReset(year, month, n.ResetDay, loc)
+		if boundary.After(now) {
+			boundary = monthlyReset(year, month-1, n.ResetDay, loc)
+		}
+		return boundary
+	case ResetModeYearly:
+		boundary := yearlyReset(year, n.ResetDay, loc)
+		if boundary.After(now) {
+			boundary = yearlyReset(year-1, n.ResetDay, loc)
+		}
+		return boundary
+	}
+	return time.Time{}
+}
+
+// ResetDue reports whether a reset boundary passed since the node was last
+// reset, or since it was created if it never was
+func (n *Node) ResetDue(now time.Time) bool {
+	boundary := n.LastScheduledReset(now)
+	if boundary.IsZero() {
+		return false
+	}
+	last := n.CreatedAt
+	if n.LastResetAt != nil {
+		last = *n.LastResetAt
+	}
+	return last.Before(boundary)
+}
+
+// monthlyReset is midnight on the given day of a month, clamped to the
+// month's length
+func monthlyReset(year int, month time.Month, day int, loc *time.Location) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	days := first.AddDate(0, 1, -1).Day()
+	if day < 1 {
+		day = 1
+	}
+	if day > days {
+		day = days
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// yearlyReset is midnight on the given day of a year, clamped to the year's
+// length
+func yearlyReset(year, day int, loc *time.Location) time.Time {
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	days := first.AddDate(1, 0, -1).YearDay()
+	if day < 1 {
+		day = 1
+	}
+	if day > days {
+		day = days
+	}
+	return first.AddDate(0, 0, day-1)
 }
 
 func (n *Node) syncIPs() {
@@ -0,0 +1,30 @@
+package domain
+
+import "time"
+
+// NodeSyncUser is a user a node may serve, with the credentials to
+// configure it and the limits the node can enforce on its own while HUE is
+// unreachable. The user ID is the UUID VLESS/VMess clients connect with and
+// ProtocolSecret the Trojan/Shadowsocks password. Login passwords are stored
+// hashed and are checked with VerifyUserPassword instead.
+type NodeSyncUser struct {
+	UserID         string     `json:"user_id"`
+	Username       string     `json:"username"`
+	PublicKey      string     `json:"public_key,omitempty"`
+	ProtocolSecret string     `json:"protocol_secret,omitempty"`
+	Status         UserStatus `json:"status"`
+	Remaining      int64      `json:"remaining"` // Bytes the node may still measure; -1 is unlimited
+	MaxConcurrent  int        `json:"max_concurrent"`
+	MaxIPs         int        `json:"max_ips"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+}
+
+// NodeSync is a full snapshot or an incremental update of the users a node
+// may serve. Nodes pass Cursor back to receive only later changes.
+type NodeSync struct {
+	NodeID  string          `json:"node_id"`
+	Cursor  int64           `json:"cursor"`
+	Full    bool            `json:"full"`
+	Users   []*NodeSyncUser `json:"users"`   // Users added or changed
+	Removed []string        `json:"removed"` // User IDs the node must stop serving
+}
@@ -12,6 +12,9 @@ const (
 	PackageStatusExpired   PackageStatus = "expired"
 	PackageStatusFinish    PackageStatus = "finish"
 	PackageStatusSuspended PackageStatus = "suspended"
+	// PackageStatusQueued waits in the user's queue and becomes active when
+	// the package before it finishes or expires
+	PackageStatusQueued PackageStatus = "queued"
 )
 
 // ResetMode defines how usage counters are reset
@@ -26,49 +29,206 @@ const (
 	ResetModeYearly  ResetMode = "yearly"
 )
 
+// PackagePriority is the QoS class of a package. When a node is congested,
+// sessions of lower priority packages are shed first.
+type PackagePriority string
+
+const (
+	PackagePriorityBronze PackagePriority = "bronze"
+	PackagePrioritySilver PackagePriority = "silver"
+	PackagePriorityGold   PackagePriority = "gold"
+
+	// DefaultPackagePriority applies to packages created without a priority
+	// and to users that have no package
+	DefaultPackagePriority = PackagePrioritySilver
+)
+
+// Rank returns the relative weight of the priority, higher is more important
+func (p PackagePriority) Rank() int {
+	switch p {
+	case PackagePriorityGold:
+		return 3
+	case PackagePrioritySilver:
+		return 2
+	case PackagePriorityBronze:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// IsValid returns true if the priority is one of the known classes
+func (p PackagePriority) IsValid() bool {
+	return p.Rank() > 0
+}
+
+// SessionIdentity selects what counts as one concurrent session. Users behind
+// CGNAT churn IPs constantly, so they can be counted per subnet or per device
+// instead of per reported session.
+type SessionIdentity string
+
+const (
+	SessionIdentitySession SessionIdentity = "session" // Session ID only
+	SessionIdentitySubnet  SessionIdentity = "subnet"  // IPv4 /24, IPv6 /64
+	SessionIdentityDevice  SessionIdentity = "device"  // Client-reported device ID
+)
+
+// IsValid returns true if the strategy is one of the known identities
+func (s SessionIdentity) IsValid() bool {
+	switch s {
+	case SessionIdentitySession, SessionIdentitySubnet, SessionIdentityDevice:
+		return true
+	default:
+		return false
+	}
+}
+
+// SessionReplace controls how a new session from the same IP as a session
+// that has gone quiet is counted. Clients that reconnect quickly get a new
+// session ID while the old one is still inside the concurrency window.
+type SessionReplace string
+
+const (
+	SessionReplaceOff    SessionReplace = "off"     // Count the old session until it expires
+	SessionReplaceSameIP SessionReplace = "same_ip" // Replace a stale session with the same IP hash
+)
+
+// IsValid returns true if the mode is one of the known replacement modes
+func (r SessionReplace) IsValid() bool {
+	return r == SessionReplaceOff || r == SessionReplaceSameIP
+}
+
+// CountMode selects which direction of traffic counts against a package's
+// TotalTraffic. Upload and download limits always apply to their own
+// direction.
+type CountMode string
+
+const (
+	CountModeTotal    CountMode = "total"    // Upload plus download
+	CountModeDownload CountMode = "download" // Download only
+	CountModeUpload   CountMode = "upload"   // Upload only
+)
+
+// IsValid returns true if the mode is known. The empty mode counts the total.
+func (m CountMode) IsValid() bool {
+	switch m {
+	case "", CountModeTotal, CountModeDownload, CountModeUpload:
+		return true
+	default:
+		return false
+	}
+}
+
+// Counted returns the bytes that count against TotalTraffic
+func (m CountMode) Counted(upload, download int64) int64 {
+	switch m {
+	case CountModeDownload:
+		return download
+	case CountModeUpload:
+		return upload
+	default:
+		return upload + download
+	}
+}
+
 // Package represents a subscription package
 type Package struct {
-	ID              string        `json:"id" db:"id"`
-	UserID          string        `json:"user_id" db:"user_id"`
-	TotalLimit      int64         `json:"total_limit" db:"total_traffic"`
-	TotalTraffic    int64         `json:"total_traffic" db:"total_traffic"`       // Bytes
-	UploadLimit     int64         `json:"upload_limit,omitempty" db:"upload_limit"`   // Bytes, 0 = unlimited
-	DownloadLimit   int64         `json:"download_limit,omitempty" db:"download_limit"` // Bytes, 0 = unlimited
-	ResetMode       ResetMode     `json:"reset_mode" db:"reset_mode"`
-	Duration        int64         `json:"duration" db:"duration"` // Seconds
-	StartAt         *time.Time    `json:"start_at,omitempty" db:"start_at"`
-	MaxConcurrent   int           `json:"max_concurrent" db:"max_concurrent"`
-	Status          PackageStatus `json:"status" db:"status"`
-	CurrentUpload   int64         `json:"current_upload" db:"current_upload"`
-	CurrentDownload int64         `json:"current_download" db:"current_download"`
-	CurrentTotal    int64         `json:"current_total" db:"current_total"`
-	ExpiresAt       *time.Time    `json:"expires_at,omitempty" db:"expires_at"`
-	CreatedAt       time.Time     `json:"created_at" db:"created_at"`
-	UpdatedAt       time.Time     `json:"updated_at" db:"updated_at"`
+	ID                string          `json:"id" db:"id"`
+	UserID            string          `json:"user_id" db:"user_id"`
+	TotalLimit        int64           `json:"total_limit" db:"total_traffic"`
+	TotalTraffic      int64           `json:"total_traffic" db:"total_traffic"`             // Bytes
+	UploadLimit       int64           `json:"upload_limit,omitempty" db:"upload_limit"`     // Bytes, 0 = unlimited
+	DownloadLimit     int64           `json:"download_limit,omitempty" db:"download_limit"` // Bytes, 0 = unlimited
+	CountMode         CountMode       `json:"count_mode,omitempty" db:"count_mode"`         // Empty = total
+	ResetMode         ResetMode       `json:"reset_mode" db:"reset_mode"`
+	Duration          int64           `json:"duration" db:"duration"` // Seconds
+	StartAt           *time.Time      `json:"start_at,omitempty" db:"start_at"`
+	MaxConcurrent     int             `json:"max_concurrent" db:"max_concurrent"`
+	MaxIPs            int             `json:"max_ips,omitempty" db:"max_ips"`                       // Distinct client IPs, 0 = unlimited
+	MaxDevices        int             `json:"max_devices,omitempty" db:"max_devices"`               // Approved devices, 0 = unlimited
+	ThrottleThreshold int             `json:"throttle_threshold,omitempty" db:"throttle_threshold"` // Percent of total_traffic, 0 = never throttle
+	ThrottleRate      int64           `json:"throttle_rate,omitempty" db:"throttle_rate"`           // Bytes/sec suggested past the threshold
+	PenaltyDuration   int64           `json:"penalty_duration,omitempty" db:"penalty_duration"`     // Seconds, 0 = server default
+	PenaltyAction     PenaltyAction   `json:"penalty_action,omitempty" db:"penalty_action"`         // Empty = disconnect
+	Priority          PackagePriority `json:"priority" db:"priority"`
+	SessionIdentity   SessionIdentity `json:"session_identity,omitempty" db:"session_identity"`   // Empty = inherit from group/default
+	SessionReplace    SessionReplace  `json:"session_replace,omitempty" db:"session_replace"`     // Empty = server default
+	AllowedNodes      []string        `json:"allowed_nodes,omitempty" db:"allowed_nodes"`         // Empty = all nodes
+	AllowedServices   []string        `json:"allowed_services,omitempty" db:"allowed_services"`   // Empty = all services
+	AllowedCountries  []string        `json:"allowed_countries,omitempty" db:"allowed_countries"` // Empty = all countries
+	DeniedCountries   []string        `json:"denied_countries,omitempty" db:"denied_countries"`
+	Status            PackageStatus   `json:"status" db:"status"`
+	CurrentUpload     int64           `json:"current_upload" db:"current_upload"`
+	CurrentDownload   int64           `json:"current_download" db:"current_download"`
+	CurrentTotal      int64           `json:"current_total" db:"current_total"`
+	Reserved          int64           `json:"reserved" db:"reserved"`                       // Billed bytes held by open quota reservations
+	QueuePosition     int             `json:"queue_position,omitempty" db:"queue_position"` // Order among the user's queued packages
+	ExpiresAt         *time.Time      `json:"expires_at,omitempty" db:"expires_at"`
+	CreatedAt         time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time       `json:"updated_at" db:"updated_at"`
 }
 
 // PackageCreate represents the input for creating a new package
 type PackageCreate struct {
-	UserID        string     `json:"user_id" validate:"required"`
-	TotalLimit    int64      `json:"total_limit"`
-	TotalTraffic  int64      `json:"total_traffic" validate:"min=0"`
-	UploadLimit   int64      `json:"upload_limit,omitempty"`
-	DownloadLimit int64      `json:"download_limit,omitempty"`
-	ResetMode     ResetMode  `json:"reset_mode" validate:"required"`
-	Duration      int64      `json:"duration" validate:"required,min=1"` // Seconds
-	StartAt       *time.Time `json:"start_at,omitempty"`
-	MaxConcurrent int        `json:"max_concurrent" validate:"min=1"`
+	UserID            string          `json:"user_id" validate:"required"`
+	TotalLimit        int64           `json:"total_limit"`
+	TotalTraffic      int64           `json:"total_traffic" validate:"min=0"`
+	UploadLimit       int64           `json:"upload_limit,omitempty"`
+	DownloadLimit     int64           `json:"download_limit,omitempty"`
+	CountMode         CountMode       `json:"count_mode,omitempty"`
+	ResetMode         ResetMode       `json:"reset_mode" validate:"required"`
+	Duration          int64           `json:"duration" validate:"required,min=1"` // Seconds
+	StartAt           *time.Time      `json:"start_at,omitempty"`
+	MaxConcurrent     int             `json:"max_concurrent" validate:"min=1"`
+	MaxIPs            int             `json:"max_ips,omitempty" validate:"min=0"`
+	MaxDevices        int             `json:"max_devices,omitempty" validate:"min=0"`
+	ThrottleThreshold int             `json:"throttle_threshold,omitempty" validate:"min=0,max=100"`
+	ThrottleRate      int64           `json:"throttle_rate,omitempty" validate:"min=0"`
+	PenaltyDuration   int64           `json:"penalty_duration,omitempty" validate:"min=0"` // Seconds
+	PenaltyAction     PenaltyAction   `json:"penalty_action,omitempty"`
+	Priority          PackagePriority `json:"priority,omitempty"`
+	SessionIdentity   SessionIdentity `json:"session_identity,omitempty"`
+	SessionReplace    SessionReplace  `json:"session_replace,omitempty"`
+	AllowedNodes      []string        `json:"allowed_nodes,omitempty"`
+	AllowedServices   []string        `json:"allowed_services,omitempty"`
+	AllowedCountries  []string        `json:"allowed_countries,omitempty"`
+	DeniedCountries   []string        `json:"denied_countries,omitempty"`
+	Queued            bool            `json:"queued,omitempty"`                          // Add to the user's queue instead of creating it active
+	QueuePosition     int             `json:"queue_position,omitempty" validate:"min=0"` // Order in the queue; 0 appends
 }
 
 // PackageUpdate represents the input for updating a package
 type PackageUpdate struct {
-	TotalTraffic    *int64        `json:"total_traffic,omitempty"`
-	UploadLimit     *int64        `json:"upload_limit,omitempty"`
-	DownloadLimit   *int64        `json:"download_limit,omitempty"`
-	ResetMode       *ResetMode    `json:"reset_mode,omitempty"`
-	Duration        *int64        `json:"duration,omitempty"`
-	MaxConcurrent   *int          `json:"max_concurrent,omitempty"`
-	Status          *PackageStatus `json:"status,omitempty"`
+	TotalTraffic      *int64           `json:"total_traffic,omitempty"`
+	UploadLimit       *int64           `json:"upload_limit,omitempty"`
+	DownloadLimit     *int64           `json:"download_limit,omitempty"`
+	ResetMode         *ResetMode       `json:"reset_mode,omitempty"`
+	Duration          *int64           `json:"duration,omitempty"`
+	MaxConcurrent     *int             `json:"max_concurrent,omitempty"`
+	MaxIPs            *int             `json:"max_ips,omitempty"`
+	MaxDevices        *int             `json:"max_devices,omitempty"`
+	ThrottleThreshold *int             `json:"throttle_threshold,omitempty"`
+	ThrottleRate      *int64           `json:"throttle_rate,omitempty"`
+	PenaltyDuration   *int64           `json:"penalty_duration,omitempty"`
+	PenaltyAction     *PenaltyAction   `json:"penalty_action,omitempty"`
+	Priority          *PackagePriority `json:"priority,omitempty"`
+	SessionIdentity   *SessionIdentity `json:"session_identity,omitempty"`
+	SessionReplace    *SessionReplace  `json:"session_replace,omitempty"`
+	AllowedNodes      *[]string        `json:"allowed_nodes,omitempty"`
+	AllowedServices   *[]string        `json:"allowed_services,omitempty"`
+	AllowedCountries  *[]string        `json:"allowed_countries,omitempty"`
+	DeniedCountries   *[]string        `json:"denied_countries,omitempty"`
+	Status            *PackageStatus   `json:"status,omitempty"`
+}
+
+// Permits returns true if the package's allow-lists permit the node and service
+func (p *Package) Permits(nodeID, serviceID string) bool {
+	return AllowListPermits(p.AllowedNodes, nodeID) && AllowListPermits(p.AllowedServices, serviceID)
+}
+
+// PermitsCountry returns true if the package's country lists permit geo
+func (p *Package) PermitsCountry(geo *GeoData) bool {
+	return CountryPermits(p.AllowedCountries, p.DeniedCountries, geo)
 }
 
 // IsActive returns true if the package is active
@@ -78,10 +238,38 @@ func (p *Package) IsActive() bool {
 
 // IsExpired returns true if the package has expired
 func (p *Package) IsExpired() bool {
-	if p.ExpiresAt == nil {
-		return false
+	return p.IsExpiredAt(time.Now())
+}
+
+// IsExpiredAt returns true if the package's expiry lies before now
+func (p *Package) IsExpiredAt(now time.Time) bool {
+	expiry := p.ExpiryTime()
+	return expiry != nil && now.After(*expiry)
+}
+
+// ExpiryTime returns when the package expires: ExpiresAt when set, else
+// StartAt plus Duration. It returns nil for a package that has not started
+// or has no duration.
+func (p *Package) ExpiryTime() *time.Time {
+	if p.ExpiresAt != nil {
+		return p.ExpiresAt
+	}
+	if p.StartAt == nil || p.Duration <= 0 {
+		return nil
+	}
+	expiry := p.StartAt.Add(time.Duration(p.Duration) * time.Second)
+	return &expiry
+}
+
+// Start starts a package's duration at the given time and sets ExpiresAt
+// from it. A package without a duration never expires.
+func (p *Package) Start(at time.Time) {
+	p.StartAt = &at
+	p.ExpiresAt = nil
+	if p.Duration > 0 {
+		expiry := at.Add(time.Duration(p.Duration) * time.Second)
+		p.ExpiresAt = &expiry
 	}
-	return time.Now().After(*p.ExpiresAt)
 }
 
 // HasTrafficRemaining returns true if there is traffic quota remaining
@@ -93,7 +281,32 @@ func (p *Package) HasTrafficRemaining() bool {
 	if total == 0 {
 		return true // Unlimited
 	}
-	return p.CurrentTotal < total
+	return p.CountedUsage() < total
+}
+
+// ThrottleRateAt returns the rate limit in bytes per second suggested once
+// used counted bytes reach the throttle threshold, or 0 when the package is
+// not throttled
+func (p *Package) ThrottleRateAt(used int64) int64 {
+	if p.ThrottleThreshold <= 0 || p.ThrottleRate <= 0 || p.TotalTraffic <= 0 {
+		return 0
+	}
+	if used*100 < p.TotalTraffic*int64(p.ThrottleThreshold) {
+		return 0
+	}
+	return p.ThrottleRate
+}
+
+// CountedUsage returns the used bytes that count against TotalTraffic
+func (p *Package) CountedUsage() int64 {
+	switch p.CountMode {
+	case CountModeDownload:
+		return p.CurrentDownload
+	case CountModeUpload:
+		return p.CurrentUpload
+	default:
+		return p.CurrentTotal
+	}
 }
 
 // HasUploadRemaining returns true if upload quota is remaining
@@ -135,7 +348,7 @@ func (p *Package) AddUsage(upload, download int64) {
 // CalculateNextReset returns the next reset time based on reset mode
 func (p *Package) CalculateNextReset() *time.Time {
 	now := time.Now()
-	
+
 	switch p.ResetMode {
 	case ResetModeHourly:
 		next := now.Add(time.Hour)
@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PanelDelivery is the delivery state of a panel callback
+type PanelDelivery string
+
+const (
+	PanelDeliveryPending   PanelDelivery = "pending"
+	PanelDeliveryDelivered PanelDelivery = "delivered"
+)
+
+// PanelCallback is a user status change queued for the Hiddify panel. Seq
+// orders callbacks and lets the panel ask for the ones it missed.
+type PanelCallback struct {
+	Seq         int64         `json:"sequence" db:"seq"`
+	ID          string        `json:"id" db:"id"`
+	EventID     string        `json:"event_id" db:"event_id"`
+	EventType   EventType     `json:"event" db:"event_type"`
+	UserID      string        `json:"user_id" db:"user_id"`
+	PackageID   string        `json:"package_id,omitempty" db:"package_id"`
+	Status      string        `json:"status" db:"status"`
+	Reason      string        `json:"reason,omitempty" db:"reason"`
+	OccurredAt  time.Time     `json:"occurred_at" db:"occurred_at"`
+	ExpiresAt   *time.Time    `json:"expires_at,omitempty" db:"expires_at"`
+	Delivery    PanelDelivery `json:"delivery" db:"delivery"`
+	Attempts    int           `json:"attempts" db:"attempts"`
+	LastError   string        `json:"last_error,omitempty" db:"last_error"`
+	DeliveredAt *time.Time    `json:"delivered_at,omitempty" db:"delivered_at"`
+}
+
+// PenaltyInfo is the metadata of a PENALTY_APPLIED event
+type PenaltyInfo struct {
+	Reason    string        `json:"reason"`
+	Action    PenaltyAction `json:"action,omitempty"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	Strike    int           `json:"strike,omitempty"` // Penalties in a row, when escalation is on
+}
+
+// Metadata encodes the penalty as event metadata
+func (p PenaltyInfo) Metadata() []byte {
+	data, _ := json.Marshal(p)
+	return data
+}
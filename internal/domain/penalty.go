@@ -0,0 +1,62 @@
+package domain
+
+import "time"
+
+// PenaltyAction is what a penalty does to the user it is applied to
+type PenaltyAction string
+
+const (
+	PenaltyActionDisconnect PenaltyAction = "disconnect" // Reject every report and disconnect all sessions
+	PenaltyActionReject     PenaltyAction = "reject"     // Reject new sessions, keep the active ones
+	PenaltyActionNone       PenaltyAction = "none"       // Reject only the offending report, no penalty
+)
+
+// IsValid returns true if the action is one of the known penalty actions
+func (a PenaltyAction) IsValid() bool {
+	return a == PenaltyActionDisconnect || a == PenaltyActionReject || a == PenaltyActionNone
+}
+
+// severity orders actions from none to disconnect; unset ranks below none
+func (a PenaltyAction) severity() int {
+	switch a {
+	case PenaltyActionNone:
+		return 1
+	case PenaltyActionReject:
+		return 2
+	case PenaltyActionDisconnect:
+		return 3
+	}
+	return 0
+}
+
+// PenaltyPolicy is how a package or group wants its users penalized. Zero
+// fields fall back to the server's penalty duration and the disconnect
+// action.
+type PenaltyPolicy struct {
+	Duration time.Duration
+	Action   PenaltyAction
+}
+
+// ResolvePenaltyPolicy returns the penalty policy for a package's user. A
+// group's duration or action overrides the package's; across several groups
+// the longest duration and the strictest action win.
+func ResolvePenaltyPolicy(groups []*Group, pkg *Package) PenaltyPolicy {
+	var policy PenaltyPolicy
+	for _, g := range groups {
+		if duration := time.Duration(g.PenaltyDuration) * time.Second; duration > policy.Duration {
+			policy.Duration = duration
+		}
+		if g.PenaltyAction.severity() > policy.Action.severity() {
+			policy.Action = g.PenaltyAction
+		}
+	}
+	if pkg != nil {
+		if policy.Duration == 0 && pkg.PenaltyDuration > 0 {
+			policy.Duration = time.Duration(pkg.PenaltyDuration) * time.Second
+		}
+		if policy.Action == "" {
+			policy.Action = pkg.PenaltyAction
+		}
+	}
+	return policy
+}
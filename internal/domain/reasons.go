@@ -0,0 +1,114 @@
+package domain
+
+// ReasonCode is a stable, machine-readable code explaining why a usage report
+// was rejected or a session was disconnected. Node agents and client apps map
+// it to user-facing text through the reason catalog.
+type ReasonCode string
+
+const (
+	ReasonUserPenalized         ReasonCode = "user_penalized"
+	ReasonConcurrentLimit       ReasonCode = "concurrent_session_limit_exceeded"
+	ReasonIPLimit               ReasonCode = "concurrent_ip_limit_exceeded"
+	ReasonCrossNodeRoaming      ReasonCode = "session_cross_node_roaming"
+	ReasonImpossibleRoaming     ReasonCode = "impossible_roaming"
+	ReasonNodeOverloaded        ReasonCode = "node_overloaded"
+	ReasonNodeDraining          ReasonCode = "node_draining"
+	ReasonNodeUserLimit         ReasonCode = "node_user_limit_reached"
+	ReasonNodeNotAllowed        ReasonCode = "node_not_allowed"
+	ReasonNodeNotInPlan         ReasonCode = "node_not_in_plan"
+	ReasonQuotaExceeded         ReasonCode = "quota_exceeded"
+	ReasonUploadQuotaExceeded   ReasonCode = "upload_quota_exceeded"
+	ReasonDownloadQuotaExceeded ReasonCode = "download_quota_exceeded"
+	ReasonManagerLimit          ReasonCode = "manager_limit_reached"
+	ReasonGroupLimit            ReasonCode = "group_limit_reached"
+	ReasonDeviceNotAllowed      ReasonCode = "device_not_allowed"
+	ReasonDeviceLimit           ReasonCode = "device_limit_exceeded"
+	ReasonCountryNotAllowed     ReasonCode = "country_not_allowed"
+	ReasonUserNotFound          ReasonCode = "user_not_found"
+	ReasonInvalidCredentials    ReasonCode = "invalid_credentials"
+	ReasonUserInactive          ReasonCode = "user_inactive"
+	ReasonNoActivePackage       ReasonCode = "no_active_package"
+	ReasonPackageInactive       ReasonCode = "package_inactive"
+	ReasonPackageExpired        ReasonCode = "package_expired"
+	ReasonInternalError         ReasonCode = "internal_error"
+	ReasonAdminDisconnect       ReasonCode = "admin_disconnect"
+)
+
+// DefaultReasonLanguage is used when a reason message is not available in
+// the requested language
+const DefaultReasonLanguage = DefaultLanguage
+
+// DisconnectReason is a catalog entry for a reason code
+type DisconnectReason struct {
+	Code      ReasonCode        `json:"code"`
+	Penalty   bool              `json:"penalty"`   // Whether a temporary penalty is applied
+	Retryable bool              `json:"retryable"` // Whether the client may reconnect without user action
+	Messages  map[string]string `json:"messages"`  // Language → user-facing text
+}
+
+// Message returns the text for lang, falling back to the default language
+func (r DisconnectReason) Message(lang string) string {
+	return Translate(r.Code.MessageKey(), lang, nil)
+}
+
+// MessageKey returns the catalog key holding the reason's user-facing text
+func (c ReasonCode) MessageKey() MessageKey {
+	return MessageKey("reason." + string(c))
+}
+
+// withMessages fills in the reason's texts from the message catalog
+func (r DisconnectReason) withMessages() DisconnectReason {
+	r.Messages = make(map[string]string, len(supportedLanguages))
+	for _, lang := range supportedLanguages {
+		r.Messages[lang] = r.Message(lang)
+	}
+	return r
+}
+
+var disconnectReasons = []DisconnectReason{
+	{Code: ReasonUserPenalized, Penalty: true, Retryable: true},
+	{Code: ReasonConcurrentLimit, Penalty: true, Retryable: true},
+	{Code: ReasonIPLimit, Penalty: true, Retryable: true},
+	{Code: ReasonCrossNodeRoaming, Retryable: true},
+	{Code: ReasonImpossibleRoaming, Retryable: true},
+	{Code: ReasonNodeOverloaded, Retryable: true},
+	{Code: ReasonNodeDraining, Retryable: true},
+	{Code: ReasonNodeUserLimit, Retryable: true},
+	{Code: ReasonNodeNotAllowed},
+	{Code: ReasonNodeNotInPlan},
+	{Code: ReasonQuotaExceeded},
+	{Code: ReasonUploadQuotaExceeded},
+	{Code: ReasonDownloadQuotaExceeded},
+	{Code: ReasonManagerLimit},
+	{Code: ReasonGroupLimit},
+	{Code: ReasonDeviceNotAllowed},
+	{Code: ReasonDeviceLimit},
+	{Code: ReasonCountryNotAllowed},
+	{Code: ReasonUserNotFound},
+	{Code: ReasonInvalidCredentials},
+	{Code: ReasonUserInactive},
+	{Code: ReasonNoActivePackage},
+	{Code: ReasonPackageInactive},
+	{Code: ReasonPackageExpired},
+	{Code: ReasonInternalError, Retryable: true},
+	{Code: ReasonAdminDisconnect, Retryable: true},
+}
+
+// DisconnectReasons returns the full reason catalog in a stable order
+func DisconnectReasons() []DisconnectReason {
+	reasons := make([]DisconnectReason, 0, len(disconnectReasons))
+	for _, r := range disconnectReasons {
+		reasons = append(reasons, r.withMessages())
+	}
+	return reasons
+}
+
+// LookupReason returns the catalog entry for a code
+func LookupReason(code ReasonCode) (DisconnectReason, bool) {
+	for _, r := range disconnectReasons {
+		if r.Code == code {
+			return r.withMessages(), true
+		}
+	}
+	return DisconnectReason{}, false
+}
@@ -0,0 +1,28 @@
+package domain
+
+import "time"
+
+// ReservationStatus is the lifecycle state of a quota reservation
+type ReservationStatus string
+
+const (
+	ReservationStatusActive    ReservationStatus = "active"
+	ReservationStatusCommitted ReservationStatus = "committed"
+	ReservationStatusExpired   ReservationStatus = "expired"
+)
+
+// QuotaReservation holds billed bytes of a user's package for one session
+// until the node commits the actual usage. Active reservations count against
+// the package's remaining traffic.
+type QuotaReservation struct {
+	ID        string            `json:"id" db:"id"`
+	UserID    string            `json:"user_id" db:"user_id"`
+	PackageID string            `json:"package_id" db:"package_id"`
+	SessionID string            `json:"session_id,omitempty" db:"session_id"`
+	NodeID    string            `json:"node_id,omitempty" db:"node_id"`
+	Amount    int64             `json:"amount" db:"amount"` // Billed bytes
+	Status    ReservationStatus `json:"status" db:"status"`
+	ExpiresAt time.Time         `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time         `json:"created_at" db:"created_at"`
+	SettledAt *time.Time        `json:"settled_at,omitempty" db:"settled_at"`
+}
@@ -16,37 +16,46 @@ const (
 
 // Service represents a protocol instance on a Node
 type Service struct {
-	ID              string      `json:"id" db:"id"`
-	SecretKey       string      `json:"-" db:"secret_key"` // Omit from JSON responses
-	AccessToken     string      `json:"access_token,omitempty" db:"-"`
-	NodeID          string      `json:"node_id" db:"node_id"`
-	Name            string      `json:"name" db:"name"`
-	Protocol        string      `json:"protocol" db:"protocol"` // vless, trojan, wireguard, etc.
+	ID                 string       `json:"id" db:"id"`
+	SecretKey          string       `json:"-" db:"secret_key"` // Omit from JSON responses
+	AccessToken        string       `json:"access_token,omitempty" db:"-"`
+	NodeID             string       `json:"node_id" db:"node_id"`
+	Name               string       `json:"name" db:"name"`
+	Protocol           string       `json:"protocol" db:"protocol"` // vless, trojan, wireguard, etc.
 	AllowedAuthMethods []AuthMethod `json:"allowed_auth_methods" db:"allowed_auth_methods"`
-	CallbackURL     string      `json:"callback_url,omitempty" db:"callback_url"`
-	CurrentUpload   int64       `json:"current_upload" db:"current_upload"`
-	CurrentDownload int64       `json:"current_download" db:"current_download"`
-	CreatedAt       time.Time   `json:"created_at" db:"created_at"`
-	UpdatedAt       time.Time   `json:"updated_at" db:"updated_at"`
+	CallbackURL        string       `json:"callback_url,omitempty" db:"callback_url"`
+	ManagerID          *string      `json:"manager_id,omitempty" db:"manager_id"` // Owning reseller; nil for shared services
+	CurrentUpload      int64        `json:"current_upload" db:"current_upload"`
+	CurrentDownload    int64        `json:"current_download" db:"current_download"`
+	CreatedAt          time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time    `json:"updated_at" db:"updated_at"`
 }
 
 // ServiceCreate represents the input for creating a new service
 type ServiceCreate struct {
-	NodeID            string      `json:"node_id" validate:"required"`
-	SecretKey         string      `json:"secret_key" validate:"required"`
-	AccessToken       string      `json:"access_token,omitempty"`
-	Name              string      `json:"name" validate:"required"`
-	Protocol          string      `json:"protocol" validate:"required"`
+	NodeID             string       `json:"node_id" validate:"required"`
+	SecretKey          string       `json:"secret_key" validate:"required"`
+	AccessToken        string       `json:"access_token,omitempty"`
+	Name               string       `json:"name" validate:"required"`
+	Protocol           string       `json:"protocol" validate:"required"`
 	AllowedAuthMethods []AuthMethod `json:"allowed_auth_methods" validate:"required"`
-	CallbackURL       string      `json:"callback_url,omitempty"`
+	CallbackURL        string       `json:"callback_url,omitempty"`
+	ManagerID          *string      `json:"manager_id,omitempty"`
 }
 
 // ServiceUpdate represents the input for updating a service
 type ServiceUpdate struct {
-	Name              *string     `json:"name,omitempty"`
-	SecretKey         *string    `json:"secret_key,omitempty"`
+	Name               *string       `json:"name,omitempty"`
+	SecretKey          *string       `json:"secret_key,omitempty"`
 	AllowedAuthMethods *[]AuthMethod `json:"allowed_auth_methods,omitempty"`
-	CallbackURL       *string    `json:"callback_url,omitempty"`
+	CallbackURL        *string       `json:"callback_url,omitempty"`
+}
+
+// ServiceFilter narrows a service listing; nil fields match every service
+type ServiceFilter struct {
+	NodeID *string `json:"node_id,omitempty"`
+	// ManagerID limits the listing to services visible to the manager
+	ManagerID *string `json:"manager_id,omitempty"`
 }
 
 // AddUsage adds upload and download bytes to the service counters
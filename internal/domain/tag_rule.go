@@ -0,0 +1,181 @@
+package domain
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TagRuleField names the report attribute a tag rule matches on
+type TagRuleField string
+
+const (
+	// TagRuleISP matches when the client's ISP contains one of the values
+	TagRuleISP TagRuleField = "isp"
+	// TagRuleASN matches the client's autonomous system number
+	TagRuleASN TagRuleField = "asn"
+	// TagRuleCountry matches the client's country name
+	TagRuleCountry TagRuleField = "country"
+	// TagRuleNode matches the reporting node ID
+	TagRuleNode TagRuleField = "node"
+	// TagRuleService matches the reporting service ID
+	TagRuleService TagRuleField = "service"
+	// TagRuleHour matches reports timestamped within an hour range
+	TagRuleHour TagRuleField = "hour"
+)
+
+// TagRule adds Tag to usage reports that match it, so history and stats can
+// be grouped without changing node agents
+type TagRule struct {
+	Tag    string       `json:"tag"`
+	Field  TagRuleField `json:"field"`
+	Values []string     `json:"values,omitempty"`
+	// FromHour and ToHour bound hour rules as [FromHour, ToHour); a range
+	// such as 22-6 wraps past midnight
+	FromHour int `json:"from_hour,omitempty"`
+	ToHour   int `json:"to_hour,omitempty"`
+}
+
+// ParseTagRule parses a "tag=field:value|value" entry, e.g.
+// "mobile=isp:Irancell|MCI" or "night=hour:0-6"
+func ParseTagRule(entry string) (TagRule, error) {
+	tag, spec, ok := strings.Cut(entry, "=")
+	tag = strings.TrimSpace(tag)
+	if !ok || tag == "" {
+		return TagRule{}, fmt.Errorf("tag rule %q: expected tag=field:values", entry)
+	}
+	field, values, ok := strings.Cut(spec, ":")
+	if !ok {
+		return TagRule{}, fmt.Errorf("tag rule %q: expected tag=field:values", entry)
+	}
+
+	rule := TagRule{Tag: tag, Field: TagRuleField(strings.ToLower(strings.TrimSpace(field)))}
+	switch rule.Field {
+	case TagRuleHour:
+		from, to, ok := strings.Cut(values, "-")
+		if !ok {
+			return TagRule{}, fmt.Errorf("tag rule %q: hour range must be from-to", entry)
+		}
+		var err error
+		if rule.FromHour, err = parseHour(from); err != nil {
+			return TagRule{}, fmt.Errorf("tag rule %q: %w", entry, err)
+		}
+		if rule.ToHour, err = parseHour(to); err != nil {
+			return TagRule{}, fmt.Errorf("tag rule %q: %w", entry, err)
+		}
+		if rule.FromHour == rule.ToHour {
+			return TagRule{}, fmt.Errorf("tag rule %q: hour range is empty", entry)
+		}
+	case TagRuleISP, TagRuleASN, TagRuleCountry, TagRuleNode, TagRuleService:
+		for _, value := range strings.Split(values, "|") {
+			if value = strings.TrimSpace(value); value != "" {
+				rule.Values = append(rule.Values, value)
+			}
+		}
+		if len(rule.Values) == 0 {
+			return TagRule{}, fmt.Errorf("tag rule %q: no values", entry)
+		}
+	default:
+		return TagRule{}, fmt.Errorf("tag rule %q: unknown field %q", entry, field)
+	}
+	return rule, nil
+}
+
+// parseHour parses an hour of day, accepting "6" and "06:00"
+func parseHour(s string) (int, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), ":00")
+	hour, err := strconv.Atoi(s)
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("invalid hour %q", s)
+	}
+	return hour % 24, nil
+}
+
+// Matches reports whether the rule applies to a report seen at the given
+// time. geo may be nil when no geo data was extracted.
+func (r TagRule) Matches(report *UsageReport, geo *GeoData, at time.Time) bool {
+	switch r.Field {
+	case TagRuleHour:
+		hour := at.Hour()
+		if r.FromHour < r.ToHour {
+			return hour >= r.FromHour && hour < r.ToHour
+		}
+		return hour >= r.FromHour || hour < r.ToHour
+	case TagRuleISP:
+		if geo == nil || geo.ISP == "" {
+			return false
+		}
+		isp := strings.ToLower(geo.ISP)
+		for _, value := range r.Values {
+			if strings.Contains(isp, strings.ToLower(value)) {
+				return true
+			}
+		}
+		return false
+	case TagRuleASN:
+		if geo == nil || geo.ASN == 0 {
+			return false
+		}
+		return r.matchesValue(strconv.FormatUint(uint64(geo.ASN), 10))
+	case TagRuleCountry:
+		if geo == nil || geo.Country == "" {
+			return false
+		}
+		return r.matchesValue(geo.Country)
+	case TagRuleNode:
+		return r.matchesValue(report.NodeID)
+	case TagRuleService:
+		return r.matchesValue(report.ServiceID)
+	}
+	return false
+}
+
+func (r TagRule) matchesValue(s string) bool {
+	for _, value := range r.Values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyTagRules adds the tags of all matching rules to the report, skipping
+// tags it already carries. Hour rules use the report timestamp, or now when
+// the report has none, in loc.
+func ApplyTagRules(rules []TagRule, report *UsageReport, geo *GeoData, loc *time.Location) {
+	if len(rules) == 0 {
+		return
+	}
+	at := report.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if loc != nil {
+		at = at.In(loc)
+	}
+
+	var tags []string
+	for _, rule := range rules {
+		if !rule.Matches(report, geo, at) || hasTag(report.Tags, rule.Tag) || hasTag(tags, rule.Tag) {
+			continue
+		}
+		tags = append(tags, rule.Tag)
+	}
+	if len(tags) == 0 {
+		return
+	}
+	// Copy so the caller's slice is never written through
+	merged := make([]string, 0, len(report.Tags)+len(tags))
+	merged = append(merged, report.Tags...)
+	report.Tags = append(merged, tags...)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
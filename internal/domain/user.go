@@ -1,6 +1,8 @@
 package domain
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -17,58 +19,107 @@ const (
 
 // User represents a user entity in the system
 type User struct {
-	ID             string     `json:"id" db:"id"`
-	ManagerID      *string    `json:"manager_id,omitempty" db:"manager_id"`
-	Username       string     `json:"username" db:"username"`
-	Password       string     `json:"-" db:"password"` // Omit from JSON responses
-	PublicKey      string     `json:"public_key,omitempty" db:"public_key"`
-	PrivateKey     string     `json:"-" db:"private_key"` // Omit from JSON responses
-	CACertList     []string   `json:"ca_cert_list,omitempty" db:"ca_cert_list"`
-	Groups         []string   `json:"groups,omitempty" db:"groups"`
-	AllowedDevices []string   `json:"allowed_devices,omitempty" db:"allowed_devices"`
-	Status         UserStatus `json:"status" db:"status"`
-	ActivePackageID *string   `json:"active_package_id,omitempty" db:"active_package_id"`
-	Metadata       map[string]any `json:"metadata,omitempty" db:"-"`
-	FirstConnectionAt *time.Time `json:"first_connection_at,omitempty" db:"first_connection_at"`
-	LastConnectionAt  *time.Time `json:"last_connection_at,omitempty" db:"last_connection_at"`
-	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+	ID                string            `json:"id" db:"id"`
+	ManagerID         *string           `json:"manager_id,omitempty" db:"manager_id"`
+	Username          string            `json:"username" db:"username"`
+	Password          string            `json:"-" db:"password"` // Omit from JSON responses
+	PublicKey         string            `json:"public_key,omitempty" db:"public_key"`
+	PrivateKey        string            `json:"-" db:"private_key"`     // Omit from JSON responses
+	ProtocolSecret    string            `json:"-" db:"protocol_secret"` // Trojan/Shadowsocks password, kept in plaintext for nodes
+	CACertList        []string          `json:"ca_cert_list,omitempty" db:"ca_cert_list"`
+	Groups            []string          `json:"groups,omitempty" db:"groups"`
+	AllowedDevices    []string          `json:"allowed_devices,omitempty" db:"allowed_devices"`
+	AllowedNodes      []string          `json:"allowed_nodes,omitempty" db:"allowed_nodes"`         // Empty = all nodes
+	AllowedServices   []string          `json:"allowed_services,omitempty" db:"allowed_services"`   // Empty = all services
+	AllowedCountries  []string          `json:"allowed_countries,omitempty" db:"allowed_countries"` // Empty = all countries
+	DeniedCountries   []string          `json:"denied_countries,omitempty" db:"denied_countries"`
+	Attributes        map[string]string `json:"attributes,omitempty" db:"attributes"` // Free-form settings such as "locale"
+	Status            UserStatus        `json:"status" db:"status"`
+	ActivePackageID   *string           `json:"active_package_id,omitempty" db:"active_package_id"`
+	Metadata          map[string]any    `json:"metadata,omitempty" db:"-"`
+	FirstConnectionAt *time.Time        `json:"first_connection_at,omitempty" db:"first_connection_at"`
+	LastConnectionAt  *time.Time        `json:"last_connection_at,omitempty" db:"last_connection_at"`
+	CreatedAt         time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at" db:"updated_at"`
 }
 
 // UserCreate represents the input for creating a new user
 type UserCreate struct {
-	Username       string   `json:"username" validate:"required"`
-	ManagerID      *string  `json:"manager_id,omitempty"`
-	Password       string   `json:"password" validate:"required"`
-	PublicKey      string   `json:"public_key,omitempty"`
-	PrivateKey     string   `json:"private_key,omitempty"`
-	CACertList     []string `json:"ca_cert_list,omitempty"`
-	Groups         []string `json:"groups,omitempty"`
-	AllowedDevices []string `json:"allowed_devices,omitempty"`
-	ActivePackageID *string `json:"active_package_id,omitempty"`
+	Username         string            `json:"username" validate:"required"`
+	ManagerID        *string           `json:"manager_id,omitempty"`
+	Password         string            `json:"password" validate:"required"`
+	PublicKey        string            `json:"public_key,omitempty"`
+	PrivateKey       string            `json:"private_key,omitempty"`
+	ProtocolSecret   string            `json:"protocol_secret,omitempty"`
+	CACertList       []string          `json:"ca_cert_list,omitempty"`
+	Groups           []string          `json:"groups,omitempty"`
+	AllowedDevices   []string          `json:"allowed_devices,omitempty"`
+	AllowedNodes     []string          `json:"allowed_nodes,omitempty"`
+	AllowedServices  []string          `json:"allowed_services,omitempty"`
+	AllowedCountries []string          `json:"allowed_countries,omitempty"`
+	DeniedCountries  []string          `json:"denied_countries,omitempty"`
+	Attributes       map[string]string `json:"attributes,omitempty"`
+	ActivePackageID  *string           `json:"active_package_id,omitempty"`
 }
 
 // UserUpdate represents the input for updating a user
 type UserUpdate struct {
-	Username       *string   `json:"username,omitempty"`
-	ManagerID      *string   `json:"manager_id,omitempty"`
-	Password       *string   `json:"password,omitempty"`
-	PublicKey      *string   `json:"public_key,omitempty"`
-	PrivateKey     *string   `json:"private_key,omitempty"`
-	CACertList     *[]string `json:"ca_cert_list,omitempty"`
-	Groups         *[]string `json:"groups,omitempty"`
-	AllowedDevices *[]string `json:"allowed_devices,omitempty"`
-	Status         *UserStatus `json:"status,omitempty"`
-	ActivePackageID *string  `json:"active_package_id,omitempty"`
+	Username         *string            `json:"username,omitempty"`
+	ManagerID        *string            `json:"manager_id,omitempty"`
+	Password         *string            `json:"password,omitempty"`
+	PublicKey        *string            `json:"public_key,omitempty"`
+	PrivateKey       *string            `json:"private_key,omitempty"`
+	ProtocolSecret   *string            `json:"protocol_secret,omitempty"`
+	CACertList       *[]string          `json:"ca_cert_list,omitempty"`
+	Groups           *[]string          `json:"groups,omitempty"`
+	AllowedDevices   *[]string          `json:"allowed_devices,omitempty"`
+	AllowedNodes     *[]string          `json:"allowed_nodes,omitempty"`
+	AllowedServices  *[]string          `json:"allowed_services,omitempty"`
+	AllowedCountries *[]string          `json:"allowed_countries,omitempty"`
+	DeniedCountries  *[]string          `json:"denied_countries,omitempty"`
+	Attributes       *map[string]string `json:"attributes,omitempty"`
+	Status           *UserStatus        `json:"status,omitempty"`
+	ActivePackageID  *string            `json:"active_package_id,omitempty"`
 }
 
 // UserFilter represents filters for listing users
 type UserFilter struct {
-	Status  *UserStatus `json:"status,omitempty"`
-	Group   *string     `json:"group,omitempty"`
-	Search  *string     `json:"search,omitempty"`
-	Limit   int         `json:"limit,omitempty"`
-	Offset  int         `json:"offset,omitempty"`
+	Status    *UserStatus `json:"status,omitempty"`
+	ManagerID *string     `json:"manager_id,omitempty"`
+	Group     *string     `json:"group,omitempty"`
+	Search    *string     `json:"search,omitempty"`
+	Limit     int         `json:"limit,omitempty"`
+	Offset    int         `json:"offset,omitempty"`
+}
+
+// UserAttributeLocale is the user attribute holding the preferred language
+const UserAttributeLocale = "locale"
+
+// Locale returns the user's preferred language, or "" when unset
+func (u *User) Locale() string {
+	if u == nil {
+		return ""
+	}
+	return u.Attributes[UserAttributeLocale]
+}
+
+// MaxPasswordLength is the longest password in bytes, the most bcrypt hashes
+const MaxPasswordLength = 72
+
+// ValidateUserPassword checks that a password can be hashed
+func ValidateUserPassword(password string) error {
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("password is longer than %d bytes", MaxPasswordLength)
+	}
+	return nil
+}
+
+// ValidateUserAttributes checks attributes with a known meaning
+func ValidateUserAttributes(attrs map[string]string) error {
+	if locale, ok := attrs[UserAttributeLocale]; ok && locale != "" && !IsSupportedLanguage(locale) {
+		return fmt.Errorf("unsupported locale %q (supported: %s)", locale, strings.Join(supportedLanguages, ", "))
+	}
+	return nil
 }
 
 // IsActive returns true if the user is in active status
@@ -80,3 +131,27 @@ func (u *User) IsActive() bool {
 func (u *User) CanConnect() bool {
 	return u.IsActive() && u.ActivePackageID != nil
 }
+
+// Permits returns true if the user's allow-lists permit the node and service
+func (u *User) Permits(nodeID, serviceID string) bool {
+	return AllowListPermits(u.AllowedNodes, nodeID) && AllowListPermits(u.AllowedServices, serviceID)
+}
+
+// PermitsCountry returns true if the user's country lists permit geo
+func (u *User) PermitsCountry(geo *GeoData) bool {
+	return CountryPermits(u.AllowedCountries, u.DeniedCountries, geo)
+}
+
+// AllowListPermits returns true if id is in list. An empty list permits
+// everything, and an empty id is never restricted.
+func AllowListPermits(list []string, id string) bool {
+	if len(list) == 0 || id == "" {
+		return true
+	}
+	for _, allowed := range list {
+		if allowed == id {
+			return true
+		}
+	}
+	return false
+}
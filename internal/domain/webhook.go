@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+// WebhookDeadLetter is an event webhook delivery that failed on every
+// attempt. The payload is the exact body that was posted.
+type WebhookDeadLetter struct {
+	ID        string    `json:"id" db:"id"`
+	URL       string    `json:"url" db:"url"`
+	EventID   string    `json:"event_id" db:"event_id"`
+	EventType EventType `json:"event_type" db:"event_type"`
+	Payload   []byte    `json:"payload" db:"payload"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	LastError string    `json:"last_error" db:"last_error"`
+	FailedAt  time.Time `json:"failed_at" db:"failed_at"`
+}
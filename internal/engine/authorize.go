@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+var (
+	// ErrAuthMethodNotAllowed is returned when a connection uses an auth
+	// method its service does not allow
+	ErrAuthMethodNotAllowed = errors.New("service does not allow this auth method")
+	// ErrUnsupportedAuthMethod is returned for auth methods HUE cannot check,
+	// such as certificates, which the node verifies itself
+	ErrUnsupportedAuthMethod = errors.New("auth method cannot be checked by HUE")
+)
+
+// AuthorizeConnection decides whether a node may let a client in, so nodes
+// need not hold the users to authenticate them. The user is found from the
+// credentials of the service's auth method. The checks of a usage report
+// that need no traffic are run, without recording a session or applying
+// penalties; the session starts with the first report. An allowed decision
+// carries the limits the node should apply.
+func (e *Engine) AuthorizeConnection(req *domain.ConnectionRequest) (*domain.ConnectionDecision, error) {
+	service, err := e.userDB.GetService(req.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+	if service == nil {
+		return nil, ErrUnknownService
+	}
+	if !slices.Contains(service.AllowedAuthMethods, req.Method) {
+		return nil, ErrAuthMethodNotAllowed
+	}
+
+	user, err := e.connectingUser(req)
+	if err != nil {
+		return nil, err
+	}
+	decision := &domain.ConnectionDecision{}
+	deny := func(code domain.ReasonCode, reason string) (*domain.ConnectionDecision, error) {
+		decision.ReasonCode = code
+		decision.Reason = reason
+		return decision, nil
+	}
+	if user == nil {
+		return deny(domain.ReasonInvalidCredentials, "invalid credentials")
+	}
+	decision.UserID = user.ID
+
+	if e.penalty.BlockingPenalty(user.ID, req.SessionID) != nil {
+		return deny(domain.ReasonUserPenalized, "user has active penalty")
+	}
+	quota, err := e.quota.CheckQuota(user.ID, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !quota.CanUse {
+		return deny(quota.ReasonCode, quota.Reason)
+	}
+	pkg, err := e.userDB.GetPackageByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if pkg == nil {
+		return deny(domain.ReasonNoActivePackage, "no active package")
+	}
+	decision.PackageID = pkg.ID
+	decision.RateLimit = quota.RateLimit
+
+	code, err := e.quota.CheckAccess(user.ID, req.NodeID, req.ServiceID, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if code != "" {
+		return deny(code, accessRejectionReason(code))
+	}
+
+	if e.geo != nil && (e.geo.IsReady() || e.geo.HasASN()) && req.ClientIP != "" {
+		rule, err := e.quota.CheckCountry(user.ID, pkg, e.geo.ExtractGeo(req.ClientIP))
+		if err != nil {
+			return nil, err
+		}
+		if rule != "" {
+			return deny(domain.ReasonCountryNotAllowed, "country is not allowed")
+		}
+	}
+
+	decision.MaxConcurrent = e.quota.MaxConcurrent(user.ID, pkg)
+	decision.MaxIPs = pkg.MaxIPs
+	active, room, existing := e.session.HasRoom(user.ID, req.SessionID, decision.MaxConcurrent)
+	decision.ActiveSessions = active
+	if !existing {
+		if !room {
+			return deny(domain.ReasonConcurrentLimit, "concurrent session limit exceeded")
+		}
+		if e.cache.IsNodeDraining(req.NodeID) {
+			return deny(domain.ReasonNodeDraining, "node is draining")
+		}
+		full, err := e.nodeUserLimitReached(req.NodeID, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if full {
+			return deny(domain.ReasonNodeUserLimit, "node active user limit reached")
+		}
+	}
+
+	decision.Allowed = true
+	return decision, nil
+}
+
+// connectingUser returns the user whose credentials a connection presents,
+// nil when they match no one
+func (e *Engine) connectingUser(req *domain.ConnectionRequest) (*domain.User, error) {
+	switch req.Method {
+	case domain.AuthMethodUUID:
+		if req.UserID == "" {
+			return nil, nil
+		}
+		return e.userDB.GetUser(req.UserID)
+	case domain.AuthMethodPassword:
+		return e.userDB.VerifyUserPassword(req.Username, req.Password)
+	case domain.AuthMethodPubKey:
+		return e.userDB.GetUserByPublicKey(req.PublicKey)
+	default:
+		return nil, ErrUnsupportedAuthMethod
+	}
+}
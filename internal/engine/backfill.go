@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// SetBackfillAfter sets how old a report's timestamp must be for the report
+// to be processed as offline backfill. Zero disables backfill.
+func (e *Engine) SetBackfillAfter(d time.Duration) {
+	e.backfillAfter = d
+}
+
+// IsBackfill reports whether a report carries traffic a node buffered while
+// it could not reach HUE
+func (e *Engine) IsBackfill(report *domain.UsageReport) bool {
+	return e.backfillAfter > 0 && !report.Timestamp.IsZero() && time.Since(report.Timestamp) > e.backfillAfter
+}
+
+// ProcessBackfill charges a buffered report against the package as it was
+// when the traffic happened. Session, penalty and speed checks are skipped
+// since the sessions are long gone; the charge is capped at the traffic the
+// package had left and recorded under the report's original timestamp.
+// Traffic from before the active package started belongs to an earlier one
+// and is not charged.
+func (e *Engine) ProcessBackfill(report *domain.UsageReport) *domain.UsageReportResult {
+	result := &domain.UsageReportResult{
+		UserID:     report.UserID,
+		Backfilled: true,
+	}
+
+	pkg, err := e.userDB.GetPackageByUserID(report.UserID)
+	if err != nil {
+		result.Reason = "failed to get package"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("failed to get package", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+	if pkg == nil {
+		result.Reason = "no active package"
+		result.ReasonCode = domain.ReasonNoActivePackage
+		return result
+	}
+	result.PackageID = pkg.ID
+	result.Priority = pkg.Priority
+
+	startedAt := pkg.CreatedAt
+	if pkg.StartAt != nil {
+		startedAt = *pkg.StartAt
+	}
+	if report.Timestamp.Before(startedAt) {
+		result.Reason = "traffic predates the active package"
+		result.ReasonCode = domain.ReasonPackageInactive
+		return result
+	}
+
+	// Traffic after the package expired is not charged to it
+	if pkg.ExpiresAt != nil && report.Timestamp.After(*pkg.ExpiresAt) {
+		result.ShouldDisconnect = true
+		result.Reason = "package had expired"
+		result.ReasonCode = domain.ReasonPackageExpired
+		return result
+	}
+
+	if !pkg.CanUse() {
+		result.ShouldDisconnect = true
+		switch {
+		case !pkg.HasTrafficRemaining():
+			result.QuotaExceeded = true
+			result.Reason = "total traffic quota exceeded"
+			result.ReasonCode = domain.ReasonQuotaExceeded
+		case pkg.IsExpired():
+			result.Reason = "package has expired"
+			result.ReasonCode = domain.ReasonPackageExpired
+		default:
+			result.Reason = "package is not active"
+			result.ReasonCode = domain.ReasonPackageInactive
+		}
+		return result
+	}
+
+	user, err := e.userDB.GetUser(report.UserID)
+	if err != nil {
+		result.Reason = "failed to get user"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("failed to get user", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+	if user == nil || !user.CanConnect() {
+		result.ShouldDisconnect = true
+		result.Reason = "user is not active"
+		result.ReasonCode = domain.ReasonUserInactive
+		return result
+	}
+
+	accessCode, err := e.quota.CheckAccess(report.UserID, report.NodeID, report.ServiceID, pkg)
+	if err != nil {
+		result.Reason = "access check failed"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("access check failed", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+	if accessCode != "" {
+		result.ShouldDisconnect = true
+		result.Reason = accessRejectionReason(accessCode)
+		result.ReasonCode = accessCode
+		return result
+	}
+
+	// Geo data is not kept for buffered traffic, so only node, service and
+	// hour rules can match
+	e.ApplyTagRules(report, nil)
+
+	traffic, err := e.quota.BillUsage(report.NodeID, report.Upload, report.Download)
+	if err != nil {
+		result.Reason = "failed to bill usage"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("failed to bill usage", zap.String("node_id", report.NodeID), zap.Error(err))
+		return result
+	}
+
+	charged, err := e.quota.RecordBackfill(report, traffic)
+	if err != nil {
+		result.Reason = "failed to record usage"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("failed to record backfill", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+
+	backfill := domain.Backfill{
+		ReportedAt: report.Timestamp,
+		Billed:     traffic.Total(),
+		Charged:    charged,
+		Capped:     charged.Total() < traffic.Total(),
+	}
+	e.emitEventWithMetadata(domain.EventBackfill, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, report.Tags, backfill.Metadata())
+
+	// The user's usage history only holds what was charged
+	if charged.Total() > 0 {
+		stored := *report
+		stored.Upload = charged.RawUpload
+		stored.Download = charged.RawDownload
+		if err := e.quota.BufferReport(&stored, charged); err != nil {
+			e.logger.Warn("failed to buffer usage report", zap.String("user_id", report.UserID), zap.Error(err))
+		}
+		e.recordUsageHistory(&stored, pkg.ID, charged, nil)
+
+		updatedPkg, _ := e.userDB.GetPackage(pkg.ID)
+		if updatedPkg = e.quota.withPendingUsage(updatedPkg); updatedPkg != nil && !updatedPkg.HasTrafficRemaining() {
+			e.finishPackage(report.UserID, updatedPkg)
+		}
+	}
+
+	result.Accepted = charged.Total() > 0
+	result.SetTraffic(charged)
+	if backfill.Capped {
+		result.QuotaExceeded = true
+		result.ShouldDisconnect = true
+		result.Reason = "total traffic quota exceeded"
+		result.ReasonCode = domain.ReasonQuotaExceeded
+	}
+
+	e.logger.Info("usage backfilled",
+		zap.String("user_id", report.UserID),
+		zap.Time("reported_at", report.Timestamp),
+		zap.Int64("billed", backfill.Billed),
+		zap.Int64("charged", charged.Total()),
+	)
+	return result
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"go.uber.org/zap"
+)
+
+// Biller turns measured usage into monthly billing records per user and
+// node group
+type Biller struct {
+	userDB   *sqlite.UserDB
+	activeDB *sqlite.ActiveDB
+	rates    domain.BillingRates
+	logger   *zap.Logger
+}
+
+// NewBiller creates a biller pricing usage with the given rates
+func NewBiller(userDB *sqlite.UserDB, activeDB *sqlite.ActiveDB, rates domain.BillingRates, logger *zap.Logger) *Biller {
+	return &Biller{
+		userDB:   userDB,
+		activeDB: activeDB,
+		rates:    rates,
+		logger:   logger,
+	}
+}
+
+// Generate recomputes the records of a YYYY-MM period and replaces the stored
+// ones. Reports are billed the bytes they were charged when they arrived;
+// reports stored without billed bytes go through the node's current traffic
+// multiplier.
+func (b *Biller) Generate(period string) ([]*domain.BillingRecord, error) {
+	start, end, err := domain.ParseBillingPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := b.activeDB.GetUsageByUserNode(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*domain.Node)
+	users := make(map[string]*domain.User)
+	byKey := make(map[[2]string]*domain.BillingRecord)
+	now := time.Now()
+
+	for _, u := range usage {
+		node, ok := nodes[u.NodeID]
+		if !ok {
+			if node, err = b.userDB.GetNode(u.NodeID); err != nil {
+				return nil, err
+			}
+			nodes[u.NodeID] = node
+		}
+		user, ok := users[u.UserID]
+		if !ok {
+			if user, err = b.userDB.GetUser(u.UserID); err != nil {
+				return nil, err
+			}
+			users[u.UserID] = user
+		}
+
+		multiplier := 1.0
+		if node != nil && node.TrafficMultiplier > 0 {
+			multiplier = node.TrafficMultiplier
+		}
+		group := b.rates.GroupFor(node)
+
+		key := [2]string{u.UserID, group}
+		record, ok := byKey[key]
+		if !ok {
+			record = &domain.BillingRecord{
+				ID:        uuid.New().String(),
+				Period:    period,
+				UserID:    u.UserID,
+				NodeGroup: group,
+				Rate:      b.rates.RateFor(group),
+				Currency:  b.rates.Currency,
+				CreatedAt: now,
+			}
+			if user != nil {
+				record.Username = user.Username
+				record.ManagerID = user.ManagerID
+			}
+			byKey[key] = record
+		}
+		record.Upload += u.BilledUpload + int64(float64(u.UnbilledUpload)*multiplier)
+		record.Download += u.BilledDownload + int64(float64(u.UnbilledDownload)*multiplier)
+	}
+
+	records := make([]*domain.BillingRecord, 0, len(byKey))
+	for _, record := range byKey {
+		record.Total = record.Upload + record.Download
+		record.Amount = b.rates.Amount(record.Total, record.Rate)
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].UserID != records[j].UserID {
+			return records[i].UserID < records[j].UserID
+		}
+		return records[i].NodeGroup < records[j].NodeGroup
+	})
+
+	if err := b.userDB.ReplaceBillingRecords(period, records); err != nil {
+		return nil, err
+	}
+
+	b.logger.Info("billing records generated", zap.String("period", period), zap.Int("records", len(records)))
+	return records, nil
+}
+
+// Run refreshes the current month and generates the previous month once, so
+// a finished month is captured before its reports age out
+func (b *Biller) Run(now time.Time) error {
+	current := domain.BillingPeriod(now)
+	if _, err := b.Generate(current); err != nil {
+		return err
+	}
+
+	previous := domain.BillingPeriod(time.Date(now.UTC().Year(), now.UTC().Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0))
+	done, err := b.userDB.HasBillingRecords(previous)
+	if err != nil || done {
+		return err
+	}
+	_, err = b.Generate(previous)
+	return err
+}
@@ -0,0 +1,32 @@
+package engine
+
+import "github.com/hiddify/hue-go/internal/domain"
+
+// CheckCountry returns the rule rejecting a report from the country in geo:
+// "user", "package" or "group:<name>", or "" when every country list of the
+// user, the package and the user's groups permits it
+func (e *QuotaEngine) CheckCountry(userID string, pkg *domain.Package, geo *domain.GeoData) (string, error) {
+	if geo == nil || (geo.Country == "" && geo.CountryCode == "") {
+		return "", nil
+	}
+	user, err := e.userDB.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if user != nil && !user.PermitsCountry(geo) {
+		return "user", nil
+	}
+	if pkg != nil && !pkg.PermitsCountry(geo) {
+		return "package", nil
+	}
+	groups, err := e.userGroups(user)
+	if err != nil {
+		return "", err
+	}
+	for _, group := range groups {
+		if !group.PermitsCountry(geo) {
+			return "group:" + group.Name, nil
+		}
+	}
+	return "", nil
+}
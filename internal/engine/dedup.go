@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// SetReportDedupWindow sets how long the result of a report with an ID is
+// kept, so a node retrying the report within window gets the original result
+// instead of being charged twice. Zero disables deduplication.
+func (e *Engine) SetReportDedupWindow(window time.Duration) {
+	e.reportDedupWindow = window
+}
+
+// duplicateReport returns the original result when the report's ID was
+// already processed, and claims the ID otherwise. Reports without an ID are
+// never deduplicated.
+func (e *Engine) duplicateReport(report *domain.UsageReport) *domain.UsageReportResult {
+	if report.ID == "" || e.reportDedupWindow <= 0 {
+		return nil
+	}
+	if result := e.cache.GetReportResult(report.ID); result != nil {
+		result.Duplicate = true
+		return result
+	}
+
+	activeDB := e.quota.activeDB
+	if activeDB == nil {
+		return nil
+	}
+	claimed, err := activeDB.ClaimReport(report.ID, time.Now())
+	if err != nil {
+		e.logger.Warn("failed to claim report ID, processing without dedup", zap.String("report_id", report.ID), zap.Error(err))
+		return nil
+	}
+	if claimed {
+		return nil
+	}
+
+	result, err := activeDB.GetReportResult(report.ID)
+	if err != nil {
+		e.logger.Warn("failed to load duplicate report result", zap.String("report_id", report.ID), zap.Error(err))
+	}
+	if result == nil {
+		// The first copy is still being processed; the node may retry later
+		return &domain.UsageReportResult{
+			UserID:    report.UserID,
+			Reason:    "report is still being processed",
+			Duplicate: true,
+		}
+	}
+	e.cache.SetReportResult(report.ID, result, e.reportDedupWindow)
+	result.Duplicate = true
+	return result
+}
+
+// rememberReport keeps the result of a processed report for the dedup
+// window. Internal errors are not kept, so a retry is processed again.
+func (e *Engine) rememberReport(report *domain.UsageReport, result *domain.UsageReportResult) {
+	if report.ID == "" || e.reportDedupWindow <= 0 {
+		return
+	}
+	activeDB := e.quota.activeDB
+	if result.ReasonCode == domain.ReasonInternalError {
+		if activeDB != nil {
+			if err := activeDB.ReleaseReport(report.ID); err != nil {
+				e.logger.Warn("failed to release report ID", zap.String("report_id", report.ID), zap.Error(err))
+			}
+		}
+		return
+	}
+
+	e.cache.SetReportResult(report.ID, result, e.reportDedupWindow)
+	if activeDB != nil {
+		if err := activeDB.StoreReportResult(report.ID, result); err != nil {
+			e.logger.Warn("failed to store report result", zap.String("report_id", report.ID), zap.Error(err))
+		}
+	}
+}
+
+// forgetReport drops the kept result of a report so it is processed again
+func (e *Engine) forgetReport(reportID string) {
+	e.cache.ClearReportResult(reportID)
+	if e.quota.activeDB != nil {
+		if err := e.quota.activeDB.ReleaseReport(reportID); err != nil {
+			e.logger.Warn("failed to release report ID", zap.String("report_id", reportID), zap.Error(err))
+		}
+	}
+}
+
+// PruneReportResults drops report claims older than the dedup window and
+// returns how many were removed
+func (e *Engine) PruneReportResults(now time.Time) (int64, error) {
+	if e.reportDedupWindow <= 0 || e.quota.activeDB == nil {
+		return 0, nil
+	}
+	return e.quota.activeDB.DeleteProcessedReports(now.Add(-e.reportDedupWindow))
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// deviceSeenInterval bounds how often a device's last_seen_at is written
+const deviceSeenInterval = time.Minute
+
+// DeviceCheck is the outcome of admitting a report's device
+type DeviceCheck struct {
+	// ReasonCode is set when the device may not be used
+	ReasonCode domain.ReasonCode
+	// Held is true when the device was just added to the registry as pending
+	Held bool
+}
+
+// SetDeviceLimitAction sets what happens to reports from devices past a
+// package's max_devices: rejected, or rejected with a penalty
+func (e *Engine) SetDeviceLimitAction(action domain.DeviceLimitAction) {
+	if !action.IsValid() {
+		action = domain.DeviceLimitActionReject
+	}
+	e.deviceLimitAction = action
+}
+
+// CheckDevice admits the device a report came from. Devices in the user's
+// allowed_devices or approved in the registry pass. When the user has an
+// allow-list, other devices are held for approval. Otherwise a new device is
+// approved on first use until pkg's max_devices is reached, and held after
+// that. Reports without a device ID are not restricted.
+func (e *QuotaEngine) CheckDevice(userID, deviceID string, pkg *domain.Package) (DeviceCheck, error) {
+	if deviceID == "" {
+		return DeviceCheck{}, nil
+	}
+	user, err := e.userDB.GetUser(userID)
+	if err != nil || user == nil {
+		return DeviceCheck{}, err
+	}
+	device, err := e.userDB.GetUserDevice(userID, deviceID)
+	if err != nil {
+		return DeviceCheck{}, err
+	}
+
+	now := time.Now()
+	approved := device != nil && device.Status == domain.DeviceStatusApproved
+	listed := len(user.AllowedDevices) > 0 && domain.AllowListPermits(user.AllowedDevices, deviceID)
+	if approved || listed {
+		if !approved {
+			return DeviceCheck{}, e.userDB.ApproveUserDevice(userID, deviceID, now)
+		}
+		if now.Sub(device.LastSeenAt) >= deviceSeenInterval {
+			return DeviceCheck{}, e.userDB.SeeUserDevice(userID, deviceID, device.Status, now)
+		}
+		return DeviceCheck{}, nil
+	}
+
+	code := domain.ReasonCode("")
+	switch {
+	case len(user.AllowedDevices) > 0:
+		code = domain.ReasonDeviceNotAllowed
+	case pkg != nil && pkg.MaxDevices > 0:
+		count, err := e.userDB.CountApprovedDevices(userID)
+		if err != nil {
+			return DeviceCheck{}, err
+		}
+		if count >= pkg.MaxDevices {
+			code = domain.ReasonDeviceLimit
+		}
+	}
+	if code == "" {
+		return DeviceCheck{}, e.userDB.ApproveUserDevice(userID, deviceID, now)
+	}
+
+	if device != nil {
+		if now.Sub(device.LastSeenAt) >= deviceSeenInterval {
+			err = e.userDB.SeeUserDevice(userID, deviceID, device.Status, now)
+		}
+		return DeviceCheck{ReasonCode: code}, err
+	}
+	e.logger.Info("device held for approval",
+		zap.String("user_id", userID),
+		zap.String("device_id", deviceID),
+		zap.String("reason", string(code)),
+	)
+	return DeviceCheck{ReasonCode: code, Held: true}, e.userDB.SeeUserDevice(userID, deviceID, domain.DeviceStatusPending, now)
+}
+
+// ApproveDevice approves a device for a user, also past the package's
+// max_devices. It returns nil when the user does not exist.
+func (e *QuotaEngine) ApproveDevice(userID, deviceID string) (*domain.Device, error) {
+	user, err := e.userDB.GetUser(userID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if err := e.userDB.ApproveUserDevice(userID, deviceID, time.Now()); err != nil {
+		return nil, err
+	}
+	return e.userDB.GetUserDevice(userID, deviceID)
+}
+
+// RemoveDevice drops a device from a user's registry and allowed_devices, so
+// it counts as new when it is seen again. It reports whether the device was
+// known.
+func (e *QuotaEngine) RemoveDevice(userID, deviceID string) (bool, error) {
+	e.userLocks.Lock(userID)
+	defer e.userLocks.Unlock(userID)
+
+	removed, err := e.userDB.DeleteUserDevice(userID, deviceID)
+	if err != nil {
+		return false, err
+	}
+	user, err := e.userDB.GetUser(userID)
+	if err != nil || user == nil {
+		return removed, err
+	}
+	kept := user.AllowedDevices[:0:0]
+	for _, id := range user.AllowedDevices {
+		if id != deviceID {
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == len(user.AllowedDevices) {
+		return removed, nil
+	}
+	user.AllowedDevices = kept
+	return true, e.userDB.UpdateUser(user)
+}
+
+// deviceRejectionReason describes a device rejection code
+func deviceRejectionReason(code domain.ReasonCode) string {
+	if code == domain.ReasonDeviceLimit {
+		return "device limit reached"
+	}
+	return "device is not approved for this user"
+}
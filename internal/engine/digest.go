@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"go.uber.org/zap"
+)
+
+// digestSuspensionEvents are the events counted as suspensions in a digest
+var digestSuspensionEvents = []domain.EventType{
+	domain.EventUserSuspended,
+	domain.EventPenaltyApplied,
+}
+
+// Digester compiles per-manager summaries and delivers them to managers that
+// opted in
+type Digester struct {
+	userDB    *sqlite.UserDB
+	activeDB  *sqlite.ActiveDB
+	historyDB *sqlite.HistoryDB
+	notifier  Notifier
+	logger    *zap.Logger
+}
+
+// NewDigester creates a digester. historyDB may be nil, in which case
+// suspensions are not counted.
+func NewDigester(userDB *sqlite.UserDB, activeDB *sqlite.ActiveDB, historyDB *sqlite.HistoryDB, notifier Notifier, logger *zap.Logger) *Digester {
+	return &Digester{
+		userDB:    userDB,
+		activeDB:  activeDB,
+		historyDB: historyDB,
+		notifier:  notifier,
+		logger:    logger,
+	}
+}
+
+// Build compiles a manager's digest over [start, end). Nodes owned by the
+// manager count as offline when they are draining or sent no reports in the
+// period. It returns nil when the manager does not exist.
+func (d *Digester) Build(managerID string, frequency domain.DigestFrequency, start, end time.Time) (*domain.ManagerDigest, error) {
+	manager, err := d.userDB.GetManager(managerID)
+	if err != nil || manager == nil {
+		return nil, err
+	}
+
+	digest := &domain.ManagerDigest{
+		ManagerID:    manager.ID,
+		ManagerName:  manager.Name,
+		Frequency:    frequency,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+		NodesOffline: []string{},
+	}
+
+	users, err := d.userDB.ListUsers(&domain.UserFilter{ManagerID: &managerID})
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make(map[string]bool, len(users))
+	for _, u := range users {
+		userIDs[u.ID] = true
+		if !u.CreatedAt.Before(start) && u.CreatedAt.Before(end) {
+			digest.NewUsers++
+		}
+	}
+
+	usage, err := d.activeDB.GetUsageByUserNode(start, end)
+	if err != nil {
+		return nil, err
+	}
+	reporting := make(map[string]bool)
+	for _, u := range usage {
+		reporting[u.NodeID] = true
+		if userIDs[u.UserID] {
+			digest.Upload += u.Upload
+			digest.Download += u.Download
+		}
+	}
+	digest.Total = digest.Upload + digest.Download
+
+	if d.historyDB != nil {
+		for _, eventType := range digestSuspensionEvents {
+			eventType := eventType
+			events, err := d.historyDB.GetEvents(&eventType, nil, &start, &end, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range events {
+				if e.UserID != nil && userIDs[*e.UserID] {
+					digest.Suspensions++
+				}
+			}
+		}
+	}
+
+	nodes, err := d.userDB.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if n.ManagerID == nil || *n.ManagerID != managerID {
+			continue
+		}
+		if n.Draining || !reporting[n.ID] {
+			digest.NodesOffline = append(digest.NodesOffline, n.Name)
+		}
+	}
+	sort.Strings(digest.NodesOffline)
+
+	return digest, nil
+}
+
+// Render turns a digest into a notification in the given language
+func (d *Digester) Render(digest *domain.ManagerDigest, lang string) *domain.Notification {
+	lang = domain.NegotiateLanguage(lang)
+	key := digest.Frequency.MessageKey()
+	return &domain.Notification{
+		Key:       key,
+		Recipient: digest.ManagerID,
+		Language:  lang,
+		Text: domain.Translate(key, lang, map[string]string{
+			"manager":       digest.ManagerName,
+			"new_users":     strconv.Itoa(digest.NewUsers),
+			"traffic":       strconv.FormatFloat(float64(digest.Total)/1e9, 'f', 2, 64),
+			"suspensions":   strconv.Itoa(digest.Suspensions),
+			"nodes_offline": strconv.Itoa(len(digest.NodesOffline)),
+		}),
+		Data:      digest,
+		CreatedAt: time.Now(),
+	}
+}
+
+// Run delivers the digests that are due: a subscription is due once its
+// period has passed since the last delivery. Delivery failures are logged
+// and retried on the next run; the first error is returned.
+func (d *Digester) Run(ctx context.Context, now time.Time) error {
+	subs, err := d.userDB.ListDigestSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, sub := range subs {
+		period := sub.Frequency.Period()
+		if period == 0 || sub.WebhookURL == "" {
+			continue
+		}
+		if sub.LastSentAt != nil && now.Sub(*sub.LastSentAt) < period {
+			continue
+		}
+
+		if err := d.deliver(ctx, sub, now.Add(-period), now); err != nil {
+			d.logger.Warn("failed to deliver manager digest", zap.String("manager_id", sub.ManagerID), zap.Error(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (d *Digester) deliver(ctx context.Context, sub *domain.DigestSubscription, start, end time.Time) error {
+	digest, err := d.Build(sub.ManagerID, sub.Frequency, start, end)
+	if err != nil || digest == nil {
+		return err
+	}
+
+	if err := d.notifier.Notify(ctx, sub.WebhookURL, d.Render(digest, sub.Language)); err != nil {
+		return err
+	}
+	if err := d.userDB.MarkDigestSent(sub.ManagerID, end); err != nil {
+		return err
+	}
+
+	d.logger.Info("manager digest delivered",
+		zap.String("manager_id", sub.ManagerID),
+		zap.String("frequency", string(sub.Frequency)),
+	)
+	return nil
+}
@@ -0,0 +1,40 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/storage/cache"
+)
+
+// SetDisconnectAckTimeout sets how long a delivered disconnect command waits
+// for the node's ack before it is delivered again
+func (e *Engine) SetDisconnectAckTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		e.disconnectAckTimeout = timeout
+	}
+}
+
+// SetDisconnectBatchSize caps how many disconnect commands one delivery
+// carries
+func (e *Engine) SetDisconnectBatchSize(size int) {
+	if size > 0 {
+		e.disconnectBatchSize = size
+	}
+}
+
+// TakeDisconnects returns up to limit disconnect commands due for a node,
+// oldest first. They stay queued until AckDisconnects removes them, and are
+// delivered again once the ack timeout passes. The limit is capped at the
+// batch size, which also applies when limit is 0.
+func (e *Engine) TakeDisconnects(nodeID string, limit int) []*cache.DisconnectCommand {
+	if limit <= 0 || limit > e.disconnectBatchSize {
+		limit = e.disconnectBatchSize
+	}
+	return e.cache.TakeDisconnects(nodeID, limit, e.disconnectAckTimeout)
+}
+
+// AckDisconnects removes the commands a node carried out from its queue and
+// returns how many were removed
+func (e *Engine) AckDisconnects(nodeID string, ids []string) int {
+	return e.cache.AckDisconnects(nodeID, ids)
+}
@@ -1,33 +1,76 @@
 package engine
 
 import (
+	"context"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/metrics"
 	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/internal/tracing"
 	"go.uber.org/zap"
 )
 
 // Engine is the main usage processing engine that coordinates all components
 type Engine struct {
-	quota    *QuotaEngine
-	session  *SessionManager
-	penalty  *PenaltyHandler
-	geo      *GeoHandler
-	events   eventstore.EventStore
+	quota       *QuotaEngine
+	session     *SessionManager
+	penalty     *PenaltyHandler
+	geo         *GeoHandler
+	events      eventstore.EventStore
 	receiverHub *eventstore.ReceiverHub
-	cache    *cache.MemoryCache
-	userDB   *sqlite.UserDB
-	logger   *zap.Logger
+	cache       cache.Cache
+	userDB      *sqlite.UserDB
+	logger      *zap.Logger
+
+	nodeThresholds       domain.NodeLoadThresholds
+	nodeHeartbeatTimeout time.Duration
+	nodeResetHistory     *sqlite.HistoryDB
+
+	retention    retentionPolicy
+	usageHistory *sqlite.HistoryDB
+
+	disconnectAckTimeout time.Duration
+	disconnectBatchSize  int
+
+	unknownUsers unknownUserPolicy
+
+	backfillAfter time.Duration
+
+	reportDedupWindow time.Duration
+
+	deviceLimitAction domain.DeviceLimitAction
+
+	panel    *PanelSync
+	webhooks *EventWebhooks
+	metrics  *metrics.Metrics
+
+	tagRules        []domain.TagRule
+	tagRuleLocation *time.Location
 }
 
 func (e *Engine) SetReceiverHub(hub *eventstore.ReceiverHub) {
 	e.receiverHub = hub
 }
 
+// SetPanelSync mirrors user status events to the Hiddify panel
+func (e *Engine) SetPanelSync(panel *PanelSync) {
+	e.panel = panel
+}
+
+// SetEventWebhooks posts emitted events to the configured webhooks
+func (e *Engine) SetEventWebhooks(webhooks *EventWebhooks) {
+	e.webhooks = webhooks
+}
+
+// SetMetrics counts processed reports, penalties and cache lookups
+func (e *Engine) SetMetrics(m *metrics.Metrics) {
+	e.metrics = m
+}
+
 // NewEngine creates a new Engine instance
 func NewEngine(
 	quota *QuotaEngine,
@@ -35,7 +78,7 @@ func NewEngine(
 	penalty *PenaltyHandler,
 	geo *GeoHandler,
 	events eventstore.EventStore,
-	cache *cache.MemoryCache,
+	cache cache.Cache,
 	userDB *sqlite.UserDB,
 	logger *zap.Logger,
 ) *Engine {
@@ -48,55 +91,224 @@ func NewEngine(
 		cache:   cache,
 		userDB:  userDB,
 		logger:  logger,
+
+		nodeHeartbeatTimeout: 2 * time.Minute,
+		disconnectAckTimeout: 30 * time.Second,
+		disconnectBatchSize:  50,
+		deviceLimitAction:    domain.DeviceLimitActionReject,
 	}
 }
 
 // ProcessUsageReport processes a usage report from a node/service
 func (e *Engine) ProcessUsageReport(report *domain.UsageReport) *domain.UsageReportResult {
+	return e.ProcessUsageReportContext(context.Background(), report)
+}
+
+// ProcessUsageReportContext processes a usage report on behalf of a request;
+// ctx bounds outside calls such as provisioning an unknown user
+func (e *Engine) ProcessUsageReportContext(ctx context.Context, report *domain.UsageReport) *domain.UsageReportResult {
+	ctx, span := tracing.Start(ctx, "engine.ProcessUsageReport")
+	defer span.End()
+	span.SetAttribute("hue.user_id", report.UserID)
+	span.SetAttribute("hue.node_id", report.NodeID)
+	span.SetAttribute("hue.service_id", report.ServiceID)
+
+	if duplicate := e.duplicateReport(report); duplicate != nil {
+		span.SetAttribute("hue.duplicate", true)
+		return duplicate
+	}
+
+	result := e.processUsageReport(ctx, report)
+	e.rememberReport(report, result)
+	span.SetAttribute("hue.accepted", result.Accepted)
+	if result.ReasonCode != "" {
+		span.SetAttribute("hue.reason_code", string(result.ReasonCode))
+	}
+	if report.NodeID != "" {
+		e.cache.RecordNodeReport(report.NodeID, result.Accepted)
+	}
+	e.observeReport(result)
+	return result
+}
+
+// observeReport counts a processed report in the metrics
+func (e *Engine) observeReport(result *domain.UsageReportResult) {
+	if e.metrics == nil {
+		return
+	}
+	if result.Accepted {
+		e.metrics.Reports.Inc("accepted")
+		return
+	}
+	e.metrics.Reports.Inc("rejected")
+	e.metrics.Rejections.Inc(string(result.ReasonCode))
+	if result.ReasonCode == domain.ReasonQuotaExceeded {
+		e.metrics.QuotaExceeded.Inc()
+	}
+}
+
+func (e *Engine) processUsageReport(ctx context.Context, report *domain.UsageReport) *domain.UsageReportResult {
 	result := &domain.UsageReportResult{
-		UserID:    report.UserID,
-		Accepted:  false,
+		UserID:   report.UserID,
+		Accepted: false,
+	}
+
+	// Absolute counters advance even when the report is rejected, so the
+	// rejected bytes are not charged later
+	if err := e.quota.NormalizeCounters(report); err != nil {
+		result.Reason = "failed to compute counter delta"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("failed to compute counter delta", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+
+	if !e.CheckUnknownUser(ctx, report, result) {
+		return result
+	}
+
+	// Traffic buffered through a node outage is charged at its own time
+	if e.IsBackfill(report) {
+		return e.ProcessBackfill(report)
 	}
 
 	// 1. Check penalty first
-	penaltyResult := e.penalty.CheckPenalty(report.UserID)
-	if penaltyResult.HasPenalty {
+	if penaltyResult := e.penalty.BlockingPenalty(report.UserID, report.SessionID); penaltyResult != nil {
 		result.ShouldDisconnect = true
+		result.SetPenalty(penaltyResult.Reason, penaltyResult.TimeLeft)
 		result.Reason = "user has active penalty"
+		result.ReasonCode = domain.ReasonUserPenalized
+		return result
+	}
+
+	// Suspended, finished or expired users are rejected from memory
+	if rejected := e.quota.CachedRejection(report.UserID); rejected != nil {
+		result.ShouldDisconnect = true
+		result.Reason = rejected.Reason
+		result.ReasonCode = rejected.ReasonCode
 		return result
 	}
 
 	// 2. Get user's package for max concurrent
+	_, span := tracing.Start(ctx, "sqlite.GetPackageByUserID")
 	pkg, err := e.userDB.GetPackageByUserID(report.UserID)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		result.Reason = "failed to get package"
+		result.ReasonCode = domain.ReasonInternalError
 		e.logger.Error("failed to get package", zap.String("user_id", report.UserID), zap.Error(err))
 		return result
 	}
 	if pkg == nil {
 		result.Reason = "no active package"
+		result.ReasonCode = domain.ReasonNoActivePackage
+		return result
+	}
+	result.Priority = pkg.Priority
+
+	// Reject reports through nodes or services the user may not use
+	accessCode, err := e.quota.CheckAccess(report.UserID, report.NodeID, report.ServiceID, pkg)
+	if err != nil {
+		result.Reason = "access check failed"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("access check failed", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+	if accessCode != "" {
+		result.ShouldDisconnect = true
+		result.Reason = accessRejectionReason(accessCode)
+		result.ReasonCode = accessCode
+		return result
+	}
+
+	// Reject devices that are not approved or past the package's device limit
+	device, err := e.quota.CheckDevice(report.UserID, report.DeviceID, pkg)
+	if err != nil {
+		result.Reason = "device check failed"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("device check failed", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+	if device.ReasonCode != "" {
+		if device.Held {
+			pending := domain.DevicePending{DeviceID: report.DeviceID, Reason: device.ReasonCode}
+			e.emitEventWithMetadata(domain.EventDevicePending, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, nil, pending.Metadata())
+		}
+		result.ShouldDisconnect = true
+		result.Reason = deviceRejectionReason(device.ReasonCode)
+		result.ReasonCode = device.ReasonCode
+		if device.ReasonCode == domain.ReasonDeviceLimit && e.deviceLimitAction == domain.DeviceLimitActionPenalize {
+			if e.penalize(result, report, pkg, string(domain.ReasonDeviceLimit), &report.NodeID, &report.ServiceID, []string{"device_limit"}) {
+				result.Reason = "device limit reached, penalty applied"
+			}
+		}
+		return result
+	}
+
+	// Charge traffic through the node's multiplier; node and service counters
+	// keep the measured bytes
+	traffic, err := e.quota.BillUsage(report.NodeID, report.Upload, report.Download)
+	if err != nil {
+		result.Reason = "failed to bill usage"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("failed to bill usage", zap.String("node_id", report.NodeID), zap.Error(err))
 		return result
 	}
 
 	// 3. Check/validate session
-	sessionResult := e.session.CheckSession(report.UserID, report.SessionID, report.ClientIP, pkg.MaxConcurrent)
+	identity := e.session.IdentityKey(
+		e.session.ResolveIdentity(pkg, func() []string { return e.quota.UserGroups(report.UserID) }),
+		report.SessionID, report.ClientIP, report.DeviceID,
+	)
+	sessionResult := e.session.CheckSession(report.UserID, report.SessionID, identity, report.ClientIP, e.quota.MaxConcurrent(report.UserID, pkg), pkg.MaxIPs, e.session.ResolveReplace(pkg))
 
 	if sessionResult.SessionLimitHit {
-		// Apply penalty
-		e.penalty.ApplyPenalty(report.UserID, "concurrent_session_limit_exceeded")
-		result.PenaltyApplied = true
 		result.ShouldDisconnect = true
-		result.Reason = "concurrent session limit exceeded, penalty applied"
+		result.Reason = "concurrent session limit exceeded"
+		result.ReasonCode = domain.ReasonConcurrentLimit
+		if e.penalize(result, report, pkg, string(domain.ReasonConcurrentLimit), nil, nil, []string{"concurrent_limit"}) {
+			result.Reason += ", penalty applied"
+		}
+		return result
+	}
+	if sessionResult.IPLimitHit {
+		result.ShouldDisconnect = true
+		result.Reason = "distinct IP limit exceeded"
+		result.ReasonCode = domain.ReasonIPLimit
+		if e.penalize(result, report, pkg, string(domain.ReasonIPLimit), nil, nil, []string{"ip_limit"}) {
+			result.Reason += ", penalty applied"
+		}
+		return result
+	}
 
-		// Emit event
-		e.emitEvent(domain.EventPenaltyApplied, &report.UserID, &pkg.ID, nil, nil, []string{"concurrent_limit"})
+	// Steer new sessions away from draining (overloaded) nodes
+	if sessionResult.IsNewSession && e.cache.IsNodeDraining(report.NodeID) {
+		result.ShouldDisconnect = true
+		result.Reason = "node is draining"
+		result.ReasonCode = domain.ReasonNodeDraining
 		return result
 	}
+	if sessionResult.IsNewSession {
+		full, err := e.nodeUserLimitReached(report.NodeID, report.UserID)
+		if err != nil {
+			result.Reason = "node user limit check failed"
+			result.ReasonCode = domain.ReasonInternalError
+			e.logger.Error("node user limit check failed", zap.String("node_id", report.NodeID), zap.Error(err))
+			return result
+		}
+		if full {
+			result.ShouldDisconnect = true
+			result.Reason = "node active user limit reached"
+			result.ReasonCode = domain.ReasonNodeUserLimit
+			return result
+		}
+	}
 
 	managerSessionDelta := int64(0)
 	managerOnlineDelta := int64(0)
 	managerActiveDelta := int64(0)
-	if sessionResult.IsNewSession {
+	// A replaced session hands its manager counters over to the new one
+	if sessionResult.IsNewSession && sessionResult.ReplacedSessionID == "" {
 		managerSessionDelta = 1
 		if sessionResult.CurrentCount == 0 {
 			managerOnlineDelta = 1
@@ -106,86 +318,247 @@ func (e *Engine) ProcessUsageReport(report *domain.UsageReport) *domain.UsageRep
 		mgrRes, err := e.quota.CheckManagerSessionLimits(report.UserID, managerSessionDelta, managerOnlineDelta, managerActiveDelta)
 		if err != nil {
 			result.Reason = "manager limit check failed"
+			result.ReasonCode = domain.ReasonInternalError
 			e.logger.Error("manager session limit check failed", zap.String("user_id", report.UserID), zap.Error(err))
 			return result
 		}
 		if mgrRes != nil && !mgrRes.Allowed {
 			result.ShouldDisconnect = true
 			result.Reason = mgrRes.Reason
-			e.emitEvent(domain.EventManagerLimitReached, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, []string{"manager_limit"})
+			result.ReasonCode = domain.ReasonManagerLimit
+			limit := domain.ManagerLimitReached{ManagerID: mgrRes.ManagerID, Reason: mgrRes.Reason}
+			e.emitEventWithMetadata(domain.EventManagerLimitReached, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, []string{"manager_limit"}, limit.Metadata())
 			return result
 		}
 	}
 
 	// 4. Check quota
-	quotaResult, err := e.quota.CheckQuota(report.UserID, report.Upload, report.Download)
+	_, span = tracing.Start(ctx, "quota.CheckQuota")
+	quotaResult, err := e.quota.CheckQuota(report.UserID, traffic.BilledUpload, traffic.BilledDownload)
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		result.Reason = "quota check failed"
+		result.ReasonCode = domain.ReasonInternalError
 		e.logger.Error("quota check failed", zap.String("user_id", report.UserID), zap.Error(err))
 		return result
 	}
+	if e.metrics != nil {
+		if quotaResult.Cached {
+			e.metrics.CacheLookups.Inc("hit")
+		} else {
+			e.metrics.CacheLookups.Inc("miss")
+		}
+	}
 
 	if !quotaResult.CanUse {
 		result.QuotaExceeded = quotaResult.QuotaExceeded
 		result.ShouldDisconnect = true
 		result.Reason = quotaResult.Reason
+		result.ReasonCode = quotaResult.ReasonCode
 
 		// Suspend user if quota exceeded
 		if quotaResult.QuotaExceeded {
 			e.userDB.UpdateUserStatus(report.UserID, domain.UserStatusSuspended)
-			e.emitEvent(domain.EventUserSuspended, &report.UserID, &pkg.ID, nil, nil, []string{"quota_exceeded"})
+			usage := domain.PackageTrafficUsage(e.quota.withPendingUsage(pkg))
+			change := domain.StatusChange{To: domain.UserStatusSuspended, Reason: "quota_exceeded", Usage: &usage}
+			e.emitEventWithMetadata(domain.EventUserSuspended, &report.UserID, &pkg.ID, nil, nil, []string{"quota_exceeded"}, change.Metadata())
 		}
 		return result
 	}
 
 	// 5. Extract geo data (IP is discarded after this)
 	var geoData *domain.GeoData
-	if e.geo != nil && e.geo.IsReady() && report.ClientIP != "" {
+	if e.geo != nil && (e.geo.IsReady() || e.geo.HasASN()) && report.ClientIP != "" {
 		geoData = e.geo.ExtractGeo(report.ClientIP)
 	}
+	e.ApplyTagRules(report, geoData)
+
+	// Reject reports from countries the user, package or a group excludes
+	rule, err := e.quota.CheckCountry(report.UserID, pkg, geoData)
+	if err != nil {
+		result.Reason = "country check failed"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("country check failed", zap.String("user_id", report.UserID), zap.Error(err))
+		return result
+	}
+	if rule != "" {
+		rejection := domain.CountryRejection{Country: geoData.Country, CountryCode: geoData.CountryCode, Rule: rule}
+		e.emitEventWithMetadata(domain.EventCountryRejected, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, []string{rule}, rejection.Metadata())
+		result.ShouldDisconnect = true
+		result.Reason = "country is not allowed"
+		result.ReasonCode = domain.ReasonCountryNotAllowed
+		return result
+	}
+
+	// 6. Detect cross-node or impossible roaming
+	roaming := e.session.CheckRoaming(report.UserID, report.SessionID, report.NodeID, geoData)
+	if roaming.Detected() {
+		info := domain.SessionRoaming{
+			SessionID:       report.SessionID,
+			Reason:          roaming.Reason,
+			NodeID:          roaming.NodeID,
+			PreviousNodeID:  roaming.PreviousNodeID,
+			Country:         roaming.Country,
+			PreviousCountry: roaming.PreviousCountry,
+			Penalized:       roaming.Penalize,
+		}
+		e.emitEventWithMetadata(domain.EventSessionRoaming, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, []string{roaming.Reason}, info.Metadata())
+		if roaming.Penalize {
+			result.ShouldDisconnect = true
+			result.Reason = "session roaming detected"
+			result.ReasonCode = domain.ReasonCode(roaming.Reason)
+			if e.penalize(result, report, pkg, roaming.Reason, &report.NodeID, &report.ServiceID, []string{roaming.Reason}) {
+				result.Reason += ", penalty applied"
+			}
+			return result
+		}
+	}
 
-	// 6. Add/update session
+	// 7. Add/update session
 	if sessionResult.IsNewSession {
-		e.session.AddSession(report.UserID, report.SessionID, report.ClientIP, geoData)
+		e.session.AddSession(report.UserID, report.SessionID, identity, report.NodeID, report.ClientIP, geoData)
 		if err := e.quota.RecordManagerSessionDelta(report.UserID, managerSessionDelta, managerOnlineDelta, managerActiveDelta); err != nil {
 			e.logger.Warn("failed to record manager session delta", zap.String("user_id", report.UserID), zap.Error(err))
 		}
-		e.emitEvent(domain.EventUserConnected, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, report.Tags)
+		connected := domain.SessionConnected{SessionID: report.SessionID, Sessions: e.session.GetActiveSessionCount(report.UserID), Geo: geoData}
+		e.emitEventWithMetadata(domain.EventUserConnected, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, report.Tags, connected.Metadata())
 	} else {
-		e.session.AddSession(report.UserID, report.SessionID, report.ClientIP, geoData)
+		e.session.AddSession(report.UserID, report.SessionID, identity, report.NodeID, report.ClientIP, geoData)
 	}
 
-	// 7. Record usage
-	if err := e.quota.RecordUsage(report.UserID, report.Upload, report.Download); err != nil {
+	// 8. Record usage for the user, node and service
+	_, span = tracing.Start(ctx, "quota.RecordUsage")
+	err = e.quota.RecordReportUsage(report, traffic)
+	span.SetError(err)
+	span.End()
+	if err != nil {
 		result.Reason = "failed to record usage"
+		result.ReasonCode = domain.ReasonInternalError
 		e.logger.Error("failed to record usage", zap.String("user_id", report.UserID), zap.Error(err))
 		return result
 	}
 
-	// 8. Update node and service usage
-	if err := e.userDB.UpdateNodeUsage(report.NodeID, report.Upload, report.Download); err != nil {
-		e.logger.Warn("failed to update node usage", zap.String("node_id", report.NodeID), zap.Error(err))
-	}
-	if err := e.userDB.UpdateServiceUsage(report.ServiceID, report.Upload, report.Download); err != nil {
-		e.logger.Warn("failed to update service usage", zap.String("service_id", report.ServiceID), zap.Error(err))
+	e.startPackage(report.UserID, pkg, time.Now())
+
+	_, span = tracing.Start(ctx, "sqlite.BufferReport")
+	if err := e.quota.BufferReport(report, traffic); err != nil {
+		span.SetError(err)
+		e.logger.Warn("failed to buffer usage report", zap.String("user_id", report.UserID), zap.Error(err))
 	}
+	span.End()
+	e.recordUsageHistory(report, pkg.ID, traffic, geoData)
 
 	// 9. Emit usage recorded event
-	e.emitEvent(domain.EventUsageRecorded, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, report.Tags)
+	e.emitEventWithMetadata(domain.EventUsageRecorded, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, report.Tags, traffic.Metadata())
+
+	// 10. Estimate throughput and flag sustained high speed
+	speed := e.session.RecordThroughput(report.UserID, report.SessionID, report.Upload, report.Download)
+	if speed.Exceeded {
+		exceeded := domain.SpeedExceeded{
+			Bps:          speed.UploadBps + speed.DownloadBps,
+			ThresholdBps: speed.ThresholdBps,
+			Since:        speed.Since,
+		}
+		e.emitEventWithMetadata(domain.EventUserSpeedExceeded, &report.UserID, &pkg.ID, &report.NodeID, &report.ServiceID, report.Tags, exceeded.Metadata())
+	}
 
-	// 10. Check if package should be finished
+	// 11. Check if package should be finished
+	_, span = tracing.Start(ctx, "sqlite.GetPackage")
 	updatedPkg, _ := e.userDB.GetPackage(pkg.ID)
+	updatedPkg = e.quota.withPendingUsage(updatedPkg)
+	span.End()
 	if updatedPkg != nil && !updatedPkg.HasTrafficRemaining() {
-		e.userDB.UpdatePackageStatus(pkg.ID, domain.PackageStatusFinish)
-		e.userDB.UpdateUserStatus(report.UserID, domain.UserStatusFinish)
-		e.emitEvent(domain.EventPackageExpired, &report.UserID, &pkg.ID, nil, nil, nil)
+		e.finishPackage(report.UserID, updatedPkg)
 	}
 
 	result.Accepted = true
 	result.PackageID = pkg.ID
+	result.RateLimit = quotaResult.RateLimit
+	result.SetTraffic(traffic)
 	return result
 }
 
+// startPackage starts a package that has not started yet on its first
+// accepted traffic, so its duration counts from first use, and emits
+// USER_PACKAGE_STARTED
+func (e *Engine) startPackage(userID string, pkg *domain.Package, at time.Time) {
+	if pkg.StartAt != nil {
+		return
+	}
+	pkg.Start(at)
+	started, err := e.userDB.StartPackage(pkg.ID, *pkg.StartAt, pkg.ExpiresAt)
+	if err != nil {
+		e.logger.Error("failed to start package", zap.String("package_id", pkg.ID), zap.Error(err))
+		return
+	}
+	if !started {
+		return
+	}
+	info := domain.PackageStarted{StartAt: *pkg.StartAt, ExpiresAt: pkg.ExpiresAt}
+	e.emitEventWithMetadata(domain.EventUserPackageStarted, &userID, &pkg.ID, nil, nil, nil, info.Metadata())
+}
+
+// finishPackage marks a package whose traffic ran out as finished and emits
+// PACKAGE_EXPIRED with its usage. The user moves on to their next queued
+// package, or is marked finished when the queue is empty.
+func (e *Engine) finishPackage(userID string, pkg *domain.Package) {
+	if err := e.userDB.UpdatePackageStatus(pkg.ID, domain.PackageStatusFinish); err != nil {
+		e.logger.Error("failed to mark package as finished", zap.String("package_id", pkg.ID), zap.Error(err))
+	}
+	expiry := domain.PackageExpiry{Reason: "traffic", Usage: domain.PackageTrafficUsage(pkg)}
+	e.emitEventWithMetadata(domain.EventPackageExpired, &userID, &pkg.ID, nil, nil, nil, expiry.Metadata())
+
+	if e.promoteNextPackage(userID, pkg.ID) != nil {
+		return
+	}
+	if err := e.userDB.UpdateUserStatus(userID, domain.UserStatusFinish); err != nil {
+		e.logger.Error("failed to mark user as finished", zap.String("user_id", userID), zap.Error(err))
+	}
+}
+
+// promoteNextPackage activates the first package in the user's queue after
+// previousID finished or expired and emits PACKAGE_ACTIVATED. It returns nil
+// when the queue is empty or the promotion failed.
+func (e *Engine) promoteNextPackage(userID, previousID string) *domain.Package {
+	next, err := e.userDB.NextQueuedPackage(userID)
+	if err != nil {
+		e.logger.Error("failed to load queued package", zap.String("user_id", userID), zap.Error(err))
+		return nil
+	}
+	if next == nil {
+		return nil
+	}
+	activated, err := e.userDB.ActivatePackage(userID, next.ID)
+	if err != nil {
+		e.logger.Error("failed to activate queued package", zap.String("user_id", userID), zap.String("package_id", next.ID), zap.Error(err))
+		return nil
+	}
+	if !activated {
+		return nil
+	}
+	e.quota.InvalidateUser(userID)
+
+	next.Status = domain.PackageStatusActive
+	next.QueuePosition = 0
+	info := domain.PackageActivated{PreviousPackageID: previousID}
+	e.emitEventWithMetadata(domain.EventPackageActivated, &userID, &next.ID, nil, nil, []string{previousID}, info.Metadata())
+	e.logger.Info("queued package activated",
+		zap.String("user_id", userID),
+		zap.String("package_id", next.ID),
+		zap.String("previous_package_id", previousID),
+	)
+	return next
+}
+
+// accessRejectionReason returns the log-friendly reason for a CheckAccess code
+func accessRejectionReason(code domain.ReasonCode) string {
+	if code == domain.ReasonNodeNotInPlan {
+		return "node or service is not allowed for this user or package"
+	}
+	return "node or service belongs to another manager"
+}
+
 // HandleUserDisconnect handles a user disconnection
 func (e *Engine) HandleUserDisconnect(userID, sessionID string) {
 	before := e.session.GetActiveSessionCount(userID)
@@ -209,7 +582,45 @@ func (e *Engine) HandleUserDisconnect(userID, sessionID string) {
 	}
 
 	// Emit disconnect event
-	e.emitEvent(domain.EventUserDisconnected, &userID, nil, nil, nil, nil)
+	disconnected := domain.SessionDisconnected{SessionID: sessionID, Sessions: after}
+	e.emitEventWithMetadata(domain.EventUserDisconnected, &userID, nil, nil, nil, nil, disconnected.Metadata())
+}
+
+// ForceDisconnect ends a user's sessions on an admin's request: a
+// disconnect command is queued for each session's node and the session is
+// removed. An empty sessionID ends every session. It returns the number of
+// sessions ended.
+func (e *Engine) ForceDisconnect(userID, sessionID string) int {
+	ended := e.endSessions(userID, sessionID, domain.ReasonAdminDisconnect)
+	if ended > 0 {
+		e.logger.Info("user disconnected by admin",
+			zap.String("user_id", userID),
+			zap.String("session_id", sessionID),
+			zap.Int("sessions", ended),
+		)
+	}
+	return ended
+}
+
+// endSessions queues a disconnect command for each of a user's sessions, or
+// the one matching sessionID, and removes it
+func (e *Engine) endSessions(userID, sessionID string, reason domain.ReasonCode) int {
+	ended := 0
+	for _, session := range e.session.GetUserSessions(userID) {
+		if sessionID != "" && session.SessionID != sessionID {
+			continue
+		}
+		e.cache.QueueDisconnect(userID, session.SessionID, string(reason), session.NodeID)
+		e.HandleUserDisconnect(userID, session.SessionID)
+		ended++
+	}
+	return ended
+}
+
+// ShedNodeLoad disconnects up to count sessions on an overloaded node, lowest
+// package priority first
+func (e *Engine) ShedNodeLoad(nodeID string, count int) int {
+	return e.session.ShedNodeSessions(nodeID, count, e.quota.UserPriority, string(domain.ReasonNodeOverloaded))
 }
 
 // GetDisconnectBatch returns pending disconnect commands
@@ -225,6 +636,8 @@ func (e *Engine) Cleanup() {
 	// Cleanup expired penalties
 	penaltyCount := e.penalty.CleanupExpiredPenalties()
 
+	e.pruneProvisionFailures()
+
 	if sessionCount > 0 || penaltyCount > 0 {
 		e.logger.Info("cleanup completed",
 			zap.Int("stale_sessions", sessionCount),
@@ -233,8 +646,46 @@ func (e *Engine) Cleanup() {
 	}
 }
 
-// emitEvent emits an event to the event store
-func (e *Engine) emitEvent(eventType domain.EventType, userID, packageID, nodeID, serviceID *string, tags []string) {
+// EmitPenalty records a PENALTY_APPLIED event carrying when the penalty ends
+func (e *Engine) EmitPenalty(applied *PenaltyResult, userID string, packageID, nodeID, serviceID *string, tags []string) {
+	info := domain.PenaltyInfo{Reason: applied.Reason, Action: applied.Action, ExpiresAt: applied.ExpiresAt, Strike: applied.Strike}
+	if e.metrics != nil {
+		e.metrics.PenaltiesApplied.Inc(applied.Reason)
+	}
+	e.emitEventWithMetadata(domain.EventPenaltyApplied, &userID, packageID, nodeID, serviceID, tags, info.Metadata())
+}
+
+// penalize applies the penalty policy of the report's package and groups for
+// reason, recording it on result and the event stream. It reports whether a
+// penalty was applied; under the none action only the report is rejected.
+func (e *Engine) penalize(result *domain.UsageReportResult, report *domain.UsageReport, pkg *domain.Package, reason string, nodeID, serviceID *string, tags []string) bool {
+	applied := e.penalty.ApplyPenalty(report.UserID, reason, e.quota.PenaltyPolicy(report.UserID, pkg))
+	if applied == nil {
+		return false
+	}
+	result.SetPenalty(applied.Reason, applied.TimeLeft)
+	result.PenaltyApplied = true
+	e.EmitPenalty(applied, report.UserID, &pkg.ID, nodeID, serviceID, tags)
+	return true
+}
+
+// EmitStatusChange records an admin change of a user's status, so a
+// reactivation or a manual suspension reaches the event stream and the panel
+func (e *Engine) EmitStatusChange(userID string, from, to domain.UserStatus) {
+	if from == to {
+		return
+	}
+	change := domain.StatusChange{From: from, To: to, Reason: "admin"}
+	switch to {
+	case domain.UserStatusActive:
+		e.emitEventWithMetadata(domain.EventUserActivated, &userID, nil, nil, nil, []string{"admin"}, change.Metadata())
+	case domain.UserStatusSuspended:
+		e.emitEventWithMetadata(domain.EventUserSuspended, &userID, nil, nil, nil, []string{"admin"}, change.Metadata())
+	}
+}
+
+// emitEventWithMetadata emits an event carrying JSON metadata
+func (e *Engine) emitEventWithMetadata(eventType domain.EventType, userID, packageID, nodeID, serviceID *string, tags []string, metadata []byte) {
 	if e.events == nil {
 		return
 	}
@@ -247,6 +698,7 @@ func (e *Engine) emitEvent(eventType domain.EventType, userID, packageID, nodeID
 		NodeID:    nodeID,
 		ServiceID: serviceID,
 		Tags:      tags,
+		Metadata:  metadata,
 		Timestamp: time.Now(),
 	}
 
@@ -260,4 +712,10 @@ func (e *Engine) emitEvent(eventType domain.EventType, userID, packageID, nodeID
 	if e.receiverHub != nil {
 		e.receiverHub.Publish(event)
 	}
+	if e.panel != nil {
+		e.panel.Enqueue(event)
+	}
+	if e.webhooks != nil {
+		e.webhooks.Enqueue(event)
+	}
 }
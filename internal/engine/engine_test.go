@@ -1,14 +1,24 @@
 package engine
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/metrics"
 	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/pkg/panelhook"
 	"go.uber.org/zap"
 )
 
@@ -51,6 +61,23 @@ func (s *capturingEventStore) GetAllEvents(limit int) ([]*domain.Event, error) {
 	return out, nil
 }
 
+func (s *capturingEventStore) ListEvents(filter domain.EventFilter) (*domain.EventPage, error) {
+	events, err := s.GetEvents(filter.Type, filter.UserID, filter.Limit)
+	return &domain.EventPage{Events: events}, err
+}
+
+func (s *capturingEventStore) ReplayEvents(filter domain.EventReplayFilter, fn func(*domain.Event) error) error {
+	for _, ev := range s.events {
+		if filter.UserID != nil && (ev.UserID == nil || *ev.UserID != *filter.UserID) {
+			continue
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *capturingEventStore) Close() error {
 	return nil
 }
@@ -212,14 +239,68 @@ func TestProcessUsageReport_AcceptsAndRecordsUsage(t *testing.T) {
 		t.Fatalf("expected 1 active session, got %d", got)
 	}
 
-	if len(fx.events.events) != 2 {
-		t.Fatalf("expected 2 emitted events, got %d", len(fx.events.events))
+	if len(fx.events.events) != 3 {
+		t.Fatalf("expected 3 emitted events, got %d", len(fx.events.events))
 	}
 	if fx.events.events[0].Type != domain.EventUserConnected {
 		t.Fatalf("expected first event USER_CONNECTED, got %s", fx.events.events[0].Type)
 	}
-	if fx.events.events[1].Type != domain.EventUsageRecorded {
-		t.Fatalf("expected second event USAGE_RECORDED, got %s", fx.events.events[1].Type)
+	connected, err := fx.events.events[0].DecodeMetadata()
+	if err != nil {
+		t.Fatalf("decode USER_CONNECTED metadata: %v", err)
+	}
+	if info, ok := connected.(*domain.SessionConnected); !ok || info.SessionID != "s1" || info.Sessions != 1 {
+		t.Fatalf("expected the session in USER_CONNECTED metadata, got %#v", connected)
+	}
+	if fx.events.events[1].Type != domain.EventUserPackageStarted {
+		t.Fatalf("expected second event USER_PACKAGE_STARTED, got %s", fx.events.events[1].Type)
+	}
+	if fx.events.events[2].Type != domain.EventUsageRecorded {
+		t.Fatalf("expected third event USAGE_RECORDED, got %s", fx.events.events[2].Type)
+	}
+}
+
+func TestProcessUsageReport_StartsPackageOnFirstUse(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+
+	for i := 0; i < 2; i++ {
+		before := time.Now()
+		result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "s1",
+			Upload:    10,
+			Download:  10,
+			Timestamp: time.Now(),
+		})
+		if !result.Accepted {
+			t.Fatalf("expected report %d to be accepted, got reason=%q", i, result.Reason)
+		}
+
+		pkg, err := fx.userDB.GetPackage(fx.packageID)
+		if err != nil {
+			t.Fatalf("get package: %v", err)
+		}
+		if pkg.StartAt == nil || pkg.ExpiresAt == nil {
+			t.Fatalf("expected the package to start on first use, got start=%v expires=%v", pkg.StartAt, pkg.ExpiresAt)
+		}
+		if i == 0 && pkg.StartAt.Before(before.Add(-time.Second)) {
+			t.Fatalf("expected start_at at the first report, got %v", pkg.StartAt)
+		}
+		if got := pkg.ExpiresAt.Sub(*pkg.StartAt); got != time.Hour {
+			t.Fatalf("expected expiry one duration after start, got %v", got)
+		}
+	}
+
+	startedType := domain.EventUserPackageStarted
+	events, _ := fx.events.GetEvents(&startedType, &fx.userID, 0)
+	if len(events) != 1 {
+		t.Fatalf("expected one USER_PACKAGE_STARTED event, got %d", len(events))
+	}
+	var info domain.PackageStarted
+	if err := json.Unmarshal(events[0].Metadata, &info); err != nil || info.ExpiresAt == nil {
+		t.Fatalf("expected start metadata with an expiry, got %s (%v)", events[0].Metadata, err)
 	}
 }
 
@@ -257,6 +338,12 @@ func TestProcessUsageReport_AppliesPenaltyOnConcurrentLimit(t *testing.T) {
 	if !second.PenaltyApplied || !second.ShouldDisconnect {
 		t.Fatalf("expected penalty and disconnect, got penalty=%v disconnect=%v", second.PenaltyApplied, second.ShouldDisconnect)
 	}
+	if second.ReasonCode != domain.ReasonConcurrentLimit {
+		t.Fatalf("expected reason code %s, got %q", domain.ReasonConcurrentLimit, second.ReasonCode)
+	}
+	if second.PenaltyReason == "" || second.PenaltySecondsLeft <= 0 {
+		t.Fatalf("expected penalty reason and time left, got %q/%d", second.PenaltyReason, second.PenaltySecondsLeft)
+	}
 
 	pen := fx.penalty.CheckPenalty(fx.userID)
 	if !pen.HasPenalty {
@@ -295,6 +382,138 @@ func TestProcessUsageReport_AppliesPenaltyOnConcurrentLimit(t *testing.T) {
 	}
 }
 
+func TestProcessUsageReport_EscalatesRepeatPenalties(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 5_000)
+	fx.penalty.SetEscalation([]time.Duration{time.Minute, 10 * time.Minute, time.Hour}, time.Hour)
+
+	report := func(sessionID, ip string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  ip,
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+	if first := report("s1", "10.0.0.1"); !first.Accepted {
+		t.Fatalf("expected first report to be accepted, got reason=%q", first.Reason)
+	}
+
+	want := []time.Duration{time.Minute, 10 * time.Minute, time.Hour, time.Hour}
+	for i, duration := range want {
+		result := report(fmt.Sprintf("extra-%d", i), fmt.Sprintf("10.0.1.%d", i))
+		if !result.PenaltyApplied {
+			t.Fatalf("violation %d: expected a penalty", i+1)
+		}
+		left := time.Duration(result.PenaltySecondsLeft) * time.Second
+		if left < duration-time.Second || left > duration {
+			t.Fatalf("violation %d: expected a %v penalty, got %v", i+1, duration, left)
+		}
+		fx.penalty.ClearPenalty(fx.userID)
+	}
+
+	eventType := domain.EventPenaltyApplied
+	events, _ := fx.events.GetEvents(&eventType, &fx.userID, 0)
+	if len(events) != len(want) {
+		t.Fatalf("expected %d penalty events, got %d", len(want), len(events))
+	}
+	var info domain.PenaltyInfo
+	if err := json.Unmarshal(events[len(events)-1].Metadata, &info); err != nil || info.Strike != len(want) {
+		t.Fatalf("expected the last penalty to be strike %d, got %+v (%v)", len(want), info, err)
+	}
+}
+
+func TestProcessUsageReport_AppliesPackagePenaltyPolicy(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 5_000)
+	if _, err := fx.userDB.Exec(`UPDATE packages SET penalty_duration = 30, penalty_action = 'reject' WHERE id = ?`, fx.packageID); err != nil {
+		t.Fatalf("set penalty policy: %v", err)
+	}
+
+	report := func(sessionID, ip string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  ip,
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+	if first := report("s1", "10.0.0.1"); !first.Accepted {
+		t.Fatalf("expected first report to be accepted, got reason=%q", first.Reason)
+	}
+
+	second := report("s2", "10.0.0.2")
+	if !second.PenaltyApplied || second.PenaltySecondsLeft != 30 {
+		t.Fatalf("expected the package's 30s penalty, got penalty=%v seconds=%d", second.PenaltyApplied, second.PenaltySecondsLeft)
+	}
+	if batch := fx.engine.GetDisconnectBatch(); len(batch) != 0 {
+		t.Fatalf("expected a reject penalty to keep active sessions, got %d disconnects", len(batch))
+	}
+	if again := report("s1", "10.0.0.1"); !again.Accepted {
+		t.Fatalf("expected the active session to keep reporting, got reason=%q", again.Reason)
+	}
+	if fresh := report("s3", "10.0.0.3"); fresh.Accepted || fresh.ReasonCode != domain.ReasonUserPenalized {
+		t.Fatalf("expected a new session to be rejected while penalized, got accepted=%v code=%q", fresh.Accepted, fresh.ReasonCode)
+	}
+
+	fx.penalty.ClearPenalty(fx.userID)
+	if _, err := fx.userDB.Exec(`UPDATE packages SET penalty_action = 'none' WHERE id = ?`, fx.packageID); err != nil {
+		t.Fatalf("set penalty action: %v", err)
+	}
+	none := report("s4", "10.0.0.4")
+	if none.Accepted || none.PenaltyApplied || none.ReasonCode != domain.ReasonConcurrentLimit {
+		t.Fatalf("expected only the report to be rejected, got accepted=%v penalty=%v code=%q", none.Accepted, none.PenaltyApplied, none.ReasonCode)
+	}
+	if fx.penalty.CheckPenalty(fx.userID).HasPenalty {
+		t.Fatalf("expected no penalty under the none action")
+	}
+}
+
+func TestProcessUsageReport_CountsMetrics(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 100)
+	m := metrics.New()
+	fx.engine.SetMetrics(m)
+
+	report := func(sessionID, ip string, traffic int64) {
+		fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  ip,
+			Upload:    traffic,
+			Download:  traffic,
+			Timestamp: time.Now(),
+		})
+	}
+	report("s1", "10.0.0.1", 10)
+	report("s2", "10.0.0.2", 10)
+	fx.penalty.ClearPenalty(fx.userID)
+	report("s1", "10.0.0.1", 100)
+
+	if got := m.Reports.Value("accepted"); got != 1 {
+		t.Fatalf("expected 1 accepted report, got %d", got)
+	}
+	if got := m.Reports.Value("rejected"); got != 2 {
+		t.Fatalf("expected 2 rejected reports, got %d", got)
+	}
+	if m.Rejections.Value(string(domain.ReasonConcurrentLimit)) != 1 || m.QuotaExceeded.Value() != 1 {
+		t.Fatalf("expected one concurrent-limit and one quota rejection")
+	}
+	if got := m.PenaltiesApplied.Value(string(domain.ReasonConcurrentLimit)); got != 1 {
+		t.Fatalf("expected 1 penalty counted, got %d", got)
+	}
+	if lookups := m.CacheLookups.Value("hit") + m.CacheLookups.Value("miss"); lookups != 2 {
+		t.Fatalf("expected 2 quota cache lookups, got %d", lookups)
+	}
+}
+
 func TestProcessUsageReport_QuotaExceededSuspendsUser(t *testing.T) {
 	fx := newTestEngineFixture(t, 2, 100)
 
@@ -334,16 +553,137 @@ func TestProcessUsageReport_QuotaExceededSuspendsUser(t *testing.T) {
 	}
 }
 
+func TestProcessUsageReport_DownloadCountModeIgnoresUpload(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 100)
+	if _, err := fx.userDB.Exec(`UPDATE packages SET count_mode = ? WHERE id = ?`, domain.CountModeDownload, fx.packageID); err != nil {
+		t.Fatalf("set count mode: %v", err)
+	}
+	fx.quota.InvalidateUser(fx.userID)
+
+	report := func(session string, upload, download int64) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: session,
+			ClientIP:  "172.20.10.9",
+			Upload:    upload,
+			Download:  download,
+			Timestamp: time.Now(),
+		})
+	}
+
+	if result := report("s1", 500, 40); !result.Accepted {
+		t.Fatalf("expected upload to be free in download mode, got %s", result.Reason)
+	}
+
+	pkg, err := fx.userDB.GetPackage(fx.packageID)
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	if pkg.CurrentTotal != 540 || pkg.CountedUsage() != 40 {
+		t.Fatalf("expected total 540 with 40 counted, got total=%d counted=%d", pkg.CurrentTotal, pkg.CountedUsage())
+	}
+
+	if result := report("s1", 0, 70); result.Accepted || !result.QuotaExceeded {
+		t.Fatalf("expected download past the quota to be rejected, got accepted=%v quota=%v", result.Accepted, result.QuotaExceeded)
+	}
+}
+
+func TestProcessUsageReport_BillsThroughNodeMultiplier(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	if _, err := fx.userDB.Exec(`UPDATE nodes SET traffic_multiplier = 2 WHERE id = ?`, fx.nodeID); err != nil {
+		t.Fatalf("set multiplier: %v", err)
+	}
+
+	result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		ClientIP:  "1.2.3.4",
+		Upload:    30,
+		Download:  20,
+		Timestamp: time.Now(),
+	})
+	if !result.Accepted {
+		t.Fatalf("expected report to be accepted, got reason=%q", result.Reason)
+	}
+	if result.RawUpload != 30 || result.RawDownload != 20 || result.BilledUpload != 60 || result.BilledDownload != 40 {
+		t.Fatalf("unexpected traffic split: %+v", result)
+	}
+
+	pkg, _ := fx.userDB.GetPackage(fx.packageID)
+	if pkg.CurrentTotal != 100 {
+		t.Fatalf("expected package charged billed bytes, got %d", pkg.CurrentTotal)
+	}
+	node, _ := fx.userDB.GetNode(fx.nodeID)
+	if node.CurrentUpload != 30 || node.CurrentDownload != 20 {
+		t.Fatalf("expected node to keep measured bytes, got %d/%d", node.CurrentUpload, node.CurrentDownload)
+	}
+
+	last := fx.events.events[len(fx.events.events)-1]
+	if last.Type != domain.EventUsageRecorded {
+		t.Fatalf("expected last event USAGE_RECORDED, got %s", last.Type)
+	}
+	var traffic domain.UsageTraffic
+	if err := json.Unmarshal(last.Metadata, &traffic); err != nil {
+		t.Fatalf("decode usage metadata: %v", err)
+	}
+	if traffic.RawUpload != 30 || traffic.BilledUpload != 60 || traffic.Multiplier != 2 {
+		t.Fatalf("unexpected usage metadata: %+v", traffic)
+	}
+}
+
+func TestBiller_KeepsTheMultiplierAReportWasChargedAt(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("create active DB: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+	quota := NewQuotaEngine(fx.userDB, activeDB, fx.cache, zap.NewNop())
+	eng := NewEngine(quota, fx.session, fx.penalty, nil, fx.events, fx.cache, fx.userDB, zap.NewNop())
+
+	if _, err := fx.userDB.Exec(`UPDATE nodes SET traffic_multiplier = 2 WHERE id = ?`, fx.nodeID); err != nil {
+		t.Fatalf("set multiplier: %v", err)
+	}
+	result := eng.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		Upload:    30,
+		Download:  20,
+		Timestamp: time.Now(),
+	})
+	if !result.Accepted {
+		t.Fatalf("expected report accepted, got reason=%q", result.Reason)
+	}
+
+	// The operator lowers the multiplier before the month is billed
+	if _, err := fx.userDB.Exec(`UPDATE nodes SET traffic_multiplier = 1 WHERE id = ?`, fx.nodeID); err != nil {
+		t.Fatalf("reset multiplier: %v", err)
+	}
+	records, err := NewBiller(fx.userDB, activeDB, domain.BillingRates{}, zap.NewNop()).Generate(domain.BillingPeriod(time.Now()))
+	if err != nil {
+		t.Fatalf("generate billing: %v", err)
+	}
+	if len(records) != 1 || records[0].Upload != 60 || records[0].Download != 40 {
+		t.Fatalf("expected billing at the 2x multiplier the report was charged, got %+v", records)
+	}
+}
+
 func TestCleanup_RemovesExpiredPenaltiesAndStaleSessions(t *testing.T) {
 	fx := newTestEngineFixture(t, 2, 1_000)
 
-	fx.session.AddSession(fx.userID, "old-session", "192.168.1.5", nil)
+	fx.session.AddSession(fx.userID, "old-session", "", fx.nodeID, "192.168.1.5", nil)
 	fx.cache.RangeSessions(fx.userID, func(sessionID string, session *cache.SessionEntry) bool {
 		session.LastSeenAt = time.Now().Add(-3 * time.Second)
 		return true
 	})
 
-	fx.penalty.ApplyPenalty(fx.userID, "test")
+	fx.penalty.ApplyPenalty(fx.userID, "test", domain.PenaltyPolicy{})
 	time.Sleep(90 * time.Millisecond)
 
 	fx.engine.Cleanup()
@@ -359,6 +699,7 @@ func TestCleanup_RemovesExpiredPenaltiesAndStaleSessions(t *testing.T) {
 
 func TestQuotaEngine_CheckAndEnforceQuota_QueuesDisconnectOnExceeded(t *testing.T) {
 	fx := newTestEngineFixture(t, 2, 100)
+	fx.session.AddSession(fx.userID, "s1", "", fx.nodeID, "1.1.1.1", nil)
 
 	if err := fx.userDB.UpdatePackageUsage(fx.packageID, 100, 0); err != nil {
 		t.Fatalf("set initial package usage: %v", err)
@@ -383,6 +724,9 @@ func TestQuotaEngine_CheckAndEnforceQuota_QueuesDisconnectOnExceeded(t *testing.
 	if batch[0].UserID != fx.userID || batch[0].Reason != "quota_exceeded" {
 		t.Fatalf("unexpected disconnect command: user=%s reason=%s", batch[0].UserID, batch[0].Reason)
 	}
+	if batch[0].SessionID != "s1" || batch[0].NodeID != fx.nodeID {
+		t.Fatalf("expected the disconnect routed to the session's node, got %+v", batch[0])
+	}
 }
 
 func TestProcessUsageReport_ManagerUsageLimitEnforced(t *testing.T) {
@@ -477,3 +821,2214 @@ func TestProcessUsageReport_PropagatesManagerSessionCounters(t *testing.T) {
 		t.Fatalf("expected manager counters after disconnect to be 0/0/0, got %d/%d/%d", pkgAfter.CurrentSessions, pkgAfter.CurrentOnline, pkgAfter.CurrentActive)
 	}
 }
+
+func TestProcessUsageReport_FlagsCrossNodeRoaming(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	if err := fx.userDB.CreateNode(&domain.Node{
+		ID:                "node-2",
+		SecretKey:         "node-2-secret",
+		Name:              "node-second",
+		TrafficMultiplier: 1,
+		ResetMode:         domain.ResetModeNoReset,
+	}); err != nil {
+		t.Fatalf("create second node: %v", err)
+	}
+
+	first := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "roamer",
+		ClientIP:  "13.13.13.13",
+		Upload:    10,
+		Download:  10,
+		Timestamp: time.Now(),
+	})
+	if !first.Accepted {
+		t.Fatalf("expected first report accepted: %s", first.Reason)
+	}
+
+	sessions := fx.session.GetUserSessions(fx.userID)
+	if len(sessions) != 1 || sessions[0].NodeID != fx.nodeID {
+		t.Fatalf("expected session bound to %s, got %+v", fx.nodeID, sessions)
+	}
+
+	second := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    "node-2",
+		ServiceID: fx.serviceID,
+		SessionID: "roamer",
+		ClientIP:  "13.13.13.13",
+		Upload:    10,
+		Download:  10,
+		Timestamp: time.Now(),
+	})
+	if !second.Accepted {
+		t.Fatalf("expected flagged report to still be accepted: %s", second.Reason)
+	}
+
+	roamingEvents, _ := fx.events.GetEvents(ptrEventType(domain.EventSessionRoaming), nil, 0)
+	if len(roamingEvents) != 1 {
+		t.Fatalf("expected 1 SESSION_ROAMING event, got %d", len(roamingEvents))
+	}
+
+	sessions = fx.session.GetUserSessions(fx.userID)
+	if len(sessions) != 1 || sessions[0].NodeID != "node-2" {
+		t.Fatalf("expected session rebound to node-2, got %+v", sessions)
+	}
+}
+
+func TestProcessUsageReport_PenalizesRoamingWhenConfigured(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+	fx.session.SetRoamingPolicy(time.Minute, domain.RoamingActionPenalize)
+
+	first := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "roamer",
+		ClientIP:  "14.14.14.14",
+		Upload:    10,
+		Download:  10,
+		Timestamp: time.Now(),
+	})
+	if !first.Accepted {
+		t.Fatalf("expected first report accepted: %s", first.Reason)
+	}
+
+	second := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    "node-2",
+		ServiceID: fx.serviceID,
+		SessionID: "roamer",
+		ClientIP:  "14.14.14.14",
+		Upload:    10,
+		Download:  10,
+		Timestamp: time.Now(),
+	})
+	if second.Accepted || !second.PenaltyApplied || !second.ShouldDisconnect {
+		t.Fatalf("expected roaming penalty, got accepted=%v penalty=%v disconnect=%v", second.Accepted, second.PenaltyApplied, second.ShouldDisconnect)
+	}
+
+	batch := fx.engine.GetDisconnectBatch()
+	if len(batch) != 1 || batch[0].NodeID != fx.nodeID {
+		t.Fatalf("expected disconnect routed to original node, got %+v", batch)
+	}
+}
+
+func TestSessionManager_CheckRoamingDetectsCountryChange(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	fx.session.AddSession(fx.userID, "s1", "", fx.nodeID, "1.1.1.1", &domain.GeoData{Country: "DE"})
+
+	res := fx.session.CheckRoaming(fx.userID, "s2", fx.nodeID, &domain.GeoData{Country: "IR"})
+	if !res.ImpossibleTravel || res.PreviousCountry != "DE" {
+		t.Fatalf("expected impossible travel from DE, got %+v", res)
+	}
+
+	fx.session.SetRoamingPolicy(time.Minute, domain.RoamingActionOff)
+	if res := fx.session.CheckRoaming(fx.userID, "s2", fx.nodeID, &domain.GeoData{Country: "IR"}); res.Detected() {
+		t.Fatalf("expected roaming detection to be disabled")
+	}
+}
+
+func ptrEventType(t domain.EventType) *domain.EventType {
+	return &t
+}
+
+func TestShedNodeLoad_DisconnectsLowestPriorityFirst(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	goldPkgID := "pkg-gold"
+	if err := fx.userDB.CreatePackage(&domain.Package{
+		ID:            goldPkgID,
+		UserID:        "user-gold",
+		TotalTraffic:  10_000,
+		ResetMode:     domain.ResetModeNoReset,
+		Duration:      3600,
+		MaxConcurrent: 2,
+		Priority:      domain.PackagePriorityGold,
+		Status:        domain.PackageStatusActive,
+	}); err != nil {
+		t.Fatalf("create gold package: %v", err)
+	}
+	if err := fx.userDB.CreateUser(&domain.User{
+		ID:              "user-gold",
+		Username:        "gold",
+		Password:        "secret",
+		Status:          domain.UserStatusActive,
+		ActivePackageID: &goldPkgID,
+	}); err != nil {
+		t.Fatalf("create gold user: %v", err)
+	}
+
+	for _, userID := range []string{fx.userID, "user-gold"} {
+		result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "sess-" + userID,
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+		if !result.Accepted {
+			t.Fatalf("expected report for %s accepted: %s", userID, result.Reason)
+		}
+		if userID == "user-gold" && result.Priority != domain.PackagePriorityGold {
+			t.Fatalf("expected gold priority in result, got %q", result.Priority)
+		}
+	}
+
+	if shed := fx.engine.ShedNodeLoad(fx.nodeID, 1); shed != 1 {
+		t.Fatalf("expected 1 session shed, got %d", shed)
+	}
+
+	batch := fx.engine.GetDisconnectBatch()
+	if len(batch) != 1 || batch[0].UserID != fx.userID || batch[0].NodeID != fx.nodeID {
+		t.Fatalf("expected default-priority user to be shed first, got %+v", batch)
+	}
+}
+
+func TestHandleNodeLoad_DrainsOverloadedNode(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+	fx.engine.SetNodeLoadThresholds(domain.NodeLoadThresholds{MaxCPUPercent: 80})
+
+	res, err := fx.engine.HandleNodeLoad(&domain.NodeLoad{NodeID: fx.nodeID, CPUPercent: 95})
+	if err != nil {
+		t.Fatalf("handle node load: %v", err)
+	}
+	if !res.Overloaded || !res.Draining || res.Reason != "cpu" {
+		t.Fatalf("expected cpu overload to drain node, got %+v", res)
+	}
+
+	node, err := fx.userDB.GetNode(fx.nodeID)
+	if err != nil {
+		t.Fatalf("get node: %v", err)
+	}
+	if !node.Draining {
+		t.Fatalf("expected node to be persisted as draining")
+	}
+
+	// A restart starts from an empty cache; the persisted flag must survive it
+	fx.cache.SetNodeDraining(fx.nodeID, false)
+	if err := fx.engine.RestoreNodeDraining(); err != nil {
+		t.Fatalf("restore node draining: %v", err)
+	}
+	if !fx.cache.IsNodeDraining(fx.nodeID) {
+		t.Fatalf("expected draining restored from the database")
+	}
+
+	overloaded, _ := fx.events.GetEvents(ptrEventType(domain.EventNodeOverloaded), nil, 0)
+	if len(overloaded) != 1 {
+		t.Fatalf("expected 1 NODE_OVERLOADED event, got %d", len(overloaded))
+	}
+
+	result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "new-session",
+		Upload:    1,
+		Download:  1,
+		Timestamp: time.Now(),
+	})
+	if result.Accepted || !result.ShouldDisconnect {
+		t.Fatalf("expected new session on draining node to be refused, got %+v", result)
+	}
+
+	res, err = fx.engine.HandleNodeLoad(&domain.NodeLoad{NodeID: fx.nodeID, CPUPercent: 20})
+	if err != nil {
+		t.Fatalf("handle recovered node load: %v", err)
+	}
+	if res.Draining {
+		t.Fatalf("expected healthy heartbeat to clear draining")
+	}
+	if node, _ := fx.userDB.GetNode(fx.nodeID); node.Draining {
+		t.Fatalf("expected draining flag to be cleared")
+	}
+}
+
+func TestHeartbeatPersistsAndDetectsDownNodes(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	if n, err := fx.engine.DetectDownNodes(time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected a node without heartbeats not to go down, got %d (%v)", n, err)
+	}
+
+	load := &domain.NodeLoad{NodeID: fx.nodeID, CPUPercent: 42.5, ActiveConnections: 7, BandwidthBps: 1_000, AgentVersion: "1.4.0"}
+	if _, err := fx.engine.HandleNodeLoad(load); err != nil {
+		t.Fatalf("handle node load: %v", err)
+	}
+	node, err := fx.userDB.GetNode(fx.nodeID)
+	if err != nil {
+		t.Fatalf("get node: %v", err)
+	}
+	if node.LastSeenAt == nil || node.AgentVersion != "1.4.0" || node.CPUPercent != 42.5 || node.ActiveConnections != 7 || node.BandwidthBps != 1_000 {
+		t.Fatalf("expected the heartbeat to be stored, got %+v", node)
+	}
+
+	// A fresh cache, as after a restart, still sees the stored heartbeat
+	fresh := *fx.engine
+	fresh.cache = cache.NewMemoryCache()
+	if !fresh.NodeHealth(node).Online {
+		t.Fatalf("expected the node online from its stored heartbeat")
+	}
+
+	later := time.Now().Add(3 * time.Minute)
+	if n, err := fx.engine.DetectDownNodes(later); err != nil || n != 1 {
+		t.Fatalf("expected the silent node to go down, got %d (%v)", n, err)
+	}
+	if n, _ := fx.engine.DetectDownNodes(later.Add(time.Minute)); n != 0 {
+		t.Fatalf("expected one NODE_DOWN per outage, got another %d", n)
+	}
+	down, _ := fx.events.GetEvents(ptrEventType(domain.EventNodeDown), nil, 0)
+	if len(down) != 1 || down[0].NodeID == nil || *down[0].NodeID != fx.nodeID {
+		t.Fatalf("expected one NODE_DOWN event for the node, got %+v", down)
+	}
+
+	// An empty agent version keeps the stored one and clears the outage
+	if _, err := fx.engine.HandleNodeLoad(&domain.NodeLoad{NodeID: fx.nodeID}); err != nil {
+		t.Fatalf("handle node load: %v", err)
+	}
+	if node, _ := fx.userDB.GetNode(fx.nodeID); node.DownAt != nil || node.AgentVersion != "1.4.0" {
+		t.Fatalf("expected the heartbeat to clear down_at and keep the version, got %+v", node)
+	}
+}
+
+func TestNodeHealth_ScoresAndRecommends(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+	for _, id := range []string{"node-quiet", "node-draining"} {
+		if err := fx.userDB.CreateNode(&domain.Node{ID: id, SecretKey: id, Name: id, TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+			t.Fatalf("create node: %v", err)
+		}
+	}
+
+	quiet, _ := fx.userDB.GetNode("node-quiet")
+	if health := fx.engine.NodeHealth(quiet); health.Online || health.Score != healthWeightErrors+healthWeightDisconnect {
+		t.Fatalf("expected a node without heartbeats to be offline with a partial score, got %+v", health)
+	}
+
+	if _, err := fx.engine.HandleNodeLoad(&domain.NodeLoad{NodeID: fx.nodeID, CPUPercent: 10}); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	fx.engine.SetNodeLoadThresholds(domain.NodeLoadThresholds{MaxCPUPercent: 80})
+	if _, err := fx.engine.HandleNodeLoad(&domain.NodeLoad{NodeID: "node-draining", CPUPercent: 95}); err != nil {
+		t.Fatalf("overloaded heartbeat: %v", err)
+	}
+
+	healthy, _ := fx.userDB.GetNode(fx.nodeID)
+	if health := fx.engine.NodeHealth(healthy); !health.Online || health.Score != 100 || health.LastHeartbeatAt == nil {
+		t.Fatalf("expected a fresh node without errors to score 100, got %+v", health)
+	}
+
+	// A rejected report raises the error rate, a queued disconnect the backlog
+	fx.engine.ProcessUsageReport(&domain.UsageReport{UserID: "missing-user", NodeID: fx.nodeID, SessionID: "s", Upload: 1, Download: 1})
+	fx.cache.QueueDisconnect(fx.userID, "s", "test", fx.nodeID)
+	health := fx.engine.NodeHealth(healthy)
+	if health.ErrorRate <= 0 || health.DisconnectBacklog != 1 || health.Score >= 100 {
+		t.Fatalf("expected errors and backlog to lower the score, got %+v", health)
+	}
+
+	nodes, err := fx.userDB.ListNodes()
+	if err != nil {
+		t.Fatalf("list nodes: %v", err)
+	}
+	recommended := fx.engine.RecommendNodes(nodes, 0)
+	if len(recommended) != 1 || recommended[0].ID != fx.nodeID {
+		t.Fatalf("expected only the online healthy node to be recommended, got %d nodes", len(recommended))
+	}
+}
+
+func TestProcessUsageReport_EnforcesNodeActiveUserLimit(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("create active DB: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+	fx.quota.activeDB = activeDB
+
+	if _, err := fx.userDB.Exec(`UPDATE nodes SET max_active_users = 1 WHERE id = ?`, fx.nodeID); err != nil {
+		t.Fatalf("set node limit: %v", err)
+	}
+	otherPkg := "pkg-other"
+	if err := fx.userDB.CreatePackage(&domain.Package{
+		ID: otherPkg, UserID: "user-other", TotalTraffic: 10_000, ResetMode: domain.ResetModeNoReset,
+		Duration: 3600, MaxConcurrent: 2, Status: domain.PackageStatusActive,
+	}); err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if err := fx.userDB.CreateUser(&domain.User{
+		ID: "user-other", Username: "other", Password: "p", Status: domain.UserStatusActive, ActivePackageID: &otherPkg,
+	}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	report := func(userID, sessionID string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			Upload:    10,
+			Download:  10,
+			Timestamp: time.Now(),
+		})
+	}
+
+	if res := report(fx.userID, "s1"); !res.Accepted {
+		t.Fatalf("expected the first user to be admitted, got %q", res.Reason)
+	}
+	if res := report("user-other", "s2"); res.Accepted || res.ReasonCode != domain.ReasonNodeUserLimit {
+		t.Fatalf("expected the second user to hit the node limit, got accepted=%v code=%q", res.Accepted, res.ReasonCode)
+	}
+	if res := report(fx.userID, "s3"); !res.Accepted {
+		t.Fatalf("expected an active user's second session to be admitted, got %q", res.Reason)
+	}
+
+	now := time.Now()
+	counts, err := activeDB.GetActiveUsersByNode(fx.nodeID, false, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("active users: %v", err)
+	}
+	if len(counts) != 1 || counts[0].Users != 1 || counts[0].Period != now.Format("2006-01-02") {
+		t.Fatalf("expected one active user today, got %+v", counts)
+	}
+}
+
+func TestSessionManager_IPHashesSurviveSaltRotation(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 10_000)
+	yesterday := time.Now().AddDate(0, 0, -1)
+
+	// Sessions hashed just before midnight
+	sessions := fx.cache.GetOrCreateSessionCache(fx.userID)
+	sessions.AddSession("s1", "", fx.nodeID, hashIPAt("1.1.1.1", yesterday), "", "", "", 0)
+	sessions.AddSession("s2", "subnet:"+hashIPAt("10.0.0.0/24", yesterday), fx.nodeID, hashIPAt("10.0.0.5", yesterday), "", "", "", 0)
+
+	if res := fx.session.CheckSession(fx.userID, "s3", "s3", "1.1.1.1", 0, 2, ""); res.IPLimitHit {
+		t.Fatalf("expected the same IP to match after the salt rotated, got %+v", res)
+	}
+	if res := fx.session.CheckSession(fx.userID, "s4", "s4", "3.3.3.3", 0, 2, ""); !res.IPLimitHit {
+		t.Fatalf("expected a third IP to hit the limit, got %+v", res)
+	}
+
+	identity := fx.session.IdentityKey(domain.SessionIdentitySubnet, "s5", "10.0.0.9", "")
+	if res := fx.session.CheckSession(fx.userID, "s5", identity, "10.0.0.9", 1, 0, ""); !res.Allowed {
+		t.Fatalf("expected the subnet identity to match after the salt rotated, got %+v", res)
+	}
+}
+
+func TestProcessUsageReport_SubnetIdentityToleratesCGNATChurn(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 5_000)
+	fx.session.SetIdentityPolicy(domain.SessionIdentitySubnet, nil)
+
+	report := func(sessionID, clientIP string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  clientIP,
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+
+	if res := report("s1", "100.64.3.10"); !res.Accepted {
+		t.Fatalf("expected first session to be accepted, got reason=%q", res.Reason)
+	}
+	if res := report("s2", "100.64.3.77"); !res.Accepted {
+		t.Fatalf("expected same-subnet session to be accepted, got reason=%q", res.Reason)
+	}
+	if got := fx.session.GetActiveSessionCount(fx.userID); got != 1 {
+		t.Fatalf("expected sessions in one subnet to count once, got %d", got)
+	}
+
+	res := report("s3", "100.64.9.1")
+	if !res.SessionLimitHit && !res.PenaltyApplied {
+		t.Fatalf("expected a session from another subnet to hit the limit, got reason=%q", res.Reason)
+	}
+
+	pkg := &domain.Package{SessionIdentity: domain.SessionIdentityDevice}
+	if got := fx.session.ResolveIdentity(pkg, nil); got != domain.SessionIdentityDevice {
+		t.Fatalf("expected package override to win, got %s", got)
+	}
+	fx.session.SetIdentityPolicy(domain.SessionIdentitySession, map[string]domain.SessionIdentity{"mobile": domain.SessionIdentitySubnet})
+	if got := fx.session.ResolveIdentity(&domain.Package{}, func() []string { return []string{"basic", "mobile"} }); got != domain.SessionIdentitySubnet {
+		t.Fatalf("expected group strategy, got %s", got)
+	}
+}
+
+func TestProcessUsageReport_RejectsOtherManagersNode(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	for _, id := range []string{"mgr-a", "mgr-b"} {
+		manager := &domain.Manager{
+			ID:      id,
+			Name:    id,
+			Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive},
+		}
+		if err := fx.userDB.CreateManager(manager); err != nil {
+			t.Fatalf("create manager: %v", err)
+		}
+	}
+	if _, err := fx.userDB.Exec(`UPDATE users SET manager_id = ? WHERE id = ?`, "mgr-a", fx.userID); err != nil {
+		t.Fatalf("assign manager to user: %v", err)
+	}
+
+	report := func(sessionID string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  "11.11.11.11",
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+
+	otherID := "mgr-b"
+	if err := fx.userDB.SetNodeManager(fx.nodeID, &otherID); err != nil {
+		t.Fatalf("assign node: %v", err)
+	}
+	result := report("s1")
+	if result.Accepted || result.ReasonCode != domain.ReasonNodeNotAllowed {
+		t.Fatalf("expected node_not_allowed rejection, got %+v", result)
+	}
+
+	ownID := "mgr-a"
+	if err := fx.userDB.SetNodeManager(fx.nodeID, &ownID); err != nil {
+		t.Fatalf("reassign node: %v", err)
+	}
+	if result := report("s2"); !result.Accepted {
+		t.Fatalf("expected report through own node to be accepted, got %+v", result)
+	}
+}
+
+func TestProcessUsageReport_EnforcesAllowedNodes(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	if _, err := fx.userDB.Exec(`UPDATE packages SET allowed_nodes = ? WHERE id = ?`, `["node-premium"]`, fx.packageID); err != nil {
+		t.Fatalf("restrict package nodes: %v", err)
+	}
+
+	report := &domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		ClientIP:  "12.12.12.12",
+		Upload:    1,
+		Download:  1,
+		Timestamp: time.Now(),
+	}
+	result := fx.engine.ProcessUsageReport(report)
+	if result.Accepted || result.ReasonCode != domain.ReasonNodeNotInPlan {
+		t.Fatalf("expected node_not_in_plan rejection, got %+v", result)
+	}
+
+	if _, err := fx.userDB.Exec(`UPDATE packages SET allowed_nodes = ? WHERE id = ?`, `["node-premium","`+fx.nodeID+`"]`, fx.packageID); err != nil {
+		t.Fatalf("allow node: %v", err)
+	}
+	if _, err := fx.userDB.Exec(`UPDATE users SET allowed_services = ? WHERE id = ?`, `["svc-other"]`, fx.userID); err != nil {
+		t.Fatalf("restrict user services: %v", err)
+	}
+	result = fx.engine.ProcessUsageReport(report)
+	if result.Accepted || result.ReasonCode != domain.ReasonNodeNotInPlan {
+		t.Fatalf("expected user service allow-list to reject, got %+v", result)
+	}
+
+	if _, err := fx.userDB.Exec(`UPDATE users SET allowed_services = '[]' WHERE id = ?`, fx.userID); err != nil {
+		t.Fatalf("clear user services: %v", err)
+	}
+	if result := fx.engine.ProcessUsageReport(report); !result.Accepted {
+		t.Fatalf("expected report on allowed node to be accepted, got %+v", result)
+	}
+}
+
+func TestProcessUsageReport_EnforcesGroupLimits(t *testing.T) {
+	fx := newTestEngineFixture(t, 3, 10_000)
+
+	if err := fx.userDB.CreateGroup(&domain.Group{Name: "team", TotalLimit: 100, MaxConcurrent: 1}); err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if _, err := fx.userDB.Exec(`UPDATE users SET groups = ? WHERE id = ?`, `["team","unknown"]`, fx.userID); err != nil {
+		t.Fatalf("assign group: %v", err)
+	}
+
+	report := func(session string, download int64) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: session,
+			ClientIP:  "10.0.0.1",
+			Download:  download,
+			Timestamp: time.Now(),
+		})
+	}
+
+	if result := report("s1", 60); !result.Accepted {
+		t.Fatalf("expected report within the group pool to be accepted, got %s", result.Reason)
+	}
+	group, err := fx.userDB.GetGroup("team")
+	if err != nil {
+		t.Fatalf("get group: %v", err)
+	}
+	if group.CurrentDownload != 60 || group.CurrentTotal != 60 {
+		t.Fatalf("expected group counters to hold the usage, got download=%d total=%d", group.CurrentDownload, group.CurrentTotal)
+	}
+
+	// The group's max_concurrent of 1 overrides the package's 3
+	if result := report("s2", 1); result.Accepted || result.ReasonCode != domain.ReasonConcurrentLimit {
+		t.Fatalf("expected group concurrency override to reject a second session, got %+v", result)
+	}
+	fx.penalty.ClearPenalty(fx.userID)
+
+	if result := report("s1", 50); result.Accepted || result.ReasonCode != domain.ReasonGroupLimit {
+		t.Fatalf("expected group_limit_reached rejection, got %+v", result)
+	}
+
+	group.TotalLimit = 0
+	group.AllowedNodes = []string{"node-premium"}
+	if err := fx.userDB.UpdateGroup(group); err != nil {
+		t.Fatalf("update group: %v", err)
+	}
+	if _, err := fx.userDB.Exec(`UPDATE users SET status = ? WHERE id = ?`, domain.UserStatusActive, fx.userID); err != nil {
+		t.Fatalf("reactivate user: %v", err)
+	}
+	fx.quota.InvalidateUser(fx.userID)
+	if result := report("s1", 1); result.Accepted || result.ReasonCode != domain.ReasonNodeNotInPlan {
+		t.Fatalf("expected node_not_in_plan rejection from the group allow-list, got %+v", result)
+	}
+}
+
+func TestProcessUsageReport_ReplacesStaleSessionFromSameIP(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 5_000)
+	fx.session.SetReplacePolicy(domain.SessionReplaceOff, time.Second)
+
+	if _, err := fx.userDB.Exec(`UPDATE packages SET session_replace = ? WHERE id = ?`, domain.SessionReplaceSameIP, fx.packageID); err != nil {
+		t.Fatalf("enable session replacement: %v", err)
+	}
+
+	report := func(sessionID, clientIP string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  clientIP,
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+
+	if res := report("s1", "20.20.20.20"); !res.Accepted {
+		t.Fatalf("expected first session to be accepted, got reason=%q", res.Reason)
+	}
+	// Let s1 go quiet past the replace window but not the concurrency window
+	fx.cache.GetOrCreateSessionCache(fx.userID).Sessions["s1"].LastSeenAt = time.Now().Add(-1500 * time.Millisecond)
+
+	if res := report("s2", "20.20.20.20"); !res.Accepted {
+		t.Fatalf("expected reconnect from the same IP to replace the stale session, got reason=%q", res.Reason)
+	}
+	sessions := fx.session.GetUserSessions(fx.userID)
+	if len(sessions) != 1 || sessions[0].SessionID != "s2" {
+		t.Fatalf("expected only the replacing session to remain, got %+v", sessions)
+	}
+
+	res := report("s3", "20.20.20.20")
+	if !res.SessionLimitHit && !res.PenaltyApplied {
+		t.Fatalf("expected a fresh session from the same IP to still count, got reason=%q", res.Reason)
+	}
+
+	if got := fx.session.ResolveReplace(&domain.Package{}); got != domain.SessionReplaceOff {
+		t.Fatalf("expected default replacement mode, got %s", got)
+	}
+}
+
+func TestProcessUsageReport_EnforcesDistinctIPLimit(t *testing.T) {
+	fx := newTestEngineFixture(t, 5, 5_000)
+
+	if _, err := fx.userDB.Exec(`UPDATE packages SET max_ips = 2 WHERE id = ?`, fx.packageID); err != nil {
+		t.Fatalf("set max_ips: %v", err)
+	}
+
+	report := func(sessionID, clientIP string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  clientIP,
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+
+	for _, r := range []struct{ session, ip string }{
+		{"s1", "10.0.0.1"},
+		{"s2", "10.0.0.2"},
+		{"s3", "10.0.0.1"},
+	} {
+		if res := report(r.session, r.ip); !res.Accepted {
+			t.Fatalf("expected %s from %s to be accepted, got reason=%q", r.session, r.ip, res.Reason)
+		}
+	}
+
+	res := report("s4", "10.0.0.3")
+	if res.Accepted || !res.PenaltyApplied {
+		t.Fatalf("expected a third distinct IP to be rejected with a penalty, got accepted=%v", res.Accepted)
+	}
+	if res.ReasonCode != domain.ReasonIPLimit {
+		t.Fatalf("expected reason code %s, got %q", domain.ReasonIPLimit, res.ReasonCode)
+	}
+}
+
+func TestProcessUsageReport_AbsoluteCounterMode(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("create active DB: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+	fx.quota.activeDB = activeDB
+
+	report := func(up, down int64) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:      fx.userID,
+			NodeID:      fx.nodeID,
+			ServiceID:   fx.serviceID,
+			SessionID:   "s1",
+			ClientIP:    "1.2.3.4",
+			Upload:      up,
+			Download:    down,
+			Timestamp:   time.Now(),
+			CounterMode: domain.CounterModeAbsolute,
+		})
+	}
+
+	for _, counters := range [][2]int64{{100, 200}, {150, 260}, {20, 30}} {
+		if res := report(counters[0], counters[1]); !res.Accepted {
+			t.Fatalf("expected report %v to be accepted, got reason=%q", counters, res.Reason)
+		}
+	}
+
+	pkg, err := fx.userDB.GetPackage(fx.packageID)
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	// The first report is the baseline, then 50+20 up and 60+30 down, the
+	// last report after a counter reset
+	if pkg.CurrentUpload != 70 || pkg.CurrentDownload != 90 {
+		t.Fatalf("expected deltas 70/90 to be charged, got %d/%d", pkg.CurrentUpload, pkg.CurrentDownload)
+	}
+}
+
+type provisionFunc func(ctx context.Context, report *domain.UsageReport) error
+
+func (f provisionFunc) Provision(ctx context.Context, report *domain.UsageReport) error {
+	return f(ctx, report)
+}
+
+func TestProcessUsageReport_UnknownUserPolicies(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("create active DB: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+	fx.quota.activeDB = activeDB
+
+	packageID := "pkg-late"
+	createUser := func(userID string) {
+		if err := fx.userDB.CreatePackage(&domain.Package{
+			ID: packageID + userID, UserID: userID, TotalTraffic: 10_000, ResetMode: domain.ResetModeNoReset,
+			Duration: 3600, MaxConcurrent: 2, Status: domain.PackageStatusActive,
+		}); err != nil {
+			t.Fatalf("create package: %v", err)
+		}
+		pkgID := packageID + userID
+		if err := fx.userDB.CreateUser(&domain.User{
+			ID: userID, Username: userID, Password: "p", Status: domain.UserStatusActive, ActivePackageID: &pkgID,
+		}); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	report := func(userID string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "s-" + userID,
+			Upload:    10,
+			Download:  20,
+			Timestamp: time.Now(),
+		})
+	}
+
+	fx.engine.SetUnknownUserPolicy(domain.UnknownUserActionQueue, nil)
+	res := report("late")
+	if res.Accepted || !res.Queued || res.ReasonCode != domain.ReasonUserNotFound {
+		t.Fatalf("expected report to be queued, got accepted=%v queued=%v code=%q", res.Accepted, res.Queued, res.ReasonCode)
+	}
+	if replayed, dropped, err := fx.engine.ReplayPendingReports(time.Hour); err != nil || replayed != 0 || dropped != 0 {
+		t.Fatalf("expected nothing to replay yet, got %d/%d err=%v", replayed, dropped, err)
+	}
+
+	createUser("late")
+	if replayed, _, err := fx.engine.ReplayPendingReports(time.Hour); err != nil || replayed != 1 {
+		t.Fatalf("expected the queued report to replay, got %d err=%v", replayed, err)
+	}
+	pkg, err := fx.userDB.GetPackage(packageID + "late")
+	if err != nil || pkg.CurrentTotal != 30 {
+		t.Fatalf("expected replayed usage to be charged, got %+v err=%v", pkg, err)
+	}
+
+	res = report("gone")
+	if !res.Queued {
+		t.Fatalf("expected second unknown user to be queued")
+	}
+	if _, dropped, err := fx.engine.ReplayPendingReports(time.Nanosecond); err != nil || dropped != 1 {
+		t.Fatalf("expected expired report to be dropped, got %d err=%v", dropped, err)
+	}
+
+	calls := 0
+	fx.engine.SetUnknownUserPolicy(domain.UnknownUserActionProvision, provisionFunc(func(_ context.Context, r *domain.UsageReport) error {
+		calls++
+		createUser(r.UserID)
+		return nil
+	}))
+	if res := report("provisioned"); !res.Accepted || calls != 1 {
+		t.Fatalf("expected provisioned user to be accepted, got reason=%q calls=%d", res.Reason, calls)
+	}
+
+	// A failed hook call is not repeated for the same user within the window,
+	// and the request's context reaches the hook
+	type ctxKey struct{}
+	calls = 0
+	fx.engine.SetUnknownUserPolicy(domain.UnknownUserActionProvision, provisionFunc(func(ctx context.Context, _ *domain.UsageReport) error {
+		calls++
+		if ctx.Value(ctxKey{}) != "request" {
+			t.Errorf("expected the request context to reach the hook")
+		}
+		return errors.New("hook down")
+	}))
+	fx.engine.SetUnknownUserLimits(1, time.Minute)
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	for i := 0; i < 3; i++ {
+		res := fx.engine.ProcessUsageReportContext(ctx, &domain.UsageReport{UserID: "broken", NodeID: fx.nodeID, ServiceID: fx.serviceID, Upload: 1, Timestamp: time.Now()})
+		if res.Accepted || res.ReasonCode != domain.ReasonUserNotFound {
+			t.Fatalf("expected unknown user rejected, got %+v", res)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected one hook call within the retry window, got %d", calls)
+	}
+
+	// The queue holds at most maxPending reports
+	fx.engine.SetUnknownUserPolicy(domain.UnknownUserActionQueue, nil)
+	if res := report("first"); !res.Queued {
+		t.Fatalf("expected the first report to be queued")
+	}
+	if res := report("second"); res.Queued {
+		t.Fatalf("expected the queue cap to refuse the second report")
+	}
+}
+
+func TestCheckQuota_CachesNegativeDecisions(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	if err := fx.userDB.UpdateUserStatus(fx.userID, domain.UserStatusSuspended); err != nil {
+		t.Fatalf("suspend user: %v", err)
+	}
+
+	res, err := fx.quota.CheckQuota(fx.userID, 1, 1)
+	if err != nil {
+		t.Fatalf("check quota: %v", err)
+	}
+	if res.CanUse || res.ReasonCode != domain.ReasonUserInactive {
+		t.Fatalf("expected suspended user to be rejected, got %+v", res)
+	}
+
+	// Reactivating in the database alone is not seen until the decision
+	// expires or the user's cache entry is refreshed
+	if err := fx.userDB.UpdateUserStatus(fx.userID, domain.UserStatusActive); err != nil {
+		t.Fatalf("reactivate user: %v", err)
+	}
+	report := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		Upload:    1,
+		Download:  1,
+		Timestamp: time.Now(),
+	})
+	if report.Accepted || report.ReasonCode != domain.ReasonUserInactive || !report.ShouldDisconnect {
+		t.Fatalf("expected cached rejection, got accepted=%v code=%q", report.Accepted, report.ReasonCode)
+	}
+
+	if err := fx.quota.RefreshCache(fx.userID); err != nil {
+		t.Fatalf("refresh cache: %v", err)
+	}
+	if res, err := fx.quota.CheckQuota(fx.userID, 1, 1); err != nil || !res.CanUse {
+		t.Fatalf("expected refreshed user to be allowed, got %+v err=%v", res, err)
+	}
+
+	fx.quota.SetNegativeCacheTTL(0)
+	if err := fx.userDB.UpdateUserStatus(fx.userID, domain.UserStatusSuspended); err != nil {
+		t.Fatalf("suspend user: %v", err)
+	}
+	fx.quota.RefreshCache(fx.userID)
+	fx.quota.CheckQuota(fx.userID, 1, 1)
+	if fx.quota.CachedRejection(fx.userID) != nil {
+		t.Fatalf("expected no cached decision with the cache disabled")
+	}
+}
+
+func TestProcessUsageReport_EstimatesSpeedAndFlagsSustainedRate(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000_000_000)
+	fx.session.SetSpeedPolicy(time.Minute, domain.SpeedRule{ThresholdBps: 1, Sustain: 0})
+
+	report := func() {
+		t.Helper()
+		result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "fast",
+			Upload:    1_000,
+			Download:  1_000,
+			Timestamp: time.Now(),
+		})
+		if !result.Accepted {
+			t.Fatalf("expected report accepted: %s", result.Reason)
+		}
+	}
+
+	report()
+	if up, down := fx.session.UserThroughput(fx.userID); up != 0 || down != 0 {
+		t.Fatalf("expected no rate after the first report, got %d / %d", up, down)
+	}
+	events, _ := fx.events.GetEvents(ptrEventType(domain.EventUserSpeedExceeded), nil, 0)
+	if len(events) != 0 {
+		t.Fatalf("expected no speed event yet, got %d", len(events))
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	report()
+	sessions := fx.session.GetUserSessions(fx.userID)
+	if len(sessions) != 1 || sessions[0].UploadBps <= 0 || sessions[0].DownloadBps <= 0 {
+		t.Fatalf("expected an estimated session rate, got %+v", sessions)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	report()
+	events, _ = fx.events.GetEvents(ptrEventType(domain.EventUserSpeedExceeded), nil, 0)
+	if len(events) != 1 {
+		t.Fatalf("expected one USER_SPEED_EXCEEDED event for the stretch, got %d", len(events))
+	}
+	var meta domain.SpeedExceeded
+	if err := json.Unmarshal(events[0].Metadata, &meta); err != nil || meta.ThresholdBps != 1 || meta.Bps <= 1 {
+		t.Fatalf("unexpected speed event metadata %s: %v", events[0].Metadata, err)
+	}
+}
+
+func TestDigester_DeliversDueDigestsOnce(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("create active DB: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+
+	managerID := "mgr-digest"
+	if err := fx.userDB.CreateManager(&domain.Manager{ID: managerID, Name: "reseller", Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}}); err != nil {
+		t.Fatalf("create manager: %v", err)
+	}
+	if err := fx.userDB.CreateUser(&domain.User{ID: "u-digest", Username: "digest", Password: "x", Status: domain.UserStatusActive, ManagerID: &managerID}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if err := fx.userDB.CreateNode(&domain.Node{ID: "node-quiet", SecretKey: "q", Name: "quiet", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset, ManagerID: &managerID}); err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if err := activeDB.BufferUsage(&domain.UsageReport{ID: "r1", UserID: "u-digest", NodeID: fx.nodeID, ServiceID: fx.serviceID, Download: 2_000_000_000, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("buffer usage: %v", err)
+	}
+
+	var received []domain.Notification
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var n domain.Notification
+		_ = json.NewDecoder(r.Body).Decode(&n)
+		received = append(received, n)
+	}))
+	t.Cleanup(srv.Close)
+
+	if err := fx.userDB.SaveDigestSubscription(&domain.DigestSubscription{ManagerID: managerID, Frequency: domain.DigestFrequencyDaily, WebhookURL: srv.URL}); err != nil {
+		t.Fatalf("save subscription: %v", err)
+	}
+
+	digester := NewDigester(fx.userDB, activeDB, nil, NewWebhookNotifier(time.Second), zap.NewNop())
+
+	fail = true
+	if err := digester.Run(context.Background(), time.Now()); err == nil {
+		t.Fatalf("expected failed delivery to be reported")
+	}
+	if sub, _ := fx.userDB.GetDigestSubscription(managerID); sub.LastSentAt != nil {
+		t.Fatalf("expected a failed digest to stay due")
+	}
+
+	fail = false
+	if err := digester.Run(context.Background(), time.Now()); err != nil {
+		t.Fatalf("run digests: %v", err)
+	}
+	if err := digester.Run(context.Background(), time.Now()); err != nil {
+		t.Fatalf("run digests again: %v", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("expected one delivered digest, got %d", len(received))
+	}
+
+	want := "Daily report for reseller: 1 new users, 2.00 GB traffic, 0 suspensions, 1 nodes offline."
+	if received[0].Key != domain.MessageManagerDigestDaily || received[0].Recipient != managerID || received[0].Text != want {
+		t.Fatalf("unexpected digest notification: %+v", received[0])
+	}
+}
+
+func TestQuotaReservation_HoldsTrafficUntilSettled(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	res, err := fx.quota.Reserve(fx.userID, "s1", fx.nodeID, 6_000, 0)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if !res.Granted || res.Remaining != 4_000 || res.Reservation == nil {
+		t.Fatalf("expected reservation to be granted with 4000 left, got %+v", res)
+	}
+
+	if q, err := fx.quota.CheckQuota(fx.userID, 1, 4_000); err != nil || q.CanUse {
+		t.Fatalf("expected reserved bytes to count against the quota, got %+v err=%v", q, err)
+	}
+	if over, err := fx.quota.Reserve(fx.userID, "s2", fx.nodeID, 5_000, 0); err != nil || over.Granted || over.ReasonCode != domain.ReasonQuotaExceeded {
+		t.Fatalf("expected second reservation to be refused, got %+v err=%v", over, err)
+	}
+
+	if _, err := fx.quota.ReleaseReservation(res.Reservation.ID); err != nil {
+		t.Fatalf("release reservation: %v", err)
+	}
+	if _, err := fx.quota.ReleaseReservation(res.Reservation.ID); !errors.Is(err, sqlite.ErrReservationNotActive) {
+		t.Fatalf("expected second release to fail, got %v", err)
+	}
+	if q, err := fx.quota.CheckQuota(fx.userID, 1, 4_000); err != nil || !q.CanUse {
+		t.Fatalf("expected released bytes to be usable, got %+v err=%v", q, err)
+	}
+
+	short, err := fx.quota.Reserve(fx.userID, "s3", fx.nodeID, 3_000, time.Millisecond)
+	if err != nil || !short.Granted {
+		t.Fatalf("reserve: %+v err=%v", short, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := fx.quota.ExpireReservations(); err != nil {
+		t.Fatalf("expire reservations: %v", err)
+	}
+	expired, err := fx.userDB.GetReservation(short.Reservation.ID)
+	if err != nil || expired.Status != domain.ReservationStatusExpired {
+		t.Fatalf("expected reservation to expire, got %+v err=%v", expired, err)
+	}
+	pkg, err := fx.userDB.GetPackageByUserID(fx.userID)
+	if err != nil || pkg.Reserved != 0 {
+		t.Fatalf("expected no reserved bytes left, got %+v err=%v", pkg, err)
+	}
+}
+
+func TestNodeSync_SnapshotAndIncrementalUpdates(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	if _, err := fx.quota.NodeSync("missing", 0); !errors.Is(err, ErrUnknownNode) {
+		t.Fatalf("expected unknown node error, got %v", err)
+	}
+
+	snapshot, err := fx.quota.NodeSync(fx.nodeID, 0)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+	if !snapshot.Full || len(snapshot.Users) != 1 {
+		t.Fatalf("expected full snapshot with one user, got %+v", snapshot)
+	}
+	if u := snapshot.Users[0]; u.UserID != fx.userID || u.Remaining != 10_000 || u.MaxConcurrent != 2 {
+		t.Fatalf("unexpected sync entry %+v", u)
+	}
+
+	unchanged, err := fx.quota.NodeSync(fx.nodeID, snapshot.Cursor)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+	if unchanged.Full || len(unchanged.Users) != 0 || len(unchanged.Removed) != 0 {
+		t.Fatalf("expected no changes since the snapshot, got %+v", unchanged)
+	}
+
+	if err := fx.quota.RecordUsage(fx.userID, 1_000, 3_000); err != nil {
+		t.Fatalf("record usage: %v", err)
+	}
+	used, err := fx.quota.NodeSync(fx.nodeID, unchanged.Cursor)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+	if len(used.Users) != 1 || used.Users[0].Remaining != 6_000 {
+		t.Fatalf("expected updated remaining traffic, got %+v", used)
+	}
+
+	if err := fx.userDB.UpdateUserStatus(fx.userID, domain.UserStatusSuspended); err != nil {
+		t.Fatalf("suspend user: %v", err)
+	}
+	suspended, err := fx.quota.NodeSync(fx.nodeID, used.Cursor)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+	if len(suspended.Users) != 0 || len(suspended.Removed) != 1 || suspended.Removed[0] != fx.userID {
+		t.Fatalf("expected suspended user to be removed, got %+v", suspended)
+	}
+
+	if err := fx.userDB.UpdateUserStatus(fx.userID, domain.UserStatusActive); err != nil {
+		t.Fatalf("reactivate user: %v", err)
+	}
+	if err := fx.userDB.DeleteUser(fx.userID); err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+	deleted, err := fx.quota.NodeSync(fx.nodeID, suspended.Cursor)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+	if len(deleted.Removed) != 1 || deleted.Removed[0] != fx.userID {
+		t.Fatalf("expected deleted user to be removed, got %+v", deleted)
+	}
+}
+
+func TestNodeSync_FullSnapshotAfterNodeOrManagerChanges(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	snapshot, err := fx.quota.NodeSync(fx.nodeID, 0)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+
+	// Usage does not change the node's scope
+	if err := fx.userDB.UpdateNodeUsage(fx.nodeID, 10, 10); err != nil {
+		t.Fatalf("update node usage: %v", err)
+	}
+	quiet, err := fx.quota.NodeSync(fx.nodeID, snapshot.Cursor)
+	if err != nil || quiet.Full {
+		t.Fatalf("expected an incremental sync after usage, got %+v err=%v", quiet, err)
+	}
+
+	if err := fx.userDB.CreateManager(&domain.Manager{ID: "mgr-a", Name: "a", Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}}); err != nil {
+		t.Fatalf("create manager: %v", err)
+	}
+	managerID := "mgr-a"
+	if err := fx.userDB.SetNodeManager(fx.nodeID, &managerID); err != nil {
+		t.Fatalf("assign node manager: %v", err)
+	}
+	rescoped, err := fx.quota.NodeSync(fx.nodeID, quiet.Cursor)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+	if !rescoped.Full || len(rescoped.Users) != 0 {
+		t.Fatalf("expected a full snapshot without the unmanaged user, got %+v", rescoped)
+	}
+
+	if _, err := fx.userDB.Exec(`UPDATE users SET manager_id = ? WHERE id = ?`, "mgr-b", fx.userID); err != nil {
+		t.Fatalf("set user manager: %v", err)
+	}
+	if err := fx.userDB.CreateManager(&domain.Manager{ID: "mgr-b", Name: "b", Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}}); err != nil {
+		t.Fatalf("create manager: %v", err)
+	}
+	quiet, err = fx.quota.NodeSync(fx.nodeID, time.Now().UnixNano())
+	if err != nil || quiet.Full {
+		t.Fatalf("expected an incremental sync, got %+v err=%v", quiet, err)
+	}
+
+	// Moving the user's manager under the node's manager brings the user in
+	parent := "mgr-a"
+	manager, err := fx.userDB.GetManager("mgr-b")
+	if err != nil {
+		t.Fatalf("get manager: %v", err)
+	}
+	manager.ParentID = &parent
+	if err := fx.userDB.UpdateManager(manager); err != nil {
+		t.Fatalf("move manager: %v", err)
+	}
+	moved, err := fx.quota.NodeSync(fx.nodeID, quiet.Cursor)
+	if err != nil {
+		t.Fatalf("node sync: %v", err)
+	}
+	if !moved.Full || len(moved.Users) != 1 || moved.Users[0].UserID != fx.userID {
+		t.Fatalf("expected a full snapshot with the moved user, got %+v", moved)
+	}
+}
+
+func TestProcessUsageReport_BackfillsOldReportsCappedAtQuota(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 10_000)
+	fx.engine.SetBackfillAfter(time.Minute)
+	if _, err := fx.userDB.Exec(`UPDATE packages SET created_at = ? WHERE id = ?`, time.Now().Add(-3*time.Hour), fx.packageID); err != nil {
+		t.Fatalf("backdate package: %v", err)
+	}
+
+	reportedAt := time.Now().Add(-2 * time.Hour)
+	reportAt := func(sessionID string, upload, download int64, at time.Time) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			Upload:    upload,
+			Download:  download,
+			Timestamp: at,
+		})
+	}
+	report := func(sessionID string, upload, download int64) *domain.UsageReportResult {
+		return reportAt(sessionID, upload, download, reportedAt)
+	}
+
+	// Traffic from before the package existed is not charged to it
+	early := reportAt("older", 1_000, 1_000, time.Now().Add(-4*time.Hour))
+	if early.Accepted || early.ReasonCode != domain.ReasonPackageInactive {
+		t.Fatalf("expected traffic predating the package to be skipped, got %+v", early)
+	}
+
+	// Old sessions do not count against the concurrency limit
+	first := report("old-1", 1_000, 3_000)
+	second := report("old-2", 1_000, 1_000)
+	if !first.Backfilled || !first.Accepted || !second.Accepted || second.ShouldDisconnect {
+		t.Fatalf("expected both backfills accepted, got %+v and %+v", first, second)
+	}
+	if n := fx.engine.session.GetActiveSessionCount(fx.userID); n != 0 {
+		t.Fatalf("expected backfill to track no sessions, got %d", n)
+	}
+
+	capped := report("old-3", 0, 8_000)
+	if !capped.Accepted || !capped.QuotaExceeded || capped.ReasonCode != domain.ReasonQuotaExceeded || capped.BilledDownload != 4_000 {
+		t.Fatalf("expected backfill capped at the 4000 bytes left, got %+v", capped)
+	}
+	pkg, err := fx.userDB.GetPackage(fx.packageID)
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	if pkg.CurrentTotal != 10_000 || pkg.Status != domain.PackageStatusFinish {
+		t.Fatalf("expected package filled to its quota, got total=%d status=%s", pkg.CurrentTotal, pkg.Status)
+	}
+	if user, _ := fx.userDB.GetUser(fx.userID); user.Status != domain.UserStatusFinish {
+		t.Fatalf("expected user finished with the package, got %s", user.Status)
+	}
+	expired, _ := fx.events.GetEvents(ptrEventType(domain.EventPackageExpired), nil, 0)
+	if len(expired) != 1 {
+		t.Fatalf("expected one PACKAGE_EXPIRED event, got %d", len(expired))
+	}
+
+	dropped := report("old-4", 500, 500)
+	if dropped.Accepted || !dropped.QuotaExceeded {
+		t.Fatalf("expected backfill beyond the quota to be dropped, got %+v", dropped)
+	}
+
+	var backfills []domain.Backfill
+	for _, ev := range fx.events.events {
+		if ev.Type != domain.EventBackfill {
+			continue
+		}
+		var b domain.Backfill
+		if err := json.Unmarshal(ev.Metadata, &b); err != nil {
+			t.Fatalf("decode backfill metadata: %v", err)
+		}
+		backfills = append(backfills, b)
+	}
+	if len(backfills) != 3 {
+		t.Fatalf("expected a BACKFILL event per charged report, got %d", len(backfills))
+	}
+	if b := backfills[2]; !b.Capped || b.Billed != 8_000 || b.Charged.Total() != 4_000 || !b.ReportedAt.Equal(reportedAt) {
+		t.Fatalf("unexpected capped backfill metadata %+v", b)
+	}
+}
+
+func TestPanelSync_DeliversSignedPenaltyCallbacksInOrder(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 10_000)
+
+	var received []panelhook.Callback
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := panelhook.Verify("panel-secret", r.Header.Get(panelhook.SignatureHeader), body, time.Minute, time.Now()); err != nil {
+			t.Errorf("verify signature: %v", err)
+		}
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var cb panelhook.Callback
+		if err := json.Unmarshal(body, &cb); err != nil {
+			t.Errorf("decode callback: %v", err)
+		}
+		received = append(received, cb)
+	}))
+	defer srv.Close()
+
+	panel := NewPanelSync(fx.userDB, srv.URL, "panel-secret", time.Second, zap.NewNop())
+	fx.engine.SetPanelSync(panel)
+
+	for _, sessionID := range []string{"s1", "s2"} {
+		fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: sessionID,
+			ClientIP:  "10.0.0.1",
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+	// An admin lifting the suspension is mirrored as an activation
+	fx.engine.EmitStatusChange(fx.userID, domain.UserStatusSuspended, domain.UserStatusActive)
+	fx.engine.EmitStatusChange(fx.userID, domain.UserStatusActive, domain.UserStatusActive)
+
+	if _, err := panel.Deliver(context.Background()); err == nil {
+		t.Fatalf("expected the first delivery to fail")
+	}
+	delivered, err := panel.Deliver(context.Background())
+	if err != nil || delivered != 2 {
+		t.Fatalf("expected both callbacks delivered on retry, got %d err=%v", delivered, err)
+	}
+	if len(received) != 2 || received[0].Sequence >= received[1].Sequence {
+		t.Fatalf("expected two callbacks in order, got %+v", received)
+	}
+	penalty := received[0]
+	if penalty.Status != panelhook.StatusPenalized || penalty.UserID != fx.userID || penalty.ExpiresAt == nil || penalty.Reason != string(domain.ReasonConcurrentLimit) {
+		t.Fatalf("unexpected penalty callback %+v", penalty)
+	}
+	if received[1].Status != panelhook.StatusActive {
+		t.Fatalf("expected activation callback, got %+v", received[1])
+	}
+
+	if delivered, err := panel.Deliver(context.Background()); err != nil || delivered != 0 {
+		t.Fatalf("expected nothing left to deliver, got %d err=%v", delivered, err)
+	}
+	if n, err := panel.Replay(penalty.Sequence); err != nil || n != 1 {
+		t.Fatalf("expected one callback replayed, got %d err=%v", n, err)
+	}
+	if delivered, err := panel.Deliver(context.Background()); err != nil || delivered != 1 || received[2].ID != received[1].ID {
+		t.Fatalf("expected replay to resend the same callback, got %d err=%v", delivered, err)
+	}
+}
+
+func TestEventWebhooks_RetriesSignedDeliveriesAndDeadLetters(t *testing.T) {
+	fx := newTestEngineFixture(t, 1, 10_000)
+
+	historyDB, err := sqlite.NewHistoryDB("sqlite://" + filepath.Join(t.TempDir(), "hue-test_history.db"))
+	if err != nil {
+		t.Fatalf("create history DB: %v", err)
+	}
+	t.Cleanup(func() { _ = historyDB.Close() })
+
+	delivered := make(chan *domain.Event, 4)
+	var calls int32
+	global := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := panelhook.Verify("hook-secret", r.Header.Get(panelhook.SignatureHeader), body, time.Minute, time.Now()); err != nil {
+			t.Errorf("verify signature: %v", err)
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event domain.Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		if got := r.Header.Get(EventWebhookHeader); got != string(event.Type) {
+			t.Errorf("expected %s header %q, got %q", EventWebhookHeader, event.Type, got)
+		}
+		delivered <- &event
+	}))
+	defer global.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	service, err := fx.userDB.GetService(fx.serviceID)
+	if err != nil {
+		t.Fatalf("get service: %v", err)
+	}
+	service.CallbackURL = broken.URL
+	if err := fx.userDB.UpdateService(service); err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+
+	hooks := NewEventWebhooks(EventWebhookOptions{
+		URLs:        []string{global.URL},
+		Secret:      "hook-secret",
+		Types:       []domain.EventType{domain.EventUserConnected},
+		MaxAttempts: 2,
+		Backoff:     10 * time.Millisecond,
+		Timeout:     time.Second,
+	}, fx.userDB, historyDB, zap.NewNop())
+	hooks.Start()
+	defer hooks.Stop()
+	fx.engine.SetEventWebhooks(hooks)
+
+	serviceID := fx.serviceID
+	hooks.Enqueue(&domain.Event{ID: "ev-skipped", Type: domain.EventUserDisconnected, UserID: &fx.userID, Timestamp: time.Now()})
+	hooks.Enqueue(&domain.Event{ID: "ev-1", Type: domain.EventUserConnected, UserID: &fx.userID, ServiceID: &serviceID, Timestamp: time.Now()})
+
+	select {
+	case event := <-delivered:
+		if event.ID != "ev-1" {
+			t.Fatalf("expected ev-1 to be delivered, got %s", event.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the event to be delivered after a retry")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		letters, err := hooks.DeadLetters(10)
+		if err != nil {
+			t.Fatalf("list dead letters: %v", err)
+		}
+		if len(letters) == 1 {
+			dl := letters[0]
+			if dl.URL != broken.URL || dl.EventID != "ev-1" || dl.Attempts != 2 || dl.EventType != domain.EventUserConnected || len(dl.Payload) == 0 {
+				t.Fatalf("unexpected dead letter %+v", dl)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the service callback to be dead-lettered, got %d", len(letters))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case event := <-delivered:
+		t.Fatalf("expected filtered events to be skipped, got %s", event.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestResetDueNodesSnapshotsAndZeroesCounters(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+
+	historyDB, err := sqlite.NewHistoryDB("sqlite://" + filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("create history DB: %v", err)
+	}
+	t.Cleanup(func() { _ = historyDB.Close() })
+	fx.engine.SetNodeResetHistory(historyDB)
+
+	node, err := fx.userDB.GetNode(fx.nodeID)
+	if err != nil {
+		t.Fatalf("get node: %v", err)
+	}
+	node.ResetMode = domain.ResetModeMonthly
+	node.ResetDay = 1
+	if err := fx.userDB.UpdateNode(node); err != nil {
+		t.Fatalf("update node: %v", err)
+	}
+	if err := fx.userDB.UpdateNodeUsage(fx.nodeID, 300, 700); err != nil {
+		t.Fatalf("update node usage: %v", err)
+	}
+
+	if n, err := fx.engine.ResetDueNodes(time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected no reset before the next boundary, got %d, %v", n, err)
+	}
+
+	later := time.Now().AddDate(0, 2, 0)
+	if n, err := fx.engine.ResetDueNodes(later); err != nil || n != 1 {
+		t.Fatalf("expected one node reset, got %d, %v", n, err)
+	}
+	node, err = fx.userDB.GetNode(fx.nodeID)
+	if err != nil {
+		t.Fatalf("get node: %v", err)
+	}
+	if node.CurrentTotal != 0 || node.LastResetAt == nil {
+		t.Fatalf("expected zeroed counters and a reset time, got total=%d last_reset_at=%v", node.CurrentTotal, node.LastResetAt)
+	}
+
+	snapshots, err := historyDB.ListNodeUsageSnapshots(fx.nodeID, 0)
+	if err != nil {
+		t.Fatalf("list snapshots: %v", err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Upload != 300 || snapshots[0].Download != 700 || snapshots[0].Total != 1000 {
+		t.Fatalf("expected a snapshot of the pre-reset totals, got %+v", snapshots)
+	}
+
+	resetType := domain.EventNodeReset
+	events, _ := fx.events.GetEvents(&resetType, nil, 0)
+	if len(events) != 1 || events[0].NodeID == nil || *events[0].NodeID != fx.nodeID {
+		t.Fatalf("expected one NODE_RESET event for the node, got %+v", events)
+	}
+	var meta domain.NodeUsageSnapshot
+	if err := json.Unmarshal(events[0].Metadata, &meta); err != nil || meta.Total != 1000 {
+		t.Fatalf("expected the event to carry the snapshot, got %s (%v)", events[0].Metadata, err)
+	}
+
+	if n, err := fx.engine.ResetDueNodes(later); err != nil || n != 0 {
+		t.Fatalf("expected no second reset in the same period, got %d, %v", n, err)
+	}
+}
+
+func TestPurgeDeletesDataPastRetention(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("create active DB: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+	eng := NewEngine(NewQuotaEngine(fx.userDB, activeDB, fx.cache, zap.NewNop()), fx.session, fx.penalty, nil, fx.events, fx.cache, fx.userDB, zap.NewNop())
+	hueMetrics := metrics.New()
+	eng.SetMetrics(hueMetrics)
+
+	historyDB, err := sqlite.NewHistoryDB("sqlite://" + filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("create history DB: %v", err)
+	}
+	t.Cleanup(func() { _ = historyDB.Close() })
+
+	now := time.Now()
+	for i, at := range []time.Time{now.AddDate(0, 0, -40), now.AddDate(0, 0, -40), now.Add(-time.Hour)} {
+		report := &domain.UsageReport{ID: fmt.Sprintf("r%d", i), UserID: fx.userID, NodeID: fx.nodeID, ServiceID: fx.serviceID, Upload: 10, Timestamp: at}
+		if err := activeDB.BufferUsage(report); err != nil {
+			t.Fatalf("buffer usage: %v", err)
+		}
+		if err := historyDB.StoreUsageHistory(fx.userID, fx.packageID, fx.nodeID, fx.serviceID, domain.UsageTraffic{BilledUpload: 10}, "", &domain.GeoData{}, nil, at); err != nil {
+			t.Fatalf("store usage history: %v", err)
+		}
+	}
+	if err := activeDB.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	if n, err := eng.PurgeUsageReports(now); err != nil || n != 0 {
+		t.Fatalf("expected nothing purged without a retention, got %d, %v", n, err)
+	}
+	eng.SetRetention(historyDB, 30*24*time.Hour, 30*24*time.Hour)
+	if n, err := eng.PurgeUsageReports(now); err != nil || n != 2 {
+		t.Fatalf("expected the two old reports purged, got %d, %v", n, err)
+	}
+	if _, _, reports, _ := activeDB.GetUsageTotals(time.Time{}, now); reports != 1 {
+		t.Fatalf("expected the recent report kept, got %d", reports)
+	}
+
+	// The old rows are rolled up before they go, and then their day goes too
+	if n, err := eng.PurgeHistory(now); err != nil || n != 4 {
+		t.Fatalf("expected two history rows and their hourly and daily buckets purged, got %d, %v", n, err)
+	}
+	daily, err := historyDB.GetUsageRollups(sqlite.UsageRollupFilter{Granularity: sqlite.RollupDaily, From: now.AddDate(0, 0, -60), To: now})
+	if err != nil || len(daily) != 1 || daily[0].Reports != 1 {
+		t.Fatalf("expected only the recent day's rollup left, got %+v, %v", daily, err)
+	}
+	if got := hueMetrics.RetentionPurged.Value("usage_reports"); got != 2 {
+		t.Fatalf("expected 2 purged usage reports counted, got %d", got)
+	}
+	if got := hueMetrics.RetentionPurged.Value("usage_history"); got != 2 {
+		t.Fatalf("expected 2 purged history rows counted, got %d", got)
+	}
+
+	purgedType := domain.EventDataPurged
+	events, _ := fx.events.GetEvents(&purgedType, nil, 0)
+	if len(events) != 2 || events[0].Tags[0] != "active" || events[1].Tags[0] != "history" {
+		t.Fatalf("expected a DATA_PURGED event per database, got %+v", events)
+	}
+	var meta struct {
+		Rows map[string]int64 `json:"rows"`
+	}
+	if err := json.Unmarshal(events[1].Metadata, &meta); err != nil || meta.Rows["usage_history"] != 2 || meta.Rows["usage_daily"] != 1 {
+		t.Fatalf("expected purged rows per table in the metadata, got %s (%v)", events[1].Metadata, err)
+	}
+}
+
+func TestProcessUsageReport_BuffersUsageHistory(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	historyDB, err := sqlite.NewHistoryDB("sqlite://" + filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("create history DB: %v", err)
+	}
+	t.Cleanup(func() { _ = historyDB.Close() })
+	fx.engine.SetUsageHistory(historyDB)
+	fx.engine.SetTagRules([]domain.TagRule{{Tag: "edge", Field: domain.TagRuleNode, Values: []string{fx.nodeID}}}, nil)
+
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		Upload:    120,
+		Download:  80,
+		Tags:      []string{"vless"},
+		Timestamp: at,
+	})
+	if !result.Accepted {
+		t.Fatalf("expected report to be accepted, got reason=%q", result.Reason)
+	}
+
+	var stored int
+	if err := historyDB.QueryRow(`SELECT COUNT(*) FROM usage_history`).Scan(&stored); err != nil || stored != 0 {
+		t.Fatalf("expected usage history to wait for a flush, got %d rows, %v", stored, err)
+	}
+	if err := historyDB.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	entries, err := historyDB.GetUsageHistory(fx.userID, at.Add(-time.Second), time.Now(), 0)
+	if err != nil {
+		t.Fatalf("get usage history: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one usage history entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.PackageID != fx.packageID || entry.NodeID != fx.nodeID || entry.ServiceID != fx.serviceID || entry.SessionID != "s1" {
+		t.Fatalf("unexpected usage history entry %+v", entry)
+	}
+	if entry.Upload != 120 || entry.Download != 80 || entry.RawUpload != 120 || entry.RawDownload != 80 {
+		t.Fatalf("unexpected usage history traffic %+v", entry)
+	}
+	if len(entry.Tags) != 2 || entry.Tags[0] != "vless" || entry.Tags[1] != "edge" {
+		t.Fatalf("expected sent and rule tags, got %v", entry.Tags)
+	}
+	if !entry.Timestamp.Equal(at) {
+		t.Fatalf("expected the report timestamp %v, got %v", at, entry.Timestamp)
+	}
+}
+
+func TestReplayRebuildsPackageUsage(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	for i, size := range []int64{100, 40} {
+		result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "s1",
+			Upload:    size,
+			Download:  size * 2,
+			Timestamp: time.Now(),
+		})
+		if !result.Accepted {
+			t.Fatalf("report %d: expected accepted, got reason=%q", i, result.Reason)
+		}
+	}
+	// Counters lost, e.g. to a restored backup
+	if err := fx.userDB.SetPackageUsage(fx.packageID, 10, 0); err != nil {
+		t.Fatalf("set package usage: %v", err)
+	}
+
+	created, err := fx.userDB.GetPackage(fx.packageID)
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	historyStart := created.CreatedAt.Add(-time.Minute)
+	projection := NewPackageUsageProjection("", &historyStart)
+	replayed, err := Replay(fx.events, domain.EventReplayFilter{}, projection)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if replayed != len(fx.events.events) {
+		t.Fatalf("expected every event replayed, got %d of %d", replayed, len(fx.events.events))
+	}
+
+	changes, err := projection.Rebuild(fx.userDB, false)
+	if err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	if len(changes) != 1 || !changes[0].Changed() || changes[0].Stored.Total != 10 {
+		t.Fatalf("expected the package's lost counters reported, got %+v", changes)
+	}
+	want := domain.TrafficUsage{Upload: 140, Download: 280, Total: 420, Limit: 1_000}
+	if changes[0].Replayed != want {
+		t.Fatalf("expected replayed usage %+v, got %+v", want, changes[0].Replayed)
+	}
+	if pkg, _ := fx.userDB.GetPackage(fx.packageID); pkg.CurrentTotal != 10 {
+		t.Fatalf("expected a dry run to leave the counters, got %d", pkg.CurrentTotal)
+	}
+
+	if _, err := projection.Rebuild(fx.userDB, true); err != nil {
+		t.Fatalf("rebuild: %v", err)
+	}
+	pkg, err := fx.userDB.GetPackage(fx.packageID)
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	if pkg.CurrentUpload != 140 || pkg.CurrentDownload != 280 || pkg.CurrentTotal != 420 {
+		t.Fatalf("expected counters rebuilt from events, got %d/%d/%d", pkg.CurrentUpload, pkg.CurrentDownload, pkg.CurrentTotal)
+	}
+}
+
+func TestReplayPackageUsageStartsAtResetAndRefusesIncompleteHistory(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	report := func(size int64) {
+		t.Helper()
+		result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID: fx.userID, NodeID: fx.nodeID, ServiceID: fx.serviceID, SessionID: "s1",
+			Upload: size, Download: size, Timestamp: time.Now(),
+		})
+		if !result.Accepted {
+			t.Fatalf("expected accepted, got reason=%q", result.Reason)
+		}
+	}
+	report(100)
+	fx.events.events = append(fx.events.events, &domain.Event{ID: "reset", Type: domain.EventPackageReset, UserID: &fx.userID, PackageID: &fx.packageID, Timestamp: time.Now()})
+	report(30)
+	if err := fx.userDB.SetPackageUsage(fx.packageID, 0, 0); err != nil {
+		t.Fatalf("set package usage: %v", err)
+	}
+
+	rebuild := func(historyStart *time.Time) PackageUsageChange {
+		t.Helper()
+		projection := NewPackageUsageProjection(fx.userID, historyStart)
+		if _, err := Replay(fx.events, domain.EventReplayFilter{}, projection); err != nil {
+			t.Fatalf("replay: %v", err)
+		}
+		changes, err := projection.Rebuild(fx.userDB, true)
+		if err != nil || len(changes) != 1 {
+			t.Fatalf("expected one package rebuilt, got %+v err=%v", changes, err)
+		}
+		return changes[0]
+	}
+
+	// The reset marks where the sum starts, so the history before it does not matter
+	if change := rebuild(nil); change.Incomplete != "" || change.Replayed.Total != 60 {
+		t.Fatalf("expected only the traffic since the reset, got %+v", change)
+	}
+	if pkg, _ := fx.userDB.GetPackage(fx.packageID); pkg.CurrentTotal != 60 {
+		t.Fatalf("expected the counters rebuilt since the reset, got %d", pkg.CurrentTotal)
+	}
+
+	// Events after the reset were purged
+	if err := fx.userDB.SetPackageUsage(fx.packageID, 0, 0); err != nil {
+		t.Fatalf("set package usage: %v", err)
+	}
+	purge := domain.DataPurged{Database: "history", OlderThan: time.Now().Add(time.Second), Rows: map[string]int64{"events": 1}}
+	fx.events.events = append(fx.events.events, &domain.Event{ID: "purge", Type: domain.EventDataPurged, Metadata: purge.Metadata(), Timestamp: time.Now()})
+	if change := rebuild(nil); change.Incomplete == "" {
+		t.Fatalf("expected a purge after the reset to make the events incomplete, got %+v", change)
+	}
+	if pkg, _ := fx.userDB.GetPackage(fx.packageID); pkg.CurrentTotal != 0 {
+		t.Fatalf("expected incomplete events to leave the counters, got %d", pkg.CurrentTotal)
+	}
+}
+
+func TestReplayPackageUsageRefusesHistoryStartingAfterPackage(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID: fx.userID, NodeID: fx.nodeID, ServiceID: fx.serviceID, SessionID: "s1",
+		Upload: 10, Download: 10, Timestamp: time.Now(),
+	})
+	if !result.Accepted {
+		t.Fatalf("expected accepted, got reason=%q", result.Reason)
+	}
+	if err := fx.userDB.SetPackageUsage(fx.packageID, 500, 0); err != nil {
+		t.Fatalf("set package usage: %v", err)
+	}
+
+	// A history database created after the package, e.g. replaced by an empty one
+	historyStart := time.Now().Add(time.Hour)
+	projection := NewPackageUsageProjection("", &historyStart)
+	if _, err := Replay(fx.events, domain.EventReplayFilter{}, projection); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	changes, err := projection.Rebuild(fx.userDB, true)
+	if err != nil || len(changes) != 1 || changes[0].Incomplete == "" {
+		t.Fatalf("expected the package reported as incomplete, got %+v err=%v", changes, err)
+	}
+	if pkg, _ := fx.userDB.GetPackage(fx.packageID); pkg.CurrentUpload != 500 {
+		t.Fatalf("expected incomplete events to leave the counters, got %d", pkg.CurrentUpload)
+	}
+}
+
+func TestExpirePackagesSuspendsUserAndQueuesDisconnects(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+
+	result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		Upload:    10,
+		Download:  10,
+		Timestamp: time.Now(),
+	})
+	if !result.Accepted {
+		t.Fatalf("expected report to be accepted, got reason=%q", result.Reason)
+	}
+
+	if n, err := fx.engine.ExpirePackages(time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected nothing to expire yet, got %d, %v", n, err)
+	}
+
+	// Started an hour ago with a one minute duration
+	if _, err := fx.userDB.Exec(`UPDATE packages SET start_at = ?, duration = 60, expires_at = NULL WHERE id = ?`, time.Now().Add(-time.Hour), fx.packageID); err != nil {
+		t.Fatalf("age package: %v", err)
+	}
+	if n, err := fx.engine.ExpirePackages(time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one package to expire, got %d, %v", n, err)
+	}
+
+	pkg, err := fx.userDB.GetPackage(fx.packageID)
+	if err != nil || pkg.Status != domain.PackageStatusExpired {
+		t.Fatalf("expected package to be expired, got %+v, %v", pkg, err)
+	}
+	user, err := fx.userDB.GetUser(fx.userID)
+	if err != nil || user.Status != domain.UserStatusExpired {
+		t.Fatalf("expected user to be expired, got %+v, %v", user, err)
+	}
+	if sessions := fx.session.GetUserSessions(fx.userID); len(sessions) != 0 {
+		t.Fatalf("expected sessions to be removed, got %d", len(sessions))
+	}
+	cmds := fx.engine.TakeDisconnects(fx.nodeID, 0)
+	if len(cmds) != 1 || cmds[0].Reason != string(domain.ReasonPackageExpired) {
+		t.Fatalf("expected a package_expired disconnect, got %+v", cmds)
+	}
+	expiredType := domain.EventPackageExpired
+	if events, _ := fx.events.GetEvents(&expiredType, &fx.userID, 0); len(events) != 1 {
+		t.Fatalf("expected one PACKAGE_EXPIRED event, got %d", len(events))
+	}
+
+	if n, err := fx.engine.ExpirePackages(time.Now()); err != nil || n != 0 {
+		t.Fatalf("expected an expired package to be skipped, got %d, %v", n, err)
+	}
+}
+
+func TestQueuedPackagesArePromotedInOrder(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+
+	for _, pkg := range []*domain.Package{
+		{ID: "pkg-late", QueuePosition: 2},
+		{ID: "pkg-next", QueuePosition: 1},
+	} {
+		pkg.UserID = fx.userID
+		pkg.TotalTraffic = 1_000
+		pkg.ResetMode = domain.ResetModeNoReset
+		pkg.Duration = 3600
+		pkg.MaxConcurrent = 2
+		pkg.Status = domain.PackageStatusQueued
+		if err := fx.userDB.CreatePackage(pkg); err != nil {
+			t.Fatalf("create queued package: %v", err)
+		}
+	}
+
+	result := fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		Upload:    500,
+		Download:  500,
+		Timestamp: time.Now(),
+	})
+	if !result.Accepted {
+		t.Fatalf("expected report to be accepted, got reason=%q", result.Reason)
+	}
+
+	user, err := fx.userDB.GetUser(fx.userID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	if user.Status != domain.UserStatusActive || user.ActivePackageID == nil || *user.ActivePackageID != "pkg-next" {
+		t.Fatalf("expected pkg-next to take over, got status=%s active=%v", user.Status, user.ActivePackageID)
+	}
+	if pkg, _ := fx.userDB.GetPackage(fx.packageID); pkg.Status != domain.PackageStatusFinish {
+		t.Fatalf("expected the used up package to be finished, got %s", pkg.Status)
+	}
+	activatedType := domain.EventPackageActivated
+	if events, _ := fx.events.GetEvents(&activatedType, &fx.userID, 0); len(events) != 1 || *events[0].PackageID != "pkg-next" {
+		t.Fatalf("expected PACKAGE_ACTIVATED for pkg-next, got %+v", events)
+	}
+
+	result = fx.engine.ProcessUsageReport(&domain.UsageReport{
+		UserID:    fx.userID,
+		NodeID:    fx.nodeID,
+		ServiceID: fx.serviceID,
+		SessionID: "s1",
+		Upload:    10,
+		Download:  10,
+		Timestamp: time.Now(),
+	})
+	if !result.Accepted || result.PackageID != "pkg-next" {
+		t.Fatalf("expected the next report charged to pkg-next, got %+v", result)
+	}
+
+	// Expiry promotes too, and keeps the sessions
+	if _, err := fx.userDB.Exec(`UPDATE packages SET expires_at = ? WHERE id = ?`, time.Now().Add(-time.Minute), "pkg-next"); err != nil {
+		t.Fatalf("age package: %v", err)
+	}
+	if n, err := fx.engine.ExpirePackages(time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one package to expire, got %d, %v", n, err)
+	}
+	user, _ = fx.userDB.GetUser(fx.userID)
+	if user.Status != domain.UserStatusActive || *user.ActivePackageID != "pkg-late" {
+		t.Fatalf("expected pkg-late to take over, got status=%s active=%v", user.Status, *user.ActivePackageID)
+	}
+	if cmds := fx.engine.TakeDisconnects(fx.nodeID, 0); len(cmds) != 0 {
+		t.Fatalf("expected no disconnects while a queued package takes over, got %+v", cmds)
+	}
+
+	packages, err := fx.userDB.ListUserPackages(fx.userID)
+	if err != nil || len(packages) != 3 {
+		t.Fatalf("expected three packages, got %d, %v", len(packages), err)
+	}
+}
+
+func TestProcessUsageReport_EnforcesDeviceRegistry(t *testing.T) {
+	fx := newTestEngineFixture(t, 5, 1_000_000)
+
+	if _, err := fx.userDB.Exec(`UPDATE packages SET max_devices = 2 WHERE id = ?`, fx.packageID); err != nil {
+		t.Fatalf("set max_devices: %v", err)
+	}
+
+	report := func(deviceID string) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "s-" + deviceID,
+			DeviceID:  deviceID,
+			Upload:    1,
+			Download:  1,
+			Timestamp: time.Now(),
+		})
+	}
+
+	for _, device := range []string{"dev-a", "dev-b", "dev-a"} {
+		if res := report(device); !res.Accepted {
+			t.Fatalf("expected %s to be accepted, got reason=%q", device, res.Reason)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		res := report("dev-c")
+		if res.Accepted || res.ReasonCode != domain.ReasonDeviceLimit || res.PenaltyApplied {
+			t.Fatalf("expected dev-c to be rejected with %s, got accepted=%v reason=%q", domain.ReasonDeviceLimit, res.Accepted, res.ReasonCode)
+		}
+	}
+	pendingType := domain.EventDevicePending
+	if events, _ := fx.events.GetEvents(&pendingType, &fx.userID, 0); len(events) != 1 {
+		t.Fatalf("expected one DEVICE_PENDING event, got %d", len(events))
+	}
+
+	if device, err := fx.quota.ApproveDevice(fx.userID, "dev-c"); err != nil || device == nil || device.Status != domain.DeviceStatusApproved {
+		t.Fatalf("expected dev-c to be approved, got %+v, %v", device, err)
+	}
+	if res := report("dev-c"); !res.Accepted {
+		t.Fatalf("expected approved dev-c to be accepted, got reason=%q", res.Reason)
+	}
+
+	// A removed device counts as new again and waits while dev-b and dev-c fill the limit
+	if removed, err := fx.quota.RemoveDevice(fx.userID, "dev-a"); err != nil || !removed {
+		t.Fatalf("expected dev-a to be removed, got %v, %v", removed, err)
+	}
+	if res := report("dev-a"); res.Accepted || res.ReasonCode != domain.ReasonDeviceLimit {
+		t.Fatalf("expected removed dev-a to count as new, got accepted=%v reason=%q", res.Accepted, res.ReasonCode)
+	}
+
+	fx.engine.SetDeviceLimitAction(domain.DeviceLimitActionPenalize)
+	if res := report("dev-d"); res.Accepted || !res.PenaltyApplied {
+		t.Fatalf("expected dev-d to be rejected with a penalty, got accepted=%v", res.Accepted)
+	}
+	fx.penalty.ClearPenalty(fx.userID)
+
+	// An allow-list admits only the listed devices
+	user, err := fx.userDB.GetUser(fx.userID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	user.AllowedDevices = []string{"dev-x"}
+	if err := fx.userDB.UpdateUser(user); err != nil {
+		t.Fatalf("set allowed devices: %v", err)
+	}
+	if res := report("dev-x"); !res.Accepted {
+		t.Fatalf("expected listed dev-x to be accepted, got reason=%q", res.Reason)
+	}
+	if res := report("dev-y"); res.Accepted || res.ReasonCode != domain.ReasonDeviceNotAllowed || res.PenaltyApplied {
+		t.Fatalf("expected unlisted dev-y to be rejected with %s, got accepted=%v reason=%q", domain.ReasonDeviceNotAllowed, res.Accepted, res.ReasonCode)
+	}
+}
+
+func TestCheckCountry_UserPackageAndGroupLists(t *testing.T) {
+	fx := newTestEngineFixture(t, 5, 1_000_000)
+	iran := &domain.GeoData{Country: "Iran", CountryCode: "IR"}
+	germany := &domain.GeoData{Country: "Germany", CountryCode: "DE"}
+
+	check := func(geo *domain.GeoData) string {
+		pkg, err := fx.userDB.GetPackage(fx.packageID)
+		if err != nil {
+			t.Fatalf("get package: %v", err)
+		}
+		rule, err := fx.quota.CheckCountry(fx.userID, pkg, geo)
+		if err != nil {
+			t.Fatalf("check country: %v", err)
+		}
+		return rule
+	}
+
+	if rule := check(iran); rule != "" {
+		t.Fatalf("expected no lists to permit every country, got %q", rule)
+	}
+
+	user, err := fx.userDB.GetUser(fx.userID)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	user.AllowedCountries = []string{"IR", "DE"}
+	user.Groups = []string{"eu-blocked"}
+	if err := fx.userDB.UpdateUser(user); err != nil {
+		t.Fatalf("update user: %v", err)
+	}
+	if rule := check(&domain.GeoData{Country: "France", CountryCode: "FR"}); rule != "user" {
+		t.Fatalf("expected the user allow-list to reject FR, got %q", rule)
+	}
+
+	if _, err := fx.userDB.Exec(`UPDATE packages SET denied_countries = '["ir"]' WHERE id = ?`, fx.packageID); err != nil {
+		t.Fatalf("set denied countries: %v", err)
+	}
+	if rule := check(iran); rule != "package" {
+		t.Fatalf("expected the package deny-list to reject IR, got %q", rule)
+	}
+
+	if err := fx.userDB.CreateGroup(&domain.Group{Name: "eu-blocked", DeniedCountries: []string{"Germany"}}); err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if rule := check(germany); rule != "group:eu-blocked" {
+		t.Fatalf("expected the group deny-list to reject DE, got %q", rule)
+	}
+	if rule := check(nil); rule != "" {
+		t.Fatalf("expected reports without geo data not to be restricted, got %q", rule)
+	}
+}
+
+func TestProcessUsageReport_SuggestsThrottleNearQuota(t *testing.T) {
+	fx := newTestEngineFixture(t, 5, 1_000)
+
+	if _, err := fx.userDB.Exec(`UPDATE packages SET throttle_threshold = 90, throttle_rate = 1024 WHERE id = ?`, fx.packageID); err != nil {
+		t.Fatalf("set throttle: %v", err)
+	}
+
+	report := func(download int64) *domain.UsageReportResult {
+		return fx.engine.ProcessUsageReport(&domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "s1",
+			Download:  download,
+			Timestamp: time.Now(),
+		})
+	}
+
+	if res := report(800); !res.Accepted || res.RateLimit != 0 {
+		t.Fatalf("expected no throttle at 80%%, got accepted=%v rate=%d", res.Accepted, res.RateLimit)
+	}
+	if res := report(100); !res.Accepted || res.RateLimit != 1024 {
+		t.Fatalf("expected a 1024 B/s throttle at 90%%, got accepted=%v rate=%d", res.Accepted, res.RateLimit)
+	}
+}
+
+func TestProcessUsageReport_DeduplicatesReportIDs(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("create active DB: %v", err)
+	}
+	t.Cleanup(func() { _ = activeDB.Close() })
+	fx.quota.activeDB = activeDB
+	fx.engine.SetReportDedupWindow(time.Minute)
+
+	report := func() *domain.UsageReport {
+		return &domain.UsageReport{
+			ID:        "report-1",
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "s1",
+			Upload:    100,
+			Download:  50,
+			Timestamp: time.Now(),
+		}
+	}
+	assertTotal := func(want int64) {
+		t.Helper()
+		pkg, err := fx.userDB.GetPackage(fx.packageID)
+		if err != nil {
+			t.Fatalf("get package: %v", err)
+		}
+		if pkg.CurrentTotal != want {
+			t.Fatalf("expected package total %d, got %d", want, pkg.CurrentTotal)
+		}
+	}
+
+	first := fx.engine.ProcessUsageReport(report())
+	if !first.Accepted || first.Duplicate {
+		t.Fatalf("expected the first report to be accepted, got %+v", first)
+	}
+
+	retry := fx.engine.ProcessUsageReport(report())
+	if !retry.Accepted || !retry.Duplicate || retry.BilledUpload != first.BilledUpload {
+		t.Fatalf("expected the original result for the retry, got %+v", retry)
+	}
+	assertTotal(150)
+
+	// Another instance, or this one after a restart, finds the claim in the
+	// active database
+	fx.cache.ClearReportResult("report-1")
+	retry = fx.engine.ProcessUsageReport(report())
+	if !retry.Accepted || !retry.Duplicate {
+		t.Fatalf("expected the stored result for the retry, got %+v", retry)
+	}
+	assertTotal(150)
+
+	pruned, err := fx.engine.PruneReportResults(time.Now().Add(2 * time.Minute))
+	if err != nil || pruned != 1 {
+		t.Fatalf("expected one pruned report, got %d err=%v", pruned, err)
+	}
+	fx.cache.ClearReportResult("report-1")
+	again := fx.engine.ProcessUsageReport(report())
+	if !again.Accepted || again.Duplicate {
+		t.Fatalf("expected the report to be processed after the window, got %+v", again)
+	}
+	assertTotal(300)
+
+	// Reports without an ID are never deduplicated
+	for i := 0; i < 2; i++ {
+		r := report()
+		r.ID = ""
+		if result := fx.engine.ProcessUsageReport(r); result.Duplicate {
+			t.Fatalf("expected a report without ID to be processed, got %+v", result)
+		}
+	}
+	assertTotal(600)
+}
+
+func TestProcessUsageReport_WriteBehindFlushesAggregatedUsage(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 1_000)
+	fx.quota.SetWriteBehind(true)
+
+	report := func(upload, download int64) *domain.UsageReport {
+		return &domain.UsageReport{
+			UserID:    fx.userID,
+			NodeID:    fx.nodeID,
+			ServiceID: fx.serviceID,
+			SessionID: "s1",
+			Upload:    upload,
+			Download:  download,
+			Timestamp: time.Now(),
+		}
+	}
+	packageTotal := func() int64 {
+		t.Helper()
+		pkg, err := fx.userDB.GetPackage(fx.packageID)
+		if err != nil {
+			t.Fatalf("get package: %v", err)
+		}
+		return pkg.CurrentTotal
+	}
+
+	for i := 0; i < 3; i++ {
+		if result := fx.engine.ProcessUsageReport(report(100, 100)); !result.Accepted {
+			t.Fatalf("expected report %d to be accepted, got reason=%q", i, result.Reason)
+		}
+	}
+	if total := packageTotal(); total != 0 {
+		t.Fatalf("expected no usage written before the flush, got %d", total)
+	}
+
+	// Quota counts the unwritten traffic, also when the user is reloaded
+	fx.quota.InvalidateUser(fx.userID)
+	if result := fx.engine.ProcessUsageReport(report(300, 200)); result.Accepted || result.ReasonCode != domain.ReasonQuotaExceeded {
+		t.Fatalf("expected the unwritten usage to exhaust the quota, got %+v", result)
+	}
+
+	flushed, err := fx.quota.FlushUsage()
+	if err != nil || flushed != 3 {
+		t.Fatalf("expected package, node and service to be flushed, got %d err=%v", flushed, err)
+	}
+	if total := packageTotal(); total != 600 {
+		t.Fatalf("expected the flushed package total 600, got %d", total)
+	}
+	node, err := fx.userDB.GetNode(fx.nodeID)
+	if err != nil || node.CurrentUpload != 300 || node.CurrentDownload != 300 {
+		t.Fatalf("unexpected node counters %+v err=%v", node, err)
+	}
+	svc, err := fx.userDB.GetService(fx.serviceID)
+	if err != nil || svc.CurrentUpload != 300 || svc.CurrentDownload != 300 {
+		t.Fatalf("unexpected service counters %+v err=%v", svc, err)
+	}
+	if flushed, err := fx.quota.FlushUsage(); err != nil || flushed != 0 {
+		t.Fatalf("expected nothing left to flush, got %d err=%v", flushed, err)
+	}
+
+	// A package that runs out is written and finished right away
+	if result := fx.engine.ProcessUsageReport(report(200, 200)); !result.Accepted {
+		t.Fatalf("expected the last report to be accepted, got reason=%q", result.Reason)
+	}
+	pkg, err := fx.userDB.GetPackage(fx.packageID)
+	if err != nil || pkg.CurrentTotal != 1_000 || pkg.Status != domain.PackageStatusFinish {
+		t.Fatalf("expected the finished package to be written, got %+v err=%v", pkg, err)
+	}
+}
+
+func TestWarmCacheLoadsActiveUsers(t *testing.T) {
+	fx := newTestEngineFixture(t, 2, 10_000)
+
+	if err := fx.userDB.UpdatePackageUsage(fx.packageID, 100, 200); err != nil {
+		t.Fatalf("update package usage: %v", err)
+	}
+	otherPkg := "pkg-other"
+	if err := fx.userDB.CreatePackage(&domain.Package{
+		ID: otherPkg, UserID: "user-other", TotalTraffic: 10_000, ResetMode: domain.ResetModeNoReset, Status: domain.PackageStatusActive,
+	}); err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if err := fx.userDB.CreateUser(&domain.User{
+		ID: "user-other", Username: "other", Status: domain.UserStatusSuspended, ActivePackageID: &otherPkg,
+	}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	warmed, err := fx.quota.WarmCache(0)
+	if err != nil || warmed != 1 {
+		t.Fatalf("expected one active user to be loaded, got %d err=%v", warmed, err)
+	}
+	cached := fx.cache.GetUser(fx.userID)
+	if cached == nil || cached.ActivePackageID == nil || *cached.ActivePackageID != fx.packageID || cached.CurrentTotal != 300 {
+		t.Fatalf("unexpected cached user %+v", cached)
+	}
+	if fx.cache.GetUser("user-other") != nil {
+		t.Fatalf("expected the suspended user not to be loaded")
+	}
+
+	if err := fx.userDB.UpdateUserStatus("user-other", domain.UserStatusActive); err != nil {
+		t.Fatalf("activate user: %v", err)
+	}
+	if warmed, err := fx.quota.WarmCache(1); err != nil || warmed != 1 {
+		t.Fatalf("expected the limit to bound the warm-up, got %d err=%v", warmed, err)
+	}
+	if warmed, err := fx.quota.WarmCache(0); err != nil || warmed != 2 {
+		t.Fatalf("expected both active users to be loaded, got %d err=%v", warmed, err)
+	}
+}
@@ -3,16 +3,26 @@ package engine
 import (
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 
 	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/oschwald/geoip2-golang"
 )
 
-// GeoHandler handles GeoIP extraction with zero raw IP retention
+// GeoHandler handles GeoIP extraction with zero raw IP retention. A handler
+// without a database stays on standby until Load or LoadBytes is called.
 type GeoHandler struct {
-	db *geoip2.Reader
+	db        *geoip2.Reader
+	asn       *geoip2.Reader
+	source    string
+	asnSource string
+	mu        sync.RWMutex
 }
 
+// GeoSourceUpload is reported as the source of a database loaded from bytes
+const GeoSourceUpload = "upload"
+
 // NewGeoHandler creates a new GeoHandler instance
 func NewGeoHandler(dbPath string) (*GeoHandler, error) {
 	if dbPath == "" {
@@ -24,13 +34,120 @@ func NewGeoHandler(dbPath string) (*GeoHandler, error) {
 		return nil, fmt.Errorf("failed to open maxmind db: %w", err)
 	}
 
-	return &GeoHandler{db: db}, nil
+	return &GeoHandler{db: db, source: dbPath}, nil
+}
+
+// NewStandbyGeoHandler creates a handler without a database. Geo lookups
+// return empty data until a database is loaded.
+func NewStandbyGeoHandler() *GeoHandler {
+	return &GeoHandler{}
+}
+
+// Load opens the MaxMind city database at dbPath and swaps it in
+func (h *GeoHandler) Load(dbPath string) error {
+	if dbPath == "" {
+		return fmt.Errorf("maxmind db path not configured")
+	}
+
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open maxmind db: %w", err)
+	}
+	return h.swap(db, dbPath)
+}
+
+// LoadBytes swaps in a MaxMind city database held in memory, e.g. one
+// uploaded through the admin API
+func (h *GeoHandler) LoadBytes(data []byte) error {
+	db, err := geoip2.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to read maxmind db: %w", err)
+	}
+	return h.swap(db, GeoSourceUpload)
+}
+
+// LoadASN opens the MaxMind ASN database at dbPath. Once loaded, extracted
+// geo data carries the client's ISP and AS number.
+func (h *GeoHandler) LoadASN(dbPath string) error {
+	if dbPath == "" {
+		return fmt.Errorf("maxmind asn db path not configured")
+	}
+
+	db, err := geoip2.Open(dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open maxmind asn db: %w", err)
+	}
+	return h.swapASN(db, dbPath)
+}
+
+// LoadASNBytes swaps in a MaxMind ASN database held in memory
+func (h *GeoHandler) LoadASNBytes(data []byte) error {
+	db, err := geoip2.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to read maxmind asn db: %w", err)
+	}
+	return h.swapASN(db, GeoSourceUpload)
+}
+
+func (h *GeoHandler) swapASN(db *geoip2.Reader, source string) error {
+	if dbType := db.Metadata().DatabaseType; !strings.Contains(dbType, "ASN") {
+		db.Close()
+		return fmt.Errorf("maxmind db type %q is not an ASN database", dbType)
+	}
+
+	h.mu.Lock()
+	old := h.asn
+	h.asn = db
+	h.asnSource = source
+	h.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (h *GeoHandler) swap(db *geoip2.Reader, source string) error {
+	if dbType := db.Metadata().DatabaseType; !strings.Contains(dbType, "City") {
+		db.Close()
+		return fmt.Errorf("maxmind db type %q is not a city database", dbType)
+	}
+
+	h.mu.Lock()
+	old := h.db
+	h.db = db
+	h.source = source
+	h.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Source returns the path of the loaded database, GeoSourceUpload, or "" on
+// standby
+func (h *GeoHandler) Source() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.source
+}
+
+// ASNSource returns the path of the loaded ASN database, GeoSourceUpload, or
+// "" when none is loaded
+func (h *GeoHandler) ASNSource() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.asnSource
 }
 
 // ExtractGeo extracts geo information from an IP and immediately discards the IP
 // This enforces the Zero Raw-IP Retention policy
 func (h *GeoHandler) ExtractGeo(ipStr string) *domain.GeoData {
-	if h.db == nil {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.db == nil && h.asn == nil {
 		return &domain.GeoData{}
 	}
 
@@ -40,18 +157,19 @@ func (h *GeoHandler) ExtractGeo(ipStr string) *domain.GeoData {
 		return &domain.GeoData{}
 	}
 
-	// Lookup geo data
-	city, err := h.db.City(ip)
-	if err != nil {
-		return &domain.GeoData{}
+	geoData := &domain.GeoData{}
+	if h.db != nil {
+		if city, err := h.db.City(ip); err == nil {
+			geoData.Country = h.getEnglishName(city.Country.Names)
+			geoData.CountryCode = city.Country.IsoCode
+			geoData.City = h.getEnglishName(city.City.Names)
+		}
 	}
-
-	// Extract data
-	geoData := &domain.GeoData{
-		Country: h.getEnglishName(city.Country.Names),
-		City:    h.getEnglishName(city.City.Names),
-		ISP:     "", // ISP requires ASN database
-		ASN:     0,  // ASN requires separate database
+	if h.asn != nil {
+		if asn, err := h.asn.ASN(ip); err == nil {
+			geoData.ISP = asn.AutonomousSystemOrganization
+			geoData.ASN = asn.AutonomousSystemNumber
+		}
 	}
 
 	// IP is discarded here - no storage, no logging
@@ -60,29 +178,44 @@ func (h *GeoHandler) ExtractGeo(ipStr string) *domain.GeoData {
 	return geoData
 }
 
-// ExtractGeoWithISP extracts geo information including ISP (requires ASN database)
+// ExtractGeoWithISP extracts geo information including ISP. ISP and ASN are
+// only filled once an ASN database is loaded with LoadASN.
 func (h *GeoHandler) ExtractGeoWithISP(ipStr string) *domain.GeoData {
-	geoData := h.ExtractGeo(ipStr)
-
-	// ISP extraction would require a separate ASN database
-	// For now, we leave ISP empty
-
-	return geoData
+	return h.ExtractGeo(ipStr)
 }
 
 // Close closes the GeoIP database
 func (h *GeoHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.asn != nil {
+		h.asn.Close()
+		h.asn = nil
+		h.asnSource = ""
+	}
 	if h.db != nil {
-		return h.db.Close()
+		err := h.db.Close()
+		h.db = nil
+		return err
 	}
 	return nil
 }
 
 // IsReady returns true if the handler is ready to use
 func (h *GeoHandler) IsReady() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	return h.db != nil
 }
 
+// HasASN returns true if an ASN database is loaded
+func (h *GeoHandler) HasASN() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.asn != nil
+}
+
 // getEnglishName gets the English name from a map of names
 func (h *GeoHandler) getEnglishName(names map[string]string) string {
 	if names == nil {
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// userGroups loads the groups a user belongs to; names without a group row
+// are ignored
+func (e *QuotaEngine) userGroups(user *domain.User) ([]*domain.Group, error) {
+	if user == nil || len(user.Groups) == 0 {
+		return nil, nil
+	}
+	return e.userDB.GetGroups(user.Groups)
+}
+
+// checkGroupLimits returns the reason the traffic would push one of the
+// user's groups past its limits, or an empty string
+func (e *QuotaEngine) checkGroupLimits(user *domain.User, upload, download int64) (string, error) {
+	groups, err := e.userGroups(user)
+	if err != nil {
+		return "", err
+	}
+	for _, group := range groups {
+		if reason := group.ExceededLimit(upload, download); reason != "" {
+			e.logger.Warn("group limit reached",
+				zap.String("group", group.Name),
+				zap.String("user_id", user.ID),
+				zap.String("reason", reason),
+			)
+			return reason, nil
+		}
+	}
+	return "", nil
+}
+
+// PenaltyPolicy returns how a user on pkg is penalized, with the overrides
+// of the user's groups applied
+func (e *QuotaEngine) PenaltyPolicy(userID string, pkg *domain.Package) domain.PenaltyPolicy {
+	user, err := e.userDB.GetUser(userID)
+	if err == nil {
+		var groups []*domain.Group
+		if groups, err = e.userGroups(user); err == nil {
+			return domain.ResolvePenaltyPolicy(groups, pkg)
+		}
+	}
+	e.logger.Warn("failed to load user groups", zap.String("user_id", userID), zap.Error(err))
+	return domain.ResolvePenaltyPolicy(nil, pkg)
+}
+
+// MaxConcurrent returns the concurrent session limit for a user on pkg. A
+// group's max_concurrent overrides the package's; across several groups the
+// smallest override wins.
+func (e *QuotaEngine) MaxConcurrent(userID string, pkg *domain.Package) int {
+	user, err := e.userDB.GetUser(userID)
+	if err == nil {
+		var groups []*domain.Group
+		if groups, err = e.userGroups(user); err == nil {
+			return domain.GroupMaxConcurrent(groups, pkg.MaxConcurrent)
+		}
+	}
+	e.logger.Warn("failed to load user groups", zap.String("user_id", userID), zap.Error(err))
+	return pkg.MaxConcurrent
+}
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// Weights of the parts of a node's health score; they add up to 100
+const (
+	healthWeightOnline     = 50
+	healthWeightErrors     = 30
+	healthWeightDisconnect = 20
+
+	// healthBacklogLimit is the disconnect backlog at which a node loses the
+	// whole backlog part of its score
+	healthBacklogLimit = 100
+)
+
+// SetNodeHeartbeatTimeout sets how long after its last heartbeat a node still
+// counts as online
+func (e *Engine) SetNodeHeartbeatTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		e.nodeHeartbeatTimeout = timeout
+	}
+}
+
+// NodeHealth scores a node from its heartbeat freshness, the share of its
+// recent reports that were rejected and its queued disconnects. A draining
+// node scores 0.
+func (e *Engine) NodeHealth(node *domain.Node) *domain.NodeHealth {
+	lastHeartbeat, errorRate := e.cache.NodeActivity(node.ID)
+	// Heartbeats another instance received, or received before a restart
+	if node.LastSeenAt != nil && node.LastSeenAt.After(lastHeartbeat) {
+		lastHeartbeat = *node.LastSeenAt
+	}
+	health := &domain.NodeHealth{
+		Draining:          node.Draining || e.cache.IsNodeDraining(node.ID),
+		ErrorRate:         math.Round(errorRate*1000) / 1000,
+		DisconnectBacklog: e.cache.PendingDisconnects(node.ID),
+	}
+	if !lastHeartbeat.IsZero() {
+		health.LastHeartbeatAt = &lastHeartbeat
+		health.Online = time.Since(lastHeartbeat) <= e.nodeHeartbeatTimeout
+	}
+	if health.Draining {
+		return health
+	}
+
+	score := healthWeightErrors * (1 - errorRate)
+	if health.Online {
+		score += healthWeightOnline
+	}
+	backlog := math.Min(float64(health.DisconnectBacklog), healthBacklogLimit)
+	score += healthWeightDisconnect * (1 - backlog/healthBacklogLimit)
+	health.Score = int(math.Round(score))
+	return health
+}
+
+// DetectDownNodes emits NODE_DOWN for every node that sent heartbeats but
+// none within the heartbeat timeout before now. Each outage is reported once;
+// the node's next heartbeat clears it. It returns how many nodes went down.
+func (e *Engine) DetectDownNodes(now time.Time) (int, error) {
+	nodes, err := e.userDB.MarkNodesDown(now.Add(-e.nodeHeartbeatTimeout), now)
+	for _, node := range nodes {
+		down := domain.NodeDown{LastSeenAt: node.LastSeenAt}
+		nodeID := node.ID
+		e.emitEventWithMetadata(domain.EventNodeDown, nil, nil, &nodeID, nil, nil, down.Metadata())
+		e.logger.Warn("node missed heartbeats",
+			zap.String("node_id", node.ID),
+			zap.Timep("last_seen_at", node.LastSeenAt),
+		)
+	}
+	return len(nodes), err
+}
+
+// AttachNodeHealth fills in the health of each node
+func (e *Engine) AttachNodeHealth(nodes []*domain.Node) {
+	for _, node := range nodes {
+		node.Health = e.NodeHealth(node)
+	}
+}
+
+// RecommendNodes orders nodes by health, best first, for panels choosing
+// where to send users. Draining nodes are left out and so are offline ones,
+// unless none is online. At most limit nodes are returned when limit > 0.
+func (e *Engine) RecommendNodes(nodes []*domain.Node, limit int) []*domain.Node {
+	e.AttachNodeHealth(nodes)
+
+	online := make([]*domain.Node, 0, len(nodes))
+	available := make([]*domain.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Health.Draining {
+			continue
+		}
+		available = append(available, node)
+		if node.Health.Online {
+			online = append(online, node)
+		}
+	}
+	recommended := available
+	if len(online) > 0 {
+		recommended = online
+	}
+
+	sort.SliceStable(recommended, func(i, j int) bool {
+		return recommended[i].Health.Score > recommended[j].Health.Score
+	})
+	if limit > 0 && len(recommended) > limit {
+		recommended = recommended[:limit]
+	}
+	return recommended
+}
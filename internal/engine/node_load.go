@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// NodeLoadResult describes how a node's heartbeat load report was handled
+type NodeLoadResult struct {
+	NodeID       string
+	Overloaded   bool
+	Draining     bool
+	Reason       string
+	SessionsShed int
+}
+
+// SetNodeLoadThresholds sets the limits above which a node is treated as
+// overloaded even if it does not signal overload itself
+func (e *Engine) SetNodeLoadThresholds(thresholds domain.NodeLoadThresholds) {
+	e.nodeThresholds = thresholds
+}
+
+// RestoreNodeDraining loads the draining flag persisted on each node into the
+// cache, so a restart keeps steering new sessions away from overloaded nodes
+// until they report healthy again
+func (e *Engine) RestoreNodeDraining() error {
+	nodes, err := e.userDB.ListNodes()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		e.cache.SetNodeDraining(node.ID, node.Draining)
+	}
+	return nil
+}
+
+// HandleNodeLoad evaluates the load a node reported with its heartbeat.
+// An overloaded node is marked draining so no new sessions are admitted
+// there, its lowest priority sessions are shed, and NODE_OVERLOADED is
+// emitted when it starts draining. A healthy heartbeat clears draining.
+func (e *Engine) HandleNodeLoad(load *domain.NodeLoad) (*NodeLoadResult, error) {
+	result := &NodeLoadResult{NodeID: load.NodeID}
+
+	node, err := e.userDB.GetNode(load.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return result, nil
+	}
+	now := time.Now()
+	e.cache.RecordNodeHeartbeat(node.ID, now)
+	if err := e.userDB.RecordNodeHeartbeat(load, now); err != nil {
+		return nil, err
+	}
+	if node.DownAt != nil {
+		e.logger.Info("node back online",
+			zap.String("node_id", node.ID),
+			zap.Duration("down_for", now.Sub(*node.DownAt)),
+		)
+	}
+
+	result.Overloaded = load.Overloaded
+	result.Reason = "node_signal"
+	if exceeded, reason := e.nodeThresholds.Exceeded(load); exceeded {
+		result.Overloaded = true
+		result.Reason = reason
+	}
+
+	if !result.Overloaded {
+		result.Reason = ""
+		if node.Draining {
+			if err := e.userDB.SetNodeDraining(node.ID, false); err != nil {
+				return nil, err
+			}
+			e.logger.Info("node recovered, accepting new sessions", zap.String("node_id", node.ID))
+		}
+		e.cache.SetNodeDraining(node.ID, false)
+		return result, nil
+	}
+
+	result.Draining = true
+	e.cache.SetNodeDraining(node.ID, true)
+	if !node.Draining {
+		if err := e.userDB.SetNodeDraining(node.ID, true); err != nil {
+			return nil, err
+		}
+		e.logger.Warn("node overloaded, draining",
+			zap.String("node_id", node.ID),
+			zap.String("reason", result.Reason),
+			zap.Float64("cpu_percent", load.CPUPercent),
+			zap.Int64("active_connections", load.ActiveConnections),
+			zap.Int64("bandwidth_bps", load.BandwidthBps),
+		)
+		overloaded := domain.NodeOverloaded{
+			Reason:            result.Reason,
+			CPUPercent:        load.CPUPercent,
+			ActiveConnections: load.ActiveConnections,
+			BandwidthBps:      load.BandwidthBps,
+		}
+		e.emitEventWithMetadata(domain.EventNodeOverloaded, nil, nil, &node.ID, nil, []string{result.Reason}, overloaded.Metadata())
+	}
+
+	if load.ShedSessions > 0 {
+		result.SessionsShed = e.ShedNodeLoad(node.ID, load.ShedSessions)
+	}
+
+	return result, nil
+}
+
+// nodeUserLimitReached reports whether a new session of userID would push the
+// node past its max active users. Users already active on the node are
+// always let through, so a second device never counts twice.
+func (e *Engine) nodeUserLimitReached(nodeID, userID string) (bool, error) {
+	if nodeID == "" {
+		return false, nil
+	}
+	node, err := e.userDB.GetNode(nodeID)
+	if err != nil || node == nil || node.MaxActiveUsers <= 0 {
+		return false, err
+	}
+	others, present := e.session.NodeUsers(nodeID, userID)
+	return !present && others >= node.MaxActiveUsers, nil
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"go.uber.org/zap"
+)
+
+// SetNodeResetHistory keeps each node's counters from before a reset in the
+// history database. Without it resets still happen and are only recorded as
+// NODE_RESET events.
+func (e *Engine) SetNodeResetHistory(historyDB *sqlite.HistoryDB) {
+	e.nodeResetHistory = historyDB
+}
+
+// ResetDueNodes zeroes the usage counters of every node whose reset_mode and
+// reset_day put a reset boundary between its last reset and now. Each reset
+// emits NODE_RESET carrying the pre-reset totals and stores them as a
+// snapshot. It returns how many nodes were reset.
+func (e *Engine) ResetDueNodes(now time.Time) (int, error) {
+	nodes, err := e.userDB.ListNodes()
+	if err != nil {
+		return 0, err
+	}
+
+	reset := 0
+	for _, node := range nodes {
+		if !node.ResetDue(now) {
+			continue
+		}
+		snapshot, err := e.userDB.ResetNodeUsage(node.ID, now)
+		if err != nil {
+			return reset, err
+		}
+		if snapshot == nil {
+			continue
+		}
+		snapshot.ID = uuid.New().String()
+		reset++
+
+		if e.nodeResetHistory != nil {
+			if err := e.nodeResetHistory.StoreNodeUsageSnapshot(snapshot); err != nil {
+				e.logger.Error("failed to store node usage snapshot", zap.String("node_id", node.ID), zap.Error(err))
+			}
+		}
+		metadata, _ := json.Marshal(snapshot)
+		nodeID := node.ID
+		e.emitEventWithMetadata(domain.EventNodeReset, nil, nil, &nodeID, nil, []string{string(node.ResetMode)}, metadata)
+
+		e.logger.Info("node usage reset",
+			zap.String("node_id", node.ID),
+			zap.String("reset_mode", string(node.ResetMode)),
+			zap.Int64("upload", snapshot.Upload),
+			zap.Int64("download", snapshot.Download),
+		)
+	}
+	return reset, nil
+}
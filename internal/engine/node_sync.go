@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+// ErrUnknownNode is returned when syncing a node that does not exist
+var ErrUnknownNode = errors.New("unknown node")
+
+// NodeSync returns the users a node may serve with their remaining traffic
+// and session limits. A zero cursor returns a full snapshot; otherwise only
+// users changed since the cursor are listed, and users deleted or no longer
+// allowed on the node are returned as removed. Changes to the node itself or,
+// for a manager-scoped node, to the manager hierarchy can change which users
+// it serves without touching them, so they also produce a full snapshot.
+func (e *QuotaEngine) NodeSync(nodeID string, cursor int64) (*domain.NodeSync, error) {
+	node, err := e.userDB.GetNode(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, ErrUnknownNode
+	}
+
+	// Take the new cursor before reading so writes racing the read are sent
+	// again next time rather than lost
+	now := time.Now()
+	sync := &domain.NodeSync{
+		NodeID:  nodeID,
+		Cursor:  now.UnixNano(),
+		Full:    cursor <= 0,
+		Users:   []*domain.NodeSyncUser{},
+		Removed: []string{},
+	}
+
+	if !sync.Full {
+		if sync.Full, err = e.scopeChangedSince(node, time.Unix(0, cursor)); err != nil {
+			return nil, err
+		}
+	}
+
+	var users []*domain.User
+	if sync.Full {
+		users, err = e.userDB.ListUsers(nil)
+	} else {
+		since := time.Unix(0, cursor)
+		users, err = e.userDB.ListUsersChangedSince(since)
+		if err == nil {
+			sync.Removed, err = e.userDB.ListUserDeletionsSince(since)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	chains := make(map[string][]string)
+	for _, user := range users {
+		entry, err := e.nodeSyncUser(node, user, chains)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			sync.Users = append(sync.Users, entry)
+		} else if !sync.Full {
+			sync.Removed = append(sync.Removed, user.ID)
+		}
+	}
+	return sync, nil
+}
+
+// scopeChangedSince reports whether the set of users node may serve could
+// have changed since the cursor for reasons other than user changes
+func (e *QuotaEngine) scopeChangedSince(node *domain.Node, since time.Time) (bool, error) {
+	changed, err := e.userDB.NodeScopeChangedSince(node.ID, since)
+	if err != nil || changed {
+		return changed, err
+	}
+	if node.ManagerID == nil || *node.ManagerID == "" {
+		return false, nil
+	}
+	return e.userDB.ManagersChangedSince(since)
+}
+
+// nodeSyncUser returns the sync entry for user on node, or nil when the node
+// must not serve the user. chains caches manager ancestor chains by manager.
+func (e *QuotaEngine) nodeSyncUser(node *domain.Node, user *domain.User, chains map[string][]string) (*domain.NodeSyncUser, error) {
+	if !user.CanConnect() || !user.Permits(node.ID, "") {
+		return nil, nil
+	}
+	if rejected := e.CachedRejection(user.ID); rejected != nil {
+		return nil, nil
+	}
+	groups, err := e.userGroups(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if !group.Permits(node.ID) {
+			return nil, nil
+		}
+	}
+
+	if node.ManagerID != nil && *node.ManagerID != "" {
+		var chain []string
+		if user.ManagerID != nil && *user.ManagerID != "" {
+			var ok bool
+			if chain, ok = chains[*user.ManagerID]; !ok {
+				var err error
+				if chain, err = e.userDB.GetManagerAncestors(*user.ManagerID); err != nil {
+					return nil, err
+				}
+				chains[*user.ManagerID] = chain
+			}
+		}
+		if !domain.ManagerScopeAllows(node.ManagerID, chain) {
+			return nil, nil
+		}
+	}
+
+	pkg, err := e.userDB.GetPackage(*user.ActivePackageID)
+	if err != nil {
+		return nil, err
+	}
+	if pkg == nil || !pkg.CanUse() || !pkg.Permits(node.ID, "") {
+		return nil, nil
+	}
+
+	entry := &domain.NodeSyncUser{
+		UserID:         user.ID,
+		Username:       user.Username,
+		PublicKey:      user.PublicKey,
+		ProtocolSecret: user.ProtocolSecret,
+		Status:         user.Status,
+		Remaining:      -1,
+		MaxConcurrent:  domain.GroupMaxConcurrent(groups, pkg.MaxConcurrent),
+		MaxIPs:         pkg.MaxIPs,
+		ExpiresAt:      pkg.ExpiresAt,
+	}
+
+	if pkg.TotalTraffic > 0 {
+		remaining := pkg.TotalTraffic - e.PackageUsage(user.ID, pkg) - pkg.Reserved
+		if remaining <= 0 {
+			return nil, nil
+		}
+		// Remaining is billed traffic; nodes count measured bytes
+		if node.TrafficMultiplier > 0 && node.TrafficMultiplier != 1 {
+			remaining = int64(math.Floor(float64(remaining) / node.TrafficMultiplier))
+		}
+		entry.Remaining = remaining
+	}
+	return entry, nil
+}
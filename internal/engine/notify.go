@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+// Notifier delivers rendered notifications to a target such as a webhook URL
+type Notifier interface {
+	Notify(ctx context.Context, target string, notification *domain.Notification) error
+}
+
+// WebhookNotifier posts notifications as JSON to the target URL
+type WebhookNotifier struct {
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a notifier with the given request timeout
+func NewWebhookNotifier(timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{client: &http.Client{Timeout: timeout}}
+}
+
+// Notify implements Notifier
+func (n *WebhookNotifier) Notify(ctx context.Context, target string, notification *domain.Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// ExpirePackages marks every active package past its expiry as expired,
+// without waiting for its user's next report. When the package is the
+// user's active one, the user moves on to their next queued package. With
+// an empty queue the user is moved to expired, their sessions are
+// disconnected and the cached quota decision is dropped. Each package emits
+// PACKAGE_EXPIRED tagged "expired". It returns how many packages expired.
+func (e *Engine) ExpirePackages(now time.Time) (int, error) {
+	packages, err := e.userDB.ListExpiredPackages(now)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, pkg := range packages {
+		if err := e.userDB.UpdatePackageStatus(pkg.ID, domain.PackageStatusExpired); err != nil {
+			return 0, err
+		}
+
+		userID, packageID := pkg.UserID, pkg.ID
+		user, err := e.userDB.GetUser(userID)
+		if err != nil {
+			return 0, err
+		}
+		expiry := domain.PackageExpiry{Reason: "expired", Usage: domain.PackageTrafficUsage(pkg), ExpiresAt: pkg.ExpiresAt}
+		e.emitEventWithMetadata(domain.EventPackageExpired, &userID, &packageID, nil, nil, []string{"expired"}, expiry.Metadata())
+
+		sessions := 0
+		if user != nil && user.ActivePackageID != nil && *user.ActivePackageID == pkg.ID && e.promoteNextPackage(userID, packageID) == nil {
+			if user.Status == domain.UserStatusActive {
+				if err := e.userDB.UpdateUserStatus(userID, domain.UserStatusExpired); err != nil {
+					return 0, err
+				}
+			}
+			e.quota.InvalidateUser(userID)
+			sessions = e.endSessions(userID, "", domain.ReasonPackageExpired)
+		}
+
+		e.logger.Info("package expired",
+			zap.String("user_id", userID),
+			zap.String("package_id", packageID),
+			zap.Int("sessions", sessions),
+		)
+	}
+	return len(packages), nil
+}
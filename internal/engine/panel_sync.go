@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/pkg/panelhook"
+	"go.uber.org/zap"
+)
+
+// panelDeliveryBatch caps the callbacks sent per delivery run
+const panelDeliveryBatch = 100
+
+// PanelSync mirrors user suspensions and penalties to the Hiddify panel.
+// Status changes are queued durably and posted in order as signed
+// panelhook.Callback payloads; the panel can list or replay missed ones.
+type PanelSync struct {
+	userDB *sqlite.UserDB
+	url    string
+	secret string
+	client *http.Client
+	logger *zap.Logger
+}
+
+// NewPanelSync creates a panel sync posting to url, signed with secret
+func NewPanelSync(userDB *sqlite.UserDB, url, secret string, timeout time.Duration, logger *zap.Logger) *PanelSync {
+	return &PanelSync{
+		userDB: userDB,
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+		logger: logger,
+	}
+}
+
+// panelStatus maps an event to the status mirrored to the panel, or "" when
+// the event does not change a user's status
+func panelStatus(event *domain.Event) (status, reason string, expiresAt *time.Time) {
+	if len(event.Tags) > 0 {
+		reason = event.Tags[0]
+	}
+	switch event.Type {
+	case domain.EventUserSuspended:
+		return panelhook.StatusSuspended, reason, nil
+	case domain.EventUserActivated:
+		return panelhook.StatusActive, reason, nil
+	case domain.EventPackageExpired, domain.EventUserUsageFinished:
+		return panelhook.StatusFinished, reason, nil
+	case domain.EventPenaltyApplied:
+		var info domain.PenaltyInfo
+		if len(event.Metadata) > 0 && json.Unmarshal(event.Metadata, &info) == nil {
+			if info.Reason != "" {
+				reason = info.Reason
+			}
+			if !info.ExpiresAt.IsZero() {
+				expiresAt = &info.ExpiresAt
+			}
+		}
+		return panelhook.StatusPenalized, reason, expiresAt
+	}
+	return "", "", nil
+}
+
+// Enqueue queues a callback for events that change a user's status
+func (p *PanelSync) Enqueue(event *domain.Event) {
+	if event.UserID == nil {
+		return
+	}
+	status, reason, expiresAt := panelStatus(event)
+	if status == "" {
+		return
+	}
+
+	cb := &domain.PanelCallback{
+		ID:         uuid.New().String(),
+		EventID:    event.ID,
+		EventType:  event.Type,
+		UserID:     *event.UserID,
+		Status:     status,
+		Reason:     reason,
+		OccurredAt: event.Timestamp,
+		ExpiresAt:  expiresAt,
+	}
+	if event.PackageID != nil {
+		cb.PackageID = *event.PackageID
+	}
+	if err := p.userDB.CreatePanelCallback(cb); err != nil {
+		p.logger.Error("failed to queue panel callback", zap.String("user_id", cb.UserID), zap.Error(err))
+	}
+}
+
+// Payload returns the versioned wire form of a callback
+func (p *PanelSync) Payload(cb *domain.PanelCallback) *panelhook.Callback {
+	return &panelhook.Callback{
+		Version:    panelhook.Version,
+		ID:         cb.ID,
+		Sequence:   cb.Seq,
+		Event:      string(cb.EventType),
+		UserID:     cb.UserID,
+		PackageID:  cb.PackageID,
+		Status:     cb.Status,
+		Reason:     cb.Reason,
+		OccurredAt: cb.OccurredAt,
+		ExpiresAt:  cb.ExpiresAt,
+	}
+}
+
+// Deliver posts pending callbacks in sequence order. It stops at the first
+// failure so the panel never sees a later status before an earlier one; the
+// failed callback is retried on the next run.
+func (p *PanelSync) Deliver(ctx context.Context) (int, error) {
+	pending, err := p.userDB.ListPanelCallbacks(0, domain.PanelDeliveryPending, panelDeliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, cb := range pending {
+		if err := p.post(ctx, cb); err != nil {
+			if markErr := p.userDB.MarkPanelCallbackFailed(cb.Seq, err.Error()); markErr != nil {
+				p.logger.Error("failed to record panel callback failure", zap.Int64("seq", cb.Seq), zap.Error(markErr))
+			}
+			return delivered, fmt.Errorf("panel callback %d: %w", cb.Seq, err)
+		}
+		if err := p.userDB.MarkPanelCallbackDelivered(cb.Seq, time.Now()); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+func (p *PanelSync) post(ctx context.Context, cb *domain.PanelCallback) error {
+	body, err := json.Marshal(p.Payload(cb))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(panelhook.VersionHeader, panelhook.Version)
+	req.Header.Set(panelhook.SignatureHeader, panelhook.Sign(p.secret, time.Now(), body))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("panel webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Callbacks lists callbacks after the given sequence, delivered or not
+func (p *PanelSync) Callbacks(after int64, limit int) ([]*domain.PanelCallback, error) {
+	return p.userDB.ListPanelCallbacks(after, "", limit)
+}
+
+// Replay queues delivered callbacks after the given sequence for delivery
+// again
+func (p *PanelSync) Replay(after int64) (int, error) {
+	return p.userDB.RequeuePanelCallbacks(after)
+}
@@ -1,26 +1,49 @@
 package engine
 
 import (
+	"sync/atomic"
 	"time"
 
+	"github.com/hiddify/hue-go/internal/domain"
 	"github.com/hiddify/hue-go/internal/storage/cache"
 	"go.uber.org/zap"
 )
 
 // PenaltyHandler handles temporary penalties for concurrent session violations
 type PenaltyHandler struct {
-	cache    *cache.MemoryCache
-	duration time.Duration
+	cache    cache.Cache
+	duration atomic.Int64 // Changes on config reload
 	logger   *zap.Logger
+
+	// Escalation: the nth penalty within window of the previous one lasts
+	// steps[n-1], the last step repeating. Empty steps keep duration flat.
+	steps  []time.Duration
+	window time.Duration
 }
 
 // NewPenaltyHandler creates a new PenaltyHandler instance
-func NewPenaltyHandler(cache *cache.MemoryCache, duration time.Duration, logger *zap.Logger) *PenaltyHandler {
-	return &PenaltyHandler{
-		cache:    cache,
-		duration: duration,
-		logger:   logger,
+func NewPenaltyHandler(cache cache.Cache, duration time.Duration, logger *zap.Logger) *PenaltyHandler {
+	h := &PenaltyHandler{
+		cache:  cache,
+		logger: logger,
 	}
+	h.duration.Store(int64(duration))
+	return h
+}
+
+// SetDuration changes the duration of penalties applied from now on
+func (h *PenaltyHandler) SetDuration(duration time.Duration) {
+	h.duration.Store(int64(duration))
+}
+
+// SetEscalation makes repeat offenders' penalties longer. A penalty applied
+// within window of the user's previous one moves to the next step, e.g.
+// 1m, 10m, 1h; past the last step the last duration repeats. No steps keeps
+// every penalty at the flat duration. Policies with their own duration are
+// not escalated.
+func (h *PenaltyHandler) SetEscalation(steps []time.Duration, window time.Duration) {
+	h.steps = steps
+	h.window = window
 }
 
 // PenaltyResult represents the result of a penalty check
@@ -28,8 +51,10 @@ type PenaltyResult struct {
 	UserID     string
 	HasPenalty bool
 	Reason     string
+	Action     domain.PenaltyAction
 	ExpiresAt  time.Time
 	TimeLeft   time.Duration
+	Strike     int // Penalties in a row within the escalation window; 0 without escalation
 }
 
 // CheckPenalty checks if a user has an active penalty
@@ -46,6 +71,10 @@ func (h *PenaltyHandler) CheckPenalty(userID string) *PenaltyResult {
 
 	result.HasPenalty = true
 	result.Reason = penalty.Reason
+	result.Action = penalty.Action
+	if result.Action == "" {
+		result.Action = domain.PenaltyActionDisconnect
+	}
 	result.ExpiresAt = penalty.ExpiresAt
 	result.TimeLeft = time.Until(penalty.ExpiresAt)
 
@@ -58,21 +87,72 @@ func (h *PenaltyHandler) CheckPenalty(userID string) *PenaltyResult {
 	return result
 }
 
-// ApplyPenalty applies a penalty to a user
-func (h *PenaltyHandler) ApplyPenalty(userID, reason string) {
-	h.cache.SetPenalty(userID, reason, h.duration)
+// BlockingPenalty returns the user's penalty if it rejects reports from
+// sessionID, or nil. A disconnect penalty blocks every session; a reject
+// penalty only blocks sessions that are not already active.
+func (h *PenaltyHandler) BlockingPenalty(userID, sessionID string) *PenaltyResult {
+	penalty := h.CheckPenalty(userID)
+	if !penalty.HasPenalty {
+		return nil
+	}
+	if penalty.Action == domain.PenaltyActionReject && sessionID != "" && h.cache.GetOrCreateSessionCache(userID).HasSession(sessionID) {
+		return nil
+	}
+	return penalty
+}
 
-	// Queue disconnect for all sessions
-	sessions := h.cache.GetOrCreateSessionCache(userID).GetSessions()
-	for _, session := range sessions {
-		h.cache.QueueDisconnect(userID, session.SessionID, reason, "")
+// ApplyPenalty applies a penalty to a user under policy and returns it. A
+// policy without a duration gets the handler's, escalated for repeat
+// offenders when configured. The none action applies nothing and returns
+// nil.
+func (h *PenaltyHandler) ApplyPenalty(userID, reason string, policy domain.PenaltyPolicy) *PenaltyResult {
+	action := policy.Action
+	if action == "" {
+		action = domain.PenaltyActionDisconnect
+	}
+	if action == domain.PenaltyActionNone {
+		h.logger.Info("penalty skipped by policy",
+			zap.String("user_id", userID),
+			zap.String("reason", reason),
+		)
+		return nil
+	}
+
+	duration, strike := policy.Duration, 0
+	if duration <= 0 {
+		duration = time.Duration(h.duration.Load())
+		if len(h.steps) > 0 {
+			strike = h.cache.RecordOffense(userID, h.window)
+			duration = h.steps[min(strike, len(h.steps))-1]
+		}
+	}
+	h.cache.SetPenalty(userID, reason, action, duration)
+
+	// Queue disconnect for all sessions; a reject penalty leaves them running
+	if action == domain.PenaltyActionDisconnect {
+		sessions := h.cache.GetOrCreateSessionCache(userID).GetSessions()
+		for _, session := range sessions {
+			h.cache.QueueDisconnect(userID, session.SessionID, reason, session.NodeID)
+		}
 	}
 
 	h.logger.Warn("penalty applied",
 		zap.String("user_id", userID),
 		zap.String("reason", reason),
-		zap.Duration("duration", h.duration),
+		zap.String("action", string(action)),
+		zap.Duration("duration", duration),
+		zap.Int("strike", strike),
 	)
+
+	return &PenaltyResult{
+		UserID:     userID,
+		HasPenalty: true,
+		Reason:     reason,
+		Action:     action,
+		ExpiresAt:  time.Now().Add(duration),
+		TimeLeft:   duration,
+		Strike:     strike,
+	}
 }
 
 // ClearPenalty clears a penalty for a user
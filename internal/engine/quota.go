@@ -2,9 +2,12 @@ package engine
 
 import (
 	"fmt"
-	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/keylock"
 	"github.com/hiddify/hue-go/internal/storage/cache"
 	"github.com/hiddify/hue-go/internal/storage/sqlite"
 	"go.uber.org/zap"
@@ -12,52 +15,101 @@ import (
 
 // QuotaEngine handles quota enforcement and usage tracking
 type QuotaEngine struct {
-	userDB   *sqlite.UserDB
-	activeDB *sqlite.ActiveDB
-	cache    *cache.MemoryCache
-	logger   *zap.Logger
-	managerEnforcementMode domain.EnforcementMode
+	userDB                 *sqlite.UserDB
+	activeDB               *sqlite.ActiveDB
+	cache                  cache.Cache
+	logger                 *zap.Logger
+	managerEnforcementMode atomic.Value // domain.EnforcementMode; changes on config reload
+	negativeTTL            time.Duration
+	reservationTTL         time.Duration
+	requireReportSource    bool
+	writeBehind            bool
 
 	// Fine-grained locks per user
-	userLocks sync.Map // map[string]*sync.RWMutex
+	userLocks *keylock.Pool
 }
 
 // NewQuotaEngine creates a new QuotaEngine instance
-func NewQuotaEngine(userDB *sqlite.UserDB, activeDB *sqlite.ActiveDB, cache *cache.MemoryCache, logger *zap.Logger) *QuotaEngine {
-	return &QuotaEngine{
-		userDB:   userDB,
-		activeDB: activeDB,
-		cache:    cache,
-		logger:   logger,
-		managerEnforcementMode: domain.EnforcementModeDefault,
+func NewQuotaEngine(userDB *sqlite.UserDB, activeDB *sqlite.ActiveDB, cache cache.Cache, logger *zap.Logger) *QuotaEngine {
+	e := &QuotaEngine{
+		userDB:         userDB,
+		activeDB:       activeDB,
+		cache:          cache,
+		logger:         logger,
+		negativeTTL:    15 * time.Second,
+		reservationTTL: 10 * time.Minute,
+		userLocks:      keylock.New(),
+	}
+	e.managerEnforcementMode.Store(domain.EnforcementModeDefault)
+	return e
+}
+
+// SetNegativeCacheTTL sets how long rejections of suspended, finished or
+// expired users are served from memory. Zero disables the cache.
+func (e *QuotaEngine) SetNegativeCacheTTL(ttl time.Duration) {
+	e.negativeTTL = ttl
+}
+
+// isCacheableRejection reports whether a rejection only changes through an
+// admin write or a job, not through the report itself
+func isCacheableRejection(code domain.ReasonCode) bool {
+	switch code {
+	case domain.ReasonUserInactive, domain.ReasonNoActivePackage, domain.ReasonPackageInactive, domain.ReasonPackageExpired:
+		return true
 	}
+	return false
 }
 
-func (e *QuotaEngine) SetManagerEnforcementMode(mode domain.EnforcementMode) {
-	switch mode {
-	case domain.EnforcementModeSoft, domain.EnforcementModeDefault, domain.EnforcementModeHard:
-		e.managerEnforcementMode = mode
-	default:
-		e.managerEnforcementMode = domain.EnforcementModeDefault
+// CachedRejection returns the cached negative decision for a user, or nil
+func (e *QuotaEngine) CachedRejection(userID string) *QuotaResult {
+	if e.negativeTTL <= 0 {
+		return nil
+	}
+	decision := e.cache.GetDecision(userID)
+	if decision == nil {
+		return nil
+	}
+	return &QuotaResult{
+		UserID:     userID,
+		Reason:     decision.Reason,
+		ReasonCode: decision.ReasonCode,
+		Cached:     true,
 	}
 }
 
-// getUserLock gets or creates a lock for a specific user
-func (e *QuotaEngine) getUserLock(userID string) *sync.RWMutex {
-	if v, ok := e.userLocks.Load(userID); ok {
-		return v.(*sync.RWMutex)
+// SetManagerEnforcementMode sets how manager limits are enforced. In soft
+// mode a user over their manager's limits is flagged but still served. An
+// unknown mode falls back to the default.
+func (e *QuotaEngine) SetManagerEnforcementMode(mode domain.EnforcementMode) {
+	if !mode.IsValid() {
+		mode = domain.EnforcementModeDefault
 	}
+	e.managerEnforcementMode.Store(mode)
+}
 
-	lock := &sync.RWMutex{}
-	actual, _ := e.userLocks.LoadOrStore(userID, lock)
-	return actual.(*sync.RWMutex)
+// ManagerEnforcementMode returns how manager limits are enforced
+func (e *QuotaEngine) ManagerEnforcementMode() domain.EnforcementMode {
+	return e.managerEnforcementMode.Load().(domain.EnforcementMode)
 }
 
-// CheckQuota checks if a user can use the specified amount of traffic
+// CheckQuota checks if a user can use the specified amount of traffic.
+// Rejections that only an admin write or a job can lift are cached for the
+// negative cache TTL.
 func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaResult, error) {
-	lock := e.getUserLock(userID)
-	lock.RLock()
-	defer lock.RUnlock()
+	if cached := e.CachedRejection(userID); cached != nil {
+		return cached, nil
+	}
+
+	result, err := e.checkQuota(userID, upload, download)
+	if err == nil && !result.CanUse && e.negativeTTL > 0 && isCacheableRejection(result.ReasonCode) {
+		e.cache.SetDecision(userID, result.Reason, result.ReasonCode, e.negativeTTL)
+	}
+	return result, err
+}
+
+func (e *QuotaEngine) checkQuota(userID string, upload, download int64) (*QuotaResult, error) {
+	e.userLocks.RLock(userID)
+	defer e.userLocks.RUnlock(userID)
 
 	result := &QuotaResult{
 		UserID: userID,
@@ -75,12 +127,14 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 		// Check user status
 		if cachedUser.Status != domain.UserStatusActive {
 			result.Reason = fmt.Sprintf("user status is %s", cachedUser.Status)
+			result.ReasonCode = domain.ReasonUserInactive
 			return result, nil
 		}
 
 		// Check if user has active package
 		if cachedUser.ActivePackageID == nil {
 			result.Reason = "no active package"
+			result.ReasonCode = domain.ReasonNoActivePackage
 			return result, nil
 		}
 
@@ -91,28 +145,33 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 		}
 		if pkg == nil {
 			result.Reason = "package not found"
+			result.ReasonCode = domain.ReasonNoActivePackage
 			return result, nil
 		}
 
+		pkg = e.withPendingUsage(pkg)
 		result.Pkg = pkg
 
 		// Check if package is active
 		if !pkg.IsActive() {
 			result.Reason = fmt.Sprintf("package status is %s", pkg.Status)
+			result.ReasonCode = domain.ReasonPackageInactive
 			return result, nil
 		}
 
 		// Check expiry
 		if pkg.IsExpired() {
 			result.Reason = "package expired"
+			result.ReasonCode = domain.ReasonPackageExpired
 			return result, nil
 		}
 
 		// Check total traffic
 		if pkg.TotalTraffic > 0 {
-			projectedTotal := cachedUser.CurrentTotal + upload + download
+			projectedTotal := pkg.CountMode.Counted(cachedUser.CurrentUpload, cachedUser.CurrentDownload) + pkg.Reserved + pkg.CountMode.Counted(upload, download)
 			if projectedTotal > pkg.TotalTraffic {
 				result.Reason = "total traffic quota exceeded"
+				result.ReasonCode = domain.ReasonQuotaExceeded
 				result.QuotaExceeded = true
 				return result, nil
 			}
@@ -123,6 +182,7 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 			projectedUpload := cachedUser.CurrentUpload + upload
 			if projectedUpload > pkg.UploadLimit {
 				result.Reason = "upload quota exceeded"
+				result.ReasonCode = domain.ReasonUploadQuotaExceeded
 				result.QuotaExceeded = true
 				return result, nil
 			}
@@ -133,21 +193,37 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 			projectedDownload := cachedUser.CurrentDownload + download
 			if projectedDownload > pkg.DownloadLimit {
 				result.Reason = "download quota exceeded"
+				result.ReasonCode = domain.ReasonDownloadQuotaExceeded
 				result.QuotaExceeded = true
 				return result, nil
 			}
 		}
 
+		user, err := e.userDB.GetUser(userID)
+		if err != nil {
+			return nil, err
+		}
+		if reason, err := e.checkGroupLimits(user, upload, download); err != nil {
+			return nil, err
+		} else if reason != "" {
+			result.Reason = reason
+			result.ReasonCode = domain.ReasonGroupLimit
+			result.QuotaExceeded = true
+			return result, nil
+		}
+
 		result.CanUse = true
+		result.RateLimit = pkg.ThrottleRateAt(pkg.CountMode.Counted(cachedUser.CurrentUpload, cachedUser.CurrentDownload) + pkg.Reserved + pkg.CountMode.Counted(upload, download))
 
-		mgrRes, err := e.checkManagerLimitsByUserID(userID, upload, download, 0, 0, 0)
+		mgrRes, err := e.checkManagerLimitsByUser(user, upload, download, 0, 0, 0)
 		if err != nil {
 			return nil, err
 		}
 		if mgrRes != nil && !mgrRes.Allowed {
 			result.QuotaExceeded = true
 			result.Reason = mgrRes.Reason
-			if e.managerEnforcementMode == domain.EnforcementModeSoft {
+			result.ReasonCode = domain.ReasonManagerLimit
+			if e.ManagerEnforcementMode() == domain.EnforcementModeSoft {
 				result.CanUse = true
 			} else {
 				result.CanUse = false
@@ -163,6 +239,7 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 	}
 	if user == nil {
 		result.Reason = "user not found"
+		result.ReasonCode = domain.ReasonUserNotFound
 		return result, nil
 	}
 
@@ -172,6 +249,7 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 	// Check user status
 	if !user.CanConnect() {
 		result.Reason = fmt.Sprintf("user cannot connect: status=%s", user.Status)
+		result.ReasonCode = domain.ReasonUserInactive
 		return result, nil
 	}
 
@@ -182,9 +260,11 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 	}
 	if pkg == nil {
 		result.Reason = "no active package"
+		result.ReasonCode = domain.ReasonNoActivePackage
 		return result, nil
 	}
 
+	pkg = e.withPendingUsage(pkg)
 	result.Pkg = pkg
 
 	// Update cache with max concurrent
@@ -193,17 +273,32 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 	// Check package status
 	if !pkg.CanUse() {
 		result.Reason = fmt.Sprintf("package cannot be used: status=%s, expired=%v", pkg.Status, pkg.IsExpired())
+		result.ReasonCode = domain.ReasonPackageInactive
+		if pkg.IsExpired() {
+			result.ReasonCode = domain.ReasonPackageExpired
+		}
 		return result, nil
 	}
 
 	// Check traffic limits
 	if !e.checkTrafficLimits(pkg, upload, download) {
 		result.Reason = "traffic quota exceeded"
+		result.ReasonCode = domain.ReasonQuotaExceeded
+		result.QuotaExceeded = true
+		return result, nil
+	}
+
+	if reason, err := e.checkGroupLimits(user, upload, download); err != nil {
+		return nil, err
+	} else if reason != "" {
+		result.Reason = reason
+		result.ReasonCode = domain.ReasonGroupLimit
 		result.QuotaExceeded = true
 		return result, nil
 	}
 
 	result.CanUse = true
+	result.RateLimit = pkg.ThrottleRateAt(pkg.CountedUsage() + pkg.Reserved + pkg.CountMode.Counted(upload, download))
 	mgrRes, err := e.checkManagerLimitsByUser(user, upload, download, 0, 0, 0)
 	if err != nil {
 		return nil, err
@@ -211,7 +306,8 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 	if mgrRes != nil && !mgrRes.Allowed {
 		result.QuotaExceeded = true
 		result.Reason = mgrRes.Reason
-		if e.managerEnforcementMode != domain.EnforcementModeSoft {
+		result.ReasonCode = domain.ReasonManagerLimit
+		if e.ManagerEnforcementMode() != domain.EnforcementModeSoft {
 			result.CanUse = false
 		}
 	}
@@ -220,45 +316,105 @@ func (e *QuotaEngine) CheckQuota(userID string, upload, download int64) (*QuotaR
 
 // RecordUsage records usage for a user and updates quotas
 func (e *QuotaEngine) RecordUsage(userID string, upload, download int64) error {
-	lock := e.getUserLock(userID)
-	lock.Lock()
-	defer lock.Unlock()
+	e.userLocks.Lock(userID)
+	defer e.userLocks.Unlock(userID)
+
+	return e.recordUsage(sqlite.UsageDelta{UserID: userID, Upload: upload, Download: download})
+}
+
+// RecordReportUsage records the traffic a report was charged against its
+// user and the measured traffic against its node and service. All counters
+// are updated in one transaction.
+func (e *QuotaEngine) RecordReportUsage(report *domain.UsageReport, traffic domain.UsageTraffic) error {
+	e.userLocks.Lock(report.UserID)
+	defer e.userLocks.Unlock(report.UserID)
+
+	return e.recordUsage(reportUsageDelta(report, traffic))
+}
+
+// reportUsageDelta returns the counter updates for a report charged traffic
+func reportUsageDelta(report *domain.UsageReport, traffic domain.UsageTraffic) sqlite.UsageDelta {
+	return sqlite.UsageDelta{
+		UserID:      report.UserID,
+		NodeID:      report.NodeID,
+		ServiceID:   report.ServiceID,
+		Upload:      traffic.BilledUpload,
+		Download:    traffic.BilledDownload,
+		RawUpload:   report.Upload,
+		RawDownload: report.Download,
+	}
+}
+
+// RecordBackfill records traffic a node buffered during an outage, capped at
+// what the package had left, along with the report's measured traffic for
+// its node and service. It returns the traffic actually charged.
+func (e *QuotaEngine) RecordBackfill(report *domain.UsageReport, traffic domain.UsageTraffic) (domain.UsageTraffic, error) {
+	userID := report.UserID
+	e.userLocks.Lock(userID)
+	defer e.userLocks.Unlock(userID)
 
-	// Get package
 	pkg, err := e.userDB.GetPackageByUserID(userID)
 	if err != nil {
-		return err
+		return domain.UsageTraffic{}, err
 	}
 	if pkg == nil {
-		return fmt.Errorf("no active package for user %s", userID)
+		return domain.UsageTraffic{}, fmt.Errorf("no active package for user %s", userID)
 	}
 
-	// Update package usage in database
-	if err := e.userDB.UpdatePackageUsage(pkg.ID, upload, download); err != nil {
-		return err
+	if pkg.TotalTraffic > 0 {
+		remaining := pkg.TotalTraffic - e.PackageUsage(userID, pkg) - pkg.Reserved
+		// Scale the cap so only the counted direction is held to what is left
+		if counted := pkg.CountMode.Counted(traffic.BilledUpload, traffic.BilledDownload); counted > remaining {
+			limit := int64(0)
+			if remaining > 0 {
+				limit = int64(float64(traffic.Total()) * float64(remaining) / float64(counted))
+			}
+			traffic = traffic.Capped(limit)
+		}
+	}
+	// Node and service counters keep the measured bytes even when nothing
+	// is charged
+	delta := reportUsageDelta(report, traffic)
+	if traffic.Total() == 0 {
+		delta.UserID = ""
+		return traffic, e.applyUsage(delta)
 	}
+	return traffic, e.recordUsage(delta)
+}
 
-	user, err := e.userDB.GetUser(userID)
+// recordUsage charges delta to the user's active package and writes it, or
+// keeps it for the next flush; the caller holds the user's lock
+func (e *QuotaEngine) recordUsage(delta sqlite.UsageDelta) error {
+	userID := delta.UserID
+
+	// Get package
+	pkg, err := e.userDB.GetPackageByUserID(userID)
 	if err != nil {
 		return err
 	}
-	if user != nil && user.ManagerID != nil {
-		if err := e.userDB.ApplyManagerUsageDelta(*user.ManagerID, upload, download, 0, 0, 0); err != nil {
-			return err
-		}
+	if pkg == nil {
+		return fmt.Errorf("no active package for user %s", userID)
 	}
+	delta.PackageID = pkg.ID
+	delta.LastConnectionAt = time.Now()
 
-	// Update cache
-	e.cache.UpdateUserUsage(userID, upload, download)
-
-	// Update last connection
-	if err := e.userDB.UpdateUserLastConnection(userID); err != nil {
-		e.logger.Warn("failed to update last connection", zap.String("user_id", userID), zap.Error(err))
+	if err := e.applyUsage(delta); err != nil {
+		return err
 	}
 
+	// Update cache
+	e.cache.UpdateUserUsage(userID, delta.Upload, delta.Download)
+
 	// Check if quota exceeded after update
-	pkg, _ = e.userDB.GetPackage(pkg.ID)
+	if !e.writeBehind {
+		pkg, _ = e.userDB.GetPackage(pkg.ID)
+	}
+	pkg = e.withPendingUsage(pkg)
 	if pkg != nil && !pkg.HasTrafficRemaining() {
+		// A finished package's usage is written right away
+		if err := e.flushPackageUsage(pkg.ID); err != nil {
+			e.logger.Error("failed to flush usage of finished package", zap.String("package_id", pkg.ID), zap.Error(err))
+		}
 		// Mark package as finished
 		if err := e.userDB.UpdatePackageStatus(pkg.ID, domain.PackageStatusFinish); err != nil {
 			e.logger.Error("failed to mark package as finished", zap.String("package_id", pkg.ID), zap.Error(err))
@@ -273,13 +429,66 @@ func (e *QuotaEngine) RecordUsage(userID string, upload, download int64) error {
 
 	e.logger.Debug("usage recorded",
 		zap.String("user_id", userID),
-		zap.Int64("upload", upload),
-		zap.Int64("download", download),
+		zap.Int64("upload", delta.Upload),
+		zap.Int64("download", delta.Download),
 	)
 
 	return nil
 }
 
+// UserPriority returns the QoS class of the user's active package, falling
+// back to the default priority when the user has no package
+func (e *QuotaEngine) UserPriority(userID string) domain.PackagePriority {
+	pkg, err := e.userDB.GetPackageByUserID(userID)
+	if err != nil || pkg == nil || !pkg.Priority.IsValid() {
+		return domain.DefaultPackagePriority
+	}
+	return pkg.Priority
+}
+
+// UserGroups returns the groups of a user, or nil if the user is unknown
+func (e *QuotaEngine) UserGroups(userID string) []string {
+	user, err := e.userDB.GetUser(userID)
+	if err != nil || user == nil {
+		return nil
+	}
+	return user.Groups
+}
+
+// NormalizeCounters turns a report sent in absolute counter mode into a delta
+// report, using the last counters stored for the user and service
+func (e *QuotaEngine) NormalizeCounters(report *domain.UsageReport) error {
+	if report.CounterMode != domain.CounterModeAbsolute {
+		return nil
+	}
+	if e.activeDB == nil {
+		return fmt.Errorf("absolute counters need the active database")
+	}
+
+	up, down, err := e.activeDB.CounterDelta(report.UserID, report.ServiceID, report.Upload, report.Download)
+	if err != nil {
+		return err
+	}
+	report.Upload, report.Download = up, down
+	report.CounterMode = domain.CounterModeDelta
+	return nil
+}
+
+// BufferReport keeps the raw usage report in the active database, along with
+// the traffic it was charged, so it can be aggregated and billed later
+func (e *QuotaEngine) BufferReport(report *domain.UsageReport, traffic domain.UsageTraffic) error {
+	if e.activeDB == nil {
+		return nil
+	}
+	if report.ID == "" {
+		report.ID = uuid.New().String()
+	}
+	if report.Timestamp.IsZero() {
+		report.Timestamp = time.Now()
+	}
+	return e.activeDB.BufferBilledUsage(report, traffic)
+}
+
 func (e *QuotaEngine) CheckManagerSessionLimits(userID string, sessionDelta, onlineUsersDelta, activeUsersDelta int64) (*sqlite.ManagerLimitCheckResult, error) {
 	return e.checkManagerLimitsByUserID(userID, 0, 0, sessionDelta, onlineUsersDelta, activeUsersDelta)
 }
@@ -298,6 +507,89 @@ func (e *QuotaEngine) RecordManagerSessionDelta(userID string, sessionDelta, onl
 	return e.userDB.ApplyManagerUsageDelta(*user.ManagerID, 0, 0, sessionDelta, onlineUsersDelta, activeUsersDelta)
 }
 
+// BillUsage applies the reporting node's traffic multiplier, returning the
+// measured and charged bytes. Unknown nodes are charged one to one.
+func (e *QuotaEngine) BillUsage(nodeID string, upload, download int64) (domain.UsageTraffic, error) {
+	if nodeID == "" {
+		return domain.UnbilledTraffic(upload, download), nil
+	}
+	node, err := e.userDB.GetNode(nodeID)
+	if err != nil {
+		return domain.UsageTraffic{}, err
+	}
+	if node == nil {
+		return domain.UnbilledTraffic(upload, download), nil
+	}
+	return node.Bill(upload, download), nil
+}
+
+// CheckAccess reports whether a user may consume traffic through the given
+// node and service, returning the rejection reason or an empty code. The
+// allow-lists on the user, on pkg (when not nil) and on the user's groups must
+// all permit them, and infrastructure owned by a manager only serves users of that manager or its
+// sub-managers.
+func (e *QuotaEngine) CheckAccess(userID, nodeID, serviceID string, pkg *domain.Package) (domain.ReasonCode, error) {
+	user, err := e.userDB.GetUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if user != nil && !user.Permits(nodeID, serviceID) {
+		return domain.ReasonNodeNotInPlan, nil
+	}
+	if pkg != nil && !pkg.Permits(nodeID, serviceID) {
+		return domain.ReasonNodeNotInPlan, nil
+	}
+	groups, err := e.userGroups(user)
+	if err != nil {
+		return "", err
+	}
+	for _, group := range groups {
+		if !group.Permits(nodeID) {
+			return domain.ReasonNodeNotInPlan, nil
+		}
+	}
+
+	var owners []*string
+	if nodeID != "" {
+		node, err := e.userDB.GetNode(nodeID)
+		if err != nil {
+			return "", err
+		}
+		if node != nil {
+			owners = append(owners, node.ManagerID)
+		}
+	}
+	if serviceID != "" {
+		service, err := e.userDB.GetService(serviceID)
+		if err != nil {
+			return "", err
+		}
+		if service != nil {
+			owners = append(owners, service.ManagerID)
+		}
+	}
+
+	var chain []string
+	chainLoaded := false
+	for _, owner := range owners {
+		if owner == nil || *owner == "" {
+			continue
+		}
+		if !chainLoaded {
+			if user != nil && user.ManagerID != nil && *user.ManagerID != "" {
+				if chain, err = e.userDB.GetManagerAncestors(*user.ManagerID); err != nil {
+					return "", err
+				}
+			}
+			chainLoaded = true
+		}
+		if !domain.ManagerScopeAllows(owner, chain) {
+			return domain.ReasonNodeNotAllowed, nil
+		}
+	}
+	return "", nil
+}
+
 func (e *QuotaEngine) checkManagerLimitsByUserID(userID string, upload, download, sessionDelta, onlineUsersDelta, activeUsersDelta int64) (*sqlite.ManagerLimitCheckResult, error) {
 	user, err := e.userDB.GetUser(userID)
 	if err != nil {
@@ -319,7 +611,7 @@ func (e *QuotaEngine) checkManagerLimitsByUser(user *domain.User, upload, downlo
 		e.logger.Warn("manager limit reached",
 			zap.String("manager_id", res.ManagerID),
 			zap.String("reason", res.Reason),
-			zap.String("mode", string(e.managerEnforcementMode)),
+			zap.String("mode", string(e.ManagerEnforcementMode())),
 		)
 	}
 	return res, nil
@@ -338,10 +630,11 @@ func (e *QuotaEngine) CheckAndEnforceQuota(userID string) (*QuotaResult, error)
 		if err != nil {
 			return nil, err
 		}
+		pkg = e.withPendingUsage(pkg)
 	}
 
 	if pkg != nil {
-		totalExceeded := pkg.TotalTraffic > 0 && pkg.CurrentTotal >= pkg.TotalTraffic
+		totalExceeded := pkg.TotalTraffic > 0 && pkg.CountedUsage() >= pkg.TotalTraffic
 		uploadExceeded := pkg.UploadLimit > 0 && pkg.CurrentUpload >= pkg.UploadLimit
 		downloadExceeded := pkg.DownloadLimit > 0 && pkg.CurrentDownload >= pkg.DownloadLimit
 
@@ -349,6 +642,7 @@ func (e *QuotaEngine) CheckAndEnforceQuota(userID string) (*QuotaResult, error)
 			result.CanUse = false
 			result.QuotaExceeded = true
 			result.Reason = "traffic quota exceeded"
+			result.ReasonCode = domain.ReasonQuotaExceeded
 		}
 	}
 
@@ -358,8 +652,10 @@ func (e *QuotaEngine) CheckAndEnforceQuota(userID string) (*QuotaResult, error)
 			e.logger.Error("failed to suspend user", zap.String("user_id", userID), zap.Error(err))
 		}
 
-		// Queue disconnect
-		e.cache.QueueDisconnect(userID, "", "quota_exceeded", "")
+		// Queue a disconnect for every session on the node serving it
+		for _, session := range e.cache.GetOrCreateSessionCache(userID).GetSessions() {
+			e.cache.QueueDisconnect(userID, session.SessionID, string(domain.ReasonQuotaExceeded), session.NodeID)
+		}
 	}
 
 	return result, nil
@@ -375,6 +671,7 @@ func (e *QuotaEngine) RefreshCache(userID string) error {
 		e.cache.DeleteUser(userID)
 		return nil
 	}
+	e.cache.ClearDecision(userID)
 
 	pkg, _ := e.userDB.GetPackageByUserID(userID)
 	maxConcurrent := 1
@@ -386,11 +683,45 @@ func (e *QuotaEngine) RefreshCache(userID string) error {
 	return nil
 }
 
-// checkTrafficLimits checks if the traffic limits are exceeded
+// InvalidateUser drops a user's cache entry and decision after an admin
+// write, so the next report reloads status and package from the database.
+// Nothing is cached ahead of that report, so out-of-band database writes
+// made in between are picked up as well.
+func (e *QuotaEngine) InvalidateUser(userID string) {
+	e.cache.ForgetUser(userID)
+}
+
+// Remaining returns the bytes left on pkg's TotalTraffic after usage not
+// flushed yet and open reservations, or -1 for an unlimited package
+func (e *QuotaEngine) Remaining(userID string, pkg *domain.Package) int64 {
+	if pkg.TotalTraffic <= 0 {
+		return -1
+	}
+	remaining := pkg.TotalTraffic - e.PackageUsage(userID, pkg) - pkg.Reserved
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// PackageUsage returns the bytes counted against a package's TotalTraffic,
+// including usage that has not been flushed yet
+func (e *QuotaEngine) PackageUsage(userID string, pkg *domain.Package) int64 {
+	used := e.withPendingUsage(pkg).CountedUsage()
+	if cached := e.cache.GetUser(userID); cached != nil {
+		if counted := pkg.CountMode.Counted(cached.CurrentUpload, cached.CurrentDownload); counted > used {
+			used = counted
+		}
+	}
+	return used
+}
+
+// checkTrafficLimits checks if the traffic limits are exceeded. Bytes held
+// by open reservations count against the total.
 func (e *QuotaEngine) checkTrafficLimits(pkg *domain.Package, upload, download int64) bool {
 	// Check total traffic
 	if pkg.TotalTraffic > 0 {
-		if pkg.CurrentTotal+upload+download > pkg.TotalTraffic {
+		if pkg.CountedUsage()+pkg.Reserved+pkg.CountMode.Counted(upload, download) > pkg.TotalTraffic {
 			return false
 		}
 	}
@@ -417,7 +748,11 @@ type QuotaResult struct {
 	UserID        string
 	CanUse        bool
 	Reason        string
+	ReasonCode    domain.ReasonCode
 	QuotaExceeded bool
 	Pkg           *domain.Package
 	Cached        bool
+	// RateLimit is the bytes/sec the package suggests once the traffic is
+	// counted, 0 when the user is not throttled
+	RateLimit int64
 }
@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+)
+
+// Projection is state rebuilt by folding the event history over it
+type Projection interface {
+	// Apply folds one event into the projection; events arrive in the order
+	// they were stored
+	Apply(event *domain.Event) error
+}
+
+// Replay feeds the stored events matching filter to every projection in the
+// order they were stored and returns how many events it replayed
+func Replay(events eventstore.EventStore, filter domain.EventReplayFilter, projections ...Projection) (int, error) {
+	replayed := 0
+	err := events.ReplayEvents(filter, func(event *domain.Event) error {
+		for _, p := range projections {
+			if err := p.Apply(event); err != nil {
+				return err
+			}
+		}
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// PackageUsageEventTypes are the events a PackageUsageProjection folds
+var PackageUsageEventTypes = []domain.EventType{
+	domain.EventUsageRecorded,
+	domain.EventBackfill,
+	domain.EventPackageReset,
+	domain.EventPackageActivated,
+	domain.EventDataPurged,
+}
+
+// PackageUsageProjection sums the traffic charged to each package by
+// USAGE_RECORDED and BACKFILL events, the same traffic that moves the
+// package counters. A package's sum starts over at its last PACKAGE_RESET
+// or PACKAGE_ACTIVATED. It also tracks whether the history still holds
+// every event since then: DATA_PURGED events and the start of the history
+// tell when it does not.
+type PackageUsageProjection struct {
+	userID       string
+	usage        map[string]*domain.TrafficUsage
+	since        map[string]time.Time // The reset or activation each sum starts at
+	historyStart time.Time            // Zero until the first event
+	purgedBefore time.Time            // History events before this were purged
+}
+
+// NewPackageUsageProjection creates an empty projection of userID's
+// packages, or of every package when userID is empty. historyStart is when
+// the history database began recording, nil when unknown; the oldest event
+// replayed counts when it is older. Purges concern every user, so replay
+// every user's events even when userID is set.
+func NewPackageUsageProjection(userID string, historyStart *time.Time) *PackageUsageProjection {
+	p := &PackageUsageProjection{
+		userID: userID,
+		usage:  make(map[string]*domain.TrafficUsage),
+		since:  make(map[string]time.Time),
+	}
+	if historyStart != nil {
+		p.historyStart = *historyStart
+	}
+	return p
+}
+
+// Apply adds the traffic an event charged to its package
+func (p *PackageUsageProjection) Apply(event *domain.Event) error {
+	if p.historyStart.IsZero() || event.Timestamp.Before(p.historyStart) {
+		p.historyStart = event.Timestamp
+	}
+
+	if event.Type == domain.EventDataPurged {
+		metadata, err := event.DecodeMetadata()
+		if err != nil {
+			return err
+		}
+		if purged, ok := metadata.(*domain.DataPurged); ok && purged.Database == "history" && purged.OlderThan.After(p.purgedBefore) {
+			p.purgedBefore = purged.OlderThan
+		}
+		return nil
+	}
+	if event.PackageID == nil || (p.userID != "" && (event.UserID == nil || *event.UserID != p.userID)) {
+		return nil
+	}
+
+	switch event.Type {
+	case domain.EventPackageReset, domain.EventPackageActivated:
+		p.usage[*event.PackageID] = &domain.TrafficUsage{}
+		p.since[*event.PackageID] = event.Timestamp
+		return nil
+	case domain.EventUsageRecorded, domain.EventBackfill:
+	default:
+		return nil
+	}
+	metadata, err := event.DecodeMetadata()
+	if err != nil || metadata == nil {
+		return err
+	}
+
+	var charged domain.UsageTraffic
+	switch m := metadata.(type) {
+	case *domain.UsageTraffic:
+		charged = *m
+	case *domain.Backfill:
+		charged = m.Charged
+	}
+	usage, ok := p.usage[*event.PackageID]
+	if !ok {
+		usage = &domain.TrafficUsage{}
+		p.usage[*event.PackageID] = usage
+	}
+	usage.Upload += charged.BilledUpload
+	usage.Download += charged.BilledDownload
+	usage.Total += charged.Total()
+	return nil
+}
+
+// PackageUsageChange compares a package's stored counters with the ones
+// rebuilt from its events
+type PackageUsageChange struct {
+	PackageID  string
+	UserID     string
+	Stored     domain.TrafficUsage
+	Replayed   domain.TrafficUsage
+	Incomplete string // Why the events cannot rebuild the counters, empty when they can
+}
+
+// Changed reports whether the rebuilt counters differ from the stored ones
+func (c PackageUsageChange) Changed() bool {
+	return c.Stored != c.Replayed
+}
+
+// incomplete returns why the replayed events may miss some of a package's
+// traffic, or "" when the history holds all of it
+func (p *PackageUsageProjection) incomplete(pkg *domain.Package) string {
+	start, reset := p.since[pkg.ID]
+	if !reset {
+		start = pkg.CreatedAt
+	}
+	if start.Before(p.purgedBefore) {
+		return fmt.Sprintf("events before %s were purged", p.purgedBefore.UTC().Format(time.RFC3339))
+	}
+	if !reset && start.Before(p.historyStart) {
+		return "the event history starts after the package was created"
+	}
+	return ""
+}
+
+// Rebuild compares the counters of every package seen in the replay with
+// userDB, ordered by package ID. When apply is set it overwrites those that
+// differ, unless the history may miss some of their events. Packages
+// deleted since are skipped.
+func (p *PackageUsageProjection) Rebuild(userDB *sqlite.UserDB, apply bool) ([]PackageUsageChange, error) {
+	ids := make([]string, 0, len(p.usage))
+	for id := range p.usage {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	changes := make([]PackageUsageChange, 0, len(ids))
+	for _, id := range ids {
+		pkg, err := userDB.GetPackage(id)
+		if err != nil {
+			return changes, err
+		}
+		if pkg == nil {
+			continue
+		}
+		stored := domain.PackageTrafficUsage(pkg)
+		replayed := *p.usage[id]
+		replayed.Limit = stored.Limit
+		change := PackageUsageChange{PackageID: id, UserID: pkg.UserID, Stored: stored, Replayed: replayed, Incomplete: p.incomplete(pkg)}
+		if apply && change.Changed() && change.Incomplete == "" {
+			if err := userDB.SetPackageUsage(id, replayed.Upload, replayed.Download); err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"errors"
+
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+var (
+	// ErrUnknownService is returned when a report names a service that does not exist
+	ErrUnknownService = errors.New("unknown service")
+	// ErrServiceNodeMismatch is returned when the reported service runs on another node
+	ErrServiceNodeMismatch = errors.New("service does not belong to the reported node")
+	// ErrServiceKeyMismatch is returned when a service key reports for another service
+	ErrServiceKeyMismatch = errors.New("authenticated key does not belong to the reported service")
+)
+
+// SetRequireReportSource makes reports without a service ID fail
+// validation. It is off by default so agents that predate service IDs and
+// report with a shared key keep working.
+func (e *QuotaEngine) SetRequireReportSource(require bool) {
+	e.requireReportSource = require
+}
+
+// ValidateReportSource checks that a usage report names an existing service
+// running on the reported node. When callerServiceID is set (the report was
+// authenticated with a service key) the report must be for that service; a
+// missing service or node ID is filled in from the caller's service. A
+// report that still has no service ID is let through unchecked unless
+// SetRequireReportSource is on.
+func (e *QuotaEngine) ValidateReportSource(report *domain.UsageReport, callerServiceID string) error {
+	if callerServiceID != "" {
+		if report.ServiceID == "" {
+			report.ServiceID = callerServiceID
+		}
+		if report.ServiceID != callerServiceID {
+			return ErrServiceKeyMismatch
+		}
+	}
+	if report.ServiceID == "" {
+		if e.requireReportSource {
+			return ErrUnknownService
+		}
+		return nil
+	}
+
+	service, err := e.userDB.GetService(report.ServiceID)
+	if err != nil {
+		return err
+	}
+	if service == nil {
+		return ErrUnknownService
+	}
+
+	if report.NodeID == "" {
+		report.NodeID = service.NodeID
+	}
+	if report.NodeID != service.NodeID {
+		return ErrServiceNodeMismatch
+	}
+	return nil
+}
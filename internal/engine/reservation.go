@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// ReservationResult is the outcome of a quota reservation request
+type ReservationResult struct {
+	Reservation *domain.QuotaReservation
+	Granted     bool
+	Reason      string
+	ReasonCode  domain.ReasonCode
+	// Remaining is the package's unreserved traffic after the request, or -1
+	// for unlimited packages
+	Remaining int64
+}
+
+// SetReservationTTL sets how long a reservation holds quota when the request
+// does not ask for a lifetime, and the longest lifetime it may ask for
+func (e *QuotaEngine) SetReservationTTL(ttl time.Duration) {
+	if ttl > 0 {
+		e.reservationTTL = ttl
+	}
+}
+
+// Reserve holds amount measured bytes for a session before they are used.
+// The amount is billed through the node's multiplier and counted against the
+// package's remaining traffic until the reservation is committed or expires.
+func (e *QuotaEngine) Reserve(userID, sessionID, nodeID string, amount int64, ttl time.Duration) (*ReservationResult, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("reservation amount must be positive")
+	}
+	if ttl <= 0 || ttl > e.reservationTTL {
+		ttl = e.reservationTTL
+	}
+
+	traffic, err := e.BillUsage(nodeID, 0, amount)
+	if err != nil {
+		return nil, err
+	}
+	billed := traffic.BilledDownload
+
+	if cached := e.CachedRejection(userID); cached != nil {
+		return &ReservationResult{Reason: cached.Reason, ReasonCode: cached.ReasonCode}, nil
+	}
+
+	e.userLocks.Lock(userID)
+	defer e.userLocks.Unlock(userID)
+
+	user, err := e.userDB.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return &ReservationResult{Reason: "user not found", ReasonCode: domain.ReasonUserNotFound}, nil
+	}
+	if !user.CanConnect() {
+		return &ReservationResult{Reason: fmt.Sprintf("user cannot connect: status=%s", user.Status), ReasonCode: domain.ReasonUserInactive}, nil
+	}
+
+	pkg, err := e.userDB.GetPackageByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if pkg == nil {
+		return &ReservationResult{Reason: "no active package", ReasonCode: domain.ReasonNoActivePackage}, nil
+	}
+	if !pkg.CanUse() {
+		result := &ReservationResult{Reason: fmt.Sprintf("package cannot be used: status=%s", pkg.Status), ReasonCode: domain.ReasonPackageInactive}
+		if pkg.IsExpired() {
+			result.ReasonCode = domain.ReasonPackageExpired
+		}
+		return result, nil
+	}
+
+	used := e.PackageUsage(userID, pkg)
+
+	remaining := int64(-1)
+	if pkg.TotalTraffic > 0 {
+		remaining = pkg.TotalTraffic - used - pkg.Reserved
+		if remaining < 0 {
+			remaining = 0
+		}
+		if billed > remaining {
+			return &ReservationResult{
+				Reason:     "not enough traffic left to reserve",
+				ReasonCode: domain.ReasonQuotaExceeded,
+				Remaining:  remaining,
+			}, nil
+		}
+		remaining -= billed
+	}
+
+	now := time.Now()
+	reservation := &domain.QuotaReservation{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		PackageID: pkg.ID,
+		SessionID: sessionID,
+		NodeID:    nodeID,
+		Amount:    billed,
+		Status:    domain.ReservationStatusActive,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+	if err := e.userDB.CreateReservation(reservation); err != nil {
+		return nil, err
+	}
+
+	e.logger.Debug("quota reserved",
+		zap.String("user_id", userID),
+		zap.String("reservation_id", reservation.ID),
+		zap.Int64("amount", billed),
+	)
+
+	return &ReservationResult{Reservation: reservation, Granted: true, Remaining: remaining}, nil
+}
+
+// ReleaseReservation returns an active reservation's bytes to the package
+// ahead of committing the actual usage. It returns nil when the reservation
+// does not exist and sqlite.ErrReservationNotActive when it was already
+// settled.
+func (e *QuotaEngine) ReleaseReservation(id string) (*domain.QuotaReservation, error) {
+	reservation, err := e.userDB.GetReservation(id)
+	if err != nil || reservation == nil {
+		return nil, err
+	}
+
+	e.userLocks.Lock(reservation.UserID)
+	defer e.userLocks.Unlock(reservation.UserID)
+
+	return e.userDB.SettleReservation(id, domain.ReservationStatusCommitted)
+}
+
+// ExpireReservations releases reservations that were never committed
+func (e *QuotaEngine) ExpireReservations() error {
+	count, err := e.userDB.ExpireReservations(time.Now())
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		e.logger.Info("expired quota reservations", zap.Int("count", count))
+	}
+	return nil
+}
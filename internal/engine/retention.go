@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"go.uber.org/zap"
+)
+
+// retentionPolicy is how long stored usage and history are kept
+type retentionPolicy struct {
+	historyDB *sqlite.HistoryDB
+	usage     time.Duration // Usage reports in the active database
+	history   time.Duration // Events, usage history and rollups
+}
+
+// SetRetention sets how long usage reports in the active database and
+// events, usage history and rollups in historyDB are kept. Zero keeps them
+// forever.
+func (e *Engine) SetRetention(historyDB *sqlite.HistoryDB, usage, history time.Duration) {
+	e.retention = retentionPolicy{historyDB: historyDB, usage: usage, history: history}
+}
+
+// PurgeUsageReports deletes the usage reports older than the usage retention
+// and returns how many were removed
+func (e *Engine) PurgeUsageReports(now time.Time) (int64, error) {
+	if e.retention.usage <= 0 || e.quota.activeDB == nil {
+		return 0, nil
+	}
+	olderThan := now.Add(-e.retention.usage)
+	n, err := e.quota.activeDB.DeleteOldReports(olderThan)
+	if err != nil {
+		return 0, err
+	}
+	e.recordPurge("active", olderThan, map[string]int64{"usage_reports": n})
+	return n, nil
+}
+
+// PurgeHistory deletes the events, usage history and rollup buckets older
+// than the history retention and returns how many rows were removed. Usage
+// history is rolled up first, so no row leaves before it is counted.
+func (e *Engine) PurgeHistory(now time.Time) (int64, error) {
+	if e.retention.history <= 0 || e.retention.historyDB == nil {
+		return 0, nil
+	}
+	if _, err := e.retention.historyDB.RollupUsage(); err != nil {
+		return 0, err
+	}
+	olderThan := now.Add(-e.retention.history)
+	purged, err := e.retention.historyDB.DeleteOldHistory(olderThan)
+	// Rows removed before a failure are gone all the same
+	e.recordPurge("history", olderThan, purged)
+
+	var total int64
+	for _, n := range purged {
+		total += n
+	}
+	return total, err
+}
+
+// recordPurge counts purged rows per table and emits DATA_PURGED when any
+// were removed
+func (e *Engine) recordPurge(database string, olderThan time.Time, purged map[string]int64) {
+	var total int64
+	for table, n := range purged {
+		total += n
+		if e.metrics != nil && n > 0 {
+			e.metrics.RetentionPurged.Add(table, uint64(n))
+		}
+	}
+	if total == 0 {
+		return
+	}
+
+	info := domain.DataPurged{Database: database, OlderThan: olderThan, Rows: purged}
+	e.emitEventWithMetadata(domain.EventDataPurged, nil, nil, nil, nil, []string{database}, info.Metadata())
+	e.logger.Info("purged data past retention",
+		zap.String("database", database),
+		zap.Time("older_than", olderThan),
+		zap.Int64("rows", total),
+	)
+}
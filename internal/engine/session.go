@@ -3,6 +3,9 @@ package engine
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"net"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/hiddify/hue-go/internal/domain"
@@ -12,18 +15,162 @@ import (
 
 // SessionManager handles concurrent session tracking and enforcement
 type SessionManager struct {
-	cache  *cache.MemoryCache
-	window time.Duration
+	cache  cache.Cache
+	window atomic.Int64 // Concurrent window; changes on config reload
 	logger *zap.Logger
+
+	// Roaming detection
+	roamingWindow time.Duration
+	roamingAction domain.RoamingAction
+
+	// Session identity (what counts as one concurrent session)
+	defaultIdentity domain.SessionIdentity
+	groupIdentities map[string]domain.SessionIdentity
+
+	// Stale session replacement on quick reconnects
+	replaceMode  domain.SessionReplace
+	replaceAfter time.Duration
+
+	// Throughput estimation: rates of sessions quiet for longer than
+	// speedStaleAfter count as idle
+	speedStaleAfter time.Duration
+	speedRule       domain.SpeedRule
 }
 
 // NewSessionManager creates a new SessionManager instance
-func NewSessionManager(cache *cache.MemoryCache, window time.Duration, logger *zap.Logger) *SessionManager {
-	return &SessionManager{
-		cache:  cache,
-		window: window,
-		logger: logger,
+func NewSessionManager(cache cache.Cache, window time.Duration, logger *zap.Logger) *SessionManager {
+	m := &SessionManager{
+		cache:         cache,
+		logger:        logger,
+		roamingWindow: 10 * time.Minute,
+		roamingAction: domain.RoamingActionFlag,
+
+		defaultIdentity: domain.SessionIdentitySession,
+		groupIdentities: map[string]domain.SessionIdentity{},
+
+		replaceMode:  domain.SessionReplaceOff,
+		replaceAfter: 30 * time.Second,
+
+		speedStaleAfter: 2 * time.Minute,
+	}
+	m.window.Store(int64(window))
+	return m
+}
+
+// Window returns how long a session counts as active after its last report
+func (m *SessionManager) Window() time.Duration {
+	return time.Duration(m.window.Load())
+}
+
+// SetWindow changes the concurrent window. Sessions already tracked are
+// counted with the new window from the next check on.
+func (m *SessionManager) SetWindow(window time.Duration) {
+	m.window.Store(int64(window))
+}
+
+// SetRoamingPolicy configures cross-node and impossible roaming detection.
+// A session is considered roaming when the same session ID shows up on another
+// node, or when the user is seen from two countries within the given window.
+func (m *SessionManager) SetRoamingPolicy(window time.Duration, action domain.RoamingAction) {
+	switch action {
+	case domain.RoamingActionOff, domain.RoamingActionFlag, domain.RoamingActionPenalize:
+		m.roamingAction = action
+	default:
+		m.roamingAction = domain.RoamingActionFlag
+	}
+	if window > 0 {
+		m.roamingWindow = window
+	}
+}
+
+// SetIdentityPolicy configures how reports are grouped into concurrent
+// sessions. Groups map a user group to a strategy; packages that set their
+// own strategy take precedence over both.
+func (m *SessionManager) SetIdentityPolicy(defaultIdentity domain.SessionIdentity, groups map[string]domain.SessionIdentity) {
+	if defaultIdentity.IsValid() {
+		m.defaultIdentity = defaultIdentity
+	}
+	m.groupIdentities = make(map[string]domain.SessionIdentity, len(groups))
+	for group, identity := range groups {
+		if identity.IsValid() {
+			m.groupIdentities[group] = identity
+		}
+	}
+}
+
+// SetReplacePolicy configures the default stale session replacement mode and
+// how long a session must be quiet before it can be replaced
+func (m *SessionManager) SetReplacePolicy(mode domain.SessionReplace, staleAfter time.Duration) {
+	if mode.IsValid() {
+		m.replaceMode = mode
+	}
+	if staleAfter > 0 {
+		m.replaceAfter = staleAfter
+	}
+}
+
+// SetSpeedPolicy configures when a session's throughput estimate goes stale
+// and the sustained speed rule; a zero rule threshold disables the rule
+func (m *SessionManager) SetSpeedPolicy(staleAfter time.Duration, rule domain.SpeedRule) {
+	if staleAfter > 0 {
+		m.speedStaleAfter = staleAfter
 	}
+	m.speedRule = rule
+}
+
+// ResolveReplace returns the package's replacement mode or the default
+func (m *SessionManager) ResolveReplace(pkg *domain.Package) domain.SessionReplace {
+	if pkg != nil && pkg.SessionReplace.IsValid() {
+		return pkg.SessionReplace
+	}
+	return m.replaceMode
+}
+
+// ResolveIdentity picks the session identity strategy for a user: the
+// package override first, then the first of the user's groups with a
+// configured strategy, then the default. groupsOf is only called when
+// group strategies are configured.
+func (m *SessionManager) ResolveIdentity(pkg *domain.Package, groupsOf func() []string) domain.SessionIdentity {
+	if pkg != nil && pkg.SessionIdentity.IsValid() {
+		return pkg.SessionIdentity
+	}
+	if len(m.groupIdentities) > 0 && groupsOf != nil {
+		for _, group := range groupsOf() {
+			if identity, ok := m.groupIdentities[group]; ok {
+				return identity
+			}
+		}
+	}
+	return m.defaultIdentity
+}
+
+// IdentityKey returns the key a session is counted under for the given
+// strategy. Strategies fall back to the session ID when the report lacks the
+// data they need (no client IP or no device ID).
+func (m *SessionManager) IdentityKey(identity domain.SessionIdentity, sessionID, clientIP, deviceID string) string {
+	switch identity {
+	case domain.SessionIdentitySubnet:
+		if subnet := subnetOf(clientIP); subnet != "" {
+			return "subnet:" + m.hashIP(subnet)
+		}
+	case domain.SessionIdentityDevice:
+		if deviceID != "" {
+			return "device:" + deviceID
+		}
+	}
+	return sessionID
+}
+
+// subnetOf returns the /24 (IPv4) or /64 (IPv6) network of an IP
+func subnetOf(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
 }
 
 // SessionResult represents the result of a session check
@@ -34,22 +181,55 @@ type SessionResult struct {
 	CurrentCount    int
 	MaxConcurrent   int
 	SessionLimitHit bool
+	ActiveIPs       int
+	MaxIPs          int
+	IPLimitHit      bool
 	Reason          string
 	IsNewSession    bool
+
+	// ReplacedSessionID is the stale session the new one took over, if any
+	ReplacedSessionID string
 }
 
-// CheckSession checks if a new session is allowed for the user
-func (m *SessionManager) CheckSession(userID, sessionID, clientIP string, maxConcurrent int) *SessionResult {
+// RoamingResult represents the result of a roaming check
+type RoamingResult struct {
+	UserID           string
+	SessionID        string
+	NodeID           string
+	PreviousNodeID   string
+	Country          string
+	PreviousCountry  string
+	CrossNode        bool
+	ImpossibleTravel bool
+	Penalize         bool
+	Reason           string
+}
+
+// Detected reports whether any kind of roaming was detected
+func (r *RoamingResult) Detected() bool {
+	return r.CrossNode || r.ImpossibleTravel
+}
+
+// CheckSession checks if a new session is allowed for the user. identity is
+// the key from IdentityKey; a new session sharing the identity of an active
+// one does not count against the concurrency limit. With SessionReplaceSameIP
+// a stale session from the same client IP is replaced instead of counted.
+// maxIPs separately caps the distinct client IPs across the user's sessions.
+func (m *SessionManager) CheckSession(userID, sessionID, identity, clientIP string, maxConcurrent, maxIPs int, replace domain.SessionReplace) *SessionResult {
 	result := &SessionResult{
 		UserID:        userID,
 		SessionID:     sessionID,
 		Allowed:       false,
 		MaxConcurrent: maxConcurrent,
+		MaxIPs:        maxIPs,
 		IsNewSession:  false,
 	}
 
+	window := m.Window()
+
 	// Get or create session cache for user
 	sessionCache := m.cache.GetOrCreateSessionCache(userID)
+	m.carryOverSalt(sessionCache, clientIP, identity)
 
 	// Check if session already exists using exported method
 	if sessionCache.HasSession(sessionID) {
@@ -57,14 +237,50 @@ func (m *SessionManager) CheckSession(userID, sessionID, clientIP string, maxCon
 		sessionCache.UpdateSessionLastSeen(sessionID)
 		result.Allowed = true
 		result.IsNewSession = false
-		result.CurrentCount = sessionCache.GetActiveSessionCount(m.window)
+		result.CurrentCount = sessionCache.GetActiveSessionCount(window)
 		return result
 	}
 
+	// A quick reconnect from the same IP takes over the quiet session
+	if replace == domain.SessionReplaceSameIP && clientIP != "" {
+		if replaced := sessionCache.ReplaceStaleSession(m.hashIP(clientIP), sessionID, m.replaceAfter); replaced != "" {
+			result.ReplacedSessionID = replaced
+			m.logger.Debug("stale session replaced",
+				zap.String("user_id", userID),
+				zap.String("session_id", sessionID),
+				zap.String("replaced_session_id", replaced),
+			)
+		}
+	}
+
 	// Count active sessions within the window
-	activeCount := sessionCache.GetActiveSessionCount(m.window)
+	activeCount := sessionCache.GetActiveSessionCount(window)
 	result.CurrentCount = activeCount
 
+	// A new IP may not push the user past the distinct IP limit, even when
+	// the session shares an identity with an active one
+	if maxIPs > 0 && clientIP != "" {
+		ipHash := m.hashIP(clientIP)
+		result.ActiveIPs = sessionCache.GetActiveIPCount(window)
+		if !sessionCache.HasActiveIP(ipHash, window) && result.ActiveIPs >= maxIPs {
+			result.IPLimitHit = true
+			result.Reason = "max distinct IPs exceeded"
+			m.logger.Warn("ip limit exceeded",
+				zap.String("user_id", userID),
+				zap.Int("current", result.ActiveIPs),
+				zap.Int("max", maxIPs),
+			)
+			return result
+		}
+	}
+
+	// Same subnet/device as an already counted session
+	if identity != "" && identity != sessionID && sessionCache.HasActiveIdentity(identity, window) {
+		result.Allowed = true
+		result.IsNewSession = true
+		return result
+	}
+
 	// Check if we can add a new session
 	if maxConcurrent > 0 && activeCount >= maxConcurrent {
 		result.Allowed = false
@@ -83,8 +299,67 @@ func (m *SessionManager) CheckSession(userID, sessionID, clientIP string, maxCon
 	return result
 }
 
-// AddSession adds a new session for a user
-func (m *SessionManager) AddSession(userID, sessionID, clientIP string, geoData *domain.GeoData) {
+// CheckRoaming checks whether a report for the session looks like roaming:
+// the same session ID reported from a different node, or the user showing up
+// in two different countries within the roaming window. It works on copies of
+// the user's sessions, so concurrent reports can update them meanwhile.
+func (m *SessionManager) CheckRoaming(userID, sessionID, nodeID string, geoData *domain.GeoData) *RoamingResult {
+	result := &RoamingResult{
+		UserID:    userID,
+		SessionID: sessionID,
+		NodeID:    nodeID,
+	}
+	if m.roamingAction == domain.RoamingActionOff {
+		return result
+	}
+	if geoData != nil {
+		result.Country = geoData.Country
+	}
+
+	now := time.Now()
+	sessionCache := m.cache.GetOrCreateSessionCache(userID)
+
+	if prev, ok := sessionCache.GetSession(sessionID); ok {
+		if prev.NodeID != "" && nodeID != "" && prev.NodeID != nodeID && now.Sub(prev.LastSeenAt) <= m.roamingWindow {
+			result.CrossNode = true
+			result.PreviousNodeID = prev.NodeID
+			result.Reason = string(domain.ReasonCrossNodeRoaming)
+		}
+	}
+
+	if result.Country != "" {
+		for _, s := range sessionCache.GetSessions() {
+			if s.Country == "" || s.Country == result.Country {
+				continue
+			}
+			if now.Sub(s.LastSeenAt) > m.roamingWindow {
+				continue
+			}
+			result.ImpossibleTravel = true
+			result.PreviousCountry = s.Country
+			result.Reason = string(domain.ReasonImpossibleRoaming)
+			break
+		}
+	}
+
+	if result.Detected() {
+		result.Penalize = m.roamingAction == domain.RoamingActionPenalize
+		m.logger.Warn("session roaming detected",
+			zap.String("user_id", userID),
+			zap.String("session_id", sessionID),
+			zap.String("node_id", nodeID),
+			zap.String("previous_node_id", result.PreviousNodeID),
+			zap.String("country", result.Country),
+			zap.String("previous_country", result.PreviousCountry),
+		)
+	}
+
+	return result
+}
+
+// AddSession adds a new session for a user, bound to the reporting node and
+// counted under the given identity
+func (m *SessionManager) AddSession(userID, sessionID, identity, nodeID, clientIP string, geoData *domain.GeoData) {
 	ipHash := m.hashIP(clientIP)
 
 	sessionCache := m.cache.GetOrCreateSessionCache(userID)
@@ -92,17 +367,20 @@ func (m *SessionManager) AddSession(userID, sessionID, clientIP string, geoData
 	country := ""
 	city := ""
 	isp := ""
+	var asn uint
 	if geoData != nil {
 		country = geoData.Country
 		city = geoData.City
 		isp = geoData.ISP
+		asn = geoData.ASN
 	}
 
-	sessionCache.AddSession(sessionID, ipHash, country, city, isp)
+	sessionCache.AddSession(sessionID, identity, nodeID, ipHash, country, city, isp, asn)
 
 	m.logger.Debug("session added",
 		zap.String("user_id", userID),
 		zap.String("session_id", sessionID),
+		zap.String("node_id", nodeID),
 		zap.String("country", country),
 	)
 }
@@ -121,13 +399,215 @@ func (m *SessionManager) RemoveSession(userID, sessionID string) {
 // GetActiveSessionCount returns the number of active sessions for a user
 func (m *SessionManager) GetActiveSessionCount(userID string) int {
 	sessionCache := m.cache.GetOrCreateSessionCache(userID)
-	return sessionCache.GetActiveSessionCount(m.window)
+	return sessionCache.GetActiveSessionCount(m.Window())
+}
+
+// HasRoom returns the user's active sessions, whether sessionID may start
+// without passing maxConcurrent and whether it is already active, which
+// always leaves room. Unlike CheckSession nothing is recorded,
+// and sessions the new one could replace or share an identity with are not
+// taken into account.
+func (m *SessionManager) HasRoom(userID, sessionID string, maxConcurrent int) (active int, room, existing bool) {
+	sessionCache := m.cache.GetOrCreateSessionCache(userID)
+	active = sessionCache.GetActiveSessionCount(m.Window())
+	if sessionID != "" && sessionCache.HasSession(sessionID) {
+		return active, true, true
+	}
+	return active, maxConcurrent <= 0 || active < maxConcurrent, false
+}
+
+// SpeedResult is a user's estimated throughput after a report
+type SpeedResult struct {
+	UploadBps   int64
+	DownloadBps int64
+
+	// Exceeded is set once when the speed rule trips, with the start of the
+	// stretch above the threshold
+	Exceeded     bool
+	Since        time.Time
+	ThresholdBps int64
+}
+
+// RecordThroughput feeds a report's raw byte deltas into the session's rate
+// estimate and evaluates the speed rule against the user's combined rate
+func (m *SessionManager) RecordThroughput(userID, sessionID string, upload, download int64) *SpeedResult {
+	now := time.Now()
+	sessionCache := m.cache.GetOrCreateSessionCache(userID)
+	sessionCache.RecordTraffic(sessionID, upload, download, now)
+
+	up, down := sessionCache.Throughput(m.speedStaleAfter)
+	result := &SpeedResult{UploadBps: int64(up), DownloadBps: int64(down)}
+	if m.speedRule.Enabled() {
+		result.ThresholdBps = m.speedRule.ThresholdBps
+		result.Exceeded, result.Since = sessionCache.SustainedAbove(up+down, float64(m.speedRule.ThresholdBps), m.speedRule.Sustain, now)
+		if result.Exceeded {
+			m.logger.Warn("sustained speed exceeded",
+				zap.String("user_id", userID),
+				zap.Int64("bps", result.UploadBps+result.DownloadBps),
+				zap.Int64("threshold_bps", m.speedRule.ThresholdBps),
+				zap.Time("since", result.Since),
+			)
+		}
+	}
+	return result
+}
+
+// UserThroughput returns a user's estimated current throughput in bits per
+// second
+func (m *SessionManager) UserThroughput(userID string) (uploadBps, downloadBps int64) {
+	up, down := m.cache.GetOrCreateSessionCache(userID).Throughput(m.speedStaleAfter)
+	return int64(up), int64(down)
+}
+
+// TotalThroughput returns the estimated current throughput across all users
+func (m *SessionManager) TotalThroughput() (uploadBps, downloadBps int64) {
+	var up, down float64
+	m.cache.RangeAllSessions(func(_ string, sessionCache *cache.SessionCache) bool {
+		u, d := sessionCache.Throughput(m.speedStaleAfter)
+		up += u
+		down += d
+		return true
+	})
+	return int64(up), int64(down)
+}
+
+// TotalActiveSessions returns the number of active sessions across all users
+func (m *SessionManager) TotalActiveSessions() int {
+	total := 0
+	m.cache.RangeAllSessions(func(_ string, sessionCache *cache.SessionCache) bool {
+		total += sessionCache.GetActiveSessionCount(m.Window())
+		return true
+	})
+	return total
+}
+
+// OnlineUsers returns the number of users with at least one active session
+func (m *SessionManager) OnlineUsers() int {
+	online := 0
+	m.cache.RangeAllSessions(func(_ string, sessionCache *cache.SessionCache) bool {
+		if sessionCache.GetActiveSessionCount(m.Window()) > 0 {
+			online++
+		}
+		return true
+	})
+	return online
 }
 
 // GetUserSessions returns all sessions for a user
-func (m *SessionManager) GetUserSessions(userID string) []*cache.SessionEntry {
+func (m *SessionManager) GetUserSessions(userID string) []*domain.SessionInfo {
 	sessionCache := m.cache.GetOrCreateSessionCache(userID)
-	return sessionCache.GetSessions()
+	sessions := sessionCache.GetSessions()
+
+	infos := make([]*domain.SessionInfo, 0, len(sessions))
+	now := time.Now()
+	for _, s := range sessions {
+		info := &domain.SessionInfo{
+			UserID:     userID,
+			SessionID:  s.SessionID,
+			NodeID:     s.NodeID,
+			IPHash:     s.IPHash,
+			Country:    s.Country,
+			City:       s.City,
+			ISP:        s.ISP,
+			ASN:        s.ASN,
+			StartedAt:  s.StartedAt,
+			LastSeenAt: s.LastSeenAt,
+		}
+		if !s.RateAt.IsZero() && now.Sub(s.RateAt) <= m.speedStaleAfter {
+			info.UploadBps = int64(s.UploadBps)
+			info.DownloadBps = int64(s.DownloadBps)
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ShedNodeSessions queues disconnects for up to count sessions on a node,
+// picking sessions of the lowest priority packages first and, within the same
+// priority, the most recently started ones. It returns the number queued.
+func (m *SessionManager) ShedNodeSessions(nodeID string, count int, priorityOf func(userID string) domain.PackagePriority, reason string) int {
+	if count <= 0 {
+		return 0
+	}
+
+	type candidate struct {
+		userID    string
+		sessionID string
+		rank      int
+		startedAt time.Time
+	}
+
+	ranks := make(map[string]int)
+	candidates := []candidate{}
+	m.cache.RangeAllSessions(func(userID string, sessionCache *cache.SessionCache) bool {
+		for _, s := range sessionCache.GetSessions() {
+			if s.NodeID != nodeID {
+				continue
+			}
+			rank, ok := ranks[userID]
+			if !ok {
+				rank = priorityOf(userID).Rank()
+				ranks[userID] = rank
+			}
+			candidates = append(candidates, candidate{
+				userID:    userID,
+				sessionID: s.SessionID,
+				rank:      rank,
+				startedAt: s.StartedAt,
+			})
+		}
+		return true
+	})
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].startedAt.After(candidates[j].startedAt)
+	})
+
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	for _, c := range candidates {
+		m.cache.QueueDisconnect(c.userID, c.sessionID, reason, nodeID)
+	}
+
+	if len(candidates) > 0 {
+		m.logger.Info("shed sessions on congested node",
+			zap.String("node_id", nodeID),
+			zap.Int("count", len(candidates)),
+		)
+	}
+
+	return len(candidates)
+}
+
+// IsNodeDraining reports whether new sessions should be steered away from a node
+func (m *SessionManager) IsNodeDraining(nodeID string) bool {
+	return m.cache.IsNodeDraining(nodeID)
+}
+
+// NodeUsers counts the distinct users other than userID with a session on
+// the node seen within the session window, and reports whether userID has
+// one there too
+func (m *SessionManager) NodeUsers(nodeID, userID string) (others int, present bool) {
+	now := time.Now()
+	m.cache.RangeAllSessions(func(id string, sessionCache *cache.SessionCache) bool {
+		for _, s := range sessionCache.GetSessions() {
+			if s.NodeID != nodeID || now.Sub(s.LastSeenAt) > m.Window() {
+				continue
+			}
+			if id == userID {
+				present = true
+			} else {
+				others++
+			}
+			break
+		}
+		return true
+	})
+	return others, present
 }
 
 // CleanupStaleSessions removes sessions that haven't been seen within the window
@@ -135,7 +615,7 @@ func (m *SessionManager) CleanupStaleSessions() int {
 	count := 0
 
 	m.cache.RangeAllSessions(func(userID string, sessionCache *cache.SessionCache) bool {
-		sessionCache.RemoveStaleSessions(m.window, &count)
+		sessionCache.RemoveStaleSessions(m.Window(), &count)
 		return true
 	})
 
@@ -148,10 +628,32 @@ func (m *SessionManager) CleanupStaleSessions() int {
 
 // hashIP hashes an IP address for privacy (zero raw IP retention)
 func (m *SessionManager) hashIP(ip string) string {
+	return hashIPAt(ip, time.Now())
+}
+
+// hashIPAt hashes an IP address under the salt of the day at t
+func hashIPAt(ip string, t time.Time) string {
 	if ip == "" {
 		return ""
 	}
 
-	hash := sha256.Sum256([]byte(ip + time.Now().Format("2006-01-02"))) // Daily rotating salt
-	return hex.EncodeToString(hash[:16])                                // Use first 16 bytes for shorter hash
+	hash := sha256.Sum256([]byte(ip + t.Format("2006-01-02"))) // Daily rotating salt
+	return hex.EncodeToString(hash[:16])                       // Use first 16 bytes for shorter hash
+}
+
+// carryOverSalt moves the client's IP hash and subnet identity that the
+// user's sessions took under yesterday's salt to today's, so the distinct IP
+// limit and subnet identity keep matching across midnight
+func (m *SessionManager) carryOverSalt(sessionCache *cache.SessionCache, clientIP, identity string) {
+	if clientIP == "" {
+		return
+	}
+	now := time.Now()
+	yesterday := now.AddDate(0, 0, -1)
+
+	var previousIdentity string
+	if subnet := subnetOf(clientIP); subnet != "" && identity == "subnet:"+hashIPAt(subnet, now) {
+		previousIdentity = "subnet:" + hashIPAt(subnet, yesterday)
+	}
+	sessionCache.Rekey(hashIPAt(clientIP, yesterday), hashIPAt(clientIP, now), previousIdentity, identity)
 }
@@ -0,0 +1,19 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+// SetTagRules sets the rules that add tags to usage reports before they are
+// stored. Hour rules are evaluated in loc; nil means the server's local time.
+func (e *Engine) SetTagRules(rules []domain.TagRule, loc *time.Location) {
+	e.tagRules = rules
+	e.tagRuleLocation = loc
+}
+
+// ApplyTagRules adds the tags of matching rules to the report
+func (e *Engine) ApplyTagRules(report *domain.UsageReport, geoData *domain.GeoData) {
+	domain.ApplyTagRules(e.tagRules, report, geoData, e.tagRuleLocation)
+}
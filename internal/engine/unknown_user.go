@@ -0,0 +1,251 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"go.uber.org/zap"
+)
+
+// Provisioner asks an outside system, usually the panel, to create a user
+// that showed up in a usage report before HUE knew about it
+type Provisioner interface {
+	Provision(ctx context.Context, report *domain.UsageReport) error
+}
+
+// WebhookProvisioner posts the unknown user to an HTTP endpoint. The endpoint
+// should create the user through the admin API before it answers.
+type WebhookProvisioner struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookProvisioner creates a provisioner that calls url with the given
+// request timeout
+func NewWebhookProvisioner(url string, timeout time.Duration) *WebhookProvisioner {
+	return &WebhookProvisioner{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Provision implements Provisioner
+func (p *WebhookProvisioner) Provision(ctx context.Context, report *domain.UsageReport) error {
+	body, err := json.Marshal(map[string]string{
+		"user_id":    report.UserID,
+		"node_id":    report.NodeID,
+		"service_id": report.ServiceID,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("provisioning hook returned %s", resp.Status)
+	}
+	return nil
+}
+
+type unknownUserPolicy struct {
+	action      domain.UnknownUserAction
+	provisioner Provisioner
+	maxPending  int
+	retryAfter  time.Duration
+	// When provisioning last failed per user, so a user the hook cannot
+	// create does not cost a hook call on every report
+	failures *sync.Map // map[string]time.Time // key: userID
+}
+
+// SetUnknownUserPolicy configures what happens to reports for unknown users.
+// Reject keeps the plain user_not_found rejection, queue holds the report in
+// the active database until ReplayPendingReports finds the user, and
+// provision calls the provisioner once and retries the lookup.
+func (e *Engine) SetUnknownUserPolicy(action domain.UnknownUserAction, provisioner Provisioner) {
+	if !action.IsValid() {
+		action = domain.UnknownUserActionReject
+	}
+	e.unknownUsers.action = action
+	e.unknownUsers.provisioner = provisioner
+	e.unknownUsers.failures = &sync.Map{}
+}
+
+// SetUnknownUserLimits caps how many reports queue holds, 0 for no cap, and
+// how long provision waits before calling the hook again for a user it
+// failed to provision
+func (e *Engine) SetUnknownUserLimits(maxPending int, retryAfter time.Duration) {
+	e.unknownUsers.maxPending = maxPending
+	e.unknownUsers.retryAfter = retryAfter
+}
+
+// CheckUnknownUser applies the unknown user policy to a report. It returns
+// true when processing may continue; otherwise result says why it stopped.
+// ctx bounds the provisioning call.
+func (e *Engine) CheckUnknownUser(ctx context.Context, report *domain.UsageReport, result *domain.UsageReportResult) bool {
+	action := e.unknownUsers.action
+	if action == "" || action == domain.UnknownUserActionReject {
+		return true
+	}
+
+	known, err := e.userKnown(report.UserID)
+	if err != nil {
+		result.Reason = "user lookup failed"
+		result.ReasonCode = domain.ReasonInternalError
+		e.logger.Error("user lookup failed", zap.String("user_id", report.UserID), zap.Error(err))
+		return false
+	}
+	if known {
+		return true
+	}
+
+	result.Reason = "user not found"
+	result.ReasonCode = domain.ReasonUserNotFound
+
+	switch action {
+	case domain.UnknownUserActionQueue:
+		if e.quota.activeDB == nil {
+			e.logger.Error("cannot queue report without the active database", zap.String("user_id", report.UserID))
+			return false
+		}
+		if report.ID == "" {
+			report.ID = uuid.New().String()
+		}
+		if report.Timestamp.IsZero() {
+			report.Timestamp = time.Now()
+		}
+		if err := e.quota.activeDB.QueuePendingReport(report, e.unknownUsers.maxPending); err != nil {
+			if errors.Is(err, sqlite.ErrPendingQueueFull) {
+				e.logger.Warn("pending report queue full, dropping report", zap.String("user_id", report.UserID))
+				return false
+			}
+			e.logger.Error("failed to queue report for unknown user", zap.String("user_id", report.UserID), zap.Error(err))
+			return false
+		}
+		result.Queued = true
+		result.Reason = "user not found, report queued"
+		return false
+
+	case domain.UnknownUserActionProvision:
+		if e.unknownUsers.provisioner == nil {
+			return false
+		}
+		if e.provisionFailedRecently(report.UserID) {
+			return false
+		}
+		if err := e.unknownUsers.provisioner.Provision(ctx, report); err != nil {
+			e.logger.Warn("user provisioning failed", zap.String("user_id", report.UserID), zap.Error(err))
+			e.unknownUsers.failures.Store(report.UserID, time.Now())
+			return false
+		}
+		known, err := e.userKnown(report.UserID)
+		if err != nil || !known {
+			e.logger.Warn("provisioned user still unknown", zap.String("user_id", report.UserID), zap.Error(err))
+			e.unknownUsers.failures.Store(report.UserID, time.Now())
+			return false
+		}
+		e.unknownUsers.failures.Delete(report.UserID)
+		e.logger.Info("provisioned unknown user", zap.String("user_id", report.UserID))
+		return true
+	}
+
+	return false
+}
+
+// provisionFailedRecently reports whether provisioning the user failed within
+// the retry window
+func (e *Engine) provisionFailedRecently(userID string) bool {
+	v, ok := e.unknownUsers.failures.Load(userID)
+	if !ok {
+		return false
+	}
+	if time.Since(v.(time.Time)) < e.unknownUsers.retryAfter {
+		return true
+	}
+	e.unknownUsers.failures.Delete(userID)
+	return false
+}
+
+// pruneProvisionFailures forgets failures older than the retry window
+func (e *Engine) pruneProvisionFailures() {
+	if e.unknownUsers.failures == nil {
+		return
+	}
+	e.unknownUsers.failures.Range(func(key, value any) bool {
+		if time.Since(value.(time.Time)) >= e.unknownUsers.retryAfter {
+			e.unknownUsers.failures.Delete(key)
+		}
+		return true
+	})
+}
+
+// ReplayPendingReports processes held reports whose user now exists and
+// drops those held longer than maxAge. It returns how many reports were
+// replayed and dropped.
+func (e *Engine) ReplayPendingReports(maxAge time.Duration) (replayed, dropped int, err error) {
+	if e.quota.activeDB == nil {
+		return 0, 0, nil
+	}
+
+	pending, err := e.quota.activeDB.ListPendingReports(1000)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, p := range pending {
+		known, err := e.userKnown(p.Report.UserID)
+		if err != nil {
+			return replayed, dropped, err
+		}
+
+		switch {
+		case known:
+			// The queued result was kept under the report's ID
+			e.forgetReport(p.Report.ID)
+			e.ProcessUsageReport(p.Report)
+			replayed++
+		case maxAge > 0 && time.Since(p.QueuedAt) > maxAge:
+			dropped++
+		default:
+			continue
+		}
+		if err := e.quota.activeDB.DeletePendingReport(p.Report.ID); err != nil {
+			return replayed, dropped, err
+		}
+	}
+
+	if replayed > 0 || dropped > 0 {
+		e.logger.Info("processed reports held for unknown users",
+			zap.Int("replayed", replayed),
+			zap.Int("dropped", dropped),
+		)
+	}
+	return replayed, dropped, nil
+}
+
+func (e *Engine) userKnown(userID string) (bool, error) {
+	if e.cache.GetUser(userID) != nil {
+		return true, nil
+	}
+	user, err := e.userDB.GetUser(userID)
+	return user != nil, err
+}
@@ -0,0 +1,43 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"go.uber.org/zap"
+)
+
+// SetUsageHistory records the traffic of every accepted report in the usage
+// history of historyDB. Records are buffered and written when historyDB is
+// flushed, or once enough of them pile up.
+func (e *Engine) SetUsageHistory(historyDB *sqlite.HistoryDB) {
+	e.usageHistory = historyDB
+}
+
+// recordUsageHistory buffers the traffic a report was charged, with where it
+// came from and its tags, for the usage history. A failure is logged; the
+// report was already billed.
+func (e *Engine) recordUsageHistory(report *domain.UsageReport, packageID string, traffic domain.UsageTraffic, geoData *domain.GeoData) {
+	if e.usageHistory == nil {
+		return
+	}
+	timestamp := report.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	err := e.usageHistory.BufferUsageHistory(sqlite.UsageHistoryRecord{
+		UserID:    report.UserID,
+		PackageID: packageID,
+		NodeID:    report.NodeID,
+		ServiceID: report.ServiceID,
+		SessionID: report.SessionID,
+		Traffic:   traffic,
+		Geo:       geoData,
+		Tags:      append([]string(nil), report.Tags...),
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		e.logger.Warn("failed to buffer usage history", zap.String("user_id", report.UserID), zap.Error(err))
+	}
+}
@@ -0,0 +1,22 @@
+package engine
+
+import "github.com/hiddify/hue-go/internal/domain"
+
+// WarmCache loads the active users of up to limit active packages into the
+// cache, with their package's usage counters, so their first report skips
+// the database. Users who connected most recently are loaded first; limit 0
+// loads all of them. It returns how many users were loaded.
+func (e *QuotaEngine) WarmCache(limit int) (int, error) {
+	packages, err := e.userDB.ListActivePackages(limit)
+	if err != nil {
+		return 0, err
+	}
+	// Oldest first, so a bounded cache keeps the most recent users
+	for i := len(packages) - 1; i >= 0; i-- {
+		pkg := packages[i]
+		packageID := pkg.ID
+		e.cache.SetUser(pkg.UserID, domain.UserStatusActive, &packageID, pkg.MaxConcurrent)
+		e.cache.UpdateUserUsage(pkg.UserID, pkg.CurrentUpload, pkg.CurrentDownload)
+	}
+	return len(packages), nil
+}
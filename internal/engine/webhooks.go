@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"github.com/hiddify/hue-go/pkg/panelhook"
+	"go.uber.org/zap"
+)
+
+// EventWebhookHeader carries the event type of a webhook delivery
+const EventWebhookHeader = "Hue-Event-Type"
+
+const (
+	// webhookQueueSize bounds the deliveries waiting for a worker
+	webhookQueueSize = 1024
+	// webhookWorkers is the number of deliveries posted in parallel
+	webhookWorkers = 4
+	// webhookMaxBackoff caps the wait between attempts
+	webhookMaxBackoff = 10 * time.Minute
+	// webhookServiceTTL is how long a service's callback URL is cached
+	webhookServiceTTL = time.Minute
+)
+
+// EventWebhookOptions configures the event webhook dispatcher
+type EventWebhookOptions struct {
+	// URLs receive every dispatched event
+	URLs []string
+	// Secret signs each body like panel callbacks, see pkg/panelhook
+	Secret string
+	// Types limits the dispatched events; empty dispatches all
+	Types []domain.EventType
+	// MaxAttempts is how often a delivery is tried before it is dead-lettered
+	MaxAttempts int
+	// Backoff is the wait before the first retry; it doubles per attempt
+	Backoff time.Duration
+	// Timeout bounds each request
+	Timeout time.Duration
+}
+
+// EventWebhooks posts events as JSON to the configured URLs and to the
+// callback URL of the service an event belongs to. Failed deliveries are
+// retried with exponential backoff and recorded in the history database's
+// dead-letter table once every attempt failed. Retries are held in memory.
+type EventWebhooks struct {
+	opts      EventWebhookOptions
+	types     map[domain.EventType]bool
+	userDB    *sqlite.UserDB
+	historyDB *sqlite.HistoryDB
+	client    *http.Client
+	logger    *zap.Logger
+
+	queue    chan *webhookDelivery
+	services sync.Map // map[string]*serviceCallback // key: serviceID
+
+	// Deliveries waiting for their next attempt
+	retryMu sync.Mutex
+	retries map[*webhookDelivery]*time.Timer
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// webhookDelivery is one event bound for one URL
+type webhookDelivery struct {
+	url      string
+	event    *domain.Event
+	body     []byte
+	attempts int
+}
+
+// serviceCallback caches a service's callback URL
+type serviceCallback struct {
+	url       string
+	fetchedAt time.Time
+}
+
+// NewEventWebhooks creates a dispatcher; Start launches its workers
+func NewEventWebhooks(opts EventWebhookOptions, userDB *sqlite.UserDB, historyDB *sqlite.HistoryDB, logger *zap.Logger) *EventWebhooks {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	types := make(map[domain.EventType]bool, len(opts.Types))
+	for _, t := range opts.Types {
+		types[t] = true
+	}
+	return &EventWebhooks{
+		opts:      opts,
+		types:     types,
+		userDB:    userDB,
+		historyDB: historyDB,
+		client:    &http.Client{Timeout: opts.Timeout},
+		logger:    logger,
+		queue:     make(chan *webhookDelivery, webhookQueueSize),
+		retries:   make(map[*webhookDelivery]*time.Timer),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start launches the delivery workers
+func (w *EventWebhooks) Start() {
+	for i := 0; i < webhookWorkers; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+}
+
+// Stop stops the workers. Deliveries still queued or waiting for a retry are
+// dead-lettered.
+func (w *EventWebhooks) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+	w.wg.Wait()
+
+	w.retryMu.Lock()
+	for d, timer := range w.retries {
+		if timer.Stop() {
+			w.deadLetter(d, "stopped before delivery")
+		}
+		delete(w.retries, d)
+	}
+	w.retryMu.Unlock()
+
+	for {
+		select {
+		case d := <-w.queue:
+			w.deadLetter(d, "stopped before delivery")
+		default:
+			return
+		}
+	}
+}
+
+// Enqueue queues an event for every URL it should be posted to
+func (w *EventWebhooks) Enqueue(event *domain.Event) {
+	if len(w.types) > 0 && !w.types[event.Type] {
+		return
+	}
+
+	urls := append([]string(nil), w.opts.URLs...)
+	if event.ServiceID != nil {
+		if url := w.serviceURL(*event.ServiceID); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.logger.Error("failed to encode webhook event", zap.String("event_id", event.ID), zap.Error(err))
+		return
+	}
+	for _, url := range urls {
+		w.push(&webhookDelivery{url: url, event: event, body: body})
+	}
+}
+
+// serviceURL returns a service's callback URL, cached for webhookServiceTTL
+func (w *EventWebhooks) serviceURL(serviceID string) string {
+	if v, ok := w.services.Load(serviceID); ok {
+		cb := v.(*serviceCallback)
+		if time.Since(cb.fetchedAt) < webhookServiceTTL {
+			return cb.url
+		}
+	}
+	if w.userDB == nil {
+		return ""
+	}
+
+	svc, err := w.userDB.GetService(serviceID)
+	if err != nil {
+		w.logger.Warn("failed to look up service callback URL", zap.String("service_id", serviceID), zap.Error(err))
+		return ""
+	}
+	cb := &serviceCallback{fetchedAt: time.Now()}
+	if svc != nil {
+		cb.url = svc.CallbackURL
+	}
+	w.services.Store(serviceID, cb)
+	return cb.url
+}
+
+// push hands a delivery to the workers, dead-lettering it when the queue is
+// full or the dispatcher stopped
+func (w *EventWebhooks) push(d *webhookDelivery) {
+	select {
+	case <-w.stop:
+		w.deadLetter(d, "stopped before delivery")
+		return
+	default:
+	}
+	select {
+	case w.queue <- d:
+	default:
+		w.deadLetter(d, "webhook queue full")
+	}
+}
+
+func (w *EventWebhooks) work() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case d := <-w.queue:
+			w.deliver(d)
+		}
+	}
+}
+
+// deliver posts one delivery and schedules a retry or dead-letters it when
+// the post fails
+func (w *EventWebhooks) deliver(d *webhookDelivery) {
+	d.attempts++
+	err := w.post(d)
+	if err == nil {
+		return
+	}
+	if d.attempts >= w.opts.MaxAttempts {
+		w.deadLetter(d, err.Error())
+		return
+	}
+
+	backoff := w.opts.Backoff << (d.attempts - 1)
+	if backoff <= 0 || backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	w.logger.Debug("event webhook failed, retrying",
+		zap.String("url", d.url),
+		zap.String("event_id", d.event.ID),
+		zap.Int("attempts", d.attempts),
+		zap.Duration("backoff", backoff),
+		zap.Error(err),
+	)
+	w.retryMu.Lock()
+	w.retries[d] = time.AfterFunc(backoff, func() {
+		w.retryMu.Lock()
+		delete(w.retries, d)
+		w.retryMu.Unlock()
+		w.push(d)
+	})
+	w.retryMu.Unlock()
+}
+
+func (w *EventWebhooks) post(d *webhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventWebhookHeader, string(d.event.Type))
+	req.Header.Set(panelhook.SignatureHeader, panelhook.Sign(w.opts.Secret, time.Now(), d.body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("event webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *EventWebhooks) deadLetter(d *webhookDelivery, reason string) {
+	w.logger.Error("event webhook gave up",
+		zap.String("url", d.url),
+		zap.String("event_id", d.event.ID),
+		zap.Int("attempts", d.attempts),
+		zap.String("error", reason),
+	)
+	if w.historyDB == nil {
+		return
+	}
+
+	dl := &domain.WebhookDeadLetter{
+		ID:        uuid.New().String(),
+		URL:       d.url,
+		EventID:   d.event.ID,
+		EventType: d.event.Type,
+		Payload:   d.body,
+		Attempts:  d.attempts,
+		LastError: reason,
+		FailedAt:  time.Now(),
+	}
+	if err := w.historyDB.StoreWebhookDeadLetter(dl); err != nil {
+		w.logger.Error("failed to store webhook dead letter", zap.String("event_id", d.event.ID), zap.Error(err))
+	}
+}
+
+// DeadLetters lists deliveries that gave up, newest first
+func (w *EventWebhooks) DeadLetters(limit int) ([]*domain.WebhookDeadLetter, error) {
+	if w.historyDB == nil {
+		return []*domain.WebhookDeadLetter{}, nil
+	}
+	return w.historyDB.ListWebhookDeadLetters(limit)
+}
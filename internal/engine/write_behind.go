@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/cache"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+)
+
+// SetWriteBehind makes RecordUsage keep charged traffic in the cache instead
+// of writing it to the database on every report. Quota is enforced against
+// the database counters plus the cached traffic, and FlushUsage writes the
+// traffic in aggregate.
+func (e *QuotaEngine) SetWriteBehind(enabled bool) {
+	e.writeBehind = enabled
+}
+
+// withPendingUsage returns pkg with the traffic not yet flushed added to its
+// counters. pkg itself is not changed.
+func (e *QuotaEngine) withPendingUsage(pkg *domain.Package) *domain.Package {
+	if pkg == nil {
+		return nil
+	}
+	pending := e.cache.GetPendingUsage(cache.UsageKindPackage, pkg.ID)
+	if pending.Upload == 0 && pending.Download == 0 {
+		return pkg
+	}
+	withPending := *pkg
+	withPending.CurrentUpload += pending.Upload
+	withPending.CurrentDownload += pending.Download
+	withPending.CurrentTotal += pending.Upload + pending.Download
+	return &withPending
+}
+
+// applyUsage writes delta, or keeps it for the next flush with write-behind
+func (e *QuotaEngine) applyUsage(delta sqlite.UsageDelta) error {
+	if !e.writeBehind {
+		return e.writeUsage(delta)
+	}
+	at := delta.LastConnectionAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if delta.PackageID != "" {
+		e.cache.AddPendingUsage(cache.PendingUsage{Kind: cache.UsageKindPackage, ID: delta.PackageID, UserID: delta.UserID, Upload: delta.Upload, Download: delta.Download, LastAt: at})
+	}
+	if delta.NodeID != "" {
+		e.cache.AddPendingUsage(cache.PendingUsage{Kind: cache.UsageKindNode, ID: delta.NodeID, Upload: delta.RawUpload, Download: delta.RawDownload, LastAt: at})
+	}
+	if delta.ServiceID != "" {
+		e.cache.AddPendingUsage(cache.PendingUsage{Kind: cache.UsageKindService, ID: delta.ServiceID, Upload: delta.RawUpload, Download: delta.RawDownload, LastAt: at})
+	}
+	return nil
+}
+
+// writeUsage writes delta to the database in one transaction. Traffic
+// charged to a package is charged to its user's manager and groups as well.
+func (e *QuotaEngine) writeUsage(delta sqlite.UsageDelta) error {
+	if delta.PackageID != "" && delta.UserID != "" {
+		user, err := e.userDB.GetUser(delta.UserID)
+		if err != nil {
+			return err
+		}
+		if user != nil {
+			if user.ManagerID != nil {
+				delta.ManagerID = *user.ManagerID
+			}
+			delta.Groups = user.Groups
+		}
+	}
+	return e.userDB.ApplyUsage(delta)
+}
+
+// flushPackageUsage writes a package's unflushed traffic; the caller holds
+// the lock of the package's user. The traffic is kept for the next flush
+// when the write fails.
+func (e *QuotaEngine) flushPackageUsage(packageID string) error {
+	pending := e.cache.TakePendingUsage(cache.UsageKindPackage, packageID)
+	if pending.Upload == 0 && pending.Download == 0 {
+		return nil
+	}
+	err := e.writeUsage(sqlite.UsageDelta{
+		UserID:           pending.UserID,
+		PackageID:        packageID,
+		Upload:           pending.Upload,
+		Download:         pending.Download,
+		LastConnectionAt: pending.LastAt,
+	})
+	if err != nil {
+		e.cache.AddPendingUsage(pending)
+		return err
+	}
+	return nil
+}
+
+// FlushUsage writes the traffic kept by write-behind to the database, one
+// aggregated update per package, node and service. It returns how many
+// counters were written.
+func (e *QuotaEngine) FlushUsage() (int, error) {
+	var pending []cache.PendingUsage
+	e.cache.RangePendingUsage(func(usage cache.PendingUsage) bool {
+		pending = append(pending, usage)
+		return true
+	})
+
+	flushed := 0
+	var errs []error
+	for _, usage := range pending {
+		var err error
+		switch usage.Kind {
+		case cache.UsageKindPackage:
+			// The user's lock keeps quota checks from seeing the traffic
+			// after it left the cache but before it reached the database
+			e.userLocks.Lock(usage.UserID)
+			err = e.flushPackageUsage(usage.ID)
+			e.userLocks.Unlock(usage.UserID)
+		default:
+			err = e.flushCounterUsage(usage.Kind, usage.ID)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		flushed++
+	}
+	return flushed, errors.Join(errs...)
+}
+
+// flushCounterUsage writes the unflushed traffic of a node or service
+func (e *QuotaEngine) flushCounterUsage(kind cache.UsageKind, id string) error {
+	pending := e.cache.TakePendingUsage(kind, id)
+	if pending.Upload == 0 && pending.Download == 0 {
+		return nil
+	}
+	delta := sqlite.UsageDelta{RawUpload: pending.Upload, RawDownload: pending.Download}
+	if kind == cache.UsageKindNode {
+		delta.NodeID = id
+	} else {
+		delta.ServiceID = id
+	}
+	err := e.writeUsage(delta)
+	if err != nil {
+		e.cache.AddPendingUsage(pending)
+	}
+	return err
+}
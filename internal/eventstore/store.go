@@ -12,6 +12,8 @@ type EventStore interface {
 	Store(event *domain.Event) error
 	GetEvents(eventType *domain.EventType, userID *string, limit int) ([]*domain.Event, error)
 	GetAllEvents(limit int) ([]*domain.Event, error)
+	ListEvents(filter domain.EventFilter) (*domain.EventPage, error)
+	ReplayEvents(filter domain.EventReplayFilter, fn func(*domain.Event) error) error
 	Close() error
 }
 
@@ -64,6 +66,16 @@ func (s *DBEventStore) GetAllEvents(limit int) ([]*domain.Event, error) {
 	return s.db.GetEvents(nil, nil, nil, nil, limit)
 }
 
+// ListEvents retrieves a page of events, newest first
+func (s *DBEventStore) ListEvents(filter domain.EventFilter) (*domain.EventPage, error) {
+	return s.db.ListEvents(filter)
+}
+
+// ReplayEvents calls fn for each stored event, oldest first
+func (s *DBEventStore) ReplayEvents(filter domain.EventReplayFilter, fn func(*domain.Event) error) error {
+	return s.db.ReplayEvents(filter, fn)
+}
+
 // Close closes the event store
 func (s *DBEventStore) Close() error {
 	return nil // DB is managed separately
@@ -92,6 +104,16 @@ func (s *NullEventStore) GetAllEvents(limit int) ([]*domain.Event, error) {
 	return []*domain.Event{}, nil
 }
 
+// ListEvents returns an empty page
+func (s *NullEventStore) ListEvents(filter domain.EventFilter) (*domain.EventPage, error) {
+	return &domain.EventPage{Events: []*domain.Event{}}, nil
+}
+
+// ReplayEvents replays nothing
+func (s *NullEventStore) ReplayEvents(filter domain.EventReplayFilter, fn func(*domain.Event) error) error {
+	return nil
+}
+
 // Close does nothing
 func (s *NullEventStore) Close() error {
 	return nil
@@ -0,0 +1,129 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+// hiddifyGB is the unit of Hiddify's usage_limit_GB and current_usage_GB
+const hiddifyGB = 1 << 30
+
+// hiddifyResetModes maps Hiddify's user mode to reset modes
+var hiddifyResetModes = map[string]domain.ResetMode{
+	"no_reset": domain.ResetModeNoReset,
+	"daily":    domain.ResetModeDaily,
+	"weekly":   domain.ResetModeWeekly,
+	"monthly":  domain.ResetModeMonthly,
+}
+
+// hiddifyBackup is the part of a Hiddify panel backup holding users
+type hiddifyBackup struct {
+	Users []hiddifyUser `json:"users"`
+}
+
+// hiddifyUser is a user of a Hiddify panel backup
+type hiddifyUser struct {
+	UUID           string  `json:"uuid"`
+	Name           string  `json:"name"`
+	UsageLimitGB   float64 `json:"usage_limit_GB"`
+	CurrentUsageGB float64 `json:"current_usage_GB"`
+	PackageDays    int64   `json:"package_days"`
+	StartDate      string  `json:"start_date"`
+	Mode           string  `json:"mode"`
+	MaxIPs         int     `json:"max_ips"`
+	Enable         *bool   `json:"enable"`
+	Comment        string  `json:"comment"`
+}
+
+// ReadHiddify reads the users of a Hiddify panel JSON backup. A user's UUID
+// becomes both its HUE ID and password, so existing client configs keep
+// working.
+func ReadHiddify(r io.Reader) ([]Record, error) {
+	var backup hiddifyBackup
+	if err := json.NewDecoder(r).Decode(&backup); err != nil {
+		return nil, fmt.Errorf("failed to parse Hiddify backup: %w", err)
+	}
+
+	now := time.Now()
+	records := make([]Record, 0, len(backup.Users))
+	for _, u := range backup.Users {
+		record, err := hiddifyRecord(u, now)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// hiddifyRecord maps a Hiddify user to a HUE user and package
+func hiddifyRecord(u hiddifyUser, now time.Time) (Record, error) {
+	user := &domain.User{
+		ID:         u.UUID,
+		Username:   u.Name,
+		Password:   u.UUID,
+		Status:     domain.UserStatusActive,
+		Attributes: map[string]string{AttributeImportedFrom: string(SourceHiddify)},
+	}
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+		user.Password = user.ID
+	}
+	// Hiddify configures every protocol with the UUID, Trojan and
+	// Shadowsocks included
+	user.ProtocolSecret = user.ID
+	if u.Enable != nil && !*u.Enable {
+		user.Status = domain.UserStatusSuspended
+	}
+	if u.Comment != "" {
+		user.Attributes[AttributeNote] = u.Comment
+	}
+
+	used := int64(u.CurrentUsageGB * hiddifyGB)
+	pkg := &domain.Package{
+		ID:              uuid.New().String(),
+		TotalTraffic:    int64(u.UsageLimitGB * hiddifyGB),
+		ResetMode:       domain.ResetModeNoReset,
+		Duration:        u.PackageDays * 24 * 60 * 60,
+		MaxIPs:          u.MaxIPs,
+		Status:          domain.PackageStatusActive,
+		CurrentDownload: used,
+		CurrentTotal:    used,
+	}
+	if mode, ok := hiddifyResetModes[u.Mode]; ok {
+		pkg.ResetMode = mode
+	}
+
+	// Without a start date the package starts on first connection
+	if u.StartDate != "" {
+		start, err := parseHiddifyDate(u.StartDate)
+		if err != nil {
+			return Record{}, fmt.Errorf("user %s: invalid start_date %q", u.Name, u.StartDate)
+		}
+		pkg.Start(start)
+		if pkg.IsExpiredAt(now) {
+			pkg.Status = domain.PackageStatusExpired
+		}
+	}
+	finishIfUsedUp(pkg)
+
+	return newRecord(user, pkg), nil
+}
+
+// parseHiddifyDate parses a start date, which backups store as a date or, in
+// some versions, a date and time
+func parseHiddifyDate(s string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{time.DateOnly, time.DateTime, time.RFC3339} {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
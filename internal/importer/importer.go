@@ -0,0 +1,183 @@
+// Package importer moves users from other panels into HUE. Readers turn a
+// Marzban database or a Hiddify panel backup into HUE users with one package
+// each, carrying over traffic limits, usage so far, expiry and reset mode, and
+// Import writes them to the user database.
+package importer
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+)
+
+// Source names the panel a dump comes from
+type Source string
+
+const (
+	SourceMarzban Source = "marzban" // Marzban SQLite database (db.sqlite3)
+	SourceHiddify Source = "hiddify" // Hiddify panel JSON backup
+)
+
+// Attributes set on imported users
+const (
+	AttributeImportedFrom = "imported_from" // Source the user was imported from
+	AttributeNote         = "note"          // The source panel's note or comment
+)
+
+// ParseSource returns the source named s
+func ParseSource(s string) (Source, error) {
+	switch Source(s) {
+	case SourceMarzban, SourceHiddify:
+		return Source(s), nil
+	}
+	return "", fmt.Errorf("unknown import source %q, expected marzban or hiddify", s)
+}
+
+// Record is one imported user and the package carrying its plan. The user's
+// ActivePackageID points at the package.
+type Record struct {
+	User    *domain.User
+	Package *domain.Package
+}
+
+// Read reads the records of a dump. A Marzban dump is a SQLite database file
+// and is read from path; a Hiddify backup is read from r.
+func Read(source Source, path string, r io.Reader) ([]Record, error) {
+	switch source {
+	case SourceMarzban:
+		return ReadMarzban(path)
+	case SourceHiddify:
+		return ReadHiddify(r)
+	}
+	return nil, fmt.Errorf("unknown import source %q", source)
+}
+
+// Options changes how Import writes records
+type Options struct {
+	// ManagerID assigns every imported user to a manager
+	ManagerID string
+	// DryRun reports what would be imported without writing it
+	DryRun bool
+}
+
+// Outcome is what Import did with one record
+type Outcome struct {
+	Username string `json:"username"`
+	UserID   string `json:"user_id"`
+	Imported bool   `json:"imported"`
+	Reason   string `json:"reason,omitempty"` // Why the record was skipped
+}
+
+func (o Outcome) String() string {
+	if o.Imported {
+		return fmt.Sprintf("import user %s (%s)", o.Username, o.UserID)
+	}
+	return fmt.Sprintf("skip user %s (%s)", o.Username, o.Reason)
+}
+
+// Import creates the records' users and packages. Records whose username or
+// user ID already exists are skipped, so an import can be run again after
+// fixing a failure.
+func Import(db *sqlite.UserDB, records []Record, opts Options) ([]Outcome, error) {
+	if opts.ManagerID != "" {
+		manager, err := db.GetManager(opts.ManagerID)
+		if err != nil {
+			return nil, err
+		}
+		if manager == nil {
+			return nil, fmt.Errorf("manager %q not found", opts.ManagerID)
+		}
+	}
+
+	seen := make(map[string]bool, len(records))
+	outcomes := make([]Outcome, 0, len(records))
+	for _, rec := range records {
+		user, pkg := rec.User, rec.Package
+		outcome := Outcome{Username: user.Username, UserID: user.ID}
+
+		reason, err := skipReason(db, user, seen)
+		if err != nil {
+			return outcomes, err
+		}
+		seen[user.Username] = true
+		seen["id:"+user.ID] = true
+		if reason != "" {
+			outcome.Reason = reason
+			outcomes = append(outcomes, outcome)
+			continue
+		}
+
+		if opts.ManagerID != "" {
+			managerID := opts.ManagerID
+			user.ManagerID = &managerID
+		}
+		if !opts.DryRun {
+			if err := db.CreateUser(user); err != nil {
+				return outcomes, fmt.Errorf("failed to create user %s: %w", user.Username, err)
+			}
+			if err := db.CreatePackage(pkg); err != nil {
+				return outcomes, fmt.Errorf("failed to create package of user %s: %w", user.Username, err)
+			}
+		}
+		outcome.Imported = true
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes, nil
+}
+
+// skipReason returns why a user cannot be imported, or ""
+func skipReason(db *sqlite.UserDB, user *domain.User, seen map[string]bool) (string, error) {
+	if user.Username == "" {
+		return "no username", nil
+	}
+	if seen[user.Username] || seen["id:"+user.ID] {
+		return "duplicate in dump", nil
+	}
+	if domain.ValidateUserPassword(user.Password) != nil {
+		return "password too long", nil
+	}
+	existing, err := db.GetUserByUsername(user.Username)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "username exists", nil
+	}
+	if existing, err = db.GetUser(user.ID); err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "user ID exists", nil
+	}
+	return "", nil
+}
+
+// newRecord links a user to its package
+func newRecord(user *domain.User, pkg *domain.Package) Record {
+	pkg.UserID = user.ID
+	user.ActivePackageID = &pkg.ID
+	return Record{User: user, Package: pkg}
+}
+
+// expiryPackage sets a package to end at expiresAt, counted from now, so the
+// remaining days survive the import. A past expiry marks it expired.
+func expiryPackage(pkg *domain.Package, expiresAt, now time.Time) {
+	if !expiresAt.After(now) {
+		pkg.Status = domain.PackageStatusExpired
+		pkg.Start(expiresAt)
+		pkg.ExpiresAt = &expiresAt
+		return
+	}
+	pkg.Duration = int64(expiresAt.Sub(now) / time.Second)
+	pkg.Start(now)
+}
+
+// finishIfUsedUp marks a package with a limit and no traffic left finished
+func finishIfUsedUp(pkg *domain.Package) {
+	if pkg.Status == domain.PackageStatusActive && pkg.TotalTraffic > 0 && pkg.CurrentTotal >= pkg.TotalTraffic {
+		pkg.Status = domain.PackageStatusFinish
+	}
+}
@@ -0,0 +1,146 @@
+package importer
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+)
+
+func TestReadMarzbanMapsUsersAndPackages(t *testing.T) {
+	path := t.TempDir() + "/marzban.sqlite3"
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	expire := time.Now().Add(10 * 24 * time.Hour).Unix()
+	for _, stmt := range []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT, status TEXT, used_traffic INTEGER, data_limit INTEGER,
+			expire INTEGER, data_limit_reset_strategy TEXT, note TEXT, on_hold_expire_duration INTEGER)`,
+		`CREATE TABLE proxies (id INTEGER PRIMARY KEY, user_id INTEGER, type TEXT, settings TEXT)`,
+		`INSERT INTO users VALUES (1, 'alice', 'active', 1000, 5000, ` + strconv.FormatInt(expire, 10) + `, 'month', 'vip', NULL)`,
+		`INSERT INTO users VALUES (2, 'bob', 'disabled', 0, NULL, NULL, 'no_reset', NULL, NULL)`,
+		`INSERT INTO users VALUES (3, 'carol', 'on_hold', 0, 1000, NULL, 'no_reset', NULL, 86400)`,
+		`INSERT INTO users VALUES (4, 'dave', 'limited', 2000, 2000, NULL, 'no_reset', NULL, NULL)`,
+		`INSERT INTO proxies VALUES (1, 1, 'VLESS', '{"id": "2f1d5a52-7c35-4ad8-9f3b-0f5d0c0f6a11", "flow": ""}')`,
+		`INSERT INTO proxies VALUES (2, 2, 'Trojan', '{"password": "bob-secret"}')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("exec %s: %v", stmt, err)
+		}
+	}
+	db.Close()
+
+	records, err := ReadMarzban(path)
+	if err != nil {
+		t.Fatalf("read marzban: %v", err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+
+	alice := records[0]
+	if alice.User.ID != "2f1d5a52-7c35-4ad8-9f3b-0f5d0c0f6a11" || alice.User.Password != alice.User.ID {
+		t.Fatalf("expected alice to keep her VLESS UUID, got id %q password %q", alice.User.ID, alice.User.Password)
+	}
+	if alice.User.Attributes[AttributeNote] != "vip" || alice.User.Attributes[AttributeImportedFrom] != "marzban" {
+		t.Fatalf("unexpected attributes %v", alice.User.Attributes)
+	}
+	pkg := alice.Package
+	if pkg.TotalTraffic != 5000 || pkg.CurrentTotal != 1000 || pkg.ResetMode != domain.ResetModeMonthly || pkg.Status != domain.PackageStatusActive {
+		t.Fatalf("unexpected package %+v", pkg)
+	}
+	if pkg.ExpiresAt == nil || pkg.ExpiresAt.Unix()-expire > 1 || expire-pkg.ExpiresAt.Unix() > 1 {
+		t.Fatalf("expected expiry near %d, got %v", expire, pkg.ExpiresAt)
+	}
+	if *alice.User.ActivePackageID != pkg.ID || pkg.UserID != alice.User.ID {
+		t.Fatal("expected user and package to be linked")
+	}
+
+	if bob := records[1]; bob.User.Status != domain.UserStatusSuspended || bob.User.Password != "bob-secret" || bob.User.ProtocolSecret != "bob-secret" || bob.Package.TotalTraffic != 0 {
+		t.Fatalf("unexpected bob %+v %+v", bob.User, bob.Package)
+	}
+	if carol := records[2].Package; carol.Duration != 86400 || carol.StartAt != nil {
+		t.Fatalf("expected on-hold package to start on first connection, got %+v", carol)
+	}
+	if dave := records[3].Package; dave.Status != domain.PackageStatusFinish {
+		t.Fatalf("expected limited user's package to be finished, got %s", dave.Status)
+	}
+}
+
+func TestReadHiddifyAndImport(t *testing.T) {
+	backup := `{"users": [
+		{"uuid": "6b0c1e3e-8a4e-4b43-9b1c-1f3f4c1d2e01", "name": "alice", "usage_limit_GB": 10, "current_usage_GB": 2.5,
+		 "package_days": 30, "start_date": "` + time.Now().AddDate(0, 0, -5).Format(time.DateOnly) + `", "mode": "monthly", "max_ips": 3, "enable": true},
+		{"uuid": "6b0c1e3e-8a4e-4b43-9b1c-1f3f4c1d2e02", "name": "bob", "usage_limit_GB": 1, "package_days": 7,
+		 "start_date": "2020-01-01", "mode": "no_reset", "enable": false, "comment": "old"},
+		{"uuid": "6b0c1e3e-8a4e-4b43-9b1c-1f3f4c1d2e03", "name": "carol", "usage_limit_GB": 1, "package_days": 7}
+	]}`
+	records, err := ReadHiddify(strings.NewReader(backup))
+	if err != nil {
+		t.Fatalf("read hiddify: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	alice := records[0].Package
+	if alice.TotalTraffic != 10<<30 || alice.CurrentTotal != 5<<29 || alice.Duration != 30*86400 || alice.MaxIPs != 3 ||
+		alice.ResetMode != domain.ResetModeMonthly || alice.Status != domain.PackageStatusActive || alice.StartAt == nil {
+		t.Fatalf("unexpected package %+v", alice)
+	}
+	if bob := records[1]; bob.User.Status != domain.UserStatusSuspended || bob.Package.Status != domain.PackageStatusExpired {
+		t.Fatalf("expected bob suspended with an expired package, got %s %s", bob.User.Status, bob.Package.Status)
+	}
+	if carol := records[2].Package; carol.StartAt != nil {
+		t.Fatal("expected package without start date to start on first connection")
+	}
+
+	db, err := sqlite.NewUserDB("sqlite://" + t.TempDir() + "/import.db")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate user db: %v", err)
+	}
+	if err := db.CreateUser(&domain.User{ID: "existing", Username: "carol", Password: "x", Status: domain.UserStatusActive}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	outcomes, err := Import(db, records, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(outcomes) != 3 || !outcomes[0].Imported || outcomes[2].Imported || outcomes[2].Reason != "username exists" {
+		t.Fatalf("unexpected dry run outcomes %+v", outcomes)
+	}
+	if user, _ := db.GetUserByUsername("alice"); user != nil {
+		t.Fatal("expected dry run not to create users")
+	}
+
+	if _, err := Import(db, records, Options{}); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	user, err := db.GetUserByUsername("alice")
+	if err != nil || user == nil {
+		t.Fatalf("expected alice to be imported: %v", err)
+	}
+	imported, err := db.GetPackage(*user.ActivePackageID)
+	if err != nil || imported == nil || imported.CurrentTotal != 5<<29 || imported.UserID != user.ID {
+		t.Fatalf("unexpected imported package %+v: %v", imported, err)
+	}
+
+	outcomes, err = Import(db, records, Options{})
+	if err != nil {
+		t.Fatalf("second import: %v", err)
+	}
+	for _, o := range outcomes {
+		if o.Imported {
+			t.Fatalf("expected a second import to skip %s", o.Username)
+		}
+	}
+}
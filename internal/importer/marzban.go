@@ -0,0 +1,210 @@
+package importer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+// marzbanResetModes maps Marzban's data_limit_reset_strategy to reset modes
+var marzbanResetModes = map[string]domain.ResetMode{
+	"no_reset": domain.ResetModeNoReset,
+	"day":      domain.ResetModeDaily,
+	"week":     domain.ResetModeWeekly,
+	"month":    domain.ResetModeMonthly,
+	"year":     domain.ResetModeYearly,
+}
+
+// marzbanOptionalColumns are users columns missing from older Marzban
+// versions, read as NULL when absent
+var marzbanOptionalColumns = []string{"data_limit_reset_strategy", "note", "on_hold_expire_duration"}
+
+// marzbanUser is a row of Marzban's users table
+type marzbanUser struct {
+	id                   int64
+	username             string
+	status               string
+	usedTraffic          int64
+	dataLimit            sql.NullInt64
+	expire               sql.NullInt64
+	resetStrategy        sql.NullString
+	note                 sql.NullString
+	onHoldExpireDuration sql.NullInt64
+}
+
+// ReadMarzban reads the users of a Marzban SQLite database. Each user becomes
+// a HUE user whose ID and password come from its VLESS/VMess UUID, or
+// Trojan/Shadowsocks password, so existing client configs keep working.
+func ReadMarzban(path string) ([]Record, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Marzban database: %w", err)
+	}
+	defer db.Close()
+
+	existing, err := tableColumns(db, "users")
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return nil, fmt.Errorf("%s is not a Marzban database: no users table", path)
+	}
+	columns := []string{"id", "username", "status", "COALESCE(used_traffic, 0)", "data_limit", "expire"}
+	for _, col := range marzbanOptionalColumns {
+		if existing[col] {
+			columns = append(columns, col)
+		} else {
+			columns = append(columns, "NULL")
+		}
+	}
+
+	credentials, err := readMarzbanProxies(db)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT ` + strings.Join(columns, ", ") + ` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Marzban users: %w", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var records []Record
+	for rows.Next() {
+		var u marzbanUser
+		if err := rows.Scan(&u.id, &u.username, &u.status, &u.usedTraffic, &u.dataLimit, &u.expire,
+			&u.resetStrategy, &u.note, &u.onHoldExpireDuration); err != nil {
+			return nil, fmt.Errorf("failed to read Marzban user: %w", err)
+		}
+		records = append(records, marzbanRecord(u, credentials[u.id], now))
+	}
+	return records, rows.Err()
+}
+
+// marzbanCredential is the ID and password a Marzban user connects with
+type marzbanCredential struct {
+	id       string
+	password string
+}
+
+// readMarzbanProxies returns each user's credential from the proxies table.
+// A VLESS/VMess UUID is preferred over a Trojan/Shadowsocks password.
+func readMarzbanProxies(db *sql.DB) (map[int64]marzbanCredential, error) {
+	credentials := make(map[int64]marzbanCredential)
+	existing, err := tableColumns(db, "proxies")
+	if err != nil || len(existing) == 0 {
+		return credentials, err
+	}
+
+	rows, err := db.Query(`SELECT user_id, settings FROM proxies ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Marzban proxies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int64
+		var raw sql.NullString
+		if err := rows.Scan(&userID, &raw); err != nil {
+			return nil, fmt.Errorf("failed to read Marzban proxy: %w", err)
+		}
+		var settings struct {
+			ID       string `json:"id"`
+			Password string `json:"password"`
+		}
+		if json.Unmarshal([]byte(raw.String), &settings) != nil {
+			continue
+		}
+		cred := credentials[userID]
+		if cred.id == "" && settings.ID != "" {
+			cred.id = settings.ID
+		}
+		if cred.password == "" && settings.Password != "" {
+			cred.password = settings.Password
+		}
+		credentials[userID] = cred
+	}
+	return credentials, rows.Err()
+}
+
+// marzbanRecord maps a Marzban user to a HUE user and package
+func marzbanRecord(u marzbanUser, cred marzbanCredential, now time.Time) Record {
+	user := &domain.User{
+		ID:         cred.id,
+		Username:   u.username,
+		Password:   cred.id,
+		Status:     domain.UserStatusActive,
+		Attributes: map[string]string{AttributeImportedFrom: string(SourceMarzban)},
+	}
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+	// Trojan/Shadowsocks clients keep their password as protocol secret; it
+	// is also the login password unless it is too long to hash
+	user.ProtocolSecret = cred.password
+	if cred.password != "" && domain.ValidateUserPassword(cred.password) == nil {
+		user.Password = cred.password
+	}
+	if user.Password == "" {
+		user.Password = user.ID
+	}
+	if u.note.String != "" {
+		user.Attributes[AttributeNote] = u.note.String
+	}
+
+	pkg := &domain.Package{
+		ID:              uuid.New().String(),
+		TotalTraffic:    u.dataLimit.Int64,
+		ResetMode:       domain.ResetModeNoReset,
+		Status:          domain.PackageStatusActive,
+		CurrentDownload: u.usedTraffic,
+		CurrentTotal:    u.usedTraffic,
+	}
+	if mode, ok := marzbanResetModes[u.resetStrategy.String]; ok {
+		pkg.ResetMode = mode
+	}
+
+	switch u.status {
+	case "disabled":
+		user.Status = domain.UserStatusSuspended
+	case "limited":
+		pkg.Status = domain.PackageStatusFinish
+	case "expired":
+		pkg.Status = domain.PackageStatusExpired
+	}
+
+	if u.status == "on_hold" {
+		// The clock starts on first connection, as in Marzban
+		pkg.Duration = u.onHoldExpireDuration.Int64
+	} else if u.expire.Valid && u.expire.Int64 > 0 {
+		expiryPackage(pkg, time.Unix(u.expire.Int64, 0), now)
+	}
+	finishIfUsedUp(pkg)
+
+	return newRecord(user, pkg)
+}
+
+// tableColumns returns the columns of table, none if it does not exist
+func tableColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,320 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrJobNotFound is returned when a job name is not registered
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobRunning is returned when a job is triggered while already running
+	ErrJobRunning = errors.New("job is already running")
+	// ErrSchedulerStopped is returned when a job is triggered after Stop
+	ErrSchedulerStopped = errors.New("scheduler is stopped")
+)
+
+// Func is the work performed by a job
+type Func func(ctx context.Context) error
+
+// Status is a snapshot of a job's schedule and run history
+type Status struct {
+	Name                string     `json:"name"`
+	Interval            string     `json:"interval"`
+	Running             bool       `json:"running"`
+	Runs                int64      `json:"runs"`
+	Failures            int64      `json:"failures"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+	LastRunAt           *time.Time `json:"last_run_at,omitempty"`
+	LastDuration        string     `json:"last_duration,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	NextRunAt           *time.Time `json:"next_run_at,omitempty"`
+}
+
+type job struct {
+	name     string
+	interval time.Duration
+	fn       Func
+	// rescheduled wakes the job's loop after SetInterval
+	rescheduled chan struct{}
+
+	running             bool
+	runs                int64
+	failures            int64
+	consecutiveFailures int64
+	lastRunAt           time.Time
+	lastDuration        time.Duration
+	lastError           string
+	nextRunAt           time.Time
+}
+
+// Scheduler runs registered jobs on fixed intervals and on demand. A job never
+// overlaps with itself: scheduled ticks are skipped while a run is in flight.
+type Scheduler struct {
+	mu       sync.Mutex
+	jobs     map[string]*job
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopping bool
+	logger   *zap.Logger
+}
+
+// NewScheduler creates a new Scheduler instance
+func NewScheduler(logger *zap.Logger) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		jobs:   make(map[string]*job),
+		ctx:    ctx,
+		cancel: cancel,
+		logger: logger,
+	}
+}
+
+// Register adds a job. An interval of zero registers a manual-only job that
+// runs only when triggered with RunNow.
+func (s *Scheduler) Register(name string, interval time.Duration, fn Func) error {
+	if name == "" || fn == nil {
+		return fmt.Errorf("job name and function are required")
+	}
+	if interval < 0 {
+		return fmt.Errorf("job %s: negative interval", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.jobs[name]; exists {
+		return fmt.Errorf("job %s already registered", name)
+	}
+	s.jobs[name] = &job{name: name, interval: interval, fn: fn, rescheduled: make(chan struct{}, 1)}
+	return nil
+}
+
+// SetInterval changes how often a scheduled job runs. The next run is one
+// new interval from now. Manual-only jobs stay manual.
+func (s *Scheduler) SetInterval(name string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("job %s: interval must be positive", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if j.interval <= 0 {
+		return fmt.Errorf("job %s is manual-only", name)
+	}
+	if j.interval == interval {
+		return nil
+	}
+	j.interval = interval
+	if !j.nextRunAt.IsZero() {
+		j.nextRunAt = time.Now().Add(interval)
+	}
+	select {
+	case j.rescheduled <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start launches the schedule loop of every registered job. Jobs run until
+// the parent context is cancelled or Stop is called.
+func (s *Scheduler) Start(parent context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopping {
+		return
+	}
+
+	go func() {
+		select {
+		case <-parent.Done():
+			s.cancel()
+		case <-s.ctx.Done():
+		}
+	}()
+
+	for _, j := range s.jobs {
+		if j.interval <= 0 {
+			continue
+		}
+		j.nextRunAt = time.Now().Add(j.interval)
+		s.wg.Add(1)
+		go s.loop(j, j.interval)
+	}
+}
+
+// Stop cancels all schedules and waits for in-flight runs to finish. Jobs
+// triggered after Stop are refused with ErrSchedulerStopped.
+func (s *Scheduler) Stop() {
+	// Set under the lock so no RunNow can add to the wait group once Wait
+	// may have started
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+
+	s.cancel()
+	s.wg.Wait()
+}
+
+// RunNow triggers a job immediately in the background
+func (s *Scheduler) RunNow(name string) error {
+	s.mu.Lock()
+	if s.stopping || s.ctx.Err() != nil {
+		s.mu.Unlock()
+		return ErrSchedulerStopped
+	}
+	j, ok := s.jobs[name]
+	if !ok {
+		s.mu.Unlock()
+		return ErrJobNotFound
+	}
+	if j.running {
+		s.mu.Unlock()
+		return ErrJobRunning
+	}
+	j.running = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		s.execute(j)
+	}()
+	return nil
+}
+
+// Status returns the status of every job sorted by name
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		statuses = append(statuses, j.status())
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+// Get returns the status of a single job
+func (s *Scheduler) Get(name string) (Status, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return Status{}, false
+	}
+	return j.status(), true
+}
+
+// loop runs j every interval until the scheduler stops. The interval is
+// passed in since SetInterval may change j's under the lock meanwhile.
+func (s *Scheduler) loop(j *job, interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-j.rescheduled:
+			s.mu.Lock()
+			ticker.Reset(j.interval)
+			s.mu.Unlock()
+		case <-ticker.C:
+			s.mu.Lock()
+			j.nextRunAt = time.Now().Add(j.interval)
+			if j.running {
+				s.mu.Unlock()
+				continue
+			}
+			j.running = true
+			s.mu.Unlock()
+
+			s.execute(j)
+		}
+	}
+}
+
+// execute runs the job; the caller must have marked it running
+func (s *Scheduler) execute(j *job) {
+	start := time.Now()
+	err := s.safeRun(j)
+	duration := time.Since(start)
+
+	s.mu.Lock()
+	j.running = false
+	j.runs++
+	j.lastRunAt = start
+	j.lastDuration = duration
+	if err != nil {
+		j.failures++
+		j.consecutiveFailures++
+		j.lastError = err.Error()
+	} else {
+		j.consecutiveFailures = 0
+		j.lastError = ""
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Error("job failed",
+			zap.String("job", j.name),
+			zap.Duration("duration", duration),
+			zap.Error(err),
+		)
+		return
+	}
+	s.logger.Debug("job completed", zap.String("job", j.name), zap.Duration("duration", duration))
+}
+
+// safeRun turns a panicking job into a failed run
+func (s *Scheduler) safeRun(j *job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.fn(s.ctx)
+}
+
+func (j *job) status() Status {
+	st := Status{
+		Name:                j.name,
+		Interval:            "manual",
+		Running:             j.running,
+		Runs:                j.runs,
+		Failures:            j.failures,
+		ConsecutiveFailures: j.consecutiveFailures,
+		LastError:           j.lastError,
+	}
+	if j.interval > 0 {
+		st.Interval = j.interval.String()
+	}
+	if !j.lastRunAt.IsZero() {
+		lastRunAt := j.lastRunAt
+		st.LastRunAt = &lastRunAt
+		st.LastDuration = j.lastDuration.String()
+	}
+	if !j.nextRunAt.IsZero() {
+		nextRunAt := j.nextRunAt
+		st.NextRunAt = &nextRunAt
+	}
+	return st
+}
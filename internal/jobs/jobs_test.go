@@ -0,0 +1,155 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSchedulerRunsAndTracksFailures(t *testing.T) {
+	s := NewScheduler(zap.NewNop())
+
+	var ticks int32
+	if err := s.Register("tick", 10*time.Millisecond, func(context.Context) error {
+		atomic.AddInt32(&ticks, 1)
+		return nil
+	}); err != nil {
+		t.Fatalf("register tick: %v", err)
+	}
+	if err := s.Register("broken", 0, func(context.Context) error {
+		return errors.New("boom")
+	}); err != nil {
+		t.Fatalf("register broken: %v", err)
+	}
+	if err := s.Register("tick", time.Second, func(context.Context) error { return nil }); err == nil {
+		t.Fatalf("expected duplicate registration to fail")
+	}
+
+	s.Start(context.Background())
+	defer s.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&ticks) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&ticks) < 2 {
+		t.Fatalf("expected scheduled job to run repeatedly")
+	}
+
+	if err := s.RunNow("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("expected ErrJobNotFound, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.RunNow("broken"); err != nil {
+			t.Fatalf("run broken: %v", err)
+		}
+		deadline = time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if st, _ := s.Get("broken"); st.Runs == int64(i+1) {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	st, ok := s.Get("broken")
+	if !ok {
+		t.Fatalf("expected broken job status")
+	}
+	if st.Runs != 2 || st.Failures != 2 || st.ConsecutiveFailures != 2 || st.LastError != "boom" || st.LastRunAt == nil {
+		t.Fatalf("unexpected failure tracking: %+v", st)
+	}
+	if st.Interval != "manual" || st.NextRunAt != nil {
+		t.Fatalf("expected manual job without next run, got %+v", st)
+	}
+}
+
+func TestSchedulerRecoversFromPanics(t *testing.T) {
+	s := NewScheduler(zap.NewNop())
+	defer s.Stop()
+
+	if err := s.Register("panics", 0, func(context.Context) error {
+		panic("kaboom")
+	}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := s.RunNow("panics"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if st, _ := s.Get("panics"); st.Failures == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected panic to be recorded as a failure")
+}
+
+func TestSchedulerRefusesRunsAfterStop(t *testing.T) {
+	s := NewScheduler(zap.NewNop())
+	if err := s.Register("noop", 0, func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// Triggers racing with Stop must either finish before it returns or be
+	// refused; run with -race to catch a wait group reuse
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := s.RunNow("noop"); errors.Is(err, ErrSchedulerStopped) {
+				return
+			}
+		}
+	}()
+	s.Stop()
+	<-done
+
+	if err := s.RunNow("noop"); !errors.Is(err, ErrSchedulerStopped) {
+		t.Fatalf("expected ErrSchedulerStopped after Stop, got %v", err)
+	}
+}
+
+func TestSchedulerSetIntervalReschedules(t *testing.T) {
+	s := NewScheduler(zap.NewNop())
+
+	var ticks int32
+	if err := s.Register("tick", time.Hour, func(context.Context) error {
+		atomic.AddInt32(&ticks, 1)
+		return nil
+	}); err != nil {
+		t.Fatalf("register tick: %v", err)
+	}
+	if err := s.Register("manual", 0, func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("register manual: %v", err)
+	}
+	s.Start(context.Background())
+	defer s.Stop()
+
+	if err := s.SetInterval("tick", 10*time.Millisecond); err != nil {
+		t.Fatalf("set interval: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&ticks) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&ticks) < 2 {
+		t.Fatalf("expected job to run on the new interval")
+	}
+	if st, _ := s.Get("tick"); st.Interval != "10ms" {
+		t.Fatalf("expected status to show the new interval, got %s", st.Interval)
+	}
+
+	if err := s.SetInterval("manual", time.Minute); err == nil {
+		t.Fatalf("expected manual-only job to stay manual")
+	}
+	if err := s.SetInterval("missing", time.Minute); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("expected ErrJobNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+// Package keylock provides read-write locks keyed by string, such as one per
+// user, that are created on first use and reclaimed once nobody holds or
+// waits for them.
+package keylock
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// shardCount spreads keys over several maps so unrelated keys rarely contend
+// for the same map mutex
+const shardCount = 32
+
+// Pool hands out a read-write lock per key. A key's lock exists only while it
+// is held or waited for, so the pool does not grow with every key ever seen.
+type Pool struct {
+	shards [shardCount]shard
+}
+
+type shard struct {
+	mu    sync.Mutex
+	locks map[string]*entry
+}
+
+type entry struct {
+	sync.RWMutex
+	refs int // Holders plus waiters
+}
+
+// New creates an empty Pool
+func New() *Pool {
+	p := &Pool{}
+	for i := range p.shards {
+		p.shards[i].locks = make(map[string]*entry)
+	}
+	return p
+}
+
+// Lock locks key exclusively
+func (p *Pool) Lock(key string) {
+	p.acquire(key).Lock()
+}
+
+// Unlock releases an exclusive lock taken with Lock
+func (p *Pool) Unlock(key string) {
+	p.held(key).Unlock()
+	p.release(key)
+}
+
+// RLock locks key for reading
+func (p *Pool) RLock(key string) {
+	p.acquire(key).RLock()
+}
+
+// RUnlock releases a read lock taken with RLock
+func (p *Pool) RUnlock(key string) {
+	p.held(key).RUnlock()
+	p.release(key)
+}
+
+// Len returns how many keys have a lock that is held or waited for
+func (p *Pool) Len() int {
+	n := 0
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.mu.Lock()
+		n += len(s.locks)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func (p *Pool) shard(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &p.shards[h.Sum32()%shardCount]
+}
+
+// acquire returns key's lock, creating it, and counts the caller as using it
+func (p *Pool) acquire(key string) *entry {
+	s := p.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.locks[key]
+	if !ok {
+		e = &entry{}
+		s.locks[key] = e
+	}
+	e.refs++
+	return e
+}
+
+// held returns the lock of a key the caller holds
+func (p *Pool) held(key string) *entry {
+	s := p.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.locks[key]
+	if !ok {
+		panic("keylock: unlock of unlocked key " + key)
+	}
+	return e
+}
+
+// release stops counting the caller as using key's lock and drops the lock
+// once nobody does. The caller must already have unlocked it, so a lock is
+// never dropped while held.
+func (p *Pool) release(key string) {
+	s := p.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.locks[key]
+	e.refs--
+	if e.refs == 0 {
+		delete(s.locks, key)
+	}
+}
@@ -0,0 +1,63 @@
+package keylock
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPoolExcludesWritersAndReclaimsLocks(t *testing.T) {
+	p := New()
+
+	counter := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.Lock("u1")
+				counter++
+				p.Unlock("u1")
+				p.RLock("u2")
+				p.RUnlock("u2")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter != 5000 {
+		t.Fatalf("expected 5000 increments under the lock, got %d", counter)
+	}
+	if n := p.Len(); n != 0 {
+		t.Fatalf("expected released locks to be reclaimed, %d left", n)
+	}
+}
+
+func TestPoolKeepsLockWhileHeld(t *testing.T) {
+	p := New()
+
+	p.RLock("u1")
+	p.RLock("u1")
+	p.RUnlock("u1")
+	if n := p.Len(); n != 1 {
+		t.Fatalf("expected a lock still held by a reader to be kept, got %d", n)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		p.Lock("u1")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected writer to wait for the reader")
+	default:
+	}
+	p.RUnlock("u1")
+	<-locked
+	p.Unlock("u1")
+
+	if n := p.Len(); n != 0 {
+		t.Fatalf("expected lock to be reclaimed, got %d", n)
+	}
+}
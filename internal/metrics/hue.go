@@ -0,0 +1,50 @@
+package metrics
+
+// Metrics are the metrics HUE updates while it processes reports. Gauges for
+// state owned elsewhere, such as active sessions, are added to the registry
+// by whoever owns that state.
+type Metrics struct {
+	*Registry
+
+	// Reports counts processed usage reports by result: accepted or rejected
+	Reports *CounterVec
+	// Rejections counts rejected reports by reason code
+	Rejections *CounterVec
+	// QuotaExceeded counts reports rejected for exhausted traffic
+	QuotaExceeded *Counter
+	// PenaltiesApplied counts penalties by reason
+	PenaltiesApplied *CounterVec
+	// CacheLookups counts quota checks by whether the user was cached
+	CacheLookups *CounterVec
+	// CacheEvictions counts cached users and nodes dropped by reason:
+	// expired or capacity
+	CacheEvictions *CounterVec
+	// RetentionPurged counts rows the retention jobs deleted by table
+	RetentionPurged *CounterVec
+	// FlushDuration observes how long buffered usage takes to write
+	FlushDuration *Histogram
+}
+
+// New creates HUE's metrics on a fresh registry
+func New() *Metrics {
+	r := NewRegistry()
+	m := &Metrics{
+		Registry:         r,
+		Reports:          r.NewCounterVec("hue_usage_reports_total", "Usage reports processed, by result.", "result"),
+		Rejections:       r.NewCounterVec("hue_usage_rejections_total", "Usage reports rejected, by reason code.", "reason"),
+		QuotaExceeded:    r.NewCounter("hue_quota_exceeded_total", "Usage reports rejected because the package ran out of traffic."),
+		PenaltiesApplied: r.NewCounterVec("hue_penalties_applied_total", "Penalties applied, by reason.", "reason"),
+		CacheLookups:     r.NewCounterVec("hue_cache_lookups_total", "Quota checks, by whether the user was found in the cache.", "result"),
+		CacheEvictions:   r.NewCounterVec("hue_cache_evictions_total", "Cached users and nodes evicted, by reason.", "reason"),
+		RetentionPurged:  r.NewCounterVec("hue_retention_purged_rows_total", "Rows deleted by the retention jobs, by table.", "table"),
+		FlushDuration:    r.NewHistogram("hue_db_flush_duration_seconds", "Time taken to write buffered usage reports to the database.", DefBuckets),
+	}
+	r.NewGaugeFunc("hue_cache_hit_ratio", "Share of quota checks served from the cache since start.", func() float64 {
+		hits, misses := m.CacheLookups.Value("hit"), m.CacheLookups.Value("miss")
+		if hits+misses == 0 {
+			return 0
+		}
+		return float64(hits) / float64(hits+misses)
+	})
+	return m
+}
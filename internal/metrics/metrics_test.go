@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WritesPrometheusText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.")
+	c.Add(3)
+	v := r.NewCounterVec("test_by_reason_total", "A labelled counter.", "reason")
+	v.Inc(`say "hi"`)
+	v.Inc("b")
+	v.Inc("b")
+	r.NewGaugeFunc("test_gauge", "A gauge.", func() float64 { return 1.5 })
+	h := r.NewHistogram("test_seconds", "A histogram.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var out strings.Builder
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3
+# HELP test_by_reason_total A labelled counter.
+# TYPE test_by_reason_total counter
+test_by_reason_total{reason="b"} 2
+test_by_reason_total{reason="say \"hi\""} 1
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if out.String() != want {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+}
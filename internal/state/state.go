@@ -0,0 +1,606 @@
+// Package state exports the fleet definition (managers, nodes and services) as
+// a declarative YAML document and reconciles a database against one. Users,
+// their packages and usage counters are per-user data and are never part of
+// the state.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the state document format version
+const Version = 1
+
+// State is the declarative fleet definition
+type State struct {
+	Version  int       `yaml:"version"`
+	Managers []Manager `yaml:"managers,omitempty"`
+	Nodes    []Node    `yaml:"nodes,omitempty"`
+	Services []Service `yaml:"services,omitempty"`
+}
+
+// Manager declares a reseller and its package limits
+type Manager struct {
+	ID       string                 `yaml:"id"`
+	Name     string                 `yaml:"name"`
+	ParentID string                 `yaml:"parent_id,omitempty"`
+	Metadata map[string]interface{} `yaml:"metadata,omitempty"`
+	Package  ManagerPackage         `yaml:"package"`
+}
+
+// ManagerPackage declares the limits of a manager package
+type ManagerPackage struct {
+	TotalLimit     int64                       `yaml:"total_limit,omitempty"`
+	UploadLimit    int64                       `yaml:"upload_limit,omitempty"`
+	DownloadLimit  int64                       `yaml:"download_limit,omitempty"`
+	ResetMode      domain.ResetMode            `yaml:"reset_mode,omitempty"`
+	Duration       int64                       `yaml:"duration,omitempty"`
+	MaxSessions    int                         `yaml:"max_sessions,omitempty"`
+	MaxOnlineUsers int                         `yaml:"max_online_users,omitempty"`
+	MaxActiveUsers int                         `yaml:"max_active_users,omitempty"`
+	Status         domain.ManagerPackageStatus `yaml:"status,omitempty"`
+}
+
+// Node declares a node
+type Node struct {
+	ID                string           `yaml:"id"`
+	Name              string           `yaml:"name"`
+	SecretKey         string           `yaml:"secret_key,omitempty"`
+	AllowedIPs        []string         `yaml:"allowed_ips,omitempty"`
+	TrafficMultiplier float64          `yaml:"traffic_multiplier,omitempty"`
+	ResetMode         domain.ResetMode `yaml:"reset_mode,omitempty"`
+	ResetDay          int              `yaml:"reset_day,omitempty"`
+	Country           string           `yaml:"country,omitempty"`
+	City              string           `yaml:"city,omitempty"`
+	ISP               string           `yaml:"isp,omitempty"`
+	ManagerID         string           `yaml:"manager_id,omitempty"`
+	MaxActiveUsers    int              `yaml:"max_active_users,omitempty"`
+}
+
+// Service declares a service running on a node
+type Service struct {
+	ID                 string              `yaml:"id"`
+	NodeID             string              `yaml:"node_id"`
+	Name               string              `yaml:"name"`
+	Protocol           string              `yaml:"protocol"`
+	SecretKey          string              `yaml:"secret_key,omitempty"`
+	AllowedAuthMethods []domain.AuthMethod `yaml:"allowed_auth_methods,omitempty"`
+	CallbackURL        string              `yaml:"callback_url,omitempty"`
+	ManagerID          string              `yaml:"manager_id,omitempty"`
+}
+
+// Read decodes a state document
+func Read(r io.Reader) (*State, error) {
+	s := &State{}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode state: %w", err)
+	}
+	return s, nil
+}
+
+// Write encodes the state document as YAML
+func (s *State) Write(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Validate checks the document version, required fields, duplicate IDs and
+// references between entries. known reports whether a manager or node ID that
+// is not declared in the document may still be referenced.
+func (s *State) Validate(known func(kind, id string) bool) error {
+	if s.Version != Version {
+		return fmt.Errorf("unsupported state version %d (expected %d)", s.Version, Version)
+	}
+
+	managers := make(map[string]bool, len(s.Managers))
+	for _, m := range s.Managers {
+		if m.ID == "" || m.Name == "" {
+			return fmt.Errorf("manager %q: id and name are required", m.ID)
+		}
+		if managers[m.ID] {
+			return fmt.Errorf("manager %q is declared twice", m.ID)
+		}
+		managers[m.ID] = true
+	}
+	managerExists := func(id string) bool {
+		return id == "" || managers[id] || (known != nil && known("manager", id))
+	}
+	for _, m := range s.Managers {
+		if !managerExists(m.ParentID) {
+			return fmt.Errorf("manager %q: parent %q not found", m.ID, m.ParentID)
+		}
+	}
+
+	nodes := make(map[string]bool, len(s.Nodes))
+	for _, n := range s.Nodes {
+		if n.ID == "" || n.Name == "" {
+			return fmt.Errorf("node %q: id and name are required", n.ID)
+		}
+		if nodes[n.ID] {
+			return fmt.Errorf("node %q is declared twice", n.ID)
+		}
+		if !managerExists(n.ManagerID) {
+			return fmt.Errorf("node %q: manager %q not found", n.ID, n.ManagerID)
+		}
+		nodes[n.ID] = true
+	}
+
+	services := make(map[string]bool, len(s.Services))
+	for _, svc := range s.Services {
+		if svc.ID == "" || svc.Name == "" || svc.NodeID == "" || svc.Protocol == "" {
+			return fmt.Errorf("service %q: id, name, node_id and protocol are required", svc.ID)
+		}
+		if services[svc.ID] {
+			return fmt.Errorf("service %q is declared twice", svc.ID)
+		}
+		if !nodes[svc.NodeID] && (known == nil || !known("node", svc.NodeID)) {
+			return fmt.Errorf("service %q: node %q not found", svc.ID, svc.NodeID)
+		}
+		if !managerExists(svc.ManagerID) {
+			return fmt.Errorf("service %q: manager %q not found", svc.ID, svc.ManagerID)
+		}
+		services[svc.ID] = true
+	}
+
+	return nil
+}
+
+// ExportOptions controls what Export includes
+type ExportOptions struct {
+	// IncludeSecrets writes node and service secret keys into the document
+	IncludeSecrets bool
+}
+
+// Export reads the current fleet definition from db
+func Export(db *sqlite.UserDB, opts ExportOptions) (*State, error) {
+	s := &State{Version: Version}
+
+	managers, err := db.ListManagers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list managers: %w", err)
+	}
+	for _, m := range managers {
+		s.Managers = append(s.Managers, managerSpec(m))
+	}
+
+	nodes, err := db.ListNodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	for _, n := range nodes {
+		s.Nodes = append(s.Nodes, nodeSpec(n, opts.IncludeSecrets))
+	}
+
+	services, err := db.ListServices()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	for _, svc := range services {
+		s.Services = append(s.Services, serviceSpec(svc, opts.IncludeSecrets))
+	}
+
+	sort.Slice(s.Managers, func(i, j int) bool { return s.Managers[i].ID < s.Managers[j].ID })
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].ID < s.Nodes[j].ID })
+	sort.Slice(s.Services, func(i, j int) bool { return s.Services[i].ID < s.Services[j].ID })
+
+	return s, nil
+}
+
+// ApplyOptions controls how Apply reconciles the database
+type ApplyOptions struct {
+	// Prune deletes nodes and services that the document does not declare.
+	// Managers are never pruned.
+	Prune bool
+	// DryRun computes the changes without writing them
+	DryRun bool
+}
+
+// Action is the kind of change Apply makes to an entry
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+)
+
+// Change describes one change Apply made or, in a dry run, would make
+type Change struct {
+	Action Action
+	Kind   string
+	ID     string
+	Note   string
+}
+
+func (c Change) String() string {
+	if c.Note == "" {
+		return fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.ID)
+	}
+	return fmt.Sprintf("%s %s %s (%s)", c.Action, c.Kind, c.ID, c.Note)
+}
+
+// Apply reconciles db with the document: missing entries are created,
+// entries that differ are updated, and with Prune undeclared nodes and
+// services are deleted. Secrets omitted from the document keep their current
+// value; new nodes and services without one get a generated secret, reported
+// in the change note.
+func Apply(db *sqlite.UserDB, s *State, opts ApplyOptions) ([]Change, error) {
+	known := func(kind, id string) bool {
+		if kind == "manager" {
+			m, err := db.GetManager(id)
+			return err == nil && m != nil
+		}
+		n, err := db.GetNode(id)
+		return err == nil && n != nil && !opts.Prune
+	}
+	if err := s.Validate(known); err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	record := func(c Change, write func() error) error {
+		if !opts.DryRun {
+			if err := write(); err != nil {
+				return fmt.Errorf("%s %s %s: %w", c.Action, c.Kind, c.ID, err)
+			}
+		}
+		changes = append(changes, c)
+		return nil
+	}
+
+	managers, err := orderManagers(s.Managers)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range managers {
+		existing, err := db.GetManager(spec.ID)
+		if err != nil {
+			return nil, err
+		}
+		desired := spec.toDomain(existing)
+		switch {
+		case existing == nil:
+			err = record(Change{Action: ActionCreate, Kind: "manager", ID: spec.ID}, func() error {
+				return db.CreateManager(desired)
+			})
+		case !sameDefinition(managerSpec(existing), managerSpec(desired)):
+			err = record(Change{Action: ActionUpdate, Kind: "manager", ID: spec.ID}, func() error {
+				return db.UpdateManager(desired)
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, spec := range s.Nodes {
+		existing, err := db.GetNode(spec.ID)
+		if err != nil {
+			return nil, err
+		}
+		desired := spec.toDomain(existing)
+		switch {
+		case existing == nil:
+			note := ""
+			if spec.SecretKey == "" {
+				note = "generated secret_key " + desired.SecretKey
+			}
+			err = record(Change{Action: ActionCreate, Kind: "node", ID: spec.ID, Note: note}, func() error {
+				return db.CreateNode(desired)
+			})
+		case !sameDefinition(nodeSpec(existing, true), nodeSpec(desired, true)):
+			err = record(Change{Action: ActionUpdate, Kind: "node", ID: spec.ID}, func() error {
+				return db.UpdateNode(desired)
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, spec := range s.Services {
+		existing, err := db.GetService(spec.ID)
+		if err != nil {
+			return nil, err
+		}
+		desired := spec.toDomain(existing)
+		switch {
+		case existing == nil:
+			note := ""
+			if spec.SecretKey == "" {
+				note = "generated secret_key " + desired.SecretKey
+			}
+			err = record(Change{Action: ActionCreate, Kind: "service", ID: spec.ID, Note: note}, func() error {
+				return db.CreateService(desired)
+			})
+		case !sameDefinition(serviceSpec(existing, true), serviceSpec(desired, true)):
+			err = record(Change{Action: ActionUpdate, Kind: "service", ID: spec.ID}, func() error {
+				return db.UpdateService(desired)
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Prune {
+		if err := prune(db, s, record); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// prune deletes services and then nodes that the document does not declare.
+// Deletions go through record, so they land in the shared change list.
+func prune(db *sqlite.UserDB, s *State, record func(Change, func() error) error) error {
+	declaredServices := make(map[string]bool, len(s.Services))
+	for _, svc := range s.Services {
+		declaredServices[svc.ID] = true
+	}
+	declaredNodes := make(map[string]bool, len(s.Nodes))
+	for _, n := range s.Nodes {
+		declaredNodes[n.ID] = true
+	}
+
+	services, err := db.ListServices()
+	if err != nil {
+		return err
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	for _, svc := range services {
+		if declaredServices[svc.ID] {
+			continue
+		}
+		id := svc.ID
+		if err := record(Change{Action: ActionDelete, Kind: "service", ID: id}, func() error {
+			return db.DeleteService(id)
+		}); err != nil {
+			return err
+		}
+	}
+
+	nodes, err := db.ListNodes()
+	if err != nil {
+		return err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	for _, n := range nodes {
+		if declaredNodes[n.ID] {
+			continue
+		}
+		id := n.ID
+		if err := record(Change{Action: ActionDelete, Kind: "node", ID: id}, func() error {
+			return db.DeleteNode(id)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// orderManagers returns managers with every declared parent ahead of its
+// children, rejecting cycles
+func orderManagers(managers []Manager) ([]Manager, error) {
+	byID := make(map[string]Manager, len(managers))
+	for _, m := range managers {
+		byID[m.ID] = m
+	}
+
+	ordered := make([]Manager, 0, len(managers))
+	state := make(map[string]int, len(managers)) // 1 visiting, 2 done
+	var visit func(m Manager) error
+	visit = func(m Manager) error {
+		switch state[m.ID] {
+		case 1:
+			return fmt.Errorf("manager %q is part of a parent cycle", m.ID)
+		case 2:
+			return nil
+		}
+		state[m.ID] = 1
+		if parent, ok := byID[m.ParentID]; ok {
+			if err := visit(parent); err != nil {
+				return err
+			}
+		}
+		state[m.ID] = 2
+		ordered = append(ordered, m)
+		return nil
+	}
+	for _, m := range managers {
+		if err := visit(m); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// sameDefinition compares two specs by their JSON encoding, which treats
+// numbers decoded from YAML and from stored JSON metadata alike
+func sameDefinition(a, b interface{}) bool {
+	left, errA := json.Marshal(a)
+	right, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(left) == string(right)
+}
+
+func managerSpec(m *domain.Manager) Manager {
+	spec := Manager{ID: m.ID, Name: m.Name, Metadata: m.Metadata}
+	if m.ParentID != nil {
+		spec.ParentID = *m.ParentID
+	}
+	if len(spec.Metadata) == 0 {
+		spec.Metadata = nil
+	}
+	if p := m.Package; p != nil {
+		spec.Package = ManagerPackage{
+			TotalLimit:     p.TotalLimit,
+			UploadLimit:    p.UploadLimit,
+			DownloadLimit:  p.DownloadLimit,
+			ResetMode:      p.ResetMode,
+			Duration:       p.Duration,
+			MaxSessions:    p.MaxSessions,
+			MaxOnlineUsers: p.MaxOnlineUsers,
+			MaxActiveUsers: p.MaxActiveUsers,
+			Status:         p.Status,
+		}
+	}
+	return spec
+}
+
+// toDomain builds the desired manager, keeping the package start time of an
+// existing manager
+func (m Manager) toDomain(existing *domain.Manager) *domain.Manager {
+	pkg := &domain.ManagerPackage{
+		ManagerID:      m.ID,
+		TotalLimit:     m.Package.TotalLimit,
+		UploadLimit:    m.Package.UploadLimit,
+		DownloadLimit:  m.Package.DownloadLimit,
+		ResetMode:      m.Package.ResetMode,
+		Duration:       m.Package.Duration,
+		MaxSessions:    m.Package.MaxSessions,
+		MaxOnlineUsers: m.Package.MaxOnlineUsers,
+		MaxActiveUsers: m.Package.MaxActiveUsers,
+		Status:         m.Package.Status,
+	}
+	if pkg.ResetMode == "" {
+		pkg.ResetMode = domain.ResetModeNoReset
+	}
+	if pkg.Status == "" {
+		pkg.Status = domain.ManagerPackageStatusActive
+	}
+	if existing != nil && existing.Package != nil {
+		pkg.StartAt = existing.Package.StartAt
+	}
+
+	manager := &domain.Manager{ID: m.ID, Name: m.Name, Metadata: m.Metadata, Package: pkg}
+	if m.ParentID != "" {
+		parentID := m.ParentID
+		manager.ParentID = &parentID
+	}
+	return manager
+}
+
+func nodeSpec(n *domain.Node, withSecret bool) Node {
+	spec := Node{
+		ID:                n.ID,
+		Name:              n.Name,
+		AllowedIPs:        n.AllowedIPs,
+		TrafficMultiplier: n.TrafficMultiplier,
+		ResetMode:         n.ResetMode,
+		ResetDay:          n.ResetDay,
+		Country:           n.Country,
+		City:              n.City,
+		ISP:               n.ISP,
+		MaxActiveUsers:    n.MaxActiveUsers,
+	}
+	if withSecret {
+		spec.SecretKey = n.SecretKey
+	}
+	if len(spec.AllowedIPs) == 0 {
+		spec.AllowedIPs = nil
+	}
+	if n.ManagerID != nil {
+		spec.ManagerID = *n.ManagerID
+	}
+	return spec
+}
+
+// toDomain builds the desired node, keeping the existing secret when the
+// document omits it and generating one for a new node
+func (n Node) toDomain(existing *domain.Node) *domain.Node {
+	node := &domain.Node{
+		ID:                n.ID,
+		SecretKey:         n.SecretKey,
+		Name:              n.Name,
+		AllowedIPs:        n.AllowedIPs,
+		TrafficMultiplier: n.TrafficMultiplier,
+		ResetMode:         n.ResetMode,
+		ResetDay:          n.ResetDay,
+		Country:           n.Country,
+		City:              n.City,
+		ISP:               n.ISP,
+		MaxActiveUsers:    n.MaxActiveUsers,
+	}
+	if node.TrafficMultiplier == 0 {
+		node.TrafficMultiplier = 1
+	}
+	if node.ResetMode == "" {
+		node.ResetMode = domain.ResetModeNoReset
+	}
+	if n.ManagerID != "" {
+		managerID := n.ManagerID
+		node.ManagerID = &managerID
+	}
+	if node.SecretKey == "" {
+		if existing != nil {
+			node.SecretKey = existing.SecretKey
+		} else {
+			node.SecretKey = uuid.New().String()
+		}
+	}
+	return node
+}
+
+func serviceSpec(s *domain.Service, withSecret bool) Service {
+	spec := Service{
+		ID:                 s.ID,
+		NodeID:             s.NodeID,
+		Name:               s.Name,
+		Protocol:           s.Protocol,
+		AllowedAuthMethods: s.AllowedAuthMethods,
+		CallbackURL:        s.CallbackURL,
+	}
+	if withSecret {
+		spec.SecretKey = s.SecretKey
+	}
+	if len(spec.AllowedAuthMethods) == 0 {
+		spec.AllowedAuthMethods = nil
+	}
+	if s.ManagerID != nil {
+		spec.ManagerID = *s.ManagerID
+	}
+	return spec
+}
+
+// toDomain builds the desired service, keeping the existing secret when the
+// document omits it and generating one for a new service
+func (s Service) toDomain(existing *domain.Service) *domain.Service {
+	service := &domain.Service{
+		ID:                 s.ID,
+		SecretKey:          s.SecretKey,
+		NodeID:             s.NodeID,
+		Name:               s.Name,
+		Protocol:           s.Protocol,
+		AllowedAuthMethods: s.AllowedAuthMethods,
+		CallbackURL:        s.CallbackURL,
+	}
+	if s.ManagerID != "" {
+		managerID := s.ManagerID
+		service.ManagerID = &managerID
+	}
+	if service.SecretKey == "" {
+		if existing != nil {
+			service.SecretKey = existing.SecretKey
+		} else {
+			service.SecretKey = uuid.New().String()
+		}
+	}
+	service.AccessToken = service.SecretKey
+	return service
+}
@@ -0,0 +1,181 @@
+package state
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+)
+
+func newStateDB(t *testing.T) *sqlite.UserDB {
+	t.Helper()
+
+	db, err := sqlite.NewUserDB("sqlite://" + filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+const fleetYAML = `
+version: 1
+managers:
+  - id: child
+    name: Child
+    parent_id: root
+    package:
+      total_limit: 500
+  - id: root
+    name: Root
+    metadata:
+      region: eu
+      tier: 2
+    package:
+      total_limit: 1000
+      max_sessions: 10
+nodes:
+  - id: node-1
+    name: Frankfurt
+    secret_key: node-secret
+    allowed_ips: [10.0.0.1]
+    traffic_multiplier: 1.5
+    manager_id: root
+services:
+  - id: svc-1
+    node_id: node-1
+    name: vless
+    protocol: vless
+    secret_key: svc-secret
+    allowed_auth_methods: [uuid]
+`
+
+func TestApplyCreatesThenIsIdempotent(t *testing.T) {
+	db := newStateDB(t)
+
+	s, err := Read(strings.NewReader(fleetYAML))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	changes, err := Apply(db, s, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if len(changes) != 4 || changes[0].ID != "root" || changes[1].ID != "child" {
+		t.Fatalf("expected parents created first, got %v", changes)
+	}
+
+	child, _ := db.GetManager("child")
+	if child == nil || child.ParentID == nil || *child.ParentID != "root" || child.Package.TotalLimit != 500 {
+		t.Fatalf("unexpected child manager: %+v", child)
+	}
+	node, _ := db.GetNode("node-1")
+	if node == nil || node.TrafficMultiplier != 1.5 || node.ManagerID == nil || *node.ManagerID != "root" {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+	if ok, _ := db.ValidateServiceAuthKey("svc-1", "svc-secret"); !ok {
+		t.Fatalf("expected service key to be registered")
+	}
+
+	changes, err = Apply(db, s, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("re-apply: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes on re-apply, got %v", changes)
+	}
+}
+
+func TestExportRoundTripsWithoutSecrets(t *testing.T) {
+	db := newStateDB(t)
+	s, _ := Read(strings.NewReader(fleetYAML))
+	if _, err := Apply(db, s, ApplyOptions{}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	exported, err := Export(db, ExportOptions{})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := exported.Write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("expected secrets to be left out:\n%s", buf.String())
+	}
+
+	reread, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("read exported: %v", err)
+	}
+	changes, err := Apply(db, reread, ApplyOptions{})
+	if err != nil {
+		t.Fatalf("apply exported: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("expected exported state to match the database, got %v", changes)
+	}
+	if node, _ := db.GetNode("node-1"); node.SecretKey != "node-secret" {
+		t.Fatalf("expected omitted secret to be kept, got %q", node.SecretKey)
+	}
+}
+
+func TestApplyUpdatesPrunesAndDryRuns(t *testing.T) {
+	db := newStateDB(t)
+	s, _ := Read(strings.NewReader(fleetYAML))
+	if _, err := Apply(db, s, ApplyOptions{}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if err := db.CreateNode(&domain.Node{ID: "stray", SecretKey: "stray-secret", Name: "stray", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+		t.Fatalf("create stray node: %v", err)
+	}
+
+	s.Nodes[0].TrafficMultiplier = 2
+	changes, err := Apply(db, s, ApplyOptions{Prune: true, DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(changes) != 2 || changes[0].Action != ActionUpdate || changes[1].Action != ActionDelete || changes[1].ID != "stray" {
+		t.Fatalf("unexpected dry-run changes: %v", changes)
+	}
+	if node, _ := db.GetNode("stray"); node == nil {
+		t.Fatalf("dry run must not delete")
+	}
+
+	if _, err := Apply(db, s, ApplyOptions{Prune: true}); err != nil {
+		t.Fatalf("apply with prune: %v", err)
+	}
+	if node, _ := db.GetNode("stray"); node != nil {
+		t.Fatalf("expected stray node to be pruned")
+	}
+	if node, _ := db.GetNode("node-1"); node.TrafficMultiplier != 2 {
+		t.Fatalf("expected multiplier update, got %v", node.TrafficMultiplier)
+	}
+}
+
+func TestValidateRejectsBadReferences(t *testing.T) {
+	cases := map[string]string{
+		"unknown node":   "version: 1\nservices:\n  - {id: s, node_id: missing, name: s, protocol: vless}\n",
+		"duplicate node": "version: 1\nnodes:\n  - {id: n, name: a}\n  - {id: n, name: b}\n",
+		"bad version":    "version: 7\n",
+		"parent cycle":   "version: 1\nmanagers:\n  - {id: a, name: a, parent_id: b}\n  - {id: b, name: b, parent_id: a}\n",
+	}
+	for name, doc := range cases {
+		db := newStateDB(t)
+		s, err := Read(strings.NewReader(doc))
+		if err != nil {
+			t.Fatalf("%s: read: %v", name, err)
+		}
+		if _, err := Apply(db, s, ApplyOptions{}); err == nil {
+			t.Fatalf("%s: expected apply to fail", name)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+)
+
+// Cache holds the hot state the engine consults on every report: cached
+// users and rejections, sessions, penalties, recent report results, node
+// flags, usage waiting to be written and the disconnect queue. MemoryCache
+// keeps it in process; RedisCache shares everything but the node flags and
+// the unwritten usage between HUE instances.
+type Cache interface {
+	// Users
+	SetUser(userID string, status domain.UserStatus, packageID *string, maxConcurrent int)
+	GetUser(userID string) *UserCacheEntry
+	UpdateUserUsage(userID string, upload, download int64)
+	DeleteUser(userID string)
+	ForgetUser(userID string)
+
+	// Sessions
+	GetOrCreateSessionCache(userID string) *SessionCache
+	RangeSessions(userID string, fn func(sessionID string, session *SessionEntry) bool)
+	RangeAllSessions(fn func(userID string, sessionCache *SessionCache) bool)
+
+	// Penalties
+	SetPenalty(userID, reason string, action domain.PenaltyAction, duration time.Duration)
+	GetPenalty(userID string) *PenaltyEntry
+	ClearPenalty(userID string)
+	RangePenalties(fn func(userID string, penalty *PenaltyEntry) bool)
+	RecordOffense(userID string, window time.Duration) int
+
+	// Cached rejections
+	SetDecision(userID, reason string, code domain.ReasonCode, ttl time.Duration)
+	GetDecision(userID string) *DecisionEntry
+	ClearDecision(userID string)
+
+	// Processed report results, for deduplicating retried reports
+	SetReportResult(reportID string, result *domain.UsageReportResult, ttl time.Duration)
+	GetReportResult(reportID string) *domain.UsageReportResult
+	ClearReportResult(reportID string)
+
+	// Nodes
+	SetNodeDraining(nodeID string, draining bool)
+	IsNodeDraining(nodeID string) bool
+	RecordNodeHeartbeat(nodeID string, at time.Time)
+	RecordNodeReport(nodeID string, accepted bool)
+	NodeActivity(nodeID string) (time.Time, float64)
+
+	// Write-behind usage
+	AddPendingUsage(usage PendingUsage)
+	GetPendingUsage(kind UsageKind, id string) PendingUsage
+	TakePendingUsage(kind UsageKind, id string) PendingUsage
+	RangePendingUsage(fn func(usage PendingUsage) bool)
+
+	// Disconnect queue
+	QueueDisconnect(userID, sessionID, reason, nodeID string)
+	GetDisconnectBatch() []*DisconnectCommand
+	TakeDisconnects(nodeID string, limit int, lease time.Duration) []*DisconnectCommand
+	AckDisconnects(nodeID string, ids []string) int
+	PendingDisconnects(nodeID string) int
+}
+
+var _ Cache = (*MemoryCache)(nil)
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// EvictReason tells why an entry left a bounded cache map
+type EvictReason string
+
+const (
+	EvictExpired  EvictReason = "expired"  // Older than the TTL
+	EvictCapacity EvictReason = "capacity" // Least recently used past the entry cap
+)
+
+// lruSweepInterval bounds how often an lruMap scans for expired entries
+const lruSweepInterval = time.Minute
+
+// lruMap is a string-keyed map whose entries expire ttl after they were
+// stored and which drops its least recently used entry past capacity. A zero
+// ttl or capacity disables that bound.
+type lruMap[V any] struct {
+	mu        sync.Mutex
+	items     map[string]*list.Element
+	order     *list.List // Most recently used first
+	ttl       time.Duration
+	capacity  int
+	lastSweep time.Time
+	onEvict   func(reason EvictReason)
+}
+
+type lruItem[V any] struct {
+	key      string
+	value    V
+	storedAt time.Time
+}
+
+func newLRUMap[V any]() *lruMap[V] {
+	return &lruMap[V]{
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// setLimits changes the bounds; entries past a lower capacity are dropped
+func (m *lruMap[V]) setLimits(ttl time.Duration, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ttl = ttl
+	m.capacity = capacity
+	m.trim()
+}
+
+// setEvictionObserver has fn called for every entry that is evicted
+func (m *lruMap[V]) setEvictionObserver(fn func(reason EvictReason)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onEvict = fn
+}
+
+// load returns the value stored under key and marks it recently used
+func (m *lruMap[V]) load(key string) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var zero V
+	elem, ok := m.items[key]
+	if !ok {
+		return zero, false
+	}
+	item := elem.Value.(*lruItem[V])
+	if m.expired(item, time.Now()) {
+		m.remove(elem, EvictExpired)
+		return zero, false
+	}
+	m.order.MoveToFront(elem)
+	return item.value, true
+}
+
+// store sets the value under key, restarting its TTL
+func (m *lruMap[V]) store(key string, value V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := m.items[key]; ok {
+		item := elem.Value.(*lruItem[V])
+		item.value = value
+		item.storedAt = now
+		m.order.MoveToFront(elem)
+	} else {
+		m.items[key] = m.order.PushFront(&lruItem[V]{key: key, value: value, storedAt: now})
+	}
+	m.trim()
+	m.sweep(now)
+}
+
+// delete drops the entry under key; it does not count as an eviction
+func (m *lruMap[V]) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		m.order.Remove(elem)
+		delete(m.items, key)
+	}
+}
+
+// len returns the number of entries, expired ones not yet swept included
+func (m *lruMap[V]) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.items)
+}
+
+func (m *lruMap[V]) expired(item *lruItem[V], now time.Time) bool {
+	return m.ttl > 0 && now.Sub(item.storedAt) > m.ttl
+}
+
+// trim drops least recently used entries past the capacity
+func (m *lruMap[V]) trim() {
+	for m.capacity > 0 && len(m.items) > m.capacity {
+		m.remove(m.order.Back(), EvictCapacity)
+	}
+}
+
+// sweep drops expired entries, at most once per lruSweepInterval
+func (m *lruMap[V]) sweep(now time.Time) {
+	if m.ttl <= 0 || now.Sub(m.lastSweep) < lruSweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for elem := m.order.Front(); elem != nil; {
+		next := elem.Next()
+		if m.expired(elem.Value.(*lruItem[V]), now) {
+			m.remove(elem, EvictExpired)
+		}
+		elem = next
+	}
+}
+
+func (m *lruMap[V]) remove(elem *list.Element, reason EvictReason) {
+	item := m.order.Remove(elem).(*lruItem[V])
+	delete(m.items, item.key)
+	if m.onEvict != nil {
+		m.onEvict(reason)
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/hiddify/hue-go/internal/domain"
 )
 
 // MemoryCache provides in-memory caching for active users and sessions
 type MemoryCache struct {
-	// User status cache
-	users sync.Map // map[string]*UserCacheEntry
+	// User status cache, bounded by SetLimits
+	users *lruMap[*UserCacheEntry]
 
 	// Session tracking
 	sessions sync.Map // map[string]*SessionCache // key: userID
@@ -18,12 +19,35 @@ type MemoryCache struct {
 	// Penalty tracking
 	penalties sync.Map // map[string]*PenaltyEntry // key: userID
 
-	// Node cache
-	nodes sync.Map // map[string]*NodeCacheEntry
+	// Recent penalty counts for escalation
+	offenses  sync.Map // map[string]*offenseEntry // key: userID
+	offenseMu sync.Mutex
+
+	// Cached negative quota decisions
+	decisions sync.Map // map[string]*DecisionEntry // key: userID
+
+	// Results of recently processed reports, for deduplicating retries
+	reports      sync.Map // map[string]*reportEntry // key: report ID
+	reportsMu    sync.Mutex
+	reportsSweep time.Time
+
+	// Node cache, bounded by SetLimits
+	nodes *lruMap[*NodeCacheEntry]
+
+	// Nodes currently draining, kept apart from the node entries so the flag
+	// can be flipped by heartbeats while reports read it
+	drainingNodes sync.Map // map[string]struct{} // key: nodeID
+
+	// Heartbeats and report outcomes per node, for health scores
+	nodeActivity sync.Map // map[string]*NodeActivity // key: nodeID
 
 	// Prepared disconnect commands
 	disconnectQueue []*DisconnectCommand
 	disconnectMu    sync.Mutex
+
+	// Charged traffic not yet written to the database
+	pendingUsage   map[pendingUsageKey]*PendingUsage
+	pendingUsageMu sync.Mutex
 }
 
 // UserCacheEntry represents cached user data
@@ -43,27 +67,71 @@ type SessionCache struct {
 	UserID   string
 	Sessions map[string]*SessionEntry // key: IP hash or session ID
 	mu       sync.RWMutex
+
+	// Sustained speed tracking: when the user's throughput first went above
+	// the alert threshold, and whether that stretch was already flagged
+	speedAboveSince time.Time
+	speedFlagged    bool
+
+	// persist, when set, receives the sessions after every change so a
+	// shared cache can store them
+	persist func(userID string, sessions []SessionEntry)
 }
 
 // SessionEntry represents an active session
 type SessionEntry struct {
 	SessionID  string
+	Identity   string // Concurrency identity (session, subnet or device key)
+	NodeID     string // Node the session was last reported from
 	IPHash     string // Hashed IP for privacy
 	Country    string
 	City       string
 	ISP        string
+	ASN        uint
 	StartedAt  time.Time
 	LastSeenAt time.Time
+
+	// Estimated throughput in bits per second, smoothed over reports, and
+	// when the last report feeding it arrived
+	UploadBps   float64
+	DownloadBps float64
+	RateAt      time.Time
+	rated       bool
 }
 
 // PenaltyEntry tracks a temporary penalty
 type PenaltyEntry struct {
 	UserID    string
 	Reason    string
+	Action    domain.PenaltyAction
 	AppliedAt time.Time
 	ExpiresAt time.Time
 }
 
+// offenseEntry counts a user's penalties that came within the escalation
+// window of the previous one
+type offenseEntry struct {
+	count  int
+	lastAt time.Time
+}
+
+// DecisionEntry is a cached rejection served without a database lookup
+type DecisionEntry struct {
+	UserID     string
+	Reason     string
+	ReasonCode domain.ReasonCode
+	ExpiresAt  time.Time
+}
+
+// reportEntry is the result of a processed report, kept for the dedup window
+type reportEntry struct {
+	result    domain.UsageReportResult
+	expiresAt time.Time
+}
+
+// reportSweepInterval bounds how often expired report results are dropped
+const reportSweepInterval = time.Minute
+
 // NodeCacheEntry represents cached node data
 type NodeCacheEntry struct {
 	NodeID            string
@@ -73,26 +141,91 @@ type NodeCacheEntry struct {
 	LastUpdated       time.Time
 }
 
+// NodeActivity tracks a node's last heartbeat and how many of its recent
+// reports were rejected
+type NodeActivity struct {
+	mu              sync.Mutex
+	lastHeartbeatAt time.Time
+	errorRate       float64
+}
+
+// nodeErrorSmoothing is the weight of the newest report in a node's error rate
+const nodeErrorSmoothing = 0.05
+
+// UsageKind names the counters a pending usage delta is written to
+type UsageKind string
+
+const (
+	UsageKindPackage UsageKind = "package" // Also charges the user's manager and groups
+	UsageKindNode    UsageKind = "node"
+	UsageKindService UsageKind = "service"
+)
+
+// PendingUsage is traffic that was charged but not yet written to the
+// database. Deltas for the same counters add up until they are flushed.
+type PendingUsage struct {
+	Kind     UsageKind
+	ID       string
+	UserID   string // The user charged, for packages
+	Upload   int64
+	Download int64
+	LastAt   time.Time
+}
+
+type pendingUsageKey struct {
+	kind UsageKind
+	id   string
+}
+
 // DisconnectCommand represents a pending disconnect command
 type DisconnectCommand struct {
+	ID        string
 	UserID    string
 	SessionID string
 	Reason    string
 	NodeID    string
+	QueuedAt  time.Time
+
+	// LeasedUntil is when a delivered command that was not acknowledged
+	// becomes due for redelivery
+	LeasedUntil time.Time
 }
 
 // NewMemoryCache creates a new MemoryCache instance
 func NewMemoryCache() *MemoryCache {
 	return &MemoryCache{
+		users:           newLRUMap[*UserCacheEntry](),
+		nodes:           newLRUMap[*NodeCacheEntry](),
 		disconnectQueue: make([]*DisconnectCommand, 0, 100),
+		pendingUsage:    make(map[pendingUsageKey]*PendingUsage),
 	}
 }
 
+// SetLimits bounds the cached users and nodes: entries expire ttl after they
+// were loaded, and past maxEntries each map drops its least recently used
+// entry. Zero disables either bound.
+func (c *MemoryCache) SetLimits(ttl time.Duration, maxEntries int) {
+	c.users.setLimits(ttl, maxEntries)
+	c.nodes.setLimits(ttl, maxEntries)
+}
+
+// SetEvictionObserver has fn called with the reason for every cached user or
+// node that expired or was dropped for space
+func (c *MemoryCache) SetEvictionObserver(fn func(reason EvictReason)) {
+	c.users.setEvictionObserver(fn)
+	c.nodes.setEvictionObserver(fn)
+}
+
+// UserCount returns how many users are cached
+func (c *MemoryCache) UserCount() int {
+	return c.users.len()
+}
+
 // User operations
 
 // SetUser caches user data
 func (c *MemoryCache) SetUser(userID string, status domain.UserStatus, packageID *string, maxConcurrent int) {
-	c.users.Store(userID, &UserCacheEntry{
+	c.users.store(userID, &UserCacheEntry{
 		UserID:          userID,
 		Status:          status,
 		ActivePackageID: packageID,
@@ -103,16 +236,15 @@ func (c *MemoryCache) SetUser(userID string, status domain.UserStatus, packageID
 
 // GetUser retrieves cached user data
 func (c *MemoryCache) GetUser(userID string) *UserCacheEntry {
-	if v, ok := c.users.Load(userID); ok {
-		return v.(*UserCacheEntry)
+	if entry, ok := c.users.load(userID); ok {
+		return entry
 	}
 	return nil
 }
 
 // UpdateUserUsage updates the cached usage counters
 func (c *MemoryCache) UpdateUserUsage(userID string, upload, download int64) {
-	if v, ok := c.users.Load(userID); ok {
-		entry := v.(*UserCacheEntry)
+	if entry, ok := c.users.load(userID); ok {
 		entry.CurrentUpload += upload
 		entry.CurrentDownload += download
 		entry.CurrentTotal += upload + download
@@ -122,9 +254,18 @@ func (c *MemoryCache) UpdateUserUsage(userID string, upload, download int64) {
 
 // DeleteUser removes user from cache
 func (c *MemoryCache) DeleteUser(userID string) {
-	c.users.Delete(userID)
+	c.users.delete(userID)
 	c.sessions.Delete(userID)
 	c.penalties.Delete(userID)
+	c.offenses.Delete(userID)
+	c.decisions.Delete(userID)
+}
+
+// ForgetUser drops the cached user data and decision but keeps the user's
+// sessions and penalties
+func (c *MemoryCache) ForgetUser(userID string) {
+	c.users.delete(userID)
+	c.decisions.Delete(userID)
 }
 
 // Session operations
@@ -143,21 +284,38 @@ func (c *MemoryCache) GetOrCreateSessionCache(userID string) *SessionCache {
 	return actual.(*SessionCache)
 }
 
-// AddSession adds a new session
-func (sc *SessionCache) AddSession(sessionID, ipHash, country, city, isp string) {
+// AddSession adds a new session. An empty identity counts the session on its own.
+func (sc *SessionCache) AddSession(sessionID, identity, nodeID, ipHash, country, city, isp string, asn uint) {
 	sc.mu.Lock()
 	defer sc.mu.Unlock()
 
+	if identity == "" {
+		identity = sessionID
+	}
+
 	now := time.Now()
-	sc.Sessions[sessionID] = &SessionEntry{
+	entry := &SessionEntry{
 		SessionID:  sessionID,
+		Identity:   identity,
+		NodeID:     nodeID,
 		IPHash:     ipHash,
 		Country:    country,
 		City:       city,
 		ISP:        isp,
+		ASN:        asn,
 		StartedAt:  now,
 		LastSeenAt: now,
 	}
+	// Re-adding a known session keeps its start time and throughput estimate
+	if prev, ok := sc.Sessions[sessionID]; ok {
+		entry.StartedAt = prev.StartedAt
+		entry.UploadBps = prev.UploadBps
+		entry.DownloadBps = prev.DownloadBps
+		entry.RateAt = prev.RateAt
+		entry.rated = prev.rated
+	}
+	sc.Sessions[sessionID] = entry
+	sc.changed()
 }
 
 // UpdateSessionLastSeen updates the last seen time for a session
@@ -167,7 +325,84 @@ func (sc *SessionCache) UpdateSessionLastSeen(sessionID string) {
 
 	if session, ok := sc.Sessions[sessionID]; ok {
 		session.LastSeenAt = time.Now()
+		sc.changed()
+	}
+}
+
+// speedSmoothing is the weight of the newest interval in a session's
+// throughput estimate
+const speedSmoothing = 0.5
+
+// RecordTraffic feeds a report's byte deltas into the session's throughput
+// estimate. The rate is the bytes over the time since the previous report,
+// smoothed with the earlier estimate; the first report only starts the clock.
+func (sc *SessionCache) RecordTraffic(sessionID string, upload, download int64, at time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	session, ok := sc.Sessions[sessionID]
+	if !ok {
+		return
+	}
+
+	if !session.RateAt.IsZero() {
+		if elapsed := at.Sub(session.RateAt).Seconds(); elapsed > 0 {
+			session.UploadBps = smoothRate(session.UploadBps, float64(upload)*8/elapsed, session.rated)
+			session.DownloadBps = smoothRate(session.DownloadBps, float64(download)*8/elapsed, session.rated)
+			session.rated = true
+		}
+	}
+	if at.After(session.RateAt) {
+		session.RateAt = at
+	}
+	sc.changed()
+}
+
+func smoothRate(previous, current float64, rated bool) float64 {
+	if !rated {
+		return current
+	}
+	return previous + speedSmoothing*(current-previous)
+}
+
+// Throughput sums the estimated rates of sessions that reported within
+// staleAfter; quieter sessions are treated as idle
+func (sc *SessionCache) Throughput(staleAfter time.Duration) (uploadBps, downloadBps float64) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	now := time.Now()
+	for _, session := range sc.Sessions {
+		if session.RateAt.IsZero() || now.Sub(session.RateAt) > staleAfter {
+			continue
+		}
+		uploadBps += session.UploadBps
+		downloadBps += session.DownloadBps
+	}
+	return uploadBps, downloadBps
+}
+
+// SustainedAbove tracks whether the user's throughput stays above threshold.
+// It returns true once per stretch, when bps has been above the threshold for
+// at least sustain, along with when the stretch began.
+func (sc *SessionCache) SustainedAbove(bps, threshold float64, sustain time.Duration, at time.Time) (bool, time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if bps <= threshold {
+		sc.speedAboveSince = time.Time{}
+		sc.speedFlagged = false
+		return false, time.Time{}
+	}
+
+	if sc.speedAboveSince.IsZero() {
+		sc.speedAboveSince = at
+	}
+	if sc.speedFlagged || at.Sub(sc.speedAboveSince) < sustain {
+		return false, sc.speedAboveSince
 	}
+	sc.speedFlagged = true
+	return true, sc.speedAboveSince
 }
 
 // RemoveSession removes a session
@@ -175,24 +410,129 @@ func (sc *SessionCache) RemoveSession(sessionID string) {
 	sc.mu.Lock()
 	defer sc.mu.Unlock()
 
-	delete(sc.Sessions, sessionID)
+	if _, ok := sc.Sessions[sessionID]; ok {
+		delete(sc.Sessions, sessionID)
+		sc.changed()
+	}
 }
 
-// GetActiveSessionCount returns the number of active sessions within the window
+// GetActiveSessionCount returns the number of distinct session identities
+// active within the window
 func (sc *SessionCache) GetActiveSessionCount(window time.Duration) int {
 	sc.mu.RLock()
 	defer sc.mu.RUnlock()
 
 	now := time.Now()
-	count := 0
+	identities := make(map[string]struct{}, len(sc.Sessions))
 
 	for _, session := range sc.Sessions {
 		if now.Sub(session.LastSeenAt) <= window {
-			count++
+			identities[session.identityKey()] = struct{}{}
 		}
 	}
 
-	return count
+	return len(identities)
+}
+
+// HasActiveIdentity checks if any session with the identity was seen within the window
+func (sc *SessionCache) HasActiveIdentity(identity string, window time.Duration) bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	now := time.Now()
+	for _, session := range sc.Sessions {
+		if session.identityKey() == identity && now.Sub(session.LastSeenAt) <= window {
+			return true
+		}
+	}
+	return false
+}
+
+// Rekey moves sessions whose IP hash or identity was taken under a previous
+// salt to the current values, so the same client keeps matching after the
+// salt rotates. Empty previous values are skipped.
+func (sc *SessionCache) Rekey(previousIPHash, currentIPHash, previousIdentity, currentIdentity string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for _, session := range sc.Sessions {
+		if previousIPHash != "" && session.IPHash == previousIPHash {
+			session.IPHash = currentIPHash
+		}
+		if previousIdentity != "" && session.Identity == previousIdentity {
+			session.Identity = currentIdentity
+		}
+	}
+	sc.changed()
+}
+
+// GetActiveIPCount returns the number of distinct IP hashes seen within the
+// window. Sessions reported without a client IP are not counted.
+func (sc *SessionCache) GetActiveIPCount(window time.Duration) int {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	now := time.Now()
+	ips := make(map[string]struct{}, len(sc.Sessions))
+
+	for _, session := range sc.Sessions {
+		if session.IPHash != "" && now.Sub(session.LastSeenAt) <= window {
+			ips[session.IPHash] = struct{}{}
+		}
+	}
+
+	return len(ips)
+}
+
+// HasActiveIP checks if any session from the IP hash was seen within the window
+func (sc *SessionCache) HasActiveIP(ipHash string, window time.Duration) bool {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	now := time.Now()
+	for _, session := range sc.Sessions {
+		if session.IPHash == ipHash && now.Sub(session.LastSeenAt) <= window {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SessionEntry) identityKey() string {
+	if s.Identity != "" {
+		return s.Identity
+	}
+	return s.SessionID
+}
+
+// ReplaceStaleSession removes the least recently seen session with the given
+// IP hash that has been quiet for at least staleAfter, other than keepID. It
+// returns the removed session ID, or "" if none matched.
+func (sc *SessionCache) ReplaceStaleSession(ipHash, keepID string, staleAfter time.Duration) string {
+	if ipHash == "" {
+		return ""
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	var stale *SessionEntry
+	for id, session := range sc.Sessions {
+		if id == keepID || session.IPHash != ipHash || now.Sub(session.LastSeenAt) < staleAfter {
+			continue
+		}
+		if stale == nil || session.LastSeenAt.Before(stale.LastSeenAt) {
+			stale = session
+		}
+	}
+	if stale == nil {
+		return ""
+	}
+
+	delete(sc.Sessions, stale.SessionID)
+	sc.changed()
+	return stale.SessionID
 }
 
 // HasSession checks if a session exists
@@ -203,25 +543,62 @@ func (sc *SessionCache) HasSession(sessionID string) bool {
 	return ok
 }
 
-// GetSessions returns all sessions
-func (sc *SessionCache) GetSessions() []*SessionEntry {
+// GetSession returns a copy of a single session
+func (sc *SessionCache) GetSession(sessionID string) (SessionEntry, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	session, ok := sc.Sessions[sessionID]
+	if !ok {
+		return SessionEntry{}, false
+	}
+	return *session, true
+}
+
+// GetSessions returns copies of all sessions, taken under the lock so callers
+// never read entries that a concurrent report is updating
+func (sc *SessionCache) GetSessions() []SessionEntry {
 	sc.mu.RLock()
 	defer sc.mu.RUnlock()
 
-	sessions := make([]*SessionEntry, 0, len(sc.Sessions))
+	return sc.snapshot()
+}
+
+// snapshot copies the sessions; callers hold the lock
+func (sc *SessionCache) snapshot() []SessionEntry {
+	sessions := make([]SessionEntry, 0, len(sc.Sessions))
 	for _, s := range sc.Sessions {
-		sessions = append(sessions, s)
+		sessions = append(sessions, *s)
 	}
 	return sessions
 }
 
+// changed hands the sessions to persist; callers hold the write lock
+func (sc *SessionCache) changed() {
+	if sc.persist != nil {
+		sc.persist(sc.UserID, sc.snapshot())
+	}
+}
+
+// replace swaps in sessions loaded from a shared cache
+func (sc *SessionCache) replace(sessions []SessionEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.Sessions = make(map[string]*SessionEntry, len(sessions))
+	for i := range sessions {
+		sc.Sessions[sessions[i].SessionID] = &sessions[i]
+	}
+}
+
 // Penalty operations
 
 // SetPenalty sets a penalty for a user
-func (c *MemoryCache) SetPenalty(userID, reason string, duration time.Duration) {
+func (c *MemoryCache) SetPenalty(userID, reason string, action domain.PenaltyAction, duration time.Duration) {
 	c.penalties.Store(userID, &PenaltyEntry{
 		UserID:    userID,
 		Reason:    reason,
+		Action:    action,
 		AppliedAt: time.Now(),
 		ExpiresAt: time.Now().Add(duration),
 	})
@@ -246,6 +623,96 @@ func (c *MemoryCache) ClearPenalty(userID string) {
 	c.penalties.Delete(userID)
 }
 
+// RecordOffense counts a penalty against a user and returns how many
+// penalties in a row came within window of the previous one, this one
+// included
+func (c *MemoryCache) RecordOffense(userID string, window time.Duration) int {
+	c.offenseMu.Lock()
+	defer c.offenseMu.Unlock()
+
+	now := time.Now()
+	entry := &offenseEntry{}
+	if v, ok := c.offenses.Load(userID); ok && now.Sub(v.(*offenseEntry).lastAt) <= window {
+		entry = v.(*offenseEntry)
+	}
+	entry.count++
+	entry.lastAt = now
+	c.offenses.Store(userID, entry)
+	return entry.count
+}
+
+// Decision operations
+
+// SetDecision caches a rejection for a user for the given duration
+func (c *MemoryCache) SetDecision(userID, reason string, code domain.ReasonCode, ttl time.Duration) {
+	c.decisions.Store(userID, &DecisionEntry{
+		UserID:     userID,
+		Reason:     reason,
+		ReasonCode: code,
+		ExpiresAt:  time.Now().Add(ttl),
+	})
+}
+
+// GetDecision returns the cached rejection for a user, or nil if there is
+// none or it expired
+func (c *MemoryCache) GetDecision(userID string) *DecisionEntry {
+	if v, ok := c.decisions.Load(userID); ok {
+		entry := v.(*DecisionEntry)
+		if time.Now().After(entry.ExpiresAt) {
+			c.decisions.Delete(userID)
+			return nil
+		}
+		return entry
+	}
+	return nil
+}
+
+// ClearDecision drops the cached rejection for a user
+func (c *MemoryCache) ClearDecision(userID string) {
+	c.decisions.Delete(userID)
+}
+
+// Report result operations
+
+// SetReportResult keeps the result of a processed report for ttl
+func (c *MemoryCache) SetReportResult(reportID string, result *domain.UsageReportResult, ttl time.Duration) {
+	now := time.Now()
+	c.reports.Store(reportID, &reportEntry{result: *result, expiresAt: now.Add(ttl)})
+
+	c.reportsMu.Lock()
+	defer c.reportsMu.Unlock()
+	if now.Sub(c.reportsSweep) < reportSweepInterval {
+		return
+	}
+	c.reportsSweep = now
+	c.reports.Range(func(key, value interface{}) bool {
+		if now.After(value.(*reportEntry).expiresAt) {
+			c.reports.Delete(key)
+		}
+		return true
+	})
+}
+
+// GetReportResult returns a copy of the result kept for a report, or nil if
+// there is none or it expired
+func (c *MemoryCache) GetReportResult(reportID string) *domain.UsageReportResult {
+	if v, ok := c.reports.Load(reportID); ok {
+		entry := v.(*reportEntry)
+		if time.Now().After(entry.expiresAt) {
+			c.reports.Delete(reportID)
+			return nil
+		}
+		result := entry.result
+		return &result
+	}
+	return nil
+}
+
+// ClearReportResult drops the result kept for a report
+func (c *MemoryCache) ClearReportResult(reportID string) {
+	c.reports.Delete(reportID)
+}
+
 // RangePenalties iterates over all penalties
 func (c *MemoryCache) RangePenalties(fn func(userID string, penalty *PenaltyEntry) bool) {
 	c.penalties.Range(func(key, value interface{}) bool {
@@ -280,19 +747,24 @@ func (sc *SessionCache) RemoveStaleSessions(window time.Duration, count *int) {
 	defer sc.mu.Unlock()
 
 	now := time.Now()
+	removed := 0
 	for sessionID, session := range sc.Sessions {
 		if now.Sub(session.LastSeenAt) > window {
 			delete(sc.Sessions, sessionID)
-			*count++
+			removed++
 		}
 	}
+	*count += removed
+	if removed > 0 {
+		sc.changed()
+	}
 }
 
 // Node operations
 
 // SetNode caches node data
 func (c *MemoryCache) SetNode(nodeID string, multiplier float64) {
-	c.nodes.Store(nodeID, &NodeCacheEntry{
+	c.nodes.store(nodeID, &NodeCacheEntry{
 		NodeID:            nodeID,
 		TrafficMultiplier: multiplier,
 		LastUpdated:       time.Now(),
@@ -301,34 +773,105 @@ func (c *MemoryCache) SetNode(nodeID string, multiplier float64) {
 
 // GetNode retrieves cached node data
 func (c *MemoryCache) GetNode(nodeID string) *NodeCacheEntry {
-	if v, ok := c.nodes.Load(nodeID); ok {
-		return v.(*NodeCacheEntry)
+	if entry, ok := c.nodes.load(nodeID); ok {
+		return entry
 	}
 	return nil
 }
 
 // UpdateNodeUsage updates cached node usage
 func (c *MemoryCache) UpdateNodeUsage(nodeID string, upload, download int64) {
-	if v, ok := c.nodes.Load(nodeID); ok {
-		entry := v.(*NodeCacheEntry)
+	if entry, ok := c.nodes.load(nodeID); ok {
 		entry.CurrentUpload += upload
 		entry.CurrentDownload += download
 		entry.LastUpdated = time.Now()
 	}
 }
 
+// SetNodeDraining marks a node as draining so new sessions are steered away
+func (c *MemoryCache) SetNodeDraining(nodeID string, draining bool) {
+	if draining {
+		c.drainingNodes.Store(nodeID, struct{}{})
+		return
+	}
+	c.drainingNodes.Delete(nodeID)
+}
+
+// IsNodeDraining reports whether a node is currently draining
+func (c *MemoryCache) IsNodeDraining(nodeID string) bool {
+	_, ok := c.drainingNodes.Load(nodeID)
+	return ok
+}
+
+func (c *MemoryCache) nodeActivityEntry(nodeID string) *NodeActivity {
+	if v, ok := c.nodeActivity.Load(nodeID); ok {
+		return v.(*NodeActivity)
+	}
+	actual, _ := c.nodeActivity.LoadOrStore(nodeID, &NodeActivity{})
+	return actual.(*NodeActivity)
+}
+
+// RecordNodeHeartbeat notes that a node sent a heartbeat at the given time
+func (c *MemoryCache) RecordNodeHeartbeat(nodeID string, at time.Time) {
+	a := c.nodeActivityEntry(nodeID)
+	a.mu.Lock()
+	a.lastHeartbeatAt = at
+	a.mu.Unlock()
+}
+
+// RecordNodeReport folds a report outcome into the node's error rate
+func (c *MemoryCache) RecordNodeReport(nodeID string, accepted bool) {
+	a := c.nodeActivityEntry(nodeID)
+	failed := 0.0
+	if !accepted {
+		failed = 1
+	}
+	a.mu.Lock()
+	a.errorRate += nodeErrorSmoothing * (failed - a.errorRate)
+	a.mu.Unlock()
+}
+
+// NodeActivity returns a node's last heartbeat, zero if it never sent one,
+// and the smoothed share of its reports that were rejected
+func (c *MemoryCache) NodeActivity(nodeID string) (time.Time, float64) {
+	v, ok := c.nodeActivity.Load(nodeID)
+	if !ok {
+		return time.Time{}, 0
+	}
+	a := v.(*NodeActivity)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastHeartbeatAt, a.errorRate
+}
+
 // Disconnect queue operations
 
+// PendingDisconnects counts the queued disconnect commands for a node
+func (c *MemoryCache) PendingDisconnects(nodeID string) int {
+	c.disconnectMu.Lock()
+	defer c.disconnectMu.Unlock()
+
+	count := 0
+	for _, cmd := range c.disconnectQueue {
+		if cmd.NodeID == nodeID {
+			count++
+		}
+	}
+	return count
+}
+
 // QueueDisconnect adds a disconnect command to the queue
 func (c *MemoryCache) QueueDisconnect(userID, sessionID, reason, nodeID string) {
 	c.disconnectMu.Lock()
 	defer c.disconnectMu.Unlock()
 
 	c.disconnectQueue = append(c.disconnectQueue, &DisconnectCommand{
+		ID:        uuid.New().String(),
 		UserID:    userID,
 		SessionID: sessionID,
 		Reason:    reason,
 		NodeID:    nodeID,
+		QueuedAt:  time.Now(),
 	})
 }
 
@@ -341,3 +884,119 @@ func (c *MemoryCache) GetDisconnectBatch() []*DisconnectCommand {
 	c.disconnectQueue = make([]*DisconnectCommand, 0, 100)
 	return batch
 }
+
+// TakeDisconnects returns up to limit commands for a node that are not
+// awaiting an ack, oldest first, and leases them for the given duration.
+// Commands stay queued until acknowledged; a lapsed lease makes them due
+// again. A limit of 0 returns every due command.
+func (c *MemoryCache) TakeDisconnects(nodeID string, limit int, lease time.Duration) []*DisconnectCommand {
+	c.disconnectMu.Lock()
+	defer c.disconnectMu.Unlock()
+
+	now := time.Now()
+	batch := make([]*DisconnectCommand, 0)
+	for _, cmd := range c.disconnectQueue {
+		if limit > 0 && len(batch) >= limit {
+			break
+		}
+		if cmd.NodeID != nodeID || now.Before(cmd.LeasedUntil) {
+			continue
+		}
+		cmd.LeasedUntil = now.Add(lease)
+		leased := *cmd
+		batch = append(batch, &leased)
+	}
+	return batch
+}
+
+// AckDisconnects removes a node's delivered commands from the queue and
+// returns how many were removed
+func (c *MemoryCache) AckDisconnects(nodeID string, ids []string) int {
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+
+	c.disconnectMu.Lock()
+	defer c.disconnectMu.Unlock()
+
+	kept := c.disconnectQueue[:0]
+	removed := 0
+	for _, cmd := range c.disconnectQueue {
+		if cmd.NodeID == nodeID && acked[cmd.ID] {
+			removed++
+			continue
+		}
+		kept = append(kept, cmd)
+	}
+	for i := len(kept); i < len(c.disconnectQueue); i++ {
+		c.disconnectQueue[i] = nil
+	}
+	c.disconnectQueue = kept
+	return removed
+}
+
+// Pending usage operations
+
+// AddPendingUsage adds a usage delta to the counters waiting to be flushed
+func (c *MemoryCache) AddPendingUsage(usage PendingUsage) {
+	c.pendingUsageMu.Lock()
+	defer c.pendingUsageMu.Unlock()
+
+	key := pendingUsageKey{kind: usage.Kind, id: usage.ID}
+	entry, ok := c.pendingUsage[key]
+	if !ok {
+		entry = &PendingUsage{Kind: usage.Kind, ID: usage.ID}
+		c.pendingUsage[key] = entry
+	}
+	if usage.UserID != "" {
+		entry.UserID = usage.UserID
+	}
+	entry.Upload += usage.Upload
+	entry.Download += usage.Download
+	if usage.LastAt.After(entry.LastAt) {
+		entry.LastAt = usage.LastAt
+	}
+}
+
+// GetPendingUsage returns the usage waiting to be flushed for a counter
+func (c *MemoryCache) GetPendingUsage(kind UsageKind, id string) PendingUsage {
+	c.pendingUsageMu.Lock()
+	defer c.pendingUsageMu.Unlock()
+
+	if entry, ok := c.pendingUsage[pendingUsageKey{kind: kind, id: id}]; ok {
+		return *entry
+	}
+	return PendingUsage{Kind: kind, ID: id}
+}
+
+// TakePendingUsage removes and returns the usage waiting to be flushed for a
+// counter
+func (c *MemoryCache) TakePendingUsage(kind UsageKind, id string) PendingUsage {
+	c.pendingUsageMu.Lock()
+	defer c.pendingUsageMu.Unlock()
+
+	key := pendingUsageKey{kind: kind, id: id}
+	if entry, ok := c.pendingUsage[key]; ok {
+		delete(c.pendingUsage, key)
+		return *entry
+	}
+	return PendingUsage{Kind: kind, ID: id}
+}
+
+// RangePendingUsage iterates over a snapshot of the usage waiting to be
+// flushed
+func (c *MemoryCache) RangePendingUsage(fn func(usage PendingUsage) bool) {
+	c.pendingUsageMu.Lock()
+	pending := make([]PendingUsage, 0, len(c.pendingUsage))
+	for _, entry := range c.pendingUsage {
+		pending = append(pending, *entry)
+	}
+	c.pendingUsageMu.Unlock()
+
+	for _, usage := range pending {
+		if !fn(usage) {
+			return
+		}
+	}
+}
@@ -20,15 +20,21 @@ func TestMemoryCacheUserSessionPenaltyAndDisconnectFlow(t *testing.T) {
 	}
 
 	sc := c.GetOrCreateSessionCache("u1")
-	sc.AddSession("s1", "hash1", "US", "NY", "ISP")
+	sc.AddSession("s1", "", "n1", "hash1", "US", "NY", "ISP", 64500)
 	if !sc.HasSession("s1") {
 		t.Fatalf("expected session to exist")
 	}
 	if sc.GetActiveSessionCount(time.Minute) != 1 {
 		t.Fatalf("expected one active session")
 	}
+	if s, ok := sc.GetSession("s1"); !ok || s.NodeID != "n1" {
+		t.Fatalf("expected session to be bound to node n1")
+	}
+	if s, _ := sc.GetSession("s1"); s.ISP != "ISP" || s.ASN != 64500 {
+		t.Fatalf("expected session to keep ISP and ASN, got %q/%d", s.ISP, s.ASN)
+	}
 
-	c.SetPenalty("u1", "reason", 20*time.Millisecond)
+	c.SetPenalty("u1", "reason", domain.PenaltyActionDisconnect, 20*time.Millisecond)
 	if c.GetPenalty("u1") == nil {
 		t.Fatalf("expected active penalty")
 	}
@@ -46,6 +52,30 @@ func TestMemoryCacheUserSessionPenaltyAndDisconnectFlow(t *testing.T) {
 		t.Fatalf("expected disconnect queue to be cleared")
 	}
 
+	c.QueueDisconnect("u1", "s1", "test", "n1")
+	c.QueueDisconnect("u2", "s2", "test", "n2")
+	taken := c.TakeDisconnects("n1", 0, 20*time.Millisecond)
+	if len(taken) != 1 || taken[0].UserID != "u1" || taken[0].ID == "" {
+		t.Fatalf("expected only n1's command, got %+v", taken)
+	}
+	if len(c.TakeDisconnects("n1", 0, 20*time.Millisecond)) != 0 {
+		t.Fatalf("expected a leased command not to be delivered twice")
+	}
+	time.Sleep(30 * time.Millisecond)
+	redelivered := c.TakeDisconnects("n1", 0, time.Minute)
+	if len(redelivered) != 1 || redelivered[0].ID != taken[0].ID {
+		t.Fatalf("expected an unacked command to be redelivered after its lease, got %+v", redelivered)
+	}
+	if n := c.AckDisconnects("n2", []string{taken[0].ID}); n != 0 {
+		t.Fatalf("expected a node not to ack another node's command, got %d", n)
+	}
+	if n := c.AckDisconnects("n1", []string{taken[0].ID}); n != 1 || c.PendingDisconnects("n1") != 0 {
+		t.Fatalf("expected the ack to remove the command, got %d", n)
+	}
+	if c.PendingDisconnects("n2") != 1 {
+		t.Fatalf("expected n2's command to stay queued")
+	}
+
 	c.SetNode("n1", 2.0)
 	c.UpdateNodeUsage("n1", 5, 7)
 	n := c.GetNode("n1")
@@ -53,3 +83,147 @@ func TestMemoryCacheUserSessionPenaltyAndDisconnectFlow(t *testing.T) {
 		t.Fatalf("unexpected node usage in cache")
 	}
 }
+
+func TestStatsCacheTTLAndBust(t *testing.T) {
+	c := NewStatsCache(time.Minute)
+
+	if _, ok := c.Get("stats"); ok {
+		t.Fatalf("expected empty cache")
+	}
+	set := c.Set("stats", []byte(`{"total_users":1}`))
+	got, ok := c.Get("stats")
+	if !ok || string(got.Body) != `{"total_users":1}` || got.ETag != set.ETag {
+		t.Fatalf("expected cached stats entry")
+	}
+	if other := c.Set("stats", []byte(`{"total_users":2}`)); other.ETag == set.ETag {
+		t.Fatalf("expected ETag to change with the body")
+	}
+
+	c.Bust()
+	if _, ok := c.Get("stats"); ok {
+		t.Fatalf("expected bust to drop cached entries")
+	}
+
+	disabled := NewStatsCache(0)
+	if entry := disabled.Set("stats", []byte("{}")); entry.ETag == "" {
+		t.Fatalf("expected ETag even with caching disabled")
+	}
+	if _, ok := disabled.Get("stats"); ok {
+		t.Fatalf("expected nothing cached when TTL is zero")
+	}
+}
+
+func TestSessionCacheThroughputAndSustainedSpeed(t *testing.T) {
+	c := NewMemoryCache()
+	sc := c.GetOrCreateSessionCache("u1")
+	sc.AddSession("s1", "", "n1", "hash1", "", "", "", 0)
+	startedAt := sc.GetSessions()[0].StartedAt
+	time.Sleep(time.Millisecond)
+	sc.AddSession("s1", "", "n1", "hash1", "", "", "", 0)
+	if got := sc.GetSessions()[0].StartedAt; !got.Equal(startedAt) {
+		t.Fatalf("expected a re-added session to keep its start time %v, got %v", startedAt, got)
+	}
+
+	base := time.Now().Add(-time.Minute)
+	sc.RecordTraffic("s1", 0, 999_999, base)
+	if _, down := sc.Throughput(time.Minute); down != 0 {
+		t.Fatalf("expected the first report to only start the clock, got %v", down)
+	}
+
+	// 1.25 MB in 10s is 1 Mbps, then 2 Mbps smoothed halfway to 1.5 Mbps
+	sc.RecordTraffic("s1", 0, 1_250_000, base.Add(10*time.Second))
+	if _, down := sc.Throughput(time.Minute); down != 1_000_000 {
+		t.Fatalf("expected 1 Mbps, got %v", down)
+	}
+	sc.RecordTraffic("s1", 125_000, 2_500_000, base.Add(20*time.Second))
+	if up, down := sc.Throughput(time.Minute); up != 50_000 || down != 1_500_000 {
+		t.Fatalf("expected 50 kbps up and 1.5 Mbps down, got %v / %v", up, down)
+	}
+	if _, down := sc.Throughput(30 * time.Second); down != 0 {
+		t.Fatalf("expected a quiet session to count as idle, got %v", down)
+	}
+
+	start := time.Now()
+	if hit, _ := sc.SustainedAbove(2_000, 1_000, time.Minute, start); hit {
+		t.Fatalf("expected no alert before the sustain period")
+	}
+	hit, since := sc.SustainedAbove(2_000, 1_000, time.Minute, start.Add(time.Minute))
+	if !hit || !since.Equal(start) {
+		t.Fatalf("expected alert after a sustained minute since %v, got %v %v", start, hit, since)
+	}
+	if hit, _ := sc.SustainedAbove(2_000, 1_000, time.Minute, start.Add(2*time.Minute)); hit {
+		t.Fatalf("expected a stretch to be flagged only once")
+	}
+	sc.SustainedAbove(500, 1_000, time.Minute, start.Add(3*time.Minute))
+	if hit, _ := sc.SustainedAbove(2_000, 1_000, 0, start.Add(4*time.Minute)); !hit {
+		t.Fatalf("expected a new stretch to be flagged again")
+	}
+}
+
+func TestMemoryCachePendingUsage(t *testing.T) {
+	c := NewMemoryCache()
+
+	first := time.Now()
+	c.AddPendingUsage(PendingUsage{Kind: UsageKindPackage, ID: "p1", UserID: "u1", Upload: 10, Download: 20, LastAt: first})
+	c.AddPendingUsage(PendingUsage{Kind: UsageKindPackage, ID: "p1", UserID: "u1", Upload: 5, Download: 5, LastAt: first.Add(time.Second)})
+	c.AddPendingUsage(PendingUsage{Kind: UsageKindNode, ID: "p1", Upload: 1})
+
+	pending := c.GetPendingUsage(UsageKindPackage, "p1")
+	if pending.Upload != 15 || pending.Download != 25 || pending.UserID != "u1" || !pending.LastAt.Equal(first.Add(time.Second)) {
+		t.Fatalf("unexpected pending usage %+v", pending)
+	}
+
+	count := 0
+	c.RangePendingUsage(func(PendingUsage) bool {
+		count++
+		return true
+	})
+	if count != 2 {
+		t.Fatalf("expected package and node counters to be kept apart, got %d", count)
+	}
+
+	if taken := c.TakePendingUsage(UsageKindPackage, "p1"); taken.Upload != 15 {
+		t.Fatalf("unexpected taken usage %+v", taken)
+	}
+	if left := c.GetPendingUsage(UsageKindPackage, "p1"); left.Upload != 0 || left.Download != 0 {
+		t.Fatalf("expected taken usage to be removed, got %+v", left)
+	}
+}
+
+func TestMemoryCacheEvictsExpiredAndLeastRecentlyUsedUsers(t *testing.T) {
+	c := NewMemoryCache()
+	evictions := map[EvictReason]int{}
+	c.SetEvictionObserver(func(reason EvictReason) { evictions[reason]++ })
+	c.SetLimits(0, 2)
+
+	c.SetUser("u1", domain.UserStatusActive, nil, 1)
+	c.SetUser("u2", domain.UserStatusActive, nil, 1)
+	if c.GetUser("u1") == nil {
+		t.Fatal("expected u1 to be cached")
+	}
+	c.SetUser("u3", domain.UserStatusActive, nil, 1)
+	if c.GetUser("u2") != nil {
+		t.Fatal("expected least recently used u2 to be evicted")
+	}
+	if c.GetUser("u1") == nil || c.GetUser("u3") == nil {
+		t.Fatal("expected u1 and u3 to stay cached")
+	}
+	if c.UserCount() != 2 || evictions[EvictCapacity] != 1 {
+		t.Fatalf("unexpected count %d or evictions %v", c.UserCount(), evictions)
+	}
+
+	c.DeleteUser("u3")
+	if evictions[EvictCapacity] != 1 {
+		t.Fatalf("expected deletes not to count as evictions, got %v", evictions)
+	}
+
+	c.SetLimits(time.Millisecond, 0)
+	c.SetUser("u4", domain.UserStatusActive, nil, 1)
+	time.Sleep(5 * time.Millisecond)
+	if c.GetUser("u4") != nil {
+		t.Fatal("expected u4 to expire")
+	}
+	if evictions[EvictExpired] == 0 {
+		t.Fatalf("expected an expiry eviction, got %v", evictions)
+	}
+}
@@ -0,0 +1,654 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// RedisCache shares users, sessions, penalties, cached rejections, recent
+// report results and the disconnect queue between HUE instances through
+// Redis. Node draining flags and health stay per instance, since every
+// instance restores draining from the database and hears its own heartbeats.
+// Usage waiting to be written stays per instance too, since each instance
+// flushes what it charged.
+//
+// A user's sessions are stored as one value. Each lookup reloads them and
+// each change writes them back, so two instances changing the same user's
+// sessions at the same moment keep the later write.
+//
+// Redis failures never fail a report: lookups fall back to what this
+// instance last saw and the error is logged.
+type RedisCache struct {
+	client *redisClient
+	prefix string
+	local  *MemoryCache
+	logger *zap.Logger
+}
+
+var _ Cache = (*RedisCache)(nil)
+
+const (
+	// redisUserTTL bounds how long a cached user outlives its last refresh
+	redisUserTTL = 24 * time.Hour
+	// redisSessionTTL drops a user's sessions once none was touched for this
+	// long, well past any session window
+	redisSessionTTL = time.Hour
+	// redisTimeout bounds each round trip
+	redisTimeout = 2 * time.Second
+)
+
+// NewRedisCache connects to the Redis server at rawURL
+// (redis://[:password@]host[:port][/db]) and namespaces keys under prefix
+func NewRedisCache(rawURL, prefix string, logger *zap.Logger) (*RedisCache, error) {
+	client, err := newRedisClient(rawURL, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Do("PING"); err != nil {
+		return nil, fmt.Errorf("failed to reach redis: %w", err)
+	}
+	return &RedisCache{
+		client: client,
+		prefix: prefix,
+		local:  NewMemoryCache(),
+		logger: logger,
+	}, nil
+}
+
+// Close closes the connections to Redis
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+func (c *RedisCache) key(kind, id string) string {
+	return c.prefix + kind + ":" + id
+}
+
+func (c *RedisCache) warn(op string, err error) {
+	c.logger.Warn("redis cache "+op+" failed", zap.Error(err))
+}
+
+// User operations
+
+// SetUser caches user data, resetting its usage counters
+func (c *RedisCache) SetUser(userID string, status domain.UserStatus, packageID *string, maxConcurrent int) {
+	key := c.key("user", userID)
+	pkg := ""
+	if packageID != nil {
+		pkg = *packageID
+	}
+	_, err := c.exec([][]string{
+		{"DEL", key},
+		{"HSET", key,
+			"status", string(status),
+			"package", pkg,
+			"max_concurrent", strconv.Itoa(maxConcurrent),
+			"upload", "0", "download", "0", "total", "0",
+			"updated", strconv.FormatInt(time.Now().UnixNano(), 10),
+		},
+		{"PEXPIRE", key, millis(redisUserTTL)},
+	})
+	if err != nil {
+		c.warn("set user", err)
+	}
+}
+
+// GetUser retrieves cached user data
+func (c *RedisCache) GetUser(userID string) *UserCacheEntry {
+	reply, err := c.client.Do("HGETALL", c.key("user", userID))
+	if err != nil {
+		c.warn("get user", err)
+		return nil
+	}
+	fields := hashFields(reply)
+	// Usage increments can outlive the entry itself; without a status the
+	// user is not cached
+	status, ok := fields["status"]
+	if !ok {
+		return nil
+	}
+
+	entry := &UserCacheEntry{UserID: userID, Status: domain.UserStatus(status)}
+	if pkg := fields["package"]; pkg != "" {
+		entry.ActivePackageID = &pkg
+	}
+	entry.MaxConcurrent, _ = strconv.Atoi(fields["max_concurrent"])
+	entry.CurrentUpload, _ = strconv.ParseInt(fields["upload"], 10, 64)
+	entry.CurrentDownload, _ = strconv.ParseInt(fields["download"], 10, 64)
+	entry.CurrentTotal, _ = strconv.ParseInt(fields["total"], 10, 64)
+	if updated, err := strconv.ParseInt(fields["updated"], 10, 64); err == nil {
+		entry.LastUpdated = time.Unix(0, updated)
+	}
+	return entry
+}
+
+// UpdateUserUsage adds to the cached usage counters
+func (c *RedisCache) UpdateUserUsage(userID string, upload, download int64) {
+	key := c.key("user", userID)
+	_, err := c.exec([][]string{
+		{"HINCRBY", key, "upload", strconv.FormatInt(upload, 10)},
+		{"HINCRBY", key, "download", strconv.FormatInt(download, 10)},
+		{"HINCRBY", key, "total", strconv.FormatInt(upload+download, 10)},
+		{"HSET", key, "updated", strconv.FormatInt(time.Now().UnixNano(), 10)},
+		{"PEXPIRE", key, millis(redisUserTTL)},
+	})
+	if err != nil {
+		c.warn("update user usage", err)
+	}
+}
+
+// DeleteUser removes the user and its sessions, penalty and decision
+func (c *RedisCache) DeleteUser(userID string) {
+	c.local.DeleteUser(userID)
+	if _, err := c.client.Do("DEL", c.key("user", userID), c.key("sessions", userID), c.key("penalty", userID), c.key("offenses", userID), c.key("decision", userID)); err != nil {
+		c.warn("delete user", err)
+	}
+}
+
+// ForgetUser drops the cached user data and decision but keeps the user's
+// sessions and penalties
+func (c *RedisCache) ForgetUser(userID string) {
+	c.local.ForgetUser(userID)
+	if _, err := c.client.Do("DEL", c.key("user", userID), c.key("decision", userID)); err != nil {
+		c.warn("forget user", err)
+	}
+}
+
+// Session operations
+
+// storedSession carries the unexported rate flag through JSON
+type storedSession struct {
+	SessionEntry
+	Rated bool `json:"rated"`
+}
+
+// GetOrCreateSessionCache returns the user's sessions as last stored in
+// Redis. Changes made through the returned cache are written back.
+func (c *RedisCache) GetOrCreateSessionCache(userID string) *SessionCache {
+	sc := c.local.GetOrCreateSessionCache(userID)
+	sc.mu.Lock()
+	if sc.persist == nil {
+		sc.persist = c.storeSessions
+	}
+	sc.mu.Unlock()
+
+	if sessions, ok := c.loadSessions(userID); ok {
+		sc.replace(sessions)
+	}
+	return sc
+}
+
+func (c *RedisCache) loadSessions(userID string) ([]SessionEntry, bool) {
+	reply, err := c.client.Do("GET", c.key("sessions", userID))
+	if err != nil {
+		c.warn("load sessions", err)
+		return nil, false
+	}
+	raw, _ := reply.(string)
+	if raw == "" {
+		return nil, true
+	}
+
+	var stored []storedSession
+	if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+		c.warn("decode sessions", err)
+		return nil, false
+	}
+	sessions := make([]SessionEntry, len(stored))
+	for i, s := range stored {
+		sessions[i] = s.SessionEntry
+		sessions[i].rated = s.Rated
+	}
+	return sessions, true
+}
+
+func (c *RedisCache) storeSessions(userID string, sessions []SessionEntry) {
+	key := c.key("sessions", userID)
+	var err error
+	if len(sessions) == 0 {
+		_, err = c.client.Do("DEL", key)
+	} else {
+		stored := make([]storedSession, len(sessions))
+		for i, s := range sessions {
+			stored[i] = storedSession{SessionEntry: s, Rated: s.rated}
+		}
+		var raw []byte
+		if raw, err = json.Marshal(stored); err == nil {
+			_, err = c.client.Do("SET", key, string(raw), "PX", millis(redisSessionTTL))
+		}
+	}
+	if err != nil {
+		c.warn("store sessions", err)
+	}
+}
+
+// RangeSessions iterates over all sessions for a user
+func (c *RedisCache) RangeSessions(userID string, fn func(sessionID string, session *SessionEntry) bool) {
+	sc := c.GetOrCreateSessionCache(userID)
+	for _, s := range sc.GetSessions() {
+		s := s
+		if !fn(s.SessionID, &s) {
+			break
+		}
+	}
+}
+
+// RangeAllSessions iterates over the sessions of every user with sessions
+// stored in Redis
+func (c *RedisCache) RangeAllSessions(fn func(userID string, sessionCache *SessionCache) bool) {
+	keys, err := c.scan(c.key("sessions", "*"))
+	if err != nil {
+		c.warn("scan sessions", err)
+		c.local.RangeAllSessions(fn)
+		return
+	}
+	for _, key := range keys {
+		userID := strings.TrimPrefix(key, c.key("sessions", ""))
+		if !fn(userID, c.GetOrCreateSessionCache(userID)) {
+			return
+		}
+	}
+}
+
+// Penalty operations
+
+// SetPenalty sets a penalty for a user
+func (c *RedisCache) SetPenalty(userID, reason string, action domain.PenaltyAction, duration time.Duration) {
+	now := time.Now()
+	c.setJSON("penalty", userID, &PenaltyEntry{
+		UserID:    userID,
+		Reason:    reason,
+		Action:    action,
+		AppliedAt: now,
+		ExpiresAt: now.Add(duration),
+	}, duration)
+}
+
+// GetPenalty gets the current penalty for a user
+func (c *RedisCache) GetPenalty(userID string) *PenaltyEntry {
+	var entry PenaltyEntry
+	if !c.getJSON("penalty", userID, &entry) || time.Now().After(entry.ExpiresAt) {
+		return nil
+	}
+	return &entry
+}
+
+// ClearPenalty removes a penalty
+func (c *RedisCache) ClearPenalty(userID string) {
+	if _, err := c.client.Do("DEL", c.key("penalty", userID)); err != nil {
+		c.warn("clear penalty", err)
+	}
+}
+
+// RecordOffense counts a penalty against a user and returns how many
+// penalties in a row came within window of the previous one. The counter
+// expires window after the last penalty.
+func (c *RedisCache) RecordOffense(userID string, window time.Duration) int {
+	key := c.key("offenses", userID)
+	replies, err := c.exec([][]string{
+		{"INCR", key},
+		{"PEXPIRE", key, millis(window)},
+	})
+	if err != nil {
+		c.warn("record offense", err)
+		return 1
+	}
+	count, _ := replies[0].(int64)
+	return int(count)
+}
+
+// RangePenalties iterates over all penalties
+func (c *RedisCache) RangePenalties(fn func(userID string, penalty *PenaltyEntry) bool) {
+	keys, err := c.scan(c.key("penalty", "*"))
+	if err != nil {
+		c.warn("scan penalties", err)
+		return
+	}
+	for _, key := range keys {
+		userID := strings.TrimPrefix(key, c.key("penalty", ""))
+		if penalty := c.GetPenalty(userID); penalty != nil && !fn(userID, penalty) {
+			return
+		}
+	}
+}
+
+// Decision operations
+
+// SetDecision caches a rejection for a user for the given duration
+func (c *RedisCache) SetDecision(userID, reason string, code domain.ReasonCode, ttl time.Duration) {
+	c.setJSON("decision", userID, &DecisionEntry{
+		UserID:     userID,
+		Reason:     reason,
+		ReasonCode: code,
+		ExpiresAt:  time.Now().Add(ttl),
+	}, ttl)
+}
+
+// GetDecision returns the cached rejection for a user, or nil if there is
+// none or it expired
+func (c *RedisCache) GetDecision(userID string) *DecisionEntry {
+	var entry DecisionEntry
+	if !c.getJSON("decision", userID, &entry) || time.Now().After(entry.ExpiresAt) {
+		return nil
+	}
+	return &entry
+}
+
+// ClearDecision drops the cached rejection for a user
+func (c *RedisCache) ClearDecision(userID string) {
+	if _, err := c.client.Do("DEL", c.key("decision", userID)); err != nil {
+		c.warn("clear decision", err)
+	}
+}
+
+// Report result operations
+
+// SetReportResult keeps the result of a processed report for ttl
+func (c *RedisCache) SetReportResult(reportID string, result *domain.UsageReportResult, ttl time.Duration) {
+	c.setJSON("report", reportID, result, ttl)
+}
+
+// GetReportResult returns the result kept for a report, or nil if there is
+// none or it expired
+func (c *RedisCache) GetReportResult(reportID string) *domain.UsageReportResult {
+	var result domain.UsageReportResult
+	if !c.getJSON("report", reportID, &result) {
+		return nil
+	}
+	return &result
+}
+
+// ClearReportResult drops the result kept for a report
+func (c *RedisCache) ClearReportResult(reportID string) {
+	if _, err := c.client.Do("DEL", c.key("report", reportID)); err != nil {
+		c.warn("clear report result", err)
+	}
+}
+
+// Write-behind usage stays local
+
+// AddPendingUsage adds a usage delta this instance charged
+func (c *RedisCache) AddPendingUsage(usage PendingUsage) {
+	c.local.AddPendingUsage(usage)
+}
+
+// GetPendingUsage returns the usage this instance has not flushed yet
+func (c *RedisCache) GetPendingUsage(kind UsageKind, id string) PendingUsage {
+	return c.local.GetPendingUsage(kind, id)
+}
+
+// TakePendingUsage removes and returns usage this instance has not flushed
+func (c *RedisCache) TakePendingUsage(kind UsageKind, id string) PendingUsage {
+	return c.local.TakePendingUsage(kind, id)
+}
+
+// RangePendingUsage iterates over the usage this instance has not flushed
+func (c *RedisCache) RangePendingUsage(fn func(usage PendingUsage) bool) {
+	c.local.RangePendingUsage(fn)
+}
+
+// Node operations stay local
+
+// SetNodeDraining marks a node as draining on this instance
+func (c *RedisCache) SetNodeDraining(nodeID string, draining bool) {
+	c.local.SetNodeDraining(nodeID, draining)
+}
+
+// IsNodeDraining reports whether a node is draining on this instance
+func (c *RedisCache) IsNodeDraining(nodeID string) bool {
+	return c.local.IsNodeDraining(nodeID)
+}
+
+// RecordNodeHeartbeat notes a heartbeat this instance received
+func (c *RedisCache) RecordNodeHeartbeat(nodeID string, at time.Time) {
+	c.local.RecordNodeHeartbeat(nodeID, at)
+}
+
+// RecordNodeReport folds a report outcome into the node's error rate
+func (c *RedisCache) RecordNodeReport(nodeID string, accepted bool) {
+	c.local.RecordNodeReport(nodeID, accepted)
+}
+
+// NodeActivity returns the node activity seen by this instance
+func (c *RedisCache) NodeActivity(nodeID string) (time.Time, float64) {
+	return c.local.NodeActivity(nodeID)
+}
+
+// Disconnect queue operations
+
+// The shared disconnect queue is one hash of command ID to command. Two
+// instances leasing the same command at the same moment may both deliver it,
+// which is harmless since disconnecting is idempotent.
+
+// QueueDisconnect adds a disconnect command to the shared queue
+func (c *RedisCache) QueueDisconnect(userID, sessionID, reason, nodeID string) {
+	cmd := &DisconnectCommand{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		SessionID: sessionID,
+		Reason:    reason,
+		NodeID:    nodeID,
+		QueuedAt:  time.Now(),
+	}
+	raw, _ := json.Marshal(cmd)
+	if _, err := c.client.Do("HSET", c.disconnectKey(), cmd.ID, string(raw)); err != nil {
+		c.warn("queue disconnect", err)
+	}
+}
+
+// GetDisconnectBatch retrieves and clears the shared disconnect queue
+func (c *RedisCache) GetDisconnectBatch() []*DisconnectCommand {
+	key := c.disconnectKey()
+	replies, err := c.exec([][]string{
+		{"HGETALL", key},
+		{"DEL", key},
+	})
+	if err != nil {
+		c.warn("take disconnects", err)
+		return []*DisconnectCommand{}
+	}
+	return decodeDisconnects(replies[0])
+}
+
+// TakeDisconnects returns up to limit due commands for a node, oldest
+// first, and leases them for the given duration
+func (c *RedisCache) TakeDisconnects(nodeID string, limit int, lease time.Duration) []*DisconnectCommand {
+	now := time.Now()
+	batch := make([]*DisconnectCommand, 0)
+	args := []string{"HSET", c.disconnectKey()}
+	for _, cmd := range c.nodeDisconnects(nodeID) {
+		if limit > 0 && len(batch) >= limit {
+			break
+		}
+		if now.Before(cmd.LeasedUntil) {
+			continue
+		}
+		cmd.LeasedUntil = now.Add(lease)
+		raw, _ := json.Marshal(cmd)
+		args = append(args, cmd.ID, string(raw))
+		batch = append(batch, cmd)
+	}
+	if len(batch) > 0 {
+		if _, err := c.client.Do(args...); err != nil {
+			c.warn("lease disconnects", err)
+		}
+	}
+	return batch
+}
+
+// AckDisconnects removes a node's delivered commands from the shared queue
+func (c *RedisCache) AckDisconnects(nodeID string, ids []string) int {
+	acked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		acked[id] = true
+	}
+
+	args := []string{"HDEL", c.disconnectKey()}
+	for _, cmd := range c.nodeDisconnects(nodeID) {
+		if acked[cmd.ID] {
+			args = append(args, cmd.ID)
+		}
+	}
+	if len(args) == 2 {
+		return 0
+	}
+	reply, err := c.client.Do(args...)
+	if err != nil {
+		c.warn("ack disconnects", err)
+		return 0
+	}
+	removed, _ := reply.(int64)
+	return int(removed)
+}
+
+// PendingDisconnects counts the queued disconnect commands for a node
+func (c *RedisCache) PendingDisconnects(nodeID string) int {
+	return len(c.nodeDisconnects(nodeID))
+}
+
+func (c *RedisCache) disconnectKey() string {
+	return c.key("disconnects", "pending")
+}
+
+// nodeDisconnects returns a node's queued commands, oldest first
+func (c *RedisCache) nodeDisconnects(nodeID string) []*DisconnectCommand {
+	reply, err := c.client.Do("HGETALL", c.disconnectKey())
+	if err != nil {
+		c.warn("read disconnects", err)
+		return nil
+	}
+	all := decodeDisconnects(reply)
+	cmds := all[:0]
+	for _, cmd := range all {
+		if cmd.NodeID == nodeID {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+// decodeDisconnects decodes an HGETALL reply into commands, oldest first
+func decodeDisconnects(reply interface{}) []*DisconnectCommand {
+	items, _ := reply.([]interface{})
+	batch := make([]*DisconnectCommand, 0, len(items)/2)
+	for i := 1; i < len(items); i += 2 {
+		raw, _ := items[i].(string)
+		cmd := &DisconnectCommand{}
+		if err := json.Unmarshal([]byte(raw), cmd); err == nil {
+			batch = append(batch, cmd)
+		}
+	}
+	sort.SliceStable(batch, func(i, j int) bool {
+		return batch[i].QueuedAt.Before(batch[j].QueuedAt)
+	})
+	return batch
+}
+
+// Helpers
+
+// exec runs the commands atomically in a MULTI block and returns their
+// replies
+func (c *RedisCache) exec(cmds [][]string) ([]interface{}, error) {
+	block := make([][]string, 0, len(cmds)+2)
+	block = append(block, []string{"MULTI"})
+	block = append(block, cmds...)
+	block = append(block, []string{"EXEC"})
+
+	replies, err := c.client.Pipeline(block)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(error); ok {
+			return nil, err
+		}
+	}
+	results, _ := replies[len(replies)-1].([]interface{})
+	if len(results) != len(cmds) {
+		return nil, fmt.Errorf("redis: transaction aborted")
+	}
+	for _, result := range results {
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (c *RedisCache) setJSON(kind, id string, value interface{}, ttl time.Duration) {
+	raw, err := json.Marshal(value)
+	if err == nil {
+		_, err = c.client.Do("SET", c.key(kind, id), string(raw), "PX", millis(ttl))
+	}
+	if err != nil {
+		c.warn("set "+kind, err)
+	}
+}
+
+func (c *RedisCache) getJSON(kind, id string, value interface{}) bool {
+	reply, err := c.client.Do("GET", c.key(kind, id))
+	if err != nil {
+		c.warn("get "+kind, err)
+		return false
+	}
+	raw, _ := reply.(string)
+	if raw == "" {
+		return false
+	}
+	return json.Unmarshal([]byte(raw), value) == nil
+}
+
+// scan lists the keys matching pattern
+func (c *RedisCache) scan(pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.client.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "200")
+		if err != nil {
+			return nil, err
+		}
+		parts, _ := reply.([]interface{})
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if s, ok := key.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// hashFields turns an HGETALL reply into a map
+func hashFields(reply interface{}) map[string]string {
+	items, _ := reply.([]interface{})
+	fields := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		name, _ := items[i].(string)
+		value, _ := items[i+1].(string)
+		fields[name] = value
+	}
+	return fields
+}
+
+// millis formats a duration for PX and PEXPIRE, at least one millisecond
+func millis(d time.Duration) string {
+	ms := d.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
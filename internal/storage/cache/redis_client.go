@@ -0,0 +1,254 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// errRedisNil is returned for a nil bulk or array reply
+var errRedisNil = errors.New("redis: nil")
+
+// redisClient speaks enough RESP to run the cache's commands over a small
+// pool of connections
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// maxIdleRedisConns bounds the connections kept open between commands
+const maxIdleRedisConns = 8
+
+// newRedisClient parses a redis://[:password@]host[:port][/db] URL
+func newRedisClient(rawURL string, timeout time.Duration) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid redis URL %q: scheme must be redis", rawURL)
+	}
+
+	c := &redisClient{addr: u.Host, timeout: timeout}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+		if c.password == "" {
+			c.password = u.User.Username()
+		}
+	}
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		if c.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", path)
+		}
+	}
+	return c, nil
+}
+
+// Do runs one command and returns its reply
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	replies, err := c.Pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends the commands in one round trip on one connection. Error
+// replies are returned in place; the error is for connection failures.
+func (c *redisClient) Pipeline(cmds [][]string) ([]interface{}, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := conn.roundTrip(cmds, c.timeout)
+	if err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return replies, nil
+}
+
+// Close closes the idle connections
+func (c *redisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.idle {
+		conn.conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *redisClient) get() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	netConn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	conn := &redisConn{conn: netConn, r: bufio.NewReader(netConn), w: bufio.NewWriter(netConn)}
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		replies, err := conn.roundTrip(setup, c.timeout)
+		if err == nil {
+			for _, reply := range replies {
+				if replyErr, ok := reply.(error); ok {
+					err = replyErr
+					break
+				}
+			}
+		}
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) put(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdleRedisConns {
+		conn.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+func (conn *redisConn) roundTrip(cmds [][]string, timeout time.Duration) ([]interface{}, error) {
+	if timeout > 0 {
+		conn.conn.SetDeadline(time.Now().Add(timeout))
+	}
+	for _, args := range cmds {
+		fmt.Fprintf(conn.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(conn.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := readRedisReply(conn.r)
+		if err != nil {
+			if _, ok := err.(redisError); !ok && err != errRedisNil {
+				return nil, err
+			}
+			if err == errRedisNil {
+				reply, err = nil, nil
+			} else {
+				reply = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readRedisReply reads one reply: a string for simple and bulk strings, an
+// int64, a []interface{} for arrays, or a redisError
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readRedisReply(r)
+			switch {
+			case err == errRedisNil:
+				item = nil
+			case err != nil:
+				if replyErr, ok := err.(redisError); ok {
+					item = replyErr
+				} else {
+					return nil, err
+				}
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"go.uber.org/zap"
+)
+
+// fakeRedis serves the subset of Redis commands RedisCache uses
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	lists   map[string][]string
+	expires map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	f := &fakeRedis{
+		strings: map[string]string{},
+		hashes:  map[string]map[string]string{},
+		lists:   map[string][]string{},
+		expires: map[string]time.Time{},
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return "redis://" + lis.Addr().String() + "/0"
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+
+		var out string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			inMulti, queued = true, nil
+			out = "+OK\r\n"
+		case cmd == "EXEC":
+			inMulti = false
+			out = fmt.Sprintf("*%d\r\n", len(queued))
+			for _, q := range queued {
+				out += f.run(q)
+			}
+		case inMulti:
+			queued = append(queued, args)
+			out = "+QUEUED\r\n"
+		default:
+			out = f.run(args)
+		}
+		if _, err := conn.Write([]byte(out)); err != nil {
+			return
+		}
+	}
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func array(items []string) string {
+	out := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		out += bulk(item)
+	}
+	return out
+}
+
+func (f *fakeRedis) run(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, at := range f.expires {
+		if time.Now().After(at) {
+			f.del(key)
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.strings[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "SET":
+		f.del(args[1])
+		f.strings[args[1]] = args[2]
+		if len(args) == 5 && strings.EqualFold(args[3], "PX") {
+			ms, _ := strconv.Atoi(args[4])
+			f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if f.del(key) {
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "HSET":
+		h := f.hashes[args[1]]
+		if h == nil {
+			h = map[string]string{}
+			f.hashes[args[1]] = h
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		return ":1\r\n"
+	case "HGETALL":
+		var items []string
+		for k, v := range f.hashes[args[1]] {
+			items = append(items, k, v)
+		}
+		return array(items)
+	case "HINCRBY":
+		h := f.hashes[args[1]]
+		if h == nil {
+			h = map[string]string{}
+			f.hashes[args[1]] = h
+		}
+		cur, _ := strconv.ParseInt(h[args[2]], 10, 64)
+		by, _ := strconv.ParseInt(args[3], 10, 64)
+		h[args[2]] = strconv.FormatInt(cur+by, 10)
+		return fmt.Sprintf(":%d\r\n", cur+by)
+	case "HDEL":
+		n := 0
+		for _, field := range args[2:] {
+			if _, ok := f.hashes[args[1]][field]; ok {
+				delete(f.hashes[args[1]], field)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "INCR":
+		cur, _ := strconv.ParseInt(f.strings[args[1]], 10, 64)
+		f.strings[args[1]] = strconv.FormatInt(cur+1, 10)
+		return fmt.Sprintf(":%d\r\n", cur+1)
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "RPUSH":
+		f.lists[args[1]] = append(f.lists[args[1]], args[2:]...)
+		return fmt.Sprintf(":%d\r\n", len(f.lists[args[1]]))
+	case "LRANGE":
+		return array(f.lists[args[1]])
+	case "SCAN":
+		var keys []string
+		for key := range f.strings {
+			if ok, _ := path.Match(args[3], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		return "*2\r\n" + bulk("0") + array(keys)
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func (f *fakeRedis) del(key string) bool {
+	_, s := f.strings[key]
+	_, h := f.hashes[key]
+	_, l := f.lists[key]
+	delete(f.strings, key)
+	delete(f.hashes, key)
+	delete(f.lists, key)
+	delete(f.expires, key)
+	return s || h || l
+}
+
+func newTestRedisCache(t *testing.T, url string) *RedisCache {
+	t.Helper()
+	c, err := NewRedisCache(url, "hue:", zap.NewNop())
+	if err != nil {
+		t.Fatalf("new redis cache: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestRedisCache_SharesStateBetweenInstances(t *testing.T) {
+	url := startFakeRedis(t)
+	a := newTestRedisCache(t, url)
+	b := newTestRedisCache(t, url)
+
+	pkg := "pkg-1"
+	a.SetUser("u1", domain.UserStatusActive, &pkg, 2)
+	a.UpdateUserUsage("u1", 10, 20)
+	user := b.GetUser("u1")
+	if user == nil || user.ActivePackageID == nil || *user.ActivePackageID != pkg || user.CurrentTotal != 30 || user.MaxConcurrent != 2 {
+		t.Fatalf("expected the user cached by one instance to be seen by the other, got %+v", user)
+	}
+	b.UpdateUserUsage("u2", 1, 1)
+	if b.GetUser("u2") != nil {
+		t.Fatalf("expected usage for an uncached user not to create an entry")
+	}
+
+	a.GetOrCreateSessionCache("u1").AddSession("s1", "", "node-1", "ip-1", "", "", "", 0)
+	if count := b.GetOrCreateSessionCache("u1").GetActiveSessionCount(time.Minute); count != 1 {
+		t.Fatalf("expected the session added on one instance to count on the other, got %d", count)
+	}
+	b.GetOrCreateSessionCache("u1").RemoveSession("s1")
+	if a.GetOrCreateSessionCache("u1").HasSession("s1") {
+		t.Fatalf("expected the removal to reach the first instance")
+	}
+	a.GetOrCreateSessionCache("u3").AddSession("s3", "", "node-1", "ip-3", "", "", "", 0)
+	users := 0
+	b.RangeAllSessions(func(string, *SessionCache) bool { users++; return true })
+	if users != 1 {
+		t.Fatalf("expected one user with sessions, got %d", users)
+	}
+
+	a.SetPenalty("u1", "concurrent_limit", domain.PenaltyActionReject, time.Minute)
+	if p := b.GetPenalty("u1"); p == nil || p.Reason != "concurrent_limit" || p.Action != domain.PenaltyActionReject {
+		t.Fatalf("expected the penalty to be shared, got %+v", p)
+	}
+	b.ClearPenalty("u1")
+	if a.GetPenalty("u1") != nil {
+		t.Fatalf("expected the cleared penalty to be gone everywhere")
+	}
+	a.RecordOffense("u1", time.Minute)
+	if n := b.RecordOffense("u1", time.Minute); n != 2 {
+		t.Fatalf("expected offenses to be counted across instances, got %d", n)
+	}
+
+	a.QueueDisconnect("u1", "s1", "quota", "node-1")
+	a.QueueDisconnect("u3", "s3", "quota", "node-2")
+	if n := b.PendingDisconnects("node-1"); n != 1 {
+		t.Fatalf("expected one pending disconnect for node-1, got %d", n)
+	}
+	batch := b.GetDisconnectBatch()
+	if len(batch) != 2 || batch[0].UserID != "u1" || batch[1].NodeID != "node-2" {
+		t.Fatalf("expected both queued disconnects in order, got %+v", batch)
+	}
+	if len(a.GetDisconnectBatch()) != 0 {
+		t.Fatalf("expected the queue to be drained for every instance")
+	}
+
+	a.QueueDisconnect("u1", "s1", "quota", "node-1")
+	taken := b.TakeDisconnects("node-1", 0, time.Minute)
+	if len(taken) != 1 || taken[0].ID == "" {
+		t.Fatalf("expected the queued command to be delivered, got %+v", taken)
+	}
+	if len(a.TakeDisconnects("node-1", 0, time.Minute)) != 0 {
+		t.Fatalf("expected the lease to be shared between instances")
+	}
+	if n := a.AckDisconnects("node-1", []string{taken[0].ID}); n != 1 || b.PendingDisconnects("node-1") != 0 {
+		t.Fatalf("expected the ack to remove the command everywhere, got %d", n)
+	}
+
+	a.SetDecision("u1", "quota exceeded", domain.ReasonQuotaExceeded, time.Minute)
+	b.ForgetUser("u1")
+	if a.GetDecision("u1") != nil || a.GetUser("u1") != nil {
+		t.Fatalf("expected forgetting a user to drop its shared entry and decision")
+	}
+}
+
+func TestRedisCache_RejectsBadURL(t *testing.T) {
+	if _, err := NewRedisCache("http://localhost:6379", "hue:", zap.NewNop()); err == nil {
+		t.Fatalf("expected a non-redis URL to be rejected")
+	}
+}
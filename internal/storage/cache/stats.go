@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// StatsCache keeps rendered stats responses for a short TTL so polling panels
+// do not hit SQLite on every request. Writes that change the underlying data
+// call Bust; usage recorded by nodes is picked up when the TTL runs out.
+type StatsCache struct {
+	ttl     time.Duration
+	entries map[string]*StatsEntry
+	mu      sync.RWMutex
+}
+
+// StatsEntry is a cached stats response body with its entity tag
+type StatsEntry struct {
+	Body      []byte
+	ETag      string
+	ExpiresAt time.Time
+}
+
+// NewStatsCache creates a stats cache. A ttl of zero or less disables caching.
+func NewStatsCache(ttl time.Duration) *StatsCache {
+	return &StatsCache{
+		ttl:     ttl,
+		entries: make(map[string]*StatsEntry),
+	}
+}
+
+// Get returns the cached entry for key if it has not expired
+func (c *StatsCache) Get(key string) (*StatsEntry, bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(entry.ExpiresAt) {
+		return nil, false
+	}
+	return entry, true
+}
+
+// Set stores body under key and returns the entry with its entity tag. The
+// entry is returned even when caching is disabled so callers can still send
+// an ETag.
+func (c *StatsCache) Set(key string, body []byte) *StatsEntry {
+	entry := &StatsEntry{Body: body, ETag: StatsETag(body)}
+	if c == nil || c.ttl <= 0 {
+		return entry
+	}
+
+	entry.ExpiresAt = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+	return entry
+}
+
+// Bust drops every cached entry
+func (c *StatsCache) Bust() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.entries = make(map[string]*StatsEntry)
+	c.mu.Unlock()
+}
+
+// StatsETag returns a strong entity tag for a response body
+func StatsETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
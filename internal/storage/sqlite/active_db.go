@@ -3,7 +3,9 @@ package sqlite
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"sync"
 	"time"
 
@@ -13,13 +15,43 @@ import (
 // ActiveDB handles temporary usage data with buffered writes
 type ActiveDB struct {
 	*DB
-	buffer     []*domain.UsageReport
-	bufferMu   sync.Mutex
-	flushSize  int
+	buffer    []bufferedUsage
+	bufferMu  sync.Mutex
+	flushSize int
+	onFlush   func(time.Duration)
+
+	countersMu sync.Mutex
+}
+
+// SetFlushObserver has fn called with the duration of every buffer flush
+func (db *ActiveDB) SetFlushObserver(fn func(time.Duration)) {
+	db.bufferMu.Lock()
+	defer db.bufferMu.Unlock()
+	db.onFlush = fn
+}
+
+// BufferDepth returns how many usage reports wait to be flushed
+func (db *ActiveDB) BufferDepth() int {
+	db.bufferMu.Lock()
+	defer db.bufferMu.Unlock()
+	return len(db.buffer)
 }
 
-// NewActiveDB creates a new ActiveDB instance
+// NewActiveDB opens the active database and applies pending migrations
 func NewActiveDB(dbURL string) (*ActiveDB, error) {
+	activeDB, err := OpenActiveDB(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := activeDB.Migrate(); err != nil {
+		activeDB.Close()
+		return nil, err
+	}
+	return activeDB, nil
+}
+
+// OpenActiveDB opens the active database without migrating it
+func OpenActiveDB(dbURL string) (*ActiveDB, error) {
 	// Use a separate database file for active data
 	activeURL := dbURL
 	if dbURL != ":memory:" && !containsActiveSuffix(dbURL) {
@@ -31,23 +63,35 @@ func NewActiveDB(dbURL string) (*ActiveDB, error) {
 		return nil, err
 	}
 
-	activeDB := &ActiveDB{
+	db.migrations = activeMigrations
+	return &ActiveDB{
 		DB:        db,
-		buffer:    make([]*domain.UsageReport, 0, 1000),
+		buffer:    make([]bufferedUsage, 0, 1000),
 		flushSize: 100,
-	}
-
-	// Create tables
-	if err := activeDB.createTables(); err != nil {
-		return nil, err
-	}
+	}, nil
+}
 
-	return activeDB, nil
+// activeMigrations are the active database's schema changes, oldest first
+var activeMigrations = []Migration{
+	{Version: 1, Name: "baseline", Up: migrateActiveBaseline, Down: dropTables(
+		"processed_reports",
+		"pending_reports",
+		"usage_counters",
+		"usage_reports",
+	)},
+	// /stats counts the reports that arrived in the last minute
+	{Version: 2, Name: "usage_reports_created_at_index", Up: execAll(
+		`CREATE INDEX idx_usage_reports_created_at ON usage_reports(created_at)`,
+	), Down: execAll(
+		`DROP INDEX idx_usage_reports_created_at`,
+	)},
 }
 
-func (db *ActiveDB) createTables() error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS usage_reports (
+// migrateActiveBaseline creates the schema as it was before versioned
+// migrations. Databases created before then are brought up to it as well.
+func migrateActiveBaseline(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS usage_reports (
 			id TEXT PRIMARY KEY,
 			user_id TEXT NOT NULL,
 			node_id TEXT NOT NULL,
@@ -59,27 +103,238 @@ func (db *ActiveDB) createTables() error {
 			timestamp DATETIME NOT NULL,
 			processed INTEGER DEFAULT 0,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_usage_reports_user_id ON usage_reports(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_usage_reports_timestamp ON usage_reports(timestamp)`,
+		`CREATE TABLE IF NOT EXISTS usage_counters (
+			user_id TEXT NOT NULL,
+			service_id TEXT NOT NULL,
+			upload INTEGER NOT NULL,
+			download INTEGER NOT NULL,
+			updated_at DATETIME NOT NULL,
+			PRIMARY KEY (user_id, service_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS pending_reports (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			report TEXT NOT NULL,
+			queued_at DATETIME NOT NULL
+		)`,
+		// A claimed report has no result until it finishes processing
+		`CREATE TABLE IF NOT EXISTS processed_reports (
+			id TEXT PRIMARY KEY,
+			result TEXT,
+			processed_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_processed_reports_processed_at ON processed_reports(processed_at)`,
+	}
+	if err := execAll(stmts...)(tx); err != nil {
+		return err
+	}
+
+	// Billed bytes are what the report was charged when it arrived; rows
+	// buffered before they were kept have NULL here
+	for _, column := range []string{"billed_upload", "billed_download"} {
+		if err := ensureColumn(tx, "usage_reports", column, "INTEGER"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimReport records that a report ID is being processed. It returns false
+// when the ID was already claimed.
+func (db *ActiveDB) ClaimReport(id string, at time.Time) (bool, error) {
+	res, err := db.Exec(`
+		INSERT INTO processed_reports (id, processed_at) VALUES (?, ?)
+		ON CONFLICT(id) DO NOTHING
+	`, id, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// StoreReportResult saves the result of a claimed report
+func (db *ActiveDB) StoreReportResult(id string, result *domain.UsageReportResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE processed_reports SET result = ? WHERE id = ?`, string(data), id)
+	return err
+}
+
+// GetReportResult returns the saved result of a claimed report. It returns
+// nil while the report is still being processed or when it was never
+// claimed.
+func (db *ActiveDB) GetReportResult(id string) (*domain.UsageReportResult, error) {
+	var data sql.NullString
+	err := db.QueryRow(`SELECT result FROM processed_reports WHERE id = ?`, id).Scan(&data)
+	if err == sql.ErrNoRows || (err == nil && !data.Valid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result domain.UsageReportResult
+	if err := json.Unmarshal([]byte(data.String), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ReleaseReport drops a report's claim so the ID can be processed again
+func (db *ActiveDB) ReleaseReport(id string) error {
+	_, err := db.Exec(`DELETE FROM processed_reports WHERE id = ?`, id)
+	return err
+}
+
+// DeleteProcessedReports drops the claims made before olderThan and returns
+// how many were removed
+func (db *ActiveDB) DeleteProcessedReports(olderThan time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM processed_reports WHERE processed_at < ?`, olderThan)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PendingReport is a usage report held until its user exists
+type PendingReport struct {
+	Report   *domain.UsageReport
+	QueuedAt time.Time
+}
+
+// ErrPendingQueueFull is returned when the pending report table is at its cap
+var ErrPendingQueueFull = errors.New("pending report queue is full")
+
+// QueuePendingReport holds a report for a user HUE does not know yet. It
+// returns ErrPendingQueueFull when max reports are already held; max 0 means
+// no limit.
+func (db *ActiveDB) QueuePendingReport(report *domain.UsageReport, max int) error {
+	data, err := json.Marshal(report)
 	if err != nil {
 		return err
 	}
 
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_usage_reports_user_id ON usage_reports(user_id)`)
+	res, err := db.Exec(`
+		INSERT INTO pending_reports (id, user_id, report, queued_at)
+		SELECT ?, ?, ?, ?
+		WHERE ? <= 0 OR (SELECT COUNT(*) FROM pending_reports) < ?
+	`, report.ID, report.UserID, string(data), time.Now(), max, max)
 	if err != nil {
 		return err
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPendingQueueFull
+	}
+	return nil
+}
+
+// ListPendingReports returns up to limit held reports, oldest first
+func (db *ActiveDB) ListPendingReports(limit int) ([]*PendingReport, error) {
+	rows, err := db.Query(`SELECT report, queued_at FROM pending_reports ORDER BY queued_at LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_usage_reports_timestamp ON usage_reports(timestamp)`)
+	pending := []*PendingReport{}
+	for rows.Next() {
+		var data string
+		p := &PendingReport{}
+		if err := rows.Scan(&data, scanTime(&p.QueuedAt)); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &p.Report); err != nil {
+			return nil, err
+		}
+		pending = append(pending, p)
+	}
+	return pending, rows.Err()
+}
+
+// DeletePendingReport removes a held report
+func (db *ActiveDB) DeletePendingReport(id string) error {
+	_, err := db.Exec(`DELETE FROM pending_reports WHERE id = ?`, id)
 	return err
 }
 
-// BufferUsage adds a usage report to the in-memory buffer
+// CounterDelta converts absolute counters reported for a user on a service
+// into the bytes since the previous report and stores the new values. The
+// first report for a pair only sets the baseline and counts as zero, since
+// HUE cannot tell how much of the counter it already saw through another
+// path. See counterDelta for counters that go backwards.
+func (db *ActiveDB) CounterDelta(userID, serviceID string, upload, download int64) (deltaUp, deltaDown int64, err error) {
+	db.countersMu.Lock()
+	defer db.countersMu.Unlock()
+
+	var lastUp, lastDown int64
+	err = db.QueryRow(`SELECT upload, download FROM usage_counters WHERE user_id = ? AND service_id = ?`, userID, serviceID).Scan(&lastUp, &lastDown)
+	first := err == sql.ErrNoRows
+	if err != nil && !first {
+		return 0, 0, err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO usage_counters (user_id, service_id, upload, download, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, service_id) DO UPDATE SET upload = excluded.upload, download = excluded.download, updated_at = excluded.updated_at
+	`, userID, serviceID, upload, download, time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if first {
+		return 0, 0, nil
+	}
+	return counterDelta(lastUp, upload), counterDelta(lastDown, download), nil
+}
+
+// counterDelta returns the bytes between two readings of an absolute
+// counter. A counter that went backwards either wrapped or was reset. A
+// 32-bit counter last read in its upper half wrapped, and the delta runs
+// through the wrap; anything else is a reset after a backend restart, and
+// counting started again from zero.
+func counterDelta(last, current int64) int64 {
+	if current >= last {
+		return current - last
+	}
+	if last <= math.MaxUint32 && last > math.MaxUint32/2 {
+		return math.MaxUint32 - last + current + 1
+	}
+	return current
+}
+
+// bufferedUsage is a report waiting to be flushed, with the traffic it was
+// charged when known
+type bufferedUsage struct {
+	report     *domain.UsageReport
+	traffic    *domain.UsageTraffic
+	receivedAt time.Time // Stored as created_at
+}
+
+// BufferUsage adds a usage report to the in-memory buffer without billed
+// bytes; billing prices it through the node's current multiplier
 func (db *ActiveDB) BufferUsage(report *domain.UsageReport) error {
+	return db.bufferUsage(bufferedUsage{report: report})
+}
+
+// BufferBilledUsage adds a usage report to the in-memory buffer along with
+// the bytes it was billed, so later multiplier changes do not reprice it
+func (db *ActiveDB) BufferBilledUsage(report *domain.UsageReport, traffic domain.UsageTraffic) error {
+	return db.bufferUsage(bufferedUsage{report: report, traffic: &traffic})
+}
+
+func (db *ActiveDB) bufferUsage(entry bufferedUsage) error {
+	entry.receivedAt = time.Now()
+
 	db.bufferMu.Lock()
 	defer db.bufferMu.Unlock()
 
-	db.buffer = append(db.buffer, report)
+	db.buffer = append(db.buffer, entry)
 
 	// Auto-flush if buffer is full
 	if len(db.buffer) >= db.flushSize {
@@ -101,6 +356,10 @@ func (db *ActiveDB) flushBuffer() error {
 	if len(db.buffer) == 0 {
 		return nil
 	}
+	if db.onFlush != nil {
+		start := time.Now()
+		defer func() { db.onFlush(time.Since(start)) }()
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -108,8 +367,8 @@ func (db *ActiveDB) flushBuffer() error {
 	}
 
 	stmt, err := tx.Prepare(`
-		INSERT INTO usage_reports (id, user_id, node_id, service_id, upload, download, session_id, tags, timestamp, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO usage_reports (id, user_id, node_id, service_id, upload, download, billed_upload, billed_download, session_id, tags, timestamp, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		tx.Rollback()
@@ -117,13 +376,18 @@ func (db *ActiveDB) flushBuffer() error {
 	}
 	defer stmt.Close()
 
-	now := time.Now()
-	for _, report := range db.buffer {
+	for _, entry := range db.buffer {
+		report := entry.report
 		tags, _ := json.Marshal(report.Tags)
+		var billedUp, billedDown sql.NullInt64
+		if entry.traffic != nil {
+			billedUp = sql.NullInt64{Int64: entry.traffic.BilledUpload, Valid: true}
+			billedDown = sql.NullInt64{Int64: entry.traffic.BilledDownload, Valid: true}
+		}
 		_, err := stmt.Exec(
 			report.ID, report.UserID, report.NodeID, report.ServiceID,
-			report.Upload, report.Download, report.SessionID,
-			string(tags), report.Timestamp, now,
+			report.Upload, report.Download, billedUp, billedDown, report.SessionID,
+			string(tags), report.Timestamp, entry.receivedAt,
 		)
 		if err != nil {
 			tx.Rollback()
@@ -159,11 +423,10 @@ func (db *ActiveDB) GetUnprocessedReports(limit int) ([]*domain.UsageReport, err
 		report := &domain.UsageReport{}
 		var tags sql.NullString
 		var sessionID sql.NullString
-		var timestampRaw string
 
 		err := rows.Scan(
 			&report.ID, &report.UserID, &report.NodeID, &report.ServiceID,
-			&report.Upload, &report.Download, &sessionID, &tags, &timestampRaw,
+			&report.Upload, &report.Download, &sessionID, &tags, scanTime(&report.Timestamp),
 		)
 		if err != nil {
 			return nil, err
@@ -175,10 +438,6 @@ func (db *ActiveDB) GetUnprocessedReports(limit int) ([]*domain.UsageReport, err
 		if tags.Valid {
 			json.Unmarshal([]byte(tags.String), &report.Tags)
 		}
-		report.Timestamp, err = parseSQLiteTime(timestampRaw)
-		if err != nil {
-			return nil, err
-		}
 
 		reports = append(reports, report)
 	}
@@ -214,10 +473,15 @@ func (db *ActiveDB) MarkProcessed(ids []string) error {
 	return tx.Commit()
 }
 
-// DeleteOldReports deletes processed reports older than the retention period
-func (db *ActiveDB) DeleteOldReports(olderThan time.Time) error {
-	_, err := db.Exec(`DELETE FROM usage_reports WHERE processed = 1 AND timestamp < ?`, olderThan)
-	return err
+// DeleteOldReports deletes the usage reports timestamped before olderThan
+// and returns how many were removed. Reports are charged when they arrive,
+// so stored ones are only kept for stats and billing.
+func (db *ActiveDB) DeleteOldReports(olderThan time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM usage_reports WHERE timestamp < ?`, olderThan)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 // GetAggregatedUsage returns aggregated usage for a user within a time range
@@ -230,6 +494,216 @@ func (db *ActiveDB) GetAggregatedUsage(userID string, start, end time.Time) (upl
 	return
 }
 
+// GetUsageTotals returns the measured traffic and the number of reports of
+// every user within [start, end)
+func (db *ActiveDB) GetUsageTotals(start, end time.Time) (upload, download, reports int64, err error) {
+	if err = db.Flush(); err != nil {
+		return
+	}
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(upload), 0), COALESCE(SUM(download), 0), COUNT(*)
+		FROM usage_reports
+		WHERE timestamp >= ? AND timestamp < ?
+	`, start, end).Scan(&upload, &download, &reports)
+	return
+}
+
+// CountReportsReceived returns the number of reports that arrived within
+// [start, end), whatever time the nodes stamped them with
+func (db *ActiveDB) CountReportsReceived(start, end time.Time) (int64, error) {
+	if err := db.Flush(); err != nil {
+		return 0, err
+	}
+	var reports int64
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM usage_reports
+		WHERE created_at >= ? AND created_at < ?
+	`, start, end).Scan(&reports)
+	return reports, err
+}
+
+// TagUsage represents usage aggregated for a single report tag
+type TagUsage struct {
+	Tag      string          `json:"tag"`
+	Upload   int64           `json:"upload"`
+	Download int64           `json:"download"`
+	Total    int64           `json:"total"`
+	Reports  int64           `json:"reports"`
+	Nodes    []*TagNodeUsage `json:"nodes"`
+}
+
+// TagNodeUsage represents the share of a tag's usage reported by one node
+type TagNodeUsage struct {
+	NodeID   string `json:"node_id"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+	Total    int64  `json:"total"`
+	Reports  int64  `json:"reports"`
+}
+
+// GetUsageByTag aggregates usage per tag and node within a time range.
+// An empty tag returns every tag seen in the range.
+func (db *ActiveDB) GetUsageByTag(tag string, start, end time.Time) ([]*TagUsage, error) {
+	// Make sure buffered reports are part of the aggregation
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT j.value, r.node_id, COALESCE(SUM(r.upload), 0), COALESCE(SUM(r.download), 0), COUNT(*)
+		FROM usage_reports r, json_each(r.tags) j
+		WHERE j.type = 'text' AND r.timestamp >= ? AND r.timestamp <= ?
+	`
+	args := []interface{}{start, end}
+	if tag != "" {
+		query += " AND j.value = ?"
+		args = append(args, tag)
+	}
+	query += " GROUP BY j.value, r.node_id ORDER BY j.value, r.node_id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []*TagUsage{}
+	byTag := make(map[string]*TagUsage)
+	for rows.Next() {
+		node := &TagNodeUsage{}
+		var tagName string
+		if err := rows.Scan(&tagName, &node.NodeID, &node.Upload, &node.Download, &node.Reports); err != nil {
+			return nil, err
+		}
+		node.Total = node.Upload + node.Download
+
+		entry, ok := byTag[tagName]
+		if !ok {
+			entry = &TagUsage{Tag: tagName, Nodes: []*TagNodeUsage{}}
+			byTag[tagName] = entry
+			usage = append(usage, entry)
+		}
+		entry.Upload += node.Upload
+		entry.Download += node.Download
+		entry.Total += node.Total
+		entry.Reports += node.Reports
+		entry.Nodes = append(entry.Nodes, node)
+	}
+
+	return usage, rows.Err()
+}
+
+// UserNodeUsage is the usage of one user through one node. Upload and
+// Download are the measured bytes of all reports. BilledUpload and
+// BilledDownload sum what reports were charged when they arrived, and
+// UnbilledUpload and UnbilledDownload hold the measured bytes of reports
+// stored without billed bytes.
+type UserNodeUsage struct {
+	UserID           string
+	NodeID           string
+	Upload           int64
+	Download         int64
+	BilledUpload     int64
+	BilledDownload   int64
+	UnbilledUpload   int64
+	UnbilledDownload int64
+}
+
+// GetUsageByUserNode aggregates usage per user and node within [start, end)
+func (db *ActiveDB) GetUsageByUserNode(start, end time.Time) ([]*UserNodeUsage, error) {
+	return db.usageByUserNode("", start, end)
+}
+
+// GetUserUsageByNode aggregates one user's usage per node within
+// [start, end)
+func (db *ActiveDB) GetUserUsageByNode(userID string, start, end time.Time) ([]*UserNodeUsage, error) {
+	return db.usageByUserNode(userID, start, end)
+}
+
+// usageByUserNode aggregates usage per user and node, of every user when
+// userID is empty
+func (db *ActiveDB) usageByUserNode(userID string, start, end time.Time) ([]*UserNodeUsage, error) {
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT user_id, node_id, COALESCE(SUM(upload), 0), COALESCE(SUM(download), 0),
+			COALESCE(SUM(billed_upload), 0), COALESCE(SUM(billed_download), 0),
+			COALESCE(SUM(CASE WHEN billed_upload IS NULL THEN upload ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN billed_download IS NULL THEN download ELSE 0 END), 0)
+		FROM usage_reports
+		WHERE timestamp >= ? AND timestamp < ? AND (? = '' OR user_id = ?)
+		GROUP BY user_id, node_id
+		ORDER BY user_id, node_id
+	`, start, end, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []*UserNodeUsage{}
+	for rows.Next() {
+		u := &UserNodeUsage{}
+		if err := rows.Scan(&u.UserID, &u.NodeID, &u.Upload, &u.Download,
+			&u.BilledUpload, &u.BilledDownload, &u.UnbilledUpload, &u.UnbilledDownload); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// NodeActiveUsers is the number of distinct users that sent traffic through
+// a node in one day ("2006-01-02") or month ("2006-01")
+type NodeActiveUsers struct {
+	NodeID string `json:"node_id"`
+	Period string `json:"period"`
+	Users  int64  `json:"users"`
+}
+
+// GetActiveUsersByNode counts distinct users per node and day, or per node
+// and month when monthly is set, within [start, end). An empty nodeID covers
+// every node. Periods follow the dates reports were stored with.
+func (db *ActiveDB) GetActiveUsersByNode(nodeID string, monthly bool, start, end time.Time) ([]*NodeActiveUsers, error) {
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Both stored datetime forms start with YYYY-MM-DD
+	width := 10
+	if monthly {
+		width = 7
+	}
+	query := `
+		SELECT node_id, substr(timestamp, 1, ?) AS period, COUNT(DISTINCT user_id)
+		FROM usage_reports
+		WHERE node_id != '' AND timestamp >= ? AND timestamp < ?
+	`
+	args := []interface{}{width, start, end}
+	if nodeID != "" {
+		query += " AND node_id = ?"
+		args = append(args, nodeID)
+	}
+	query += " GROUP BY node_id, period ORDER BY node_id, period"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*NodeActiveUsers{}
+	for rows.Next() {
+		c := &NodeActiveUsers{}
+		if err := rows.Scan(&c.NodeID, &c.Period, &c.Users); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
 func containsActiveSuffix(url string) bool {
 	return len(url) > 7 && url[len(url)-7:] == "_active"
 }
@@ -3,8 +3,10 @@ package sqlite
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
@@ -14,8 +16,46 @@ type DB struct {
 	*sql.DB
 	path string
 	mu   sync.RWMutex
+
+	// read is a pool of read-only connections for list queries, nil unless
+	// Tune opened one
+	read *sql.DB
+
+	// migrations are the versioned schema changes of this database
+	migrations []Migration
+}
+
+// Tuning holds the PRAGMA settings applied to every connection and the size
+// of the read-only pool. Zero values leave SQLite's defaults.
+type Tuning struct {
+	BusyTimeout time.Duration // How long a connection waits for a lock before SQLITE_BUSY
+	Synchronous string        // OFF, NORMAL, FULL or EXTRA
+	CacheSize   int           // Pages when positive, KiB when negative
+	MmapSize    int64         // Bytes of the file to memory-map
+	ReadConns   int           // Read-only connections next to the single writer
 }
 
+// pragmas returns the tuning as PRAGMA statements without the PRAGMA keyword
+func (t Tuning) pragmas() []string {
+	var pragmas []string
+	if t.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("busy_timeout = %d", t.BusyTimeout.Milliseconds()))
+	}
+	if t.Synchronous != "" {
+		pragmas = append(pragmas, fmt.Sprintf("synchronous = %s", t.Synchronous))
+	}
+	if t.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("cache_size = %d", t.CacheSize))
+	}
+	if t.MmapSize > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("mmap_size = %d", t.MmapSize))
+	}
+	return pragmas
+}
+
+// validSynchronous lists the values PRAGMA synchronous accepts
+var validSynchronous = map[string]bool{"OFF": true, "NORMAL": true, "FULL": true, "EXTRA": true}
+
 // NewDB creates a new SQLite database connection
 func NewDB(dbURL string) (*DB, error) {
 	// Parse database URL
@@ -47,8 +87,69 @@ func NewDB(dbURL string) (*DB, error) {
 	}, nil
 }
 
+// Tune applies t to the writer connection and, for a database file, opens a
+// pool of t.ReadConns read-only connections with the same settings. An
+// in-memory database has no read pool, since every connection would see a
+// database of its own.
+func (db *DB) Tune(t Tuning) error {
+	t.Synchronous = strings.ToUpper(t.Synchronous)
+	if t.Synchronous != "" && !validSynchronous[t.Synchronous] {
+		return fmt.Errorf("invalid synchronous setting %q, expected OFF, NORMAL, FULL or EXTRA", t.Synchronous)
+	}
+	pragmas := t.pragmas()
+	for _, pragma := range pragmas {
+		if _, err := db.Exec("PRAGMA " + pragma); err != nil {
+			return fmt.Errorf("failed to apply PRAGMA %s: %w", pragma, err)
+		}
+	}
+
+	if t.ReadConns <= 0 || isMemoryPath(db.path) {
+		return nil
+	}
+	params := url.Values{}
+	for _, pragma := range append(pragmas, "query_only = 1") {
+		params.Add("_pragma", pragma)
+	}
+	sep := "?"
+	if strings.Contains(db.path, "?") {
+		sep = "&"
+	}
+	read, err := sql.Open("sqlite", db.path+sep+params.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to open read pool: %w", err)
+	}
+	read.SetMaxOpenConns(t.ReadConns)
+	read.SetMaxIdleConns(t.ReadConns)
+	if err := read.Ping(); err != nil {
+		read.Close()
+		return fmt.Errorf("failed to open read pool: %w", err)
+	}
+	if db.read != nil {
+		db.read.Close()
+	}
+	db.read = read
+	return nil
+}
+
+// isMemoryPath reports whether path names an in-memory database
+func isMemoryPath(path string) bool {
+	return path == ":memory:" || strings.Contains(path, "mode=memory") || strings.HasPrefix(path, "file::memory:")
+}
+
+// reader returns the read-only pool, or the writer when there is none. Only
+// statements that do not write may run on it.
+func (db *DB) reader() *sql.DB {
+	if db.read != nil {
+		return db.read
+	}
+	return db.DB
+}
+
 // Close closes the database connection
 func (db *DB) Close() error {
+	if db.read != nil {
+		db.read.Close()
+	}
 	return db.DB.Close()
 }
 
@@ -76,3 +177,45 @@ func (db *DB) Transaction(fn func(tx *sql.Tx) error) error {
 
 	return tx.Commit()
 }
+
+// busyRetries bounds how often TransactionWithRetry retries a busy database
+const busyRetries = 5
+
+// busyBackoff is the wait before the first retry; it doubles on each retry
+const busyBackoff = 10 * time.Millisecond
+
+// TransactionWithRetry executes a function within a transaction and retries
+// it while the database is locked by another connection or process. fn may
+// run more than once, so it must only write through tx.
+func (db *DB) TransactionWithRetry(fn func(tx *sql.Tx) error) error {
+	wait := busyBackoff
+	for attempt := 0; ; attempt++ {
+		err := db.Transaction(fn)
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// isBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED
+func isBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "SQLITE_LOCKED") || strings.Contains(msg, "database is locked")
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// ensureColumn adds a column to an existing table if it is missing
+func ensureColumn(db execer, table, column, definition string) error {
+	if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)); err != nil {
+		if !strings.Contains(strings.ToLower(err.Error()), "duplicate column name") {
+			return fmt.Errorf("failed to ensure %s.%s column: %w", table, column, err)
+		}
+	}
+	return nil
+}
@@ -2,8 +2,13 @@ package sqlite
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hiddify/hue-go/internal/domain"
@@ -12,10 +17,26 @@ import (
 // HistoryDB handles historical event and usage data
 type HistoryDB struct {
 	*DB
+	buffer    []UsageHistoryRecord
+	bufferMu  sync.Mutex
+	flushSize int
 }
 
-// NewHistoryDB creates a new HistoryDB instance
+// NewHistoryDB opens the history database and applies pending migrations
 func NewHistoryDB(dbURL string) (*HistoryDB, error) {
+	historyDB, err := OpenHistoryDB(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := historyDB.Migrate(); err != nil {
+		historyDB.Close()
+		return nil, err
+	}
+	return historyDB, nil
+}
+
+// OpenHistoryDB opens the history database without migrating it
+func OpenHistoryDB(dbURL string) (*HistoryDB, error) {
 	// Use a separate database file for history data
 	historyURL := dbURL
 	if dbURL != ":memory:" && !containsHistorySuffix(dbURL) {
@@ -27,18 +48,42 @@ func NewHistoryDB(dbURL string) (*HistoryDB, error) {
 		return nil, err
 	}
 
-	historyDB := &HistoryDB{DB: db}
-
-	// Create tables
-	if err := historyDB.createTables(); err != nil {
-		return nil, err
-	}
+	db.migrations = historyMigrations
+	return &HistoryDB{
+		DB:        db,
+		buffer:    make([]UsageHistoryRecord, 0, 1000),
+		flushSize: 100,
+	}, nil
+}
 
-	return historyDB, nil
+// historyMigrations are the history database's schema changes, oldest first
+var historyMigrations = []Migration{
+	{Version: 1, Name: "baseline", Up: migrateHistoryBaseline, Down: dropTables(
+		"node_usage_snapshots",
+		"webhook_dead_letters",
+		"usage_history",
+		"events",
+	)},
+	// Cover the columns the top users and nodes reports read, so ranking a
+	// time range does not touch the table
+	{Version: 2, Name: "usage_history_top_indexes", Up: execAll(
+		`CREATE INDEX idx_usage_history_timestamp_user ON usage_history(timestamp, user_id, upload, download)`,
+		`CREATE INDEX idx_usage_history_timestamp_node ON usage_history(timestamp, node_id, upload, download)`,
+	), Down: execAll(
+		`DROP INDEX idx_usage_history_timestamp_user`,
+		`DROP INDEX idx_usage_history_timestamp_node`,
+	)},
+	{Version: 3, Name: "usage_rollups", Up: migrateUsageRollups, Down: dropTables(
+		"usage_daily",
+		"usage_hourly",
+		"usage_rollup_state",
+	)},
 }
 
-func (db *HistoryDB) createTables() error {
-	queries := []string{
+// migrateHistoryBaseline creates the schema as it was before versioned
+// migrations. Databases created before then are brought up to it as well.
+func migrateHistoryBaseline(tx *sql.Tx) error {
+	stmts := []string{
 		`CREATE TABLE IF NOT EXISTS events (
 			id TEXT PRIMARY KEY,
 			type TEXT NOT NULL,
@@ -59,23 +104,59 @@ func (db *HistoryDB) createTables() error {
 			service_id TEXT NOT NULL,
 			upload INTEGER NOT NULL,
 			download INTEGER NOT NULL,
+			raw_upload INTEGER NOT NULL DEFAULT 0,
+			raw_download INTEGER NOT NULL DEFAULT 0,
 			session_id TEXT,
 			country TEXT,
 			city TEXT,
 			isp TEXT,
+			asn INTEGER NOT NULL DEFAULT 0,
 			tags TEXT,
 			timestamp DATETIME NOT NULL,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+			id TEXT PRIMARY KEY,
+			url TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			event_type TEXT NOT NULL,
+			payload BLOB NOT NULL,
+			attempts INTEGER NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			failed_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS node_usage_snapshots (
+			id TEXT PRIMARY KEY,
+			node_id TEXT NOT NULL,
+			reset_mode TEXT NOT NULL,
+			upload INTEGER NOT NULL,
+			download INTEGER NOT NULL,
+			period_start DATETIME NOT NULL,
+			reset_at DATETIME NOT NULL
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_events_type ON events(type)`,
 		`CREATE INDEX IF NOT EXISTS idx_events_user_id ON events(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_usage_history_user_id ON usage_history(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_usage_history_timestamp ON usage_history(timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_node_usage_snapshots_node_id ON node_usage_snapshots(node_id, reset_at)`,
+	}
+
+	if err := execAll(stmts...)(tx); err != nil {
+		return err
 	}
 
-	for _, q := range queries {
-		if _, err := db.Exec(q); err != nil {
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"usage_history", "raw_upload", "INTEGER NOT NULL DEFAULT 0"},
+		{"usage_history", "raw_download", "INTEGER NOT NULL DEFAULT 0"},
+		{"usage_history", "asn", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		if err := ensureColumn(tx, c.table, c.column, c.definition); err != nil {
 			return err
 		}
 	}
@@ -83,22 +164,65 @@ func (db *HistoryDB) createTables() error {
 	return nil
 }
 
-// StoreEvent stores an event in the history
+// StoreEvent stores an event in the history and sets its Seq
 func (db *HistoryDB) StoreEvent(event *domain.Event) error {
 	tags, _ := json.Marshal(event.Tags)
 
-	_, err := db.Exec(`
+	result, err := db.Exec(`
 		INSERT INTO events (id, type, user_id, package_id, node_id, service_id, tags, metadata, timestamp, created_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, event.ID, event.Type, event.UserID, event.PackageID, event.NodeID, event.ServiceID,
 		string(tags), event.Metadata, event.Timestamp, time.Now())
+	if err != nil {
+		return err
+	}
 
+	event.Seq, err = result.LastInsertId()
 	return err
 }
 
+// eventColumns are the columns scanEvent reads
+const eventColumns = `id, type, user_id, package_id, node_id, service_id, tags, metadata, timestamp`
+
+// scanEvent reads a row selected with eventColumns, followed by extra
+func scanEvent(row rowScanner, extra ...interface{}) (*domain.Event, error) {
+	event := &domain.Event{}
+	var userID, packageID, nodeID, serviceID sql.NullString
+	var tags sql.NullString
+	var metadata []byte
+
+	dest := append([]interface{}{
+		&event.ID, &event.Type, &userID, &packageID, &nodeID, &serviceID,
+		&tags, &metadata, scanTime(&event.Timestamp),
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	if userID.Valid {
+		event.UserID = &userID.String
+	}
+	if packageID.Valid {
+		event.PackageID = &packageID.String
+	}
+	if nodeID.Valid {
+		event.NodeID = &nodeID.String
+	}
+	if serviceID.Valid {
+		event.ServiceID = &serviceID.String
+	}
+	if tags.Valid {
+		json.Unmarshal([]byte(tags.String), &event.Tags)
+	}
+	if metadata != nil {
+		event.Metadata = metadata
+	}
+	return event, nil
+}
+
 // GetEvents retrieves events with optional filtering
 func (db *HistoryDB) GetEvents(eventType *domain.EventType, userID *string, start, end *time.Time, limit int) ([]*domain.Event, error) {
-	query := `SELECT id, type, user_id, package_id, node_id, service_id, tags, metadata, timestamp FROM events WHERE 1=1`
+	query := `SELECT ` + eventColumns + ` FROM events WHERE 1=1`
 	args := []interface{}{}
 
 	if start != nil {
@@ -133,74 +257,305 @@ func (db *HistoryDB) GetEvents(eventType *domain.EventType, userID *string, star
 
 	events := []*domain.Event{}
 	for rows.Next() {
-		event := &domain.Event{}
-		var userID, packageID, nodeID, serviceID sql.NullString
-		var tags sql.NullString
-		var metadata []byte
-		var timestampRaw string
-
-		err := rows.Scan(
-			&event.ID, &event.Type, &userID, &packageID, &nodeID, &serviceID,
-			&tags, &metadata, &timestampRaw,
-		)
+		event, err := scanEvent(rows)
 		if err != nil {
 			return nil, err
 		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+const (
+	// DefaultEventPageSize is the page size when a filter sets no limit
+	DefaultEventPageSize = 100
+	// MaxEventPageSize caps the page size
+	MaxEventPageSize = 1000
+)
+
+// ErrInvalidEventCursor is returned for a cursor ListEvents did not issue
+var ErrInvalidEventCursor = errors.New("invalid event cursor")
+
+// ListEvents returns a page of events, newest first. Pages are keyed on the
+// stored timestamp and rowid of the last event, so events written while a
+// client pages through do not shift later pages.
+func (db *HistoryDB) ListEvents(filter domain.EventFilter) (*domain.EventPage, error) {
+	query := `SELECT ` + eventColumns + `, rowid, CAST(timestamp AS TEXT) FROM events WHERE 1=1`
+	args := []interface{}{}
 
-		if userID.Valid {
-			event.UserID = &userID.String
+	if filter.From != nil {
+		query += " AND timestamp >= ?"
+		args = append(args, *filter.From)
+	}
+	if filter.To != nil {
+		query += " AND timestamp <= ?"
+		args = append(args, *filter.To)
+	}
+	if filter.Type != nil {
+		query += " AND type = ?"
+		args = append(args, *filter.Type)
+	}
+	if filter.UserID != nil {
+		query += " AND user_id = ?"
+		args = append(args, *filter.UserID)
+	}
+	if filter.Cursor != "" {
+		timestamp, rowID, err := decodeEventCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
 		}
-		if packageID.Valid {
-			event.PackageID = &packageID.String
+		query += " AND (timestamp < ? OR (timestamp = ? AND rowid < ?))"
+		args = append(args, timestamp, timestamp, rowID)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultEventPageSize
+	}
+	if limit > MaxEventPageSize {
+		limit = MaxEventPageSize
+	}
+	// One extra row tells whether another page follows
+	query += fmt.Sprintf(" ORDER BY timestamp DESC, rowid DESC LIMIT %d", limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &domain.EventPage{Events: []*domain.Event{}}
+	var lastRowID int64
+	var lastTimestamp string
+	for rows.Next() {
+		var rowID int64
+		var timestamp string
+		event, err := scanEvent(rows, &rowID, &timestamp)
+		if err != nil {
+			return nil, err
 		}
-		if nodeID.Valid {
-			event.NodeID = &nodeID.String
+		if len(page.Events) == limit {
+			page.NextCursor = encodeEventCursor(lastTimestamp, lastRowID)
+			break
 		}
-		if serviceID.Valid {
-			event.ServiceID = &serviceID.String
+		page.Events = append(page.Events, event)
+		lastRowID, lastTimestamp = rowID, timestamp
+	}
+	return page, rows.Err()
+}
+
+// ErrEventNotFound is returned when a replay starts after an unknown event
+var ErrEventNotFound = errors.New("event not found")
+
+// ReplayEvents calls fn for each event matching filter in the order they
+// were stored, with Seq set, without loading them all at once. It stops at the first
+// error fn returns. fn must not query the history database.
+func (db *HistoryDB) ReplayEvents(filter domain.EventReplayFilter, fn func(*domain.Event) error) error {
+	var conditions []string
+	var args []interface{}
+	if filter.AfterID != "" {
+		var after int64
+		err := db.reader().QueryRow(`SELECT rowid FROM events WHERE id = ?`, filter.AfterID).Scan(&after)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEventNotFound
 		}
-		if tags.Valid {
-			json.Unmarshal([]byte(tags.String), &event.Tags)
+		if err != nil {
+			return err
 		}
-		if metadata != nil {
-			event.Metadata = metadata
+		conditions = append(conditions, "rowid > ?")
+		args = append(args, after)
+	}
+	if len(filter.Types) > 0 {
+		conditions = append(conditions, "type IN (?"+strings.Repeat(", ?", len(filter.Types)-1)+")")
+		for _, t := range filter.Types {
+			args = append(args, t)
 		}
-		event.Timestamp, err = parseSQLiteTime(timestampRaw)
+	}
+	if filter.UserID != nil {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, *filter.UserID)
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, *filter.From)
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, *filter.To)
+	}
+
+	query := `SELECT ` + eventColumns + `, rowid FROM events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY rowid"
+
+	rows, err := db.reader().Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seq int64
+		event, err := scanEvent(rows, &seq)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		event.Seq = seq
+		if err := fn(event); err != nil {
+			return err
 		}
-
-		events = append(events, event)
 	}
+	return rows.Err()
+}
 
-	return events, nil
+// encodeEventCursor makes an opaque cursor from an event's stored timestamp
+// and rowid
+func encodeEventCursor(timestamp string, rowID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(rowID, 10) + "|" + timestamp))
+}
+
+func decodeEventCursor(cursor string) (string, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, ErrInvalidEventCursor
+	}
+	id, timestamp, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return "", 0, ErrInvalidEventCursor
+	}
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return "", 0, ErrInvalidEventCursor
+	}
+	return timestamp, rowID, nil
 }
 
-// StoreUsageHistory stores aggregated usage history
+// StoreUsageHistory stores aggregated usage history. upload and download hold
+// the billed bytes; the measured bytes are kept next to them for auditing.
 func (db *HistoryDB) StoreUsageHistory(
 	userID, packageID, nodeID, serviceID string,
-	upload, download int64,
+	traffic domain.UsageTraffic,
 	sessionID string,
 	geoData *domain.GeoData,
 	tags []string,
 	timestamp time.Time,
 ) error {
-	id := generateID()
-	tagsJSON, _ := json.Marshal(tags)
+	_, err := db.Exec(insertUsageHistory, UsageHistoryRecord{
+		UserID:    userID,
+		PackageID: packageID,
+		NodeID:    nodeID,
+		ServiceID: serviceID,
+		SessionID: sessionID,
+		Traffic:   traffic,
+		Geo:       geoData,
+		Tags:      tags,
+		Timestamp: timestamp,
+	}.args(time.Now())...)
+	return err
+}
 
-	_, err := db.Exec(`
-		INSERT INTO usage_history (id, user_id, package_id, node_id, service_id, upload, download, session_id, country, city, isp, tags, timestamp, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, id, userID, packageID, nodeID, serviceID, upload, download, sessionID,
-		geoData.Country, geoData.City, geoData.ISP, string(tagsJSON), timestamp, time.Now())
+const insertUsageHistory = `
+	INSERT INTO usage_history (id, user_id, package_id, node_id, service_id, upload, download, raw_upload, raw_download, session_id, country, city, isp, asn, tags, timestamp, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// UsageHistoryRecord is the traffic of one accepted report, waiting in the
+// buffer to be written to the usage history
+type UsageHistoryRecord struct {
+	UserID    string
+	PackageID string
+	NodeID    string
+	ServiceID string
+	SessionID string
+	Traffic   domain.UsageTraffic
+	Geo       *domain.GeoData // Nil when the IP could not be located
+	Tags      []string
+	Timestamp time.Time
+}
 
-	return err
+// args returns the insertUsageHistory arguments of the record
+func (r UsageHistoryRecord) args(now time.Time) []interface{} {
+	geo := r.Geo
+	if geo == nil {
+		geo = &domain.GeoData{}
+	}
+	tags, _ := json.Marshal(r.Tags)
+	return []interface{}{
+		generateID(), r.UserID, r.PackageID, r.NodeID, r.ServiceID,
+		r.Traffic.BilledUpload, r.Traffic.BilledDownload, r.Traffic.RawUpload, r.Traffic.RawDownload, r.SessionID,
+		geo.Country, geo.City, geo.ISP, geo.ASN, string(tags), r.Timestamp, now,
+	}
 }
 
+// BufferUsageHistory adds a record to the in-memory buffer, which is written
+// out by Flush or once it holds flushSize records
+func (db *HistoryDB) BufferUsageHistory(record UsageHistoryRecord) error {
+	db.bufferMu.Lock()
+	defer db.bufferMu.Unlock()
+
+	db.buffer = append(db.buffer, record)
+	if len(db.buffer) >= db.flushSize {
+		return db.flushBuffer()
+	}
+	return nil
+}
+
+// Flush writes all buffered usage history to the database
+func (db *HistoryDB) Flush() error {
+	db.bufferMu.Lock()
+	defer db.bufferMu.Unlock()
+
+	return db.flushBuffer()
+}
+
+func (db *HistoryDB) flushBuffer() error {
+	if len(db.buffer) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	stmt, err := tx.Prepare(insertUsageHistory)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, record := range db.buffer {
+		if _, err := stmt.Exec(record.args(now)...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to insert usage history: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	db.buffer = db.buffer[:0]
+	return nil
+}
+
+// usageHistoryColumns are the columns scanUsageHistory reads, in order
+const usageHistoryColumns = `id, user_id, package_id, node_id, service_id, upload, download, raw_upload, raw_download, session_id, country, city, isp, asn, tags, timestamp`
+
 // GetUsageHistory retrieves usage history for a user
 func (db *HistoryDB) GetUsageHistory(userID string, start, end time.Time, limit int) ([]*UsageHistoryEntry, error) {
+	// Make sure buffered usage history is part of the result
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
 	query := `
-		SELECT id, user_id, package_id, node_id, service_id, upload, download, session_id, country, city, isp, tags, timestamp
+		SELECT ` + usageHistoryColumns + `
 		FROM usage_history
 		WHERE user_id = ? AND timestamp >= ? AND timestamp <= ?
 		ORDER BY timestamp DESC
@@ -219,81 +574,274 @@ func (db *HistoryDB) GetUsageHistory(userID string, start, end time.Time, limit
 
 	entries := []*UsageHistoryEntry{}
 	for rows.Next() {
-		entry := &UsageHistoryEntry{}
-		var packageID, nodeID, serviceID, sessionID sql.NullString
-		var country, city, isp sql.NullString
-		var tags sql.NullString
-		var timestampRaw string
-
-		err := rows.Scan(
-			&entry.ID, &entry.UserID, &packageID, &nodeID, &serviceID,
-			&entry.Upload, &entry.Download, &sessionID,
-			&country, &city, &isp, &tags, &timestampRaw,
-		)
+		entry, err := scanUsageHistory(rows)
 		if err != nil {
 			return nil, err
 		}
+		entries = append(entries, entry)
+	}
 
-		if packageID.Valid {
-			entry.PackageID = packageID.String
-		}
-		if nodeID.Valid {
-			entry.NodeID = nodeID.String
-		}
-		if serviceID.Valid {
-			entry.ServiceID = serviceID.String
+	return entries, nil
+}
+
+// UsageHistoryFilter selects usage history rows; empty fields match all
+type UsageHistoryFilter struct {
+	UserID    string
+	NodeID    string
+	ServiceID string
+	From      *time.Time
+	To        *time.Time
+}
+
+// RangeUsageHistory calls fn for each usage history row matching filter,
+// oldest first, without loading them all at once. It stops at the first
+// error fn returns. fn must not query the history database.
+func (db *HistoryDB) RangeUsageHistory(filter UsageHistoryFilter, fn func(*UsageHistoryEntry) error) error {
+	// Make sure buffered usage history is part of the result
+	if err := db.Flush(); err != nil {
+		return err
+	}
+
+	var conditions []string
+	var args []interface{}
+	for _, eq := range []struct{ column, value string }{
+		{"user_id", filter.UserID}, {"node_id", filter.NodeID}, {"service_id", filter.ServiceID},
+	} {
+		if eq.value != "" {
+			conditions = append(conditions, eq.column+" = ?")
+			args = append(args, eq.value)
 		}
-		if sessionID.Valid {
-			entry.SessionID = sessionID.String
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, *filter.From)
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, *filter.To)
+	}
+
+	query := `SELECT ` + usageHistoryColumns + ` FROM usage_history`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY timestamp, rowid"
+
+	rows, err := db.reader().Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanUsageHistory(rows)
+		if err != nil {
+			return err
 		}
-		if country.Valid {
-			entry.Country = country.String
+		if err := fn(entry); err != nil {
+			return err
 		}
-		if city.Valid {
-			entry.City = city.String
+	}
+	return rows.Err()
+}
+
+func scanUsageHistory(row rowScanner) (*UsageHistoryEntry, error) {
+	entry := &UsageHistoryEntry{}
+	var packageID, nodeID, serviceID, sessionID sql.NullString
+	var country, city, isp sql.NullString
+	var tags sql.NullString
+
+	err := row.Scan(
+		&entry.ID, &entry.UserID, &packageID, &nodeID, &serviceID,
+		&entry.Upload, &entry.Download, &entry.RawUpload, &entry.RawDownload, &sessionID,
+		&country, &city, &isp, &entry.ASN, &tags, scanTime(&entry.Timestamp),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.PackageID = packageID.String
+	entry.NodeID = nodeID.String
+	entry.ServiceID = serviceID.String
+	entry.SessionID = sessionID.String
+	entry.Country = country.String
+	entry.City = city.String
+	entry.ISP = isp.String
+	if tags.Valid {
+		json.Unmarshal([]byte(tags.String), &entry.Tags)
+	}
+	return entry, nil
+}
+
+// TopUsage is the billed traffic of one user or node within a time range
+type TopUsage struct {
+	ID       string `json:"id"`
+	Name     string `json:"name,omitempty"` // Username or node name, filled in by callers
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+	Total    int64  `json:"total"`
+	Reports  int64  `json:"reports"`
+}
+
+// GetTopUsers returns the limit users with the most billed traffic within
+// [start, end), most first
+func (db *HistoryDB) GetTopUsers(start, end time.Time, limit int) ([]*TopUsage, error) {
+	return db.topUsage("user_id", start, end, limit)
+}
+
+// GetTopNodes returns the limit nodes with the most billed traffic within
+// [start, end), most first
+func (db *HistoryDB) GetTopNodes(start, end time.Time, limit int) ([]*TopUsage, error) {
+	return db.topUsage("node_id", start, end, limit)
+}
+
+// topUsage ranks the values of column by billed traffic. It reads the rows
+// the engine writes through BufferUsageHistory, so traffic from before that
+// write path existed is not ranked.
+func (db *HistoryDB) topUsage(column string, start, end time.Time, limit int) ([]*TopUsage, error) {
+	// Make sure buffered usage history is part of the result
+	if err := db.Flush(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.reader().Query(`
+		SELECT `+column+`, SUM(upload), SUM(download), SUM(upload) + SUM(download) AS total, COUNT(*)
+		FROM usage_history
+		WHERE timestamp >= ? AND timestamp < ?
+		GROUP BY `+column+`
+		ORDER BY total DESC, `+column+`
+		LIMIT ?
+	`, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	top := []*TopUsage{}
+	for rows.Next() {
+		u := &TopUsage{}
+		if err := rows.Scan(&u.ID, &u.Upload, &u.Download, &u.Total, &u.Reports); err != nil {
+			return nil, err
 		}
-		if isp.Valid {
-			entry.ISP = isp.String
+		top = append(top, u)
+	}
+	return top, rows.Err()
+}
+
+// DeleteOldHistory deletes the events, usage history and rollup buckets
+// from before olderThan and returns how many rows it removed per table.
+// Usage history not rolled up yet is lost to the rollups; run RollupUsage
+// first.
+func (db *HistoryDB) DeleteOldHistory(olderThan time.Time) (map[string]int64, error) {
+	deletes := []struct {
+		table, column string
+		before        interface{}
+	}{
+		{"events", "timestamp", olderThan},
+		{"usage_history", "timestamp", olderThan},
+		// Rollup buckets go once they end before olderThan
+		{usageRollups[RollupHourly].table, "bucket", olderThan.Format(usageRollups[RollupHourly].layout)},
+		{usageRollups[RollupDaily].table, "bucket", olderThan.Format(usageRollups[RollupDaily].layout)},
+	}
+
+	purged := make(map[string]int64, len(deletes))
+	for _, d := range deletes {
+		res, err := db.Exec(`DELETE FROM `+d.table+` WHERE `+d.column+` < ?`, d.before)
+		if err != nil {
+			return purged, err
 		}
-		if tags.Valid {
-			json.Unmarshal([]byte(tags.String), &entry.Tags)
+		if purged[d.table], err = res.RowsAffected(); err != nil {
+			return purged, err
 		}
-		entry.Timestamp, err = parseSQLiteTime(timestampRaw)
-		if err != nil {
+	}
+	return purged, nil
+}
+
+// StoreWebhookDeadLetter records an event webhook delivery that gave up
+func (db *HistoryDB) StoreWebhookDeadLetter(dl *domain.WebhookDeadLetter) error {
+	_, err := db.Exec(`
+		INSERT INTO webhook_dead_letters (id, url, event_id, event_type, payload, attempts, last_error, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, dl.ID, dl.URL, dl.EventID, dl.EventType, dl.Payload, dl.Attempts, dl.LastError, dl.FailedAt)
+	return err
+}
+
+// ListWebhookDeadLetters returns failed webhook deliveries, newest first
+func (db *HistoryDB) ListWebhookDeadLetters(limit int) ([]*domain.WebhookDeadLetter, error) {
+	query := `SELECT id, url, event_id, event_type, payload, attempts, last_error, failed_at FROM webhook_dead_letters ORDER BY failed_at DESC`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []*domain.WebhookDeadLetter{}
+	for rows.Next() {
+		dl := &domain.WebhookDeadLetter{}
+		if err := rows.Scan(&dl.ID, &dl.URL, &dl.EventID, &dl.EventType, &dl.Payload, &dl.Attempts, &dl.LastError, scanTime(&dl.FailedAt)); err != nil {
 			return nil, err
 		}
-
-		entries = append(entries, entry)
+		letters = append(letters, dl)
 	}
+	return letters, rows.Err()
+}
 
-	return entries, nil
+// StoreNodeUsageSnapshot records a node's counters from before a reset
+func (db *HistoryDB) StoreNodeUsageSnapshot(s *domain.NodeUsageSnapshot) error {
+	_, err := db.Exec(`
+		INSERT INTO node_usage_snapshots (id, node_id, reset_mode, upload, download, period_start, reset_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, s.ID, s.NodeID, s.ResetMode, s.Upload, s.Download, s.PeriodStart, s.ResetAt)
+	return err
 }
 
-// DeleteOldHistory deletes history older than the retention period
-func (db *HistoryDB) DeleteOldHistory(olderThan time.Time) error {
-	_, err := db.Exec(`DELETE FROM events WHERE timestamp < ?`, olderThan)
+// ListNodeUsageSnapshots returns a node's reset snapshots, newest first
+func (db *HistoryDB) ListNodeUsageSnapshots(nodeID string, limit int) ([]*domain.NodeUsageSnapshot, error) {
+	query := `SELECT id, node_id, reset_mode, upload, download, period_start, reset_at FROM node_usage_snapshots WHERE node_id = ? ORDER BY reset_at DESC`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := db.Query(query, nodeID)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = db.Exec(`DELETE FROM usage_history WHERE timestamp < ?`, olderThan)
-	return err
+	defer rows.Close()
+
+	snapshots := []*domain.NodeUsageSnapshot{}
+	for rows.Next() {
+		s := &domain.NodeUsageSnapshot{}
+		if err := rows.Scan(&s.ID, &s.NodeID, &s.ResetMode, &s.Upload, &s.Download, scanTime(&s.PeriodStart), scanTime(&s.ResetAt)); err != nil {
+			return nil, err
+		}
+		s.Total = s.Upload + s.Download
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, rows.Err()
 }
 
 // UsageHistoryEntry represents a usage history entry
 type UsageHistoryEntry struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	PackageID string    `json:"package_id,omitempty"`
-	NodeID    string    `json:"node_id,omitempty"`
-	ServiceID string    `json:"service_id,omitempty"`
-	Upload    int64     `json:"upload"`
-	Download  int64     `json:"download"`
-	SessionID string    `json:"session_id,omitempty"`
-	Country   string    `json:"country,omitempty"`
-	City      string    `json:"city,omitempty"`
-	ISP       string    `json:"isp,omitempty"`
-	Tags      []string  `json:"tags,omitempty"`
-	Timestamp time.Time `json:"timestamp"`
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	PackageID   string    `json:"package_id,omitempty"`
+	NodeID      string    `json:"node_id,omitempty"`
+	ServiceID   string    `json:"service_id,omitempty"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+	RawUpload   int64     `json:"raw_upload"`
+	RawDownload int64     `json:"raw_download"`
+	SessionID   string    `json:"session_id,omitempty"`
+	Country     string    `json:"country,omitempty"`
+	City        string    `json:"city,omitempty"`
+	ISP         string    `json:"isp,omitempty"`
+	ASN         uint      `json:"asn,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
 }
 
 func containsHistorySuffix(url string) bool {
@@ -0,0 +1,199 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// LatestVersion as a migration target means every known migration
+const LatestVersion = -1
+
+// Migration is one schema change. Up moves the schema to Version and Down
+// moves it back to the version before. Both run in one transaction, which
+// also records the new version.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// MigrationStep is a migration applied, or planned on a dry run, in one
+// direction
+type MigrationStep struct {
+	Version int
+	Name    string
+	Down    bool
+}
+
+// String returns the step as "up 1 baseline" or "down 1 baseline"
+func (s MigrationStep) String() string {
+	direction := "up"
+	if s.Down {
+		direction = "down"
+	}
+	return fmt.Sprintf("%s %d %s", direction, s.Version, s.Name)
+}
+
+// execAll returns a migration function running stmts in order
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// dropTables returns a migration function dropping tables
+func dropTables(tables ...string) func(tx *sql.Tx) error {
+	stmts := make([]string, len(tables))
+	for i, table := range tables {
+		stmts[i] = `DROP TABLE IF EXISTS ` + table
+	}
+	return execAll(stmts...)
+}
+
+// ensureSchemaVersion creates the table recording applied migrations
+func (db *DB) ensureSchemaVersion() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME NOT NULL
+		)
+	`)
+	return err
+}
+
+// schemaVersion returns the highest applied migration, 0 for none
+func (db *DB) schemaVersion() (int, error) {
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).Scan(&tables); err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// migrateTo applies or reverts migrations until the schema is at target,
+// LatestVersion for the last migration. migrations must be sorted by
+// version. With dryRun it only returns the steps it would take.
+func (db *DB) migrateTo(migrations []Migration, target int, dryRun bool) ([]MigrationStep, error) {
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	if target == LatestVersion {
+		target = latest
+	}
+	if target < 0 || target > latest {
+		return nil, fmt.Errorf("unknown schema version %d, latest is %d", target, latest)
+	}
+
+	current, err := db.schemaVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if current > latest {
+		return nil, fmt.Errorf("schema version %d is newer than this binary's %d", current, latest)
+	}
+
+	var steps []MigrationStep
+	if target >= current {
+		for _, m := range migrations {
+			if m.Version > current && m.Version <= target {
+				steps = append(steps, MigrationStep{Version: m.Version, Name: m.Name})
+			}
+		}
+	} else {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if m := migrations[i]; m.Version <= current && m.Version > target {
+				steps = append(steps, MigrationStep{Version: m.Version, Name: m.Name, Down: true})
+			}
+		}
+	}
+	if dryRun || len(steps) == 0 {
+		return steps, nil
+	}
+	if err := db.ensureSchemaVersion(); err != nil {
+		return nil, fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+	for i, step := range steps {
+		m := byVersion[step.Version]
+		err := db.Transaction(func(tx *sql.Tx) error {
+			if step.Down {
+				if m.Down == nil {
+					return fmt.Errorf("migration %d %s cannot be reverted", m.Version, m.Name)
+				}
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`DELETE FROM schema_version WHERE version = ?`, m.Version)
+				return err
+			}
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`, m.Version, m.Name, time.Now())
+			return err
+		})
+		if err != nil {
+			return steps[:i], fmt.Errorf("migration %s failed: %w", step, err)
+		}
+	}
+	return steps, nil
+}
+
+// CreatedAt returns when the database's first migration was applied, which
+// is when it was created or first upgraded to versioned migrations. It is
+// nil for a database that was never migrated.
+func (db *DB) CreatedAt() (*time.Time, error) {
+	if version, err := db.schemaVersion(); err != nil || version == 0 {
+		return nil, err
+	}
+	var createdAt *time.Time
+	err := db.QueryRow(`SELECT applied_at FROM schema_version ORDER BY version LIMIT 1`).Scan(scanNullTime(&createdAt))
+	return createdAt, err
+}
+
+// SchemaStatus is a database's applied and latest known schema version
+type SchemaStatus struct {
+	Current int
+	Latest  int
+}
+
+// SchemaStatus returns the database's applied and latest schema version
+func (db *DB) SchemaStatus() (SchemaStatus, error) {
+	current, err := db.schemaVersion()
+	if err != nil {
+		return SchemaStatus{}, err
+	}
+	status := SchemaStatus{Current: current}
+	if len(db.migrations) > 0 {
+		status.Latest = db.migrations[len(db.migrations)-1].Version
+	}
+	return status, nil
+}
+
+// Migrate applies every pending migration
+func (db *DB) Migrate() error {
+	_, err := db.MigrateTo(LatestVersion, false)
+	return err
+}
+
+// MigrateTo applies or reverts migrations until the schema is at target,
+// LatestVersion for the newest. With dryRun nothing is changed and the steps
+// that would be taken are returned.
+func (db *DB) MigrateTo(target int, dryRun bool) ([]MigrationStep, error) {
+	return db.migrateTo(db.migrations, target, dryRun)
+}
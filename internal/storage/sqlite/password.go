@@ -0,0 +1,120 @@
+package sqlite
+
+import (
+	"database/sql"
+	"runtime"
+	"sync"
+
+	"github.com/hiddify/hue-go/internal/domain"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordCost is the bcrypt cost of stored user passwords
+const passwordCost = bcrypt.DefaultCost
+
+// dummyPasswordHash is compared against when a username is unknown, so a
+// miss takes as long as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("hue"), passwordCost)
+
+// isPasswordHash reports whether a stored password is already a bcrypt hash
+func isPasswordHash(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+// hashPassword returns the bcrypt hash of password. A value that already is
+// a bcrypt hash is kept, so users read back and saved again keep theirs and
+// hashes exported from another system can be imported as they are.
+func hashPassword(password string) (string, error) {
+	if password == "" || isPasswordHash(password) {
+		return password, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// VerifyUserPassword returns the user whose username and password match,
+// nil when either does not
+func (db *UserDB) VerifyUserPassword(username, password string) (*domain.User, error) {
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Password == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// migrateHashPasswords replaces plaintext user passwords with their bcrypt
+// hashes, hashing on every CPU since each takes tens of milliseconds. The
+// plaintext is kept as the user's protocol secret first, since Trojan and
+// Shadowsocks clients were configured with it and nodes still need it.
+// Passwords stored before the length limit may be longer than bcrypt takes;
+// their first domain.MaxPasswordLength bytes are hashed, which is also all
+// that bcrypt compares when they are verified.
+func migrateHashPasswords(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE users ADD COLUMN protocol_secret TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT id, password FROM users`)
+	if err != nil {
+		return err
+	}
+	type userPassword struct{ id, password string }
+	var plain []userPassword
+	for rows.Next() {
+		var u userPassword
+		if err := rows.Scan(&u.id, &u.password); err != nil {
+			rows.Close()
+			return err
+		}
+		if !isPasswordHash(u.password) {
+			plain = append(plain, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	hashes := make([]string, len(plain))
+	errs := make([]error, len(plain))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				password := plain[i].password
+				if len(password) > domain.MaxPasswordLength {
+					password = password[:domain.MaxPasswordLength]
+				}
+				hashes[i], errs[i] = hashPassword(password)
+			}
+		}()
+	}
+	for i := range plain {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, u := range plain {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		if _, err := tx.Exec(`UPDATE users SET password = ?, protocol_secret = ? WHERE id = ?`, hashes[i], u.password, u.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package sqlite
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -55,6 +59,41 @@ func TestActiveDBBufferFlushAndAggregation(t *testing.T) {
 	}
 }
 
+func TestActiveDBCounterDelta(t *testing.T) {
+	db, err := NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("new active db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	steps := []struct {
+		up, down         int64
+		wantUp, wantDown int64
+	}{
+		{100, 1000, 0, 0}, // first report sets the baseline
+		{150, 1000, 50, 0},
+		{400, 1800, 250, 800},
+		{30, 70, 30, 70}, // counters reset after a backend restart
+		{45, 70, 15, 0},
+		{4_294_967_000, 70, 4_294_966_955, 0},
+		{200, 70, 496, 0}, // 32-bit counter wrapped
+	}
+	for i, step := range steps {
+		up, down, err := db.CounterDelta("u1", "s1", step.up, step.down)
+		if err != nil {
+			t.Fatalf("step %d: counter delta: %v", i, err)
+		}
+		if up != step.wantUp || down != step.wantDown {
+			t.Fatalf("step %d: expected %d/%d, got %d/%d", i, step.wantUp, step.wantDown, up, down)
+		}
+	}
+
+	up, down, err := db.CounterDelta("u1", "s2", 10, 20)
+	if err != nil || up != 0 || down != 0 {
+		t.Fatalf("expected a new service to start its own baseline, got %d/%d err=%v", up, down, err)
+	}
+}
+
 func TestHistoryDBStoreAndQuery(t *testing.T) {
 	db, err := NewHistoryDB(":memory:")
 	if err != nil {
@@ -90,7 +129,7 @@ func TestHistoryDBStoreAndQuery(t *testing.T) {
 		t.Fatalf("unexpected events query result")
 	}
 
-	if err := db.StoreUsageHistory(userID, pkgID, nodeID, serviceID, 25, 35, "sess-1", &domain.GeoData{Country: "US", City: "NY", ISP: "ISP"}, []string{"tag1"}, time.Now()); err != nil {
+	if err := db.StoreUsageHistory(userID, pkgID, nodeID, serviceID, domain.UsageTraffic{RawUpload: 20, RawDownload: 30, BilledUpload: 25, BilledDownload: 35, Multiplier: 1.25}, "sess-1", &domain.GeoData{Country: "US", City: "NY", ISP: "ISP", ASN: 64500}, []string{"tag1"}, time.Now()); err != nil {
 		t.Fatalf("store usage history: %v", err)
 	}
 
@@ -101,6 +140,181 @@ func TestHistoryDBStoreAndQuery(t *testing.T) {
 	if len(history) != 1 || history[0].Upload != 25 || history[0].Download != 35 {
 		t.Fatalf("unexpected usage history result")
 	}
+	if history[0].RawUpload != 20 || history[0].RawDownload != 30 {
+		t.Fatalf("expected raw bytes kept next to billed bytes, got %d/%d", history[0].RawUpload, history[0].RawDownload)
+	}
+	if history[0].ISP != "ISP" || history[0].ASN != 64500 {
+		t.Fatalf("expected ISP and ASN kept, got %q/%d", history[0].ISP, history[0].ASN)
+	}
+
+	// Buffered records without geo data are flushed before reads
+	if err := db.BufferUsageHistory(UsageHistoryRecord{UserID: userID, PackageID: pkgID, Traffic: domain.UsageTraffic{BilledUpload: 5}, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("buffer usage history: %v", err)
+	}
+	history, err = db.GetUsageHistory(userID, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatalf("get usage history: %v", err)
+	}
+	if len(history) != 2 || history[0].Upload != 5 || history[0].Country != "" {
+		t.Fatalf("expected the buffered record read back, got %d entries", len(history))
+	}
+}
+
+func TestHistoryDBReplayEvents(t *testing.T) {
+	db, err := NewHistoryDB(":memory:")
+	if err != nil {
+		t.Fatalf("new history db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	// Stored out of timestamp order; replay follows the order of storing
+	base := time.Now()
+	alice, bob := "alice", "bob"
+	for i, e := range []struct {
+		eventType domain.EventType
+		userID    *string
+		at        time.Time
+	}{
+		{domain.EventUserConnected, &alice, base},
+		{domain.EventUsageRecorded, &alice, base.Add(-time.Minute)},
+		{domain.EventUsageRecorded, &bob, base.Add(time.Minute)},
+		{domain.EventUserDisconnected, &alice, base.Add(2 * time.Minute)},
+	} {
+		event := &domain.Event{ID: fmt.Sprintf("e%d", i), Type: e.eventType, UserID: e.userID, Timestamp: e.at}
+		if err := db.StoreEvent(event); err != nil {
+			t.Fatalf("store event: %v", err)
+		}
+	}
+
+	replay := func(filter domain.EventReplayFilter) string {
+		t.Helper()
+		var ids []string
+		if err := db.ReplayEvents(filter, func(e *domain.Event) error {
+			ids = append(ids, e.ID)
+			return nil
+		}); err != nil {
+			t.Fatalf("replay events: %v", err)
+		}
+		return strings.Join(ids, ",")
+	}
+	if got := replay(domain.EventReplayFilter{}); got != "e0,e1,e2,e3" {
+		t.Fatalf("expected every event in the order stored, got %s", got)
+	}
+	if got := replay(domain.EventReplayFilter{Types: []domain.EventType{domain.EventUsageRecorded, domain.EventUserDisconnected}, UserID: &alice}); got != "e1,e3" {
+		t.Fatalf("expected alice's usage and disconnect events, got %s", got)
+	}
+	if got := replay(domain.EventReplayFilter{AfterID: "e1"}); got != "e2,e3" {
+		t.Fatalf("expected the events stored after e1, got %s", got)
+	}
+	if err := db.ReplayEvents(domain.EventReplayFilter{AfterID: "missing"}, func(*domain.Event) error { return nil }); !errors.Is(err, ErrEventNotFound) {
+		t.Fatalf("expected ErrEventNotFound after an unknown event, got %v", err)
+	}
+}
+
+func TestHistoryDBTopUsersAndNodes(t *testing.T) {
+	db, err := NewHistoryDB(":memory:")
+	if err != nil {
+		t.Fatalf("new history db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	now := time.Now()
+	for _, r := range []struct {
+		userID, nodeID string
+		bytes          int64
+		at             time.Time
+	}{
+		{"u1", "n1", 100, now},
+		{"u2", "n1", 300, now},
+		{"u2", "n2", 300, now},
+		{"u3", "n2", 50, now},
+		{"u1", "n2", 5000, now.Add(-48 * time.Hour)}, // Outside the range
+	} {
+		traffic := domain.UsageTraffic{RawUpload: r.bytes, BilledUpload: r.bytes, BilledDownload: r.bytes}
+		if err := db.StoreUsageHistory(r.userID, "p1", r.nodeID, "s1", traffic, "", &domain.GeoData{}, nil, r.at); err != nil {
+			t.Fatalf("store usage history: %v", err)
+		}
+	}
+
+	start, end := now.Add(-time.Hour), now.Add(time.Hour)
+	users, err := db.GetTopUsers(start, end, 2)
+	if err != nil {
+		t.Fatalf("top users: %v", err)
+	}
+	if len(users) != 2 || users[0].ID != "u2" || users[0].Total != 1200 || users[0].Reports != 2 || users[1].ID != "u1" || users[1].Total != 200 {
+		t.Fatalf("unexpected top users %+v %+v", users[0], users[1])
+	}
+	nodes, err := db.GetTopNodes(start, end, 10)
+	if err != nil {
+		t.Fatalf("top nodes: %v", err)
+	}
+	if len(nodes) != 2 || nodes[0].ID != "n1" || nodes[0].Total != 800 || nodes[1].ID != "n2" || nodes[1].Upload != 350 {
+		t.Fatalf("unexpected top nodes %+v %+v", nodes[0], nodes[1])
+	}
+
+	var id, parent, notUsed int
+	var detail string
+	if err := db.QueryRow(`EXPLAIN QUERY PLAN SELECT user_id, SUM(upload), SUM(download) FROM usage_history
+		WHERE timestamp >= ? AND timestamp < ? GROUP BY user_id`, start, end).Scan(&id, &parent, &notUsed, &detail); err != nil {
+		t.Fatalf("explain: %v", err)
+	}
+	if !strings.Contains(detail, "COVERING INDEX idx_usage_history_timestamp_user") {
+		t.Fatalf("expected the top users query to use its covering index, got %q", detail)
+	}
+}
+
+func TestHistoryDBUsageRollups(t *testing.T) {
+	db, err := NewHistoryDB(":memory:")
+	if err != nil {
+		t.Fatalf("new history db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)
+	store := func(userID, nodeID string, at time.Time) {
+		t.Helper()
+		traffic := domain.UsageTraffic{RawUpload: 10, RawDownload: 20, BilledUpload: 15, BilledDownload: 30}
+		if err := db.StoreUsageHistory(userID, "p1", nodeID, "s1", traffic, "", &domain.GeoData{}, nil, at); err != nil {
+			t.Fatalf("store usage history: %v", err)
+		}
+	}
+	store("u1", "n1", day.Add(10*time.Hour))
+	store("u1", "n1", day.Add(10*time.Hour+30*time.Minute))
+	store("u2", "n2", day.Add(11*time.Hour))
+	store("u1", "n2", day.Add(26*time.Hour))
+
+	if n, err := db.RollupUsage(); err != nil || n != 4 {
+		t.Fatalf("expected 4 rows rolled up, got %d: %v", n, err)
+	}
+	if n, err := db.RollupUsage(); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to roll up, got %d: %v", n, err)
+	}
+	// A late report adds to a bucket that was already rolled up
+	store("u1", "n1", day.Add(10*time.Hour+45*time.Minute))
+	if n, err := db.RollupUsage(); err != nil || n != 1 {
+		t.Fatalf("expected the late row rolled up, got %d: %v", n, err)
+	}
+
+	hourly, err := db.GetUsageRollups(UsageRollupFilter{Granularity: RollupHourly, From: day, To: day.Add(48 * time.Hour)})
+	if err != nil {
+		t.Fatalf("hourly rollups: %v", err)
+	}
+	if len(hourly) != 3 || hourly[0].Period != "2026-03-01 10:00" || hourly[0].Reports != 3 || hourly[0].Upload != 45 || hourly[0].RawDownload != 60 {
+		t.Fatalf("unexpected hourly rollups %+v", hourly[0])
+	}
+
+	daily, err := db.GetUsageRollups(UsageRollupFilter{Granularity: RollupDaily, UserID: "u1", From: day, To: day.Add(48 * time.Hour)})
+	if err != nil {
+		t.Fatalf("daily rollups: %v", err)
+	}
+	if len(daily) != 2 || daily[0].Period != "2026-03-01" || daily[0].Total != 135 || daily[1].Period != "2026-03-02" || daily[1].Reports != 1 {
+		t.Fatalf("unexpected daily rollups %+v %+v", daily[0], daily[1])
+	}
+
+	byNode, err := db.GetUsageRollups(UsageRollupFilter{Granularity: RollupDaily, NodeID: "n2", From: day, To: day})
+	if err != nil || len(byNode) != 1 || byNode[0].Reports != 1 {
+		t.Fatalf("expected n2's first day only, got %+v: %v", byNode, err)
+	}
 }
 
 func TestUserDBManagerHierarchyAndPropagation(t *testing.T) {
@@ -268,3 +482,581 @@ func TestUserDBOwnerAndServiceAuthKeys(t *testing.T) {
 		t.Fatalf("expected wrong service key to fail")
 	}
 }
+
+func TestUserDBAuthKeyRotationAndExpiry(t *testing.T) {
+	db, err := NewUserDB("sqlite://" + t.TempDir() + "/auth-rotation.db")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate user db: %v", err)
+	}
+
+	if err := db.UpsertOwnerAuthKey("owner-v1"); err != nil {
+		t.Fatalf("upsert owner auth key: %v", err)
+	}
+	ownerV2, err := db.RotateOwnerAuthKey(nil, time.Hour)
+	if err != nil || ownerV2 == "" {
+		t.Fatalf("rotate owner key: %q %v", ownerV2, err)
+	}
+	for _, key := range []string{"owner-v1", ownerV2} {
+		if ok, _ := db.ValidateOwnerAuthKey(key); !ok {
+			t.Fatalf("expected %q to work during the overlap", key)
+		}
+	}
+	ownerV3, _ := db.RotateOwnerAuthKey(nil, 0)
+	if ok, _ := db.ValidateOwnerAuthKey(ownerV2); ok {
+		t.Fatal("expected a rotation without overlap to replace the key at once")
+	}
+	if ok, _ := db.ValidateOwnerAuthKey("owner-v1"); ok {
+		t.Fatal("expected only the last replaced key to overlap")
+	}
+	if ok, _ := db.ValidateOwnerAuthKey(ownerV3); !ok {
+		t.Fatal("expected the new owner key to work")
+	}
+
+	if err := db.CreateNode(&domain.Node{ID: "n1", SecretKey: "node-key", Name: "n1", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if err := db.CreateService(&domain.Service{ID: "s1", SecretKey: "svc-v1", NodeID: "n1", Name: "s1", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	svcV2, err := db.RotateServiceAuthKey("s1", nil, time.Hour)
+	if err != nil || svcV2 == "" {
+		t.Fatalf("rotate service key: %q %v", svcV2, err)
+	}
+	for _, key := range []string{"svc-v1", svcV2} {
+		if svc, _ := db.AuthenticateServiceKey(key); svc == nil || svc.ID != "s1" {
+			t.Fatalf("expected %q to authenticate during the overlap", key)
+		}
+	}
+
+	// Editing the service keeps the rotated key
+	svc, _ := db.GetService("s1")
+	svc.Name = "renamed"
+	if err := db.UpdateService(svc); err != nil {
+		t.Fatalf("update service: %v", err)
+	}
+	if svc, _ := db.AuthenticateServiceKey(svcV2); svc == nil {
+		t.Fatal("expected a service edit to keep the rotated key")
+	}
+
+	keys, err := db.ListAuthKeys()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("expected the owner and one service key, got %d: %v", len(keys), err)
+	}
+	if keys[0].Kind != domain.AuthKeyKindOwner || keys[0].LastUsedAt == nil {
+		t.Fatalf("expected the owner key with its last use, got %+v", keys[0])
+	}
+	if keys[1].ServiceID != "s1" || keys[1].PreviousExpiresAt == nil || keys[1].LastUsedAt == nil {
+		t.Fatalf("expected the rotated service key, got %+v", keys[1])
+	}
+
+	expired := time.Now().Add(-time.Second)
+	svcV3, _ := db.RotateServiceAuthKey("s1", &expired, 0)
+	if svc, _ := db.AuthenticateServiceKey(svcV3); svc != nil {
+		t.Fatal("expected an expired service key to be rejected")
+	}
+
+	if ok, err := db.RevokeServiceAuthKey("s1"); err != nil || !ok {
+		t.Fatalf("revoke service key: %v %v", ok, err)
+	}
+	svcV4, _ := db.RotateServiceAuthKey("s1", nil, time.Hour)
+	if key, _ := db.GetAuthKey("s1"); key == nil || key.Revoked || key.PreviousExpiresAt != nil {
+		t.Fatalf("expected a rotation after revocation to start without overlap, got %+v", key)
+	}
+	if svc, _ := db.AuthenticateServiceKey(svcV4); svc == nil {
+		t.Fatal("expected the newly issued service key to work")
+	}
+	if key, _ := db.RotateServiceAuthKey("missing", nil, 0); key != "" {
+		t.Fatal("expected no key for a missing service")
+	}
+}
+
+func TestSQLiteTimeScanners(t *testing.T) {
+	want := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)
+	inputs := []interface{}{
+		want,
+		"2024-03-01T12:30:45Z",
+		"2024-03-01 12:30:45 +0000 UTC",
+		"2024-03-01 12:30:45 +0000 UTC m=+0.000000001",
+		[]byte("2024-03-01 12:30:45"),
+		want.Unix(),
+	}
+	for _, in := range inputs {
+		var got time.Time
+		if err := scanTime(&got).Scan(in); err != nil {
+			t.Fatalf("scan %v: %v", in, err)
+		}
+		if !got.Equal(want) {
+			t.Fatalf("scan %v: got %v, want %v", in, got, want)
+		}
+	}
+
+	var required time.Time
+	if err := scanTime(&required).Scan(nil); err == nil {
+		t.Fatalf("expected error scanning NULL into required time")
+	}
+	if err := scanTime(&required).Scan("yesterday"); err == nil {
+		t.Fatalf("expected error for unsupported format")
+	}
+
+	optional := &want
+	if err := scanNullTime(&optional).Scan(nil); err != nil || optional != nil {
+		t.Fatalf("expected nil for NULL, got %v (err=%v)", optional, err)
+	}
+	if err := scanNullTime(&optional).Scan(""); err != nil || optional != nil {
+		t.Fatalf("expected nil for empty string, got %v (err=%v)", optional, err)
+	}
+	if err := scanNullTime(&optional).Scan("2024-03-01 12:30:45"); err != nil || optional == nil || !optional.Equal(want) {
+		t.Fatalf("expected parsed time, got %v (err=%v)", optional, err)
+	}
+}
+
+func TestUserDBManagerTreeRollsUpUsers(t *testing.T) {
+	db, err := NewUserDB("sqlite://" + t.TempDir() + "/tree.db")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate user db: %v", err)
+	}
+
+	strPtr := func(s string) *string { return &s }
+	for _, m := range []*domain.Manager{
+		{ID: "root", Name: "Root", Package: &domain.ManagerPackage{TotalLimit: 1000, Status: domain.ManagerPackageStatusActive}},
+		{ID: "a", Name: "A", ParentID: strPtr("root"), Package: &domain.ManagerPackage{TotalLimit: 500, Status: domain.ManagerPackageStatusActive}},
+		{ID: "a1", Name: "A1", ParentID: strPtr("a"), Package: &domain.ManagerPackage{TotalLimit: 100, Status: domain.ManagerPackageStatusActive}},
+		{ID: "b", Name: "B", ParentID: strPtr("root"), Package: &domain.ManagerPackage{TotalLimit: 300, Status: domain.ManagerPackageStatusActive}},
+		{ID: "other", Name: "Other", Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}},
+	} {
+		if err := db.CreateManager(m); err != nil {
+			t.Fatalf("create manager %s: %v", m.ID, err)
+		}
+	}
+	for i, u := range []struct {
+		manager string
+		status  domain.UserStatus
+	}{
+		{"a1", domain.UserStatusActive},
+		{"a1", domain.UserStatusActive},
+		{"a", domain.UserStatusSuspended},
+		{"b", domain.UserStatusActive},
+		{"other", domain.UserStatusActive},
+	} {
+		user := &domain.User{ID: fmt.Sprintf("u%d", i), Username: fmt.Sprintf("u%d", i), Password: "p", ManagerID: strPtr(u.manager), Status: u.status}
+		if err := db.CreateUser(user); err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	if err := db.ApplyManagerUsageDelta("a1", 10, 20, 0, 0, 0); err != nil {
+		t.Fatalf("apply usage: %v", err)
+	}
+
+	tree, err := db.GetManagerTree("root")
+	if err != nil {
+		t.Fatalf("get tree: %v", err)
+	}
+	if tree.SubtreeUsers != 4 || tree.SubtreeActiveUsers != 3 || tree.Users != 0 {
+		t.Fatalf("unexpected root counts: %+v", tree)
+	}
+	if len(tree.Children) != 2 || tree.Children[0].ID != "a" || tree.Children[1].ID != "b" {
+		t.Fatalf("unexpected root children: %+v", tree.Children)
+	}
+	a := tree.Children[0]
+	if a.Users != 1 || a.ActiveUsers != 0 || a.SubtreeUsers != 3 || a.SubtreeActiveUsers != 2 {
+		t.Fatalf("unexpected counts for a: %+v", a)
+	}
+	if len(a.Children) != 1 || a.Children[0].Package == nil || a.Children[0].Package.TotalLimit != 100 {
+		t.Fatalf("expected a1 with its package, got %+v", a.Children)
+	}
+	if tree.Package == nil || tree.Package.CurrentTotal != 30 || a.Package.CurrentTotal != 30 {
+		t.Fatalf("expected usage propagated to every ancestor package, got root=%+v a=%+v", tree.Package, a.Package)
+	}
+
+	if missing, err := db.GetManagerTree("missing"); err != nil || missing != nil {
+		t.Fatalf("expected nil tree for unknown manager, got %+v err=%v", missing, err)
+	}
+}
+
+func TestUserDBManagerScopedNodesAndServices(t *testing.T) {
+	db, err := NewUserDB("sqlite://" + t.TempDir() + "/scope.db")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate user db: %v", err)
+	}
+
+	rootID, childID, otherID := "mgr-root", "mgr-child", "mgr-other"
+	for _, m := range []*domain.Manager{
+		{ID: rootID, Name: "Root"},
+		{ID: childID, Name: "Child", ParentID: &rootID},
+		{ID: otherID, Name: "Other"},
+	} {
+		m.Package = &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}
+		if err := db.CreateManager(m); err != nil {
+			t.Fatalf("create manager %s: %v", m.ID, err)
+		}
+	}
+
+	nodes := []*domain.Node{
+		{ID: "node-shared", SecretKey: "k1", Name: "shared", TrafficMultiplier: 1},
+		{ID: "node-root", SecretKey: "k2", Name: "root", TrafficMultiplier: 1, ManagerID: &rootID},
+		{ID: "node-other", SecretKey: "k3", Name: "other", TrafficMultiplier: 1, ManagerID: &otherID},
+	}
+	for _, n := range nodes {
+		if err := db.CreateNode(n); err != nil {
+			t.Fatalf("create node %s: %v", n.ID, err)
+		}
+		if err := db.CreateService(&domain.Service{
+			ID: "svc-" + n.ID, SecretKey: "svc-" + n.SecretKey, NodeID: n.ID, Name: n.Name, Protocol: "vless",
+			ManagerID: n.ManagerID,
+		}); err != nil {
+			t.Fatalf("create service for %s: %v", n.ID, err)
+		}
+	}
+
+	visible, err := db.ListNodesForManager(childID)
+	if err != nil {
+		t.Fatalf("list nodes for manager: %v", err)
+	}
+	ids := map[string]bool{}
+	for _, n := range visible {
+		ids[n.ID] = true
+	}
+	if len(visible) != 2 || !ids["node-shared"] || !ids["node-root"] {
+		t.Fatalf("expected shared and ancestor nodes, got %v", ids)
+	}
+
+	services, err := db.ListServicesForManager(otherID)
+	if err != nil {
+		t.Fatalf("list services for manager: %v", err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("expected shared and own services, got %d", len(services))
+	}
+
+	if err := db.SetNodeManager("node-other", nil); err != nil {
+		t.Fatalf("unassign node: %v", err)
+	}
+	node, err := db.GetNode("node-other")
+	if err != nil || node == nil {
+		t.Fatalf("get node: %v", err)
+	}
+	if node.ManagerID != nil {
+		t.Fatalf("expected node to be shared after unassigning, got %v", *node.ManagerID)
+	}
+}
+
+func TestActiveDBReportClaims(t *testing.T) {
+	db, err := NewActiveDB(":memory:")
+	if err != nil {
+		t.Fatalf("new active db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	now := time.Now()
+	claimed, err := db.ClaimReport("r1", now)
+	if err != nil || !claimed {
+		t.Fatalf("expected the first claim to succeed, got %v err=%v", claimed, err)
+	}
+	if claimed, err = db.ClaimReport("r1", now); err != nil || claimed {
+		t.Fatalf("expected a repeated claim to fail, got %v err=%v", claimed, err)
+	}
+	if result, err := db.GetReportResult("r1"); err != nil || result != nil {
+		t.Fatalf("expected no result while processing, got %+v err=%v", result, err)
+	}
+
+	if err := db.StoreReportResult("r1", &domain.UsageReportResult{UserID: "u1", Accepted: true, BilledUpload: 10}); err != nil {
+		t.Fatalf("store result: %v", err)
+	}
+	result, err := db.GetReportResult("r1")
+	if err != nil || result == nil || !result.Accepted || result.BilledUpload != 10 {
+		t.Fatalf("unexpected stored result %+v err=%v", result, err)
+	}
+
+	if err := db.ReleaseReport("r1"); err != nil {
+		t.Fatalf("release report: %v", err)
+	}
+	if claimed, err = db.ClaimReport("r1", now); err != nil || !claimed {
+		t.Fatalf("expected a released ID to be claimable, got %v err=%v", claimed, err)
+	}
+
+	removed, err := db.DeleteProcessedReports(now.Add(time.Second))
+	if err != nil || removed != 1 {
+		t.Fatalf("expected one pruned claim, got %d err=%v", removed, err)
+	}
+}
+
+func TestUserDBApplyUsage(t *testing.T) {
+	db, err := NewUserDB("sqlite://" + t.TempDir() + "/usage.db")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate user db: %v", err)
+	}
+
+	rootID := "mgr-root"
+	for _, m := range []*domain.Manager{
+		{ID: rootID, Name: "Root", Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}},
+		{ID: "mgr-child", Name: "Child", ParentID: &rootID, Package: &domain.ManagerPackage{Status: domain.ManagerPackageStatusActive}},
+	} {
+		if err := db.CreateManager(m); err != nil {
+			t.Fatalf("create manager %s: %v", m.ID, err)
+		}
+	}
+	if err := db.CreateGroup(&domain.Group{Name: "team"}); err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	if err := db.CreateNode(&domain.Node{ID: "n1", SecretKey: "node-secret", Name: "node", TrafficMultiplier: 1, ResetMode: domain.ResetModeNoReset}); err != nil {
+		t.Fatalf("create node: %v", err)
+	}
+	if err := db.CreateService(&domain.Service{ID: "s1", SecretKey: "service-secret", NodeID: "n1", Name: "vless", Protocol: "vless"}); err != nil {
+		t.Fatalf("create service: %v", err)
+	}
+	if err := db.CreatePackage(&domain.Package{ID: "p1", UserID: "u1", ResetMode: domain.ResetModeNoReset, Status: domain.PackageStatusActive}); err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	if err := db.CreateUser(&domain.User{ID: "u1", Username: "u1", Status: domain.UserStatusActive}); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := db.ApplyUsage(UsageDelta{
+		UserID:           "u1",
+		PackageID:        "p1",
+		ManagerID:        "mgr-child",
+		Groups:           []string{"team"},
+		NodeID:           "n1",
+		ServiceID:        "s1",
+		Upload:           20,
+		Download:         40,
+		RawUpload:        10,
+		RawDownload:      20,
+		LastConnectionAt: at,
+	}); err != nil {
+		t.Fatalf("apply usage: %v", err)
+	}
+
+	if pkg, err := db.GetPackage("p1"); err != nil || pkg.CurrentTotal != 60 {
+		t.Fatalf("unexpected package %+v err=%v", pkg, err)
+	}
+	for _, id := range []string{rootID, "mgr-child"} {
+		if mp, err := db.GetManagerPackage(id); err != nil || mp.CurrentTotal != 60 {
+			t.Fatalf("unexpected manager package %s: %+v err=%v", id, mp, err)
+		}
+	}
+	if g, err := db.GetGroup("team"); err != nil || g.CurrentTotal != 60 {
+		t.Fatalf("unexpected group %+v err=%v", g, err)
+	}
+	if n, err := db.GetNode("n1"); err != nil || n.CurrentUpload != 10 || n.CurrentDownload != 20 {
+		t.Fatalf("unexpected node %+v err=%v", n, err)
+	}
+	if s, err := db.GetService("s1"); err != nil || s.CurrentUpload != 10 || s.CurrentDownload != 20 {
+		t.Fatalf("unexpected service %+v err=%v", s, err)
+	}
+	if u, err := db.GetUser("u1"); err != nil || u.LastConnectionAt == nil || !u.LastConnectionAt.Equal(at) {
+		t.Fatalf("unexpected last connection %+v err=%v", u, err)
+	}
+}
+
+func TestTransactionWithRetryRetriesBusyDatabase(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	attempts := 0
+	err = db.TransactionWithRetry(func(tx *sql.Tx) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("database is locked (5) (SQLITE_BUSY)")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("expected success on the third attempt, got %d attempts err=%v", attempts, err)
+	}
+
+	attempts = 0
+	failure := errors.New("constraint failed")
+	if err := db.TransactionWithRetry(func(tx *sql.Tx) error {
+		attempts++
+		return failure
+	}); !errors.Is(err, failure) || attempts != 1 {
+		t.Fatalf("expected other errors to fail at once, got %d attempts err=%v", attempts, err)
+	}
+}
+
+func TestTuneAppliesPragmasAndOpensReadPool(t *testing.T) {
+	db, err := NewUserDB("sqlite://" + t.TempDir() + "/tuned.db")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	if err := db.Tune(Tuning{Synchronous: "sometimes"}); err == nil {
+		t.Fatal("expected an invalid synchronous setting to be rejected")
+	}
+	if err := db.Tune(Tuning{BusyTimeout: 2 * time.Second, Synchronous: "normal", CacheSize: -4000, ReadConns: 2}); err != nil {
+		t.Fatalf("tune: %v", err)
+	}
+
+	var busyTimeout, synchronous int
+	if err := db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout); err != nil || busyTimeout != 2000 {
+		t.Fatalf("expected busy_timeout 2000 on the writer, got %d err=%v", busyTimeout, err)
+	}
+	if err := db.reader().QueryRow("PRAGMA synchronous").Scan(&synchronous); err != nil || synchronous != 1 {
+		t.Fatalf("expected synchronous NORMAL on the read pool, got %d err=%v", synchronous, err)
+	}
+	if _, err := db.reader().Exec(`DELETE FROM users`); err == nil {
+		t.Fatal("expected the read pool to refuse writes")
+	}
+
+	user := &domain.User{ID: "u1", Username: "alice", Password: "pw", Status: domain.UserStatusActive}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	users, err := db.ListUsers(nil)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("expected the read pool to see the committed user, got %d err=%v", len(users), err)
+	}
+}
+
+func TestMigrateToAppliesAndRevertsInOrder(t *testing.T) {
+	db, err := NewDB(":memory:")
+	if err != nil {
+		t.Fatalf("new db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	db.migrations = []Migration{
+		{Version: 1, Name: "things", Up: execAll(`CREATE TABLE things (id TEXT PRIMARY KEY)`), Down: dropTables("things")},
+		{Version: 2, Name: "thing_name", Up: execAll(`ALTER TABLE things ADD COLUMN name TEXT`), Down: execAll(`ALTER TABLE things DROP COLUMN name`)},
+	}
+
+	steps, err := db.MigrateTo(LatestVersion, true)
+	if err != nil || len(steps) != 2 || steps[0].String() != "up 1 things" {
+		t.Fatalf("unexpected dry run %v err=%v", steps, err)
+	}
+	if status, _ := db.SchemaStatus(); status.Current != 0 || status.Latest != 2 {
+		t.Fatalf("expected a dry run to change nothing, got %+v", status)
+	}
+
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO things (id, name) VALUES ('t1', 'one')`); err != nil {
+		t.Fatalf("expected both migrations applied: %v", err)
+	}
+	if steps, err := db.MigrateTo(LatestVersion, false); err != nil || len(steps) != 0 {
+		t.Fatalf("expected nothing left to apply, got %v err=%v", steps, err)
+	}
+
+	steps, err = db.MigrateTo(1, false)
+	if err != nil || len(steps) != 1 || steps[0].String() != "down 2 thing_name" {
+		t.Fatalf("unexpected revert %v err=%v", steps, err)
+	}
+	if status, _ := db.SchemaStatus(); status.Current != 1 {
+		t.Fatalf("expected version 1 after the revert, got %+v", status)
+	}
+	if _, err := db.Exec(`INSERT INTO things (id, name) VALUES ('t2', 'two')`); err == nil {
+		t.Fatal("expected the name column to be dropped")
+	}
+
+	if _, err := db.MigrateTo(3, false); err == nil {
+		t.Fatal("expected an unknown target version to be rejected")
+	}
+}
+
+func TestUserDBBaselineMigratesLegacyDatabase(t *testing.T) {
+	db, err := NewUserDB(":memory:")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	// A database created before manager_id existed and before versioning
+	if _, err := db.Exec(`CREATE TABLE users (id TEXT PRIMARY KEY, username TEXT UNIQUE NOT NULL, password TEXT NOT NULL, public_key TEXT, status TEXT NOT NULL DEFAULT 'active', created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE users SET manager_id = NULL, attributes = '{}'`); err != nil {
+		t.Fatalf("expected the baseline to add missing columns: %v", err)
+	}
+	if status, err := db.SchemaStatus(); err != nil || status.Current != status.Latest {
+		t.Fatalf("expected the latest schema, got %+v err=%v", status, err)
+	}
+}
+
+func TestUserDBHashesPasswords(t *testing.T) {
+	db, err := NewUserDB(":memory:")
+	if err != nil {
+		t.Fatalf("new user db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if _, err := db.MigrateTo(2, false); err != nil {
+		t.Fatalf("migrate to 2: %v", err)
+	}
+
+	// A user stored in plaintext before passwords were hashed
+	if _, err := db.Exec(`INSERT INTO users (id, username, password, public_key, private_key, status) VALUES ('u-old', 'old', 'old-pass', '', '', 'active')`); err != nil {
+		t.Fatalf("insert plaintext user: %v", err)
+	}
+	if err := db.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if user, err := db.VerifyUserPassword("old", "old-pass"); err != nil || user == nil || user.ID != "u-old" {
+		t.Fatalf("expected the migrated password to verify, got %+v err=%v", user, err)
+	}
+	if user, _ := db.GetUser("u-old"); user == nil || user.ProtocolSecret != "old-pass" {
+		t.Fatalf("expected the plaintext kept as protocol secret, got %+v", user)
+	}
+
+	user := &domain.User{ID: "u-new", Username: "new", Password: "new-pass", ProtocolSecret: "trojan-pass", Status: domain.UserStatusActive}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	stored, err := db.GetUser("u-new")
+	if err != nil || stored == nil || stored.Password == "new-pass" || !isPasswordHash(stored.Password) {
+		t.Fatalf("expected the password stored hashed, got %+v err=%v", stored, err)
+	}
+	if stored.ProtocolSecret != "trojan-pass" {
+		t.Fatalf("expected the protocol secret stored as given, got %q", stored.ProtocolSecret)
+	}
+
+	// Saving the user again keeps the hash; setting a password hashes it
+	stored.Groups = []string{"gold"}
+	if err := db.UpdateUser(stored); err != nil {
+		t.Fatalf("update user: %v", err)
+	}
+	if user, _ := db.VerifyUserPassword("new", "new-pass"); user == nil {
+		t.Fatal("expected an unrelated update to keep the password")
+	}
+	stored.Password = "changed"
+	if err := db.UpdateUser(stored); err != nil {
+		t.Fatalf("change password: %v", err)
+	}
+	if user, _ := db.VerifyUserPassword("new", "new-pass"); user != nil {
+		t.Fatal("expected the old password to stop verifying")
+	}
+	if user, _ := db.VerifyUserPassword("new", "changed"); user == nil {
+		t.Fatal("expected the new password to verify")
+	}
+	if user, err := db.VerifyUserPassword("nobody", "changed"); err != nil || user != nil {
+		t.Fatalf("expected an unknown user not to verify, got %+v err=%v", user, err)
+	}
+}
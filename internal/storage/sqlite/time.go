@@ -0,0 +1,116 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqliteTimeLayouts lists every datetime representation we have seen come
+// back from the driver. time.Time values bound as parameters are stored using
+// their String() form, so the Go-style layouts must stay in this list.
+var sqliteTimeLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999 -0700 -0700",
+	"2006-01-02 15:04:05 -0700 MST",
+	"2006-01-02 15:04:05 -0700 -0700",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+}
+
+func parseSQLiteTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if idx := strings.Index(value, " m="); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+
+	for _, layout := range sqliteTimeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported sqlite datetime format: %q", value)
+}
+
+// convertSQLiteTime converts a raw driver value into a time. The boolean
+// result is false when the column was NULL or empty.
+func convertSQLiteTime(src interface{}) (time.Time, bool, error) {
+	switch v := src.(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case time.Time:
+		return v, true, nil
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return time.Time{}, false, nil
+		}
+		parsed, err := parseSQLiteTime(v)
+		return parsed, err == nil, err
+	case []byte:
+		if strings.TrimSpace(string(v)) == "" {
+			return time.Time{}, false, nil
+		}
+		parsed, err := parseSQLiteTime(string(v))
+		return parsed, err == nil, err
+	case int64:
+		return time.Unix(v, 0), true, nil
+	default:
+		return time.Time{}, false, fmt.Errorf("unsupported sqlite datetime type %T", src)
+	}
+}
+
+// timeScanner scans a NOT NULL datetime column into a time.Time.
+type timeScanner struct {
+	dst *time.Time
+}
+
+// Scan implements sql.Scanner
+func (s timeScanner) Scan(src interface{}) error {
+	parsed, ok, err := convertSQLiteTime(src)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("unexpected NULL datetime")
+	}
+	*s.dst = parsed
+	return nil
+}
+
+// nullTimeScanner scans a nullable datetime column into a *time.Time,
+// leaving it nil for NULL or empty values.
+type nullTimeScanner struct {
+	dst **time.Time
+}
+
+// Scan implements sql.Scanner
+func (s nullTimeScanner) Scan(src interface{}) error {
+	parsed, ok, err := convertSQLiteTime(src)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		*s.dst = nil
+		return nil
+	}
+	*s.dst = &parsed
+	return nil
+}
+
+// scanTime returns a scan destination for a NOT NULL datetime column.
+func scanTime(dst *time.Time) sql.Scanner {
+	return timeScanner{dst: dst}
+}
+
+// scanNullTime returns a scan destination for a nullable datetime column.
+func scanNullTime(dst **time.Time) sql.Scanner {
+	return nullTimeScanner{dst: dst}
+}
@@ -0,0 +1,184 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RollupGranularity is the bucket size of a usage rollup
+type RollupGranularity string
+
+const (
+	RollupHourly RollupGranularity = "hour"
+	RollupDaily  RollupGranularity = "day"
+)
+
+// usageRollup describes the table of one granularity. Buckets are cut from
+// the stored timestamps, so they follow the time zone reports were stored
+// with.
+type usageRollup struct {
+	table  string
+	bucket string // SQL deriving the bucket from usage_history.timestamp
+	layout string // Go layout of the bucket, for range bounds
+}
+
+var usageRollups = map[RollupGranularity]usageRollup{
+	RollupHourly: {table: "usage_hourly", bucket: `substr(timestamp, 1, 13) || ':00'`, layout: "2006-01-02 15:00"},
+	RollupDaily:  {table: "usage_daily", bucket: `substr(timestamp, 1, 10)`, layout: "2006-01-02"},
+}
+
+// ParseRollupGranularity parses hour or day
+func ParseRollupGranularity(s string) (RollupGranularity, error) {
+	g := RollupGranularity(strings.ToLower(s))
+	if _, ok := usageRollups[g]; !ok {
+		return "", fmt.Errorf("invalid granularity %q, expected hour or day", s)
+	}
+	return g, nil
+}
+
+// migrateUsageRollups creates the hourly and daily rollup tables and the
+// watermark of the usage history rows already rolled up
+func migrateUsageRollups(tx *sql.Tx) error {
+	stmts := []string{
+		`CREATE TABLE usage_rollup_state (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			last_rowid INTEGER NOT NULL
+		)`,
+		`INSERT INTO usage_rollup_state (id, last_rowid) VALUES (1, 0)`,
+	}
+	for _, r := range []usageRollup{usageRollups[RollupHourly], usageRollups[RollupDaily]} {
+		stmts = append(stmts,
+			`CREATE TABLE `+r.table+` (
+				bucket TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				node_id TEXT NOT NULL,
+				upload INTEGER NOT NULL,
+				download INTEGER NOT NULL,
+				raw_upload INTEGER NOT NULL,
+				raw_download INTEGER NOT NULL,
+				reports INTEGER NOT NULL,
+				PRIMARY KEY (bucket, user_id, node_id)
+			)`,
+			`CREATE INDEX idx_`+r.table+`_user ON `+r.table+`(user_id, bucket)`,
+			`CREATE INDEX idx_`+r.table+`_node ON `+r.table+`(node_id, bucket)`,
+		)
+	}
+	return execAll(stmts...)(tx)
+}
+
+// RollupUsage flushes the buffered usage history and adds the rows stored
+// since the last run to the hourly and daily rollups, returning how many it
+// rolled up. Rows are tracked by rowid, so late reports land in their own
+// bucket however old it is.
+func (db *HistoryDB) RollupUsage() (int64, error) {
+	if err := db.Flush(); err != nil {
+		return 0, err
+	}
+
+	var rolled int64
+	err := db.Transaction(func(tx *sql.Tx) error {
+		var last, latest int64
+		if err := tx.QueryRow(`SELECT last_rowid FROM usage_rollup_state WHERE id = 1`).Scan(&last); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(rowid), 0) FROM usage_history`).Scan(&latest); err != nil {
+			return err
+		}
+		if latest < last {
+			// The history was emptied and rowids start over
+			last = 0
+		}
+		if latest == last {
+			return nil
+		}
+
+		for _, r := range usageRollups {
+			_, err := tx.Exec(`
+				INSERT INTO `+r.table+` (bucket, user_id, node_id, upload, download, raw_upload, raw_download, reports)
+				SELECT `+r.bucket+`, user_id, node_id, SUM(upload), SUM(download), SUM(raw_upload), SUM(raw_download), COUNT(*)
+				FROM usage_history
+				WHERE rowid > ? AND rowid <= ?
+				GROUP BY 1, user_id, node_id
+				ON CONFLICT(bucket, user_id, node_id) DO UPDATE SET
+					upload = upload + excluded.upload,
+					download = download + excluded.download,
+					raw_upload = raw_upload + excluded.raw_upload,
+					raw_download = raw_download + excluded.raw_download,
+					reports = reports + excluded.reports
+			`, last, latest)
+			if err != nil {
+				return fmt.Errorf("failed to roll up %s: %w", r.table, err)
+			}
+		}
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM usage_history WHERE rowid > ? AND rowid <= ?`, last, latest).Scan(&rolled); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE usage_rollup_state SET last_rowid = ? WHERE id = 1`, latest)
+		return err
+	})
+	return rolled, err
+}
+
+// UsageRollup is the traffic of one bucket. Upload and download hold the
+// billed bytes like the usage history they come from.
+type UsageRollup struct {
+	Period      string `json:"period"` // "2006-01-02 15:00" or "2006-01-02"
+	Upload      int64  `json:"upload"`
+	Download    int64  `json:"download"`
+	Total       int64  `json:"total"`
+	RawUpload   int64  `json:"raw_upload"`
+	RawDownload int64  `json:"raw_download"`
+	Reports     int64  `json:"reports"`
+}
+
+// UsageRollupFilter selects rollup buckets; empty IDs match all
+type UsageRollupFilter struct {
+	Granularity RollupGranularity
+	UserID      string
+	NodeID      string
+	From        time.Time // Buckets containing From and later
+	To          time.Time // Buckets containing To and earlier
+}
+
+// GetUsageRollups returns the traffic of each bucket in range, summed over
+// the matching users and nodes, oldest first
+func (db *HistoryDB) GetUsageRollups(filter UsageRollupFilter) ([]*UsageRollup, error) {
+	r, ok := usageRollups[filter.Granularity]
+	if !ok {
+		return nil, fmt.Errorf("invalid granularity %q, expected hour or day", filter.Granularity)
+	}
+
+	conditions := []string{"bucket >= ?", "bucket <= ?"}
+	args := []interface{}{filter.From.Format(r.layout), filter.To.Format(r.layout)}
+	for _, eq := range []struct{ column, value string }{{"user_id", filter.UserID}, {"node_id", filter.NodeID}} {
+		if eq.value != "" {
+			conditions = append(conditions, eq.column+" = ?")
+			args = append(args, eq.value)
+		}
+	}
+
+	rows, err := db.reader().Query(`
+		SELECT bucket, SUM(upload), SUM(download), SUM(raw_upload), SUM(raw_download), SUM(reports)
+		FROM `+r.table+`
+		WHERE `+strings.Join(conditions, " AND ")+`
+		GROUP BY bucket
+		ORDER BY bucket
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollups := []*UsageRollup{}
+	for rows.Next() {
+		u := &UsageRollup{}
+		if err := rows.Scan(&u.Period, &u.Upload, &u.Download, &u.RawUpload, &u.RawDownload, &u.Reports); err != nil {
+			return nil, err
+		}
+		u.Total = u.Upload + u.Download
+		rollups = append(rollups, u)
+	}
+	return rollups, rows.Err()
+}
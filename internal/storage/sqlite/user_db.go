@@ -1,48 +1,19 @@
 package sqlite
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"database/sql"
-	"encoding/json"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/hiddify/hue-go/internal/domain"
 )
 
-func parseSQLiteTime(value string) (time.Time, error) {
-	value = strings.TrimSpace(value)
-	if idx := strings.Index(value, " m="); idx >= 0 {
-		value = strings.TrimSpace(value[:idx])
-	}
-
-	layouts := []string{
-		time.RFC3339Nano,
-		time.RFC3339,
-		"2006-01-02 15:04:05.999999999 -0700 MST",
-		"2006-01-02 15:04:05.999999999 -0700 -0700",
-		"2006-01-02 15:04:05 -0700 MST",
-		"2006-01-02 15:04:05 -0700 -0700",
-		"2006-01-02 15:04:05.999999999-07:00",
-		"2006-01-02 15:04:05-07:00",
-		"2006-01-02 15:04:05.999999999",
-		"2006-01-02 15:04:05",
-		"2006-01-02T15:04:05.999999999",
-		"2006-01-02T15:04:05",
-	}
-
-	for _, layout := range layouts {
-		if parsed, err := time.Parse(layout, value); err == nil {
-			return parsed, nil
-		}
-	}
-
-	return time.Time{}, fmt.Errorf("unsupported sqlite datetime format: %q", value)
-}
-
 // UserDB handles user-related database operations
 type UserDB struct {
 	*DB
@@ -54,12 +25,69 @@ func NewUserDB(dbURL string) (*UserDB, error) {
 	if err != nil {
 		return nil, err
 	}
+	db.migrations = userMigrations
 	return &UserDB{DB: db}, nil
 }
 
-// Migrate runs database migrations for user tables
-func (db *UserDB) Migrate() error {
-	migrations := []string{
+// userMigrations are the user database's schema changes, oldest first
+var userMigrations = []Migration{
+	{Version: 1, Name: "baseline", Up: migrateUserBaseline, Down: dropTables(
+		"manager_digests",
+		"user_deletions",
+		"user_devices",
+		"groups",
+		"panel_callbacks",
+		"quota_reservations",
+		"billing_records",
+		"manager_topups",
+		"api_keys",
+		"service_auth_keys",
+		"owner_auth_key",
+		"manager_packages",
+		"managers",
+		"services",
+		"nodes",
+		"packages",
+		"users",
+	)},
+	{Version: 2, Name: "auth_key_lifecycle", Up: execAll(
+		`ALTER TABLE owner_auth_key ADD COLUMN expires_at DATETIME`,
+		`ALTER TABLE owner_auth_key ADD COLUMN last_used_at DATETIME`,
+		`ALTER TABLE owner_auth_key ADD COLUMN previous_hashed_key TEXT`,
+		`ALTER TABLE owner_auth_key ADD COLUMN previous_expires_at DATETIME`,
+		`ALTER TABLE service_auth_keys ADD COLUMN expires_at DATETIME`,
+		`ALTER TABLE service_auth_keys ADD COLUMN last_used_at DATETIME`,
+		`ALTER TABLE service_auth_keys ADD COLUMN previous_hashed_key TEXT`,
+		`ALTER TABLE service_auth_keys ADD COLUMN previous_expires_at DATETIME`,
+		`CREATE INDEX idx_service_auth_keys_hashed_key ON service_auth_keys(hashed_key)`,
+		`CREATE INDEX idx_service_auth_keys_previous_hashed_key ON service_auth_keys(previous_hashed_key)`,
+	), Down: execAll(
+		`DROP INDEX idx_service_auth_keys_previous_hashed_key`,
+		`DROP INDEX idx_service_auth_keys_hashed_key`,
+		`ALTER TABLE service_auth_keys DROP COLUMN previous_expires_at`,
+		`ALTER TABLE service_auth_keys DROP COLUMN previous_hashed_key`,
+		`ALTER TABLE service_auth_keys DROP COLUMN last_used_at`,
+		`ALTER TABLE service_auth_keys DROP COLUMN expires_at`,
+		`ALTER TABLE owner_auth_key DROP COLUMN previous_expires_at`,
+		`ALTER TABLE owner_auth_key DROP COLUMN previous_hashed_key`,
+		`ALTER TABLE owner_auth_key DROP COLUMN last_used_at`,
+		`ALTER TABLE owner_auth_key DROP COLUMN expires_at`,
+	)},
+	// Hashes cannot be turned back into passwords, so going down keeps them
+	{Version: 3, Name: "hash_user_passwords", Up: migrateHashPasswords, Down: execAll(
+		`ALTER TABLE users DROP COLUMN protocol_secret`,
+	)},
+	{Version: 4, Name: "users_public_key_index", Up: execAll(
+		`CREATE INDEX idx_users_public_key ON users(public_key)`,
+	), Down: execAll(
+		`DROP INDEX idx_users_public_key`,
+	)},
+}
+
+// migrateUserBaseline creates the schema as it was before versioned
+// migrations. Databases created before then are brought up to it as well.
+func migrateUserBaseline(tx *sql.Tx) error {
+	stmts := []string{
 		`CREATE TABLE IF NOT EXISTS users (
 			id TEXT PRIMARY KEY,
 			manager_id TEXT,
@@ -70,6 +98,11 @@ func (db *UserDB) Migrate() error {
 			ca_cert_list TEXT DEFAULT '[]',
 			groups TEXT DEFAULT '[]',
 			allowed_devices TEXT DEFAULT '[]',
+			allowed_nodes TEXT DEFAULT '[]',
+			allowed_services TEXT DEFAULT '[]',
+			allowed_countries TEXT DEFAULT '[]',
+			denied_countries TEXT DEFAULT '[]',
+			attributes TEXT DEFAULT '{}',
 			status TEXT NOT NULL DEFAULT 'active',
 			active_package_id TEXT,
 			first_connection_at DATETIME,
@@ -83,14 +116,30 @@ func (db *UserDB) Migrate() error {
 			total_traffic INTEGER NOT NULL DEFAULT 0,
 			upload_limit INTEGER NOT NULL DEFAULT 0,
 			download_limit INTEGER NOT NULL DEFAULT 0,
+			count_mode TEXT NOT NULL DEFAULT '',
 			reset_mode TEXT NOT NULL DEFAULT 'no-reset',
 			duration INTEGER NOT NULL,
 			start_at DATETIME,
 			max_concurrent INTEGER NOT NULL DEFAULT 1,
+			max_ips INTEGER NOT NULL DEFAULT 0,
+			max_devices INTEGER NOT NULL DEFAULT 0,
+			throttle_threshold INTEGER NOT NULL DEFAULT 0,
+			throttle_rate INTEGER NOT NULL DEFAULT 0,
+			penalty_duration INTEGER NOT NULL DEFAULT 0,
+			penalty_action TEXT NOT NULL DEFAULT '',
+			priority TEXT NOT NULL DEFAULT 'silver',
+			session_identity TEXT NOT NULL DEFAULT '',
+			session_replace TEXT NOT NULL DEFAULT '',
+			allowed_nodes TEXT DEFAULT '[]',
+			allowed_services TEXT DEFAULT '[]',
+			allowed_countries TEXT DEFAULT '[]',
+			denied_countries TEXT DEFAULT '[]',
 			status TEXT NOT NULL DEFAULT 'active',
 			current_upload INTEGER NOT NULL DEFAULT 0,
 			current_download INTEGER NOT NULL DEFAULT 0,
 			current_total INTEGER NOT NULL DEFAULT 0,
+			reserved INTEGER NOT NULL DEFAULT 0,
+			queue_position INTEGER NOT NULL DEFAULT 0,
 			expires_at DATETIME,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
@@ -109,6 +158,17 @@ func (db *UserDB) Migrate() error {
 			country TEXT,
 			city TEXT,
 			isp TEXT,
+			draining INTEGER NOT NULL DEFAULT 0,
+			manager_id TEXT,
+			max_active_users INTEGER NOT NULL DEFAULT 0,
+			scope_changed_at DATETIME,
+			last_reset_at DATETIME,
+			last_seen_at DATETIME,
+			agent_version TEXT NOT NULL DEFAULT '',
+			cpu_percent REAL NOT NULL DEFAULT 0,
+			active_connections INTEGER NOT NULL DEFAULT 0,
+			bandwidth_bps INTEGER NOT NULL DEFAULT 0,
+			down_at DATETIME,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		)`,
@@ -120,6 +180,7 @@ func (db *UserDB) Migrate() error {
 			protocol TEXT NOT NULL,
 			allowed_auth_methods TEXT NOT NULL DEFAULT '["password"]',
 			callback_url TEXT,
+			manager_id TEXT,
 			current_upload INTEGER NOT NULL DEFAULT 0,
 			current_download INTEGER NOT NULL DEFAULT 0,
 			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
@@ -172,70 +233,247 @@ func (db *UserDB) Migrate() error {
 			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (service_id) REFERENCES services(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			scope TEXT NOT NULL,
+			manager_id TEXT,
+			hashed_key TEXT NOT NULL UNIQUE,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS manager_topups (
+			id TEXT PRIMARY KEY,
+			manager_id TEXT NOT NULL,
+			parent_id TEXT NOT NULL,
+			total_limit INTEGER NOT NULL DEFAULT 0,
+			upload_limit INTEGER NOT NULL DEFAULT 0,
+			download_limit INTEGER NOT NULL DEFAULT 0,
+			max_sessions INTEGER NOT NULL DEFAULT 0,
+			max_online_users INTEGER NOT NULL DEFAULT 0,
+			max_active_users INTEGER NOT NULL DEFAULT 0,
+			note TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'pending',
+			requested_by TEXT NOT NULL DEFAULT '',
+			decided_by TEXT NOT NULL DEFAULT '',
+			decision_note TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			decided_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS billing_records (
+			id TEXT PRIMARY KEY,
+			period TEXT NOT NULL,
+			manager_id TEXT,
+			user_id TEXT NOT NULL,
+			username TEXT NOT NULL DEFAULT '',
+			node_group TEXT NOT NULL,
+			upload INTEGER NOT NULL DEFAULT 0,
+			download INTEGER NOT NULL DEFAULT 0,
+			total INTEGER NOT NULL DEFAULT 0,
+			rate REAL NOT NULL DEFAULT 0,
+			amount REAL NOT NULL DEFAULT 0,
+			currency TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS quota_reservations (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			package_id TEXT NOT NULL,
+			session_id TEXT NOT NULL DEFAULT '',
+			node_id TEXT NOT NULL DEFAULT '',
+			amount INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'active',
+			expires_at DATETIME NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			settled_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS panel_callbacks (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			id TEXT NOT NULL UNIQUE,
+			event_id TEXT NOT NULL DEFAULT '',
+			event_type TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			package_id TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			occurred_at DATETIME NOT NULL,
+			expires_at DATETIME,
+			delivery TEXT NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			delivered_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS groups (
+			name TEXT PRIMARY KEY,
+			total_limit INTEGER NOT NULL DEFAULT 0,
+			upload_limit INTEGER NOT NULL DEFAULT 0,
+			download_limit INTEGER NOT NULL DEFAULT 0,
+			max_concurrent INTEGER NOT NULL DEFAULT 0,
+			penalty_duration INTEGER NOT NULL DEFAULT 0,
+			penalty_action TEXT NOT NULL DEFAULT '',
+			allowed_nodes TEXT DEFAULT '[]',
+			allowed_countries TEXT DEFAULT '[]',
+			denied_countries TEXT DEFAULT '[]',
+			current_upload INTEGER NOT NULL DEFAULT 0,
+			current_download INTEGER NOT NULL DEFAULT 0,
+			current_total INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_devices (
+			user_id TEXT NOT NULL,
+			device_id TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'approved',
+			first_seen_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			approved_at DATETIME,
+			PRIMARY KEY (user_id, device_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_deletions (
+			user_id TEXT PRIMARY KEY,
+			deleted_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS manager_digests (
+			manager_id TEXT PRIMARY KEY,
+			frequency TEXT NOT NULL DEFAULT 'off',
+			webhook_url TEXT NOT NULL DEFAULT '',
+			language TEXT NOT NULL DEFAULT '',
+			last_sent_at DATETIME,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (manager_id) REFERENCES managers(id) ON DELETE CASCADE
+		)`,
+	}
+
+	if err := execAll(stmts...)(tx); err != nil {
+		return err
+	}
+
+	// Columns added before versioned migrations. Fresh databases already
+	// have them from CREATE TABLE, so "duplicate column name" is expected.
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"users", "manager_id", "TEXT"},
+		{"packages", "priority", "TEXT NOT NULL DEFAULT 'silver'"},
+		{"packages", "session_identity", "TEXT NOT NULL DEFAULT ''"},
+		{"nodes", "draining", "INTEGER NOT NULL DEFAULT 0"},
+		{"nodes", "manager_id", "TEXT"},
+		{"services", "manager_id", "TEXT"},
+		{"users", "allowed_nodes", "TEXT DEFAULT '[]'"},
+		{"users", "allowed_services", "TEXT DEFAULT '[]'"},
+		{"packages", "allowed_nodes", "TEXT DEFAULT '[]'"},
+		{"packages", "allowed_services", "TEXT DEFAULT '[]'"},
+		{"packages", "session_replace", "TEXT NOT NULL DEFAULT ''"},
+		{"packages", "max_ips", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "attributes", "TEXT DEFAULT '{}'"},
+		{"api_keys", "manager_id", "TEXT"},
+		{"packages", "reserved", "INTEGER NOT NULL DEFAULT 0"},
+		{"nodes", "scope_changed_at", "DATETIME"},
+		{"nodes", "max_active_users", "INTEGER NOT NULL DEFAULT 0"},
+		{"nodes", "last_reset_at", "DATETIME"},
+		{"packages", "queue_position", "INTEGER NOT NULL DEFAULT 0"},
+		{"packages", "count_mode", "TEXT NOT NULL DEFAULT ''"},
+		{"packages", "max_devices", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "allowed_countries", "TEXT DEFAULT '[]'"},
+		{"users", "denied_countries", "TEXT DEFAULT '[]'"},
+		{"packages", "allowed_countries", "TEXT DEFAULT '[]'"},
+		{"packages", "denied_countries", "TEXT DEFAULT '[]'"},
+		{"groups", "allowed_countries", "TEXT DEFAULT '[]'"},
+		{"groups", "denied_countries", "TEXT DEFAULT '[]'"},
+		{"packages", "throttle_threshold", "INTEGER NOT NULL DEFAULT 0"},
+		{"packages", "throttle_rate", "INTEGER NOT NULL DEFAULT 0"},
+		{"packages", "penalty_duration", "INTEGER NOT NULL DEFAULT 0"},
+		{"packages", "penalty_action", "TEXT NOT NULL DEFAULT ''"},
+		{"groups", "penalty_duration", "INTEGER NOT NULL DEFAULT 0"},
+		{"groups", "penalty_action", "TEXT NOT NULL DEFAULT ''"},
+		{"nodes", "last_seen_at", "DATETIME"},
+		{"nodes", "agent_version", "TEXT NOT NULL DEFAULT ''"},
+		{"nodes", "cpu_percent", "REAL NOT NULL DEFAULT 0"},
+		{"nodes", "active_connections", "INTEGER NOT NULL DEFAULT 0"},
+		{"nodes", "bandwidth_bps", "INTEGER NOT NULL DEFAULT 0"},
+		{"nodes", "down_at", "DATETIME"},
+	}
+	for _, c := range columns {
+		if err := ensureColumn(tx, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	// Indexes come last, since they may cover the columns added above
+	return execAll(
+		`CREATE INDEX IF NOT EXISTS idx_manager_topups_manager_id ON manager_topups(manager_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_manager_topups_parent_id ON manager_topups(parent_id, status)`,
+		`CREATE INDEX IF NOT EXISTS idx_billing_records_period ON billing_records(period, manager_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_quota_reservations_user ON quota_reservations(user_id, status)`,
+		`CREATE INDEX IF NOT EXISTS idx_quota_reservations_expiry ON quota_reservations(status, expires_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_panel_callbacks_delivery ON panel_callbacks(delivery, seq)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_updated ON users(updated_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_packages_updated ON packages(updated_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_users_status ON users(status)`,
 		`CREATE INDEX IF NOT EXISTS idx_users_username ON users(username)`,
 		`CREATE INDEX IF NOT EXISTS idx_users_manager_id ON users(manager_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_packages_user_id ON packages(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_packages_status ON packages(status)`,
+		`CREATE INDEX IF NOT EXISTS idx_packages_queue ON packages(user_id, status, queue_position)`,
 		`CREATE INDEX IF NOT EXISTS idx_services_node_id ON services(node_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_managers_parent_id ON managers(parent_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_manager_packages_status ON manager_packages(status)`,
 		`CREATE INDEX IF NOT EXISTS idx_service_auth_keys_revoked ON service_auth_keys(revoked)`,
-	}
-
-	for _, m := range migrations {
-		if _, err := db.Exec(m); err != nil {
-			return fmt.Errorf("migration failed: %w", err)
-		}
-	}
-
-	if _, err := db.Exec(`ALTER TABLE users ADD COLUMN manager_id TEXT`); err != nil {
-		if !strings.Contains(strings.ToLower(err.Error()), "duplicate column name") {
-			return fmt.Errorf("failed to ensure users.manager_id column: %w", err)
-		}
-	}
-
-	return nil
+	)(tx)
 }
 
 // User operations
 
-// CreateUser creates a new user
+// CreateUser creates a new user, storing its password as a bcrypt hash
 func (db *UserDB) CreateUser(user *domain.User) error {
+	password, err := hashPassword(user.Password)
+	if err != nil {
+		return err
+	}
 	caCerts, _ := json.Marshal(user.CACertList)
 	groups, _ := json.Marshal(user.Groups)
 	devices, _ := json.Marshal(user.AllowedDevices)
+	nodes, _ := json.Marshal(user.AllowedNodes)
+	services, _ := json.Marshal(user.AllowedServices)
+	allowedCountries, _ := json.Marshal(user.AllowedCountries)
+	deniedCountries, _ := json.Marshal(user.DeniedCountries)
+	attributes, _ := json.Marshal(user.Attributes)
 
 	now := time.Now()
-	_, err := db.Exec(`
-		INSERT INTO users (id, manager_id, username, password, public_key, private_key, ca_cert_list, groups, allowed_devices, status, active_package_id, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, user.ID, user.ManagerID, user.Username, user.Password, user.PublicKey, user.PrivateKey, string(caCerts), string(groups), string(devices), user.Status, user.ActivePackageID, now, now)
-
+	_, err = db.Exec(`
+		INSERT INTO users (id, manager_id, username, password, public_key, private_key, protocol_secret, ca_cert_list, groups, allowed_devices, allowed_nodes, allowed_services, allowed_countries, denied_countries, attributes, status, active_package_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, user.ID, user.ManagerID, user.Username, password, user.PublicKey, user.PrivateKey, user.ProtocolSecret, string(caCerts), string(groups), string(devices), string(nodes), string(services),
+		string(allowedCountries), string(deniedCountries), string(attributes), user.Status, user.ActivePackageID, now, now)
+	if err == nil {
+		user.Password = password
+	}
 	return err
 }
 
-// GetUser retrieves a user by ID
-func (db *UserDB) GetUser(id string) (*domain.User, error) {
+const userColumns = `id, manager_id, username, password, public_key, private_key, protocol_secret, ca_cert_list, groups, allowed_devices, allowed_nodes, allowed_services, allowed_countries, denied_countries, attributes, status, active_package_id, first_connection_at, last_connection_at, created_at, updated_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a row selected with userColumns
+func scanUser(row rowScanner) (*domain.User, error) {
 	user := &domain.User{}
-	var caCerts, groups, devices sql.NullString
+	var caCerts, groups, devices, nodes, services, allowedCountries, deniedCountries, attributes sql.NullString
 	var managerID sql.NullString
 	var activePackageID sql.NullString
-	var firstConnRaw, lastConnRaw sql.NullString
-	var createdAtRaw, updatedAtRaw string
 
-	err := db.QueryRow(`
-		SELECT id, manager_id, username, password, public_key, private_key, ca_cert_list, groups, allowed_devices, status, active_package_id, first_connection_at, last_connection_at, created_at, updated_at
-		FROM users WHERE id = ?
-	`, id).Scan(
-		&user.ID, &managerID, &user.Username, &user.Password, &user.PublicKey, &user.PrivateKey,
-		&caCerts, &groups, &devices, &user.Status, &activePackageID,
-		&firstConnRaw, &lastConnRaw, &createdAtRaw, &updatedAtRaw,
+	err := row.Scan(
+		&user.ID, &managerID, &user.Username, &user.Password, &user.PublicKey, &user.PrivateKey, &user.ProtocolSecret,
+		&caCerts, &groups, &devices, &nodes, &services, &allowedCountries, &deniedCountries, &attributes, &user.Status, &activePackageID,
+		scanNullTime(&user.FirstConnectionAt), scanNullTime(&user.LastConnectionAt),
+		scanTime(&user.CreatedAt), scanTime(&user.UpdatedAt),
 	)
-
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
 	if err != nil {
 		return nil, err
 	}
@@ -250,111 +488,80 @@ func (db *UserDB) GetUser(id string) (*domain.User, error) {
 	if devices.Valid {
 		json.Unmarshal([]byte(devices.String), &user.AllowedDevices)
 	}
-	if managerID.Valid {
-		user.ManagerID = &managerID.String
+	if nodes.Valid {
+		json.Unmarshal([]byte(nodes.String), &user.AllowedNodes)
 	}
-	if activePackageID.Valid {
-		user.ActivePackageID = &activePackageID.String
+	if services.Valid {
+		json.Unmarshal([]byte(services.String), &user.AllowedServices)
 	}
-	if firstConnRaw.Valid && firstConnRaw.String != "" {
-		parsed, parseErr := parseSQLiteTime(firstConnRaw.String)
-		if parseErr != nil {
-			return nil, parseErr
-		}
-		user.FirstConnectionAt = &parsed
+	if allowedCountries.Valid {
+		json.Unmarshal([]byte(allowedCountries.String), &user.AllowedCountries)
 	}
-	if lastConnRaw.Valid && lastConnRaw.String != "" {
-		parsed, parseErr := parseSQLiteTime(lastConnRaw.String)
-		if parseErr != nil {
-			return nil, parseErr
-		}
-		user.LastConnectionAt = &parsed
+	if deniedCountries.Valid {
+		json.Unmarshal([]byte(deniedCountries.String), &user.DeniedCountries)
 	}
-
-	user.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-	if err != nil {
-		return nil, err
+	if attributes.Valid {
+		json.Unmarshal([]byte(attributes.String), &user.Attributes)
 	}
-
-	user.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-	if err != nil {
-		return nil, err
+	if managerID.Valid {
+		user.ManagerID = &managerID.String
+	}
+	if activePackageID.Valid {
+		user.ActivePackageID = &activePackageID.String
 	}
 
 	return user, nil
 }
 
-// GetUserByUsername retrieves a user by username
-func (db *UserDB) GetUserByUsername(username string) (*domain.User, error) {
-	user := &domain.User{}
-	var caCerts, groups, devices sql.NullString
-	var managerID sql.NullString
-	var activePackageID sql.NullString
-	var firstConnRaw, lastConnRaw sql.NullString
-	var createdAtRaw, updatedAtRaw string
-
-	err := db.QueryRow(`
-		SELECT id, manager_id, username, password, public_key, private_key, ca_cert_list, groups, allowed_devices, status, active_package_id, first_connection_at, last_connection_at, created_at, updated_at
-		FROM users WHERE username = ?
-	`, username).Scan(
-		&user.ID, &managerID, &user.Username, &user.Password, &user.PublicKey, &user.PrivateKey,
-		&caCerts, &groups, &devices, &user.Status, &activePackageID,
-		&firstConnRaw, &lastConnRaw, &createdAtRaw, &updatedAtRaw,
-	)
-
+// GetUser retrieves a user by ID
+func (db *UserDB) GetUser(id string) (*domain.User, error) {
+	user, err := scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
+	return user, err
+}
 
-	if caCerts.Valid {
-		json.Unmarshal([]byte(caCerts.String), &user.CACertList)
-	}
-	if groups.Valid {
-		json.Unmarshal([]byte(groups.String), &user.Groups)
-	}
-	if devices.Valid {
-		json.Unmarshal([]byte(devices.String), &user.AllowedDevices)
-	}
-	if managerID.Valid {
-		user.ManagerID = &managerID.String
-	}
-	if activePackageID.Valid {
-		user.ActivePackageID = &activePackageID.String
-	}
-	if firstConnRaw.Valid && firstConnRaw.String != "" {
-		parsed, parseErr := parseSQLiteTime(firstConnRaw.String)
-		if parseErr != nil {
-			return nil, parseErr
-		}
-		user.FirstConnectionAt = &parsed
+// GetUserByPublicKey retrieves the user holding a public key, nil for an
+// empty key
+func (db *UserDB) GetUserByPublicKey(publicKey string) (*domain.User, error) {
+	if publicKey == "" {
+		return nil, nil
 	}
-	if lastConnRaw.Valid && lastConnRaw.String != "" {
-		parsed, parseErr := parseSQLiteTime(lastConnRaw.String)
-		if parseErr != nil {
-			return nil, parseErr
-		}
-		user.LastConnectionAt = &parsed
+	user, err := scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE public_key = ?`, publicKey))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	return user, err
+}
 
-	user.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-	if err != nil {
-		return nil, err
+// GetUserByUsername retrieves a user by username
+func (db *UserDB) GetUserByUsername(username string) (*domain.User, error) {
+	user, err := scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	return user, err
+}
 
-	user.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
+// ListUsers retrieves users with optional filtering
+func (db *UserDB) ListUsers(filter *domain.UserFilter) ([]*domain.User, error) {
+	users := []*domain.User{}
+	err := db.RangeUsers(filter, func(user *domain.User) error {
+		users = append(users, user)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	return user, nil
+	return users, nil
 }
 
-// ListUsers retrieves users with optional filtering
-func (db *UserDB) ListUsers(filter *domain.UserFilter) ([]*domain.User, error) {
-	query := `SELECT id, manager_id, username, password, public_key, private_key, ca_cert_list, groups, allowed_devices, status, active_package_id, first_connection_at, last_connection_at, created_at, updated_at FROM users`
+// RangeUsers calls fn for each user matching filter, newest first, without
+// loading them all at once. It stops at the first error fn returns. fn must
+// not query the user database.
+func (db *UserDB) RangeUsers(filter *domain.UserFilter, fn func(*domain.User) error) error {
+	query := `SELECT ` + userColumns + ` FROM users`
 	args := []interface{}{}
 	conditions := []string{}
 
@@ -363,6 +570,10 @@ func (db *UserDB) ListUsers(filter *domain.UserFilter) ([]*domain.User, error) {
 			conditions = append(conditions, "status = ?")
 			args = append(args, *filter.Status)
 		}
+		if filter.ManagerID != nil {
+			conditions = append(conditions, "manager_id = ?")
+			args = append(args, *filter.ManagerID)
+		}
 		if filter.Search != nil {
 			conditions = append(conditions, "username LIKE ?")
 			args = append(args, "%"+*filter.Search+"%")
@@ -382,94 +593,54 @@ func (db *UserDB) ListUsers(filter *domain.UserFilter) ([]*domain.User, error) {
 		}
 	}
 
-	rows, err := db.Query(query, args...)
+	rows, err := db.reader().Query(query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	users := []*domain.User{}
 	for rows.Next() {
-		user := &domain.User{}
-		var caCerts, groups, devices sql.NullString
-		var managerID sql.NullString
-		var activePackageID sql.NullString
-		var firstConnRaw, lastConnRaw sql.NullString
-		var createdAtRaw, updatedAtRaw string
-
-		err := rows.Scan(
-			&user.ID, &managerID, &user.Username, &user.Password, &user.PublicKey, &user.PrivateKey,
-			&caCerts, &groups, &devices, &user.Status, &activePackageID,
-			&firstConnRaw, &lastConnRaw, &createdAtRaw, &updatedAtRaw,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		if caCerts.Valid {
-			json.Unmarshal([]byte(caCerts.String), &user.CACertList)
-		}
-		if groups.Valid {
-			json.Unmarshal([]byte(groups.String), &user.Groups)
-		}
-		if devices.Valid {
-			json.Unmarshal([]byte(devices.String), &user.AllowedDevices)
-		}
-		if managerID.Valid {
-			user.ManagerID = &managerID.String
-		}
-		if activePackageID.Valid {
-			user.ActivePackageID = &activePackageID.String
-		}
-		if firstConnRaw.Valid && firstConnRaw.String != "" {
-			parsed, parseErr := parseSQLiteTime(firstConnRaw.String)
-			if parseErr != nil {
-				return nil, parseErr
-			}
-			user.FirstConnectionAt = &parsed
-		}
-		if lastConnRaw.Valid && lastConnRaw.String != "" {
-			parsed, parseErr := parseSQLiteTime(lastConnRaw.String)
-			if parseErr != nil {
-				return nil, parseErr
-			}
-			user.LastConnectionAt = &parsed
-		}
-
-		user.CreatedAt, err = parseSQLiteTime(createdAtRaw)
+		user, err := scanUser(rows)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		user.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-		if err != nil {
-			return nil, err
+		if err := fn(user); err != nil {
+			return err
 		}
-
-		users = append(users, user)
 	}
-
-	return users, nil
+	return rows.Err()
 }
 
-// UpdateUser updates a user
+// UpdateUser updates a user. A password that is not already a hash, such as
+// a new one set by an API call, is stored hashed.
 func (db *UserDB) UpdateUser(user *domain.User) error {
+	password, err := hashPassword(user.Password)
+	if err != nil {
+		return err
+	}
 	caCerts, _ := json.Marshal(user.CACertList)
 	groups, _ := json.Marshal(user.Groups)
 	devices, _ := json.Marshal(user.AllowedDevices)
+	nodes, _ := json.Marshal(user.AllowedNodes)
+	services, _ := json.Marshal(user.AllowedServices)
+	allowedCountries, _ := json.Marshal(user.AllowedCountries)
+	deniedCountries, _ := json.Marshal(user.DeniedCountries)
+	attributes, _ := json.Marshal(user.Attributes)
 
-	_, err := db.Exec(`
+	_, err = db.Exec(`
 		UPDATE users SET
-			manager_id = ?, username = ?, password = ?, public_key = ?, private_key = ?,
-			ca_cert_list = ?, groups = ?, allowed_devices = ?,
-			status = ?, active_package_id = ?, first_connection_at = ?,
+			manager_id = ?, username = ?, password = ?, public_key = ?, private_key = ?, protocol_secret = ?,
+			ca_cert_list = ?, groups = ?, allowed_devices = ?, allowed_nodes = ?, allowed_services = ?,
+			allowed_countries = ?, denied_countries = ?, attributes = ?, status = ?, active_package_id = ?, first_connection_at = ?,
 			last_connection_at = ?, updated_at = ?
 		WHERE id = ?
-	`, user.ManagerID, user.Username, user.Password, user.PublicKey, user.PrivateKey,
-		string(caCerts), string(groups), string(devices),
-		user.Status, user.ActivePackageID, user.FirstConnectionAt,
+	`, user.ManagerID, user.Username, password, user.PublicKey, user.PrivateKey, user.ProtocolSecret,
+		string(caCerts), string(groups), string(devices), string(nodes), string(services),
+		string(allowedCountries), string(deniedCountries), string(attributes), user.Status, user.ActivePackageID, user.FirstConnectionAt,
 		user.LastConnectionAt, time.Now(), user.ID)
-
+	if err == nil {
+		user.Password = password
+	}
 	return err
 }
 
@@ -479,19 +650,84 @@ func (db *UserDB) UpdateUserStatus(id string, status domain.UserStatus) error {
 	return err
 }
 
-// UpdateUserLastConnection updates the last connection timestamp
-func (db *UserDB) UpdateUserLastConnection(id string) error {
-	now := time.Now()
-	_, err := db.Exec(`
-		UPDATE users SET last_connection_at = ?, updated_at = ? WHERE id = ?
-	`, now, now, id)
-	return err
+// DeleteUser deletes a user and records the deletion for node sync
+func (db *UserDB) DeleteUser(id string) error {
+	return db.Transaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+		if _, err := tx.Exec(`DELETE FROM user_devices WHERE user_id = ?`, id); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO user_deletions (user_id, deleted_at) VALUES (?, ?)`, id, time.Now())
+		return err
+	})
 }
 
-// DeleteUser deletes a user
-func (db *UserDB) DeleteUser(id string) error {
-	_, err := db.Exec(`DELETE FROM users WHERE id = ?`, id)
-	return err
+// CountUsersByStatus returns the number of users in each status
+func (db *UserDB) CountUsersByStatus() (map[domain.UserStatus]int64, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM users GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[domain.UserStatus]int64)
+	for rows.Next() {
+		var status domain.UserStatus
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// ListUsersChangedSince returns users whose record or any of whose packages
+// changed at or after since
+func (db *UserDB) ListUsersChangedSince(since time.Time) ([]*domain.User, error) {
+	rows, err := db.Query(`
+		SELECT `+userColumns+` FROM users
+		WHERE updated_at >= ? OR id IN (SELECT user_id FROM packages WHERE updated_at >= ?)
+	`, since, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*domain.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// ListUserDeletionsSince returns the IDs of users deleted at or after since
+func (db *UserDB) ListUserDeletionsSince(since time.Time) ([]string, error) {
+	rows, err := db.Query(`SELECT user_id FROM user_deletions WHERE deleted_at >= ?`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
 // Package operations
@@ -505,105 +741,177 @@ func (db *UserDB) CreatePackage(pkg *domain.Package) error {
 		pkg.TotalTraffic = pkg.TotalLimit
 	}
 
-	now := time.Now()
-	_, err := db.Exec(`
-		INSERT INTO packages (id, user_id, total_traffic, upload_limit, download_limit, reset_mode, duration, start_at, max_concurrent, status, current_upload, current_download, current_total, expires_at, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, pkg.ID, pkg.UserID, pkg.TotalTraffic, pkg.UploadLimit, pkg.DownloadLimit,
-		pkg.ResetMode, pkg.Duration, pkg.StartAt, pkg.MaxConcurrent, pkg.Status,
-		pkg.CurrentUpload, pkg.CurrentDownload, pkg.CurrentTotal, pkg.ExpiresAt, now, now)
-
+	if !pkg.Priority.IsValid() {
+		pkg.Priority = domain.DefaultPackagePriority
+	}
+	if !pkg.SessionIdentity.IsValid() {
+		pkg.SessionIdentity = ""
+	}
+	if !pkg.SessionReplace.IsValid() {
+		pkg.SessionReplace = ""
+	}
+	if !pkg.CountMode.IsValid() {
+		pkg.CountMode = ""
+	}
+
+	nodes, _ := json.Marshal(pkg.AllowedNodes)
+	services, _ := json.Marshal(pkg.AllowedServices)
+	allowedCountries, _ := json.Marshal(pkg.AllowedCountries)
+	deniedCountries, _ := json.Marshal(pkg.DeniedCountries)
+
+	if pkg.Status != domain.PackageStatusQueued {
+		pkg.QueuePosition = 0
+	} else if pkg.QueuePosition <= 0 {
+		// Append behind the user's last queued package
+		if err := db.QueryRow(`SELECT COALESCE(MAX(queue_position), 0) + 1 FROM packages WHERE user_id = ? AND status = ?`,
+			pkg.UserID, domain.PackageStatusQueued).Scan(&pkg.QueuePosition); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO packages (id, user_id, total_traffic, upload_limit, download_limit, count_mode, reset_mode, duration, start_at, max_concurrent, max_ips, max_devices, throttle_threshold, throttle_rate, penalty_duration, penalty_action, priority, session_identity, session_replace, allowed_nodes, allowed_services, allowed_countries, denied_countries, status, current_upload, current_download, current_total, queue_position, expires_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, pkg.ID, pkg.UserID, pkg.TotalTraffic, pkg.UploadLimit, pkg.DownloadLimit, pkg.CountMode,
+		pkg.ResetMode, pkg.Duration, pkg.StartAt, pkg.MaxConcurrent, pkg.MaxIPs, pkg.MaxDevices, pkg.ThrottleThreshold, pkg.ThrottleRate, pkg.PenaltyDuration, pkg.PenaltyAction, pkg.Priority, pkg.SessionIdentity, pkg.SessionReplace, string(nodes), string(services), string(allowedCountries), string(deniedCountries), pkg.Status,
+		pkg.CurrentUpload, pkg.CurrentDownload, pkg.CurrentTotal, pkg.QueuePosition, pkg.ExpiresAt, now, now)
+
 	return err
 }
 
-// GetPackage retrieves a package by ID
-func (db *UserDB) GetPackage(id string) (*domain.Package, error) {
-	pkg := &domain.Package{}
-	var startAt, expiresAt sql.NullTime
-	var createdAtRaw, updatedAtRaw string
+const packageColumns = `id, user_id, total_traffic, upload_limit, download_limit, count_mode, reset_mode, duration, start_at, max_concurrent, max_ips, max_devices, throttle_threshold, throttle_rate, penalty_duration, penalty_action, priority, session_identity, session_replace, allowed_nodes, allowed_services, allowed_countries, denied_countries, status, current_upload, current_download, current_total, reserved, queue_position, expires_at, created_at, updated_at`
 
-	err := db.QueryRow(`
-		SELECT id, user_id, total_traffic, upload_limit, download_limit, reset_mode, duration, start_at, max_concurrent, status, current_upload, current_download, current_total, expires_at, created_at, updated_at
-		FROM packages WHERE id = ?
-	`, id).Scan(
-		&pkg.ID, &pkg.UserID, &pkg.TotalTraffic, &pkg.UploadLimit, &pkg.DownloadLimit,
-		&pkg.ResetMode, &pkg.Duration, &startAt, &pkg.MaxConcurrent, &pkg.Status,
-		&pkg.CurrentUpload, &pkg.CurrentDownload, &pkg.CurrentTotal, &expiresAt,
-		&createdAtRaw, &updatedAtRaw,
+// scanPackage reads a row selected with packageColumns
+func scanPackage(row rowScanner) (*domain.Package, error) {
+	pkg := &domain.Package{}
+	var nodes, services, allowedCountries, deniedCountries sql.NullString
+
+	err := row.Scan(
+		&pkg.ID, &pkg.UserID, &pkg.TotalTraffic, &pkg.UploadLimit, &pkg.DownloadLimit, &pkg.CountMode,
+		&pkg.ResetMode, &pkg.Duration, scanNullTime(&pkg.StartAt), &pkg.MaxConcurrent, &pkg.MaxIPs, &pkg.MaxDevices, &pkg.ThrottleThreshold, &pkg.ThrottleRate, &pkg.PenaltyDuration, &pkg.PenaltyAction, &pkg.Priority, &pkg.SessionIdentity, &pkg.SessionReplace,
+		&nodes, &services, &allowedCountries, &deniedCountries, &pkg.Status,
+		&pkg.CurrentUpload, &pkg.CurrentDownload, &pkg.CurrentTotal, &pkg.Reserved, &pkg.QueuePosition, scanNullTime(&pkg.ExpiresAt),
+		scanTime(&pkg.CreatedAt), scanTime(&pkg.UpdatedAt),
 	)
-
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
 	if err != nil {
 		return nil, err
 	}
-
-	if startAt.Valid {
-		pkg.StartAt = &startAt.Time
+	pkg.TotalLimit = pkg.TotalTraffic
+	if nodes.Valid {
+		json.Unmarshal([]byte(nodes.String), &pkg.AllowedNodes)
 	}
-	if expiresAt.Valid {
-		pkg.ExpiresAt = &expiresAt.Time
+	if services.Valid {
+		json.Unmarshal([]byte(services.String), &pkg.AllowedServices)
 	}
-	pkg.TotalLimit = pkg.TotalTraffic
-
-	pkg.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-	if err != nil {
-		return nil, err
+	if allowedCountries.Valid {
+		json.Unmarshal([]byte(allowedCountries.String), &pkg.AllowedCountries)
 	}
-
-	pkg.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-	if err != nil {
-		return nil, err
+	if deniedCountries.Valid {
+		json.Unmarshal([]byte(deniedCountries.String), &pkg.DeniedCountries)
 	}
 
 	return pkg, nil
 }
 
+// GetPackage retrieves a package by ID
+func (db *UserDB) GetPackage(id string) (*domain.Package, error) {
+	pkg, err := scanPackage(db.QueryRow(`SELECT `+packageColumns+` FROM packages WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pkg, err
+}
+
 // GetPackageByUserID retrieves the active package for a user
 func (db *UserDB) GetPackageByUserID(userID string) (*domain.Package, error) {
-	pkg := &domain.Package{}
-	var startAt, expiresAt sql.NullTime
-	var createdAtRaw, updatedAtRaw string
+	pkg, err := scanPackage(db.QueryRow(`
+		SELECT `+packageColumns+` FROM packages
+		WHERE id = (SELECT active_package_id FROM users WHERE id = ?)
+	`, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pkg, err
+}
 
-	err := db.QueryRow(`
-		SELECT p.id, p.user_id, p.total_traffic, p.upload_limit, p.download_limit, p.reset_mode, p.duration, p.start_at, p.max_concurrent, p.status, p.current_upload, p.current_download, p.current_total, p.expires_at, p.created_at, p.updated_at
-		FROM packages p
-		JOIN users u ON u.active_package_id = p.id
-		WHERE u.id = ?
-	`, userID).Scan(
-		&pkg.ID, &pkg.UserID, &pkg.TotalTraffic, &pkg.UploadLimit, &pkg.DownloadLimit,
-		&pkg.ResetMode, &pkg.Duration, &startAt, &pkg.MaxConcurrent, &pkg.Status,
-		&pkg.CurrentUpload, &pkg.CurrentDownload, &pkg.CurrentTotal, &expiresAt,
-		&createdAtRaw, &updatedAtRaw,
-	)
+// ListUserPackages returns a user's packages: the others first, newest
+// first, then the queued ones in queue order
+func (db *UserDB) ListUserPackages(userID string) ([]*domain.Package, error) {
+	return db.listPackages(`
+		SELECT `+packageColumns+` FROM packages WHERE user_id = ?
+		ORDER BY status = ?, queue_position, created_at DESC
+	`, userID, domain.PackageStatusQueued)
+}
 
+// NextQueuedPackage returns the first package in a user's queue, or nil
+func (db *UserDB) NextQueuedPackage(userID string) (*domain.Package, error) {
+	pkg, err := scanPackage(db.QueryRow(`
+		SELECT `+packageColumns+` FROM packages WHERE user_id = ? AND status = ?
+		ORDER BY queue_position, created_at LIMIT 1
+	`, userID, domain.PackageStatusQueued))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
+	return pkg, err
+}
 
-	if startAt.Valid {
-		pkg.StartAt = &startAt.Time
-	}
-	if expiresAt.Valid {
-		pkg.ExpiresAt = &expiresAt.Time
-	}
-	pkg.TotalLimit = pkg.TotalTraffic
+// ActivatePackage makes a queued package the user's active package and the
+// user active. It reports false when the package is no longer queued.
+func (db *UserDB) ActivatePackage(userID, packageID string) (bool, error) {
+	activated := false
+	err := db.Transaction(func(tx *sql.Tx) error {
+		now := time.Now()
+		res, err := tx.Exec(`UPDATE packages SET status = ?, queue_position = 0, updated_at = ? WHERE id = ? AND user_id = ? AND status = ?`,
+			domain.PackageStatusActive, now, packageID, userID, domain.PackageStatusQueued)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE users SET active_package_id = ?, status = ?, updated_at = ? WHERE id = ?`,
+			packageID, domain.UserStatusActive, now, userID); err != nil {
+			return err
+		}
+		activated = true
+		return nil
+	})
+	return activated, err
+}
 
-	pkg.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-	if err != nil {
-		return nil, err
-	}
+// ListActivePackages returns the active packages of active users, those who
+// connected most recently first. limit 0 returns all of them.
+func (db *UserDB) ListActivePackages(limit int) ([]*domain.Package, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return db.listPackages(`
+		SELECT `+packageColumns+` FROM packages
+		WHERE status = ? AND id IN (
+			SELECT active_package_id FROM users WHERE status = ?
+			ORDER BY last_connection_at IS NULL, last_connection_at DESC
+			LIMIT ?
+		)
+	`, domain.PackageStatusActive, domain.UserStatusActive, limit)
+}
 
-	pkg.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
+func (db *UserDB) listPackages(query string, args ...interface{}) ([]*domain.Package, error) {
+	rows, err := db.reader().Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return pkg, nil
+	packages := []*domain.Package{}
+	for rows.Next() {
+		pkg, err := scanPackage(rows)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, pkg)
+	}
+	return packages, rows.Err()
 }
 
 // UpdatePackageUsage updates the current usage counters
@@ -625,6 +933,54 @@ func (db *UserDB) UpdatePackageStatus(id string, status domain.PackageStatus) er
 	return err
 }
 
+// StartPackage stores a package's start and expiry unless it has already
+// started. It reports whether this call started it.
+func (db *UserDB) StartPackage(id string, startAt time.Time, expiresAt *time.Time) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE packages SET start_at = ?, expires_at = ?, updated_at = ?
+		WHERE id = ? AND start_at IS NULL
+	`, startAt, expiresAt, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListExpiredPackages returns the active packages whose expiry, from
+// expires_at or from start_at plus duration, lies before now
+func (db *UserDB) ListExpiredPackages(now time.Time) ([]*domain.Package, error) {
+	candidates, err := db.listPackages(`
+		SELECT `+packageColumns+` FROM packages
+		WHERE status = ? AND (expires_at IS NOT NULL OR (start_at IS NOT NULL AND duration > 0))
+	`, domain.PackageStatusActive)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []*domain.Package{}
+	for _, pkg := range candidates {
+		if pkg.IsExpiredAt(now) {
+			packages = append(packages, pkg)
+		}
+	}
+	return packages, nil
+}
+
+// SetPackageUsage overwrites the usage counters, e.g. with counters rebuilt
+// from the event history
+func (db *UserDB) SetPackageUsage(id string, upload, download int64) error {
+	_, err := db.Exec(`
+		UPDATE packages SET
+			current_upload = ?,
+			current_download = ?,
+			current_total = ?,
+			updated_at = ?
+		WHERE id = ?
+	`, upload, download, upload+download, time.Now(), id)
+	return err
+}
+
 // ResetPackageUsage resets the usage counters
 func (db *UserDB) ResetPackageUsage(id string) error {
 	_, err := db.Exec(`
@@ -653,33 +1009,30 @@ func (db *UserDB) CreateNode(node *domain.Node) error {
 	now := time.Now()
 
 	_, err := db.Exec(`
-		INSERT INTO nodes (id, secret_key, name, allowed_ips, traffic_multiplier, reset_mode, reset_day, current_upload, current_download, country, city, isp, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO nodes (id, secret_key, name, allowed_ips, traffic_multiplier, reset_mode, reset_day, current_upload, current_download, country, city, isp, manager_id, max_active_users, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, node.ID, node.SecretKey, node.Name, string(allowedIPs), node.TrafficMultiplier,
 		node.ResetMode, node.ResetDay, node.CurrentUpload, node.CurrentDownload,
-		node.Country, node.City, node.ISP, now, now)
+		node.Country, node.City, node.ISP, node.ManagerID, node.MaxActiveUsers, now, now)
 
 	return err
 }
 
-// GetNode retrieves a node by ID
-func (db *UserDB) GetNode(id string) (*domain.Node, error) {
+const nodeColumns = `id, secret_key, name, allowed_ips, traffic_multiplier, reset_mode, reset_day, current_upload, current_download, country, city, isp, draining, manager_id, max_active_users, last_reset_at, last_seen_at, agent_version, cpu_percent, active_connections, bandwidth_bps, down_at, created_at, updated_at`
+
+// scanNode reads a row selected with nodeColumns
+func scanNode(row rowScanner) (*domain.Node, error) {
 	node := &domain.Node{}
-	var allowedIPs sql.NullString
-	var createdAtRaw, updatedAtRaw string
+	var allowedIPs, managerID sql.NullString
 
-	err := db.QueryRow(`
-		SELECT id, secret_key, name, allowed_ips, traffic_multiplier, reset_mode, reset_day, current_upload, current_download, country, city, isp, created_at, updated_at
-		FROM nodes WHERE id = ?
-	`, id).Scan(
+	err := row.Scan(
 		&node.ID, &node.SecretKey, &node.Name, &allowedIPs, &node.TrafficMultiplier,
 		&node.ResetMode, &node.ResetDay, &node.CurrentUpload, &node.CurrentDownload,
-		&node.Country, &node.City, &node.ISP, &createdAtRaw, &updatedAtRaw,
+		&node.Country, &node.City, &node.ISP, &node.Draining, &managerID, &node.MaxActiveUsers,
+		scanNullTime(&node.LastResetAt), scanNullTime(&node.LastSeenAt), &node.AgentVersion,
+		&node.CPUPercent, &node.ActiveConnections, &node.BandwidthBps, scanNullTime(&node.DownAt),
+		scanTime(&node.CreatedAt), scanTime(&node.UpdatedAt),
 	)
-
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
 	if err != nil {
 		return nil, err
 	}
@@ -688,66 +1041,49 @@ func (db *UserDB) GetNode(id string) (*domain.Node, error) {
 		json.Unmarshal([]byte(allowedIPs.String), &node.AllowedIPs)
 		node.IPs = append([]string(nil), node.AllowedIPs...)
 	}
-	node.CurrentTotal = node.CurrentUpload + node.CurrentDownload
-
-	node.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-	if err != nil {
-		return nil, err
-	}
-	node.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-	if err != nil {
-		return nil, err
+	if managerID.Valid && managerID.String != "" {
+		node.ManagerID = &managerID.String
 	}
+	node.CurrentTotal = node.CurrentUpload + node.CurrentDownload
 
 	return node, nil
 }
 
+// GetNode retrieves a node by ID
+func (db *UserDB) GetNode(id string) (*domain.Node, error) {
+	node, err := scanNode(db.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return node, err
+}
+
 // GetNodeBySecretKey retrieves a node by secret key
 func (db *UserDB) GetNodeBySecretKey(secretKey string) (*domain.Node, error) {
-	node := &domain.Node{}
-	var allowedIPs sql.NullString
-	var createdAtRaw, updatedAtRaw string
-
-	err := db.QueryRow(`
-		SELECT id, secret_key, name, allowed_ips, traffic_multiplier, reset_mode, reset_day, current_upload, current_download, country, city, isp, created_at, updated_at
-		FROM nodes WHERE secret_key = ?
-	`, secretKey).Scan(
-		&node.ID, &node.SecretKey, &node.Name, &allowedIPs, &node.TrafficMultiplier,
-		&node.ResetMode, &node.ResetDay, &node.CurrentUpload, &node.CurrentDownload,
-		&node.Country, &node.City, &node.ISP, &createdAtRaw, &updatedAtRaw,
-	)
-
+	node, err := scanNode(db.QueryRow(`SELECT `+nodeColumns+` FROM nodes WHERE secret_key = ?`, secretKey))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
+	return node, err
+}
 
-	if allowedIPs.Valid {
-		json.Unmarshal([]byte(allowedIPs.String), &node.AllowedIPs)
-		node.IPs = append([]string(nil), node.AllowedIPs...)
-	}
-	node.CurrentTotal = node.CurrentUpload + node.CurrentDownload
+// ListNodes retrieves all nodes
+func (db *UserDB) ListNodes() ([]*domain.Node, error) {
+	return db.listNodes(`SELECT ` + nodeColumns + ` FROM nodes ORDER BY created_at DESC`)
+}
 
-	node.CreatedAt, err = parseSQLiteTime(createdAtRaw)
+// ListNodesForManager retrieves the nodes visible to a manager: shared nodes
+// and nodes owned by the manager or one of its ancestors
+func (db *UserDB) ListNodesForManager(managerID string) ([]*domain.Node, error) {
+	condition, args, err := db.managerScopeCondition(managerID)
 	if err != nil {
 		return nil, err
 	}
-	node.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-	if err != nil {
-		return nil, err
-	}
-
-	return node, nil
+	return db.listNodes(`SELECT `+nodeColumns+` FROM nodes WHERE `+condition+` ORDER BY created_at DESC`, args...)
 }
 
-// ListNodes retrieves all nodes
-func (db *UserDB) ListNodes() ([]*domain.Node, error) {
-	rows, err := db.Query(`
-		SELECT id, secret_key, name, allowed_ips, traffic_multiplier, reset_mode, reset_day, current_upload, current_download, country, city, isp, created_at, updated_at
-		FROM nodes ORDER BY created_at DESC
-	`)
+func (db *UserDB) listNodes(query string, args ...interface{}) ([]*domain.Node, error) {
+	rows, err := db.reader().Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -755,34 +1091,10 @@ func (db *UserDB) ListNodes() ([]*domain.Node, error) {
 
 	nodes := []*domain.Node{}
 	for rows.Next() {
-		node := &domain.Node{}
-		var allowedIPs sql.NullString
-		var createdAtRaw, updatedAtRaw string
-
-		err := rows.Scan(
-			&node.ID, &node.SecretKey, &node.Name, &allowedIPs, &node.TrafficMultiplier,
-			&node.ResetMode, &node.ResetDay, &node.CurrentUpload, &node.CurrentDownload,
-			&node.Country, &node.City, &node.ISP, &createdAtRaw, &updatedAtRaw,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		if allowedIPs.Valid {
-			json.Unmarshal([]byte(allowedIPs.String), &node.AllowedIPs)
-			node.IPs = append([]string(nil), node.AllowedIPs...)
-		}
-		node.CurrentTotal = node.CurrentUpload + node.CurrentDownload
-
-		node.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-		if err != nil {
-			return nil, err
-		}
-		node.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
+		node, err := scanNode(rows)
 		if err != nil {
 			return nil, err
 		}
-
 		nodes = append(nodes, node)
 	}
 
@@ -801,6 +1113,126 @@ func (db *UserDB) UpdateNodeUsage(id string, upload, download int64) error {
 	return err
 }
 
+// ResetNodeUsage zeroes a node's counters and returns what they held. The
+// snapshot's period starts at the previous reset, or at the node's creation.
+// It returns nil when the node does not exist.
+func (db *UserDB) ResetNodeUsage(id string, at time.Time) (*domain.NodeUsageSnapshot, error) {
+	var snapshot *domain.NodeUsageSnapshot
+	err := db.Transaction(func(tx *sql.Tx) error {
+		s := &domain.NodeUsageSnapshot{NodeID: id, ResetAt: at}
+		var createdAt time.Time
+		var lastResetAt *time.Time
+		err := tx.QueryRow(`SELECT reset_mode, current_upload, current_download, last_reset_at, created_at FROM nodes WHERE id = ?`, id).
+			Scan(&s.ResetMode, &s.Upload, &s.Download, scanNullTime(&lastResetAt), scanTime(&createdAt))
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.Total = s.Upload + s.Download
+		s.PeriodStart = createdAt
+		if lastResetAt != nil {
+			s.PeriodStart = *lastResetAt
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE nodes SET current_upload = 0, current_download = 0, last_reset_at = ?, updated_at = ?
+			WHERE id = ?
+		`, at, time.Now(), id); err != nil {
+			return err
+		}
+		snapshot = s
+		return nil
+	})
+	return snapshot, err
+}
+
+// SetNodeDraining marks a node as draining (no new sessions) or clears it
+func (db *UserDB) SetNodeDraining(id string, draining bool) error {
+	_, err := db.Exec(`UPDATE nodes SET draining = ?, updated_at = ? WHERE id = ?`, draining, time.Now(), id)
+	return err
+}
+
+// RecordNodeHeartbeat stores when a node last sent a heartbeat, its agent
+// version and the load it reported, and clears its down mark. An empty agent
+// version keeps the stored one. updated_at is left alone so heartbeats do not
+// show up in incremental node syncs.
+func (db *UserDB) RecordNodeHeartbeat(load *domain.NodeLoad, at time.Time) error {
+	_, err := db.Exec(`
+		UPDATE nodes SET last_seen_at = ?, agent_version = CASE WHEN ? = '' THEN agent_version ELSE ? END,
+			cpu_percent = ?, active_connections = ?, bandwidth_bps = ?, down_at = NULL
+		WHERE id = ?
+	`, at, load.AgentVersion, load.AgentVersion, load.CPUPercent, load.ActiveConnections, load.BandwidthBps, load.NodeID)
+	return err
+}
+
+// MarkNodesDown marks the nodes whose last heartbeat is older than before as
+// down at the given time and returns them. Nodes that never sent a heartbeat
+// or are already marked are skipped, so each outage is returned once.
+func (db *UserDB) MarkNodesDown(before, at time.Time) ([]*domain.Node, error) {
+	nodes, err := db.listNodes(`SELECT `+nodeColumns+` FROM nodes WHERE last_seen_at IS NOT NULL AND last_seen_at < ? AND down_at IS NULL`, before)
+	if err != nil {
+		return nil, err
+	}
+
+	down := nodes[:0]
+	for _, node := range nodes {
+		res, err := db.Exec(`UPDATE nodes SET down_at = ? WHERE id = ? AND down_at IS NULL`, at, node.ID)
+		if err != nil {
+			return down, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		node.DownAt = &at
+		down = append(down, node)
+	}
+	return down, nil
+}
+
+// SetNodeManager assigns a node to a manager, or makes it shared when managerID is nil
+func (db *UserDB) SetNodeManager(id string, managerID *string) error {
+	now := time.Now()
+	_, err := db.Exec(`UPDATE nodes SET manager_id = ?, scope_changed_at = ?, updated_at = ? WHERE id = ?`, managerID, now, now, id)
+	return err
+}
+
+// UpdateNode updates a node's definition; usage counters and the draining
+// flag are left untouched. The change is recorded as a scope change for node
+// sync, since the manager or multiplier may have moved.
+func (db *UserDB) UpdateNode(node *domain.Node) error {
+	if len(node.AllowedIPs) == 0 && len(node.IPs) > 0 {
+		node.AllowedIPs = append([]string(nil), node.IPs...)
+	}
+	allowedIPs, _ := json.Marshal(node.AllowedIPs)
+
+	now := time.Now()
+	_, err := db.Exec(`
+		UPDATE nodes SET secret_key = ?, name = ?, allowed_ips = ?, traffic_multiplier = ?, reset_mode = ?, reset_day = ?,
+			country = ?, city = ?, isp = ?, manager_id = ?, max_active_users = ?, scope_changed_at = ?, updated_at = ?
+		WHERE id = ?
+	`, node.SecretKey, node.Name, string(allowedIPs), node.TrafficMultiplier, node.ResetMode, node.ResetDay,
+		node.Country, node.City, node.ISP, node.ManagerID, node.MaxActiveUsers, now, now, node.ID)
+	return err
+}
+
+// NodeScopeChangedSince reports whether the node's definition or manager
+// changed at or after since. Usage and draining updates do not count.
+func (db *UserDB) NodeScopeChangedSince(id string, since time.Time) (bool, error) {
+	var changed bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM nodes WHERE id = ? AND scope_changed_at >= ?)`, id, since).Scan(&changed)
+	return changed, err
+}
+
+// ManagersChangedSince reports whether any manager was created or edited,
+// including moves in the hierarchy, at or after since
+func (db *UserDB) ManagersChangedSince(since time.Time) (bool, error) {
+	var changed bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM managers WHERE updated_at >= ?)`, since).Scan(&changed)
+	return changed, err
+}
+
 // DeleteNode deletes a node
 func (db *UserDB) DeleteNode(id string) error {
 	_, err := db.Exec(`DELETE FROM nodes WHERE id = ?`, id)
@@ -823,10 +1255,10 @@ func (db *UserDB) CreateService(service *domain.Service) error {
 
 	return db.Transaction(func(tx *sql.Tx) error {
 		if _, err := tx.Exec(`
-			INSERT INTO services (id, secret_key, node_id, name, protocol, allowed_auth_methods, callback_url, current_upload, current_download, created_at, updated_at)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			INSERT INTO services (id, secret_key, node_id, name, protocol, allowed_auth_methods, callback_url, manager_id, current_upload, current_download, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`, service.ID, service.SecretKey, service.NodeID, service.Name, service.Protocol,
-			string(authMethods), service.CallbackURL, service.CurrentUpload, service.CurrentDownload, now, now); err != nil {
+			string(authMethods), service.CallbackURL, service.ManagerID, service.CurrentUpload, service.CurrentDownload, now, now); err != nil {
 			return err
 		}
 
@@ -835,10 +1267,7 @@ func (db *UserDB) CreateService(service *domain.Service) error {
 			if _, err := tx.Exec(`
 				INSERT INTO service_auth_keys (service_id, hashed_key, revoked, created_at, updated_at)
 				VALUES (?, ?, 0, ?, ?)
-				ON CONFLICT(service_id) DO UPDATE SET
-					hashed_key = excluded.hashed_key,
-					revoked = 0,
-					updated_at = excluded.updated_at
+				ON CONFLICT(service_id) DO UPDATE SET `+replaceAuthKeySet+`
 			`, service.ID, hashed, now, now); err != nil {
 				return err
 			}
@@ -848,24 +1277,18 @@ func (db *UserDB) CreateService(service *domain.Service) error {
 	})
 }
 
-// GetService retrieves a service by ID
-func (db *UserDB) GetService(id string) (*domain.Service, error) {
+const serviceColumns = `id, secret_key, node_id, name, protocol, allowed_auth_methods, callback_url, manager_id, current_upload, current_download, created_at, updated_at`
+
+// scanService reads a row selected with serviceColumns
+func scanService(row rowScanner) (*domain.Service, error) {
 	service := &domain.Service{}
-	var authMethods sql.NullString
-	var createdAtRaw, updatedAtRaw string
+	var authMethods, managerID sql.NullString
 
-	err := db.QueryRow(`
-		SELECT id, secret_key, node_id, name, protocol, allowed_auth_methods, callback_url, current_upload, current_download, created_at, updated_at
-		FROM services WHERE id = ?
-	`, id).Scan(
+	err := row.Scan(
 		&service.ID, &service.SecretKey, &service.NodeID, &service.Name, &service.Protocol,
-		&authMethods, &service.CallbackURL, &service.CurrentUpload, &service.CurrentDownload,
-		&createdAtRaw, &updatedAtRaw,
+		&authMethods, &service.CallbackURL, &managerID, &service.CurrentUpload, &service.CurrentDownload,
+		scanTime(&service.CreatedAt), scanTime(&service.UpdatedAt),
 	)
-
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
 	if err != nil {
 		return nil, err
 	}
@@ -873,61 +1296,93 @@ func (db *UserDB) GetService(id string) (*domain.Service, error) {
 	if authMethods.Valid {
 		json.Unmarshal([]byte(authMethods.String), &service.AllowedAuthMethods)
 	}
+	if managerID.Valid && managerID.String != "" {
+		service.ManagerID = &managerID.String
+	}
 	if service.AccessToken == "" && service.SecretKey != "" {
 		service.AccessToken = service.SecretKey
 	}
 
-	service.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-	if err != nil {
-		return nil, err
-	}
-	service.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-	if err != nil {
-		return nil, err
-	}
-
 	return service, nil
 }
 
+// GetService retrieves a service by ID
+func (db *UserDB) GetService(id string) (*domain.Service, error) {
+	service, err := scanService(db.QueryRow(`SELECT `+serviceColumns+` FROM services WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return service, err
+}
+
 // GetServiceBySecretKey retrieves a service by secret key
 func (db *UserDB) GetServiceBySecretKey(secretKey string) (*domain.Service, error) {
-	service := &domain.Service{}
-	var authMethods sql.NullString
-	var createdAtRaw, updatedAtRaw string
-
-	err := db.QueryRow(`
-		SELECT id, secret_key, node_id, name, protocol, allowed_auth_methods, callback_url, current_upload, current_download, created_at, updated_at
-		FROM services WHERE secret_key = ?
-	`, secretKey).Scan(
-		&service.ID, &service.SecretKey, &service.NodeID, &service.Name, &service.Protocol,
-		&authMethods, &service.CallbackURL, &service.CurrentUpload, &service.CurrentDownload,
-		&createdAtRaw, &updatedAtRaw,
-	)
-
+	service, err := scanService(db.QueryRow(`SELECT `+serviceColumns+` FROM services WHERE secret_key = ?`, secretKey))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	if err != nil {
-		return nil, err
-	}
+	return service, err
+}
 
-	if authMethods.Valid {
-		json.Unmarshal([]byte(authMethods.String), &service.AllowedAuthMethods)
-	}
-	if service.AccessToken == "" && service.SecretKey != "" {
-		service.AccessToken = service.SecretKey
-	}
+// ListServices retrieves all services
+func (db *UserDB) ListServices() ([]*domain.Service, error) {
+	return db.listServices(`SELECT ` + serviceColumns + ` FROM services ORDER BY created_at DESC`)
+}
 
-	service.CreatedAt, err = parseSQLiteTime(createdAtRaw)
-	if err != nil {
-		return nil, err
-	}
-	service.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
+// ListServicesForManager retrieves the services visible to a manager: shared
+// services and services owned by the manager or one of its ancestors
+func (db *UserDB) ListServicesForManager(managerID string) ([]*domain.Service, error) {
+	condition, args, err := db.managerScopeCondition(managerID)
 	if err != nil {
 		return nil, err
 	}
-
-	return service, nil
+	return db.listServices(`SELECT `+serviceColumns+` FROM services WHERE `+condition+` ORDER BY created_at DESC`, args...)
+}
+
+// ListServicesFiltered retrieves the services matching the filter
+func (db *UserDB) ListServicesFiltered(filter *domain.ServiceFilter) ([]*domain.Service, error) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if filter != nil {
+		if filter.NodeID != nil {
+			conditions = append(conditions, "node_id = ?")
+			args = append(args, *filter.NodeID)
+		}
+		if filter.ManagerID != nil {
+			condition, scopeArgs, err := db.managerScopeCondition(*filter.ManagerID)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, "("+condition+")")
+			args = append(args, scopeArgs...)
+		}
+	}
+
+	query := `SELECT ` + serviceColumns + ` FROM services`
+	if len(conditions) > 0 {
+		query += " WHERE " + joinConditions(conditions, " AND ")
+	}
+	return db.listServices(query+" ORDER BY created_at DESC", args...)
+}
+
+func (db *UserDB) listServices(query string, args ...interface{}) ([]*domain.Service, error) {
+	rows, err := db.reader().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := []*domain.Service{}
+	for rows.Next() {
+		service, err := scanService(rows)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+
+	return services, nil
 }
 
 // UpdateServiceUsage updates the service usage counters
@@ -942,12 +1397,267 @@ func (db *UserDB) UpdateServiceUsage(id string, upload, download int64) error {
 	return err
 }
 
+// SetServiceManager assigns a service to a manager, or makes it shared when managerID is nil
+func (db *UserDB) SetServiceManager(id string, managerID *string) error {
+	_, err := db.Exec(`UPDATE services SET manager_id = ?, updated_at = ? WHERE id = ?`, managerID, time.Now(), id)
+	return err
+}
+
+// UpdateService updates a service's definition and rotates its auth key when
+// the secret changed; usage counters are left untouched
+func (db *UserDB) UpdateService(service *domain.Service) error {
+	authMethods, _ := json.Marshal(service.AllowedAuthMethods)
+	now := time.Now()
+
+	return db.Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE services SET secret_key = ?, node_id = ?, name = ?, protocol = ?, allowed_auth_methods = ?,
+				callback_url = ?, manager_id = ?, updated_at = ?
+			WHERE id = ?
+		`, service.SecretKey, service.NodeID, service.Name, service.Protocol, string(authMethods),
+			service.CallbackURL, service.ManagerID, now, service.ID); err != nil {
+			return err
+		}
+
+		if service.SecretKey == "" {
+			return nil
+		}
+		// An unchanged secret keeps the key's expiry, rotation and revocation
+		_, err := tx.Exec(`
+			INSERT INTO service_auth_keys (service_id, hashed_key, revoked, created_at, updated_at)
+			VALUES (?, ?, 0, ?, ?)
+			ON CONFLICT(service_id) DO UPDATE SET `+replaceAuthKeySet+`
+			WHERE service_auth_keys.hashed_key != excluded.hashed_key
+		`, service.ID, hashAuthKey(service.SecretKey), now, now)
+		return err
+	})
+}
+
 // DeleteService deletes a service
 func (db *UserDB) DeleteService(id string) error {
 	_, err := db.Exec(`DELETE FROM services WHERE id = ?`, id)
 	return err
 }
 
+// Device operations
+
+const deviceColumns = `user_id, device_id, status, first_seen_at, last_seen_at, approved_at`
+
+func scanDevice(row rowScanner) (*domain.Device, error) {
+	device := &domain.Device{}
+	err := row.Scan(&device.UserID, &device.DeviceID, &device.Status,
+		scanTime(&device.FirstSeenAt), scanTime(&device.LastSeenAt), scanNullTime(&device.ApprovedAt))
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// GetUserDevice retrieves a device from a user's registry
+func (db *UserDB) GetUserDevice(userID, deviceID string) (*domain.Device, error) {
+	device, err := scanDevice(db.QueryRow(`SELECT `+deviceColumns+` FROM user_devices WHERE user_id = ? AND device_id = ?`, userID, deviceID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return device, err
+}
+
+// ListUserDevices retrieves a user's devices, oldest first
+func (db *UserDB) ListUserDevices(userID string) ([]*domain.Device, error) {
+	rows, err := db.reader().Query(`SELECT `+deviceColumns+` FROM user_devices WHERE user_id = ? ORDER BY first_seen_at, device_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []*domain.Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// CountApprovedDevices counts the approved devices in a user's registry
+func (db *UserDB) CountApprovedDevices(userID string) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM user_devices WHERE user_id = ? AND status = ?`,
+		userID, domain.DeviceStatusApproved).Scan(&count)
+	return count, err
+}
+
+// SeeUserDevice records that a device was seen. A new device is added with
+// the given status; a known one only has its last_seen_at moved.
+func (db *UserDB) SeeUserDevice(userID, deviceID string, status domain.DeviceStatus, at time.Time) error {
+	var approvedAt *time.Time
+	if status == domain.DeviceStatusApproved {
+		approvedAt = &at
+	}
+	_, err := db.Exec(`
+		INSERT INTO user_devices (user_id, device_id, status, first_seen_at, last_seen_at, approved_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, device_id) DO UPDATE SET last_seen_at = excluded.last_seen_at
+	`, userID, deviceID, status, at, at, approvedAt)
+	return err
+}
+
+// ApproveUserDevice marks a device approved, adding it to the registry when
+// it was never seen
+func (db *UserDB) ApproveUserDevice(userID, deviceID string, at time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO user_devices (user_id, device_id, status, first_seen_at, last_seen_at, approved_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, device_id) DO UPDATE SET status = excluded.status, approved_at = excluded.approved_at
+	`, userID, deviceID, domain.DeviceStatusApproved, at, at, at)
+	return err
+}
+
+// DeleteUserDevice removes a device from a user's registry
+func (db *UserDB) DeleteUserDevice(userID, deviceID string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM user_devices WHERE user_id = ? AND device_id = ?`, userID, deviceID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Group operations
+
+// CreateGroup creates a new group
+func (db *UserDB) CreateGroup(group *domain.Group) error {
+	nodes, _ := json.Marshal(group.AllowedNodes)
+	allowedCountries, _ := json.Marshal(group.AllowedCountries)
+	deniedCountries, _ := json.Marshal(group.DeniedCountries)
+	now := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO groups (name, total_limit, upload_limit, download_limit, max_concurrent, penalty_duration, penalty_action, allowed_nodes, allowed_countries, denied_countries, current_upload, current_download, current_total, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, group.Name, group.TotalLimit, group.UploadLimit, group.DownloadLimit, group.MaxConcurrent, group.PenaltyDuration, group.PenaltyAction, string(nodes), string(allowedCountries), string(deniedCountries),
+		group.CurrentUpload, group.CurrentDownload, group.CurrentTotal, now, now)
+	return err
+}
+
+const groupColumns = `name, total_limit, upload_limit, download_limit, max_concurrent, penalty_duration, penalty_action, allowed_nodes, allowed_countries, denied_countries, current_upload, current_download, current_total, created_at, updated_at`
+
+// scanGroup reads a row selected with groupColumns
+func scanGroup(row rowScanner) (*domain.Group, error) {
+	group := &domain.Group{}
+	var nodes, allowedCountries, deniedCountries sql.NullString
+
+	err := row.Scan(
+		&group.Name, &group.TotalLimit, &group.UploadLimit, &group.DownloadLimit, &group.MaxConcurrent, &group.PenaltyDuration, &group.PenaltyAction, &nodes, &allowedCountries, &deniedCountries,
+		&group.CurrentUpload, &group.CurrentDownload, &group.CurrentTotal,
+		scanTime(&group.CreatedAt), scanTime(&group.UpdatedAt),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if nodes.Valid {
+		json.Unmarshal([]byte(nodes.String), &group.AllowedNodes)
+	}
+	if allowedCountries.Valid {
+		json.Unmarshal([]byte(allowedCountries.String), &group.AllowedCountries)
+	}
+	if deniedCountries.Valid {
+		json.Unmarshal([]byte(deniedCountries.String), &group.DeniedCountries)
+	}
+	return group, nil
+}
+
+// GetGroup retrieves a group by name
+func (db *UserDB) GetGroup(name string) (*domain.Group, error) {
+	group, err := scanGroup(db.QueryRow(`SELECT `+groupColumns+` FROM groups WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return group, err
+}
+
+// ListGroups retrieves all groups ordered by name
+func (db *UserDB) ListGroups() ([]*domain.Group, error) {
+	return db.listGroups(`SELECT ` + groupColumns + ` FROM groups ORDER BY name`)
+}
+
+// GetGroups retrieves the named groups that exist; unknown names are skipped
+func (db *UserDB) GetGroups(names []string) ([]*domain.Group, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	placeholders, args := inPlaceholders(names)
+	return db.listGroups(`SELECT `+groupColumns+` FROM groups WHERE name IN (`+placeholders+`) ORDER BY name`, args...)
+}
+
+func (db *UserDB) listGroups(query string, args ...interface{}) ([]*domain.Group, error) {
+	rows, err := db.reader().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*domain.Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// UpdateGroup updates a group's limits; usage counters are left untouched.
+// Members are marked updated so incremental node syncs pick up the change.
+func (db *UserDB) UpdateGroup(group *domain.Group) error {
+	nodes, _ := json.Marshal(group.AllowedNodes)
+	allowedCountries, _ := json.Marshal(group.AllowedCountries)
+	deniedCountries, _ := json.Marshal(group.DeniedCountries)
+	now := time.Now()
+
+	return db.Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE groups SET total_limit = ?, upload_limit = ?, download_limit = ?, max_concurrent = ?, penalty_duration = ?, penalty_action = ?,
+				allowed_nodes = ?, allowed_countries = ?, denied_countries = ?, updated_at = ?
+			WHERE name = ?
+		`, group.TotalLimit, group.UploadLimit, group.DownloadLimit, group.MaxConcurrent, group.PenaltyDuration, group.PenaltyAction, string(nodes),
+			string(allowedCountries), string(deniedCountries), now, group.Name); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			UPDATE users SET updated_at = ?
+			WHERE EXISTS (SELECT 1 FROM json_each(users.groups) WHERE value = ?)
+		`, now, group.Name)
+		return err
+	})
+}
+
+// DeleteGroup deletes a group. Users keep the name in their groups, where it
+// no longer limits anything.
+func (db *UserDB) DeleteGroup(name string) error {
+	_, err := db.Exec(`DELETE FROM groups WHERE name = ?`, name)
+	return err
+}
+
+// ApplyGroupUsage adds usage to the counters of the named groups
+func (db *UserDB) ApplyGroupUsage(names []string, upload, download int64) error {
+	if len(names) == 0 {
+		return nil
+	}
+	placeholders, args := inPlaceholders(names)
+	_, err := db.Exec(`
+		UPDATE groups SET
+			current_upload = current_upload + ?,
+			current_download = current_download + ?,
+			current_total = current_total + ?,
+			updated_at = ?
+		WHERE name IN (`+placeholders+`)
+	`, append([]interface{}{upload, download, upload + download, time.Now()}, args...)...)
+	return err
+}
+
 func (db *UserDB) UpsertOwnerAuthKey(rawKey string) error {
 	if rawKey == "" {
 		return nil
@@ -958,34 +1668,135 @@ func (db *UserDB) UpsertOwnerAuthKey(rawKey string) error {
 	_, err := db.Exec(`
 		INSERT INTO owner_auth_key (key_id, hashed_key, revoked, created_at, updated_at)
 		VALUES (1, ?, 0, ?, ?)
-		ON CONFLICT(key_id) DO UPDATE SET
-			hashed_key = excluded.hashed_key,
-			revoked = 0,
-			updated_at = excluded.updated_at
+		ON CONFLICT(key_id) DO UPDATE SET `+replaceAuthKeySet+`
 	`, hashed, now, now)
 	return err
 }
 
+// BootstrapOwnerAuthKey generates an owner key if none has been stored yet.
+// The raw key is returned exactly once and only its hash is persisted; an
+// empty result means an owner key already exists.
+func (db *UserDB) BootstrapOwnerAuthKey() (string, error) {
+	rawKey, err := generateAuthKey()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	res, err := db.Exec(`
+		INSERT INTO owner_auth_key (key_id, hashed_key, revoked, created_at, updated_at)
+		VALUES (1, ?, 0, ?, ?)
+		ON CONFLICT(key_id) DO NOTHING
+	`, hashAuthKey(rawKey), now, now)
+	if err != nil {
+		return "", err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if inserted == 0 {
+		return "", nil
+	}
+	return rawKey, nil
+}
+
+// replaceAuthKeySet is the upsert clause installing a new owner or service
+// key, which starts without expiry, rotation overlap or recorded use
+const replaceAuthKeySet = `
+	hashed_key = excluded.hashed_key,
+	revoked = 0,
+	expires_at = NULL,
+	last_used_at = NULL,
+	previous_hashed_key = NULL,
+	previous_expires_at = NULL,
+	created_at = excluded.created_at,
+	updated_at = excluded.updated_at`
+
+// authKeyTouchInterval limits how often a key's last use is written, so a
+// busy key does not write on every request
+const authKeyTouchInterval = time.Minute
+
+const authKeyStateColumns = `hashed_key, COALESCE(previous_hashed_key, ''), revoked, expires_at, previous_expires_at, last_used_at`
+
+// authKeyState is what validating the owner key or a service key needs
+type authKeyState struct {
+	hashed            string
+	previousHashed    string
+	revoked           bool
+	expiresAt         *time.Time
+	previousExpiresAt *time.Time
+	lastUsedAt        *time.Time
+}
+
+// scanAuthKeyState reads columns selected with authKeyStateColumns after
+// any leading ones in dest
+func scanAuthKeyState(row rowScanner, state *authKeyState, dest ...interface{}) error {
+	return row.Scan(append(dest, &state.hashed, &state.previousHashed, &state.revoked,
+		scanNullTime(&state.expiresAt), scanNullTime(&state.previousExpiresAt), scanNullTime(&state.lastUsedAt))...)
+}
+
+// matches reports whether inputHash is the current key, or the key replaced
+// by the last rotation while its overlap lasts
+func (s *authKeyState) matches(inputHash string, now time.Time) bool {
+	if s.revoked {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(inputHash), []byte(s.hashed)) == 1 {
+		return s.expiresAt == nil || now.Before(*s.expiresAt)
+	}
+	return s.previousHashed != "" && s.previousExpiresAt != nil && now.Before(*s.previousExpiresAt) &&
+		subtle.ConstantTimeCompare([]byte(inputHash), []byte(s.previousHashed)) == 1
+}
+
+// usable reports whether the current key is neither revoked nor expired
+func (s *authKeyState) usable(now time.Time) bool {
+	return !s.revoked && (s.expiresAt == nil || now.Before(*s.expiresAt))
+}
+
+// touchDue reports whether the key's last use should be written
+func (s *authKeyState) touchDue(now time.Time) bool {
+	return s.lastUsedAt == nil || now.Sub(*s.lastUsedAt) >= authKeyTouchInterval
+}
+
+// HasOwnerAuthKey reports whether a non-revoked, unexpired owner key is
+// stored
+func (db *UserDB) HasOwnerAuthKey() (bool, error) {
+	var state authKeyState
+	err := scanAuthKeyState(db.QueryRow(`SELECT `+authKeyStateColumns+` FROM owner_auth_key WHERE key_id = 1`), &state)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return state.usable(time.Now()), nil
+}
+
 func (db *UserDB) ValidateOwnerAuthKey(rawKey string) (bool, error) {
 	if rawKey == "" {
 		return false, nil
 	}
 
-	var hashed string
-	var revoked int
-	err := db.QueryRow(`SELECT hashed_key, revoked FROM owner_auth_key WHERE key_id = 1`).Scan(&hashed, &revoked)
+	var state authKeyState
+	err := scanAuthKeyState(db.QueryRow(`SELECT `+authKeyStateColumns+` FROM owner_auth_key WHERE key_id = 1`), &state)
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
 	if err != nil {
 		return false, err
 	}
-	if revoked != 0 {
+
+	now := time.Now()
+	if !state.matches(hashAuthKey(rawKey), now) {
 		return false, nil
 	}
-
-	inputHash := hashAuthKey(rawKey)
-	return subtle.ConstantTimeCompare([]byte(inputHash), []byte(hashed)) == 1, nil
+	if state.touchDue(now) {
+		// Recording the last use is best effort and never fails a request
+		_, _ = db.Exec(`UPDATE owner_auth_key SET last_used_at = ? WHERE key_id = 1`, now)
+	}
+	return true, nil
 }
 
 func (db *UserDB) UpsertServiceAuthKey(serviceID, rawKey string) error {
@@ -998,10 +1809,7 @@ func (db *UserDB) UpsertServiceAuthKey(serviceID, rawKey string) error {
 	_, err := db.Exec(`
 		INSERT INTO service_auth_keys (service_id, hashed_key, revoked, created_at, updated_at)
 		VALUES (?, ?, 0, ?, ?)
-		ON CONFLICT(service_id) DO UPDATE SET
-			hashed_key = excluded.hashed_key,
-			revoked = 0,
-			updated_at = excluded.updated_at
+		ON CONFLICT(service_id) DO UPDATE SET `+replaceAuthKeySet+`
 	`, serviceID, hashed, now, now)
 	return err
 }
@@ -1011,60 +1819,342 @@ func (db *UserDB) ValidateServiceAuthKey(serviceID, rawKey string) (bool, error)
 		return false, nil
 	}
 
-	var hashed string
-	var revoked int
-	err := db.QueryRow(`SELECT hashed_key, revoked FROM service_auth_keys WHERE service_id = ?`, serviceID).Scan(&hashed, &revoked)
+	var state authKeyState
+	err := scanAuthKeyState(db.QueryRow(`SELECT `+authKeyStateColumns+` FROM service_auth_keys WHERE service_id = ?`, serviceID), &state)
 	if err == sql.ErrNoRows {
 		return false, nil
 	}
 	if err != nil {
 		return false, err
 	}
-	if revoked != 0 {
-		return false, nil
+	return state.matches(hashAuthKey(rawKey), time.Now()), nil
+}
+
+// AuthenticateServiceKey returns the service owning a usable service key,
+// or nil if no service matches. The key replaced by a rotation is accepted
+// until its overlap ends.
+func (db *UserDB) AuthenticateServiceKey(rawKey string) (*domain.Service, error) {
+	if rawKey == "" {
+		return nil, nil
 	}
 
-	inputHash := hashAuthKey(rawKey)
-	return subtle.ConstantTimeCompare([]byte(inputHash), []byte(hashed)) == 1, nil
-}
+	hashed := hashAuthKey(rawKey)
+	rows, err := db.Query(`SELECT service_id, `+authKeyStateColumns+` FROM service_auth_keys
+		WHERE revoked = 0 AND (hashed_key = ? OR previous_hashed_key = ?)`, hashed, hashed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-func hashAuthKey(raw string) string {
-	sum := sha256.Sum256([]byte(raw))
-	return hex.EncodeToString(sum[:])
+	now := time.Now()
+	var serviceID string
+	var state authKeyState
+	found := false
+	for rows.Next() && !found {
+		if err := scanAuthKeyState(rows, &state, &serviceID); err != nil {
+			return nil, err
+		}
+		found = state.matches(hashed, now)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if !found {
+		return nil, nil
+	}
+
+	if state.touchDue(now) {
+		// Recording the last use is best effort and never fails a request
+		_, _ = db.Exec(`UPDATE service_auth_keys SET last_used_at = ? WHERE service_id = ?`, now, serviceID)
+	}
+	return db.GetService(serviceID)
 }
 
-type ManagerLimitCheckResult struct {
-	Allowed   bool
-	ManagerID string
-	Reason    string
+const authKeyColumns = `revoked, expires_at, previous_expires_at, last_used_at, created_at, updated_at`
+
+// scanAuthKey reads columns selected with authKeyColumns after any leading
+// ones in dest
+func scanAuthKey(row rowScanner, key *domain.AuthKey, dest ...interface{}) error {
+	return row.Scan(append(dest, &key.Revoked, scanNullTime(&key.ExpiresAt), scanNullTime(&key.PreviousExpiresAt),
+		scanNullTime(&key.LastUsedAt), scanTime(&key.CreatedAt), scanTime(&key.UpdatedAt))...)
 }
 
-func (db *UserDB) CreateManager(manager *domain.Manager) error {
-	if manager == nil || manager.Package == nil {
-		return fmt.Errorf("manager and manager package are required")
+// ListAuthKeys describes the owner key and every service key, revoked ones
+// included
+func (db *UserDB) ListAuthKeys() ([]*domain.AuthKey, error) {
+	keys := []*domain.AuthKey{}
+
+	owner := &domain.AuthKey{Kind: domain.AuthKeyKindOwner}
+	err := scanAuthKey(db.reader().QueryRow(`SELECT `+authKeyColumns+` FROM owner_auth_key WHERE key_id = 1`), owner)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		keys = append(keys, owner)
 	}
 
-	if manager.ParentID != nil && *manager.ParentID != "" {
-		parentPkg, err := db.GetManagerPackage(*manager.ParentID)
-		if err != nil {
-			return err
-		}
-		if parentPkg == nil {
-			return fmt.Errorf("parent manager package not found")
-		}
-		if err := validateChildPackageAgainstParent(manager.Package, parentPkg); err != nil {
-			return err
+	rows, err := db.reader().Query(`SELECT service_id, ` + authKeyColumns + ` FROM service_auth_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key := &domain.AuthKey{Kind: domain.AuthKeyKindService}
+		if err := scanAuthKey(rows, key, &key.ServiceID); err != nil {
+			return nil, err
 		}
+		keys = append(keys, key)
 	}
+	return keys, rows.Err()
+}
 
-	metadata, _ := json.Marshal(manager.Metadata)
-	now := time.Now()
+// GetAuthKey describes the owner key, for an empty serviceID, or a service's
+// key. It returns nil when there is none.
+func (db *UserDB) GetAuthKey(serviceID string) (*domain.AuthKey, error) {
+	key := &domain.AuthKey{Kind: domain.AuthKeyKindOwner}
+	var err error
+	if serviceID == "" {
+		err = scanAuthKey(db.QueryRow(`SELECT `+authKeyColumns+` FROM owner_auth_key WHERE key_id = 1`), key)
+	} else {
+		key.Kind, key.ServiceID = domain.AuthKeyKindService, serviceID
+		err = scanAuthKey(db.QueryRow(`SELECT `+authKeyColumns+` FROM service_auth_keys WHERE service_id = ?`, serviceID), key)
+	}
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
 
-	return db.Transaction(func(tx *sql.Tx) error {
-		if _, err := tx.Exec(`
-			INSERT INTO managers (id, name, parent_id, metadata, created_at, updated_at)
-			VALUES (?, ?, ?, ?, ?, ?)
-		`, manager.ID, manager.Name, manager.ParentID, string(metadata), now, now); err != nil {
+// RotateOwnerAuthKey replaces the owner key with a new one, returned raw
+// exactly once. The old key keeps working for overlap, when it is neither
+// revoked nor expired, so clients can switch over. A nil expiresAt never
+// expires. The result is empty when no owner key is stored.
+func (db *UserDB) RotateOwnerAuthKey(expiresAt *time.Time, overlap time.Duration) (string, error) {
+	rawKey, err := generateAuthKey()
+	if err != nil {
+		return "", err
+	}
+
+	var rotated bool
+	err = db.Transaction(func(tx *sql.Tx) error {
+		rotated, err = rotateAuthKey(tx, "owner_auth_key", "key_id = 1", nil, rawKey, expiresAt, overlap)
+		return err
+	})
+	if err != nil || !rotated {
+		return "", err
+	}
+	return rawKey, nil
+}
+
+// RotateServiceAuthKey gives a service a new key, returned raw exactly
+// once, and stores it as the service's secret. The old key keeps working
+// for overlap, when it is neither revoked nor expired; an overlap of zero
+// replaces it at once. A nil expiresAt never expires. The result is empty
+// when the service does not exist.
+func (db *UserDB) RotateServiceAuthKey(serviceID string, expiresAt *time.Time, overlap time.Duration) (string, error) {
+	rawKey, err := generateAuthKey()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	var rotated bool
+	err = db.Transaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`UPDATE services SET secret_key = ?, updated_at = ? WHERE id = ?`, rawKey, now, serviceID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err
+		}
+
+		// A service created without a secret has no key to rotate yet
+		if _, err := tx.Exec(`
+			INSERT INTO service_auth_keys (service_id, hashed_key, revoked, created_at, updated_at)
+			VALUES (?, ?, 1, ?, ?)
+			ON CONFLICT(service_id) DO NOTHING
+		`, serviceID, hashAuthKey(rawKey), now, now); err != nil {
+			return err
+		}
+		rotated, err = rotateAuthKey(tx, "service_auth_keys", "service_id = ?", []interface{}{serviceID}, rawKey, expiresAt, overlap)
+		return err
+	})
+	if err != nil || !rotated {
+		return "", err
+	}
+	return rawKey, nil
+}
+
+// rotateAuthKey installs rawKey in the row of table matching where. The
+// current key becomes the previous one only if it is still usable and there
+// is an overlap. It reports whether the row exists.
+func rotateAuthKey(tx *sql.Tx, table, where string, args []interface{}, rawKey string, expiresAt *time.Time, overlap time.Duration) (bool, error) {
+	var state authKeyState
+	err := scanAuthKeyState(tx.QueryRow(`SELECT `+authKeyStateColumns+` FROM `+table+` WHERE `+where, args...), &state)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	var previousHashed *string
+	var previousExpiresAt *time.Time
+	if overlap > 0 && state.usable(now) {
+		until := now.Add(overlap)
+		previousHashed, previousExpiresAt = &state.hashed, &until
+	}
+	_, err = tx.Exec(`
+		UPDATE `+table+` SET hashed_key = ?, revoked = 0, expires_at = ?, last_used_at = NULL,
+			previous_hashed_key = ?, previous_expires_at = ?, created_at = ?, updated_at = ?
+		WHERE `+where,
+		append([]interface{}{hashAuthKey(rawKey), expiresAt, previousHashed, previousExpiresAt, now, now}, args...)...)
+	return err == nil, err
+}
+
+// RevokeServiceAuthKey revokes a service's key, and the key a rotation
+// replaced, reporting whether the service had a key
+func (db *UserDB) RevokeServiceAuthKey(serviceID string) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE service_auth_keys SET revoked = 1, previous_hashed_key = NULL, previous_expires_at = NULL, updated_at = ?
+		WHERE service_id = ?
+	`, time.Now(), serviceID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// generateAuthKey returns a new random raw key
+func generateAuthKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// CreateAPIKey stores a new scoped key and returns the raw key, which is not
+// kept and cannot be shown again
+func (db *UserDB) CreateAPIKey(key *domain.APIKey) (string, error) {
+	rawKey, err := generateAuthKey()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	key.CreatedAt, key.UpdatedAt = now, now
+	if _, err := db.Exec(`
+		INSERT INTO api_keys (id, name, scope, manager_id, hashed_key, revoked, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?)
+	`, key.ID, key.Name, key.Scope, key.ManagerID, hashAuthKey(rawKey), now, now); err != nil {
+		return "", err
+	}
+	return rawKey, nil
+}
+
+const apiKeyColumns = `id, name, scope, manager_id, revoked, created_at, updated_at`
+
+// scanAPIKey reads a row selected with apiKeyColumns
+func scanAPIKey(row rowScanner) (*domain.APIKey, error) {
+	key := &domain.APIKey{}
+	var managerID sql.NullString
+	err := row.Scan(&key.ID, &key.Name, &key.Scope, &managerID, &key.Revoked, scanTime(&key.CreatedAt), scanTime(&key.UpdatedAt))
+	if err != nil {
+		return nil, err
+	}
+	if managerID.Valid && managerID.String != "" {
+		key.ManagerID = &managerID.String
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns all scoped keys, revoked ones included
+func (db *UserDB) ListAPIKeys() ([]*domain.APIKey, error) {
+	rows, err := db.reader().Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*domain.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// AuthenticateAPIKey returns the non-revoked scoped key matching rawKey, or
+// nil if none matches
+func (db *UserDB) AuthenticateAPIKey(rawKey string) (*domain.APIKey, error) {
+	if rawKey == "" {
+		return nil, nil
+	}
+
+	key, err := scanAPIKey(db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE hashed_key = ? AND revoked = 0`, hashAuthKey(rawKey)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return key, err
+}
+
+// RevokeAPIKey revokes a scoped key, reporting whether it existed
+func (db *UserDB) RevokeAPIKey(id string) (bool, error) {
+	res, err := db.Exec(`UPDATE api_keys SET revoked = 1, updated_at = ? WHERE id = ?`, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func hashAuthKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+type ManagerLimitCheckResult struct {
+	Allowed   bool
+	ManagerID string
+	Reason    string
+}
+
+func (db *UserDB) CreateManager(manager *domain.Manager) error {
+	if manager == nil || manager.Package == nil {
+		return fmt.Errorf("manager and manager package are required")
+	}
+
+	if manager.ParentID != nil && *manager.ParentID != "" {
+		parentPkg, err := db.GetManagerPackage(*manager.ParentID)
+		if err != nil {
+			return err
+		}
+		if parentPkg == nil {
+			return fmt.Errorf("parent manager package not found")
+		}
+		if err := validateChildPackageAgainstParent(manager.Package, parentPkg); err != nil {
+			return fmt.Errorf("%w: %v", ErrManagerExceedsParent, err)
+		}
+	}
+
+	metadata, _ := json.Marshal(manager.Metadata)
+	now := time.Now()
+
+	return db.Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			INSERT INTO managers (id, name, parent_id, metadata, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, manager.ID, manager.Name, manager.ParentID, string(metadata), now, now); err != nil {
 			return err
 		}
 
@@ -1092,196 +2182,1008 @@ func (db *UserDB) GetManager(id string) (*domain.Manager, error) {
 	manager := &domain.Manager{}
 	var parentID sql.NullString
 	var metadata sql.NullString
-	var createdAtRaw, updatedAtRaw string
 
-	err := db.QueryRow(`
-		SELECT id, name, parent_id, metadata, created_at, updated_at
-		FROM managers
-		WHERE id = ?
-	`, id).Scan(&manager.ID, &manager.Name, &parentID, &metadata, &createdAtRaw, &updatedAtRaw)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
+	err := db.QueryRow(`
+		SELECT id, name, parent_id, metadata, created_at, updated_at
+		FROM managers
+		WHERE id = ?
+	`, id).Scan(&manager.ID, &manager.Name, &parentID, &metadata, scanTime(&manager.CreatedAt), scanTime(&manager.UpdatedAt))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if parentID.Valid {
+		manager.ParentID = &parentID.String
+	}
+	if metadata.Valid && metadata.String != "" {
+		_ = json.Unmarshal([]byte(metadata.String), &manager.Metadata)
+	}
+
+	pkg, err := db.GetManagerPackage(id)
+	if err != nil {
+		return nil, err
+	}
+	manager.Package = pkg
+
+	return manager, nil
+}
+
+// ListManagers returns every manager with its package, ordered by ID
+func (db *UserDB) ListManagers() ([]*domain.Manager, error) {
+	return db.listManagersWhere(`SELECT id FROM managers ORDER BY id`)
+}
+
+// ListManagerChildren returns the direct children of a manager with their
+// packages, ordered by ID
+func (db *UserDB) ListManagerChildren(parentID string) ([]*domain.Manager, error) {
+	return db.listManagersWhere(`SELECT id FROM managers WHERE parent_id = ? ORDER BY id`, parentID)
+}
+
+// listManagersWhere loads the managers whose IDs the query selects
+func (db *UserDB) listManagersWhere(query string, args ...interface{}) ([]*domain.Manager, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	managers := make([]*domain.Manager, 0, len(ids))
+	for _, id := range ids {
+		manager, err := db.GetManager(id)
+		if err != nil {
+			return nil, err
+		}
+		if manager != nil {
+			managers = append(managers, manager)
+		}
+	}
+	return managers, nil
+}
+
+// managerSubtreeCTE selects the IDs of a manager and all its descendants.
+// UNION rather than UNION ALL stops the recursion should the tree ever hold
+// a cycle.
+const managerSubtreeCTE = `WITH RECURSIVE subtree(id) AS (
+		SELECT id FROM managers WHERE id = ?
+		UNION
+		SELECT m.id FROM managers m JOIN subtree s ON m.parent_id = s.id
+	)`
+
+// GetManagerTree returns a manager's subtree with each manager's package and
+// user counts, or nil when the manager does not exist. The subtree and the
+// packages are read with one query each.
+func (db *UserDB) GetManagerTree(rootID string) (*domain.ManagerTreeNode, error) {
+	rows, err := db.Query(managerSubtreeCTE+`
+		SELECT m.id, m.name, m.parent_id, m.metadata, m.created_at, m.updated_at,
+			(SELECT COUNT(*) FROM users u WHERE u.manager_id = m.id),
+			(SELECT COUNT(*) FROM users u WHERE u.manager_id = m.id AND u.status = ?)
+		FROM subtree s JOIN managers m ON m.id = s.id
+		ORDER BY m.id
+	`, rootID, domain.UserStatusActive)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*domain.ManagerTreeNode)
+	var order []*domain.ManagerTreeNode
+	for rows.Next() {
+		node := &domain.ManagerTreeNode{Children: []*domain.ManagerTreeNode{}}
+		var parentID, metadata sql.NullString
+		if err := rows.Scan(&node.ID, &node.Name, &parentID, &metadata, scanTime(&node.CreatedAt), scanTime(&node.UpdatedAt),
+			&node.Users, &node.ActiveUsers); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if parentID.Valid {
+			node.ParentID = &parentID.String
+		}
+		if metadata.Valid && metadata.String != "" {
+			_ = json.Unmarshal([]byte(metadata.String), &node.Metadata)
+		}
+		nodes[node.ID] = node
+		order = append(order, node)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	root := nodes[rootID]
+	if root == nil {
+		return nil, nil
+	}
+
+	pkgRows, err := db.Query(managerSubtreeCTE+`
+		SELECT `+managerPackageColumns+` FROM manager_packages WHERE manager_id IN (SELECT id FROM subtree)
+	`, rootID)
+	if err != nil {
+		return nil, err
+	}
+	for pkgRows.Next() {
+		pkg, err := scanManagerPackage(pkgRows)
+		if err != nil {
+			pkgRows.Close()
+			return nil, err
+		}
+		if node := nodes[pkg.ManagerID]; node != nil {
+			node.Package = pkg
+		}
+	}
+	pkgRows.Close()
+	if err := pkgRows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, node := range order {
+		if node != root && node.ParentID != nil {
+			if parent := nodes[*node.ParentID]; parent != nil {
+				parent.Children = append(parent.Children, node)
+			}
+		}
+	}
+	root.Rollup()
+	return root, nil
+}
+
+// UpdateManager updates a manager's name, parent, metadata and package limits.
+// Usage counters are left untouched. The package must still fit inside the
+// parent's and hold the packages of the manager's children, and a manager
+// cannot become its own ancestor.
+func (db *UserDB) UpdateManager(manager *domain.Manager) error {
+	if manager == nil || manager.Package == nil {
+		return fmt.Errorf("manager and manager package are required")
+	}
+
+	if manager.ParentID != nil && *manager.ParentID != "" {
+		ancestors, err := db.GetManagerAncestors(*manager.ParentID)
+		if err != nil {
+			return err
+		}
+		for _, id := range ancestors {
+			if id == manager.ID {
+				return fmt.Errorf("%w: %s", ErrManagerCycle, manager.ID)
+			}
+		}
+
+		parentPkg, err := db.GetManagerPackage(*manager.ParentID)
+		if err != nil {
+			return err
+		}
+		if parentPkg == nil {
+			return fmt.Errorf("parent manager package not found")
+		}
+		if err := validateChildPackageAgainstParent(manager.Package, parentPkg); err != nil {
+			return fmt.Errorf("%w: %v", ErrManagerExceedsParent, err)
+		}
+	}
+
+	children, err := db.ListManagerChildren(manager.ID)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := validateChildPackageAgainstParent(child.Package, manager.Package); err != nil {
+			return fmt.Errorf("%w: manager %s: %v", ErrManagerExceedsParent, child.ID, err)
+		}
+	}
+
+	metadata, _ := json.Marshal(manager.Metadata)
+	now := time.Now()
+	pkg := manager.Package
+
+	return db.Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE managers SET name = ?, parent_id = ?, metadata = ?, updated_at = ? WHERE id = ?
+		`, manager.Name, manager.ParentID, string(metadata), now, manager.ID); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`
+			UPDATE manager_packages SET total_limit = ?, upload_limit = ?, download_limit = ?, reset_mode = ?,
+				duration = ?, start_at = ?, max_sessions = ?, max_online_users = ?, max_active_users = ?,
+				status = ?, updated_at = ?
+			WHERE manager_id = ?
+		`, pkg.TotalLimit, pkg.UploadLimit, pkg.DownloadLimit, pkg.ResetMode,
+			pkg.Duration, pkg.StartAt, pkg.MaxSessions, pkg.MaxOnlineUsers, pkg.MaxActiveUsers,
+			pkg.Status, now, manager.ID)
+		return err
+	})
+}
+
+var (
+	// ErrManagerExceedsParent is returned when a manager's package would not
+	// fit inside its parent's, or would no longer hold a child's
+	ErrManagerExceedsParent = errors.New("manager package exceeds parent limits")
+	// ErrManagerCycle is returned when a manager would become its own ancestor
+	ErrManagerCycle = errors.New("manager cannot be its own ancestor")
+	// ErrManagerInUse is returned when deleting a manager that still has
+	// children or owns users, nodes or services
+	ErrManagerInUse = errors.New("manager still has children, users, nodes or services")
+)
+
+// DeleteManager deletes a manager with its package and digest subscription
+// and revokes its scoped API keys. Top-ups and billing records are kept as
+// history. A
+// manager that still has children or owns users, nodes or services is left
+// in place and ErrManagerInUse is returned.
+func (db *UserDB) DeleteManager(id string) error {
+	return db.Transaction(func(tx *sql.Tx) error {
+		var inUse bool
+		if err := tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM managers WHERE parent_id = ?)
+				OR EXISTS (SELECT 1 FROM users WHERE manager_id = ?)
+				OR EXISTS (SELECT 1 FROM nodes WHERE manager_id = ?)
+				OR EXISTS (SELECT 1 FROM services WHERE manager_id = ?)
+		`, id, id, id, id).Scan(&inUse); err != nil {
+			return err
+		}
+		if inUse {
+			return ErrManagerInUse
+		}
+
+		if _, err := tx.Exec(`UPDATE api_keys SET revoked = 1, updated_at = ? WHERE manager_id = ?`, time.Now(), id); err != nil {
+			return err
+		}
+		for _, query := range []string{
+			`DELETE FROM manager_packages WHERE manager_id = ?`,
+			`DELETE FROM manager_digests WHERE manager_id = ?`,
+			`DELETE FROM managers WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const managerPackageColumns = `manager_id, total_limit, upload_limit, download_limit, reset_mode, duration, start_at,
+	max_sessions, max_online_users, max_active_users, status,
+	current_upload, current_download, current_total,
+	current_sessions, current_online_users, current_active_users,
+	created_at, updated_at`
+
+// scanManagerPackage reads a row selected with managerPackageColumns
+func scanManagerPackage(row rowScanner) (*domain.ManagerPackage, error) {
+	pkg := &domain.ManagerPackage{}
+	err := row.Scan(
+		&pkg.ManagerID, &pkg.TotalLimit, &pkg.UploadLimit, &pkg.DownloadLimit, &pkg.ResetMode, &pkg.Duration, scanNullTime(&pkg.StartAt),
+		&pkg.MaxSessions, &pkg.MaxOnlineUsers, &pkg.MaxActiveUsers, &pkg.Status,
+		&pkg.CurrentUpload, &pkg.CurrentDownload, &pkg.CurrentTotal,
+		&pkg.CurrentSessions, &pkg.CurrentOnline, &pkg.CurrentActive,
+		scanTime(&pkg.CreatedAt), scanTime(&pkg.UpdatedAt),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+func (db *UserDB) GetManagerPackage(managerID string) (*domain.ManagerPackage, error) {
+	pkg, err := scanManagerPackage(db.QueryRow(`SELECT `+managerPackageColumns+` FROM manager_packages WHERE manager_id = ?`, managerID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+func (db *UserDB) GetManagerAncestors(managerID string) ([]string, error) {
+	return managerAncestors(db, managerID)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func managerAncestors(q rowQuerier, managerID string) ([]string, error) {
+	ids := make([]string, 0, 4)
+	current := managerID
+	for current != "" {
+		ids = append(ids, current)
+		var parent sql.NullString
+		err := q.QueryRow(`SELECT parent_id FROM managers WHERE id = ?`, current).Scan(&parent)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !parent.Valid || parent.String == "" {
+			break
+		}
+		current = parent.String
+	}
+	return ids, nil
+}
+
+// managerScopeCondition builds a WHERE clause on manager_id matching rows
+// without an owner or owned by managerID or one of its ancestors
+func (db *UserDB) managerScopeCondition(managerID string) (string, []interface{}, error) {
+	chain, err := db.GetManagerAncestors(managerID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	placeholders, args := inPlaceholders(chain)
+
+	condition := "(manager_id IS NULL OR manager_id = ''"
+	if len(chain) > 0 {
+		condition += " OR manager_id IN (" + placeholders + ")"
+	}
+	return condition + ")", args, nil
+}
+
+func (db *UserDB) CheckManagerLimits(managerID string, upload, download, sessionDelta, onlineUsersDelta, activeUsersDelta int64) (*ManagerLimitCheckResult, error) {
+	if managerID == "" {
+		return &ManagerLimitCheckResult{Allowed: true}, nil
+	}
+
+	ancestors, err := db.GetManagerAncestors(managerID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ancestors {
+		pkg, err := db.GetManagerPackage(id)
+		if err != nil {
+			return nil, err
+		}
+		if pkg == nil || !pkg.IsActive() {
+			continue
+		}
+
+		projectedUpload := pkg.CurrentUpload + upload
+		projectedDownload := pkg.CurrentDownload + download
+		projectedTotal := pkg.CurrentTotal + upload + download
+		projectedSessions := pkg.CurrentSessions + sessionDelta
+		projectedOnline := pkg.CurrentOnline + onlineUsersDelta
+		projectedActive := pkg.CurrentActive + activeUsersDelta
+
+		if pkg.TotalLimit > 0 && projectedTotal > pkg.TotalLimit {
+			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager total limit reached"}, nil
+		}
+		if pkg.UploadLimit > 0 && projectedUpload > pkg.UploadLimit {
+			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager upload limit reached"}, nil
+		}
+		if pkg.DownloadLimit > 0 && projectedDownload > pkg.DownloadLimit {
+			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager download limit reached"}, nil
+		}
+		if pkg.MaxSessions > 0 && projectedSessions > int64(pkg.MaxSessions) {
+			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager max sessions reached"}, nil
+		}
+		if pkg.MaxOnlineUsers > 0 && projectedOnline > int64(pkg.MaxOnlineUsers) {
+			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager max online users reached"}, nil
+		}
+		if pkg.MaxActiveUsers > 0 && projectedActive > int64(pkg.MaxActiveUsers) {
+			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager max active users reached"}, nil
+		}
+	}
+
+	return &ManagerLimitCheckResult{Allowed: true}, nil
+}
+
+func (db *UserDB) ApplyManagerUsageDelta(managerID string, upload, download, sessionDelta, onlineUsersDelta, activeUsersDelta int64) error {
+	if managerID == "" {
+		return nil
+	}
+
+	ancestors, err := db.GetManagerAncestors(managerID)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *sql.Tx) error {
+		now := time.Now()
+		for _, id := range ancestors {
+			_, err := tx.Exec(`
+				UPDATE manager_packages
+				SET
+					current_upload = MAX(0, current_upload + ?),
+					current_download = MAX(0, current_download + ?),
+					current_total = MAX(0, current_total + ?),
+					current_sessions = MAX(0, current_sessions + ?),
+					current_online_users = MAX(0, current_online_users + ?),
+					current_active_users = MAX(0, current_active_users + ?),
+					updated_at = ?
+				WHERE manager_id = ?
+			`,
+				upload,
+				download,
+				upload+download,
+				sessionDelta,
+				onlineUsersDelta,
+				activeUsersDelta,
+				now,
+				id,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UsageDelta is the traffic one report or flush adds to the counters it
+// touches. Counters with an empty ID are skipped.
+type UsageDelta struct {
+	UserID    string
+	PackageID string
+	ManagerID string   // Charged along with its ancestors
+	Groups    []string // Names of the user's groups
+	NodeID    string
+	ServiceID string
+
+	// Charged bytes, counted against the package, managers and groups
+	Upload   int64
+	Download int64
+	// Measured bytes, counted against the node and service
+	RawUpload   int64
+	RawDownload int64
+
+	// LastConnectionAt becomes the user's last connection unless zero
+	LastConnectionAt time.Time
+}
+
+// ApplyUsage adds a usage delta to the package, manager, group, node and
+// service counters and the user's last connection in one transaction,
+// retrying while the database is busy
+func (db *UserDB) ApplyUsage(delta UsageDelta) error {
+	return db.TransactionWithRetry(func(tx *sql.Tx) error {
+		now := time.Now()
+		if delta.PackageID != "" {
+			if _, err := tx.Exec(`
+				UPDATE packages SET
+					current_upload = current_upload + ?,
+					current_download = current_download + ?,
+					current_total = current_total + ?,
+					updated_at = ?
+				WHERE id = ?
+			`, delta.Upload, delta.Download, delta.Upload+delta.Download, now, delta.PackageID); err != nil {
+				return err
+			}
+		}
+
+		if delta.ManagerID != "" {
+			ancestors, err := managerAncestors(tx, delta.ManagerID)
+			if err != nil {
+				return err
+			}
+			for _, id := range ancestors {
+				if _, err := tx.Exec(`
+					UPDATE manager_packages SET
+						current_upload = MAX(0, current_upload + ?),
+						current_download = MAX(0, current_download + ?),
+						current_total = MAX(0, current_total + ?),
+						updated_at = ?
+					WHERE manager_id = ?
+				`, delta.Upload, delta.Download, delta.Upload+delta.Download, now, id); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(delta.Groups) > 0 {
+			placeholders, args := inPlaceholders(delta.Groups)
+			if _, err := tx.Exec(`
+				UPDATE groups SET
+					current_upload = current_upload + ?,
+					current_download = current_download + ?,
+					current_total = current_total + ?,
+					updated_at = ?
+				WHERE name IN (`+placeholders+`)
+			`, append([]interface{}{delta.Upload, delta.Download, delta.Upload + delta.Download, now}, args...)...); err != nil {
+				return err
+			}
+		}
+
+		if delta.NodeID != "" {
+			if _, err := tx.Exec(`
+				UPDATE nodes SET
+					current_upload = current_upload + ?,
+					current_download = current_download + ?,
+					updated_at = ?
+				WHERE id = ?
+			`, delta.RawUpload, delta.RawDownload, now, delta.NodeID); err != nil {
+				return err
+			}
+		}
+		if delta.ServiceID != "" {
+			if _, err := tx.Exec(`
+				UPDATE services SET
+					current_upload = current_upload + ?,
+					current_download = current_download + ?,
+					updated_at = ?
+				WHERE id = ?
+			`, delta.RawUpload, delta.RawDownload, now, delta.ServiceID); err != nil {
+				return err
+			}
+		}
+
+		if delta.UserID != "" && !delta.LastConnectionAt.IsZero() {
+			if _, err := tx.Exec(`
+				UPDATE users SET last_connection_at = ?, updated_at = ? WHERE id = ?
+			`, delta.LastConnectionAt, now, delta.UserID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+var (
+	// ErrTopUpDecided is returned when a top-up request is no longer pending
+	ErrTopUpDecided = errors.New("top-up request was already decided")
+	// ErrTopUpExceedsParent is returned when approving a top-up would lift the
+	// manager's package above its parent's
+	ErrTopUpExceedsParent = errors.New("top-up exceeds parent limits")
+)
+
+// CreateManagerTopUp records a pending top-up request
+func (db *UserDB) CreateManagerTopUp(topUp *domain.ManagerTopUp) error {
+	topUp.Status = domain.TopUpStatusPending
+	topUp.CreatedAt = time.Now()
+
+	_, err := db.Exec(`
+		INSERT INTO manager_topups (
+			id, manager_id, parent_id, total_limit, upload_limit, download_limit,
+			max_sessions, max_online_users, max_active_users, note, status, requested_by, created_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, topUp.ID, topUp.ManagerID, topUp.ParentID, topUp.TotalLimit, topUp.UploadLimit, topUp.DownloadLimit,
+		topUp.MaxSessions, topUp.MaxOnlineUsers, topUp.MaxActiveUsers, topUp.Note, topUp.Status, topUp.RequestedBy, topUp.CreatedAt)
+	return err
+}
+
+const managerTopUpColumns = `id, manager_id, parent_id, total_limit, upload_limit, download_limit,
+	max_sessions, max_online_users, max_active_users, note, status, requested_by, decided_by, decision_note,
+	created_at, decided_at`
+
+// scanManagerTopUp reads a row selected with managerTopUpColumns
+func scanManagerTopUp(row rowScanner) (*domain.ManagerTopUp, error) {
+	topUp := &domain.ManagerTopUp{}
+	err := row.Scan(
+		&topUp.ID, &topUp.ManagerID, &topUp.ParentID, &topUp.TotalLimit, &topUp.UploadLimit, &topUp.DownloadLimit,
+		&topUp.MaxSessions, &topUp.MaxOnlineUsers, &topUp.MaxActiveUsers, &topUp.Note, &topUp.Status,
+		&topUp.RequestedBy, &topUp.DecidedBy, &topUp.DecisionNote,
+		scanTime(&topUp.CreatedAt), scanNullTime(&topUp.DecidedAt),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return topUp, nil
+}
+
+// GetManagerTopUp returns a top-up request by ID
+func (db *UserDB) GetManagerTopUp(id string) (*domain.ManagerTopUp, error) {
+	topUp, err := scanManagerTopUp(db.QueryRow(`SELECT `+managerTopUpColumns+` FROM manager_topups WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return topUp, err
+}
+
+// ListManagerTopUps returns the top-up requests made by managerID, or those
+// awaiting its decision when incoming is set, newest first. An empty status
+// lists every status.
+func (db *UserDB) ListManagerTopUps(managerID string, incoming bool, status domain.TopUpStatus) ([]*domain.ManagerTopUp, error) {
+	query := `SELECT ` + managerTopUpColumns + ` FROM manager_topups WHERE manager_id = ?`
+	if incoming {
+		query = `SELECT ` + managerTopUpColumns + ` FROM manager_topups WHERE parent_id = ?`
+	}
+	args := []interface{}{managerID}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY created_at DESC`
+
+	rows, err := db.reader().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	topUps := []*domain.ManagerTopUp{}
+	for rows.Next() {
+		topUp, err := scanManagerTopUp(rows)
+		if err != nil {
+			return nil, err
+		}
+		topUps = append(topUps, topUp)
+	}
+	return topUps, rows.Err()
+}
+
+// ApproveManagerTopUp approves a pending request and raises the manager's
+// package limits by the requested amounts in one transaction. Limits that
+// are unlimited (0) stay unlimited. The raised package must still fit inside
+// the parent's, otherwise nothing changes and ErrTopUpExceedsParent is
+// returned.
+func (db *UserDB) ApproveManagerTopUp(id, decidedBy, note string) (*domain.ManagerTopUp, error) {
+	var approved *domain.ManagerTopUp
+
+	err := db.Transaction(func(tx *sql.Tx) error {
+		now := time.Now()
+		res, err := tx.Exec(`
+			UPDATE manager_topups SET status = ?, decided_by = ?, decision_note = ?, decided_at = ?
+			WHERE id = ? AND status = ?
+		`, domain.TopUpStatusApproved, decidedBy, note, now, id, domain.TopUpStatusPending)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrTopUpDecided
+		}
+
+		topUp, err := scanManagerTopUp(tx.QueryRow(`SELECT `+managerTopUpColumns+` FROM manager_topups WHERE id = ?`, id))
+		if err != nil {
+			return err
+		}
+
+		pkg, err := scanManagerPackage(tx.QueryRow(`SELECT `+managerPackageColumns+` FROM manager_packages WHERE manager_id = ?`, topUp.ManagerID))
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("manager package not found")
+		}
+		if err != nil {
+			return err
+		}
+
+		raiseLimit(&pkg.TotalLimit, topUp.TotalLimit)
+		raiseLimit(&pkg.UploadLimit, topUp.UploadLimit)
+		raiseLimit(&pkg.DownloadLimit, topUp.DownloadLimit)
+		raiseIntLimit(&pkg.MaxSessions, topUp.MaxSessions)
+		raiseIntLimit(&pkg.MaxOnlineUsers, topUp.MaxOnlineUsers)
+		raiseIntLimit(&pkg.MaxActiveUsers, topUp.MaxActiveUsers)
+
+		parentPkg, err := scanManagerPackage(tx.QueryRow(`SELECT `+managerPackageColumns+` FROM manager_packages WHERE manager_id = ?`, topUp.ParentID))
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == nil {
+			if err := validateChildPackageAgainstParent(pkg, parentPkg); err != nil {
+				return fmt.Errorf("%w: %v", ErrTopUpExceedsParent, err)
+			}
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE manager_packages SET total_limit = ?, upload_limit = ?, download_limit = ?,
+				max_sessions = ?, max_online_users = ?, max_active_users = ?, updated_at = ?
+			WHERE manager_id = ?
+		`, pkg.TotalLimit, pkg.UploadLimit, pkg.DownloadLimit,
+			pkg.MaxSessions, pkg.MaxOnlineUsers, pkg.MaxActiveUsers, now, topUp.ManagerID); err != nil {
+			return err
+		}
+
+		approved = topUp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return approved, nil
+}
 
-	if parentID.Valid {
-		manager.ParentID = &parentID.String
-	}
-	if metadata.Valid && metadata.String != "" {
-		_ = json.Unmarshal([]byte(metadata.String), &manager.Metadata)
-	}
-
-	manager.CreatedAt, err = parseSQLiteTime(createdAtRaw)
+// RejectManagerTopUp rejects a pending request without touching any limits
+func (db *UserDB) RejectManagerTopUp(id, decidedBy, note string) (*domain.ManagerTopUp, error) {
+	res, err := db.Exec(`
+		UPDATE manager_topups SET status = ?, decided_by = ?, decision_note = ?, decided_at = ?
+		WHERE id = ? AND status = ?
+	`, domain.TopUpStatusRejected, decidedBy, note, time.Now(), id, domain.TopUpStatusPending)
 	if err != nil {
 		return nil, err
 	}
-	manager.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-	if err != nil {
+	if n, err := res.RowsAffected(); err != nil {
 		return nil, err
+	} else if n == 0 {
+		return nil, ErrTopUpDecided
 	}
+	return db.GetManagerTopUp(id)
+}
 
-	pkg, err := db.GetManagerPackage(id)
-	if err != nil {
-		return nil, err
+// raiseLimit adds delta to a limit unless the limit is unlimited (0)
+func raiseLimit(limit *int64, delta int64) {
+	if *limit > 0 {
+		*limit += delta
 	}
-	manager.Package = pkg
+}
 
-	return manager, nil
+func raiseIntLimit(limit *int, delta int) {
+	if *limit > 0 {
+		*limit += delta
+	}
 }
 
-func (db *UserDB) GetManagerPackage(managerID string) (*domain.ManagerPackage, error) {
-	pkg := &domain.ManagerPackage{}
-	var startAt sql.NullTime
-	var createdAtRaw, updatedAtRaw string
+// ReplaceBillingRecords replaces every record of a billing period in one
+// transaction, so regenerating a period is idempotent
+func (db *UserDB) ReplaceBillingRecords(period string, records []*domain.BillingRecord) error {
+	return db.Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM billing_records WHERE period = ?`, period); err != nil {
+			return err
+		}
 
-	err := db.QueryRow(`
-		SELECT manager_id, total_limit, upload_limit, download_limit, reset_mode, duration, start_at,
-			max_sessions, max_online_users, max_active_users, status,
-			current_upload, current_download, current_total,
-			current_sessions, current_online_users, current_active_users,
-			created_at, updated_at
-		FROM manager_packages WHERE manager_id = ?
-	`, managerID).Scan(
-		&pkg.ManagerID, &pkg.TotalLimit, &pkg.UploadLimit, &pkg.DownloadLimit, &pkg.ResetMode, &pkg.Duration, &startAt,
-		&pkg.MaxSessions, &pkg.MaxOnlineUsers, &pkg.MaxActiveUsers, &pkg.Status,
-		&pkg.CurrentUpload, &pkg.CurrentDownload, &pkg.CurrentTotal,
-		&pkg.CurrentSessions, &pkg.CurrentOnline, &pkg.CurrentActive,
-		&createdAtRaw, &updatedAtRaw,
-	)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
+		stmt, err := tx.Prepare(`
+			INSERT INTO billing_records (id, period, manager_id, user_id, username, node_group, upload, download, total, rate, amount, currency, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, r := range records {
+			if _, err := stmt.Exec(r.ID, r.Period, r.ManagerID, r.UserID, r.Username, r.NodeGroup,
+				r.Upload, r.Download, r.Total, r.Rate, r.Amount, r.Currency, r.CreatedAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const billingRecordColumns = `id, period, manager_id, user_id, username, node_group, upload, download, total, rate, amount, currency, created_at`
 
-	if startAt.Valid {
-		pkg.StartAt = &startAt.Time
+// ListBillingRecords returns a period's records ordered by manager, user and
+// node group. A non-empty managerID keeps only that manager's users.
+func (db *UserDB) ListBillingRecords(period, managerID string) ([]*domain.BillingRecord, error) {
+	query := `SELECT ` + billingRecordColumns + ` FROM billing_records WHERE period = ?`
+	args := []interface{}{period}
+	if managerID != "" {
+		query += ` AND manager_id = ?`
+		args = append(args, managerID)
 	}
-	pkg.CreatedAt, err = parseSQLiteTime(createdAtRaw)
+	query += ` ORDER BY COALESCE(manager_id, ''), username, user_id, node_group`
+
+	rows, err := db.reader().Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
-	pkg.UpdatedAt, err = parseSQLiteTime(updatedAtRaw)
-	if err != nil {
-		return nil, err
+	defer rows.Close()
+
+	records := []*domain.BillingRecord{}
+	for rows.Next() {
+		r := &domain.BillingRecord{}
+		var managerID sql.NullString
+		if err := rows.Scan(&r.ID, &r.Period, &managerID, &r.UserID, &r.Username, &r.NodeGroup,
+			&r.Upload, &r.Download, &r.Total, &r.Rate, &r.Amount, &r.Currency, scanTime(&r.CreatedAt)); err != nil {
+			return nil, err
+		}
+		if managerID.Valid && managerID.String != "" {
+			r.ManagerID = &managerID.String
+		}
+		records = append(records, r)
 	}
+	return records, rows.Err()
+}
 
-	return pkg, nil
+// HasBillingRecords reports whether a period has been generated
+func (db *UserDB) HasBillingRecords(period string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM billing_records WHERE period = ?`, period).Scan(&n)
+	return n > 0, err
 }
 
-func (db *UserDB) GetManagerAncestors(managerID string) ([]string, error) {
-	ids := make([]string, 0, 4)
-	current := managerID
-	for current != "" {
-		ids = append(ids, current)
-		var parent sql.NullString
-		err := db.QueryRow(`SELECT parent_id FROM managers WHERE id = ?`, current).Scan(&parent)
-		if err == sql.ErrNoRows {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		if !parent.Valid || parent.String == "" {
-			break
+// ErrReservationNotActive is returned when settling a reservation that was
+// already committed or expired
+var ErrReservationNotActive = errors.New("reservation is not active")
+
+// CreateReservation records a reservation and adds its amount to the
+// package's reserved bytes in one transaction
+func (db *UserDB) CreateReservation(r *domain.QuotaReservation) error {
+	return db.Transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			INSERT INTO quota_reservations (id, user_id, package_id, session_id, node_id, amount, status, expires_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, r.ID, r.UserID, r.PackageID, r.SessionID, r.NodeID, r.Amount, r.Status, r.ExpiresAt, r.CreatedAt); err != nil {
+			return err
 		}
-		current = parent.String
+		_, err := tx.Exec(`UPDATE packages SET reserved = reserved + ?, updated_at = ? WHERE id = ?`, r.Amount, time.Now(), r.PackageID)
+		return err
+	})
+}
+
+const reservationColumns = `id, user_id, package_id, session_id, node_id, amount, status, expires_at, created_at, settled_at`
+
+func scanReservation(row rowScanner) (*domain.QuotaReservation, error) {
+	r := &domain.QuotaReservation{}
+	if err := row.Scan(&r.ID, &r.UserID, &r.PackageID, &r.SessionID, &r.NodeID, &r.Amount, &r.Status,
+		scanTime(&r.ExpiresAt), scanTime(&r.CreatedAt), scanNullTime(&r.SettledAt)); err != nil {
+		return nil, err
 	}
-	return ids, nil
+	return r, nil
 }
 
-func (db *UserDB) CheckManagerLimits(managerID string, upload, download, sessionDelta, onlineUsersDelta, activeUsersDelta int64) (*ManagerLimitCheckResult, error) {
-	if managerID == "" {
-		return &ManagerLimitCheckResult{Allowed: true}, nil
+// GetReservation retrieves a reservation by ID
+func (db *UserDB) GetReservation(id string) (*domain.QuotaReservation, error) {
+	r, err := scanReservation(db.QueryRow(`SELECT `+reservationColumns+` FROM quota_reservations WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	return r, err
+}
 
-	ancestors, err := db.GetManagerAncestors(managerID)
+// ListReservations returns a user's reservations, newest first. An empty
+// status lists every status.
+func (db *UserDB) ListReservations(userID string, status domain.ReservationStatus) ([]*domain.QuotaReservation, error) {
+	query := `SELECT ` + reservationColumns + ` FROM quota_reservations WHERE user_id = ?`
+	args := []interface{}{userID}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY created_at DESC`
+
+	rows, err := db.reader().Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	for _, id := range ancestors {
-		pkg, err := db.GetManagerPackage(id)
+	reservations := []*domain.QuotaReservation{}
+	for rows.Next() {
+		r, err := scanReservation(rows)
 		if err != nil {
 			return nil, err
 		}
-		if pkg == nil || !pkg.IsActive() {
-			continue
-		}
-
-		projectedUpload := pkg.CurrentUpload + upload
-		projectedDownload := pkg.CurrentDownload + download
-		projectedTotal := pkg.CurrentTotal + upload + download
-		projectedSessions := pkg.CurrentSessions + sessionDelta
-		projectedOnline := pkg.CurrentOnline + onlineUsersDelta
-		projectedActive := pkg.CurrentActive + activeUsersDelta
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
 
-		if pkg.TotalLimit > 0 && projectedTotal > pkg.TotalLimit {
-			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager total limit reached"}, nil
+// SettleReservation moves an active reservation to status and returns its
+// amount to the package. It returns ErrReservationNotActive when the
+// reservation was already settled.
+func (db *UserDB) SettleReservation(id string, status domain.ReservationStatus) (*domain.QuotaReservation, error) {
+	var settled *domain.QuotaReservation
+	err := db.Transaction(func(tx *sql.Tx) error {
+		r, err := scanReservation(tx.QueryRow(`SELECT `+reservationColumns+` FROM quota_reservations WHERE id = ?`, id))
+		if err != nil {
+			return err
 		}
-		if pkg.UploadLimit > 0 && projectedUpload > pkg.UploadLimit {
-			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager upload limit reached"}, nil
+		if r.Status != domain.ReservationStatusActive {
+			return ErrReservationNotActive
 		}
-		if pkg.DownloadLimit > 0 && projectedDownload > pkg.DownloadLimit {
-			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager download limit reached"}, nil
+
+		if err := settleReservation(tx, r, status, time.Now()); err != nil {
+			return err
 		}
-		if pkg.MaxSessions > 0 && projectedSessions > int64(pkg.MaxSessions) {
-			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager max sessions reached"}, nil
+		settled = r
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return settled, err
+}
+
+// ExpireReservations settles every active reservation that expired before
+// now and returns how many were released
+func (db *UserDB) ExpireReservations(now time.Time) (int, error) {
+	count := 0
+	err := db.Transaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT `+reservationColumns+` FROM quota_reservations WHERE status = ? AND expires_at <= ?`,
+			domain.ReservationStatusActive, now)
+		if err != nil {
+			return err
 		}
-		if pkg.MaxOnlineUsers > 0 && projectedOnline > int64(pkg.MaxOnlineUsers) {
-			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager max online users reached"}, nil
+		expired := []*domain.QuotaReservation{}
+		for rows.Next() {
+			r, err := scanReservation(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			expired = append(expired, r)
 		}
-		if pkg.MaxActiveUsers > 0 && projectedActive > int64(pkg.MaxActiveUsers) {
-			return &ManagerLimitCheckResult{Allowed: false, ManagerID: id, Reason: "manager max active users reached"}, nil
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, r := range expired {
+			if err := settleReservation(tx, r, domain.ReservationStatusExpired, now); err != nil {
+				return err
+			}
 		}
+		count = len(expired)
+		return nil
+	})
+	return count, err
+}
+
+func settleReservation(tx *sql.Tx, r *domain.QuotaReservation, status domain.ReservationStatus, at time.Time) error {
+	if _, err := tx.Exec(`UPDATE quota_reservations SET status = ?, settled_at = ? WHERE id = ?`, status, at, r.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE packages SET reserved = MAX(0, reserved - ?), updated_at = ? WHERE id = ?`, r.Amount, at, r.PackageID); err != nil {
+		return err
 	}
+	r.Status = status
+	r.SettledAt = &at
+	return nil
+}
 
-	return &ManagerLimitCheckResult{Allowed: true}, nil
+const digestSubscriptionColumns = `manager_id, frequency, webhook_url, language, last_sent_at, updated_at`
+
+func scanDigestSubscription(row rowScanner) (*domain.DigestSubscription, error) {
+	sub := &domain.DigestSubscription{}
+	if err := row.Scan(&sub.ManagerID, &sub.Frequency, &sub.WebhookURL, &sub.Language,
+		scanNullTime(&sub.LastSentAt), scanTime(&sub.UpdatedAt)); err != nil {
+		return nil, err
+	}
+	return sub, nil
 }
 
-func (db *UserDB) ApplyManagerUsageDelta(managerID string, upload, download, sessionDelta, onlineUsersDelta, activeUsersDelta int64) error {
-	if managerID == "" {
-		return nil
+// GetDigestSubscription returns a manager's digest subscription, or nil when
+// the manager never opted in
+func (db *UserDB) GetDigestSubscription(managerID string) (*domain.DigestSubscription, error) {
+	sub, err := scanDigestSubscription(db.QueryRow(`SELECT `+digestSubscriptionColumns+` FROM manager_digests WHERE manager_id = ?`, managerID))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	return sub, err
+}
 
-	ancestors, err := db.GetManagerAncestors(managerID)
+// SaveDigestSubscription creates or replaces a manager's digest subscription,
+// keeping when the last digest was sent
+func (db *UserDB) SaveDigestSubscription(sub *domain.DigestSubscription) error {
+	sub.UpdatedAt = time.Now()
+	_, err := db.Exec(`
+		INSERT INTO manager_digests (manager_id, frequency, webhook_url, language, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(manager_id) DO UPDATE SET
+			frequency = excluded.frequency,
+			webhook_url = excluded.webhook_url,
+			language = excluded.language,
+			updated_at = excluded.updated_at
+	`, sub.ManagerID, sub.Frequency, sub.WebhookURL, sub.Language, sub.UpdatedAt)
+	return err
+}
+
+// ListDigestSubscriptions returns the subscriptions that are not turned off
+func (db *UserDB) ListDigestSubscriptions() ([]*domain.DigestSubscription, error) {
+	rows, err := db.Query(`SELECT `+digestSubscriptionColumns+` FROM manager_digests WHERE frequency != ? ORDER BY manager_id`, domain.DigestFrequencyOff)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return db.Transaction(func(tx *sql.Tx) error {
-		now := time.Now()
-		for _, id := range ancestors {
-			_, err := tx.Exec(`
-				UPDATE manager_packages
-				SET
-					current_upload = MAX(0, current_upload + ?),
-					current_download = MAX(0, current_download + ?),
-					current_total = MAX(0, current_total + ?),
-					current_sessions = MAX(0, current_sessions + ?),
-					current_online_users = MAX(0, current_online_users + ?),
-					current_active_users = MAX(0, current_active_users + ?),
-					updated_at = ?
-				WHERE manager_id = ?
-			`,
-				upload,
-				download,
-				upload+download,
-				sessionDelta,
-				onlineUsersDelta,
-				activeUsersDelta,
-				now,
-				id,
-			)
-			if err != nil {
-				return err
-			}
+	subs := []*domain.DigestSubscription{}
+	for rows.Next() {
+		sub, err := scanDigestSubscription(rows)
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	})
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// MarkDigestSent records when a manager's digest was last delivered
+func (db *UserDB) MarkDigestSent(managerID string, at time.Time) error {
+	_, err := db.Exec(`UPDATE manager_digests SET last_sent_at = ? WHERE manager_id = ?`, at, managerID)
+	return err
 }
 
 func validateChildPackageAgainstParent(child, parent *domain.ManagerPackage) error {
@@ -1321,3 +3223,99 @@ func joinConditions(conditions []string, sep string) string {
 	}
 	return result
 }
+
+// inPlaceholders returns "?, ?, ..." for an IN clause over values, with the
+// matching arguments
+func inPlaceholders(values []string) (string, []interface{}) {
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		placeholders[i] = "?"
+		args[i] = v
+	}
+	return joinConditions(placeholders, ", "), args
+}
+
+// CreatePanelCallback queues a panel callback and sets its sequence number
+func (db *UserDB) CreatePanelCallback(cb *domain.PanelCallback) error {
+	if cb.Delivery == "" {
+		cb.Delivery = domain.PanelDeliveryPending
+	}
+	res, err := db.Exec(`
+		INSERT INTO panel_callbacks (id, event_id, event_type, user_id, package_id, status, reason, occurred_at, expires_at, delivery)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, cb.ID, cb.EventID, cb.EventType, cb.UserID, cb.PackageID, cb.Status, cb.Reason, cb.OccurredAt, cb.ExpiresAt, cb.Delivery)
+	if err != nil {
+		return err
+	}
+	cb.Seq, err = res.LastInsertId()
+	return err
+}
+
+const panelCallbackColumns = `seq, id, event_id, event_type, user_id, package_id, status, reason, occurred_at, expires_at, delivery, attempts, last_error, delivered_at`
+
+func scanPanelCallback(row rowScanner) (*domain.PanelCallback, error) {
+	cb := &domain.PanelCallback{}
+	if err := row.Scan(&cb.Seq, &cb.ID, &cb.EventID, &cb.EventType, &cb.UserID, &cb.PackageID, &cb.Status, &cb.Reason,
+		scanTime(&cb.OccurredAt), scanNullTime(&cb.ExpiresAt), &cb.Delivery, &cb.Attempts, &cb.LastError, scanNullTime(&cb.DeliveredAt)); err != nil {
+		return nil, err
+	}
+	return cb, nil
+}
+
+// ListPanelCallbacks returns callbacks after the given sequence in order. An
+// empty delivery lists callbacks in any state.
+func (db *UserDB) ListPanelCallbacks(after int64, delivery domain.PanelDelivery, limit int) ([]*domain.PanelCallback, error) {
+	query := `SELECT ` + panelCallbackColumns + ` FROM panel_callbacks WHERE seq > ?`
+	args := []interface{}{after}
+	if delivery != "" {
+		query += ` AND delivery = ?`
+		args = append(args, delivery)
+	}
+	query += ` ORDER BY seq`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	callbacks := []*domain.PanelCallback{}
+	for rows.Next() {
+		cb, err := scanPanelCallback(rows)
+		if err != nil {
+			return nil, err
+		}
+		callbacks = append(callbacks, cb)
+	}
+	return callbacks, rows.Err()
+}
+
+// MarkPanelCallbackDelivered records a successful delivery
+func (db *UserDB) MarkPanelCallbackDelivered(seq int64, at time.Time) error {
+	_, err := db.Exec(`
+		UPDATE panel_callbacks SET delivery = ?, attempts = attempts + 1, last_error = '', delivered_at = ? WHERE seq = ?
+	`, domain.PanelDeliveryDelivered, at, seq)
+	return err
+}
+
+// MarkPanelCallbackFailed records a failed delivery attempt
+func (db *UserDB) MarkPanelCallbackFailed(seq int64, deliveryErr string) error {
+	_, err := db.Exec(`UPDATE panel_callbacks SET attempts = attempts + 1, last_error = ? WHERE seq = ?`, deliveryErr, seq)
+	return err
+}
+
+// RequeuePanelCallbacks marks delivered callbacks after the given sequence
+// as pending again and returns how many were requeued
+func (db *UserDB) RequeuePanelCallbacks(after int64) (int, error) {
+	res, err := db.Exec(`UPDATE panel_callbacks SET delivery = ? WHERE seq > ? AND delivery = ?`,
+		domain.PanelDeliveryPending, after, domain.PanelDeliveryDelivered)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,265 @@
+// Package tracing records spans for requests and exports them to an
+// OpenTelemetry collector over OTLP/HTTP with JSON encoding. Spans follow
+// the request context: a span started on a context with no sampled span is
+// a no-op, so instrumented code costs little while tracing is off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TraceparentHeader is the W3C Trace Context header, also read from gRPC
+// metadata
+const TraceparentHeader = "traceparent"
+
+// SpanKind tells the collector how a span relates to its peers
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Options configures a Tracer
+type Options struct {
+	// Endpoint is the collector's OTLP/HTTP base URL, e.g.
+	// http://localhost:4318; spans are posted to Endpoint/v1/traces
+	Endpoint string
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string
+	// SampleRatio is the share of new traces recorded, from 0 to 1. Traces
+	// continued from a sampled traceparent are always recorded.
+	SampleRatio float64
+	// BatchSize is how many spans are posted at once
+	BatchSize int
+	// FlushInterval bounds how long a finished span waits to be posted
+	FlushInterval time.Duration
+	// Timeout bounds each export request
+	Timeout time.Duration
+}
+
+// SpanContext identifies a span within its trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// Traceparent renders the span context as a sampled W3C traceparent
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]))
+}
+
+// ParseTraceparent reads a W3C traceparent header. sampled reports the
+// caller's sampling decision.
+func ParseTraceparent(header string) (sc SpanContext, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false, false
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return SpanContext{}, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false, false
+	}
+	return sc, flags[0]&1 == 1, true
+}
+
+// Tracer starts root spans and exports finished ones
+type Tracer struct {
+	opts     Options
+	exporter *exporter
+}
+
+// New creates a tracer; Start launches its exporter
+func New(opts Options, logger *zap.Logger) *Tracer {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "hue"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	opts.SampleRatio = math.Max(0, math.Min(1, opts.SampleRatio))
+	return &Tracer{opts: opts, exporter: newExporter(opts, logger)}
+}
+
+// Start launches the exporter
+func (t *Tracer) Start() {
+	t.exporter.start()
+}
+
+// Shutdown posts the spans still waiting and stops the exporter
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.exporter.shutdown(ctx)
+}
+
+// StartSpan starts a span under the span in ctx, or a root span continuing
+// traceparent when ctx has none. An empty traceparent starts a new trace.
+// A nil tracer or an unsampled trace returns ctx and a nil span.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind SpanKind, traceparent string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		return parent.child(ctx, name, kind)
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parentSC, sampled, ok := ParseTraceparent(traceparent); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		span.sc.TraceID = parentSC.TraceID
+		span.parentID = parentSC.SpanID
+		span.hasParent = true
+	} else {
+		if !t.sample() {
+			return ctx, nil
+		}
+		randomID(span.sc.TraceID[:])
+	}
+	randomID(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *Tracer) sample() bool {
+	switch {
+	case t.opts.SampleRatio >= 1:
+		return true
+	case t.opts.SampleRatio <= 0:
+		return false
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<53))
+	if err != nil {
+		return false
+	}
+	return float64(n.Int64())/float64(1<<53) < t.opts.SampleRatio
+}
+
+// Start starts a child of the span in ctx. Without one it returns ctx and a
+// nil span, whose methods do nothing.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.child(ctx, name, SpanKindInternal)
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span in ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Span is one timed operation. All methods are safe on a nil span.
+type Span struct {
+	tracer    *Tracer
+	name      string
+	kind      SpanKind
+	sc        SpanContext
+	parentID  [8]byte
+	hasParent bool
+	start     time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	failed bool
+	ended  bool
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+func (s *Span) child(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	span := &Span{
+		tracer:    s.tracer,
+		name:      name,
+		kind:      kind,
+		parentID:  s.sc.SpanID,
+		hasParent: true,
+		start:     time.Now(),
+	}
+	span.sc.TraceID = s.sc.TraceID
+	randomID(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Context returns the span's identifiers
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records a string, bool, integer or float attribute
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// SetError marks the span failed; a nil error is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and hands it to the exporter
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.exporter.add(s)
+}
+
+func randomID(b []byte) {
+	_, _ = rand.Read(b)
+}
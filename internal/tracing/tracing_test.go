@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, sampled, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || !sampled {
+		t.Fatalf("expected a sampled traceparent, got ok=%v sampled=%v", ok, sampled)
+	}
+	if got := sc.Traceparent(); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("unexpected round trip %q", got)
+	}
+	if _, sampled, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !ok || sampled {
+		t.Fatalf("expected an unsampled traceparent")
+	}
+	for _, bad := range []string{"", "garbage", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		if _, _, ok := ParseTraceparent(bad); ok {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestTracer_SamplesAndNestsSpans(t *testing.T) {
+	ctx := context.Background()
+	if _, span := Start(ctx, "orphan"); span != nil {
+		t.Fatalf("expected no span without a parent")
+	}
+	var nilTracer *Tracer
+	if _, span := nilTracer.StartSpan(ctx, "off", SpanKindServer, ""); span != nil {
+		t.Fatalf("expected a nil tracer to record nothing")
+	}
+
+	off := New(Options{Endpoint: "http://127.0.0.1:0", SampleRatio: 0}, zap.NewNop())
+	if _, span := off.StartSpan(ctx, "root", SpanKindServer, ""); span != nil {
+		t.Fatalf("expected a zero sample ratio to skip new traces")
+	}
+	if _, span := off.StartSpan(ctx, "root", SpanKindServer, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"); span == nil {
+		t.Fatalf("expected a sampled caller trace to be continued")
+	}
+
+	on := New(Options{Endpoint: "http://127.0.0.1:0", SampleRatio: 1}, zap.NewNop())
+	rootCtx, root := on.StartSpan(ctx, "root", SpanKindServer, "")
+	_, child := Start(rootCtx, "child")
+	if child == nil || child.Context().TraceID != root.Context().TraceID || child.parentID != root.Context().SpanID {
+		t.Fatalf("expected the child in the root's trace")
+	}
+}
@@ -0,0 +1,356 @@
+// Package huetest runs a real HUE instance inside a test process, so node
+// agents and panels can be tested against the actual gRPC and HTTP APIs
+// instead of hand-written pkg/proto mocks.
+//
+// The instance keeps all state in in-memory SQLite databases and serves both
+// protocols on one random loopback port, like hue serve does:
+//
+//	srv := huetest.New(t, huetest.Options{})
+//	fx, err := srv.Provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1 << 30})
+//	res, err := srv.Usage.ReportUsage(srv.WithAPIKey(ctx, fx.ServiceKey), ...)
+package huetest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hiddify/hue-go/internal/api/grpc"
+	httpapi "github.com/hiddify/hue-go/internal/api/http"
+	"github.com/hiddify/hue-go/internal/domain"
+	"github.com/hiddify/hue-go/internal/engine"
+	"github.com/hiddify/hue-go/internal/eventstore"
+	"github.com/hiddify/hue-go/internal/jobs"
+	"github.com/hiddify/hue-go/internal/metrics"
+	"github.com/hiddify/hue-go/internal/storage/cache"
+	"github.com/hiddify/hue-go/internal/storage/sqlite"
+	pb "github.com/hiddify/hue-go/pkg/proto"
+	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// APIKeyHeader carries the API key on HTTP requests and, lower-cased, in
+// gRPC metadata
+const APIKeyHeader = "Hue-API-Key"
+
+// Options tune the instance. The zero value is ready to use.
+type Options struct {
+	// AuthSecret is the owner API key; a random one is generated when empty
+	AuthSecret string
+	// ConcurrentWindow is how long a session counts as active after its
+	// last report (default: 5m)
+	ConcurrentWindow time.Duration
+	// PenaltyDuration is how long penalties last (default: 10m)
+	PenaltyDuration time.Duration
+	// Logger receives the instance's logs; they are discarded when nil
+	Logger *zap.Logger
+}
+
+// Server is a running HUE instance with clients connected to it
+type Server struct {
+	// Addr is the loopback host:port serving gRPC and HTTP
+	Addr string
+	// URL is the base URL of the HTTP API, e.g. http://127.0.0.1:41234
+	URL string
+	// AuthSecret is the owner API key
+	AuthSecret string
+
+	// Conn is a plaintext gRPC connection to the instance, shared by the
+	// service clients below
+	Conn  *grpclib.ClientConn
+	Admin pb.AdminServiceClient
+	Usage pb.UsageServiceClient
+	Node  pb.NodeServiceClient
+
+	lis        net.Listener
+	grpcServer *grpc.Server
+	httpServer *http.Server
+	scheduler  *jobs.Scheduler
+	dbs        []interface{ Close() error }
+	seq        atomic.Int64
+	closed     atomic.Bool
+}
+
+// New starts an instance for the test and stops it when the test ends
+func New(tb testing.TB, opts Options) *Server {
+	tb.Helper()
+
+	srv, err := Start(opts)
+	if err != nil {
+		tb.Fatalf("huetest: %v", err)
+	}
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// Start starts an instance; call Close to stop it
+func Start(opts Options) (*Server, error) {
+	if opts.AuthSecret == "" {
+		secret := make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		opts.AuthSecret = hex.EncodeToString(secret)
+	}
+	if opts.ConcurrentWindow == 0 {
+		opts.ConcurrentWindow = 5 * time.Minute
+	}
+	if opts.PenaltyDuration == 0 {
+		opts.PenaltyDuration = 10 * time.Minute
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	srv := &Server{AuthSecret: opts.AuthSecret}
+	if err := srv.start(opts, logger); err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return srv, nil
+}
+
+func (s *Server) start(opts Options, logger *zap.Logger) error {
+	userDB, err := sqlite.NewUserDB(":memory:")
+	if err != nil {
+		return fmt.Errorf("failed to initialize user database: %w", err)
+	}
+	s.dbs = append(s.dbs, userDB)
+	activeDB, err := sqlite.NewActiveDB(":memory:")
+	if err != nil {
+		return fmt.Errorf("failed to initialize active database: %w", err)
+	}
+	s.dbs = append(s.dbs, activeDB)
+	historyDB, err := sqlite.NewHistoryDB(":memory:")
+	if err != nil {
+		return fmt.Errorf("failed to initialize history database: %w", err)
+	}
+	s.dbs = append(s.dbs, historyDB)
+
+	if err := userDB.Migrate(); err != nil {
+		return fmt.Errorf("failed to run migrations: %w", err)
+	}
+	if err := userDB.UpsertOwnerAuthKey(opts.AuthSecret); err != nil {
+		return fmt.Errorf("failed to initialize owner auth key: %w", err)
+	}
+
+	memCache := cache.NewMemoryCache()
+	statsCache := cache.NewStatsCache(0)
+	eventStore, err := eventstore.New("db", historyDB)
+	if err != nil {
+		return fmt.Errorf("failed to initialize event store: %w", err)
+	}
+
+	quotaEngine := engine.NewQuotaEngine(userDB, activeDB, memCache, logger)
+	sessionManager := engine.NewSessionManager(memCache, opts.ConcurrentWindow, logger)
+	penaltyHandler := engine.NewPenaltyHandler(memCache, opts.PenaltyDuration, logger)
+	geoHandler := engine.NewStandbyGeoHandler()
+	usageEngine := engine.NewEngine(quotaEngine, sessionManager, penaltyHandler, geoHandler, eventStore, memCache, userDB, logger)
+	eventHub := eventstore.NewReceiverHub()
+	usageEngine.SetReceiverHub(eventHub)
+	hueMetrics := metrics.New()
+	usageEngine.SetMetrics(hueMetrics)
+
+	// No background jobs run, so tests stay deterministic
+	s.scheduler = jobs.NewScheduler(logger)
+	biller := engine.NewBiller(userDB, activeDB, domain.BillingRates{}, logger)
+	digester := engine.NewDigester(userDB, activeDB, historyDB, engine.NewWebhookNotifier(10*time.Second), logger)
+
+	s.grpcServer = grpc.NewServer(quotaEngine, sessionManager, penaltyHandler, geoHandler, eventStore, logger, opts.AuthSecret)
+	s.grpcServer.SetUserDB(userDB)
+	s.grpcServer.SetEngine(usageEngine)
+	s.grpcServer.SetStatsCache(statsCache)
+
+	router := httpapi.NewServer(
+		userDB,
+		activeDB,
+		historyDB,
+		quotaEngine,
+		usageEngine,
+		sessionManager,
+		penaltyHandler,
+		geoHandler,
+		statsCache,
+		s.scheduler,
+		biller,
+		digester,
+		nil,
+		eventHub,
+		eventStore,
+		hueMetrics.Registry,
+		logger,
+		opts.AuthSecret,
+		nil,
+	)
+	s.httpServer = &http.Server{Handler: router}
+
+	s.lis, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	s.Addr = s.lis.Addr().String()
+	s.URL = "http://" + s.Addr
+
+	m := cmux.New(s.lis)
+	grpcLis := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+	httpLis := m.Match(cmux.HTTP1Fast())
+	go s.grpcServer.Serve(grpcLis)
+	go s.httpServer.Serve(httpLis)
+	go m.Serve()
+
+	s.Conn, err = grpclib.NewClient(s.Addr, grpclib.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	s.Admin = pb.NewAdminServiceClient(s.Conn)
+	s.Usage = pb.NewUsageServiceClient(s.Conn)
+	s.Node = pb.NewNodeServiceClient(s.Conn)
+	return nil
+}
+
+// Close stops the servers and drops all state. It is safe to call twice.
+func (s *Server) Close() {
+	if !s.closed.CompareAndSwap(false, true) {
+		return
+	}
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.httpServer.Shutdown(ctx)
+	}
+	if s.lis != nil {
+		s.lis.Close()
+	}
+	if s.scheduler != nil {
+		s.scheduler.Stop()
+	}
+	for i := len(s.dbs) - 1; i >= 0; i-- {
+		s.dbs[i].Close()
+	}
+}
+
+// WithAPIKey attaches an API key to outgoing gRPC calls made with ctx
+func (s *Server) WithAPIKey(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "hue-api-key", key)
+}
+
+// Owner attaches the owner API key to outgoing gRPC calls made with ctx
+func (s *Server) Owner(ctx context.Context) context.Context {
+	return s.WithAPIKey(ctx, s.AuthSecret)
+}
+
+// NewRequest builds an HTTP request against the instance carrying the owner
+// API key; path is relative to URL, e.g. /api/v1/users
+func (s *Server) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(APIKeyHeader, s.AuthSecret)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// Fixture is a provisioned user with an active package, reachable through
+// one node and one service on it
+type Fixture struct {
+	UserID    string
+	Username  string
+	PackageID string
+	NodeID    string
+	NodeKey   string // Node secret key
+	ServiceID string
+	// ServiceKey authenticates the service as a node agent; pass it to
+	// WithAPIKey for usage reports
+	ServiceKey string
+}
+
+// Provision creates a node, a service on it, a user and the package
+// described by pkg, and makes the package the user's active one. pkg.UserId
+// is filled in; a nil pkg gets 1 GiB of traffic and one session.
+func (s *Server) Provision(ctx context.Context, pkg *pb.CreatePackageRequest) (*Fixture, error) {
+	ctx = s.Owner(ctx)
+	n := s.seq.Add(1)
+	fx := &Fixture{
+		Username:   fmt.Sprintf("huetest-user-%d", n),
+		NodeKey:    fmt.Sprintf("huetest-node-key-%s-%d", s.AuthSecret, n),
+		ServiceKey: fmt.Sprintf("huetest-service-key-%s-%d", s.AuthSecret, n),
+	}
+
+	node, err := s.Admin.CreateNode(ctx, &pb.CreateNodeRequest{
+		Name:      fmt.Sprintf("huetest-node-%d", n),
+		SecretKey: fx.NodeKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create node: %w", err)
+	}
+	fx.NodeID = node.Id
+
+	service, err := s.Admin.CreateService(ctx, &pb.CreateServiceRequest{
+		NodeId:    node.Id,
+		SecretKey: fx.ServiceKey,
+		Name:      fmt.Sprintf("huetest-service-%d", n),
+		Protocol:  "vless",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create service: %w", err)
+	}
+	fx.ServiceID = service.Id
+
+	user, err := s.Admin.CreateUser(ctx, &pb.CreateUserRequest{Username: fx.Username, Password: "huetest"})
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	fx.UserID = user.Id
+
+	if pkg == nil {
+		pkg = &pb.CreatePackageRequest{TotalTraffic: 1 << 30, MaxConcurrent: 1}
+	}
+	pkg.UserId = user.Id
+	created, err := s.Admin.CreatePackage(ctx, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("create package: %w", err)
+	}
+	fx.PackageID = created.Id
+
+	if _, err := s.Admin.UpdateUser(ctx, &pb.UpdateUserRequest{Id: user.Id, ActivePackageId: created.Id}); err != nil {
+		return nil, fmt.Errorf("attach package: %w", err)
+	}
+	return fx, nil
+}
+
+// Report sends one usage report for the fixture's user as its service
+func (s *Server) Report(ctx context.Context, fx *Fixture, sessionID, clientIP string, upload, download int64) (*pb.UsageReportResult, error) {
+	resp, err := s.Usage.ReportUsage(s.WithAPIKey(ctx, fx.ServiceKey), &pb.ReportUsageRequest{Report: &pb.UsageReport{
+		UserId:    fx.UserID,
+		NodeId:    fx.NodeID,
+		ServiceId: fx.ServiceID,
+		SessionId: sessionID,
+		ClientIp:  clientIP,
+		Upload:    upload,
+		Download:  download,
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,66 @@
+package huetest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	pb "github.com/hiddify/hue-go/pkg/proto"
+)
+
+func TestServer_ProvisionAndReport(t *testing.T) {
+	srv := New(t, Options{})
+	ctx := context.Background()
+
+	fx, err := srv.Provision(ctx, &pb.CreatePackageRequest{TotalTraffic: 1000, MaxConcurrent: 1})
+	if err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+
+	res, err := srv.Report(ctx, fx, "s1", "1.2.3.4", 100, 200)
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if !res.Accepted {
+		t.Fatalf("expected the report to be accepted, got %q", res.Reason)
+	}
+
+	pkg, err := srv.Admin.GetPackage(srv.Owner(ctx), &pb.GetPackageRequest{Id: fx.PackageID})
+	if err != nil {
+		t.Fatalf("get package: %v", err)
+	}
+	if pkg.CurrentUpload != 100 || pkg.CurrentDownload != 200 {
+		t.Fatalf("expected usage 100/200, got %d/%d", pkg.CurrentUpload, pkg.CurrentDownload)
+	}
+
+	res, err = srv.Report(ctx, fx, "s2", "1.2.3.4", 1000, 0)
+	if err != nil {
+		t.Fatalf("report: %v", err)
+	}
+	if res.Accepted || !res.ShouldDisconnect {
+		t.Fatalf("expected the over-quota report to be refused, got %+v", res)
+	}
+
+	req, err := srv.NewRequest(ctx, http.MethodGet, "/api/v1/users/"+fx.UserID, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 from the HTTP API, got %d", resp.StatusCode)
+	}
+}
+
+func TestServer_RejectsUnknownKey(t *testing.T) {
+	srv := New(t, Options{AuthSecret: "owner"})
+	if _, err := srv.Admin.ListNodes(srv.WithAPIKey(context.Background(), "wrong"), &pb.Empty{}); err == nil {
+		t.Fatalf("expected an unknown key to be rejected")
+	}
+	if _, err := srv.Admin.ListNodes(srv.Owner(context.Background()), &pb.Empty{}); err != nil {
+		t.Fatalf("expected the owner key to be accepted: %v", err)
+	}
+}
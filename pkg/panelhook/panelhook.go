@@ -0,0 +1,107 @@
+// Package panelhook defines the status callbacks HUE sends to the Hiddify
+// panel and how receivers verify them.
+//
+// Each callback is a JSON Callback posted with a SignatureHeader of the form
+// "t=<unix seconds>,v1=<hex HMAC-SHA256>", where the HMAC is computed with
+// the shared secret over "<t>.<body>".
+package panelhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the payload version sent in VersionHeader and Callback.Version
+const Version = "1"
+
+const (
+	// SignatureHeader carries the timestamped signature of the body
+	SignatureHeader = "Hue-Signature"
+	// VersionHeader carries the payload version
+	VersionHeader = "Hue-Callback-Version"
+)
+
+// Statuses mirrored to the panel
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusPenalized = "penalized"
+	StatusFinished  = "finished"
+	StatusExpired   = "expired"
+)
+
+var (
+	// ErrInvalidSignature is returned when the signature header is missing,
+	// malformed or does not match the body
+	ErrInvalidSignature = errors.New("invalid callback signature")
+	// ErrStaleSignature is returned when the signature is older than allowed
+	ErrStaleSignature = errors.New("callback signature too old")
+)
+
+// Callback reports a user status change. ID and Sequence stay the same
+// across retries and replays, so receivers can drop duplicates and spot gaps.
+type Callback struct {
+	Version    string     `json:"version"`
+	ID         string     `json:"id"`
+	Sequence   int64      `json:"sequence"`
+	Event      string     `json:"event"`
+	UserID     string     `json:"user_id"`
+	PackageID  string     `json:"package_id,omitempty"`
+	Status     string     `json:"status"`
+	Reason     string     `json:"reason,omitempty"`
+	OccurredAt time.Time  `json:"occurred_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // End of a penalty
+}
+
+// Sign returns the signature header value for body sent at t
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + mac(secret, ts, body)
+}
+
+// Verify checks a signature header against body. Signatures older than
+// tolerance are rejected; a zero tolerance disables the age check.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			sig = value
+		}
+	}
+	if ts == "" || sig == "" {
+		return ErrInvalidSignature
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad timestamp", ErrInvalidSignature)
+	}
+	if !hmac.Equal([]byte(sig), []byte(mac(secret, ts, body))) {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 && now.Sub(time.Unix(unix, 0)) > tolerance {
+		return ErrStaleSignature
+	}
+	return nil
+}
+
+func mac(secret, ts string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
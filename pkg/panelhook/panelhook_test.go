@@ -0,0 +1,29 @@
+package panelhook
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"version":"1","user_id":"u1","status":"suspended"}`)
+	sentAt := time.Unix(1700000000, 0)
+	header := Sign("secret", sentAt, body)
+
+	if err := Verify("secret", header, body, 5*time.Minute, sentAt.Add(time.Minute)); err != nil {
+		t.Fatalf("expected valid signature, got %v", err)
+	}
+	if err := Verify("other", header, body, 0, sentAt); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected wrong secret to fail, got %v", err)
+	}
+	if err := Verify("secret", header, []byte(`{}`), 0, sentAt); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected tampered body to fail, got %v", err)
+	}
+	if err := Verify("secret", header, body, 5*time.Minute, sentAt.Add(time.Hour)); !errors.Is(err, ErrStaleSignature) {
+		t.Fatalf("expected old signature to fail, got %v", err)
+	}
+	if err := Verify("secret", "v1=abc", body, 0, sentAt); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected malformed header to fail, got %v", err)
+	}
+}
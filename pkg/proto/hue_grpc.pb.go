@@ -15,19 +15,32 @@ import (
 
 // This is a compile-time assertion to ensure that this generated file
 // is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	UsageService_ReportUsage_FullMethodName        = "/hue.UsageService/ReportUsage"
-	UsageService_BatchReportUsage_FullMethodName   = "/hue.UsageService/BatchReportUsage"
+	UsageService_ReportUsage_FullMethodName           = "/hue.UsageService/ReportUsage"
+	UsageService_BatchReportUsage_FullMethodName      = "/hue.UsageService/BatchReportUsage"
+	UsageService_StreamUsage_FullMethodName           = "/hue.UsageService/StreamUsage"
 	UsageService_GetDisconnectCommands_FullMethodName = "/hue.UsageService/GetDisconnectCommands"
+	UsageService_SubscribeDisconnects_FullMethodName  = "/hue.UsageService/SubscribeDisconnects"
+	UsageService_AckDisconnects_FullMethodName        = "/hue.UsageService/AckDisconnects"
+	UsageService_ReserveQuota_FullMethodName          = "/hue.UsageService/ReserveQuota"
+	UsageService_CommitReservation_FullMethodName     = "/hue.UsageService/CommitReservation"
 )
 
 // UsageServiceClient is the client API for UsageService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type UsageServiceClient interface {
 	ReportUsage(ctx context.Context, in *ReportUsageRequest, opts ...grpc.CallOption) (*ReportUsageResponse, error)
 	BatchReportUsage(ctx context.Context, in *BatchReportUsageRequest, opts ...grpc.CallOption) (*BatchReportUsageResponse, error)
+	StreamUsage(ctx context.Context, opts ...grpc.CallOption) (UsageService_StreamUsageClient, error)
 	GetDisconnectCommands(ctx context.Context, in *GetDisconnectCommandsRequest, opts ...grpc.CallOption) (*GetDisconnectCommandsResponse, error)
+	SubscribeDisconnects(ctx context.Context, in *SubscribeDisconnectsRequest, opts ...grpc.CallOption) (UsageService_SubscribeDisconnectsClient, error)
+	AckDisconnects(ctx context.Context, in *AckDisconnectsRequest, opts ...grpc.CallOption) (*AckDisconnectsResponse, error)
+	ReserveQuota(ctx context.Context, in *ReserveQuotaRequest, opts ...grpc.CallOption) (*ReserveQuotaResponse, error)
+	CommitReservation(ctx context.Context, in *CommitReservationRequest, opts ...grpc.CallOption) (*ReportUsageResponse, error)
 }
 
 type usageServiceClient struct {
@@ -56,6 +69,37 @@ func (c *usageServiceClient) BatchReportUsage(ctx context.Context, in *BatchRepo
 	return out, nil
 }
 
+func (c *usageServiceClient) StreamUsage(ctx context.Context, opts ...grpc.CallOption) (UsageService_StreamUsageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UsageService_ServiceDesc.Streams[0], UsageService_StreamUsage_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &usageServiceStreamUsageClient{stream}
+	return x, nil
+}
+
+type UsageService_StreamUsageClient interface {
+	Send(*UsageReport) error
+	Recv() (*UsageReportResult, error)
+	grpc.ClientStream
+}
+
+type usageServiceStreamUsageClient struct {
+	grpc.ClientStream
+}
+
+func (x *usageServiceStreamUsageClient) Send(m *UsageReport) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *usageServiceStreamUsageClient) Recv() (*UsageReportResult, error) {
+	m := new(UsageReportResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *usageServiceClient) GetDisconnectCommands(ctx context.Context, in *GetDisconnectCommandsRequest, opts ...grpc.CallOption) (*GetDisconnectCommandsResponse, error) {
 	out := new(GetDisconnectCommandsResponse)
 	err := c.cc.Invoke(ctx, UsageService_GetDisconnectCommands_FullMethodName, in, out, opts...)
@@ -65,15 +109,83 @@ func (c *usageServiceClient) GetDisconnectCommands(ctx context.Context, in *GetD
 	return out, nil
 }
 
+func (c *usageServiceClient) SubscribeDisconnects(ctx context.Context, in *SubscribeDisconnectsRequest, opts ...grpc.CallOption) (UsageService_SubscribeDisconnectsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UsageService_ServiceDesc.Streams[1], UsageService_SubscribeDisconnects_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &usageServiceSubscribeDisconnectsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type UsageService_SubscribeDisconnectsClient interface {
+	Recv() (*DisconnectCommand, error)
+	grpc.ClientStream
+}
+
+type usageServiceSubscribeDisconnectsClient struct {
+	grpc.ClientStream
+}
+
+func (x *usageServiceSubscribeDisconnectsClient) Recv() (*DisconnectCommand, error) {
+	m := new(DisconnectCommand)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *usageServiceClient) AckDisconnects(ctx context.Context, in *AckDisconnectsRequest, opts ...grpc.CallOption) (*AckDisconnectsResponse, error) {
+	out := new(AckDisconnectsResponse)
+	err := c.cc.Invoke(ctx, UsageService_AckDisconnects_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *usageServiceClient) ReserveQuota(ctx context.Context, in *ReserveQuotaRequest, opts ...grpc.CallOption) (*ReserveQuotaResponse, error) {
+	out := new(ReserveQuotaResponse)
+	err := c.cc.Invoke(ctx, UsageService_ReserveQuota_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *usageServiceClient) CommitReservation(ctx context.Context, in *CommitReservationRequest, opts ...grpc.CallOption) (*ReportUsageResponse, error) {
+	out := new(ReportUsageResponse)
+	err := c.cc.Invoke(ctx, UsageService_CommitReservation_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // UsageServiceServer is the server API for UsageService service.
+// All implementations must embed UnimplementedUsageServiceServer
+// for forward compatibility
 type UsageServiceServer interface {
 	ReportUsage(context.Context, *ReportUsageRequest) (*ReportUsageResponse, error)
 	BatchReportUsage(context.Context, *BatchReportUsageRequest) (*BatchReportUsageResponse, error)
+	StreamUsage(UsageService_StreamUsageServer) error
 	GetDisconnectCommands(context.Context, *GetDisconnectCommandsRequest) (*GetDisconnectCommandsResponse, error)
+	SubscribeDisconnects(*SubscribeDisconnectsRequest, UsageService_SubscribeDisconnectsServer) error
+	AckDisconnects(context.Context, *AckDisconnectsRequest) (*AckDisconnectsResponse, error)
+	ReserveQuota(context.Context, *ReserveQuotaRequest) (*ReserveQuotaResponse, error)
+	CommitReservation(context.Context, *CommitReservationRequest) (*ReportUsageResponse, error)
+	mustEmbedUnimplementedUsageServiceServer()
 }
 
 // UnimplementedUsageServiceServer must be embedded to have forward compatible implementations.
-type UnimplementedUsageServiceServer struct{}
+type UnimplementedUsageServiceServer struct {
+}
 
 func (UnimplementedUsageServiceServer) ReportUsage(context.Context, *ReportUsageRequest) (*ReportUsageResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ReportUsage not implemented")
@@ -81,9 +193,32 @@ func (UnimplementedUsageServiceServer) ReportUsage(context.Context, *ReportUsage
 func (UnimplementedUsageServiceServer) BatchReportUsage(context.Context, *BatchReportUsageRequest) (*BatchReportUsageResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method BatchReportUsage not implemented")
 }
+func (UnimplementedUsageServiceServer) StreamUsage(UsageService_StreamUsageServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamUsage not implemented")
+}
 func (UnimplementedUsageServiceServer) GetDisconnectCommands(context.Context, *GetDisconnectCommandsRequest) (*GetDisconnectCommandsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetDisconnectCommands not implemented")
 }
+func (UnimplementedUsageServiceServer) SubscribeDisconnects(*SubscribeDisconnectsRequest, UsageService_SubscribeDisconnectsServer) error {
+	return status.Errorf(codes.Unimplemented, "method SubscribeDisconnects not implemented")
+}
+func (UnimplementedUsageServiceServer) AckDisconnects(context.Context, *AckDisconnectsRequest) (*AckDisconnectsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AckDisconnects not implemented")
+}
+func (UnimplementedUsageServiceServer) ReserveQuota(context.Context, *ReserveQuotaRequest) (*ReserveQuotaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReserveQuota not implemented")
+}
+func (UnimplementedUsageServiceServer) CommitReservation(context.Context, *CommitReservationRequest) (*ReportUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitReservation not implemented")
+}
+func (UnimplementedUsageServiceServer) mustEmbedUnimplementedUsageServiceServer() {}
+
+// UnsafeUsageServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UsageServiceServer will
+// result in compilation errors.
+type UnsafeUsageServiceServer interface {
+	mustEmbedUnimplementedUsageServiceServer()
+}
 
 func RegisterUsageServiceServer(s grpc.ServiceRegistrar, srv UsageServiceServer) {
 	s.RegisterService(&UsageService_ServiceDesc, srv)
@@ -125,6 +260,32 @@ func _UsageService_BatchReportUsage_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UsageService_StreamUsage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UsageServiceServer).StreamUsage(&usageServiceStreamUsageServer{stream})
+}
+
+type UsageService_StreamUsageServer interface {
+	Send(*UsageReportResult) error
+	Recv() (*UsageReport, error)
+	grpc.ServerStream
+}
+
+type usageServiceStreamUsageServer struct {
+	grpc.ServerStream
+}
+
+func (x *usageServiceStreamUsageServer) Send(m *UsageReportResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *usageServiceStreamUsageServer) Recv() (*UsageReport, error) {
+	m := new(UsageReport)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func _UsageService_GetDisconnectCommands_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(GetDisconnectCommandsRequest)
 	if err := dec(in); err != nil {
@@ -143,6 +304,84 @@ func _UsageService_GetDisconnectCommands_Handler(srv interface{}, ctx context.Co
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UsageService_SubscribeDisconnects_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeDisconnectsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UsageServiceServer).SubscribeDisconnects(m, &usageServiceSubscribeDisconnectsServer{stream})
+}
+
+type UsageService_SubscribeDisconnectsServer interface {
+	Send(*DisconnectCommand) error
+	grpc.ServerStream
+}
+
+type usageServiceSubscribeDisconnectsServer struct {
+	grpc.ServerStream
+}
+
+func (x *usageServiceSubscribeDisconnectsServer) Send(m *DisconnectCommand) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _UsageService_AckDisconnects_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AckDisconnectsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsageServiceServer).AckDisconnects(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UsageService_AckDisconnects_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsageServiceServer).AckDisconnects(ctx, req.(*AckDisconnectsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UsageService_ReserveQuota_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReserveQuotaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsageServiceServer).ReserveQuota(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UsageService_ReserveQuota_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsageServiceServer).ReserveQuota(ctx, req.(*ReserveQuotaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UsageService_CommitReservation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommitReservationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsageServiceServer).CommitReservation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: UsageService_CommitReservation_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsageServiceServer).CommitReservation(ctx, req.(*CommitReservationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// UsageService_ServiceDesc is the grpc.ServiceDesc for UsageService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
 var UsageService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "hue.UsageService",
 	HandlerType: (*UsageServiceServer)(nil),
@@ -159,8 +398,32 @@ var UsageService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetDisconnectCommands",
 			Handler:    _UsageService_GetDisconnectCommands_Handler,
 		},
+		{
+			MethodName: "AckDisconnects",
+			Handler:    _UsageService_AckDisconnects_Handler,
+		},
+		{
+			MethodName: "ReserveQuota",
+			Handler:    _UsageService_ReserveQuota_Handler,
+		},
+		{
+			MethodName: "CommitReservation",
+			Handler:    _UsageService_CommitReservation_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamUsage",
+			Handler:       _UsageService_StreamUsage_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "SubscribeDisconnects",
+			Handler:       _UsageService_SubscribeDisconnects_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/proto/hue.proto",
 }
 
@@ -170,9 +433,11 @@ const (
 	AdminService_ListUsers_FullMethodName        = "/hue.AdminService/ListUsers"
 	AdminService_UpdateUser_FullMethodName       = "/hue.AdminService/UpdateUser"
 	AdminService_DeleteUser_FullMethodName       = "/hue.AdminService/DeleteUser"
+	AdminService_DisconnectUser_FullMethodName   = "/hue.AdminService/DisconnectUser"
 	AdminService_CreatePackage_FullMethodName    = "/hue.AdminService/CreatePackage"
 	AdminService_GetPackage_FullMethodName       = "/hue.AdminService/GetPackage"
 	AdminService_GetPackageByUser_FullMethodName = "/hue.AdminService/GetPackageByUser"
+	AdminService_ListUserPackages_FullMethodName = "/hue.AdminService/ListUserPackages"
 	AdminService_DeletePackage_FullMethodName    = "/hue.AdminService/DeletePackage"
 	AdminService_CreateNode_FullMethodName       = "/hue.AdminService/CreateNode"
 	AdminService_GetNode_FullMethodName          = "/hue.AdminService/GetNode"
@@ -180,11 +445,33 @@ const (
 	AdminService_DeleteNode_FullMethodName       = "/hue.AdminService/DeleteNode"
 	AdminService_CreateService_FullMethodName    = "/hue.AdminService/CreateService"
 	AdminService_GetService_FullMethodName       = "/hue.AdminService/GetService"
+	AdminService_ListServices_FullMethodName     = "/hue.AdminService/ListServices"
+	AdminService_UpdateService_FullMethodName    = "/hue.AdminService/UpdateService"
 	AdminService_DeleteService_FullMethodName    = "/hue.AdminService/DeleteService"
+	AdminService_CreateGroup_FullMethodName      = "/hue.AdminService/CreateGroup"
+	AdminService_GetGroup_FullMethodName         = "/hue.AdminService/GetGroup"
+	AdminService_ListGroups_FullMethodName       = "/hue.AdminService/ListGroups"
+	AdminService_UpdateGroup_FullMethodName      = "/hue.AdminService/UpdateGroup"
+	AdminService_DeleteGroup_FullMethodName      = "/hue.AdminService/DeleteGroup"
+	AdminService_ListUserDevices_FullMethodName  = "/hue.AdminService/ListUserDevices"
+	AdminService_ApproveDevice_FullMethodName    = "/hue.AdminService/ApproveDevice"
+	AdminService_RemoveDevice_FullMethodName     = "/hue.AdminService/RemoveDevice"
+	AdminService_CreateManager_FullMethodName    = "/hue.AdminService/CreateManager"
+	AdminService_GetManager_FullMethodName       = "/hue.AdminService/GetManager"
+	AdminService_ListManagers_FullMethodName     = "/hue.AdminService/ListManagers"
+	AdminService_UpdateManager_FullMethodName    = "/hue.AdminService/UpdateManager"
+	AdminService_DeleteManager_FullMethodName    = "/hue.AdminService/DeleteManager"
+	AdminService_ListAuthKeys_FullMethodName     = "/hue.AdminService/ListAuthKeys"
+	AdminService_RotateOwnerKey_FullMethodName   = "/hue.AdminService/RotateOwnerKey"
+	AdminService_CreateServiceKey_FullMethodName = "/hue.AdminService/CreateServiceKey"
+	AdminService_RotateServiceKey_FullMethodName = "/hue.AdminService/RotateServiceKey"
+	AdminService_RevokeServiceKey_FullMethodName = "/hue.AdminService/RevokeServiceKey"
 	AdminService_GetEvents_FullMethodName        = "/hue.AdminService/GetEvents"
 )
 
 // AdminServiceClient is the client API for AdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type AdminServiceClient interface {
 	// User operations
 	CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*User, error)
@@ -192,10 +479,12 @@ type AdminServiceClient interface {
 	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error)
 	UpdateUser(ctx context.Context, in *UpdateUserRequest, opts ...grpc.CallOption) (*User, error)
 	DeleteUser(ctx context.Context, in *DeleteUserRequest, opts ...grpc.CallOption) (*Empty, error)
+	DisconnectUser(ctx context.Context, in *DisconnectUserRequest, opts ...grpc.CallOption) (*DisconnectUserResponse, error)
 	// Package operations
 	CreatePackage(ctx context.Context, in *CreatePackageRequest, opts ...grpc.CallOption) (*Package, error)
 	GetPackage(ctx context.Context, in *GetPackageRequest, opts ...grpc.CallOption) (*Package, error)
 	GetPackageByUser(ctx context.Context, in *GetPackageByUserRequest, opts ...grpc.CallOption) (*Package, error)
+	ListUserPackages(ctx context.Context, in *ListUserPackagesRequest, opts ...grpc.CallOption) (*ListPackagesResponse, error)
 	DeletePackage(ctx context.Context, in *DeletePackageRequest, opts ...grpc.CallOption) (*Empty, error)
 	// Node operations
 	CreateNode(ctx context.Context, in *CreateNodeRequest, opts ...grpc.CallOption) (*Node, error)
@@ -205,7 +494,31 @@ type AdminServiceClient interface {
 	// Service operations
 	CreateService(ctx context.Context, in *CreateServiceRequest, opts ...grpc.CallOption) (*Service, error)
 	GetService(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*Service, error)
+	ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error)
+	UpdateService(ctx context.Context, in *UpdateServiceRequest, opts ...grpc.CallOption) (*Service, error)
 	DeleteService(ctx context.Context, in *DeleteServiceRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Group operations
+	CreateGroup(ctx context.Context, in *CreateGroupRequest, opts ...grpc.CallOption) (*Group, error)
+	GetGroup(ctx context.Context, in *GetGroupRequest, opts ...grpc.CallOption) (*Group, error)
+	ListGroups(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListGroupsResponse, error)
+	UpdateGroup(ctx context.Context, in *UpdateGroupRequest, opts ...grpc.CallOption) (*Group, error)
+	DeleteGroup(ctx context.Context, in *DeleteGroupRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Device operations
+	ListUserDevices(ctx context.Context, in *ListUserDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error)
+	ApproveDevice(ctx context.Context, in *DeviceRequest, opts ...grpc.CallOption) (*Device, error)
+	RemoveDevice(ctx context.Context, in *DeviceRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Manager operations
+	CreateManager(ctx context.Context, in *CreateManagerRequest, opts ...grpc.CallOption) (*Manager, error)
+	GetManager(ctx context.Context, in *GetManagerRequest, opts ...grpc.CallOption) (*Manager, error)
+	ListManagers(ctx context.Context, in *ListManagersRequest, opts ...grpc.CallOption) (*ListManagersResponse, error)
+	UpdateManager(ctx context.Context, in *UpdateManagerRequest, opts ...grpc.CallOption) (*Manager, error)
+	DeleteManager(ctx context.Context, in *DeleteManagerRequest, opts ...grpc.CallOption) (*Empty, error)
+	// Auth key operations
+	ListAuthKeys(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListAuthKeysResponse, error)
+	RotateOwnerKey(ctx context.Context, in *IssueAuthKeyRequest, opts ...grpc.CallOption) (*IssuedAuthKey, error)
+	CreateServiceKey(ctx context.Context, in *IssueAuthKeyRequest, opts ...grpc.CallOption) (*IssuedAuthKey, error)
+	RotateServiceKey(ctx context.Context, in *IssueAuthKeyRequest, opts ...grpc.CallOption) (*IssuedAuthKey, error)
+	RevokeServiceKey(ctx context.Context, in *RevokeServiceKeyRequest, opts ...grpc.CallOption) (*Empty, error)
 	// Event operations
 	GetEvents(ctx context.Context, in *GetEventsRequest, opts ...grpc.CallOption) (*GetEventsResponse, error)
 }
@@ -263,6 +576,15 @@ func (c *adminServiceClient) DeleteUser(ctx context.Context, in *DeleteUserReque
 	return out, nil
 }
 
+func (c *adminServiceClient) DisconnectUser(ctx context.Context, in *DisconnectUserRequest, opts ...grpc.CallOption) (*DisconnectUserResponse, error) {
+	out := new(DisconnectUserResponse)
+	err := c.cc.Invoke(ctx, AdminService_DisconnectUser_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *adminServiceClient) CreatePackage(ctx context.Context, in *CreatePackageRequest, opts ...grpc.CallOption) (*Package, error) {
 	out := new(Package)
 	err := c.cc.Invoke(ctx, AdminService_CreatePackage_FullMethodName, in, out, opts...)
@@ -290,6 +612,15 @@ func (c *adminServiceClient) GetPackageByUser(ctx context.Context, in *GetPackag
 	return out, nil
 }
 
+func (c *adminServiceClient) ListUserPackages(ctx context.Context, in *ListUserPackagesRequest, opts ...grpc.CallOption) (*ListPackagesResponse, error) {
+	out := new(ListPackagesResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListUserPackages_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *adminServiceClient) DeletePackage(ctx context.Context, in *DeletePackageRequest, opts ...grpc.CallOption) (*Empty, error) {
 	out := new(Empty)
 	err := c.cc.Invoke(ctx, AdminService_DeletePackage_FullMethodName, in, out, opts...)
@@ -353,6 +684,24 @@ func (c *adminServiceClient) GetService(ctx context.Context, in *GetServiceReque
 	return out, nil
 }
 
+func (c *adminServiceClient) ListServices(ctx context.Context, in *ListServicesRequest, opts ...grpc.CallOption) (*ListServicesResponse, error) {
+	out := new(ListServicesResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListServices_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) UpdateService(ctx context.Context, in *UpdateServiceRequest, opts ...grpc.CallOption) (*Service, error) {
+	out := new(Service)
+	err := c.cc.Invoke(ctx, AdminService_UpdateService_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *adminServiceClient) DeleteService(ctx context.Context, in *DeleteServiceRequest, opts ...grpc.CallOption) (*Empty, error) {
 	out := new(Empty)
 	err := c.cc.Invoke(ctx, AdminService_DeleteService_FullMethodName, in, out, opts...)
@@ -362,73 +711,271 @@ func (c *adminServiceClient) DeleteService(ctx context.Context, in *DeleteServic
 	return out, nil
 }
 
-func (c *adminServiceClient) GetEvents(ctx context.Context, in *GetEventsRequest, opts ...grpc.CallOption) (*GetEventsResponse, error) {
-	out := new(GetEventsResponse)
-	err := c.cc.Invoke(ctx, AdminService_GetEvents_FullMethodName, in, out, opts...)
+func (c *adminServiceClient) CreateGroup(ctx context.Context, in *CreateGroupRequest, opts ...grpc.CallOption) (*Group, error) {
+	out := new(Group)
+	err := c.cc.Invoke(ctx, AdminService_CreateGroup_FullMethodName, in, out, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
-// AdminServiceServer is the server API for AdminService service.
-type AdminServiceServer interface {
-	// User operations
-	CreateUser(context.Context, *CreateUserRequest) (*User, error)
-	GetUser(context.Context, *GetUserRequest) (*User, error)
-	ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error)
-	UpdateUser(context.Context, *UpdateUserRequest) (*User, error)
-	DeleteUser(context.Context, *DeleteUserRequest) (*Empty, error)
-	// Package operations
-	CreatePackage(context.Context, *CreatePackageRequest) (*Package, error)
-	GetPackage(context.Context, *GetPackageRequest) (*Package, error)
-	GetPackageByUser(context.Context, *GetPackageByUserRequest) (*Package, error)
-	DeletePackage(context.Context, *DeletePackageRequest) (*Empty, error)
-	// Node operations
-	CreateNode(context.Context, *CreateNodeRequest) (*Node, error)
-	GetNode(context.Context, *GetNodeRequest) (*Node, error)
-	ListNodes(context.Context, *Empty) (*ListNodesResponse, error)
-	DeleteNode(context.Context, *DeleteNodeRequest) (*Empty, error)
-	// Service operations
-	CreateService(context.Context, *CreateServiceRequest) (*Service, error)
-	GetService(context.Context, *GetServiceRequest) (*Service, error)
-	DeleteService(context.Context, *DeleteServiceRequest) (*Empty, error)
-	// Event operations
-	GetEvents(context.Context, *GetEventsRequest) (*GetEventsResponse, error)
+func (c *adminServiceClient) GetGroup(ctx context.Context, in *GetGroupRequest, opts ...grpc.CallOption) (*Group, error) {
+	out := new(Group)
+	err := c.cc.Invoke(ctx, AdminService_GetGroup_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
 
-// UnimplementedAdminServiceServer must be embedded to have forward compatible implementations.
-type UnimplementedAdminServiceServer struct{}
-
-func (UnimplementedAdminServiceServer) CreateUser(context.Context, *CreateUserRequest) (*User, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method CreateUser not implemented")
-}
-func (UnimplementedAdminServiceServer) GetUser(context.Context, *GetUserRequest) (*User, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+func (c *adminServiceClient) ListGroups(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListGroupsResponse, error) {
+	out := new(ListGroupsResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListGroups_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+
+func (c *adminServiceClient) UpdateGroup(ctx context.Context, in *UpdateGroupRequest, opts ...grpc.CallOption) (*Group, error) {
+	out := new(Group)
+	err := c.cc.Invoke(ctx, AdminService_UpdateGroup_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) UpdateUser(context.Context, *UpdateUserRequest) (*User, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method UpdateUser not implemented")
+
+func (c *adminServiceClient) DeleteGroup(ctx context.Context, in *DeleteGroupRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, AdminService_DeleteGroup_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) DeleteUser(context.Context, *DeleteUserRequest) (*Empty, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method DeleteUser not implemented")
+
+func (c *adminServiceClient) ListUserDevices(ctx context.Context, in *ListUserDevicesRequest, opts ...grpc.CallOption) (*ListDevicesResponse, error) {
+	out := new(ListDevicesResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListUserDevices_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) CreatePackage(context.Context, *CreatePackageRequest) (*Package, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method CreatePackage not implemented")
+
+func (c *adminServiceClient) ApproveDevice(ctx context.Context, in *DeviceRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, AdminService_ApproveDevice_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) GetPackage(context.Context, *GetPackageRequest) (*Package, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetPackage not implemented")
+
+func (c *adminServiceClient) RemoveDevice(ctx context.Context, in *DeviceRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, AdminService_RemoveDevice_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) GetPackageByUser(context.Context, *GetPackageByUserRequest) (*Package, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method GetPackageByUser not implemented")
+
+func (c *adminServiceClient) CreateManager(ctx context.Context, in *CreateManagerRequest, opts ...grpc.CallOption) (*Manager, error) {
+	out := new(Manager)
+	err := c.cc.Invoke(ctx, AdminService_CreateManager_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) DeletePackage(context.Context, *DeletePackageRequest) (*Empty, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method DeletePackage not implemented")
+
+func (c *adminServiceClient) GetManager(ctx context.Context, in *GetManagerRequest, opts ...grpc.CallOption) (*Manager, error) {
+	out := new(Manager)
+	err := c.cc.Invoke(ctx, AdminService_GetManager_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
 }
-func (UnimplementedAdminServiceServer) CreateNode(context.Context, *CreateNodeRequest) (*Node, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method CreateNode not implemented")
+
+func (c *adminServiceClient) ListManagers(ctx context.Context, in *ListManagersRequest, opts ...grpc.CallOption) (*ListManagersResponse, error) {
+	out := new(ListManagersResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListManagers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) UpdateManager(ctx context.Context, in *UpdateManagerRequest, opts ...grpc.CallOption) (*Manager, error) {
+	out := new(Manager)
+	err := c.cc.Invoke(ctx, AdminService_UpdateManager_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) DeleteManager(ctx context.Context, in *DeleteManagerRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, AdminService_DeleteManager_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) ListAuthKeys(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListAuthKeysResponse, error) {
+	out := new(ListAuthKeysResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListAuthKeys_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) RotateOwnerKey(ctx context.Context, in *IssueAuthKeyRequest, opts ...grpc.CallOption) (*IssuedAuthKey, error) {
+	out := new(IssuedAuthKey)
+	err := c.cc.Invoke(ctx, AdminService_RotateOwnerKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) CreateServiceKey(ctx context.Context, in *IssueAuthKeyRequest, opts ...grpc.CallOption) (*IssuedAuthKey, error) {
+	out := new(IssuedAuthKey)
+	err := c.cc.Invoke(ctx, AdminService_CreateServiceKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) RotateServiceKey(ctx context.Context, in *IssueAuthKeyRequest, opts ...grpc.CallOption) (*IssuedAuthKey, error) {
+	out := new(IssuedAuthKey)
+	err := c.cc.Invoke(ctx, AdminService_RotateServiceKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) RevokeServiceKey(ctx context.Context, in *RevokeServiceKeyRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, AdminService_RevokeServiceKey_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetEvents(ctx context.Context, in *GetEventsRequest, opts ...grpc.CallOption) (*GetEventsResponse, error) {
+	out := new(GetEventsResponse)
+	err := c.cc.Invoke(ctx, AdminService_GetEvents_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServiceServer is the server API for AdminService service.
+// All implementations must embed UnimplementedAdminServiceServer
+// for forward compatibility
+type AdminServiceServer interface {
+	// User operations
+	CreateUser(context.Context, *CreateUserRequest) (*User, error)
+	GetUser(context.Context, *GetUserRequest) (*User, error)
+	ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error)
+	UpdateUser(context.Context, *UpdateUserRequest) (*User, error)
+	DeleteUser(context.Context, *DeleteUserRequest) (*Empty, error)
+	DisconnectUser(context.Context, *DisconnectUserRequest) (*DisconnectUserResponse, error)
+	// Package operations
+	CreatePackage(context.Context, *CreatePackageRequest) (*Package, error)
+	GetPackage(context.Context, *GetPackageRequest) (*Package, error)
+	GetPackageByUser(context.Context, *GetPackageByUserRequest) (*Package, error)
+	ListUserPackages(context.Context, *ListUserPackagesRequest) (*ListPackagesResponse, error)
+	DeletePackage(context.Context, *DeletePackageRequest) (*Empty, error)
+	// Node operations
+	CreateNode(context.Context, *CreateNodeRequest) (*Node, error)
+	GetNode(context.Context, *GetNodeRequest) (*Node, error)
+	ListNodes(context.Context, *Empty) (*ListNodesResponse, error)
+	DeleteNode(context.Context, *DeleteNodeRequest) (*Empty, error)
+	// Service operations
+	CreateService(context.Context, *CreateServiceRequest) (*Service, error)
+	GetService(context.Context, *GetServiceRequest) (*Service, error)
+	ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error)
+	UpdateService(context.Context, *UpdateServiceRequest) (*Service, error)
+	DeleteService(context.Context, *DeleteServiceRequest) (*Empty, error)
+	// Group operations
+	CreateGroup(context.Context, *CreateGroupRequest) (*Group, error)
+	GetGroup(context.Context, *GetGroupRequest) (*Group, error)
+	ListGroups(context.Context, *Empty) (*ListGroupsResponse, error)
+	UpdateGroup(context.Context, *UpdateGroupRequest) (*Group, error)
+	DeleteGroup(context.Context, *DeleteGroupRequest) (*Empty, error)
+	// Device operations
+	ListUserDevices(context.Context, *ListUserDevicesRequest) (*ListDevicesResponse, error)
+	ApproveDevice(context.Context, *DeviceRequest) (*Device, error)
+	RemoveDevice(context.Context, *DeviceRequest) (*Empty, error)
+	// Manager operations
+	CreateManager(context.Context, *CreateManagerRequest) (*Manager, error)
+	GetManager(context.Context, *GetManagerRequest) (*Manager, error)
+	ListManagers(context.Context, *ListManagersRequest) (*ListManagersResponse, error)
+	UpdateManager(context.Context, *UpdateManagerRequest) (*Manager, error)
+	DeleteManager(context.Context, *DeleteManagerRequest) (*Empty, error)
+	// Auth key operations
+	ListAuthKeys(context.Context, *Empty) (*ListAuthKeysResponse, error)
+	RotateOwnerKey(context.Context, *IssueAuthKeyRequest) (*IssuedAuthKey, error)
+	CreateServiceKey(context.Context, *IssueAuthKeyRequest) (*IssuedAuthKey, error)
+	RotateServiceKey(context.Context, *IssueAuthKeyRequest) (*IssuedAuthKey, error)
+	RevokeServiceKey(context.Context, *RevokeServiceKeyRequest) (*Empty, error)
+	// Event operations
+	GetEvents(context.Context, *GetEventsRequest) (*GetEventsResponse, error)
+	mustEmbedUnimplementedAdminServiceServer()
+}
+
+// UnimplementedAdminServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServiceServer struct {
+}
+
+func (UnimplementedAdminServiceServer) CreateUser(context.Context, *CreateUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateUser not implemented")
+}
+func (UnimplementedAdminServiceServer) GetUser(context.Context, *GetUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedAdminServiceServer) ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (UnimplementedAdminServiceServer) UpdateUser(context.Context, *UpdateUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateUser not implemented")
+}
+func (UnimplementedAdminServiceServer) DeleteUser(context.Context, *DeleteUserRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUser not implemented")
+}
+func (UnimplementedAdminServiceServer) DisconnectUser(context.Context, *DisconnectUserRequest) (*DisconnectUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DisconnectUser not implemented")
+}
+func (UnimplementedAdminServiceServer) CreatePackage(context.Context, *CreatePackageRequest) (*Package, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreatePackage not implemented")
+}
+func (UnimplementedAdminServiceServer) GetPackage(context.Context, *GetPackageRequest) (*Package, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPackage not implemented")
+}
+func (UnimplementedAdminServiceServer) GetPackageByUser(context.Context, *GetPackageByUserRequest) (*Package, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPackageByUser not implemented")
+}
+func (UnimplementedAdminServiceServer) ListUserPackages(context.Context, *ListUserPackagesRequest) (*ListPackagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUserPackages not implemented")
+}
+func (UnimplementedAdminServiceServer) DeletePackage(context.Context, *DeletePackageRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeletePackage not implemented")
+}
+func (UnimplementedAdminServiceServer) CreateNode(context.Context, *CreateNodeRequest) (*Node, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateNode not implemented")
 }
 func (UnimplementedAdminServiceServer) GetNode(context.Context, *GetNodeRequest) (*Node, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetNode not implemented")
@@ -445,12 +992,80 @@ func (UnimplementedAdminServiceServer) CreateService(context.Context, *CreateSer
 func (UnimplementedAdminServiceServer) GetService(context.Context, *GetServiceRequest) (*Service, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetService not implemented")
 }
+func (UnimplementedAdminServiceServer) ListServices(context.Context, *ListServicesRequest) (*ListServicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListServices not implemented")
+}
+func (UnimplementedAdminServiceServer) UpdateService(context.Context, *UpdateServiceRequest) (*Service, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateService not implemented")
+}
 func (UnimplementedAdminServiceServer) DeleteService(context.Context, *DeleteServiceRequest) (*Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method DeleteService not implemented")
 }
+func (UnimplementedAdminServiceServer) CreateGroup(context.Context, *CreateGroupRequest) (*Group, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateGroup not implemented")
+}
+func (UnimplementedAdminServiceServer) GetGroup(context.Context, *GetGroupRequest) (*Group, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetGroup not implemented")
+}
+func (UnimplementedAdminServiceServer) ListGroups(context.Context, *Empty) (*ListGroupsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListGroups not implemented")
+}
+func (UnimplementedAdminServiceServer) UpdateGroup(context.Context, *UpdateGroupRequest) (*Group, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateGroup not implemented")
+}
+func (UnimplementedAdminServiceServer) DeleteGroup(context.Context, *DeleteGroupRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteGroup not implemented")
+}
+func (UnimplementedAdminServiceServer) ListUserDevices(context.Context, *ListUserDevicesRequest) (*ListDevicesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUserDevices not implemented")
+}
+func (UnimplementedAdminServiceServer) ApproveDevice(context.Context, *DeviceRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApproveDevice not implemented")
+}
+func (UnimplementedAdminServiceServer) RemoveDevice(context.Context, *DeviceRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveDevice not implemented")
+}
+func (UnimplementedAdminServiceServer) CreateManager(context.Context, *CreateManagerRequest) (*Manager, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateManager not implemented")
+}
+func (UnimplementedAdminServiceServer) GetManager(context.Context, *GetManagerRequest) (*Manager, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetManager not implemented")
+}
+func (UnimplementedAdminServiceServer) ListManagers(context.Context, *ListManagersRequest) (*ListManagersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListManagers not implemented")
+}
+func (UnimplementedAdminServiceServer) UpdateManager(context.Context, *UpdateManagerRequest) (*Manager, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateManager not implemented")
+}
+func (UnimplementedAdminServiceServer) DeleteManager(context.Context, *DeleteManagerRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteManager not implemented")
+}
+func (UnimplementedAdminServiceServer) ListAuthKeys(context.Context, *Empty) (*ListAuthKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAuthKeys not implemented")
+}
+func (UnimplementedAdminServiceServer) RotateOwnerKey(context.Context, *IssueAuthKeyRequest) (*IssuedAuthKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateOwnerKey not implemented")
+}
+func (UnimplementedAdminServiceServer) CreateServiceKey(context.Context, *IssueAuthKeyRequest) (*IssuedAuthKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateServiceKey not implemented")
+}
+func (UnimplementedAdminServiceServer) RotateServiceKey(context.Context, *IssueAuthKeyRequest) (*IssuedAuthKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateServiceKey not implemented")
+}
+func (UnimplementedAdminServiceServer) RevokeServiceKey(context.Context, *RevokeServiceKeyRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeServiceKey not implemented")
+}
 func (UnimplementedAdminServiceServer) GetEvents(context.Context, *GetEventsRequest) (*GetEventsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetEvents not implemented")
 }
+func (UnimplementedAdminServiceServer) mustEmbedUnimplementedAdminServiceServer() {}
+
+// UnsafeAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServiceServer will
+// result in compilation errors.
+type UnsafeAdminServiceServer interface {
+	mustEmbedUnimplementedAdminServiceServer()
+}
 
 func RegisterAdminServiceServer(s grpc.ServiceRegistrar, srv AdminServiceServer) {
 	s.RegisterService(&AdminService_ServiceDesc, srv)
@@ -546,6 +1161,24 @@ func _AdminService_DeleteUser_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AdminService_DisconnectUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DisconnectUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).DisconnectUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_DisconnectUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).DisconnectUser(ctx, req.(*DisconnectUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _AdminService_CreatePackage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(CreatePackageRequest)
 	if err := dec(in); err != nil {
@@ -600,6 +1233,24 @@ func _AdminService_GetPackageByUser_Handler(srv interface{}, ctx context.Context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AdminService_ListUserPackages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUserPackagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListUserPackages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListUserPackages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListUserPackages(ctx, req.(*ListUserPackagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _AdminService_DeletePackage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(DeletePackageRequest)
 	if err := dec(in); err != nil {
@@ -726,163 +1377,847 @@ func _AdminService_GetService_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
-func _AdminService_DeleteService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(DeleteServiceRequest)
+func _AdminService_ListServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListServicesRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(AdminServiceServer).DeleteService(ctx, in)
+		return srv.(AdminServiceServer).ListServices(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: AdminService_DeleteService_FullMethodName,
+		FullMethod: AdminService_ListServices_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(AdminServiceServer).DeleteService(ctx, req.(*DeleteServiceRequest))
+		return srv.(AdminServiceServer).ListServices(ctx, req.(*ListServicesRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _AdminService_GetEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(GetEventsRequest)
+func _AdminService_UpdateService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateServiceRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(AdminServiceServer).GetEvents(ctx, in)
+		return srv.(AdminServiceServer).UpdateService(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: AdminService_GetEvents_FullMethodName,
+		FullMethod: AdminService_UpdateService_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(AdminServiceServer).GetEvents(ctx, req.(*GetEventsRequest))
+		return srv.(AdminServiceServer).UpdateService(ctx, req.(*UpdateServiceRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-var AdminService_ServiceDesc = grpc.ServiceDesc{
-	ServiceName: "hue.AdminService",
-	HandlerType: (*AdminServiceServer)(nil),
-	Methods: []grpc.MethodDesc{
-		{MethodName: "CreateUser", Handler: _AdminService_CreateUser_Handler},
-		{MethodName: "GetUser", Handler: _AdminService_GetUser_Handler},
-		{MethodName: "ListUsers", Handler: _AdminService_ListUsers_Handler},
-		{MethodName: "UpdateUser", Handler: _AdminService_UpdateUser_Handler},
-		{MethodName: "DeleteUser", Handler: _AdminService_DeleteUser_Handler},
-		{MethodName: "CreatePackage", Handler: _AdminService_CreatePackage_Handler},
-		{MethodName: "GetPackage", Handler: _AdminService_GetPackage_Handler},
-		{MethodName: "GetPackageByUser", Handler: _AdminService_GetPackageByUser_Handler},
-		{MethodName: "DeletePackage", Handler: _AdminService_DeletePackage_Handler},
-		{MethodName: "CreateNode", Handler: _AdminService_CreateNode_Handler},
-		{MethodName: "GetNode", Handler: _AdminService_GetNode_Handler},
-		{MethodName: "ListNodes", Handler: _AdminService_ListNodes_Handler},
-		{MethodName: "DeleteNode", Handler: _AdminService_DeleteNode_Handler},
-		{MethodName: "CreateService", Handler: _AdminService_CreateService_Handler},
-		{MethodName: "GetService", Handler: _AdminService_GetService_Handler},
-		{MethodName: "DeleteService", Handler: _AdminService_DeleteService_Handler},
-		{MethodName: "GetEvents", Handler: _AdminService_GetEvents_Handler},
-	},
-	Streams:  []grpc.StreamDesc{},
-	Metadata: "pkg/proto/hue.proto",
-}
-
-const (
-	NodeService_Authenticate_FullMethodName = "/hue.NodeService/Authenticate"
-	NodeService_Heartbeat_FullMethodName    = "/hue.NodeService/Heartbeat"
-)
-
-// NodeServiceClient is the client API for NodeService service.
-type NodeServiceClient interface {
-	Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error)
-	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error)
-}
-
-type nodeServiceClient struct {
-	cc grpc.ClientConnInterface
-}
-
-func NewNodeServiceClient(cc grpc.ClientConnInterface) NodeServiceClient {
-	return &nodeServiceClient{cc}
-}
-
-func (c *nodeServiceClient) Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error) {
-	out := new(AuthenticateResponse)
-	err := c.cc.Invoke(ctx, NodeService_Authenticate_FullMethodName, in, out, opts...)
-	if err != nil {
+func _AdminService_DeleteService_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteServiceRequest)
+	if err := dec(in); err != nil {
 		return nil, err
 	}
-	return out, nil
-}
-
-func (c *nodeServiceClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
-	out := new(HeartbeatResponse)
-	err := c.cc.Invoke(ctx, NodeService_Heartbeat_FullMethodName, in, out, opts...)
-	if err != nil {
-		return nil, err
+	if interceptor == nil {
+		return srv.(AdminServiceServer).DeleteService(ctx, in)
 	}
-	return out, nil
-}
-
-// NodeServiceServer is the server API for NodeService service.
-type NodeServiceServer interface {
-	Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error)
-	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
-}
-
-// UnimplementedNodeServiceServer must be embedded to have forward compatible implementations.
-type UnimplementedNodeServiceServer struct{}
-
-func (UnimplementedNodeServiceServer) Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method Authenticate not implemented")
-}
-func (UnimplementedNodeServiceServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
-}
-
-func RegisterNodeServiceServer(s grpc.ServiceRegistrar, srv NodeServiceServer) {
-	s.RegisterService(&NodeService_ServiceDesc, srv)
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_DeleteService_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).DeleteService(ctx, req.(*DeleteServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
 }
 
-func _NodeService_Authenticate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(AuthenticateRequest)
+func _AdminService_CreateGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateGroupRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(NodeServiceServer).Authenticate(ctx, in)
+		return srv.(AdminServiceServer).CreateGroup(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: NodeService_Authenticate_FullMethodName,
+		FullMethod: AdminService_CreateGroup_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(NodeServiceServer).Authenticate(ctx, req.(*AuthenticateRequest))
+		return srv.(AdminServiceServer).CreateGroup(ctx, req.(*CreateGroupRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-func _NodeService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(HeartbeatRequest)
+func _AdminService_GetGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetGroupRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
 	if interceptor == nil {
-		return srv.(NodeServiceServer).Heartbeat(ctx, in)
+		return srv.(AdminServiceServer).GetGroup(ctx, in)
 	}
 	info := &grpc.UnaryServerInfo{
 		Server:     srv,
-		FullMethod: NodeService_Heartbeat_FullMethodName,
+		FullMethod: AdminService_GetGroup_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(NodeServiceServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+		return srv.(AdminServiceServer).GetGroup(ctx, req.(*GetGroupRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
 
-var NodeService_ServiceDesc = grpc.ServiceDesc{
-	ServiceName: "hue.NodeService",
+func _AdminService_ListGroups_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListGroups(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListGroups_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListGroups(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_UpdateGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateGroupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).UpdateGroup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_UpdateGroup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).UpdateGroup(ctx, req.(*UpdateGroupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_DeleteGroup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteGroupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).DeleteGroup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_DeleteGroup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).DeleteGroup(ctx, req.(*DeleteGroupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_ListUserDevices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUserDevicesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListUserDevices(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListUserDevices_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListUserDevices(ctx, req.(*ListUserDevicesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_ApproveDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeviceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ApproveDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ApproveDevice_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ApproveDevice(ctx, req.(*DeviceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_RemoveDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeviceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).RemoveDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_RemoveDevice_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).RemoveDevice(ctx, req.(*DeviceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_CreateManager_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateManagerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).CreateManager(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_CreateManager_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).CreateManager(ctx, req.(*CreateManagerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetManager_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetManagerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetManager(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetManager_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetManager(ctx, req.(*GetManagerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_ListManagers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListManagersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListManagers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListManagers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListManagers(ctx, req.(*ListManagersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_UpdateManager_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateManagerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).UpdateManager(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_UpdateManager_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).UpdateManager(ctx, req.(*UpdateManagerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_DeleteManager_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteManagerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).DeleteManager(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_DeleteManager_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).DeleteManager(ctx, req.(*DeleteManagerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_ListAuthKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListAuthKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListAuthKeys_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListAuthKeys(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_RotateOwnerKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IssueAuthKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).RotateOwnerKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_RotateOwnerKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).RotateOwnerKey(ctx, req.(*IssueAuthKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_CreateServiceKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IssueAuthKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).CreateServiceKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_CreateServiceKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).CreateServiceKey(ctx, req.(*IssueAuthKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_RotateServiceKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IssueAuthKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).RotateServiceKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_RotateServiceKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).RotateServiceKey(ctx, req.(*IssueAuthKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_RevokeServiceKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeServiceKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).RevokeServiceKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_RevokeServiceKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).RevokeServiceKey(ctx, req.(*RevokeServiceKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetEvents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetEventsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetEvents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetEvents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetEvents(ctx, req.(*GetEventsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AdminService_ServiceDesc is the grpc.ServiceDesc for AdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hue.AdminService",
+	HandlerType: (*AdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateUser",
+			Handler:    _AdminService_CreateUser_Handler,
+		},
+		{
+			MethodName: "GetUser",
+			Handler:    _AdminService_GetUser_Handler,
+		},
+		{
+			MethodName: "ListUsers",
+			Handler:    _AdminService_ListUsers_Handler,
+		},
+		{
+			MethodName: "UpdateUser",
+			Handler:    _AdminService_UpdateUser_Handler,
+		},
+		{
+			MethodName: "DeleteUser",
+			Handler:    _AdminService_DeleteUser_Handler,
+		},
+		{
+			MethodName: "DisconnectUser",
+			Handler:    _AdminService_DisconnectUser_Handler,
+		},
+		{
+			MethodName: "CreatePackage",
+			Handler:    _AdminService_CreatePackage_Handler,
+		},
+		{
+			MethodName: "GetPackage",
+			Handler:    _AdminService_GetPackage_Handler,
+		},
+		{
+			MethodName: "GetPackageByUser",
+			Handler:    _AdminService_GetPackageByUser_Handler,
+		},
+		{
+			MethodName: "ListUserPackages",
+			Handler:    _AdminService_ListUserPackages_Handler,
+		},
+		{
+			MethodName: "DeletePackage",
+			Handler:    _AdminService_DeletePackage_Handler,
+		},
+		{
+			MethodName: "CreateNode",
+			Handler:    _AdminService_CreateNode_Handler,
+		},
+		{
+			MethodName: "GetNode",
+			Handler:    _AdminService_GetNode_Handler,
+		},
+		{
+			MethodName: "ListNodes",
+			Handler:    _AdminService_ListNodes_Handler,
+		},
+		{
+			MethodName: "DeleteNode",
+			Handler:    _AdminService_DeleteNode_Handler,
+		},
+		{
+			MethodName: "CreateService",
+			Handler:    _AdminService_CreateService_Handler,
+		},
+		{
+			MethodName: "GetService",
+			Handler:    _AdminService_GetService_Handler,
+		},
+		{
+			MethodName: "ListServices",
+			Handler:    _AdminService_ListServices_Handler,
+		},
+		{
+			MethodName: "UpdateService",
+			Handler:    _AdminService_UpdateService_Handler,
+		},
+		{
+			MethodName: "DeleteService",
+			Handler:    _AdminService_DeleteService_Handler,
+		},
+		{
+			MethodName: "CreateGroup",
+			Handler:    _AdminService_CreateGroup_Handler,
+		},
+		{
+			MethodName: "GetGroup",
+			Handler:    _AdminService_GetGroup_Handler,
+		},
+		{
+			MethodName: "ListGroups",
+			Handler:    _AdminService_ListGroups_Handler,
+		},
+		{
+			MethodName: "UpdateGroup",
+			Handler:    _AdminService_UpdateGroup_Handler,
+		},
+		{
+			MethodName: "DeleteGroup",
+			Handler:    _AdminService_DeleteGroup_Handler,
+		},
+		{
+			MethodName: "ListUserDevices",
+			Handler:    _AdminService_ListUserDevices_Handler,
+		},
+		{
+			MethodName: "ApproveDevice",
+			Handler:    _AdminService_ApproveDevice_Handler,
+		},
+		{
+			MethodName: "RemoveDevice",
+			Handler:    _AdminService_RemoveDevice_Handler,
+		},
+		{
+			MethodName: "CreateManager",
+			Handler:    _AdminService_CreateManager_Handler,
+		},
+		{
+			MethodName: "GetManager",
+			Handler:    _AdminService_GetManager_Handler,
+		},
+		{
+			MethodName: "ListManagers",
+			Handler:    _AdminService_ListManagers_Handler,
+		},
+		{
+			MethodName: "UpdateManager",
+			Handler:    _AdminService_UpdateManager_Handler,
+		},
+		{
+			MethodName: "DeleteManager",
+			Handler:    _AdminService_DeleteManager_Handler,
+		},
+		{
+			MethodName: "ListAuthKeys",
+			Handler:    _AdminService_ListAuthKeys_Handler,
+		},
+		{
+			MethodName: "RotateOwnerKey",
+			Handler:    _AdminService_RotateOwnerKey_Handler,
+		},
+		{
+			MethodName: "CreateServiceKey",
+			Handler:    _AdminService_CreateServiceKey_Handler,
+		},
+		{
+			MethodName: "RotateServiceKey",
+			Handler:    _AdminService_RotateServiceKey_Handler,
+		},
+		{
+			MethodName: "RevokeServiceKey",
+			Handler:    _AdminService_RevokeServiceKey_Handler,
+		},
+		{
+			MethodName: "GetEvents",
+			Handler:    _AdminService_GetEvents_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/proto/hue.proto",
+}
+
+const (
+	NodeService_Authenticate_FullMethodName         = "/hue.NodeService/Authenticate"
+	NodeService_Heartbeat_FullMethodName            = "/hue.NodeService/Heartbeat"
+	NodeService_GetDisconnectReasons_FullMethodName = "/hue.NodeService/GetDisconnectReasons"
+	NodeService_SyncNode_FullMethodName             = "/hue.NodeService/SyncNode"
+	NodeService_GetUsersForNode_FullMethodName      = "/hue.NodeService/GetUsersForNode"
+	NodeService_VerifyUserPassword_FullMethodName   = "/hue.NodeService/VerifyUserPassword"
+	NodeService_AuthorizeConnection_FullMethodName  = "/hue.NodeService/AuthorizeConnection"
+)
+
+// NodeServiceClient is the client API for NodeService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type NodeServiceClient interface {
+	Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error)
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error)
+	GetDisconnectReasons(ctx context.Context, in *GetDisconnectReasonsRequest, opts ...grpc.CallOption) (*GetDisconnectReasonsResponse, error)
+	SyncNode(ctx context.Context, in *SyncNodeRequest, opts ...grpc.CallOption) (*SyncNodeResponse, error)
+	GetUsersForNode(ctx context.Context, in *GetUsersForNodeRequest, opts ...grpc.CallOption) (*SyncNodeResponse, error)
+	VerifyUserPassword(ctx context.Context, in *VerifyUserPasswordRequest, opts ...grpc.CallOption) (*VerifyUserPasswordResponse, error)
+	AuthorizeConnection(ctx context.Context, in *AuthorizeConnectionRequest, opts ...grpc.CallOption) (*AuthorizeConnectionResponse, error)
+}
+
+type nodeServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewNodeServiceClient(cc grpc.ClientConnInterface) NodeServiceClient {
+	return &nodeServiceClient{cc}
+}
+
+func (c *nodeServiceClient) Authenticate(ctx context.Context, in *AuthenticateRequest, opts ...grpc.CallOption) (*AuthenticateResponse, error) {
+	out := new(AuthenticateResponse)
+	err := c.cc.Invoke(ctx, NodeService_Authenticate_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
+	out := new(HeartbeatResponse)
+	err := c.cc.Invoke(ctx, NodeService_Heartbeat_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) GetDisconnectReasons(ctx context.Context, in *GetDisconnectReasonsRequest, opts ...grpc.CallOption) (*GetDisconnectReasonsResponse, error) {
+	out := new(GetDisconnectReasonsResponse)
+	err := c.cc.Invoke(ctx, NodeService_GetDisconnectReasons_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) SyncNode(ctx context.Context, in *SyncNodeRequest, opts ...grpc.CallOption) (*SyncNodeResponse, error) {
+	out := new(SyncNodeResponse)
+	err := c.cc.Invoke(ctx, NodeService_SyncNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) GetUsersForNode(ctx context.Context, in *GetUsersForNodeRequest, opts ...grpc.CallOption) (*SyncNodeResponse, error) {
+	out := new(SyncNodeResponse)
+	err := c.cc.Invoke(ctx, NodeService_GetUsersForNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) VerifyUserPassword(ctx context.Context, in *VerifyUserPasswordRequest, opts ...grpc.CallOption) (*VerifyUserPasswordResponse, error) {
+	out := new(VerifyUserPasswordResponse)
+	err := c.cc.Invoke(ctx, NodeService_VerifyUserPassword_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeServiceClient) AuthorizeConnection(ctx context.Context, in *AuthorizeConnectionRequest, opts ...grpc.CallOption) (*AuthorizeConnectionResponse, error) {
+	out := new(AuthorizeConnectionResponse)
+	err := c.cc.Invoke(ctx, NodeService_AuthorizeConnection_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// NodeServiceServer is the server API for NodeService service.
+// All implementations must embed UnimplementedNodeServiceServer
+// for forward compatibility
+type NodeServiceServer interface {
+	Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error)
+	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
+	GetDisconnectReasons(context.Context, *GetDisconnectReasonsRequest) (*GetDisconnectReasonsResponse, error)
+	SyncNode(context.Context, *SyncNodeRequest) (*SyncNodeResponse, error)
+	GetUsersForNode(context.Context, *GetUsersForNodeRequest) (*SyncNodeResponse, error)
+	VerifyUserPassword(context.Context, *VerifyUserPasswordRequest) (*VerifyUserPasswordResponse, error)
+	AuthorizeConnection(context.Context, *AuthorizeConnectionRequest) (*AuthorizeConnectionResponse, error)
+	mustEmbedUnimplementedNodeServiceServer()
+}
+
+// UnimplementedNodeServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedNodeServiceServer struct {
+}
+
+func (UnimplementedNodeServiceServer) Authenticate(context.Context, *AuthenticateRequest) (*AuthenticateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Authenticate not implemented")
+}
+func (UnimplementedNodeServiceServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedNodeServiceServer) GetDisconnectReasons(context.Context, *GetDisconnectReasonsRequest) (*GetDisconnectReasonsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDisconnectReasons not implemented")
+}
+func (UnimplementedNodeServiceServer) SyncNode(context.Context, *SyncNodeRequest) (*SyncNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SyncNode not implemented")
+}
+func (UnimplementedNodeServiceServer) GetUsersForNode(context.Context, *GetUsersForNodeRequest) (*SyncNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsersForNode not implemented")
+}
+func (UnimplementedNodeServiceServer) VerifyUserPassword(context.Context, *VerifyUserPasswordRequest) (*VerifyUserPasswordResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyUserPassword not implemented")
+}
+func (UnimplementedNodeServiceServer) AuthorizeConnection(context.Context, *AuthorizeConnectionRequest) (*AuthorizeConnectionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AuthorizeConnection not implemented")
+}
+func (UnimplementedNodeServiceServer) mustEmbedUnimplementedNodeServiceServer() {}
+
+// UnsafeNodeServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to NodeServiceServer will
+// result in compilation errors.
+type UnsafeNodeServiceServer interface {
+	mustEmbedUnimplementedNodeServiceServer()
+}
+
+func RegisterNodeServiceServer(s grpc.ServiceRegistrar, srv NodeServiceServer) {
+	s.RegisterService(&NodeService_ServiceDesc, srv)
+}
+
+func _NodeService_Authenticate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthenticateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).Authenticate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_Authenticate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).Authenticate(ctx, req.(*AuthenticateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_GetDisconnectReasons_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDisconnectReasonsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).GetDisconnectReasons(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_GetDisconnectReasons_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).GetDisconnectReasons(ctx, req.(*GetDisconnectReasonsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_SyncNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).SyncNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_SyncNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).SyncNode(ctx, req.(*SyncNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_GetUsersForNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUsersForNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).GetUsersForNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_GetUsersForNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).GetUsersForNode(ctx, req.(*GetUsersForNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_VerifyUserPassword_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyUserPasswordRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).VerifyUserPassword(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_VerifyUserPassword_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).VerifyUserPassword(ctx, req.(*VerifyUserPasswordRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _NodeService_AuthorizeConnection_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthorizeConnectionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServiceServer).AuthorizeConnection(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: NodeService_AuthorizeConnection_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServiceServer).AuthorizeConnection(ctx, req.(*AuthorizeConnectionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// NodeService_ServiceDesc is the grpc.ServiceDesc for NodeService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var NodeService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "hue.NodeService",
 	HandlerType: (*NodeServiceServer)(nil),
 	Methods: []grpc.MethodDesc{
 		{
@@ -893,6 +2228,26 @@ var NodeService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Heartbeat",
 			Handler:    _NodeService_Heartbeat_Handler,
 		},
+		{
+			MethodName: "GetDisconnectReasons",
+			Handler:    _NodeService_GetDisconnectReasons_Handler,
+		},
+		{
+			MethodName: "SyncNode",
+			Handler:    _NodeService_SyncNode_Handler,
+		},
+		{
+			MethodName: "GetUsersForNode",
+			Handler:    _NodeService_GetUsersForNode_Handler,
+		},
+		{
+			MethodName: "VerifyUserPassword",
+			Handler:    _NodeService_VerifyUserPassword_Handler,
+		},
+		{
+			MethodName: "AuthorizeConnection",
+			Handler:    _NodeService_AuthorizeConnection_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/proto/hue.proto",
@@ -2,6 +2,8 @@ package proto
 
 import (
 	"testing"
+
+	"google.golang.org/protobuf/proto"
 )
 
 func TestProtoUsageReportFieldsAndGetters(t *testing.T) {
@@ -52,3 +54,45 @@ func TestProtoBasicMessages(t *testing.T) {
 		t.Fatalf("unexpected error response getters output")
 	}
 }
+
+func TestProtoWireRoundTrip(t *testing.T) {
+	data, err := proto.Marshal(&ReportUsageRequest{Report: &UsageReport{
+		UserId:      "user-1",
+		Upload:      10,
+		Tags:        []string{"edge"},
+		CounterMode: "absolute",
+	}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var req ReportUsageRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	report := req.GetReport()
+	if report.GetUserId() != "user-1" || report.GetUpload() != 10 || len(report.GetTags()) != 1 || report.GetCounterMode() != "absolute" {
+		t.Fatalf("unexpected round trip result: %+v", report)
+	}
+	if d := File_pkg_proto_hue_proto.Messages().ByName("UsageReport"); d == nil || d.Fields().ByName("counter_mode") == nil {
+		t.Fatalf("expected the file descriptor to describe UsageReport.counter_mode")
+	}
+}
+
+func TestNegotiateAPIVersion(t *testing.T) {
+	cases := []struct {
+		client int32
+		want   int32
+		ok     bool
+	}{
+		{0, 1, true},
+		{APIVersion, APIVersion, true},
+		{APIVersion + 1, APIVersion, true},
+	}
+	for _, tc := range cases {
+		got, ok := NegotiateAPIVersion(tc.client)
+		if got != tc.want || ok != tc.ok {
+			t.Fatalf("NegotiateAPIVersion(%d) = %d, %v; want %d, %v", tc.client, got, ok, tc.want, tc.ok)
+		}
+	}
+}
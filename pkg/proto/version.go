@@ -0,0 +1,25 @@
+package proto
+
+// APIVersion is the wire API version served by this build. Additive changes
+// to hue.proto keep it; a breaking change bumps it and the previous version
+// keeps being served until MinAPIVersion moves past it.
+const APIVersion int32 = 1
+
+// MinAPIVersion is the oldest agent API version still served
+const MinAPIVersion int32 = 1
+
+// NegotiateAPIVersion picks the version to use with an agent that speaks
+// client. Agents that predate versioning send 0 and get version 1. It
+// returns false when the agent is older than MinAPIVersion.
+func NegotiateAPIVersion(client int32) (int32, bool) {
+	if client <= 0 {
+		client = 1
+	}
+	if client < MinAPIVersion {
+		return 0, false
+	}
+	if client > APIVersion {
+		return APIVersion, true
+	}
+	return client, true
+}